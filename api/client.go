@@ -17,12 +17,16 @@ import (
 	"bufio"
 	"bytes"
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"net/url"
+	"os"
 	"runtime"
 
 	"github.com/ollama/ollama/envconfig"
@@ -61,10 +65,69 @@ func checkError(resp *http.Response, body []byte) error {
 //	<scheme>://<host>:<port>
 //
 // If the variable is not specified, a default ollama host and port will be
-// used.
+// used. A unix:///path/to/socket host connects over a unix socket. For https
+// hosts the CA certificate in OLLAMA_TLS_CA is trusted in addition to the
+// system's and the client certificate in OLLAMA_TLS_CLIENT_CERT and
+// OLLAMA_TLS_CLIENT_KEY is presented, if set. The API key in OLLAMA_API_KEY,
+// if set, is sent with every request.
 func ClientFromEnvironment() (*Client, error) {
+	base := envconfig.Host()
+	switch {
+	case base.Scheme == "unix":
+		socket := base.Path
+		return &Client{
+			base: &url.URL{Scheme: "http", Host: "localhost"},
+			http: &http.Client{
+				Transport: &http.Transport{
+					DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+						var d net.Dialer
+						return d.DialContext(ctx, "unix", socket)
+					},
+				},
+			},
+		}, nil
+	case base.Scheme == "https" && (envconfig.TLSCA() != "" || envconfig.TLSClientCert() != ""):
+		var cfg tls.Config
+		if path := envconfig.TLSCA(); path != "" {
+			pool, err := x509.SystemCertPool()
+			if err != nil {
+				pool = x509.NewCertPool()
+			}
+
+			ca, err := os.ReadFile(path)
+			if err != nil {
+				return nil, err
+			}
+
+			if !pool.AppendCertsFromPEM(ca) {
+				return nil, fmt.Errorf("no certificates found in %s", path)
+			}
+
+			cfg.RootCAs = pool
+		}
+
+		if path := envconfig.TLSClientCert(); path != "" {
+			cert, err := tls.LoadX509KeyPair(path, envconfig.TLSClientKey())
+			if err != nil {
+				return nil, err
+			}
+
+			cfg.Certificates = []tls.Certificate{cert}
+		}
+
+		return &Client{
+			base: base,
+			http: &http.Client{
+				Transport: &http.Transport{
+					Proxy:           http.ProxyFromEnvironment,
+					TLSClientConfig: &cfg,
+				},
+			},
+		}, nil
+	}
+
 	return &Client{
-		base: envconfig.Host(),
+		base: base,
 		http: http.DefaultClient,
 	}, nil
 }
@@ -105,6 +168,9 @@ func (c *Client) do(ctx context.Context, method, path string, reqData, respData
 	request.Header.Set("Content-Type", "application/json")
 	request.Header.Set("Accept", "application/json")
 	request.Header.Set("User-Agent", fmt.Sprintf("ollama/%s (%s %s) Go/%s", version.Version, runtime.GOARCH, runtime.GOOS, runtime.Version()))
+	if key := envconfig.APIKey(); key != "" {
+		request.Header.Set("Authorization", "Bearer "+key)
+	}
 
 	respObj, err := c.http.Do(request)
 	if err != nil {
@@ -151,6 +217,9 @@ func (c *Client) stream(ctx context.Context, method, path string, data any, fn f
 	request.Header.Set("Content-Type", "application/json")
 	request.Header.Set("Accept", "application/x-ndjson")
 	request.Header.Set("User-Agent", fmt.Sprintf("ollama/%s (%s %s) Go/%s", version.Version, runtime.GOARCH, runtime.GOOS, runtime.Version()))
+	if key := envconfig.APIKey(); key != "" {
+		request.Header.Set("Authorization", "Bearer "+key)
+	}
 
 	response, err := c.http.Do(request)
 	if err != nil {
@@ -307,6 +376,119 @@ func (c *Client) ListRunning(ctx context.Context) (*ProcessResponse, error) {
 	return &lr, nil
 }
 
+// ListSessions lists the chat sessions kept by the server.
+func (c *Client) ListSessions(ctx context.Context) (*ListSessionsResponse, error) {
+	var lr ListSessionsResponse
+	if err := c.do(ctx, http.MethodGet, "/api/sessions", nil, &lr); err != nil {
+		return nil, err
+	}
+	return &lr, nil
+}
+
+// DeleteSession deletes a chat session and the KV cache kept for it.
+func (c *Client) DeleteSession(ctx context.Context, req *DeleteSessionRequest) error {
+	return c.do(ctx, http.MethodDelete, "/api/sessions", req, nil)
+}
+
+// Affinity returns the affinity token of the KV cache a request would use,
+// and whether the server holds it.
+func (c *Client) Affinity(ctx context.Context, req *AffinityRequest) (*AffinityResponse, error) {
+	var resp AffinityResponse
+	if err := c.do(ctx, http.MethodPost, "/api/affinity", req, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// ListAdapters lists the LoRA adapters loaded for running models.
+func (c *Client) ListAdapters(ctx context.Context) (*ListAdaptersResponse, error) {
+	var lr ListAdaptersResponse
+	if err := c.do(ctx, http.MethodGet, "/api/adapters", nil, &lr); err != nil {
+		return nil, err
+	}
+	return &lr, nil
+}
+
+// LoadAdapter loads a model and the LoRA adapter of another model created
+// from it, so requests with the adapter option don't wait for it to load.
+func (c *Client) LoadAdapter(ctx context.Context, req *AdapterRequest) error {
+	return c.do(ctx, http.MethodPost, "/api/adapters", req, nil)
+}
+
+// UnloadAdapter unloads the LoRA adapter of a running model.
+func (c *Client) UnloadAdapter(ctx context.Context, req *AdapterRequest) error {
+	return c.do(ctx, http.MethodDelete, "/api/adapters", req, nil)
+}
+
+// Schedule returns the server's time-based policies.
+func (c *Client) Schedule(ctx context.Context) (*ScheduleResponse, error) {
+	var resp ScheduleResponse
+	if err := c.do(ctx, http.MethodGet, "/api/schedule", nil, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// SetSchedule replaces the server's time-based policies.
+func (c *Client) SetSchedule(ctx context.Context, req *ScheduleRequest) (*ScheduleResponse, error) {
+	var resp ScheduleResponse
+	if err := c.do(ctx, http.MethodPost, "/api/schedule", req, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// SwitchGroup loads the models of a group defined in the server's schedule
+// and unloads all others.
+func (c *Client) SwitchGroup(ctx context.Context, req *SwitchGroupRequest) (*ScheduleResponse, error) {
+	var resp ScheduleResponse
+	if err := c.do(ctx, http.MethodPost, "/api/schedule/switch", req, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// CORS returns the server's cross-origin policies.
+func (c *Client) CORS(ctx context.Context) (*CORSResponse, error) {
+	var resp CORSResponse
+	if err := c.do(ctx, http.MethodGet, "/api/cors", nil, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// SetCORS replaces the server's cross-origin policies.
+func (c *Client) SetCORS(ctx context.Context, req *CORSRequest) (*CORSResponse, error) {
+	var resp CORSResponse
+	if err := c.do(ctx, http.MethodPost, "/api/cors", req, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// Log returns the server's log levels.
+func (c *Client) Log(ctx context.Context) (*LogResponse, error) {
+	var resp LogResponse
+	if err := c.do(ctx, http.MethodGet, "/api/log", nil, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// SetLog changes the server's log levels.
+func (c *Client) SetLog(ctx context.Context, req *LogRequest) (*LogResponse, error) {
+	var resp LogResponse
+	if err := c.do(ctx, http.MethodPost, "/api/log", req, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// Reload reads the server's tenants, policies and upstreams again.
+func (c *Client) Reload(ctx context.Context) error {
+	return c.do(ctx, http.MethodPost, "/api/reload", nil, nil)
+}
+
 // Copy copies a model - creating a model with another name from an existing
 // model.
 func (c *Client) Copy(ctx context.Context, req *CopyRequest) error {
@@ -316,6 +498,15 @@ func (c *Client) Copy(ctx context.Context, req *CopyRequest) error {
 	return nil
 }
 
+// Label sets labels on a model and returns the resulting labels.
+func (c *Client) Label(ctx context.Context, req *LabelRequest) (*LabelResponse, error) {
+	var resp LabelResponse
+	if err := c.do(ctx, http.MethodPost, "/api/labels", req, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
 // Delete deletes a model and its data.
 func (c *Client) Delete(ctx context.Context, req *DeleteRequest) error {
 	if err := c.do(ctx, http.MethodDelete, "/api/delete", req, nil); err != nil {
@@ -351,6 +542,15 @@ func (c *Client) Embed(ctx context.Context, req *EmbedRequest) (*EmbedResponse,
 	return &resp, nil
 }
 
+// Reward scores candidate responses to a prompt with a reward model.
+func (c *Client) Reward(ctx context.Context, req *RewardRequest) (*RewardResponse, error) {
+	var resp RewardResponse
+	if err := c.do(ctx, http.MethodPost, "/api/reward", req, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
 // Embeddings generates an embedding from a model.
 func (c *Client) Embeddings(ctx context.Context, req *EmbeddingRequest) (*EmbeddingResponse, error) {
 	var resp EmbeddingResponse
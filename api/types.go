@@ -47,6 +47,15 @@ type GenerateRequest struct {
 	// Prompt is the textual prompt to send to the model.
 	Prompt string `json:"prompt"`
 
+	// Prompts is a batch of prompts generated together, sent as an array
+	// in place of Prompt. Each response has the Index of its prompt.
+	Prompts []string `json:"-"`
+
+	// InputTokens is a prompt of token ids sent to the model as is, instead
+	// of Prompt. It isn't templated or tokenized, so it must have every
+	// special token the model expects, such as its BOS token.
+	InputTokens []int `json:"input_tokens,omitempty"`
+
 	// Suffix is the text that comes after the inserted text.
 	Suffix string `json:"suffix"`
 
@@ -77,11 +86,109 @@ type GenerateRequest struct {
 	// request, for multimodal models.
 	Images []ImageData `json:"images,omitempty"`
 
+	// Return requests a raw debug output for the prompt instead of generated
+	// text. It may be "logits" for the final-layer logits of the last prompt
+	// token, or "hidden_states" for the pooled hidden states. It is only
+	// accepted from local clients.
+	Return string `json:"return,omitempty"`
+
+	// Head selects one of the model's alternative output heads, such as a
+	// classification or reward head, to score the prompt with instead of
+	// generating text.
+	Head string `json:"head,omitempty"`
+
+	// Reranker is a reward model used to choose between the candidates
+	// generated with the best_of option. By default the candidate with the
+	// highest log probability is chosen.
+	Reranker string `json:"reranker,omitempty"`
+
+	// ReturnCandidates returns every candidate generated with the best_of
+	// option along with the chosen one.
+	ReturnCandidates bool `json:"return_candidates,omitempty"`
+
+	// Metadata holds the client's own identifiers, such as tenant or
+	// session ids, which are echoed in the final response and added to the
+	// server's logs so its records can be correlated with the client's.
+	Metadata map[string]string `json:"metadata,omitempty"`
+
+	// Cache set to false keeps the prompt, its images and the response out
+	// of the model's prompt cache once the request is done. What comes
+	// before them, such as the system prompt, is still cached.
+	Cache *bool `json:"cache,omitempty"`
+
+	// TraceSampling is a debug option that records for each generated token
+	// how this many of the candidates with the highest logits fared in
+	// sampling, returned in the final response.
+	TraceSampling int `json:"trace_sampling,omitempty"`
+
+	// Logprobs returns the log probability of each generated token with the
+	// chunk of the response it's in, along with those of the TopLogprobs
+	// most likely tokens in its place, up to 20.
+	Logprobs    bool `json:"logprobs,omitempty"`
+	TopLogprobs int  `json:"top_logprobs,omitempty"`
+
+	// ReturnTokens returns the token ids generated for each chunk of the
+	// response along with their byte offsets.
+	ReturnTokens bool `json:"return_tokens,omitempty"`
+
+	// PositionOffset is the position of the first token of the prompt, to
+	// continue a conversation whose earlier tokens have been dropped from
+	// the prompt at the positions they'd have had.
+	PositionOffset int `json:"position_offset,omitempty"`
+
+	// Compressor is a small model used to compress the prompt before it's
+	// generated from, by dropping the tokens it finds most predictable.
+	// CompressionRate is the fraction of the tokens that are kept, half
+	// of them by default.
+	Compressor      string  `json:"compressor,omitempty"`
+	CompressionRate float64 `json:"compression_rate,omitempty"`
+
 	// Options lists model-specific options. For example, temperature can be
 	// set through this field, if the model supports it.
 	Options map[string]interface{} `json:"options"`
 }
 
+func (r *GenerateRequest) UnmarshalJSON(b []byte) error {
+	type Alias GenerateRequest
+	a := struct {
+		*Alias
+		Prompt json.RawMessage `json:"prompt"`
+	}{Alias: (*Alias)(r)}
+	if err := json.Unmarshal(b, &a); err != nil {
+		return err
+	}
+
+	switch {
+	case len(a.Prompt) == 0 || string(a.Prompt) == "null":
+	case a.Prompt[0] == '[':
+		if err := json.Unmarshal(a.Prompt, &r.Prompts); err != nil {
+			return err
+		}
+
+		if r.Prompts == nil {
+			r.Prompts = []string{}
+		}
+	default:
+		if err := json.Unmarshal(a.Prompt, &r.Prompt); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (r GenerateRequest) MarshalJSON() ([]byte, error) {
+	type Alias GenerateRequest
+	if r.Prompts == nil {
+		return json.Marshal(Alias(r))
+	}
+
+	return json.Marshal(struct {
+		Alias
+		Prompt []string `json:"prompt"`
+	}{Alias(r), r.Prompts})
+}
+
 // ChatRequest describes a request sent by [Client.Chat].
 type ChatRequest struct {
 	// Model is the model name, as in [GenerateRequest].
@@ -103,6 +210,38 @@ type ChatRequest struct {
 	// Tools is an optional list of tools the model has access to.
 	Tools `json:"tools,omitempty"`
 
+	// Template overrides the model's default prompt template for this request.
+	Template string `json:"template,omitempty"`
+
+	// Metadata is echoed in the final response, as in [GenerateRequest].
+	Metadata map[string]string `json:"metadata,omitempty"`
+
+	// MigrateFrom is experimental. It names the model that generated the
+	// last message, a partial assistant response that Model continues, for
+	// example to switch to a larger quantization of the same model for a
+	// hard question. Both models must have the same vocabulary. With a fixed
+	// seed, sampling continues from where it stopped on the other model.
+	MigrateFrom string `json:"migrate_from,omitempty"`
+
+	// SessionID continues a conversation the server keeps, creating it if
+	// there isn't one. Messages are added to those of the session, so only
+	// the new messages of each turn are sent, and the KV cache of the
+	// conversation is kept between requests rather than processed again.
+	SessionID string `json:"session_id,omitempty"`
+
+	// TraceSampling is a debug option, as in [GenerateRequest].
+	TraceSampling int `json:"trace_sampling,omitempty"`
+
+	// Logprobs and TopLogprobs return log probabilities of the generated
+	// tokens, as in [GenerateRequest].
+	Logprobs    bool `json:"logprobs,omitempty"`
+	TopLogprobs int  `json:"top_logprobs,omitempty"`
+
+	// Compressor compresses the content of messages marked with Compress,
+	// as in [GenerateRequest].
+	Compressor      string  `json:"compressor,omitempty"`
+	CompressionRate float64 `json:"compression_rate,omitempty"`
+
 	// Options lists model-specific options.
 	Options map[string]interface{} `json:"options"`
 }
@@ -127,6 +266,19 @@ type Message struct {
 	Content   string      `json:"content"`
 	Images    []ImageData `json:"images,omitempty"`
 	ToolCalls []ToolCall  `json:"tool_calls,omitempty"`
+
+	// Thinking is the reasoning of the model, moved out of its content by
+	// the think processor.
+	Thinking string `json:"thinking,omitempty"`
+
+	// Cache set to false keeps the message, and everything after it, out of
+	// the model's prompt cache once the request is done. Messages before it
+	// are cached so later requests that start with them can reuse them.
+	Cache *bool `json:"cache,omitempty"`
+
+	// Compress marks the content of the message, such as retrieved
+	// documents, to be compressed with the request's Compressor.
+	Compress bool `json:"compress,omitempty"`
 }
 
 func (m *Message) UnmarshalJSON(b []byte) error {
@@ -192,6 +344,25 @@ type ChatResponse struct {
 
 	Done bool `json:"done"`
 
+	// Metadata is the metadata of the request, set in the final response.
+	Metadata map[string]string `json:"metadata,omitempty"`
+
+	// SamplingTrace is set in the final response when the request asked for
+	// it with TraceSampling.
+	SamplingTrace []SampledToken `json:"sampling_trace,omitempty"`
+
+	// Logprobs are the log probabilities of the tokens of the chunk, set
+	// when the request asked for them with Logprobs.
+	Logprobs []Logprob `json:"logprobs,omitempty"`
+
+	// Compression reports how messages were compressed, set in the final
+	// response when the request has a Compressor.
+	Compression *CompressionStats `json:"compression,omitempty"`
+
+	// Code are the fenced code blocks of the message, set in the final
+	// response by the code processor.
+	Code []CodeBlock `json:"code,omitempty"`
+
 	Metrics
 }
 
@@ -200,8 +371,14 @@ type Metrics struct {
 	LoadDuration       time.Duration `json:"load_duration,omitempty"`
 	PromptEvalCount    int           `json:"prompt_eval_count,omitempty"`
 	PromptEvalDuration time.Duration `json:"prompt_eval_duration,omitempty"`
+	PromptCachedCount  int           `json:"prompt_cached_count,omitempty"`
 	EvalCount          int           `json:"eval_count,omitempty"`
 	EvalDuration       time.Duration `json:"eval_duration,omitempty"`
+	EnergyJoules       float64       `json:"energy_joules,omitempty"`
+
+	// ContextLength is the context length the model was loaded with when
+	// it was reduced from the requested num_ctx to fit in memory
+	ContextLength int `json:"context_length,omitempty"`
 }
 
 // Options specified in [GenerateRequest].  If you add a new option here, also
@@ -213,6 +390,7 @@ type Options struct {
 	NumKeep          int      `json:"num_keep,omitempty"`
 	Seed             int      `json:"seed,omitempty"`
 	NumPredict       int      `json:"num_predict,omitempty"`
+	MaxTimeMS        int      `json:"max_time_ms,omitempty"`
 	TopK             int      `json:"top_k,omitempty"`
 	TopP             float32  `json:"top_p,omitempty"`
 	MinP             float32  `json:"min_p,omitempty"`
@@ -227,6 +405,79 @@ type Options struct {
 	MirostatEta      float32  `json:"mirostat_eta,omitempty"`
 	PenalizeNewline  bool     `json:"penalize_newline,omitempty"`
 	Stop             []string `json:"stop,omitempty"`
+
+	// SessionSeed advances a fixed Seed deterministically for each assistant
+	// turn of a chat so multi-turn conversations are reproducible.
+	SessionSeed bool `json:"session_seed,omitempty"`
+
+	// BestOf generates this many candidates for each request and returns
+	// the best one.
+	BestOf int `json:"best_of,omitempty"`
+
+	// Processors post-process the response as it's generated, in order:
+	// "think" moves the reasoning of the model to its own field, "code"
+	// extracts fenced code blocks and "regex /pattern/replacement/"
+	// replaces text in each line.
+	Processors []string `json:"processor,omitempty"`
+
+	// Ban lists strings the model never generates, matched case
+	// insensitively however they're split into tokens, and BanTokens lists
+	// token ids it never samples.
+	Ban       []string `json:"ban,omitempty"`
+	BanTokens []int    `json:"ban_token,omitempty"`
+
+	// LogitBias is added to the logits of token ids before they're sampled,
+	// positive to make them more likely and negative to make them less, so
+	// -100 all but bans them.
+	LogitBias map[int]float32 `json:"logit_bias,omitempty"`
+
+	// DryMultiplier enables the DRY (don't repeat yourself) penalty, which
+	// penalizes a token that would extend a sequence repeated from earlier
+	// in the context by DryMultiplier * DryBase ^ (length - DryAllowedLength).
+	// DryPenaltyLastN is how many tokens are searched for repeats, -1 for
+	// the whole context, and repeats don't run across DrySequenceBreakers.
+	DryMultiplier       float32  `json:"dry_multiplier,omitempty"`
+	DryBase             float32  `json:"dry_base,omitempty"`
+	DryAllowedLength    int      `json:"dry_allowed_length,omitempty"`
+	DryPenaltyLastN     int      `json:"dry_penalty_last_n,omitempty"`
+	DrySequenceBreakers []string `json:"dry_sequence_breakers,omitempty"`
+
+	// XTCProbability is how often XTC (exclude top choices) removes all but
+	// the least likely of the tokens with a probability of at least
+	// XTCThreshold, steering the model away from its most predictable picks.
+	XTCProbability float32 `json:"xtc_probability,omitempty"`
+	XTCThreshold   float32 `json:"xtc_threshold,omitempty"`
+
+	// DynatempRange enables dynamic temperature, which samples with a
+	// temperature between Temperature - DynatempRange and Temperature +
+	// DynatempRange, higher the more uncertain the model is of the next
+	// token. DynatempExponent shapes how the uncertainty maps to the
+	// temperature.
+	DynatempRange    float32 `json:"dynatemp_range,omitempty"`
+	DynatempExponent float32 `json:"dynatemp_exponent,omitempty"`
+
+	// SamplerOrder is the order the samplers are applied in, after the
+	// penalties and logit biases, such as "top_k", "top_p", "min_p" and
+	// "temperature" to apply temperature last. Samplers left out aren't
+	// applied. The default order is "dry", "top_k", "typical_p", "top_p",
+	// "min_p", "xtc" and "temperature".
+	SamplerOrder []string `json:"sampler_order,omitempty"`
+
+	// ReasoningEffort limits how long a reasoning model thinks for before
+	// it answers: "none", "low", "medium" or "high". MaxThinkingTokens sets
+	// the limit in tokens instead.
+	ReasoningEffort   string `json:"reasoning_effort,omitempty"`
+	MaxThinkingTokens int    `json:"max_thinking_tokens,omitempty"`
+
+	// Grammar is a GBNF grammar the response is constrained to, for output
+	// such as DSLs or code that JSON formats can't describe. It can't be
+	// used with a format.
+	Grammar string `json:"grammar,omitempty"`
+
+	// Adapter names a model created with LoRA adapters from the same model
+	// as the one requested, whose adapters are applied for the request
+	// without loading the model again.
+	Adapter string `json:"adapter,omitempty"`
 }
 
 // Runner options which must be set when the model is loaded into memory
@@ -242,6 +493,33 @@ type Runner struct {
 	UseMMap   *bool `json:"use_mmap,omitempty"`
 	UseMLock  bool  `json:"use_mlock,omitempty"`
 	NumThread int   `json:"num_thread,omitempty"`
+
+	// CacheTypeK and CacheTypeV are the quantization types of the K and V
+	// caches, "f16", "q8_0" or "q4_0", in place of OLLAMA_KV_CACHE_TYPE.
+	CacheTypeK string `json:"cache_type_k,omitempty"`
+	CacheTypeV string `json:"cache_type_v,omitempty"`
+
+	// RopeScalingType is how RoPE positions are scaled to extend the
+	// context, "none", "linear", "yarn", or "ntk" for NTK-aware scaling of
+	// the base frequency. It's read from the model if unset, as are the
+	// other RoPE and YaRN options when they're 0.
+	RopeScalingType string `json:"rope_scaling_type,omitempty"`
+
+	// RopeFrequencyBase is the RoPE base frequency, and RopeFrequencyScale
+	// the factor positions are scaled by, the original context length over
+	// the extended one.
+	RopeFrequencyBase  float32 `json:"rope_frequency_base,omitempty"`
+	RopeFrequencyScale float32 `json:"rope_frequency_scale,omitempty"`
+
+	// YarnOrigCtx is the context length the model was trained with.
+	// YarnExtFactor mixes extrapolation into the interpolated dimensions,
+	// YarnAttnFactor scales the magnitude of attention, and YarnBetaFast and
+	// YarnBetaSlow bound the dimensions that are corrected.
+	YarnOrigCtx    int     `json:"yarn_orig_ctx,omitempty"`
+	YarnExtFactor  float32 `json:"yarn_ext_factor,omitempty"`
+	YarnAttnFactor float32 `json:"yarn_attn_factor,omitempty"`
+	YarnBetaFast   float32 `json:"yarn_beta_fast,omitempty"`
+	YarnBetaSlow   float32 `json:"yarn_beta_slow,omitempty"`
 }
 
 // EmbedRequest is the request passed to [Client.Embed].
@@ -252,16 +530,46 @@ type EmbedRequest struct {
 	// Input is the input to embed.
 	Input any `json:"input"`
 
+	// InputTokens are inputs of token ids to embed as is, instead of Input.
+	InputTokens TokenInputs `json:"input_tokens,omitempty"`
+
 	// KeepAlive controls how long the model will stay loaded in memory following
 	// this request.
 	KeepAlive *Duration `json:"keep_alive,omitempty"`
 
 	Truncate *bool `json:"truncate,omitempty"`
 
+	// Metadata is echoed in the response, as in [GenerateRequest].
+	Metadata map[string]string `json:"metadata,omitempty"`
+
 	// Options lists model-specific options.
 	Options map[string]interface{} `json:"options"`
 }
 
+// TokenInputs are inputs of token ids. A single array of token ids is one
+// input.
+type TokenInputs [][]int
+
+func (t *TokenInputs) UnmarshalJSON(b []byte) error {
+	if string(b) == "null" {
+		return nil
+	}
+
+	var tokens []int
+	if err := json.Unmarshal(b, &tokens); err == nil {
+		*t = TokenInputs{tokens}
+		return nil
+	}
+
+	var inputs [][]int
+	if err := json.Unmarshal(b, &inputs); err != nil {
+		return err
+	}
+
+	*t = inputs
+	return nil
+}
+
 // EmbedResponse is the response from [Client.Embed].
 type EmbedResponse struct {
 	Model      string      `json:"model"`
@@ -270,6 +578,46 @@ type EmbedResponse struct {
 	TotalDuration   time.Duration `json:"total_duration,omitempty"`
 	LoadDuration    time.Duration `json:"load_duration,omitempty"`
 	PromptEvalCount int           `json:"prompt_eval_count,omitempty"`
+
+	Metadata map[string]string `json:"metadata,omitempty"`
+}
+
+// RewardRequest is the request passed to [Client.Reward].
+type RewardRequest struct {
+	// Model is the reward model name.
+	Model string `json:"model"`
+
+	// Prompt is the prompt the responses answer.
+	Prompt string `json:"prompt"`
+
+	// Responses are the candidate responses to score.
+	Responses []string `json:"responses"`
+
+	// System overrides the model's system message.
+	System string `json:"system,omitempty"`
+
+	// Head is the name of the model's output head to score with. It defaults
+	// to "reward".
+	Head string `json:"head,omitempty"`
+
+	// KeepAlive controls how long the model will stay loaded in memory following
+	// this request.
+	KeepAlive *Duration `json:"keep_alive,omitempty"`
+
+	// Options lists model-specific options.
+	Options map[string]interface{} `json:"options"`
+}
+
+// RewardResponse is the response from [Client.Reward].
+type RewardResponse struct {
+	Model string `json:"model"`
+
+	// Scores are the rewards for each response, higher is better.
+	Scores []float32 `json:"scores"`
+
+	TotalDuration   time.Duration `json:"total_duration,omitempty"`
+	LoadDuration    time.Duration `json:"load_duration,omitempty"`
+	PromptEvalCount int           `json:"prompt_eval_count,omitempty"`
 }
 
 // EmbeddingRequest is the request passed to [Client.Embeddings].
@@ -300,6 +648,40 @@ type CreateRequest struct {
 	Stream    *bool  `json:"stream,omitempty"`
 	Quantize  string `json:"quantize,omitempty"`
 
+	// CheckPerplexity measures the perplexity of the model before and after
+	// quantizing it on a small built-in text, and records both.
+	CheckPerplexity bool `json:"check_perplexity,omitempty"`
+
+	// From is the name of an existing model to build from. It can be used
+	// instead of Modelfile.
+	From string `json:"from,omitempty"`
+
+	// Files maps file names to the digests of uploaded blobs holding the
+	// model weights. It can be used instead of From.
+	Files map[string]string `json:"files,omitempty"`
+
+	// Adapters maps file names to the digests of uploaded blobs holding
+	// LoRA adapters.
+	Adapters map[string]string `json:"adapters,omitempty"`
+
+	// Template is the prompt template for the model.
+	Template string `json:"template,omitempty"`
+
+	// License is the license, or list of licenses, for the model.
+	License any `json:"license,omitempty"`
+
+	// System is the system prompt for the model.
+	System string `json:"system,omitempty"`
+
+	// Parameters lists model parameters, as set with PARAMETER in a Modelfile.
+	Parameters map[string]any `json:"parameters,omitempty"`
+
+	// Messages is a list of messages to add to the model.
+	Messages []Message `json:"messages,omitempty"`
+
+	// Labels are arbitrary key/value pairs used to organize models.
+	Labels map[string]string `json:"labels,omitempty"`
+
 	// Deprecated: set the model name with Model instead
 	Name string `json:"name"`
 
@@ -314,6 +696,10 @@ type CreateRequest struct {
 type DeleteRequest struct {
 	Model string `json:"model"`
 
+	// Force deletes a model that's processing requests once they finish,
+	// rather than failing
+	Force bool `json:"force,omitempty"`
+
 	// Deprecated: set the model name with Model instead
 	Name string `json:"name"`
 }
@@ -335,16 +721,193 @@ type ShowRequest struct {
 
 // ShowResponse is the response returned from [Client.Show].
 type ShowResponse struct {
-	License       string         `json:"license,omitempty"`
-	Modelfile     string         `json:"modelfile,omitempty"`
-	Parameters    string         `json:"parameters,omitempty"`
-	Template      string         `json:"template,omitempty"`
-	System        string         `json:"system,omitempty"`
-	Details       ModelDetails   `json:"details,omitempty"`
-	Messages      []Message      `json:"messages,omitempty"`
-	ModelInfo     map[string]any `json:"model_info,omitempty"`
-	ProjectorInfo map[string]any `json:"projector_info,omitempty"`
-	ModifiedAt    time.Time      `json:"modified_at,omitempty"`
+	License       string            `json:"license,omitempty"`
+	Modelfile     string            `json:"modelfile,omitempty"`
+	Parameters    string            `json:"parameters,omitempty"`
+	Template      string            `json:"template,omitempty"`
+	System        string            `json:"system,omitempty"`
+	Details       ModelDetails      `json:"details,omitempty"`
+	Messages      []Message         `json:"messages,omitempty"`
+	ModelInfo     map[string]any    `json:"model_info,omitempty"`
+	ProjectorInfo map[string]any    `json:"projector_info,omitempty"`
+	ModifiedAt    time.Time         `json:"modified_at,omitempty"`
+	Labels        map[string]string `json:"labels,omitempty"`
+	Provenance    *Provenance       `json:"provenance,omitempty"`
+
+	// Capabilities lists what the model can be used for: "completion" or
+	// "embedding", then any of "tools", "insert" and "vision".
+	Capabilities []string `json:"capabilities,omitempty"`
+
+	// ContextLength is the longest context the model was trained with.
+	ContextLength int `json:"context_length,omitempty"`
+
+	// TokenizerDigest identifies the model's vocabulary. Models with the
+	// same digest tokenize text the same way.
+	TokenizerDigest string `json:"tokenizer_digest,omitempty"`
+}
+
+// Provenance records where a model came from, as it was created.
+type Provenance struct {
+	// Tool is the version of Ollama that created the model.
+	Tool string `json:"tool"`
+
+	// Source is the repository the weights were published in, from the
+	// weights' metadata or the model they were created from.
+	Source string `json:"source,omitempty"`
+
+	// Parents are the models and files the model was created from.
+	Parents []ProvenanceParent `json:"parents,omitempty"`
+
+	// Quantization is set when the weights were quantized as the model was
+	// created.
+	Quantization *ProvenanceQuantization `json:"quantization,omitempty"`
+}
+
+// ProvenanceParent is a model or file a model was created from.
+type ProvenanceParent struct {
+	// Type is the Modelfile command that referenced the parent, "model",
+	// "adapter" or "tokenizer".
+	Type string `json:"type"`
+
+	// Name is the name of a parent model.
+	Name string `json:"name,omitempty"`
+
+	// Digest is the manifest digest of a parent model, or the digest of a
+	// parent file.
+	Digest string `json:"digest"`
+
+	// Format is the format of a parent file, "gguf", "ggla", "safetensors"
+	// or "tokenizer".
+	Format string `json:"format,omitempty"`
+
+	// Converter is set when a parent file was converted to GGUF.
+	Converter string `json:"converter,omitempty"`
+
+	// Provenance is the provenance recorded by a parent model.
+	Provenance *Provenance `json:"provenance,omitempty"`
+}
+
+// ProvenanceQuantization records how a model was quantized.
+type ProvenanceQuantization struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+	Tool string `json:"tool"`
+
+	// Perplexity compares the models before and after quantization, if it
+	// was checked when the model was created.
+	Perplexity *QuantizationPerplexity `json:"perplexity,omitempty"`
+}
+
+// QuantizationPerplexity is the perplexity of a model before and after it
+// was quantized, measured on the same text. Lower is better, and the
+// increase is the quality lost to quantization.
+type QuantizationPerplexity struct {
+	From float64 `json:"from"`
+	To   float64 `json:"to"`
+
+	// Tokens is the number of tokens scored.
+	Tokens int `json:"tokens"`
+}
+
+// SchedulePolicy is a time-based policy run by the server. Times are 24-hour
+// HH:MM clock times in the server's local time zone.
+type SchedulePolicy struct {
+	// Action is "quiet" to unload all models and refuse requests from Start
+	// until End, "preload" to load Model at Start, "group" to name a group
+	// of Models, or "switch" to load the models of Group at Start and
+	// unload all others.
+	Action string   `json:"action"`
+	Start  string   `json:"start,omitempty"`
+	End    string   `json:"end,omitempty"`
+	Model  string   `json:"model,omitempty"`
+	Group  string   `json:"group,omitempty"`
+	Models []string `json:"models,omitempty"`
+}
+
+// ScheduleRequest is the request passed to [Client.SetSchedule].
+type ScheduleRequest struct {
+	Policies []SchedulePolicy `json:"policies"`
+}
+
+// ScheduleResponse is the response from [Client.Schedule].
+type ScheduleResponse struct {
+	Policies []SchedulePolicy `json:"policies"`
+
+	// Quiet reports whether the server is currently in quiet hours.
+	Quiet bool `json:"quiet"`
+
+	// Group is the model group the server last switched to, if any.
+	Group string `json:"group,omitempty"`
+}
+
+// SwitchGroupRequest is the request passed to [Client.SwitchGroup].
+type SwitchGroupRequest struct {
+	Group string `json:"group"`
+}
+
+// LabelRequest is the request passed to [Client.Label].
+type LabelRequest struct {
+	Model string `json:"model"`
+
+	// Labels are merged into the model's labels. A label with an empty
+	// value is removed.
+	Labels map[string]string `json:"labels"`
+}
+
+// LabelResponse is the response from [Client.Label].
+type LabelResponse struct {
+	Labels map[string]string `json:"labels"`
+}
+
+// CORSPolicy allows browsers on matching origins to make cross-origin
+// requests to the server.
+type CORSPolicy struct {
+	// Origin is the origin the policy applies to, such as
+	// "https://example.com". It may contain a single "*" wildcard, for
+	// example "http://localhost:*".
+	Origin string `json:"origin"`
+
+	// Endpoints limits the policy to these paths. A path ending in "*"
+	// matches any path with that prefix. An empty list allows all endpoints.
+	Endpoints []string `json:"endpoints,omitempty"`
+
+	// Credentials allows requests to include credentials such as cookies or
+	// authorization headers.
+	Credentials bool `json:"credentials,omitempty"`
+
+	// MaxAge is how long in seconds browsers may cache the result of a
+	// preflight request. Zero uses the default of 12 hours.
+	MaxAge int `json:"max_age,omitempty"`
+}
+
+// CORSRequest is the request passed to [Client.SetCORS].
+type CORSRequest struct {
+	Policies []CORSPolicy `json:"policies"`
+}
+
+// CORSResponse is the response from [Client.CORS].
+type CORSResponse struct {
+	Policies []CORSPolicy `json:"policies"`
+}
+
+// LogRequest is the request passed to [Client.SetLog].
+type LogRequest struct {
+	// Level is the level of subsystems without their own, such as "debug"
+	// or "warn". If empty, the level is left unchanged.
+	Level string `json:"level,omitempty"`
+
+	// Subsystems are merged into the levels of the subsystems "scheduler",
+	// "runner", "server", "registry" and "ml". An empty level makes a
+	// subsystem use the default again.
+	Subsystems map[string]string `json:"subsystems,omitempty"`
+}
+
+// LogResponse is the response from [Client.Log].
+type LogResponse struct {
+	Level string `json:"level"`
+
+	// Subsystems is the level of every subsystem
+	Subsystems map[string]string `json:"subsystems"`
 }
 
 // CopyRequest is the request passed to [Client.Copy].
@@ -391,6 +954,106 @@ type ListResponse struct {
 	Models []ListModelResponse `json:"models"`
 }
 
+// SessionResponse is a chat session in [ListSessionsResponse].
+type SessionResponse struct {
+	ID    string `json:"id"`
+	Model string `json:"model"`
+
+	// Messages is the number of messages in the session
+	Messages int `json:"messages"`
+
+	// Memory is set once earlier turns of the session have been summarized
+	// into its memory
+	Memory bool `json:"memory,omitempty"`
+
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// ListSessionsResponse is the response from [Client.ListSessions].
+type ListSessionsResponse struct {
+	Sessions []SessionResponse `json:"sessions"`
+}
+
+// DeleteSessionRequest is the request passed to [Client.DeleteSession].
+type DeleteSessionRequest struct {
+	SessionID string `json:"session_id"`
+}
+
+// AffinityRequest is the request passed to [Client.Affinity]. It has the
+// fields of a generate or chat request the server routes by.
+type AffinityRequest struct {
+	Model     string    `json:"model"`
+	SessionID string    `json:"session_id,omitempty"`
+	System    string    `json:"system,omitempty"`
+	Prompt    string    `json:"prompt,omitempty"`
+	Messages  []Message `json:"messages,omitempty"`
+}
+
+// AffinityResponse is the response from [Client.Affinity].
+type AffinityResponse struct {
+	// Token is the affinity token the server returns in the X-Ollama-Affinity
+	// header of the request, a key for the KV cache it would use followed by
+	// @ and Server
+	Token string `json:"token"`
+
+	// Server is the name of the server, from OLLAMA_SERVER_ID
+	Server string `json:"server"`
+
+	// Loaded is set if the model is loaded on the server, and Session if it
+	// has the session
+	Loaded  bool `json:"loaded"`
+	Session bool `json:"session,omitempty"`
+}
+
+// AdapterRequest is the request passed to [Client.LoadAdapter] and
+// [Client.UnloadAdapter].
+type AdapterRequest struct {
+	// Model is the base model the adapter is loaded for
+	Model string `json:"model"`
+
+	// Adapter is the model created with an ADAPTER for Model, as for the
+	// adapter option
+	Adapter string `json:"adapter"`
+
+	// KeepAlive controls how long Model stays loaded after loading the
+	// adapter
+	KeepAlive *Duration `json:"keep_alive,omitempty"`
+}
+
+// AdapterResponse is a LoRA adapter loaded for a running model in
+// [ListAdaptersResponse].
+type AdapterResponse struct {
+	Model string `json:"model"`
+
+	// Adapters are the models the adapter is loaded for
+	Adapters []string `json:"adapters"`
+	Digest   string   `json:"digest"`
+
+	// Requests is the number of requests using the adapter
+	Requests int       `json:"requests"`
+	LastUsed time.Time `json:"last_used"`
+}
+
+// ListAdaptersResponse is the response from [Client.ListAdapters].
+type ListAdaptersResponse struct {
+	Adapters []AdapterResponse `json:"adapters"`
+}
+
+// ModelFileRequest requests a file of a model in the format of a Hugging
+// Face repository, such as its tokenizer.json, for other tools to use.
+// Without a File, the files the model has are listed.
+type ModelFileRequest struct {
+	Model string `json:"model"`
+	File  string `json:"file,omitempty"`
+}
+
+// ModelFilesResponse lists the files of a model that can be requested with
+// a [ModelFileRequest].
+type ModelFilesResponse struct {
+	Files []string `json:"files"`
+}
+
 // ProcessResponse is the response from [Client.Process].
 type ProcessResponse struct {
 	Models []ProcessModelResponse `json:"models"`
@@ -398,12 +1061,18 @@ type ProcessResponse struct {
 
 // ListModelResponse is a single model description in [ListResponse].
 type ListModelResponse struct {
-	Name       string       `json:"name"`
-	Model      string       `json:"model"`
-	ModifiedAt time.Time    `json:"modified_at"`
-	Size       int64        `json:"size"`
-	Digest     string       `json:"digest"`
-	Details    ModelDetails `json:"details,omitempty"`
+	Name       string            `json:"name"`
+	Model      string            `json:"model"`
+	ModifiedAt time.Time         `json:"modified_at"`
+	Size       int64             `json:"size"`
+	Digest     string            `json:"digest"`
+	Details    ModelDetails      `json:"details,omitempty"`
+	Labels     map[string]string `json:"labels,omitempty"`
+
+	// Capabilities, ContextLength and TokenizerDigest are as in [ShowResponse].
+	Capabilities    []string `json:"capabilities,omitempty"`
+	ContextLength   int      `json:"context_length,omitempty"`
+	TokenizerDigest string   `json:"tokenizer_digest,omitempty"`
 }
 
 // ProcessModelResponse is a single model description in [ProcessResponse].
@@ -436,9 +1105,17 @@ type GenerateResponse struct {
 	// CreatedAt is the timestamp of the response.
 	CreatedAt time.Time `json:"created_at"`
 
+	// Index is the index of the prompt of the response when the request
+	// has a batch of prompts.
+	Index *int `json:"index,omitempty"`
+
 	// Response is the textual response itself.
 	Response string `json:"response"`
 
+	// Thinking is the reasoning of the model, moved out of Response by the
+	// think processor.
+	Thinking string `json:"thinking,omitempty"`
+
 	// Done specifies if the response is complete.
 	Done bool `json:"done"`
 
@@ -449,9 +1126,126 @@ type GenerateResponse struct {
 	// can be sent in the next request to keep a conversational memory.
 	Context []int `json:"context,omitempty"`
 
+	// Logits are the raw final-layer logits, set when the request asked for
+	// them with Return.
+	Logits []float32 `json:"logits,omitempty"`
+
+	// HiddenStates are the pooled hidden states, set when the request asked
+	// for them with Return.
+	HiddenStates []float32 `json:"hidden_states,omitempty"`
+
+	// Scores are the outputs of the head selected with Head, named by Labels
+	// if the head has them.
+	Scores []float32 `json:"scores,omitempty"`
+	Labels []string  `json:"labels,omitempty"`
+
+	// Candidates are the responses generated with the best_of option, set
+	// when the request asked for them with ReturnCandidates.
+	Candidates []Candidate `json:"candidates,omitempty"`
+
+	// Metadata is the metadata of the request, set in the final response.
+	Metadata map[string]string `json:"metadata,omitempty"`
+
+	// SamplingTrace records how each generated token was sampled, set in
+	// the final response when the request asked for it with TraceSampling.
+	SamplingTrace []SampledToken `json:"sampling_trace,omitempty"`
+
+	// Logprobs are the log probabilities of the tokens of the chunk, set
+	// when the request asked for them with Logprobs.
+	Logprobs []Logprob `json:"logprobs,omitempty"`
+
+	// Compression reports how the prompt was compressed, set in the final
+	// response when the request has a Compressor.
+	Compression *CompressionStats `json:"compression,omitempty"`
+
+	// Tokens are the token ids generated for the chunk, and Offsets the
+	// byte offsets of their pieces in the text generated for the whole
+	// response, before any of it is moved into Thinking, set when the
+	// request asked for them with ReturnTokens.
+	Tokens  []int `json:"tokens,omitempty"`
+	Offsets []int `json:"offsets,omitempty"`
+
+	// Code are the fenced code blocks of the response, set in the final
+	// response by the code processor.
+	Code []CodeBlock `json:"code,omitempty"`
+
 	Metrics
 }
 
+// CodeBlock is a fenced code block extracted from a response.
+type CodeBlock struct {
+	Language string `json:"language,omitempty"`
+	Code     string `json:"code"`
+}
+
+// Candidate is one of the responses generated with the best_of option.
+type Candidate struct {
+	Response   string `json:"response"`
+	DoneReason string `json:"done_reason,omitempty"`
+
+	// Score is the reward from the reranker, or the sum of the log
+	// probabilities of the generated tokens without one.
+	Score float64 `json:"score"`
+}
+
+// CompressionStats reports how a request's prompt was compressed.
+type CompressionStats struct {
+	// Segments is the number of parts of the prompt compressed, such as
+	// messages
+	Segments int `json:"segments"`
+
+	// Tokens and CompressedTokens are the number of tokens of the segments
+	// before and after compression, as counted by the compressor
+	Tokens           int `json:"tokens"`
+	CompressedTokens int `json:"compressed_tokens"`
+
+	Duration time.Duration `json:"duration"`
+}
+
+// Logprob is the log probability of a generated token.
+type Logprob struct {
+	TokenLogprob
+
+	// TopLogprobs are the most likely tokens in its place, most likely
+	// first.
+	TopLogprobs []TokenLogprob `json:"top_logprobs,omitempty"`
+}
+
+// TokenLogprob is the log probability of a token.
+type TokenLogprob struct {
+	Token   string  `json:"token"`
+	Logprob float64 `json:"logprob"`
+}
+
+// SampledToken records how a generated token was sampled.
+type SampledToken struct {
+	Token int    `json:"token"`
+	Piece string `json:"piece"`
+
+	// Candidates are the tokens with the highest logits from the model,
+	// most likely first.
+	Candidates []SamplingCandidate `json:"candidates"`
+}
+
+// SamplingCandidate is one of the candidates in [SampledToken].
+type SamplingCandidate struct {
+	Token int    `json:"token"`
+	Piece string `json:"piece"`
+
+	// Logit is the logit of the token from the model, and Penalized is the
+	// logit after the repeat, frequency and presence penalties.
+	Logit     float32 `json:"logit"`
+	Penalized float32 `json:"penalized"`
+
+	// Probability is the probability the token was sampled with, zero if it
+	// was eliminated.
+	Probability float32 `json:"probability,omitempty"`
+
+	// EliminatedBy names the stage of sampling that eliminated the token,
+	// such as "top-k", "min-p" or "grammar".
+	EliminatedBy string `json:"eliminated_by,omitempty"`
+}
+
 // ModelDetails provides details about a model.
 type ModelDetails struct {
 	ParentModel       string   `json:"parent_model"`
@@ -488,6 +1282,14 @@ func (m *Metrics) Summary() {
 		fmt.Fprintf(os.Stderr, "eval duration:        %s\n", m.EvalDuration)
 		fmt.Fprintf(os.Stderr, "eval rate:            %.2f tokens/s\n", float64(m.EvalCount)/m.EvalDuration.Seconds())
 	}
+
+	if m.EnergyJoules > 0 {
+		fmt.Fprintf(os.Stderr, "energy:               %.2f J\n", m.EnergyJoules)
+	}
+
+	if m.ContextLength > 0 {
+		fmt.Fprintf(os.Stderr, "context length:       %d token(s), reduced to fit in memory\n", m.ContextLength)
+	}
 }
 
 func (opts *Options) FromMap(m map[string]interface{}) error {
@@ -552,16 +1354,54 @@ func (opts *Options) FromMap(m map[string]interface{}) error {
 				if !ok {
 					return fmt.Errorf("option %q must be of type array", key)
 				}
-				// convert []interface{} to []string
-				slice := make([]string, len(val))
-				for i, item := range val {
-					str, ok := item.(string)
+
+				if field.Type().Elem().Kind() == reflect.Int {
+					// convert []interface{} to []int
+					slice := make([]int, len(val))
+					for i, item := range val {
+						// when JSON unmarshals numbers, it uses float64, not int
+						n, ok := item.(float64)
+						if !ok {
+							return fmt.Errorf("option %q must be of an array of integers", key)
+						}
+						slice[i] = int(n)
+					}
+					field.Set(reflect.ValueOf(slice))
+				} else {
+					// convert []interface{} to []string
+					slice := make([]string, len(val))
+					for i, item := range val {
+						str, ok := item.(string)
+						if !ok {
+							return fmt.Errorf("option %q must be of an array of strings", key)
+						}
+						slice[i] = str
+					}
+					field.Set(reflect.ValueOf(slice))
+				}
+			case reflect.Map:
+				// JSON unmarshals objects with string keys, so token ids are
+				// parsed from them
+				val, ok := val.(map[string]interface{})
+				if !ok {
+					return fmt.Errorf("option %q must be of type object", key)
+				}
+
+				biases := make(map[int]float32, len(val))
+				for k, v := range val {
+					token, err := strconv.Atoi(k)
+					if err != nil {
+						return fmt.Errorf("option %q must have token ids as keys", key)
+					}
+
+					bias, ok := v.(float64)
 					if !ok {
-						return fmt.Errorf("option %q must be of an array of strings", key)
+						return fmt.Errorf("option %q must have numbers as values", key)
 					}
-					slice[i] = str
+
+					biases[token] = float32(bias)
 				}
-				field.Set(reflect.ValueOf(slice))
+				field.Set(reflect.ValueOf(biases))
 			case reflect.Pointer:
 				var b bool
 				if field.Type() == reflect.TypeOf(&b) {
@@ -605,6 +1445,13 @@ func DefaultOptions() Options {
 		PenalizeNewline:  true,
 		Seed:             -1,
 
+		DryBase:             1.75,
+		DryAllowedLength:    2,
+		DryPenaltyLastN:     -1,
+		DrySequenceBreakers: []string{"\n", ":", "\"", "*"},
+		XTCThreshold:        0.1,
+		DynatempExponent:    1.0,
+
 		Runner: Runner{
 			// options set when the model is loaded
 			NumCtx:    2048,
@@ -707,8 +1554,43 @@ func FormatParams(params map[string][]string) (map[string]interface{}, error) {
 				case reflect.String:
 					out[key] = vals[0]
 				case reflect.Slice:
-					// TODO: only string slices are supported right now
-					out[key] = vals
+					if field.Type().Elem().Kind() == reflect.Int {
+						ints := make([]int64, len(vals))
+						for i, val := range vals {
+							intVal, err := strconv.ParseInt(val, 10, 64)
+							if err != nil {
+								return nil, fmt.Errorf("invalid int value %s", vals)
+							}
+
+							ints[i] = intVal
+						}
+
+						out[key] = ints
+					} else {
+						out[key] = vals
+					}
+				case reflect.Map:
+					// each value is a token id and its bias, such as 42:-100
+					biases := make(map[string]interface{}, len(vals))
+					for _, val := range vals {
+						token, bias, ok := strings.Cut(val, ":")
+						if !ok {
+							return nil, fmt.Errorf("invalid token bias %s, expected token:bias", val)
+						}
+
+						if _, err := strconv.Atoi(token); err != nil {
+							return nil, fmt.Errorf("invalid token id %s", token)
+						}
+
+						floatVal, err := strconv.ParseFloat(bias, 32)
+						if err != nil {
+							return nil, fmt.Errorf("invalid float value %s", bias)
+						}
+
+						biases[token] = floatVal
+					}
+
+					out[key] = biases
 				case reflect.Pointer:
 					var b bool
 					if field.Type() == reflect.TypeOf(&b) {
@@ -209,6 +209,53 @@ func TestUseMmapFormatParams(t *testing.T) {
 	}
 }
 
+func TestBanTokensOptions(t *testing.T) {
+	params, err := FormatParams(map[string][]string{"ban": {"foo", "bar"}, "ban_token": {"1", "2"}})
+	require.NoError(t, err)
+
+	// options of models are read back from JSON
+	b, err := json.Marshal(params)
+	require.NoError(t, err)
+
+	var oMap map[string]interface{}
+	require.NoError(t, json.Unmarshal(b, &oMap))
+
+	opts := DefaultOptions()
+	require.NoError(t, opts.FromMap(oMap))
+	assert.Equal(t, []string{"foo", "bar"}, opts.Ban)
+	assert.Equal(t, []int{1, 2}, opts.BanTokens)
+
+	_, err = FormatParams(map[string][]string{"ban_token": {"foo"}})
+	require.Error(t, err)
+
+	require.Error(t, opts.FromMap(map[string]interface{}{"ban_token": []interface{}{"foo"}}))
+}
+
+func TestLogitBiasOptions(t *testing.T) {
+	params, err := FormatParams(map[string][]string{"logit_bias": {"1:-100", "42:2.5"}})
+	require.NoError(t, err)
+
+	// options of models are read back from JSON
+	b, err := json.Marshal(params)
+	require.NoError(t, err)
+
+	var oMap map[string]interface{}
+	require.NoError(t, json.Unmarshal(b, &oMap))
+
+	opts := DefaultOptions()
+	require.NoError(t, opts.FromMap(oMap))
+	assert.Equal(t, map[int]float32{1: -100, 42: 2.5}, opts.LogitBias)
+
+	for _, v := range []string{"1", "foo:1", "1:foo"} {
+		_, err = FormatParams(map[string][]string{"logit_bias": {v}})
+		require.Error(t, err, v)
+	}
+
+	require.Error(t, opts.FromMap(map[string]interface{}{"logit_bias": []interface{}{1}}))
+	require.Error(t, opts.FromMap(map[string]interface{}{"logit_bias": map[string]interface{}{"foo": 1.0}}))
+	require.Error(t, opts.FromMap(map[string]interface{}{"logit_bias": map[string]interface{}{"1": "foo"}}))
+}
+
 func TestMessage_UnmarshalJSON(t *testing.T) {
 	tests := []struct {
 		input    string
@@ -231,3 +278,62 @@ func TestMessage_UnmarshalJSON(t *testing.T) {
 		}
 	}
 }
+
+func TestTokenInputsParsingFromJSON(t *testing.T) {
+	tests := []struct {
+		name string
+		req  string
+		exp  TokenInputs
+	}{
+		{name: "Single", req: `{ "input_tokens": [1, 2, 3] }`, exp: TokenInputs{{1, 2, 3}}},
+		{name: "Batch", req: `{ "input_tokens": [[1, 2], [3]] }`, exp: TokenInputs{{1, 2}, {3}}},
+		{name: "Null", req: `{ "input_tokens": null }`, exp: nil},
+		{name: "Unset", req: `{}`, exp: nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var req EmbedRequest
+			err := json.Unmarshal([]byte(test.req), &req)
+			require.NoError(t, err)
+			assert.Equal(t, test.exp, req.InputTokens)
+		})
+	}
+
+	var req EmbedRequest
+	require.Error(t, json.Unmarshal([]byte(`{ "input_tokens": ["a"] }`), &req))
+}
+
+func TestGenerateRequestPrompts(t *testing.T) {
+	tests := []struct {
+		name    string
+		req     string
+		prompt  string
+		prompts []string
+	}{
+		{name: "Single", req: `{ "prompt": "hi" }`, prompt: "hi"},
+		{name: "Batch", req: `{ "prompt": ["hi", "hello"] }`, prompts: []string{"hi", "hello"}},
+		{name: "Empty", req: `{ "prompt": [] }`, prompts: []string{}},
+		{name: "Null", req: `{ "prompt": null }`},
+		{name: "Unset", req: `{ "model": "test" }`},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var req GenerateRequest
+			require.NoError(t, json.Unmarshal([]byte(test.req), &req))
+			assert.Equal(t, test.prompt, req.Prompt)
+			assert.Equal(t, test.prompts, req.Prompts)
+
+			b, err := json.Marshal(req)
+			require.NoError(t, err)
+
+			var got GenerateRequest
+			require.NoError(t, json.Unmarshal(b, &got))
+			assert.Equal(t, req, got)
+		})
+	}
+
+	var req GenerateRequest
+	require.Error(t, json.Unmarshal([]byte(`{ "prompt": [1] }`), &req))
+}
@@ -0,0 +1,179 @@
+// Command benchcheck compares go test benchmark results against a baseline
+// and fails if any benchmark got slower than a threshold:
+//
+//	go test ./llama -run '^$' -bench Ops -count 5 > baseline.txt
+//	go test ./llama -run '^$' -bench Ops -count 5 | go run ./cmd/benchcheck -baseline baseline.txt
+//
+// The median of repeated runs of each benchmark is compared. Benchmarks
+// missing from either side are reported but don't fail the check.
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// parse reads go test -bench output and returns the median ns/op of each
+// benchmark, keyed by name without the GOMAXPROCS suffix
+func parse(r io.Reader) (map[string]float64, error) {
+	results := make(map[string][]float64)
+
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) < 4 || !strings.HasPrefix(fields[0], "Benchmark") {
+			continue
+		}
+
+		name := fields[0]
+		if i := strings.LastIndex(name, "-"); i > 0 {
+			if _, err := strconv.Atoi(name[i+1:]); err == nil {
+				name = name[:i]
+			}
+		}
+
+		for i := 2; i+1 < len(fields); i += 2 {
+			if fields[i+1] != "ns/op" {
+				continue
+			}
+
+			ns, err := strconv.ParseFloat(fields[i], 64)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", name, err)
+			}
+
+			results[name] = append(results[name], ns)
+		}
+	}
+
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+
+	medians := make(map[string]float64, len(results))
+	for name, values := range results {
+		slices.Sort(values)
+		n := len(values)
+		if n%2 == 1 {
+			medians[name] = values[n/2]
+		} else {
+			medians[name] = (values[n/2-1] + values[n/2]) / 2
+		}
+	}
+
+	return medians, nil
+}
+
+type comparison struct {
+	name       string
+	base, curr float64
+}
+
+// delta is the change in percent from the baseline
+func (c comparison) delta() float64 {
+	return (c.curr - c.base) / c.base * 100
+}
+
+// compare writes a report comparing current to baseline and returns the
+// benchmarks which regressed by more than threshold percent
+func compare(w io.Writer, baseline, current map[string]float64, threshold float64) []comparison {
+	var names []string
+	for name := range baseline {
+		names = append(names, name)
+	}
+
+	for name := range current {
+		if _, ok := baseline[name]; !ok {
+			names = append(names, name)
+		}
+	}
+
+	slices.Sort(names)
+
+	var regressions []comparison
+	for _, name := range names {
+		base, inBase := baseline[name]
+		curr, inCurr := current[name]
+		switch {
+		case !inBase:
+			fmt.Fprintf(w, "%-60s %14s %14.0f ns/op  (new)\n", name, "", curr)
+		case !inCurr:
+			fmt.Fprintf(w, "%-60s %14.0f %14s        (missing)\n", name, base, "")
+		default:
+			c := comparison{name, base, curr}
+			status := ""
+			if c.delta() > threshold {
+				status = "  REGRESSION"
+				regressions = append(regressions, c)
+			}
+
+			fmt.Fprintf(w, "%-60s %14.0f %14.0f ns/op %+7.1f%%%s\n", name, base, curr, c.delta(), status)
+		}
+	}
+
+	return regressions
+}
+
+func run(args []string, stdin io.Reader, stdout io.Writer) error {
+	fs := flag.NewFlagSet("benchcheck", flag.ContinueOnError)
+	baselinePath := fs.String("baseline", "", "baseline benchmark results")
+	threshold := fs.Float64("threshold", 10, "maximum allowed slowdown in percent")
+	update := fs.Bool("update", false, "write the results read from stdin to the baseline")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if *baselinePath == "" {
+		return fmt.Errorf("-baseline is required")
+	}
+
+	if *update {
+		f, err := os.Create(*baselinePath)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		_, err = io.Copy(f, stdin)
+		return err
+	}
+
+	f, err := os.Open(*baselinePath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	baseline, err := parse(f)
+	if err != nil {
+		return fmt.Errorf("baseline: %w", err)
+	}
+
+	current, err := parse(stdin)
+	if err != nil {
+		return err
+	}
+
+	if len(current) == 0 {
+		return fmt.Errorf("no benchmark results on stdin")
+	}
+
+	if regressions := compare(stdout, baseline, current, *threshold); len(regressions) > 0 {
+		return fmt.Errorf("%d benchmarks regressed by more than %g%%", len(regressions), *threshold)
+	}
+
+	return nil
+}
+
+func main() {
+	if err := run(os.Args[1:], os.Stdin, os.Stdout); err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+const baseline = `goos: linux
+goarch: amd64
+pkg: github.com/ollama/ollama/llama
+BenchmarkOps/mul_mat/q4_0/4096x4096x1-8         	    1000	   1000000 ns/op
+BenchmarkOps/mul_mat/q4_0/4096x4096x1-8         	    1000	   1200000 ns/op
+BenchmarkOps/mul_mat/q4_0/4096x4096x1-8         	    1000	   5000000 ns/op
+BenchmarkOps/rms_norm/f32/4096x512-8            	   10000	    100000 ns/op	      16 B/op	       1 allocs/op
+BenchmarkOps/rms_norm/f32/4096x512-8            	   10000	    200000 ns/op	      16 B/op	       1 allocs/op
+PASS
+ok  	github.com/ollama/ollama/llama	12.345s
+`
+
+func TestParse(t *testing.T) {
+	got, err := parse(strings.NewReader(baseline))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expect := map[string]float64{
+		"BenchmarkOps/mul_mat/q4_0/4096x4096x1": 1200000,
+		"BenchmarkOps/rms_norm/f32/4096x512":    150000,
+	}
+
+	if diff := cmp.Diff(got, expect); diff != "" {
+		t.Errorf("mismatch (-got +want):\n%s", diff)
+	}
+}
+
+func TestCompare(t *testing.T) {
+	base := map[string]float64{"a": 100, "b": 100, "c": 100}
+	curr := map[string]float64{"a": 105, "b": 120, "d": 100}
+
+	regressions := compare(io.Discard, base, curr, 10)
+	if len(regressions) != 1 || regressions[0].name != "b" {
+		t.Errorf("expected b to regress, got %v", regressions)
+	}
+
+	if regressions := compare(io.Discard, base, curr, 25); len(regressions) != 0 {
+		t.Errorf("expected no regressions, got %v", regressions)
+	}
+}
+
+func TestRun(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "baseline.txt")
+	if err := run([]string{"-baseline", path, "-update"}, strings.NewReader(baseline), io.Discard); err != nil {
+		t.Fatal(err)
+	}
+
+	if b, err := os.ReadFile(path); err != nil || string(b) != baseline {
+		t.Fatalf("expected baseline to be written, got %q %v", b, err)
+	}
+
+	if err := run([]string{"-baseline", path}, strings.NewReader(baseline), io.Discard); err != nil {
+		t.Errorf("expected no regressions, got %v", err)
+	}
+
+	slower := strings.ReplaceAll(baseline, "00000 ns/op", "50000 ns/op")
+	if err := run([]string{"-baseline", path}, strings.NewReader(slower), io.Discard); err == nil {
+		t.Error("expected regression")
+	}
+
+	if err := run([]string{"-baseline", path}, strings.NewReader(""), io.Discard); err == nil {
+		t.Error("expected error for empty input")
+	}
+}
@@ -4,10 +4,12 @@ import (
 	"archive/zip"
 	"bufio"
 	"bytes"
+	"cmp"
 	"context"
 	"crypto/ed25519"
 	"crypto/rand"
 	"crypto/sha256"
+	"crypto/tls"
 	"encoding/json"
 	"encoding/pem"
 	"errors"
@@ -15,7 +17,6 @@ import (
 	"io"
 	"log"
 	"math"
-	"net"
 	"net/http"
 	"os"
 	"os/signal"
@@ -119,7 +120,7 @@ func CreateHandler(cmd *cobra.Command, args []string) error {
 
 	for i := range modelfile.Commands {
 		switch modelfile.Commands[i].Name {
-		case "model", "adapter":
+		case "model", "adapter", "softprompt", "head", "tokenizer":
 			path := modelfile.Commands[i].Args
 			if path == "~" {
 				path = home
@@ -138,7 +139,15 @@ func CreateHandler(cmd *cobra.Command, args []string) error {
 				return err
 			}
 
-			if fi.IsDir() {
+			if fi.IsDir() && modelfile.Commands[i].Name == "tokenizer" {
+				tempfile, err := tempZipTokenizer(path)
+				if err != nil {
+					return err
+				}
+				defer os.RemoveAll(tempfile)
+
+				path = tempfile
+			} else if fi.IsDir() {
 				// this is likely a safetensors or pytorch directory
 				// TODO make this work w/ adapters
 				tempfile, err := tempZipFiles(path)
@@ -184,8 +193,9 @@ func CreateHandler(cmd *cobra.Command, args []string) error {
 	}
 
 	quantize, _ := cmd.Flags().GetString("quantize")
+	checkPerplexity, _ := cmd.Flags().GetBool("check-perplexity")
 
-	request := api.CreateRequest{Name: args[0], Modelfile: modelfile.String(), Quantize: quantize}
+	request := api.CreateRequest{Name: args[0], Modelfile: modelfile.String(), Quantize: quantize, CheckPerplexity: checkPerplexity}
 	if err := client.Create(cmd.Context(), &request, fn); err != nil {
 		return err
 	}
@@ -194,12 +204,6 @@ func CreateHandler(cmd *cobra.Command, args []string) error {
 }
 
 func tempZipFiles(path string) (string, error) {
-	tempfile, err := os.CreateTemp("", "ollama-tf")
-	if err != nil {
-		return "", err
-	}
-	defer tempfile.Close()
-
 	detectContentType := func(path string) (string, error) {
 		f, err := os.Open(path)
 		if err != nil {
@@ -282,6 +286,43 @@ func tempZipFiles(path string) (string, error) {
 		files = append(files, tks...)
 	}
 
+	return zipFiles(path, files)
+}
+
+// tempZipTokenizer zips the tokenizer files in the directory path
+func tempZipTokenizer(path string) (string, error) {
+	var files []string
+	for _, name := range []string{"tokenizer.json", "tokenizer.model"} {
+		if _, err := os.Stat(filepath.Join(path, name)); err == nil {
+			files = append(files, filepath.Join(path, name))
+		} else if !errors.Is(err, os.ErrNotExist) {
+			return "", err
+		}
+	}
+
+	if len(files) == 0 {
+		return "", fmt.Errorf("no tokenizer.json or tokenizer.model found in %s", path)
+	}
+
+	// configuration files set special tokens and the chat template
+	for _, name := range []string{"tokenizer_config.json", "added_tokens.json", "special_tokens_map.json"} {
+		if _, err := os.Stat(filepath.Join(path, name)); err == nil {
+			files = append(files, filepath.Join(path, name))
+		}
+	}
+
+	return zipFiles(path, files)
+}
+
+// zipFiles writes files, relative to the directory path, to a temporary zip
+// file and returns its name
+func zipFiles(path string, files []string) (string, error) {
+	tempfile, err := os.CreateTemp("", "ollama-tf")
+	if err != nil {
+		return "", err
+	}
+	defer tempfile.Close()
+
 	zipfile := zip.NewWriter(tempfile)
 	defer zipfile.Close()
 
@@ -680,20 +721,21 @@ func DeleteHandler(cmd *cobra.Command, args []string) error {
 		return err
 	}
 
-	// Unload the model if it's running before deletion
-	opts := &runOptions{
-		Model:     args[0],
-		KeepAlive: &api.Duration{Duration: 0},
-	}
-	if err := loadOrUnloadModel(cmd, opts); err != nil {
-		if !strings.Contains(err.Error(), "not found") {
-			return fmt.Errorf("unable to stop existing running model \"%s\": %s", args[0], err)
-		}
+	force, err := cmd.Flags().GetBool("force")
+	if err != nil {
+		return err
 	}
 
+	// the server unloads models before deleting them, and refuses to delete
+	// ones that are processing requests unless forced
 	for _, name := range args {
-		req := api.DeleteRequest{Name: name}
+		req := api.DeleteRequest{Name: name, Force: force}
 		if err := client.Delete(cmd.Context(), &req); err != nil {
+			var statusErr api.StatusError
+			if errors.As(err, &statusErr) && statusErr.StatusCode == http.StatusConflict && !force {
+				return fmt.Errorf("%w, use --force to delete it once its requests finish", err)
+			}
+
 			return err
 		}
 		fmt.Printf("deleted '%s'\n", name)
@@ -712,8 +754,9 @@ func ShowHandler(cmd *cobra.Command, args []string) error {
 	parameters, errParams := cmd.Flags().GetBool("parameters")
 	system, errSystem := cmd.Flags().GetBool("system")
 	template, errTemplate := cmd.Flags().GetBool("template")
+	provenance, errProvenance := cmd.Flags().GetBool("provenance")
 
-	for _, boolErr := range []error{errLicense, errModelfile, errParams, errSystem, errTemplate} {
+	for _, boolErr := range []error{errLicense, errModelfile, errParams, errSystem, errTemplate, errProvenance} {
 		if boolErr != nil {
 			return errors.New("error retrieving flags")
 		}
@@ -747,8 +790,13 @@ func ShowHandler(cmd *cobra.Command, args []string) error {
 		showType = "template"
 	}
 
+	if provenance {
+		flagsSet++
+		showType = "provenance"
+	}
+
 	if flagsSet > 1 {
-		return errors.New("only one of '--license', '--modelfile', '--parameters', '--system', or '--template' can be specified")
+		return errors.New("only one of '--license', '--modelfile', '--parameters', '--system', '--template', or '--provenance' can be specified")
 	}
 
 	req := api.ShowRequest{Name: args[0]}
@@ -769,6 +817,12 @@ func ShowHandler(cmd *cobra.Command, args []string) error {
 			fmt.Print(resp.System)
 		case "template":
 			fmt.Print(resp.Template)
+		case "provenance":
+			if resp.Provenance == nil {
+				return errors.New("no provenance recorded, the model was created by an older version of Ollama")
+			}
+
+			showProvenance(resp.Provenance, os.Stdout, "")
 		}
 
 		return nil
@@ -859,6 +913,47 @@ func showInfo(resp *api.ShowResponse, w io.Writer) error {
 	return nil
 }
 
+// showProvenance writes p and the provenance of its parents, each indented
+// under the parent it belongs to
+func showProvenance(p *api.Provenance, w io.Writer, indent string) {
+	row := func(key, value string) {
+		fmt.Fprintf(w, "%s%-*s%s\n", indent, 16-len(indent), key, value)
+	}
+
+	row("tool", p.Tool)
+	if p.Source != "" {
+		row("source", p.Source)
+	}
+
+	if q := p.Quantization; q != nil {
+		row("quantization", fmt.Sprintf("%s to %s with %s", q.From, q.To, q.Tool))
+		if ppl := q.Perplexity; ppl != nil {
+			row("perplexity", fmt.Sprintf("%.3f to %.3f (%+.1f%%) on %d tokens", ppl.From, ppl.To, 100*(ppl.To/ppl.From-1), ppl.Tokens))
+		}
+	}
+
+	for _, parent := range p.Parents {
+		value := cmp.Or(parent.Name, parent.Digest)
+		if parent.Name != "" && parent.Digest != "" {
+			value += " " + parent.Digest
+		}
+
+		if parent.Format != "" {
+			details := parent.Format
+			if parent.Converter != "" {
+				details += ", converted with " + parent.Converter
+			}
+
+			value += " (" + details + ")"
+		}
+
+		row(parent.Type, value)
+		if parent.Provenance != nil {
+			showProvenance(parent.Provenance, w, indent+"  ")
+		}
+	}
+}
+
 func CopyHandler(cmd *cobra.Command, args []string) error {
 	client, err := api.ClientFromEnvironment()
 	if err != nil {
@@ -1178,12 +1273,21 @@ func RunServer(_ *cobra.Command, _ []string) error {
 		return err
 	}
 
-	ln, err := net.Listen("tcp", envconfig.Host().Host)
+	ln, err := listen(envconfig.Host())
+	if err != nil {
+		return err
+	}
+
+	tlsConfig, err := server.TLSConfig()
 	if err != nil {
 		return err
 	}
 
-	err = server.Serve(ln)
+	if tlsConfig != nil {
+		ln = tls.NewListener(ln, tlsConfig)
+	}
+
+	err = serve(ln)
 	if errors.Is(err, http.ErrServerClosed) {
 		return nil
 	}
@@ -1326,6 +1430,7 @@ func NewCLI() *cobra.Command {
 
 	createCmd.Flags().StringP("file", "f", "", "Name of the Modelfile (default \"Modelfile\"")
 	createCmd.Flags().StringP("quantize", "q", "", "Quantize model to this level (e.g. q4_0)")
+	createCmd.Flags().Bool("check-perplexity", false, "Compare the perplexity of the model before and after quantizing it")
 
 	showCmd := &cobra.Command{
 		Use:     "show MODEL",
@@ -1340,6 +1445,7 @@ func NewCLI() *cobra.Command {
 	showCmd.Flags().Bool("parameters", false, "Show parameters of a model")
 	showCmd.Flags().Bool("template", false, "Show template of a model")
 	showCmd.Flags().Bool("system", false, "Show system message of a model")
+	showCmd.Flags().Bool("provenance", false, "Show where a model came from")
 
 	runCmd := &cobra.Command{
 		Use:     "run MODEL [PROMPT]",
@@ -1371,6 +1477,31 @@ func NewCLI() *cobra.Command {
 		RunE:    RunServer,
 	}
 
+	serviceCmd := &cobra.Command{
+		Use:    "service",
+		Short:  "Manage the ollama Windows service",
+		Hidden: runtime.GOOS != "windows",
+	}
+
+	serviceInstallCmd := &cobra.Command{
+		Use:   "install",
+		Short: "Install and start ollama as a Windows service",
+		Args:  cobra.ExactArgs(0),
+		RunE:  ServiceInstallHandler,
+	}
+
+	serviceInstallCmd.Flags().String("models", "", "Machine-level model store (default %ProgramData%\\Ollama\\models)")
+	serviceInstallCmd.Flags().String("group", "", "Only allow members of this group to read the model store")
+
+	serviceUninstallCmd := &cobra.Command{
+		Use:   "uninstall",
+		Short: "Stop and remove the ollama Windows service",
+		Args:  cobra.ExactArgs(0),
+		RunE:  ServiceUninstallHandler,
+	}
+
+	serviceCmd.AddCommand(serviceInstallCmd, serviceUninstallCmd)
+
 	pullCmd := &cobra.Command{
 		Use:     "pull MODEL",
 		Short:   "Pull a model from a registry",
@@ -1422,6 +1553,8 @@ func NewCLI() *cobra.Command {
 		RunE:    DeleteHandler,
 	}
 
+	deleteCmd.Flags().Bool("force", false, "Unload and delete models even if they're in use, once their requests finish")
+
 	runnerCmd := &cobra.Command{
 		Use:    "runner",
 		Short:  llama.PrintSystemInfo(),
@@ -1467,6 +1600,8 @@ func NewCLI() *cobra.Command {
 				envVars["OLLAMA_NOPRUNE"],
 				envVars["OLLAMA_ORIGINS"],
 				envVars["OLLAMA_SCHED_SPREAD"],
+				envVars["OLLAMA_FIT_CONTEXT"],
+				envVars["OLLAMA_SPLIT_FFN"],
 				envVars["OLLAMA_TMPDIR"],
 				envVars["OLLAMA_FLASH_ATTENTION"],
 				envVars["OLLAMA_KV_CACHE_TYPE"],
@@ -1491,6 +1626,7 @@ func NewCLI() *cobra.Command {
 		psCmd,
 		copyCmd,
 		deleteCmd,
+		serviceCmd,
 		runnerCmd,
 	)
 
@@ -207,8 +207,53 @@ Weigh anchor!
 	})
 }
 
+func TestShowProvenance(t *testing.T) {
+	var b bytes.Buffer
+	showProvenance(&api.Provenance{
+		Tool:   "ollama 0.5.8",
+		Source: "example/model",
+		Quantization: &api.ProvenanceQuantization{
+			From: "F16",
+			To:   "Q4_K_M",
+			Tool: "llama.cpp ba1cb19c",
+			Perplexity: &api.QuantizationPerplexity{
+				From:   6.5,
+				To:     6.773,
+				Tokens: 814,
+			},
+		},
+		Parents: []api.ProvenanceParent{
+			{
+				Type:   "model",
+				Name:   "base:latest",
+				Digest: "sha256:1234",
+				Provenance: &api.Provenance{
+					Tool: "ollama 0.5.7",
+					Parents: []api.ProvenanceParent{
+						{Type: "model", Digest: "sha256:abcd", Format: "safetensors", Converter: "ollama 0.5.7"},
+					},
+				},
+			},
+			{Type: "adapter", Digest: "sha256:5678", Format: "gguf"},
+		},
+	}, &b, "")
+
+	expect := `tool            ollama 0.5.8
+source          example/model
+quantization    F16 to Q4_K_M with llama.cpp ba1cb19c
+perplexity      6.500 to 6.773 (+4.2%) on 814 tokens
+model           base:latest sha256:1234
+  tool          ollama 0.5.7
+  model         sha256:abcd (safetensors, converted with ollama 0.5.7)
+adapter         sha256:5678 (gguf)
+`
+
+	if diff := cmp.Diff(expect, b.String()); diff != "" {
+		t.Errorf("unexpected output (-want +got):\n%s", diff)
+	}
+}
+
 func TestDeleteHandler(t *testing.T) {
-	stopped := false
 	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if r.URL.Path == "/api/delete" && r.Method == http.MethodDelete {
 			var req api.DeleteRequest
@@ -216,54 +261,49 @@ func TestDeleteHandler(t *testing.T) {
 				http.Error(w, err.Error(), http.StatusBadRequest)
 				return
 			}
-			if req.Name == "test-model" {
-				w.WriteHeader(http.StatusOK)
-			} else {
-				w.WriteHeader(http.StatusNotFound)
-			}
-			return
-		}
-		if r.URL.Path == "/api/generate" && r.Method == http.MethodPost {
-			var req api.GenerateRequest
-			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-				http.Error(w, err.Error(), http.StatusBadRequest)
-				return
-			}
-			if req.Model == "test-model" {
+			switch {
+			case req.Name == "test-model":
 				w.WriteHeader(http.StatusOK)
-				if err := json.NewEncoder(w).Encode(api.GenerateResponse{
-					Done: true,
-				}); err != nil {
+			case req.Name == "test-model-in-use" && !req.Force:
+				w.WriteHeader(http.StatusConflict)
+				if err := json.NewEncoder(w).Encode(map[string]string{"error": "model 'test-model-in-use' is in use"}); err != nil {
 					http.Error(w, err.Error(), http.StatusInternalServerError)
 				}
-				stopped = true
-				return
-			} else {
+			case req.Name == "test-model-in-use":
+				w.WriteHeader(http.StatusOK)
+			default:
 				w.WriteHeader(http.StatusNotFound)
-				if err := json.NewEncoder(w).Encode(api.GenerateResponse{
-					Done: false,
-				}); err != nil {
-					http.Error(w, err.Error(), http.StatusInternalServerError)
-				}
 			}
+			return
 		}
+		http.NotFound(w, r)
 	}))
 
 	t.Setenv("OLLAMA_HOST", mockServer.URL)
 	t.Cleanup(mockServer.Close)
 
 	cmd := &cobra.Command{}
+	cmd.Flags().Bool("force", false, "")
 	cmd.SetContext(context.TODO())
 	if err := DeleteHandler(cmd, []string{"test-model"}); err != nil {
 		t.Fatalf("DeleteHandler failed: %v", err)
 	}
-	if !stopped {
-		t.Fatal("Model was not stopped before deletion")
+
+	err := DeleteHandler(cmd, []string{"test-model-in-use"})
+	if err == nil || !strings.Contains(err.Error(), "use --force") {
+		t.Fatalf("DeleteHandler failed: expected error about the model being in use, got %v", err)
+	}
+
+	if err := cmd.Flags().Set("force", "true"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := DeleteHandler(cmd, []string{"test-model-in-use"}); err != nil {
+		t.Fatalf("DeleteHandler failed: %v", err)
 	}
 
-	err := DeleteHandler(cmd, []string{"test-model-not-found"})
-	if err == nil || !strings.Contains(err.Error(), "unable to stop existing running model \"test-model-not-found\"") {
-		t.Fatalf("DeleteHandler failed: expected error about stopping non-existent model, got %v", err)
+	if err := DeleteHandler(cmd, []string{"test-model-not-found"}); err == nil {
+		t.Fatal("DeleteHandler failed: expected error about non-existent model")
 	}
 }
 
@@ -0,0 +1,254 @@
+// Command libollama builds a shared library exposing the local package as a C
+// API, so applications not written in Go can run models in-process:
+//
+//	go build -buildmode=c-shared -o libollama.so ./cmd/libollama
+//
+// This also writes libollama.h declaring the functions below. Models are
+// referred to by handles returned from ollama_load. Functions that can fail
+// return a negative value and, if err isn't NULL, set it to a message which
+// must be freed with ollama_free_string. Requests and responses are JSON
+// encoded in the same format as the REST API.
+package main
+
+/*
+#include <stdint.h>
+#include <stdlib.h>
+
+// ollama_callback is called with each JSON encoded response. Returning a
+// non-zero value cancels the request.
+typedef int (*ollama_callback)(const char *response, void *user_data);
+
+static int ollama_call(ollama_callback cb, const char *response, void *user_data) {
+	return cb(response, user_data);
+}
+*/
+import "C"
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+	"unsafe"
+
+	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/local"
+)
+
+var (
+	errCanceled      = errors.New("canceled by callback")
+	errInvalidHandle = errors.New("invalid model handle")
+)
+
+// models are the models loaded with ollama_load by handle. Handles aren't
+// reused, so using one after it's freed fails instead of reaching another
+// model.
+var models = struct {
+	sync.Mutex
+	last    uintptr
+	handles map[uintptr]*local.Model
+}{handles: make(map[uintptr]*local.Model)}
+
+func addModel(m *local.Model) uintptr {
+	models.Lock()
+	defer models.Unlock()
+
+	models.last++
+	models.handles[models.last] = m
+	return models.last
+}
+
+func lookupModel(h uintptr) (*local.Model, error) {
+	models.Lock()
+	defer models.Unlock()
+
+	m, ok := models.handles[h]
+	if !ok {
+		return nil, errInvalidHandle
+	}
+
+	return m, nil
+}
+
+func removeModel(h uintptr) (*local.Model, error) {
+	models.Lock()
+	defer models.Unlock()
+
+	m, ok := models.handles[h]
+	if !ok {
+		return nil, errInvalidHandle
+	}
+
+	delete(models.handles, h)
+	return m, nil
+}
+
+func main() {}
+
+// setErr reports err to the caller and returns -1
+func setErr(dst **C.char, err error) C.int {
+	if dst != nil {
+		*dst = C.CString(err.Error())
+	}
+
+	return -1
+}
+
+func model(h C.uintptr_t) (*local.Model, error) {
+	return lookupModel(uintptr(h))
+}
+
+// ollama_load loads a model by name or GGUF path with options, a JSON object
+// which may be NULL, and returns its handle or 0 on failure
+//
+//export ollama_load
+func ollama_load(name *C.char, options *C.char, err **C.char) C.uintptr_t {
+	var opts map[string]any
+	if options != nil {
+		if e := json.Unmarshal([]byte(C.GoString(options)), &opts); e != nil {
+			setErr(err, e)
+			return 0
+		}
+	}
+
+	m, e := local.Load(C.GoString(name), opts)
+	if e != nil {
+		setErr(err, e)
+		return 0
+	}
+
+	return C.uintptr_t(addModel(m))
+}
+
+// ollama_free frees a model loaded with ollama_load. Freeing 0 or a handle
+// that was already freed does nothing.
+//
+//export ollama_free
+func ollama_free(h C.uintptr_t) {
+	if m, err := removeModel(uintptr(h)); err == nil {
+		m.Close()
+	}
+}
+
+// ollama_free_string frees a string returned by the library
+//
+//export ollama_free_string
+func ollama_free_string(s *C.char) {
+	C.free(unsafe.Pointer(s))
+}
+
+// ollama_tokenize writes up to n tokens of text to tokens and returns the
+// number of tokens in text, which may be more than n
+//
+//export ollama_tokenize
+func ollama_tokenize(h C.uintptr_t, text *C.char, tokens *C.int32_t, n C.int, err **C.char) C.int {
+	m, e := model(h)
+	if e != nil {
+		return setErr(err, e)
+	}
+
+	t, e := m.Tokenize(C.GoString(text))
+	if e != nil {
+		return setErr(err, e)
+	}
+
+	if n > 0 && tokens != nil {
+		dst := unsafe.Slice((*int32)(unsafe.Pointer(tokens)), int(n))
+		for i := range min(len(t), int(n)) {
+			dst[i] = int32(t[i])
+		}
+	}
+
+	return C.int(len(t))
+}
+
+// ollama_generate runs a JSON encoded generate request, calling cb with each
+// JSON encoded generate response
+//
+//export ollama_generate
+func ollama_generate(h C.uintptr_t, request *C.char, cb C.ollama_callback, userData unsafe.Pointer, err **C.char) C.int {
+	m, e := model(h)
+	if e != nil {
+		return setErr(err, e)
+	}
+
+	var req api.GenerateRequest
+	if e := json.Unmarshal([]byte(C.GoString(request)), &req); e != nil {
+		return setErr(err, e)
+	}
+
+	if e := m.Generate(context.Background(), &req, func(r api.GenerateResponse) error {
+		return respond(cb, userData, r)
+	}); e != nil {
+		return setErr(err, e)
+	}
+
+	return 0
+}
+
+// ollama_chat runs a JSON encoded chat request, calling cb with each JSON
+// encoded chat response
+//
+//export ollama_chat
+func ollama_chat(h C.uintptr_t, request *C.char, cb C.ollama_callback, userData unsafe.Pointer, err **C.char) C.int {
+	m, e := model(h)
+	if e != nil {
+		return setErr(err, e)
+	}
+
+	var req api.ChatRequest
+	if e := json.Unmarshal([]byte(C.GoString(request)), &req); e != nil {
+		return setErr(err, e)
+	}
+
+	if e := m.Chat(context.Background(), &req, func(r api.ChatResponse) error {
+		return respond(cb, userData, r)
+	}); e != nil {
+		return setErr(err, e)
+	}
+
+	return 0
+}
+
+// ollama_embed writes up to n values of the normalized embedding of text to
+// embedding and returns the number of dimensions, which may be more than n
+//
+//export ollama_embed
+func ollama_embed(h C.uintptr_t, text *C.char, embedding *C.float, n C.int, err **C.char) C.int {
+	m, e := model(h)
+	if e != nil {
+		return setErr(err, e)
+	}
+
+	embeddings, e := m.Embed(context.Background(), []string{C.GoString(text)})
+	if e != nil {
+		return setErr(err, e)
+	}
+
+	if n > 0 && embedding != nil {
+		dst := unsafe.Slice((*float32)(unsafe.Pointer(embedding)), int(n))
+		copy(dst, embeddings[0])
+	}
+
+	return C.int(len(embeddings[0]))
+}
+
+func respond(cb C.ollama_callback, userData unsafe.Pointer, v any) error {
+	if cb == nil {
+		return nil
+	}
+
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	s := C.CString(string(b))
+	defer C.free(unsafe.Pointer(s))
+
+	if C.ollama_call(cb, s, userData) != 0 {
+		return errCanceled
+	}
+
+	return nil
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/ollama/ollama/local"
+)
+
+func TestModelHandles(t *testing.T) {
+	if _, err := lookupModel(0); !errors.Is(err, errInvalidHandle) {
+		t.Errorf("expected the zero handle to be invalid, got %v", err)
+	}
+
+	if _, err := removeModel(0); !errors.Is(err, errInvalidHandle) {
+		t.Errorf("expected freeing the zero handle to fail, got %v", err)
+	}
+
+	m := &local.Model{}
+	h := addModel(m)
+	if h == 0 {
+		t.Fatal("expected a non-zero handle")
+	}
+
+	if got, err := lookupModel(h); err != nil || got != m {
+		t.Fatalf("expected the loaded model, got %v, %v", got, err)
+	}
+
+	if got, err := removeModel(h); err != nil || got != m {
+		t.Fatalf("expected to free the loaded model, got %v, %v", got, err)
+	}
+
+	if _, err := removeModel(h); !errors.Is(err, errInvalidHandle) {
+		t.Errorf("expected freeing twice to fail, got %v", err)
+	}
+
+	if _, err := lookupModel(h); !errors.Is(err, errInvalidHandle) {
+		t.Errorf("expected a freed handle to be invalid, got %v", err)
+	}
+
+	if next := addModel(m); next == h {
+		t.Errorf("expected handles not to be reused, got %d again", next)
+	}
+}
@@ -0,0 +1,67 @@
+package cmd
+
+import (
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"testing"
+)
+
+func TestListenUnix(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("unix socket permissions are not supported on windows")
+	}
+
+	path := filepath.Join(t.TempDir(), "ollama.sock")
+
+	ln, err := listen(&url.URL{Scheme: "unix", Path: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if mode := fi.Mode().Perm(); mode != 0o600 {
+		t.Errorf("expected mode 0600, got %o", mode)
+	}
+
+	if _, err := listen(&url.URL{Scheme: "unix", Path: path}); err == nil {
+		t.Error("expected error listening on a socket in use")
+	}
+
+	ln.Close()
+
+	// leave a stale socket behind as if the server had crashed
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	ln, err = listen(&url.URL{Scheme: "unix", Path: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln.Close()
+}
+
+func TestSystemdListener(t *testing.T) {
+	t.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()+1))
+	t.Setenv("LISTEN_FDS", "1")
+
+	ln, err := systemdListener()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ln != nil {
+		t.Error("expected sockets for another process to be ignored")
+	}
+}
@@ -0,0 +1,26 @@
+//go:build !windows
+
+package cmd
+
+import (
+	"errors"
+	"net"
+
+	"github.com/spf13/cobra"
+
+	"github.com/ollama/ollama/server"
+)
+
+var errServiceUnsupported = errors.New("service mode is only supported on Windows, use your init system to run 'ollama serve' instead")
+
+func ServiceInstallHandler(cmd *cobra.Command, args []string) error {
+	return errServiceUnsupported
+}
+
+func ServiceUninstallHandler(cmd *cobra.Command, args []string) error {
+	return errServiceUnsupported
+}
+
+func serve(ln net.Listener) error {
+	return server.Serve(ln)
+}
@@ -0,0 +1,269 @@
+package cmd
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+	"golang.org/x/sys/windows"
+	"golang.org/x/sys/windows/registry"
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/eventlog"
+	"golang.org/x/sys/windows/svc/mgr"
+
+	"github.com/ollama/ollama/server"
+)
+
+const serviceName = "Ollama"
+
+// serviceAccount is the virtual account the service runs as, which has the
+// privileges of a regular user rather than the local system account's
+const serviceAccount = `NT SERVICE\` + serviceName
+
+// storeSDDL restricts the machine-level model store to the service account,
+// the local system account and administrators, with read access for the
+// given principal
+const storeSDDL = "D:PAI(A;OICI;FA;;;%s)(A;OICI;FA;;;SY)(A;OICI;FA;;;BA)(A;OICI;0x1200a9;;;%s)"
+
+func ServiceInstallHandler(cmd *cobra.Command, args []string) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	models, err := cmd.Flags().GetString("models")
+	if err != nil {
+		return err
+	}
+
+	if models == "" {
+		models = filepath.Join(os.Getenv("ProgramData"), "Ollama", "models")
+	}
+
+	group, err := cmd.Flags().GetString("group")
+	if err != nil {
+		return err
+	}
+
+	m, err := mgr.Connect()
+	if err != nil {
+		return fmt.Errorf("connecting to the service manager, are you running as an administrator? %w", err)
+	}
+	defer m.Disconnect()
+
+	if s, err := m.OpenService(serviceName); err == nil {
+		s.Close()
+		return fmt.Errorf("service %s is already installed", serviceName)
+	}
+
+	if err := os.MkdirAll(models, 0o755); err != nil {
+		return err
+	}
+
+	s, err := m.CreateService(serviceName, exe, mgr.Config{
+		DisplayName:      "Ollama",
+		Description:      "Serves large language models for all users of this machine",
+		StartType:        mgr.StartAutomatic,
+		ServiceStartName: serviceAccount,
+		SidType:          windows.SERVICE_SID_TYPE_UNRESTRICTED,
+	}, "serve")
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	// the service account only exists once the service does
+	if err := setStoreACL(models, group); err != nil {
+		s.Delete()
+		return fmt.Errorf("setting access control on %s: %w", models, err)
+	}
+
+	if err := setServiceEnv(map[string]string{"OLLAMA_MODELS": models}); err != nil {
+		s.Delete()
+		return err
+	}
+
+	if err := eventlog.InstallAsEventCreate(serviceName, eventlog.Error|eventlog.Warning|eventlog.Info); err != nil {
+		s.Delete()
+		return err
+	}
+
+	if err := s.Start(); err != nil {
+		return err
+	}
+
+	fmt.Printf("installed and started the %s service with models in %s\n", serviceName, models)
+	return nil
+}
+
+func ServiceUninstallHandler(cmd *cobra.Command, args []string) error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return fmt.Errorf("connecting to the service manager, are you running as an administrator? %w", err)
+	}
+	defer m.Disconnect()
+
+	s, err := m.OpenService(serviceName)
+	if err != nil {
+		return fmt.Errorf("service %s is not installed", serviceName)
+	}
+	defer s.Close()
+
+	if status, err := s.Control(svc.Stop); err == nil {
+		for deadline := time.Now().Add(30 * time.Second); status.State != svc.Stopped && time.Now().Before(deadline); {
+			time.Sleep(250 * time.Millisecond)
+			if status, err = s.Query(); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := s.Delete(); err != nil {
+		return err
+	}
+
+	if err := eventlog.Remove(serviceName); err != nil {
+		slog.Warn("failed to remove event log source", "error", err)
+	}
+
+	fmt.Printf("uninstalled the %s service, models have been left in place\n", serviceName)
+	return nil
+}
+
+// setStoreACL replaces the permissions of the model store so it can only be
+// modified by the service and administrators. Members of group, or all users
+// if it's empty, can read it.
+func setStoreACL(path, group string) error {
+	account, _, _, err := windows.LookupSID("", serviceAccount)
+	if err != nil {
+		return fmt.Errorf("looking up %s: %w", serviceAccount, err)
+	}
+
+	reader := "BU"
+	if group != "" {
+		sid, _, _, err := windows.LookupSID("", group)
+		if err != nil {
+			return fmt.Errorf("looking up group %q: %w", group, err)
+		}
+
+		reader = sid.String()
+	}
+
+	sd, err := windows.SecurityDescriptorFromString(fmt.Sprintf(storeSDDL, account.String(), reader))
+	if err != nil {
+		return err
+	}
+
+	dacl, _, err := sd.DACL()
+	if err != nil {
+		return err
+	}
+
+	return windows.SetNamedSecurityInfo(path, windows.SE_FILE_OBJECT, windows.DACL_SECURITY_INFORMATION|windows.PROTECTED_DACL_SECURITY_INFORMATION, nil, nil, dacl, nil)
+}
+
+// setServiceEnv sets the environment the service manager starts the server with
+func setServiceEnv(env map[string]string) error {
+	k, err := registry.OpenKey(registry.LOCAL_MACHINE, `SYSTEM\CurrentControlSet\Services\`+serviceName, registry.SET_VALUE)
+	if err != nil {
+		return err
+	}
+	defer k.Close()
+
+	var values []string
+	for name, value := range env {
+		values = append(values, name+"="+value)
+	}
+
+	return k.SetStringsValue("Environment", values)
+}
+
+// serve runs the server, under the service manager if started by it
+func serve(ln net.Listener) error {
+	isService, err := svc.IsWindowsService()
+	if err != nil || !isService {
+		return server.Serve(ln)
+	}
+
+	elog, err := eventlog.Open(serviceName)
+	if err != nil {
+		return err
+	}
+	defer elog.Close()
+
+	// route the server and runner logs to the event log as there's no console
+	r, w, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+
+	os.Stderr = w
+	go logEvents(elog, r)
+
+	return svc.Run(serviceName, &service{ln: ln})
+}
+
+type service struct {
+	ln net.Listener
+}
+
+func (s *service) Execute(args []string, requests <-chan svc.ChangeRequest, status chan<- svc.Status) (bool, uint32) {
+	status <- svc.Status{State: svc.StartPending}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- server.ServeContext(ctx, s.ln)
+	}()
+
+	status <- svc.Status{State: svc.Running, Accepts: svc.AcceptStop | svc.AcceptShutdown}
+	for {
+		select {
+		case err := <-done:
+			if err != nil && !errors.Is(err, http.ErrServerClosed) {
+				slog.Error("server stopped", "error", err)
+				return false, 1
+			}
+
+			return false, 0
+		case r := <-requests:
+			switch r.Cmd {
+			case svc.Interrogate:
+				status <- r.CurrentStatus
+			case svc.Stop, svc.Shutdown:
+				status <- svc.Status{State: svc.StopPending}
+				cancel()
+			}
+		}
+	}
+}
+
+// logEvents reports each line written to r to the event log at the level of
+// the log record it contains
+func logEvents(elog *eventlog.Log, r io.Reader) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case strings.Contains(line, "level=ERROR"):
+			elog.Error(1, line)
+		case strings.Contains(line, "level=WARN"):
+			elog.Warning(1, line)
+		default:
+			elog.Info(1, line)
+		}
+	}
+}
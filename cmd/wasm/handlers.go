@@ -0,0 +1,229 @@
+// Command wasm exposes the template, Modelfile parser, request validation and
+// tokenizer used by the server to WebAssembly, so web clients can preview
+// prompts, check requests and count tokens offline with the same code:
+//
+//	GOOS=js GOARCH=wasm go build -o ollama.wasm ./cmd/wasm
+//
+// registers the functions ollamaRenderTemplate, ollamaParseModelfile,
+// ollamaValidateRequest, ollamaLoadTokenizer and ollamaTokenize with the
+// JavaScript global object, while
+//
+//	GOOS=wasip1 GOARCH=wasm go build -o ollama.wasm ./cmd/wasm
+//
+// builds a WASI command which reads its input from stdin, for example
+// "wasmtime ollama.wasm render < request.json".
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/parser"
+	"github.com/ollama/ollama/template"
+	"github.com/ollama/ollama/tokenizer"
+	"github.com/ollama/ollama/types/model"
+)
+
+// renderRequest is the input to renderTemplate
+type renderRequest struct {
+	Template string        `json:"template"`
+	System   string        `json:"system,omitempty"`
+	Messages []api.Message `json:"messages,omitempty"`
+	Tools    api.Tools     `json:"tools,omitempty"`
+	Prompt   string        `json:"prompt,omitempty"`
+	Suffix   string        `json:"suffix,omitempty"`
+}
+
+// renderTemplate renders a prompt the way the server does for a chat request
+// with messages, or a generate request with prompt
+func renderTemplate(input string) (any, error) {
+	var r renderRequest
+	if err := json.Unmarshal([]byte(input), &r); err != nil {
+		return nil, err
+	}
+
+	tmpl := template.DefaultTemplate
+	if r.Template != "" {
+		var err error
+		if tmpl, err = template.Parse(r.Template); err != nil {
+			return nil, err
+		}
+	}
+
+	var values template.Values
+	switch {
+	case r.Suffix != "":
+		values = template.Values{Prompt: r.Prompt, Suffix: r.Suffix}
+	case len(r.Messages) > 0:
+		values = template.Values{Messages: r.Messages, Tools: r.Tools}
+	default:
+		values = template.Values{Messages: []api.Message{{Role: "user", Content: r.Prompt}}}
+	}
+
+	if r.System != "" && !hasSystem(values.Messages) {
+		values.Messages = append([]api.Message{{Role: "system", Content: r.System}}, values.Messages...)
+	}
+
+	var b bytes.Buffer
+	if err := tmpl.Execute(&b, values); err != nil {
+		return nil, err
+	}
+
+	return map[string]string{"prompt": b.String()}, nil
+}
+
+func hasSystem(msgs []api.Message) bool {
+	for _, msg := range msgs {
+		if msg.Role == "system" {
+			return true
+		}
+	}
+
+	return false
+}
+
+// parseModelfile parses a Modelfile into its commands
+func parseModelfile(input string) (any, error) {
+	f, err := parser.ParseFile(strings.NewReader(input))
+	if err != nil {
+		return nil, err
+	}
+
+	type command struct {
+		Name string `json:"name"`
+		Args string `json:"args"`
+	}
+
+	commands := make([]command, len(f.Commands))
+	for i, c := range f.Commands {
+		commands[i] = command{Name: c.Name, Args: c.Args}
+	}
+
+	return map[string]any{"commands": commands}, nil
+}
+
+// validateRequest checks input is a request body for endpoint, one of
+// "generate", "chat" or "embed", that the server would accept before loading
+// the model
+func validateRequest(endpoint, input string) (any, error) {
+	d := json.NewDecoder(strings.NewReader(input))
+
+	var name string
+	var options map[string]any
+	switch endpoint {
+	case "generate":
+		var r api.GenerateRequest
+		if err := d.Decode(&r); err != nil {
+			return nil, err
+		}
+
+		if r.Template != "" {
+			if _, err := template.Parse(r.Template); err != nil {
+				return nil, err
+			}
+		}
+
+		name, options = r.Model, r.Options
+	case "chat":
+		var r api.ChatRequest
+		if err := d.Decode(&r); err != nil {
+			return nil, err
+		}
+
+		name, options = r.Model, r.Options
+	case "embed":
+		var r api.EmbedRequest
+		if err := d.Decode(&r); err != nil {
+			return nil, err
+		}
+
+		switch input := r.Input.(type) {
+		case string, nil:
+		case []any:
+			for _, v := range input {
+				if _, ok := v.(string); !ok {
+					return nil, errors.New("invalid input type")
+				}
+			}
+		default:
+			return nil, errors.New("invalid input type")
+		}
+
+		name, options = r.Model, r.Options
+	default:
+		return nil, fmt.Errorf("unknown endpoint %q", endpoint)
+	}
+
+	if !model.ParseName(name).IsValid() {
+		return nil, fmt.Errorf("invalid model name %q", name)
+	}
+
+	opts := api.DefaultOptions()
+	if err := opts.FromMap(options); err != nil {
+		return nil, err
+	}
+
+	return map[string]bool{"valid": true}, nil
+}
+
+// tok is the tokenizer loaded by loadTokenizer
+var tok *tokenizer.Tokenizer
+
+// loadTokenizer loads the tokenizer.json of a model, as served by the files
+// endpoint, for tokenize
+func loadTokenizer(input string) (any, error) {
+	t, err := tokenizer.Parse([]byte(input))
+	if err != nil {
+		return nil, err
+	}
+
+	tok = t
+	return map[string]bool{"loaded": true}, nil
+}
+
+// tokenizeRequest is the input to tokenize
+type tokenizeRequest struct {
+	Text string `json:"text"`
+
+	// AddSpecial adds the BOS and EOS tokens of the model, as the server
+	// does for prompts
+	AddSpecial bool `json:"add_special,omitempty"`
+}
+
+// tokenize encodes text with the loaded tokenizer
+func tokenize(input string) (any, error) {
+	if tok == nil {
+		return nil, errors.New("no tokenizer loaded")
+	}
+
+	var r tokenizeRequest
+	if err := json.Unmarshal([]byte(input), &r); err != nil {
+		return nil, err
+	}
+
+	tokens := tok.Encode(r.Text, r.AddSpecial)
+	return map[string]any{"tokens": tokens, "count": len(tokens)}, nil
+}
+
+// call runs fn and encodes its result, or the error it returns, as JSON
+func call(fn func() (any, error)) string {
+	v, err := fn()
+	if err != nil {
+		v = map[string]string{"error": err.Error()}
+	}
+
+	// templates are full of <|tags|> so leave them readable
+	var b bytes.Buffer
+	e := json.NewEncoder(&b)
+	e.SetEscapeHTML(false)
+	if err := e.Encode(v); err != nil {
+		b.Reset()
+		e.Encode(map[string]string{"error": err.Error()})
+	}
+
+	return strings.TrimSuffix(b.String(), "\n")
+}
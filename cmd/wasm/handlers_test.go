@@ -0,0 +1,113 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestRenderTemplate(t *testing.T) {
+	cases := []struct {
+		name   string
+		input  string
+		expect string
+	}{
+		{"prompt", `{"template": "{{ .System }}|{{ .Prompt }}", "system": "be brief", "prompt": "hi"}`, `{"prompt":"be brief|hi"}`},
+		{"messages", `{"template": "{{ range .Messages }}{{ .Role }}:{{ .Content }};{{ end }}", "messages": [{"role": "user", "content": "hi"}, {"role": "assistant", "content": "hello"}]}`, `{"prompt":"user:hi;assistant:hello;"}`},
+		{"suffix", `{"template": "{{ .Prompt }}<fim>{{ .Suffix }}", "prompt": "def", "suffix": "return"}`, `{"prompt":"def<fim>return"}`},
+		{"default template", `{"prompt": "hi"}`, `{"prompt":"hi"}`},
+		{"invalid template", `{"template": "{{ .Prompt", "prompt": "hi"}`, `{"error":"template: :1: unclosed action"}`},
+		{"invalid json", `{`, `{"error":"unexpected end of JSON input"}`},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			if diff := cmp.Diff(call(func() (any, error) { return renderTemplate(tt.input) }), tt.expect); diff != "" {
+				t.Errorf("mismatch (-got +want):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestParseModelfile(t *testing.T) {
+	got := call(func() (any, error) { return parseModelfile("FROM llama3.2\nPARAMETER temperature 0.5\n") })
+	expect := `{"commands":[{"name":"model","args":"llama3.2"},{"name":"temperature","args":"0.5"}]}`
+	if diff := cmp.Diff(got, expect); diff != "" {
+		t.Errorf("mismatch (-got +want):\n%s", diff)
+	}
+}
+
+func TestValidateRequest(t *testing.T) {
+	cases := []struct {
+		name     string
+		endpoint string
+		input    string
+		expect   string
+	}{
+		{"generate", "generate", `{"model": "llama3.2", "prompt": "hi", "options": {"temperature": 0.5}}`, `{"valid":true}`},
+		{"chat", "chat", `{"model": "llama3.2", "messages": [{"role": "user", "content": "hi"}]}`, `{"valid":true}`},
+		{"embed", "embed", `{"model": "all-minilm", "input": ["a", "b"]}`, `{"valid":true}`},
+		{"missing model", "generate", `{"prompt": "hi"}`, `{"error":"invalid model name \"\""}`},
+		{"invalid option", "chat", `{"model": "llama3.2", "options": {"temperature": "hot"}}`, `{"error":"option \"temperature\" must be of type float32"}`},
+		{"invalid input", "embed", `{"model": "all-minilm", "input": [1, 2]}`, `{"error":"invalid input type"}`},
+		{"invalid template", "generate", `{"model": "llama3.2", "template": "{{ .Prompt"}`, `{"error":"template: :1: unclosed action"}`},
+		{"unknown endpoint", "pull", `{}`, `{"error":"unknown endpoint \"pull\""}`},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			if diff := cmp.Diff(call(func() (any, error) { return validateRequest(tt.endpoint, tt.input) }), tt.expect); diff != "" {
+				t.Errorf("mismatch (-got +want):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestTokenize(t *testing.T) {
+	t.Cleanup(func() { tok = nil })
+
+	if diff := cmp.Diff(call(func() (any, error) { return tokenize(`{"text": "hi"}`) }), `{"error":"no tokenizer loaded"}`); diff != "" {
+		t.Errorf("mismatch (-got +want):\n%s", diff)
+	}
+
+	tokenizerJSON := `{
+		"added_tokens": [{"id": 0, "content": "<s>", "special": true}],
+		"pre_tokenizer": {"type": "ByteLevel", "use_regex": true},
+		"post_processor": {
+			"type": "TemplateProcessing",
+			"single": [{"SpecialToken": {"id": "<s>", "type_id": 0}}, {"Sequence": {"id": "A", "type_id": 0}}],
+			"special_tokens": {"<s>": {"id": "<s>", "ids": [0]}}
+		},
+		"model": {"type": "BPE", "vocab": {"<s>": 0, "h": 1, "i": 2, "hi": 3, "Ġ": 4, "Ġhi": 5}, "merges": ["h i", "Ġ hi"]}
+	}`
+
+	if diff := cmp.Diff(call(func() (any, error) { return loadTokenizer(tokenizerJSON) }), `{"loaded":true}`); diff != "" {
+		t.Errorf("mismatch (-got +want):\n%s", diff)
+	}
+
+	cases := []struct {
+		name   string
+		input  string
+		expect string
+	}{
+		{"text", `{"text": "hi hi"}`, `{"count":2,"tokens":[3,5]}`},
+		{"add special", `{"text": "hi", "add_special": true}`, `{"count":2,"tokens":[0,3]}`},
+		{"invalid json", `{`, `{"error":"unexpected end of JSON input"}`},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			if diff := cmp.Diff(call(func() (any, error) { return tokenize(tt.input) }), tt.expect); diff != "" {
+				t.Errorf("mismatch (-got +want):\n%s", diff)
+			}
+		})
+	}
+
+	t.Run("unsupported", func(t *testing.T) {
+		got := call(func() (any, error) { return loadTokenizer(`{"model": {"type": "WordPiece"}}`) })
+		if !strings.Contains(got, "unsupported") {
+			t.Errorf("expected an unsupported error, got %s", got)
+		}
+	})
+}
@@ -0,0 +1,62 @@
+//go:build !js
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+)
+
+const usage = "usage: ollama.wasm render | modelfile | validate generate|chat|embed | tokenize tokenizer.json < input"
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprintln(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	input, err := io.ReadAll(os.Stdin)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	var fn func() (any, error)
+	switch os.Args[1] {
+	case "render":
+		fn = func() (any, error) { return renderTemplate(string(input)) }
+	case "modelfile":
+		fn = func() (any, error) { return parseModelfile(string(input)) }
+	case "validate":
+		if len(os.Args) < 3 {
+			fmt.Fprintln(os.Stderr, usage)
+			os.Exit(2)
+		}
+
+		fn = func() (any, error) { return validateRequest(os.Args[2], string(input)) }
+	case "tokenize":
+		if len(os.Args) < 3 {
+			fmt.Fprintln(os.Stderr, usage)
+			os.Exit(2)
+		}
+
+		fn = func() (any, error) {
+			b, err := os.ReadFile(os.Args[2])
+			if err != nil {
+				return nil, err
+			}
+
+			if _, err := loadTokenizer(string(b)); err != nil {
+				return nil, err
+			}
+
+			return tokenize(string(input))
+		}
+	default:
+		fmt.Fprintln(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	fmt.Println(call(fn))
+}
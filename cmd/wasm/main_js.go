@@ -0,0 +1,40 @@
+//go:build js && wasm
+
+package main
+
+import (
+	"syscall/js"
+)
+
+func main() {
+	js.Global().Set("ollamaRenderTemplate", js.FuncOf(func(this js.Value, args []js.Value) any {
+		return call(func() (any, error) { return renderTemplate(arg(args, 0)) })
+	}))
+
+	js.Global().Set("ollamaParseModelfile", js.FuncOf(func(this js.Value, args []js.Value) any {
+		return call(func() (any, error) { return parseModelfile(arg(args, 0)) })
+	}))
+
+	js.Global().Set("ollamaValidateRequest", js.FuncOf(func(this js.Value, args []js.Value) any {
+		return call(func() (any, error) { return validateRequest(arg(args, 0), arg(args, 1)) })
+	}))
+
+	js.Global().Set("ollamaLoadTokenizer", js.FuncOf(func(this js.Value, args []js.Value) any {
+		return call(func() (any, error) { return loadTokenizer(arg(args, 0)) })
+	}))
+
+	js.Global().Set("ollamaTokenize", js.FuncOf(func(this js.Value, args []js.Value) any {
+		return call(func() (any, error) { return tokenize(arg(args, 0)) })
+	}))
+
+	// keep the functions available until the page is closed
+	select {}
+}
+
+func arg(args []js.Value, i int) string {
+	if i >= len(args) || args[i].Type() != js.TypeString {
+		return ""
+	}
+
+	return args[i].String()
+}
@@ -7,6 +7,7 @@ import (
 	"io"
 	"io/fs"
 	"log/slog"
+	"maps"
 	"strings"
 
 	"github.com/ollama/ollama/llm"
@@ -230,3 +231,20 @@ func ConvertModel(fsys fs.FS, ws io.WriteSeeker) error {
 
 	return conv.writeFile(ws, conv.KV(t), conv.Tensors(ts))
 }
+
+// ConvertTokenizer reads a tokenizer.json or tokenizer.model, along with any
+// tokenizer configuration, from fsys and returns its tokenizer key-values
+func ConvertTokenizer(fsys fs.FS) (llm.KV, error) {
+	var p ModelParameters
+	t, err := parseTokenizer(fsys, p.specialTokenTypes())
+	if err != nil {
+		return nil, err
+	}
+
+	kv := p.KV(t)
+	maps.DeleteFunc(kv, func(k string, _ any) bool {
+		return !strings.HasPrefix(k, "tokenizer.")
+	})
+
+	return kv, nil
+}
@@ -34,6 +34,10 @@ const (
 	DRMTotalMemoryFile = "mem_info_vram_total"
 	DRMUsedMemoryFile  = "mem_info_vram_used"
 
+	// Graphics translation table, the system memory the GPU can map
+	DRMGTTTotalMemoryFile = "mem_info_gtt_total"
+	DRMGTTUsedMemoryFile  = "mem_info_gtt_used"
+
 	// In hex; properties file is in decimal
 	DRMUniqueIDFile = "unique_id"
 	DRMVendorFile   = "vendor"
@@ -195,7 +199,9 @@ func AMDGetGPUInfo() ([]RocmGPUInfo, error) {
 		// Look up the memory for the current node
 		totalMemory := uint64(0)
 		usedMemory := uint64(0)
-		var usedFile string
+		gttTotal := uint64(0)
+		gttUsed := uint64(0)
+		var usedFile, gttUsedFile string
 		mapping := []struct {
 			id       uint64
 			filename string
@@ -256,6 +262,20 @@ func AMDGetGPUInfo() ([]RocmGPUInfo, error) {
 			if err != nil {
 				slog.Debug("failed to update used memory", "error", err)
 			}
+
+			// Only needed for APUs, which may not have enough VRAM to be usable otherwise
+			if totalMemory < IGPUMemLimit {
+				gttTotal, err = readSysfsUint(filepath.Join(devDir, DRMGTTTotalMemoryFile))
+				if err != nil {
+					slog.Debug("failed to read gtt memory", "error", err)
+					break
+				}
+				gttUsedFile = filepath.Join(devDir, DRMGTTUsedMemoryFile)
+				gttUsed, err = getFreeMemory(gttUsedFile)
+				if err != nil {
+					slog.Debug("failed to update used gtt memory", "error", err)
+				}
+			}
 			break
 		}
 
@@ -291,15 +311,32 @@ func AMDGetGPUInfo() ([]RocmGPUInfo, error) {
 			index:        gpuID,
 		}
 
-		// iGPU detection, remove this check once we can support an iGPU variant of the rocm library
+		// iGPU detection, only RDNA3 and newer APUs can allocate enough from system memory to be useful
 		if totalMemory < IGPUMemLimit {
-			reason := "unsupported Radeon iGPU detected skipping"
-			slog.Info(reason, "id", gpuID, "total", format.HumanBytes2(totalMemory))
-			unsupportedGPUs = append(unsupportedGPUs, UnsupportedGPUInfo{
-				GpuInfo: gpuInfo.GpuInfo,
-				Reason:  reason,
-			})
-			continue
+			if major < 11 || gttTotal == 0 {
+				reason := "unsupported Radeon iGPU detected skipping"
+				slog.Info(reason, "id", gpuID, "total", format.HumanBytes2(totalMemory))
+				unsupportedGPUs = append(unsupportedGPUs, UnsupportedGPUInfo{
+					GpuInfo: gpuInfo.GpuInfo,
+					Reason:  reason,
+				})
+				continue
+			}
+
+			systemFree := gttTotal
+			if systemMem, err := GetCPUMem(); err == nil {
+				systemFree = systemMem.FreeMemory
+			} else {
+				slog.Debug("failed to read system memory", "error", err)
+			}
+
+			gpuInfo.UnifiedMemory = true
+			gpuInfo.gttUsedFilepath = gttUsedFile
+			gpuInfo.gttTotal = gttTotal
+			gpuInfo.TotalMemory = totalMemory + gttTotal
+			gpuInfo.FreeMemory = unifiedFreeMemory(totalMemory, usedMemory, gttTotal, gttUsed, systemFree)
+			gpuInfo.EnvWorkarounds = append(gpuInfo.EnvWorkarounds, [2]string{"GGML_CUDA_ENABLE_UNIFIED_MEMORY", "1"})
+			slog.Info("Radeon APU detected, using shared system memory", "id", gpuID, "vram", format.HumanBytes2(totalMemory), "gtt", format.HumanBytes2(gttTotal))
 		}
 		minVer, err := strconv.Atoi(RocmComputeMajorMin)
 		if err != nil {
@@ -316,8 +353,8 @@ func AMDGetGPUInfo() ([]RocmGPUInfo, error) {
 			continue
 		}
 
-		slog.Debug("amdgpu memory", "gpu", gpuID, "total", format.HumanBytes2(totalMemory))
-		slog.Debug("amdgpu memory", "gpu", gpuID, "available", format.HumanBytes2(totalMemory-usedMemory))
+		slog.Debug("amdgpu memory", "gpu", gpuID, "total", format.HumanBytes2(gpuInfo.TotalMemory))
+		slog.Debug("amdgpu memory", "gpu", gpuID, "available", format.HumanBytes2(gpuInfo.FreeMemory))
 
 		// If the user wants to filter to a subset of devices, filter out if we aren't a match
 		if len(visibleDevices) > 0 {
@@ -381,6 +418,10 @@ func AMDGetGPUInfo() ([]RocmGPUInfo, error) {
 					Reason:  reason,
 				})
 
+				if gpuInfo.UnifiedMemory {
+					slog.Warn("Radeon APUs can usually run as gfx1100 by setting HSA_OVERRIDE_GFX_VERSION=11.0.0")
+				}
+
 				// TODO - consider discrete markdown just for ROCM troubleshooting?
 				slog.Warn("See https://github.com/ollama/ollama/blob/main/docs/gpu.md#overrides for HSA_OVERRIDE_GFX_VERSION usage")
 				continue
@@ -487,12 +528,37 @@ func (gpus RocmGPUInfoList) RefreshFreeMemory() error {
 		if err != nil {
 			return err
 		}
-		slog.Debug("updating rocm free memory", "gpu", gpus[i].ID, "name", gpus[i].Name, "before", format.HumanBytes2(gpus[i].FreeMemory), "now", format.HumanBytes2(gpus[i].TotalMemory-usedMemory))
-		gpus[i].FreeMemory = gpus[i].TotalMemory - usedMemory
+		freeMemory := gpus[i].TotalMemory - usedMemory
+		if gpus[i].UnifiedMemory {
+			gttUsed, err := getFreeMemory(gpus[i].gttUsedFilepath)
+			if err != nil {
+				return err
+			}
+			systemMem, err := GetCPUMem()
+			if err != nil {
+				return err
+			}
+			freeMemory = unifiedFreeMemory(gpus[i].TotalMemory-gpus[i].gttTotal, usedMemory, gpus[i].gttTotal, gttUsed, systemMem.FreeMemory)
+		}
+		slog.Debug("updating rocm free memory", "gpu", gpus[i].ID, "name", gpus[i].Name, "before", format.HumanBytes2(gpus[i].FreeMemory), "now", format.HumanBytes2(freeMemory))
+		gpus[i].FreeMemory = freeMemory
 	}
 	return nil
 }
 
+// unifiedFreeMemory returns how much an APU can still allocate, the free part of its
+// VRAM carve out plus the free part of the GTT, which is limited by the free system memory
+func unifiedFreeMemory(vramTotal, vramUsed, gttTotal, gttUsed, systemFree uint64) uint64 {
+	var free uint64
+	if vramUsed < vramTotal {
+		free = vramTotal - vramUsed
+	}
+	if gttUsed < gttTotal {
+		free += min(gttTotal-gttUsed, systemFree)
+	}
+	return free
+}
+
 func getFreeMemory(usedFile string) (uint64, error) {
 	buf, err := os.ReadFile(usedFile)
 	if err != nil {
@@ -522,6 +588,45 @@ func verifyKFDDriverAccess() error {
 	return nil
 }
 
+// thermals reads the temperature and power draw from the hwmon nodes of the
+// DRM device backing each GPU
+func (gpus RocmGPUInfoList) thermals() []GpuThermal {
+	var thermals []GpuThermal
+	for _, gpu := range gpus {
+		hwmons, _ := filepath.Glob(filepath.Join(filepath.Dir(gpu.usedFilepath), "hwmon", "hwmon*"))
+		if len(hwmons) == 0 {
+			continue
+		}
+
+		thermal := GpuThermal{ID: gpu.ID, Library: gpu.Library}
+		// temperature is reported in millidegrees
+		if temp, err := readSysfsUint(filepath.Join(hwmons[0], "temp1_input")); err == nil {
+			thermal.Temperature = temp / 1000
+		}
+
+		// power is reported in microwatts, as an average on older kernels
+		for _, name := range []string{"power1_average", "power1_input"} {
+			if power, err := readSysfsUint(filepath.Join(hwmons[0], name)); err == nil {
+				thermal.Power = power / 1000
+				break
+			}
+		}
+
+		thermals = append(thermals, thermal)
+	}
+
+	return thermals
+}
+
+func readSysfsUint(filename string) (uint64, error) {
+	buf, err := os.ReadFile(filename)
+	if err != nil {
+		return 0, err
+	}
+
+	return strconv.ParseUint(strings.TrimSpace(string(buf)), 10, 64)
+}
+
 func rocmGetVisibleDevicesEnv(gpuInfo []GpuInfo) (string, string) {
 	ids := []string{}
 	for _, info := range gpuInfo {
@@ -0,0 +1,28 @@
+package discover
+
+import (
+	"testing"
+
+	"github.com/ollama/ollama/format"
+)
+
+func TestUnifiedFreeMemory(t *testing.T) {
+	cases := []struct {
+		name                                               string
+		vramTotal, vramUsed, gttTotal, gttUsed, systemFree uint64
+		expect                                             uint64
+	}{
+		{"idle", 512 * format.MebiByte, 0, 16 * format.GibiByte, 0, 30 * format.GibiByte, 16*format.GibiByte + 512*format.MebiByte},
+		{"partly used", 512 * format.MebiByte, 256 * format.MebiByte, 16 * format.GibiByte, 4 * format.GibiByte, 30 * format.GibiByte, 12*format.GibiByte + 256*format.MebiByte},
+		{"limited by system", 512 * format.MebiByte, 0, 16 * format.GibiByte, 0, 2 * format.GibiByte, 2*format.GibiByte + 512*format.MebiByte},
+		{"over used", 512 * format.MebiByte, format.GibiByte, 16 * format.GibiByte, 17 * format.GibiByte, 30 * format.GibiByte, 0},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			if actual := unifiedFreeMemory(tt.vramTotal, tt.vramUsed, tt.gttTotal, tt.gttUsed, tt.systemFree); actual != tt.expect {
+				t.Errorf("expected %s free, got %s", format.HumanBytes2(tt.expect), format.HumanBytes2(actual))
+			}
+		})
+	}
+}
@@ -177,6 +177,11 @@ func AMDValidateLibDir() (string, error) {
 	return "", errors.New("no suitable rocm found, falling back to CPU")
 }
 
+// thermals is not supported on windows
+func (gpus RocmGPUInfoList) thermals() []GpuThermal {
+	return nil
+}
+
 func (gpus RocmGPUInfoList) RefreshFreeMemory() error {
 	if len(gpus) == 0 {
 		return nil
@@ -23,6 +23,7 @@ import (
 
 	"github.com/ollama/ollama/envconfig"
 	"github.com/ollama/ollama/format"
+	"github.com/ollama/ollama/logutil"
 	"github.com/ollama/ollama/runners"
 )
 
@@ -369,11 +370,7 @@ func GetGPUInfo() GpuInfoList {
 						}
 						// TODO - split bootstrapping from updating free memory
 						C.oneapi_check_vram(*oHandles.oneapi, C.int(d), i, &memInfo)
-						// TODO - convert this to MinimumMemory based on testing...
-						var totalFreeMem float64 = float64(memInfo.free) * 0.95 // work-around: leave some reserve vram for mkl lib used in ggml-sycl backend.
-						memInfo.free = C.uint64_t(totalFreeMem)
-						gpuInfo.TotalMemory = uint64(memInfo.total)
-						gpuInfo.FreeMemory = uint64(memInfo.free)
+						gpuInfo.updateMemory(memInfo)
 						gpuInfo.ID = C.GoString(&memInfo.gpu_id[0])
 						gpuInfo.Name = C.GoString(&memInfo.gpu_name[0])
 						gpuInfo.DependencyPath = depPaths
@@ -482,10 +479,7 @@ func GetGPUInfo() GpuInfoList {
 				continue
 			}
 			C.oneapi_check_vram(*oHandles.oneapi, C.int(gpu.driverIndex), C.int(gpu.gpuIndex), &memInfo)
-			// TODO - convert this to MinimumMemory based on testing...
-			var totalFreeMem float64 = float64(memInfo.free) * 0.95 // work-around: leave some reserve vram for mkl lib used in ggml-sycl backend.
-			memInfo.free = C.uint64_t(totalFreeMem)
-			oneapiGPUs[i].FreeMemory = uint64(memInfo.free)
+			oneapiGPUs[i].updateMemory(memInfo)
 		}
 
 		err = RocmGPUInfoList(rocmGPUs).RefreshFreeMemory()
@@ -510,6 +504,51 @@ func GetGPUInfo() GpuInfoList {
 	return resp
 }
 
+var (
+	// management library used for NVIDIA sensor readings, loaded on first use
+	thermalNVML       *C.nvml_handle_t
+	thermalNVMLLoaded bool
+)
+
+// GetGPUThermals returns the current temperature and power draw of the
+// discovered GPUs which support it. NVIDIA GPUs are read through the management
+// library and AMD GPUs through the amdgpu hwmon sysfs nodes.
+func GetGPUThermals() []GpuThermal {
+	gpuMutex.Lock()
+	defer gpuMutex.Unlock()
+	if !bootstrapped {
+		return nil
+	}
+
+	var thermals []GpuThermal
+	if len(cudaGPUs) > 0 && !thermalNVMLLoaded {
+		thermalNVMLLoaded = true
+		if libPaths := FindGPULibs(NvmlThermalName, NvmlThermalGlobs); len(libPaths) > 0 {
+			thermalNVML, _, _ = loadNVMLMgmt(libPaths)
+		}
+		if thermalNVML == nil {
+			slog.Info("nvidia-ml not found, GPU temperature and power readings unavailable")
+		}
+	}
+
+	if thermalNVML != nil {
+		for _, gpu := range cudaGPUs {
+			var temp, power C.uint
+			uuid := C.CString(gpu.ID)
+			C.nvml_get_thermal(*thermalNVML, uuid, &temp, &power)
+			C.free(unsafe.Pointer(uuid))
+			thermals = append(thermals, GpuThermal{
+				ID:          gpu.ID,
+				Library:     gpu.Library,
+				Temperature: uint64(temp),
+				Power:       uint64(power),
+			})
+		}
+	}
+
+	return append(thermals, RocmGPUInfoList(rocmGPUs).thermals()...)
+}
+
 func FindGPULibs(baseLibName string, defaultPatterns []string) []string {
 	// Multiple GPU libraries may exist, and some may not work, so keep trying until we exhaust them
 	var ldPaths []string
@@ -688,8 +727,30 @@ func loadOneapiMgmt(oneapiLibPaths []string) (int, *C.oneapi_handle_t, string, e
 	return 0, nil, "", err
 }
 
+// updateMemory sets the memory of an Intel GPU from what Level Zero reported. Integrated
+// GPUs share system memory, which Level Zero doesn't always report, so it's bounded by
+// what the system has available instead.
+func (gpu *OneapiGPUInfo) updateMemory(memInfo C.mem_info_t) {
+	total, free := uint64(memInfo.total), uint64(memInfo.free)
+	if memInfo.integrated != 0 {
+		gpu.UnifiedMemory = true
+		if mem, err := GetCPUMem(); err == nil {
+			if total == 0 {
+				total, free = mem.TotalMemory, mem.FreeMemory
+			}
+			free = min(free, mem.FreeMemory)
+		} else {
+			slog.Debug("failed to read system memory", "error", err)
+		}
+	}
+
+	// TODO - convert this to MinimumMemory based on testing...
+	gpu.TotalMemory = total
+	gpu.FreeMemory = uint64(float64(free) * 0.95) // work-around: leave some reserve vram for mkl lib used in ggml-sycl backend.
+}
+
 func getVerboseState() C.uint16_t {
-	if envconfig.Debug() {
+	if logutil.Enabled(logutil.ML, slog.LevelDebug) {
 		return C.uint16_t(1)
 	}
 	return C.uint16_t(0)
@@ -46,6 +46,11 @@ func GetGPUInfo() GpuInfoList {
 	return []GpuInfo{info}
 }
 
+// GetGPUThermals is not supported on darwin
+func GetGPUThermals() []GpuThermal {
+	return nil
+}
+
 func GetCPUInfo() GpuInfoList {
 	mem, _ := GetCPUMem()
 	return []GpuInfo{
@@ -48,6 +48,7 @@ typedef struct mem_info {
   uint64_t total;
   uint64_t free;
   uint64_t used;
+  int integrated;  // memory is shared with the system
 
   // Compute Capability
   int major; 
@@ -19,6 +19,8 @@ void nvml_init(char *nvml_lib_path, nvml_init_resp_t *resp) {
       {"nvmlShutdown", (void *)&resp->ch.nvmlShutdown},
       {"nvmlDeviceGetHandleByUUID", (void *)&resp->ch.nvmlDeviceGetHandleByUUID},
       {"nvmlDeviceGetMemoryInfo", (void *)&resp->ch.nvmlDeviceGetMemoryInfo},
+      {"nvmlDeviceGetTemperature", (void *)&resp->ch.nvmlDeviceGetTemperature},
+      {"nvmlDeviceGetPowerUsage", (void *)&resp->ch.nvmlDeviceGetPowerUsage},
       {NULL, NULL},
   };
 
@@ -89,6 +91,31 @@ void nvml_get_free(nvml_handle_t h, char *uuid, uint64_t *free, uint64_t *total,
     *used = memInfo.used;
 }
 
+void nvml_get_thermal(nvml_handle_t h, char *uuid, unsigned int *temp, unsigned int *power) {
+    nvmlDevice_t device;
+    nvmlReturn_t ret;
+    *temp = 0;
+    *power = 0;
+    ret = (*h.nvmlDeviceGetHandleByUUID)((const char *)(uuid), &device);
+    if (ret != NVML_SUCCESS) {
+        LOG(1, "unable to get device handle %s: %d", uuid, ret);
+        return;
+    }
+
+    ret = (*h.nvmlDeviceGetTemperature)(device, NVML_TEMPERATURE_GPU, temp);
+    if (ret != NVML_SUCCESS) {
+        LOG(h.verbose, "device temperature lookup failure %s: %d", uuid, ret);
+        *temp = 0;
+    }
+
+    // power usage is reported in milliwatts
+    ret = (*h.nvmlDeviceGetPowerUsage)(device, power);
+    if (ret != NVML_SUCCESS) {
+        LOG(h.verbose, "device power lookup failure %s: %d", uuid, ret);
+        *power = 0;
+    }
+}
+
 
 void nvml_release(nvml_handle_t h) {
   LOG(h.verbose, "releasing nvml library\n");
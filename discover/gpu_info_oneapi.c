@@ -146,6 +146,7 @@ void oneapi_check_vram(oneapi_handle_t h, int driver, int device,
 
   resp->total = 0;
   resp->free = 0;
+  resp->integrated = 0;
 
   zes_device_ext_properties_t ext_props;
   ext_props.stype = ZES_STRUCTURE_TYPE_DEVICE_EXT_PROPERTIES;
@@ -163,6 +164,7 @@ void oneapi_check_vram(oneapi_handle_t h, int driver, int device,
   }
 
   snprintf(&resp->gpu_name[0], GPU_NAME_LEN, "%s", props.modelName);
+  resp->integrated = (props.core.flags & ZE_DEVICE_PROPERTY_FLAG_INTEGRATED) != 0;
 
   // TODO this needs to map to ONEAPI_DEVICE_SELECTOR syntax
   // (this is probably wrong...)
@@ -30,6 +30,15 @@ var CudartGlobs = []string{
 
 var NvmlGlobs = []string{}
 
+// The management library is only used for sensor readings on linux
+var NvmlThermalGlobs = []string{
+	"/usr/lib/*-linux-gnu/nvidia/current/libnvidia-ml.so*",
+	"/usr/lib/*-linux-gnu/libnvidia-ml.so*",
+	"/usr/lib/wsl/lib/libnvidia-ml.so*",
+	"/usr/lib*/libnvidia-ml.so*",
+	"/usr/local/lib*/libnvidia-ml.so*",
+}
+
 var NvcudaGlobs = []string{
 	"/usr/local/cuda*/targets/*/lib/libcuda.so*",
 	"/usr/lib/*-linux-gnu/nvidia/current/libcuda.so*",
@@ -48,10 +57,11 @@ var OneapiGlobs = []string{
 }
 
 var (
-	CudartMgmtName = "libcudart.so*"
-	NvcudaMgmtName = "libcuda.so*"
-	NvmlMgmtName   = "" // not currently wired on linux
-	OneapiMgmtName = "libze_intel_gpu.so*"
+	CudartMgmtName  = "libcudart.so*"
+	NvcudaMgmtName  = "libcuda.so*"
+	NvmlMgmtName    = "" // not currently wired on linux
+	NvmlThermalName = "libnvidia-ml.so*"
+	OneapiMgmtName  = "libze_intel_gpu.so*"
 )
 
 func GetCPUMem() (memInfo, error) {
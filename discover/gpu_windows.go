@@ -34,6 +34,8 @@ var NvmlGlobs = []string{
 	"c:\\Windows\\System32\\nvml.dll",
 }
 
+var NvmlThermalGlobs = NvmlGlobs
+
 var NvcudaGlobs = []string{
 	"c:\\windows\\system*\\nvcuda.dll",
 }
@@ -43,10 +45,11 @@ var OneapiGlobs = []string{
 }
 
 var (
-	CudartMgmtName = "cudart64_*.dll"
-	NvcudaMgmtName = "nvcuda.dll"
-	NvmlMgmtName   = "nvml.dll"
-	OneapiMgmtName = "ze_intel_gpu64.dll"
+	CudartMgmtName  = "cudart64_*.dll"
+	NvcudaMgmtName  = "nvcuda.dll"
+	NvmlMgmtName    = "nvml.dll"
+	NvmlThermalName = "nvml.dll"
+	OneapiMgmtName  = "ze_intel_gpu64.dll"
 )
 
 func GetCPUMem() (memInfo, error) {
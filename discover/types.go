@@ -36,6 +36,10 @@ type GpuInfo struct { // TODO better name maybe "InferenceProcessor"?
 	// False indicates FreeMemory can generally be trusted on this GPU
 	UnreliableFreeMemory bool
 
+	// Set to true if the GPU allocates from system memory rather than dedicated VRAM,
+	// as on APUs, so memory used on the GPU is no longer available to the system
+	UnifiedMemory bool `json:"unified_memory,omitempty"`
+
 	// GPU information
 	ID      string `json:"gpu_id"`  // string to use for selection of this specific GPU
 	Name    string `json:"name"`    // user friendly name if available
@@ -81,8 +85,10 @@ type CudaGPUInfoList []CudaGPUInfo
 
 type RocmGPUInfo struct {
 	GpuInfo
-	usedFilepath string //nolint:unused,nolintlint
-	index        int    //nolint:unused,nolintlint
+	usedFilepath    string //nolint:unused,nolintlint
+	gttUsedFilepath string //nolint:unused,nolintlint
+	gttTotal        uint64 //nolint:unused,nolintlint
+	index           int    //nolint:unused,nolintlint
 }
 type RocmGPUInfoList []RocmGPUInfo
 
@@ -100,6 +106,19 @@ type UnsupportedGPUInfo struct {
 	Reason string `json:"reason"`
 }
 
+// GpuThermal is a point in time sensor reading for a GPU. Readings which
+// aren't supported by the device or driver are zero.
+type GpuThermal struct {
+	ID      string
+	Library string
+
+	// Temperature in degrees Celsius
+	Temperature uint64
+
+	// Power draw in milliwatts
+	Power uint64
+}
+
 // Split up the set of gpu info's by Library and variant
 func (l GpuInfoList) ByLibrary() []GpuInfoList {
 	resp := []GpuInfoList{}
@@ -28,6 +28,8 @@ func Host() *url.URL {
 		defaultPort = "80"
 	case scheme == "https":
 		defaultPort = "443"
+	case scheme == "unix":
+		return &url.URL{Scheme: scheme, Path: hostport}
 	}
 
 	hostport, path, _ := strings.Cut(hostport, "/")
@@ -78,6 +80,18 @@ func Origins() (origins []string) {
 	return origins
 }
 
+// MetricsMetadata returns the request metadata keys added as labels to usage metrics. MetricsMetadata can be configured via the OLLAMA_METRICS_METADATA environment variable as a comma separated list.
+// Metadata isn't added to metrics by default, since each distinct value adds a series.
+func MetricsMetadata() (keys []string) {
+	for _, k := range strings.Split(Var("OLLAMA_METRICS_METADATA"), ",") {
+		if k = strings.TrimSpace(k); k != "" {
+			keys = append(keys, k)
+		}
+	}
+
+	return keys
+}
+
 // Models returns the path to the models directory. Models directory can be configured via the OLLAMA_MODELS environment variable.
 // Default is $HOME/.ollama/models
 func Models() string {
@@ -93,6 +107,21 @@ func Models() string {
 	return filepath.Join(home, ".ollama", "models")
 }
 
+// Sessions returns the directory where the KV caches of chat sessions are saved. Sessions directory can be configured via the OLLAMA_SESSIONS environment variable.
+// Default is $HOME/.ollama/sessions
+func Sessions() string {
+	if s := Var("OLLAMA_SESSIONS"); s != "" {
+		return s
+	}
+
+	home, err := os.UserHomeDir()
+	if err != nil {
+		panic(err)
+	}
+
+	return filepath.Join(home, ".ollama", "sessions")
+}
+
 // KeepAlive returns the duration that models stay loaded in memory. KeepAlive can be configured via the OLLAMA_KEEP_ALIVE environment variable.
 // Negative values are treated as infinite. Zero is treated as no keep alive.
 // Default is 5 minutes.
@@ -133,6 +162,57 @@ func LoadTimeout() (loadTimeout time.Duration) {
 	return loadTimeout
 }
 
+// BatchTuning returns the micro-batch sizes prompt throughput is measured at when a model is first loaded on a GPU, to choose the fastest. BatchTuning can be configured via the OLLAMA_BATCH_TUNING environment variable as a comma separated list.
+// Invalid sizes are ignored.
+// Default is no tuning.
+func BatchTuning() (sizes []int) {
+	for _, s := range strings.Split(Var("OLLAMA_BATCH_TUNING"), ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+
+		if n, err := strconv.Atoi(s); err != nil || n <= 0 {
+			slog.Warn("invalid batch size, ignoring", "key", "OLLAMA_BATCH_TUNING", "value", s)
+		} else {
+			sizes = append(sizes, n)
+		}
+	}
+
+	return sizes
+}
+
+// GpuOverhead returns the VRAM in bytes to set aside on the GPU with the given ID. GpuOverhead can be configured via the OLLAMA_GPU_OVERHEAD environment variable as an amount for every GPU, or a comma separated list of id=amount for each GPU, where an amount without an ID applies to the rest.
+// Default is 0.
+func GpuOverhead(id string) (overhead uint64) {
+	for _, s := range strings.Split(Var("OLLAMA_GPU_OVERHEAD"), ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+
+		k, v, ok := strings.Cut(s, "=")
+		if !ok {
+			k, v = "", s
+		}
+
+		n, err := strconv.ParseUint(strings.TrimSpace(v), 10, 64)
+		if err != nil {
+			slog.Warn("invalid GPU overhead, ignoring", "key", "OLLAMA_GPU_OVERHEAD", "value", s)
+			continue
+		}
+
+		switch strings.TrimSpace(k) {
+		case id:
+			return n
+		case "":
+			overhead = n
+		}
+	}
+
+	return overhead
+}
+
 func Bool(k string) func() bool {
 	return func() bool {
 		if s := Var(k); s != "" {
@@ -159,12 +239,60 @@ var (
 	NoHistory = Bool("OLLAMA_NOHISTORY")
 	// NoPrune disables pruning of model blobs on startup.
 	NoPrune = Bool("OLLAMA_NOPRUNE")
+	// ReadOnly treats the models directory as read only, refusing requests that pull, create, copy or delete models.
+	ReadOnly = Bool("OLLAMA_READ_ONLY")
 	// SchedSpread allows scheduling models across all GPUs.
 	SchedSpread = Bool("OLLAMA_SCHED_SPREAD")
+	// FitContext reduces the context length of a model that doesn't fit in GPU memory rather than offloading it to the CPU.
+	FitContext = Bool("OLLAMA_FIT_CONTEXT")
+	// SplitFFN keeps the feed-forward weights of some layers of a model that doesn't fit in GPU memory on the CPU, rather than offloading fewer whole layers.
+	SplitFFN = Bool("OLLAMA_SPLIT_FFN")
+	// WarmUp runs a short generation after loading a model so the first request doesn't wait for kernel compilation and memory allocation.
+	WarmUp = Bool("OLLAMA_WARMUP")
 	// IntelGPU enables experimental Intel GPU detection.
 	IntelGPU = Bool("OLLAMA_INTEL_GPU")
 	// MultiUserCache optimizes prompt caching for multi-user scenarios
 	MultiUserCache = Bool("OLLAMA_MULTIUSER_CACHE")
+	// Schedule lists time-based policies such as quiet hours and scheduled preloads.
+	Schedule = String("OLLAMA_SCHEDULE")
+	// EndpointLimits lists the concurrency and queue limits of completion, embedding and model management requests.
+	EndpointLimits = String("OLLAMA_ENDPOINT_LIMITS")
+	// EmbeddingDevice sets aside "cpu" or the GPU with this ID for embedding models, so they don't unload completion models.
+	EmbeddingDevice = String("OLLAMA_EMBEDDING_DEVICE")
+	// LogLevel sets the log level of the server and of its subsystems.
+	LogLevel = String("OLLAMA_LOG_LEVEL")
+	// PrivateLogs replaces prompts, responses and other request content in logs with their hashes and lengths.
+	PrivateLogs = Bool("OLLAMA_PRIVATE_LOGS")
+	// Sandbox runs model runners with reduced privileges, without network access and with read only access to the files they need.
+	Sandbox = Bool("OLLAMA_SANDBOX")
+	// SandboxUser is the user sandboxed runners run as when the server runs as root and the model is owned by root.
+	SandboxUser = String("OLLAMA_SANDBOX_USER")
+	// TLS enables TLS with automatically generated certificates when no certificate is provided.
+	TLS = Bool("OLLAMA_TLS")
+	// TLSCert is the path of the server's TLS certificate.
+	TLSCert = String("OLLAMA_TLS_CERT")
+	// TLSKey is the path of the server's TLS private key.
+	TLSKey = String("OLLAMA_TLS_KEY")
+	// TLSCA is the path of an additional CA certificate clients trust when connecting over https.
+	TLSCA = String("OLLAMA_TLS_CA")
+	// TLSClientCert is the path of the certificate clients present when connecting over https.
+	TLSClientCert = String("OLLAMA_TLS_CLIENT_CERT")
+	// TLSClientKey is the path of the private key for TLSClientCert.
+	TLSClientKey = String("OLLAMA_TLS_CLIENT_KEY")
+	// TLSClientCA is the path of the CA certificates client certificates are verified against, enabling mutual TLS.
+	TLSClientCA = String("OLLAMA_TLS_CLIENT_CA")
+	// TLSClientPolicy is the path of a JSON file mapping client certificate identities to the scopes they're allowed.
+	TLSClientPolicy = String("OLLAMA_TLS_CLIENT_POLICY")
+	// Policy is the path of a JSON file restricting the models clients can use and the endpoints they can call.
+	Policy = String("OLLAMA_POLICY")
+	// APIKey is the key clients send to servers with tenants.
+	APIKey = String("OLLAMA_API_KEY")
+	// Tenants is the path of a JSON file of tenants, their API keys and their storage and VRAM limits.
+	Tenants = String("OLLAMA_TENANTS")
+	// Upstreams is the path of a JSON file of OpenAI compatible APIs that chat requests for matching models are proxied to.
+	Upstreams = String("OLLAMA_UPSTREAMS")
+	// ServerID names the server in the affinity tokens load balancers route requests by. It defaults to the hostname.
+	ServerID = String("OLLAMA_SERVER_ID")
 )
 
 func String(s string) func() string {
@@ -206,6 +334,20 @@ var (
 	MaxQueue = Uint("OLLAMA_MAX_QUEUE", 512)
 	// MaxVRAM sets a maximum VRAM override in bytes. MaxVRAM can be configured via the OLLAMA_MAX_VRAM environment variable.
 	MaxVRAM = Uint("OLLAMA_MAX_VRAM", 0)
+	// MaxRawOutput sets the maximum number of values returned by a raw logits or hidden states request. MaxRawOutput can be configured via the OLLAMA_MAX_RAW_OUTPUT environment variable.
+	MaxRawOutput = Uint("OLLAMA_MAX_RAW_OUTPUT", 262144)
+	// GpuTempLimit sets the GPU temperature in degrees Celsius above which generation is throttled. GpuTempLimit can be configured via the OLLAMA_GPU_TEMP_LIMIT environment variable.
+	GpuTempLimit = Uint("OLLAMA_GPU_TEMP_LIMIT", 0)
+	// GpuPowerLimit sets the GPU power draw in watts above which generation is throttled. GpuPowerLimit can be configured via the OLLAMA_GPU_POWER_LIMIT environment variable.
+	GpuPowerLimit = Uint("OLLAMA_GPU_POWER_LIMIT", 0)
+	// PrefixCache sets the number of tokens of each runner's KV cache kept for prompt prefixes shared between requests, such as system prompts. PrefixCache can be configured via the OLLAMA_PREFIX_CACHE environment variable.
+	PrefixCache = Uint("OLLAMA_PREFIX_CACHE", 0)
+	// MaxAdapters sets the number of LoRA adapters each runner keeps loaded for requests before unloading the least recently used. MaxAdapters can be configured via the OLLAMA_MAX_ADAPTERS environment variable.
+	MaxAdapters = Uint("OLLAMA_MAX_ADAPTERS", 4)
+	// SessionMemory sets the number of tokens of a chat session's history above which its older turns are summarized into a memory of the session, which is saved so sessions are restored after a restart. SessionMemory can be configured via the OLLAMA_SESSION_MEMORY environment variable.
+	SessionMemory = Uint("OLLAMA_SESSION_MEMORY", 0)
+	// MaxSessions sets the number of chat sessions each client keeps before the least recently used is deleted. Zero is treated as no limit. MaxSessions can be configured via the OLLAMA_MAX_SESSIONS environment variable.
+	MaxSessions = Uint("OLLAMA_MAX_SESSIONS", 64)
 )
 
 func Uint64(key string, defaultValue uint64) func() uint64 {
@@ -222,8 +364,10 @@ func Uint64(key string, defaultValue uint64) func() uint64 {
 	}
 }
 
-// Set aside VRAM per GPU
-var GpuOverhead = Uint64("OLLAMA_GPU_OVERHEAD", 0)
+var (
+	// MaxRequestSize sets the largest request body in bytes the server accepts, other than blob uploads. Zero means no limit.
+	MaxRequestSize = Uint64("OLLAMA_MAX_REQUEST_SIZE", 0)
+)
 
 type EnvVar struct {
 	Name        string
@@ -233,23 +377,57 @@ type EnvVar struct {
 
 func AsMap() map[string]EnvVar {
 	ret := map[string]EnvVar{
-		"OLLAMA_DEBUG":             {"OLLAMA_DEBUG", Debug(), "Show additional debug information (e.g. OLLAMA_DEBUG=1)"},
+		"OLLAMA_BATCH_TUNING":      {"OLLAMA_BATCH_TUNING", BatchTuning(), "Micro-batch sizes to measure prompt throughput at when first loading a model (e.g. \"128,256,512\")"},
+		"OLLAMA_DEBUG":             {"OLLAMA_DEBUG", Debug(), "Show additional debug information, the same as OLLAMA_LOG_LEVEL=debug (e.g. OLLAMA_DEBUG=1)"},
+		"OLLAMA_EMBEDDING_DEVICE":  {"OLLAMA_EMBEDDING_DEVICE", EmbeddingDevice(), "Load embedding models on \"cpu\" or the GPU with this ID, without unloading completion models"},
+		"OLLAMA_ENDPOINT_LIMITS":   {"OLLAMA_ENDPOINT_LIMITS", EndpointLimits(), "Concurrency and queue limits per endpoint class (e.g. \"completion=4/16,embedding=2/64\")"},
 		"OLLAMA_FLASH_ATTENTION":   {"OLLAMA_FLASH_ATTENTION", FlashAttention(), "Enabled flash attention"},
 		"OLLAMA_KV_CACHE_TYPE":     {"OLLAMA_KV_CACHE_TYPE", KvCacheType(), "Quantization type for the K/V cache (default: f16)"},
-		"OLLAMA_GPU_OVERHEAD":      {"OLLAMA_GPU_OVERHEAD", GpuOverhead(), "Reserve a portion of VRAM per GPU (bytes)"},
+		"OLLAMA_GPU_OVERHEAD":      {"OLLAMA_GPU_OVERHEAD", Var("OLLAMA_GPU_OVERHEAD"), "Reserve a portion of VRAM per GPU in bytes, for all GPUs or by GPU ID (e.g. \"1073741824\" or \"GPU-4b5c=536870912,0\")"},
+		"OLLAMA_GPU_POWER_LIMIT":   {"OLLAMA_GPU_POWER_LIMIT", GpuPowerLimit(), "Throttle generation when GPU power draw exceeds this limit (watts)"},
+		"OLLAMA_GPU_TEMP_LIMIT":    {"OLLAMA_GPU_TEMP_LIMIT", GpuTempLimit(), "Throttle generation when GPU temperature exceeds this limit (degrees Celsius)"},
 		"OLLAMA_HOST":              {"OLLAMA_HOST", Host(), "IP Address for the ollama server (default 127.0.0.1:11434)"},
 		"OLLAMA_KEEP_ALIVE":        {"OLLAMA_KEEP_ALIVE", KeepAlive(), "The duration that models stay loaded in memory (default \"5m\")"},
 		"OLLAMA_LLM_LIBRARY":       {"OLLAMA_LLM_LIBRARY", LLMLibrary(), "Set LLM library to bypass autodetection"},
 		"OLLAMA_LOAD_TIMEOUT":      {"OLLAMA_LOAD_TIMEOUT", LoadTimeout(), "How long to allow model loads to stall before giving up (default \"5m\")"},
+		"OLLAMA_LOG_LEVEL":         {"OLLAMA_LOG_LEVEL", LogLevel(), "Log level of the server and its subsystems (e.g. \"info,scheduler=debug\")"},
+		"OLLAMA_PRIVATE_LOGS":      {"OLLAMA_PRIVATE_LOGS", PrivateLogs(), "Never log request content, only its hash and length"},
+		"OLLAMA_MAX_ADAPTERS":      {"OLLAMA_MAX_ADAPTERS", MaxAdapters(), "Maximum number of LoRA adapters kept loaded per model"},
 		"OLLAMA_MAX_LOADED_MODELS": {"OLLAMA_MAX_LOADED_MODELS", MaxRunners(), "Maximum number of loaded models per GPU"},
 		"OLLAMA_MAX_QUEUE":         {"OLLAMA_MAX_QUEUE", MaxQueue(), "Maximum number of queued requests"},
+		"OLLAMA_MAX_REQUEST_SIZE":  {"OLLAMA_MAX_REQUEST_SIZE", MaxRequestSize(), "Maximum size of request bodies in bytes (default: no limit)"},
+		"OLLAMA_MAX_RAW_OUTPUT":    {"OLLAMA_MAX_RAW_OUTPUT", MaxRawOutput(), "Maximum number of values returned for raw logits or hidden states"},
+		"OLLAMA_METRICS_METADATA":  {"OLLAMA_METRICS_METADATA", MetricsMetadata(), "A comma separated list of request metadata keys to label usage metrics with"},
 		"OLLAMA_MODELS":            {"OLLAMA_MODELS", Models(), "The path to the models directory"},
 		"OLLAMA_NOHISTORY":         {"OLLAMA_NOHISTORY", NoHistory(), "Do not preserve readline history"},
 		"OLLAMA_NOPRUNE":           {"OLLAMA_NOPRUNE", NoPrune(), "Do not prune model blobs on startup"},
+		"OLLAMA_READ_ONLY":         {"OLLAMA_READ_ONLY", ReadOnly(), "Treat the models directory as read only, refusing to pull, create, copy or delete models"},
 		"OLLAMA_NUM_PARALLEL":      {"OLLAMA_NUM_PARALLEL", NumParallel(), "Maximum number of parallel requests"},
 		"OLLAMA_ORIGINS":           {"OLLAMA_ORIGINS", Origins(), "A comma separated list of allowed origins"},
 		"OLLAMA_SCHED_SPREAD":      {"OLLAMA_SCHED_SPREAD", SchedSpread(), "Always schedule model across all GPUs"},
+		"OLLAMA_FIT_CONTEXT":       {"OLLAMA_FIT_CONTEXT", FitContext(), "Reduce the context length of models that don't fit in GPU memory"},
+		"OLLAMA_SPLIT_FFN":         {"OLLAMA_SPLIT_FFN", SplitFFN(), "Offload the attention of every layer of models that don't fit in GPU memory, keeping feed-forward weights on the CPU"},
+		"OLLAMA_WARMUP":            {"OLLAMA_WARMUP", WarmUp(), "Run a short generation after loading a model to speed up its first request"},
+		"OLLAMA_SCHEDULE":          {"OLLAMA_SCHEDULE", Schedule(), "Time-based policies (e.g. \"quiet 09:00-17:00; preload 08:45 llama3.2\")"},
 		"OLLAMA_MULTIUSER_CACHE":   {"OLLAMA_MULTIUSER_CACHE", MultiUserCache(), "Optimize prompt caching for multi-user scenarios"},
+		"OLLAMA_PREFIX_CACHE":      {"OLLAMA_PREFIX_CACHE", PrefixCache(), "Tokens of KV cache kept for prompt prefixes shared between requests"},
+		"OLLAMA_SESSIONS":          {"OLLAMA_SESSIONS", Sessions(), "The directory where the KV caches of chat sessions are saved"},
+		"OLLAMA_SESSION_MEMORY":    {"OLLAMA_SESSION_MEMORY", SessionMemory(), "Tokens of chat session history above which older turns are summarized into a saved memory"},
+		"OLLAMA_MAX_SESSIONS":      {"OLLAMA_MAX_SESSIONS", MaxSessions(), "Maximum number of chat sessions per client (default: 64)"},
+		"OLLAMA_SANDBOX":           {"OLLAMA_SANDBOX", Sandbox(), "Run model runners with reduced privileges and no network access (linux only)"},
+		"OLLAMA_SANDBOX_USER":      {"OLLAMA_SANDBOX_USER", SandboxUser(), "User to run sandboxed runners as for models owned by root (default: nobody)"},
+		"OLLAMA_TLS":               {"OLLAMA_TLS", TLS(), "Serve over TLS with automatically generated local certificates"},
+		"OLLAMA_TLS_CERT":          {"OLLAMA_TLS_CERT", TLSCert(), "Path of the TLS certificate to serve with"},
+		"OLLAMA_TLS_KEY":           {"OLLAMA_TLS_KEY", TLSKey(), "Path of the TLS private key to serve with"},
+		"OLLAMA_TLS_CA":            {"OLLAMA_TLS_CA", TLSCA(), "Path of an additional CA certificate to trust for https hosts"},
+		"OLLAMA_TLS_CLIENT_CERT":   {"OLLAMA_TLS_CLIENT_CERT", TLSClientCert(), "Path of the certificate to present to https hosts"},
+		"OLLAMA_TLS_CLIENT_KEY":    {"OLLAMA_TLS_CLIENT_KEY", TLSClientKey(), "Path of the private key for OLLAMA_TLS_CLIENT_CERT"},
+		"OLLAMA_TLS_CLIENT_CA":     {"OLLAMA_TLS_CLIENT_CA", TLSClientCA(), "Require client certificates signed by these CA certificates"},
+		"OLLAMA_TLS_CLIENT_POLICY": {"OLLAMA_TLS_CLIENT_POLICY", TLSClientPolicy(), "Path of a JSON file mapping client certificate identities to allowed scopes"},
+		"OLLAMA_POLICY":            {"OLLAMA_POLICY", Policy(), "Path of a JSON file restricting models and endpoints"},
+		"OLLAMA_TENANTS":           {"OLLAMA_TENANTS", Tenants(), "Path of a JSON file of tenants, their API keys and quotas"},
+		"OLLAMA_UPSTREAMS":         {"OLLAMA_UPSTREAMS", Upstreams(), "Path of a JSON file of OpenAI compatible APIs to proxy chat requests to"},
+		"OLLAMA_SERVER_ID":         {"OLLAMA_SERVER_ID", ServerID(), "The name of the server in affinity tokens (default: hostname)"},
 
 		// Informational
 		"HTTP_PROXY":  {"HTTP_PROXY", String("HTTP_PROXY")(), "HTTP proxy"},
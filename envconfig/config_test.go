@@ -2,6 +2,7 @@ package envconfig
 
 import (
 	"math"
+	"slices"
 	"testing"
 	"time"
 
@@ -35,6 +36,7 @@ func TestHost(t *testing.T) {
 		"https":               {"https://1.2.3.4", "https://1.2.3.4:443"},
 		"https port":          {"https://1.2.3.4:4321", "https://1.2.3.4:4321"},
 		"proxy path":          {"https://example.com/ollama", "https://example.com:443/ollama"},
+		"unix socket":         {"unix:///run/user/1000/ollama.sock", "unix:///run/user/1000/ollama.sock"},
 	}
 
 	for name, tt := range cases {
@@ -141,6 +143,24 @@ func TestOrigins(t *testing.T) {
 	}
 }
 
+func TestMetricsMetadata(t *testing.T) {
+	cases := map[string][]string{
+		"":                 nil,
+		"tenant":           {"tenant"},
+		"tenant, session,": {"tenant", "session"},
+	}
+
+	for value, expect := range cases {
+		t.Run(value, func(t *testing.T) {
+			t.Setenv("OLLAMA_METRICS_METADATA", value)
+
+			if diff := cmp.Diff(MetricsMetadata(), expect); diff != "" {
+				t.Errorf("%s: mismatch (-want +got):\n%s", value, diff)
+			}
+		})
+	}
+}
+
 func TestBool(t *testing.T) {
 	cases := map[string]bool{
 		"":      false,
@@ -253,6 +273,26 @@ func TestLoadTimeout(t *testing.T) {
 	}
 }
 
+func TestBatchTuning(t *testing.T) {
+	cases := map[string][]int{
+		"":               nil,
+		"512":            {512},
+		"128,256,512":    {128, 256, 512},
+		" 128 , 256 ":    {128, 256},
+		"128,,512":       {128, 512},
+		"128,x,-1,0,512": {128, 512},
+	}
+
+	for tt, expect := range cases {
+		t.Run(tt, func(t *testing.T) {
+			t.Setenv("OLLAMA_BATCH_TUNING", tt)
+			if actual := BatchTuning(); !slices.Equal(actual, expect) {
+				t.Errorf("%s: expected %v, got %v", tt, expect, actual)
+			}
+		})
+	}
+}
+
 func TestVar(t *testing.T) {
 	cases := map[string]string{
 		"value":       "value",
@@ -272,3 +312,25 @@ func TestVar(t *testing.T) {
 		})
 	}
 }
+
+func TestGpuOverhead(t *testing.T) {
+	cases := map[string]map[string]uint64{
+		"":                     {"0": 0, "1": 0},
+		"1024":                 {"0": 1024, "1": 1024},
+		"1=2048":               {"0": 0, "1": 2048},
+		"1024, 1=2048":         {"0": 1024, "1": 2048},
+		"1=2048,1024":          {"0": 1024, "1": 2048},
+		"GPU-4b5c = 2048,x,-1": {"GPU-4b5c": 2048, "0": 0},
+	}
+
+	for value, expect := range cases {
+		t.Run(value, func(t *testing.T) {
+			t.Setenv("OLLAMA_GPU_OVERHEAD", value)
+			for id, overhead := range expect {
+				if actual := GpuOverhead(id); actual != overhead {
+					t.Errorf("%s: expected %d, got %d", id, overhead, actual)
+				}
+			}
+		})
+	}
+}
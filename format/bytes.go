@@ -3,6 +3,8 @@ package format
 import (
 	"fmt"
 	"math"
+	"strconv"
+	"strings"
 )
 
 const (
@@ -63,3 +65,40 @@ func HumanBytes2(b uint64) string {
 		return fmt.Sprintf("%d B", b)
 	}
 }
+
+// ParseHumanBytes parses a size such as "24GB", "512 MiB" or "1073741824",
+// which is a number of bytes without a unit
+func ParseHumanBytes(s string) (uint64, error) {
+	number := strings.TrimSpace(s)
+	unit := strings.TrimLeft(number, "0123456789.")
+	number = strings.TrimSpace(strings.TrimSuffix(number, unit))
+
+	var multiplier float64
+	switch strings.ToUpper(strings.TrimSpace(unit)) {
+	case "", "B":
+		multiplier = Byte
+	case "KB":
+		multiplier = KiloByte
+	case "MB":
+		multiplier = MegaByte
+	case "GB":
+		multiplier = GigaByte
+	case "TB":
+		multiplier = TeraByte
+	case "KIB":
+		multiplier = KibiByte
+	case "MIB":
+		multiplier = MebiByte
+	case "GIB":
+		multiplier = GibiByte
+	default:
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+
+	f, err := strconv.ParseFloat(number, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+
+	return uint64(math.Round(f * multiplier)), nil
+}
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"math"
 	"strconv"
+	"strings"
 )
 
 const (
@@ -32,3 +33,33 @@ func HumanNumber(b uint64) string {
 		return strconv.FormatUint(b, 10)
 	}
 }
+
+// ParseHumanNumber parses a number written by HumanNumber, or with a T suffix
+// for trillions, such as "7B" or "137M"
+func ParseHumanNumber(s string) (uint64, error) {
+	multiplier := 1.0
+	number := strings.TrimSpace(s)
+	if n := len(number); n > 0 {
+		switch number[n-1] {
+		case 'K', 'k':
+			multiplier = Thousand
+		case 'M', 'm':
+			multiplier = Million
+		case 'B', 'b':
+			multiplier = Billion
+		case 'T', 't':
+			multiplier = Billion * 1000
+		}
+
+		if multiplier > 1 {
+			number = number[:n-1]
+		}
+	}
+
+	f, err := strconv.ParseFloat(number, 64)
+	if err != nil || f < 0 {
+		return 0, fmt.Errorf("invalid number %q", s)
+	}
+
+	return uint64(math.Round(f * multiplier)), nil
+}
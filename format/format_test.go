@@ -31,3 +31,77 @@ func TestHumanNumber(t *testing.T) {
 		})
 	}
 }
+
+func TestParseHumanNumber(t *testing.T) {
+	cases := []struct {
+		input  string
+		expect uint64
+		err    bool
+	}{
+		{"0", 0, false},
+		{"137M", 137_000_000, false},
+		{"500.55M", 500_550_000, false},
+		{"8.0B", 8_000_000_000, false},
+		{"405b", 405_000_000_000, false},
+		{"1T", 1_000_000_000_000, false},
+		{"7K", 7_000, false},
+		{"", 0, true},
+		{"B", 0, true},
+		{"-1B", 0, true},
+		{"many", 0, true},
+	}
+
+	for _, tt := range cases {
+		n, err := ParseHumanNumber(tt.input)
+		if tt.err {
+			if err == nil {
+				t.Errorf("%q: expected error, got %d", tt.input, n)
+			}
+			continue
+		}
+
+		if err != nil || n != tt.expect {
+			t.Errorf("%q: expected %d, got %d %v", tt.input, tt.expect, n, err)
+		}
+	}
+
+	for _, n := range []uint64{125_000_000, 2_800_000_000, 70_000_000_000} {
+		if parsed, err := ParseHumanNumber(HumanNumber(n)); err != nil || parsed != n {
+			t.Errorf("%d didn't round trip: %d %v", n, parsed, err)
+		}
+	}
+}
+
+func TestParseHumanBytes(t *testing.T) {
+	cases := []struct {
+		input  string
+		expect uint64
+		err    bool
+	}{
+		{"0", 0, false},
+		{"1073741824", 1 << 30, false},
+		{"512B", 512, false},
+		{"24GB", 24_000_000_000, false},
+		{"1.5 TB", 1_500_000_000_000, false},
+		{"512 MiB", 512 << 20, false},
+		{"2gib", 2 << 30, false},
+		{"", 0, true},
+		{"GB", 0, true},
+		{"-1GB", 0, true},
+		{"24 GBs", 0, true},
+	}
+
+	for _, tt := range cases {
+		n, err := ParseHumanBytes(tt.input)
+		if tt.err {
+			if err == nil {
+				t.Errorf("%q: expected error, got %d", tt.input, n)
+			}
+			continue
+		}
+
+		if err != nil || n != tt.expect {
+			t.Errorf("%q: expected %d, got %d %v", tt.input, tt.expect, n, err)
+		}
+	}
+}
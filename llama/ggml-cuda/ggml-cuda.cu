@@ -138,6 +138,14 @@ static cudaError_t ggml_cuda_device_malloc(void ** ptr, size_t size, int device)
     }
     return err;
 #else
+    if (getenv("GGML_CUDA_ENABLE_UNIFIED_MEMORY") != nullptr) {
+        // APUs carve out little dedicated VRAM, allocate from system memory instead
+        auto res = hipMallocManaged(ptr, size);
+        if (res == hipSuccess) {
+            CUDA_CHECK(hipMemAdvise(*ptr, size, hipMemAdviseSetCoarseGrain, device));
+        }
+        return res;
+    }
     return cudaMalloc(ptr, size);
 #endif // !defined(GGML_USE_HIP)
 
@@ -3,6 +3,8 @@ package grammar
 import (
 	"bufio"
 	"bytes"
+	"encoding/json"
+	"fmt"
 	"strings"
 	"testing"
 
@@ -105,3 +107,27 @@ func TestSchemaToGrammer(t *testing.T) {
 		})
 	}
 }
+
+func TestSchemaToGrammarLarge(t *testing.T) {
+	properties := make(map[string]any)
+	var required []string
+	for i := range 1000 {
+		name := fmt.Sprintf("property_with_a_long_name_%d", i)
+		properties[name] = map[string]any{"type": "string"}
+		required = append(required, name)
+	}
+
+	schema, err := json.Marshal(map[string]any{"type": "object", "properties": properties, "required": required})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	g := llama.SchemaToGrammar(schema)
+	if len(g) <= 32768 {
+		t.Fatalf("expected a grammar larger than the initial buffer, got %d bytes", len(g))
+	}
+
+	if !llama.ValidGrammar(string(g)) {
+		t.Error("expected the whole grammar, got one that doesn't parse")
+	}
+}
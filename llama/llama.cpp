@@ -7668,6 +7668,7 @@ static bool llm_load_tensors(
         llama_model_loader & ml,
         llama_model & model,
         int n_gpu_layers,
+        int n_cpu_ffn_layers,
         enum llama_split_mode split_mode,
         int main_gpu,
         const float * tensor_split,
@@ -7852,6 +7853,10 @@ static bool llm_load_tensors(
                     break;
                 case LLM_TENSOR_LAYER_REPEATING:
                     buft_list = model.dev_layer.at(tn.bid).buft_list;
+                    // keep the feed-forward weights of the first layers on the CPU, while their attention and KV cache are offloaded
+                    if (tn.bid < n_cpu_ffn_layers && strstr(tn.str().c_str(), ".ffn_") != nullptr) {
+                        buft_list = &model.cpu_buft_list;
+                    }
                     break;
                 default:
                     GGML_ABORT("invalid layer %d for tensor %s", info.layer, tn.str().c_str());
@@ -9642,6 +9647,9 @@ static bool llm_load_tensors(
         const int n_gpu = std::min(n_gpu_layers, int(hparams.n_layer));
 
         LLAMA_LOG_INFO("%s: offloading %d repeating layers to GPU\n", __func__, n_gpu);
+        if (n_cpu_ffn_layers > 0) {
+            LLAMA_LOG_INFO("%s: keeping feed-forward weights of %d layers on CPU\n", __func__, std::min(n_cpu_ffn_layers, int(hparams.n_layer)));
+        }
         if (n_gpu_layers > (int) hparams.n_layer) {
             LLAMA_LOG_INFO("%s: offloading output layer to GPU\n", __func__);
         }
@@ -9721,7 +9729,7 @@ static int llama_model_load(const std::string & fname, llama_model & model, llam
         }
 
         if (!llm_load_tensors(
-            ml, model, params.n_gpu_layers, params.split_mode,  params.main_gpu, params.tensor_split, params.use_mlock,
+            ml, model, params.n_gpu_layers, params.n_cpu_ffn_layers, params.split_mode,  params.main_gpu, params.tensor_split, params.use_mlock,
             params.progress_callback, params.progress_callback_user_data
         )) {
             return -2;
@@ -20122,6 +20130,7 @@ struct llama_model_params llama_model_default_params() {
     struct llama_model_params result = {
         /*.devices                     =*/ nullptr,
         /*.n_gpu_layers                =*/ 0,
+        /*.n_cpu_ffn_layers            =*/ 0,
         /*.split_mode                  =*/ LLAMA_SPLIT_MODE_LAYER,
         /*.main_gpu                    =*/ 0,
         /*.tensor_split                =*/ nullptr,
@@ -46,7 +46,11 @@ package llama
 #cgo linux,arm64,sve CFLAGS: -march=armv8.6-a+sve
 #cgo linux,arm64,sve CXXFLAGS: -march=armv8.6-a+sve
 #cgo linux,cuda LDFLAGS: -lcuda -lcudart -lcublas -lcublasLt -lpthread -lrt -lresolv
+#cgo linux,oneapi LDFLAGS: -lpthread -lrt -lresolv
 #cgo linux,rocm LDFLAGS: -lpthread -lrt -lresolv
+#cgo oneapi CFLAGS: -DGGML_USE_SYCL -DGGML_BUILD=1
+#cgo oneapi CXXFLAGS: -DGGML_USE_SYCL -DGGML_BUILD=1
+#cgo oneapi LDFLAGS: -L${SRCDIR} -lggml_oneapi -lsycl -lOpenCL -lmkl_sycl_blas -lmkl_intel_ilp64 -lmkl_tbb_thread -lmkl_core -ltbb
 #cgo rocm CFLAGS: -DGGML_USE_CUDA -DGGML_USE_HIP -DGGML_CUDA_DMMV_X=32 -DGGML_CUDA_PEER_MAX_BATCH_SIZE=128 -DGGML_CUDA_MMV_Y=1 -DGGML_BUILD=1
 #cgo rocm CXXFLAGS: -DGGML_USE_CUDA -DGGML_USE_HIP -DGGML_CUDA_DMMV_X=32 -DGGML_CUDA_PEER_MAX_BATCH_SIZE=128 -DGGML_CUDA_MMV_Y=1 -DGGML_BUILD=1
 #cgo rocm LDFLAGS: -L${SRCDIR} -lggml_rocm -lhipblas -lamdhip64 -lrocblas
@@ -68,6 +72,7 @@ package llama
 #include "mllama.h"
 #include "sampling_ext.h"
 
+extern const char *LLAMA_COMMIT;
 extern bool llamaProgressCallback(float progress, void *user_data);
 extern void llamaLog(int level, char* text, void* user_data);
 
@@ -89,6 +94,7 @@ import (
 	_ "embed"
 	"errors"
 	"fmt"
+	"math"
 	"os"
 	"runtime"
 	"runtime/cgo"
@@ -161,7 +167,7 @@ type ContextParams struct {
 	c C.struct_llama_context_params
 }
 
-func NewContextParams(numCtx int, batchSize int, numSeqMax int, threads int, flashAttention bool, kvCacheType string) ContextParams {
+func NewContextParams(numCtx int, batchSize int, numSeqMax int, threads int, flashAttention bool, cacheTypeK, cacheTypeV string) ContextParams {
 	params := C.llama_context_default_params()
 	params.n_ctx = C.uint(numCtx)
 	params.n_batch = C.uint(batchSize)
@@ -170,12 +176,69 @@ func NewContextParams(numCtx int, batchSize int, numSeqMax int, threads int, fla
 	params.n_threads_batch = params.n_threads
 	params.embeddings = C.bool(true)
 	params.flash_attn = C.bool(flashAttention)
-	params.type_k = kvCacheTypeFromStr(strings.ToLower(kvCacheType))
-	params.type_v = kvCacheTypeFromStr(strings.ToLower(kvCacheType))
+	params.type_k = kvCacheTypeFromStr(strings.ToLower(cacheTypeK))
+	params.type_v = kvCacheTypeFromStr(strings.ToLower(cacheTypeV))
 
 	return ContextParams{c: params}
 }
 
+// SetMicroBatchSize sets the maximum number of tokens computed at once. Larger
+// batches are split into micro-batches of this size.
+func (p *ContextParams) SetMicroBatchSize(n int) {
+	p.c.n_ubatch = C.uint(n)
+}
+
+// RopeParams override how the model scales RoPE positions. Zero values are
+// read from the model.
+type RopeParams struct {
+	// ScalingType is "none", "linear" or "yarn"
+	ScalingType string
+
+	FreqBase  float32
+	FreqScale float32
+
+	YarnOrigCtx    int
+	YarnExtFactor  float32
+	YarnAttnFactor float32
+	YarnBetaFast   float32
+	YarnBetaSlow   float32
+}
+
+// SetRope overrides the RoPE scaling of the model with r
+func (p *ContextParams) SetRope(r RopeParams) error {
+	switch r.ScalingType {
+	case "":
+	case "none":
+		p.c.rope_scaling_type = C.LLAMA_ROPE_SCALING_TYPE_NONE
+	case "linear":
+		p.c.rope_scaling_type = C.LLAMA_ROPE_SCALING_TYPE_LINEAR
+	case "yarn":
+		p.c.rope_scaling_type = C.LLAMA_ROPE_SCALING_TYPE_YARN
+	default:
+		return fmt.Errorf("unknown rope scaling type %q", r.ScalingType)
+	}
+
+	p.c.rope_freq_base = C.float(r.FreqBase)
+	p.c.rope_freq_scale = C.float(r.FreqScale)
+	p.c.yarn_orig_ctx = C.uint32_t(r.YarnOrigCtx)
+
+	// the rest default to values other than 0
+	if r.YarnExtFactor != 0 {
+		p.c.yarn_ext_factor = C.float(r.YarnExtFactor)
+	}
+	if r.YarnAttnFactor != 0 {
+		p.c.yarn_attn_factor = C.float(r.YarnAttnFactor)
+	}
+	if r.YarnBetaFast != 0 {
+		p.c.yarn_beta_fast = C.float(r.YarnBetaFast)
+	}
+	if r.YarnBetaSlow != 0 {
+		p.c.yarn_beta_slow = C.float(r.YarnBetaSlow)
+	}
+
+	return nil
+}
+
 // kvCacheTypeFromStr converts a string cache type to the corresponding GGML type value
 func kvCacheTypeFromStr(s string) C.enum_ggml_type {
 	if s == "" {
@@ -217,6 +280,11 @@ func (c *Context) Decode(batch *Batch) error {
 	return nil
 }
 
+// Free releases the context. It must not be used afterwards.
+func (c *Context) Free() {
+	C.llama_free(c.c)
+}
+
 func (c *Context) Model() *Model {
 	return &Model{c: C.llama_get_model(c.c)}
 }
@@ -233,6 +301,29 @@ func (c *Context) KvCacheSeqCp(srcSeqId int, dstSeqId int, p0 int, p1 int) {
 	C.llama_kv_cache_seq_cp(c.c, C.int(srcSeqId), C.int(dstSeqId), C.int(p0), C.int(p1))
 }
 
+// StateSeqGetData returns the KV cache of a sequence, which can be loaded
+// into a sequence again with [Context.StateSeqSetData]
+func (c *Context) StateSeqGetData(seqId int) []byte {
+	size := C.llama_state_seq_get_size(c.c, C.llama_seq_id(seqId))
+	if size == 0 {
+		return nil
+	}
+
+	buf := make([]byte, size)
+	n := C.llama_state_seq_get_data(c.c, (*C.uint8_t)(unsafe.Pointer(&buf[0])), size, C.llama_seq_id(seqId))
+	return buf[:n]
+}
+
+// StateSeqSetData loads the KV cache of a sequence returned by
+// [Context.StateSeqGetData] into a sequence, reporting whether it succeeded
+func (c *Context) StateSeqSetData(seqId int, data []byte) bool {
+	if len(data) == 0 {
+		return false
+	}
+
+	return C.llama_state_seq_set_data(c.c, (*C.uint8_t)(unsafe.Pointer(&data[0])), C.size_t(len(data)), C.llama_seq_id(seqId)) > 0
+}
+
 func (c *Context) KvCacheClear() {
 	C.llama_kv_cache_clear(c.c)
 }
@@ -260,6 +351,16 @@ func (c *Context) GetEmbeddingsIth(i int) []float32 {
 	return unsafe.Slice((*float32)(embeddings), c.Model().NEmbd())
 }
 
+// Get the logits for the ith token in the last batch
+func (c *Context) GetLogitsIth(i int) []float32 {
+	logits := unsafe.Pointer(C.llama_get_logits_ith(c.c, C.int32_t(i)))
+	if logits == nil {
+		return nil
+	}
+
+	return unsafe.Slice((*float32)(logits), c.Model().NumVocab())
+}
+
 type ModelParams struct {
 	NumGpuLayers int
 	MainGpu      int
@@ -268,6 +369,10 @@ type ModelParams struct {
 	TensorSplit  []float32
 	Progress     func(float32)
 	VocabOnly    bool
+
+	// NumCPUFFNLayers keeps the feed-forward weights of this many layers,
+	// from the first, on the CPU while the rest of each layer is offloaded
+	NumCPUFFNLayers int
 }
 
 //export llamaProgressCallback
@@ -281,6 +386,7 @@ func llamaProgressCallback(progress C.float, userData unsafe.Pointer) C.bool {
 func LoadModelFromFile(modelPath string, params ModelParams) (*Model, error) {
 	cparams := C.llama_model_default_params()
 	cparams.n_gpu_layers = C.int(params.NumGpuLayers)
+	cparams.n_cpu_ffn_layers = C.int32_t(params.NumCPUFFNLayers)
 	cparams.main_gpu = C.int32_t(params.MainGpu)
 	cparams.use_mmap = C.bool(params.UseMmap)
 	cparams.use_mlock = C.bool(params.UseMlock)
@@ -364,6 +470,46 @@ func (m *Model) ApplyLoraFromFile(context *Context, loraPath string, scale float
 	return nil
 }
 
+// LoraAdapter is a LoRA adapter loaded for a model, which can be applied to
+// and removed from its contexts
+type LoraAdapter struct {
+	c *C.struct_llama_lora_adapter
+}
+
+// NewLoraAdapter loads the LoRA adapter at path. It's freed along with the
+// model unless it's freed earlier with Free.
+func (m *Model) NewLoraAdapter(path string) (*LoraAdapter, error) {
+	cPath := C.CString(path)
+	defer C.free(unsafe.Pointer(cPath))
+
+	a := C.llama_lora_adapter_init(m.c, cPath)
+	if a == nil {
+		return nil, fmt.Errorf("unable to load lora %s", path)
+	}
+
+	return &LoraAdapter{c: a}, nil
+}
+
+// SetLoraAdapter applies the adapter with scale in addition to the adapters
+// already applied to the context
+func (c *Context) SetLoraAdapter(a *LoraAdapter, scale float32) error {
+	if C.llama_lora_adapter_set(c.c, a.c, C.float(scale)) != 0 {
+		return errors.New("error applying lora")
+	}
+
+	return nil
+}
+
+// Free frees the adapter, which must have been removed from every context
+func (a *LoraAdapter) Free() {
+	C.llama_lora_adapter_free(a.c)
+}
+
+// RemoveLoraAdapter removes the adapter from the context if it's applied
+func (c *Context) RemoveLoraAdapter(a *LoraAdapter) {
+	C.llama_lora_adapter_remove(c.c, a.c)
+}
+
 type Batch struct {
 	c         C.struct_llama_batch
 	batchSize int
@@ -411,6 +557,9 @@ func (b *Batch) IsEmbedding() bool {
 	return b.embedSize != 0
 }
 
+// MaxPos is the largest position that can be added to a batch or the KV cache
+const MaxPos = math.MaxInt32
+
 // Add adds either a token or an image embedding to the batch depending on the type
 // when the batch was initialized. The other argument will be ignored. Adds to the
 // batch with the given position for the given sequence ids, and optionally instructs
@@ -523,6 +672,11 @@ func (m *Model) NEmbd() int {
 	return int(C.llama_n_embd(m.c))
 }
 
+// Commit returns the llama.cpp commit the library was built from
+func Commit() string {
+	return C.GoString(C.LLAMA_COMMIT)
+}
+
 func Quantize(infile, outfile string, ftype uint32) error {
 	cinfile := C.CString(infile)
 	defer C.free(unsafe.Pointer(cinfile))
@@ -674,6 +828,35 @@ type SamplingParams struct {
 	PenalizeNl     bool
 	Seed           uint32
 	Grammar        string
+
+	// LogitBias is added to the logits of token ids before sampling
+	LogitBias map[int]float32
+
+	DryMultiplier       float32
+	DryBase             float32
+	DryAllowedLength    int
+	DryPenaltyLastN     int
+	DrySequenceBreakers []string
+	XTCProbability      float32
+	XTCThreshold        float32
+	DynatempRange       float32
+	DynatempExponent    float32
+
+	// SamplerOrder is the order of the samplers, by their names in
+	// Samplers, or the default order if it's empty
+	SamplerOrder []string
+}
+
+// Samplers are the samplers SamplingParams.SamplerOrder can arrange, by their
+// option names, and the names llama.cpp gives them
+var Samplers = map[string]string{
+	"dry":         "dry",
+	"top_k":       "top_k",
+	"typical_p":   "typ_p",
+	"top_p":       "top_p",
+	"min_p":       "min_p",
+	"xtc":         "xtc",
+	"temperature": "temperature",
 }
 
 func NewSamplingContext(model *Model, params SamplingParams) (*SamplingContext, error) {
@@ -697,6 +880,64 @@ func NewSamplingContext(model *Model, params SamplingParams) (*SamplingContext,
 	defer C.free(unsafe.Pointer(grammar))
 
 	cparams.grammar = grammar
+
+	if len(params.LogitBias) > 0 {
+		biases := (*C.llama_logit_bias)(C.malloc(C.size_t(len(params.LogitBias)) * C.size_t(unsafe.Sizeof(C.llama_logit_bias{}))))
+		defer C.free(unsafe.Pointer(biases))
+
+		s := unsafe.Slice(biases, len(params.LogitBias))
+		var i int
+		for token, bias := range params.LogitBias {
+			s[i] = C.llama_logit_bias{token: C.llama_token(token), bias: C.float(bias)}
+			i++
+		}
+
+		cparams.logit_bias = biases
+		cparams.n_logit_bias = C.int32_t(len(params.LogitBias))
+	}
+
+	cparams.dry_multiplier = C.float(params.DryMultiplier)
+	cparams.dry_base = C.float(params.DryBase)
+	cparams.dry_allowed_length = C.int32_t(params.DryAllowedLength)
+	cparams.dry_penalty_last_n = C.int32_t(params.DryPenaltyLastN)
+	if len(params.DrySequenceBreakers) > 0 {
+		breakers := (**C.char)(C.malloc(C.size_t(len(params.DrySequenceBreakers)) * C.size_t(unsafe.Sizeof((*C.char)(nil)))))
+		defer C.free(unsafe.Pointer(breakers))
+
+		s := unsafe.Slice(breakers, len(params.DrySequenceBreakers))
+		for i, breaker := range params.DrySequenceBreakers {
+			s[i] = C.CString(breaker)
+			defer C.free(unsafe.Pointer(s[i]))
+		}
+
+		cparams.dry_sequence_breakers = breakers
+		cparams.n_dry_sequence_breakers = C.int32_t(len(params.DrySequenceBreakers))
+	}
+
+	cparams.xtc_probability = C.float(params.XTCProbability)
+	cparams.xtc_threshold = C.float(params.XTCThreshold)
+	cparams.dynatemp_range = C.float(params.DynatempRange)
+	cparams.dynatemp_exponent = C.float(params.DynatempExponent)
+
+	if len(params.SamplerOrder) > 0 {
+		samplers := (**C.char)(C.malloc(C.size_t(len(params.SamplerOrder)) * C.size_t(unsafe.Sizeof((*C.char)(nil)))))
+		defer C.free(unsafe.Pointer(samplers))
+
+		s := unsafe.Slice(samplers, len(params.SamplerOrder))
+		for i, name := range params.SamplerOrder {
+			cname, ok := Samplers[name]
+			if !ok {
+				return nil, fmt.Errorf("unknown sampler %q", name)
+			}
+
+			s[i] = C.CString(cname)
+			defer C.free(unsafe.Pointer(s[i]))
+		}
+
+		cparams.samplers = samplers
+		cparams.n_samplers = C.int32_t(len(params.SamplerOrder))
+	}
+
 	context := &SamplingContext{c: C.common_sampler_cinit(model.c, &cparams)}
 	if context.c == nil {
 		return nil, errors.New("unable to create sampling context")
@@ -719,6 +960,69 @@ func (s *SamplingContext) Accept(id int, applyGrammar bool) {
 	C.common_sampler_caccept(s.c, C.llama_token(id), C.bool(applyGrammar))
 }
 
+// SamplingCandidate is one of the candidates traced by [SamplingContext.SampleTrace]
+type SamplingCandidate struct {
+	Token int
+
+	// Logit is the logit of the token from the model, and Penalized is the
+	// logit after the repeat, frequency and presence penalties
+	Logit     float32
+	Penalized float32
+
+	// Probability is the probability the token was sampled with, zero if it
+	// was eliminated
+	Probability float32
+
+	// EliminatedBy is the name of the sampler that eliminated the token,
+	// such as "top-k" or "grammar", empty if it wasn't
+	EliminatedBy string
+}
+
+// SampleTrace samples a token like Sample, also tracing the k candidates with
+// the highest logits through each stage of sampling
+func (s *SamplingContext) SampleTrace(llamaContext *Context, idx int, k int) (int, []SamplingCandidate) {
+	trace := make([]C.struct_common_sampler_ctrace, k)
+	token := int(C.common_sampler_csample_trace(s.c, llamaContext.c, C.int(idx), unsafe.SliceData(trace), C.int(k)))
+
+	candidates := make([]SamplingCandidate, 0, k)
+	for _, t := range trace {
+		if t.stage == -2 {
+			break
+		}
+
+		c := SamplingCandidate{
+			Token:       int(t.id),
+			Logit:       float32(t.logit),
+			Penalized:   float32(t.penalized),
+			Probability: float32(t.p),
+		}
+
+		if t.stage >= 0 {
+			c.EliminatedBy = C.GoString(C.common_sampler_cstage_name(s.c, t.stage))
+		}
+
+		candidates = append(candidates, c)
+	}
+
+	return token, candidates
+}
+
+// Discard advances the random number generator as if n tokens had been
+// sampled, so a generation continued elsewhere draws the same numbers
+func (s *SamplingContext) Discard(n int) {
+	C.common_sampler_cdiscard(s.c, C.int(n))
+}
+
+// ValidGrammar reports whether grammar is a GBNF grammar the sampler can
+// constrain generation with: it parses, has a root rule and none of its
+// rules are left recursive.
+func ValidGrammar(grammar string) bool {
+	cStr := C.CString(grammar)
+	defer C.free(unsafe.Pointer(cStr))
+
+	return bool(C.validate_grammar(cStr))
+}
+
 // SchemaToGrammar converts the provided JSON schema to a grammar. It returns
 // nil if the provided schema is invalid JSON or an invalid JSON schema.
 func SchemaToGrammar(schema []byte) []byte {
@@ -726,14 +1030,20 @@ func SchemaToGrammar(schema []byte) []byte {
 	defer C.free(unsafe.Pointer(cStr))
 
 	// Allocate buffer for grammar output with reasonable size
-	const maxLen = 32768 // 32KB
-	buf := make([]byte, maxLen)
+	buf := make([]byte, 32768) // 32KB
 
 	// Call C function to convert schema to grammar
-	n := C.schema_to_grammar(cStr, (*C.char)(unsafe.Pointer(&buf[0])), C.size_t(maxLen))
+	n := int(C.schema_to_grammar(cStr, (*C.char)(unsafe.Pointer(&buf[0])), C.size_t(len(buf))))
 	if n == 0 {
 		// preserve nil
 		return nil
 	}
+
+	// large schemas don't fit, convert them again with room for all of it
+	if n >= len(buf) {
+		buf = make([]byte, n+1)
+		n = int(C.schema_to_grammar(cStr, (*C.char)(unsafe.Pointer(&buf[0])), C.size_t(len(buf))))
+	}
+
 	return buf[:n]
 }
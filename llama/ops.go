@@ -0,0 +1,182 @@
+package llama
+
+/*
+#include <stdlib.h>
+#include <string.h>
+#include "ggml.h"
+#include "ggml-cpu.h"
+*/
+import "C"
+
+import (
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"slices"
+	"unsafe"
+)
+
+// Op is a single tensor operation which can be computed repeatedly on the CPU,
+// for benchmarking kernels in isolation from a model
+type Op struct {
+	ctx   *C.struct_ggml_context
+	graph *C.struct_ggml_cgraph
+	plan  C.struct_ggml_cplan
+}
+
+// NewOp builds the operation name on random inputs. Shapes are given in ggml
+// order, innermost dimension first:
+//
+//   - mul_mat: [k, m, n] multiplies an m×k matrix of dtype by a k×n f32 matrix
+//   - rope: [head size, heads, tokens] of dtype
+//   - soft_max, rms_norm: [columns, rows] of f32
+//   - cpy: [columns, rows] of f32 stored into dtype, as when filling the cache
+func NewOp(name, dtype string, shape []int, threads int) (*Op, error) {
+	typ, ok := opTypes[dtype]
+	if !ok {
+		return nil, fmt.Errorf("unsupported type %q", dtype)
+	}
+
+	if len(shape) == 0 || slices.ContainsFunc(shape, func(d int) bool { return d <= 0 }) {
+		return nil, fmt.Errorf("invalid shape %v", shape)
+	}
+
+	// inputs and outputs are allocated in the context and are at most f32
+	var elements int
+	if name == "mul_mat" && len(shape) == 3 {
+		elements = shape[0]*shape[1] + shape[0]*shape[2] + shape[1]*shape[2]
+	} else {
+		elements = 3
+		for _, d := range shape {
+			elements *= d
+		}
+	}
+
+	size := C.ggml_graph_overhead() + 8*C.ggml_tensor_overhead() + C.size_t(elements*4) + 1<<20
+	ctx := C.ggml_init(C.struct_ggml_init_params{mem_size: size})
+	if ctx == nil {
+		return nil, errors.New("unable to allocate ggml context")
+	}
+
+	op := &Op{ctx: ctx}
+	out, err := op.build(name, typ, shape)
+	if err != nil {
+		op.Free()
+		return nil, err
+	}
+
+	op.graph = C.ggml_new_graph(ctx)
+	C.ggml_build_forward_expand(op.graph, out)
+
+	op.plan = C.ggml_graph_plan(op.graph, C.int(threads), nil)
+	if op.plan.work_size > 0 {
+		op.plan.work_data = (*C.uint8_t)(C.malloc(op.plan.work_size))
+	}
+
+	return op, nil
+}
+
+var opTypes = map[string]C.enum_ggml_type{
+	"f32":  C.GGML_TYPE_F32,
+	"f16":  C.GGML_TYPE_F16,
+	"q8_0": C.GGML_TYPE_Q8_0,
+	"q4_0": C.GGML_TYPE_Q4_0,
+}
+
+func (o *Op) build(name string, typ C.enum_ggml_type, shape []int) (*C.struct_ggml_tensor, error) {
+	dims := func(n int) error {
+		if len(shape) != n {
+			return fmt.Errorf("%s requires %d dimensions, got %v", name, n, shape)
+		}
+
+		return nil
+	}
+
+	switch name {
+	case "mul_mat":
+		if err := dims(3); err != nil {
+			return nil, err
+		}
+
+		a := o.random(typ, shape[0], shape[1])
+		b := o.random(C.GGML_TYPE_F32, shape[0], shape[2])
+		return C.ggml_mul_mat(o.ctx, a, b), nil
+	case "rope":
+		if err := dims(3); err != nil {
+			return nil, err
+		}
+
+		a := o.random(typ, shape...)
+		pos := C.ggml_new_tensor_1d(o.ctx, C.GGML_TYPE_I32, C.int64_t(shape[2]))
+		positions := unsafe.Slice((*int32)(pos.data), shape[2])
+		for i := range positions {
+			positions[i] = int32(i)
+		}
+
+		return C.ggml_rope_ext(o.ctx, a, pos, nil, C.int(shape[0]), 0, 0, 10000, 1, 0, 1, 32, 1), nil
+	case "soft_max":
+		if err := dims(2); err != nil {
+			return nil, err
+		}
+
+		return C.ggml_soft_max(o.ctx, o.random(C.GGML_TYPE_F32, shape...)), nil
+	case "rms_norm":
+		if err := dims(2); err != nil {
+			return nil, err
+		}
+
+		return C.ggml_rms_norm(o.ctx, o.random(C.GGML_TYPE_F32, shape...), 1e-6), nil
+	case "cpy":
+		if err := dims(2); err != nil {
+			return nil, err
+		}
+
+		src := o.random(C.GGML_TYPE_F32, shape...)
+		dst := C.ggml_new_tensor_2d(o.ctx, typ, C.int64_t(shape[0]), C.int64_t(shape[1]))
+		return C.ggml_cpy(o.ctx, src, dst), nil
+	default:
+		return nil, fmt.Errorf("unsupported op %q", name)
+	}
+}
+
+// random returns a tensor of typ filled with random values
+func (o *Op) random(typ C.enum_ggml_type, shape ...int) *C.struct_ggml_tensor {
+	ne := make([]C.int64_t, len(shape))
+	for i, d := range shape {
+		ne[i] = C.int64_t(d)
+	}
+
+	t := C.ggml_new_tensor(o.ctx, typ, C.int(len(ne)), &ne[0])
+
+	rows := int(C.ggml_nrows(t))
+	data := make([]float32, rows*shape[0])
+	for i := range data {
+		data[i] = rand.Float32()*2 - 1
+	}
+
+	switch typ {
+	case C.GGML_TYPE_F32:
+		C.memcpy(t.data, unsafe.Pointer(&data[0]), C.size_t(len(data)*4))
+	case C.GGML_TYPE_F16:
+		C.ggml_fp32_to_fp16_row((*C.float)(&data[0]), (*C.ggml_fp16_t)(t.data), C.int64_t(len(data)))
+	default:
+		C.ggml_quantize_chunk(typ, (*C.float)(&data[0]), t.data, 0, C.int64_t(rows), C.int64_t(shape[0]), nil)
+	}
+
+	return t
+}
+
+// Compute runs the operation once
+func (o *Op) Compute() error {
+	if status := C.ggml_graph_compute(o.graph, &o.plan); status != C.GGML_STATUS_SUCCESS {
+		return fmt.Errorf("compute failed with status %d", status)
+	}
+
+	return nil
+}
+
+// Free releases the operation's tensors. It must not be used afterwards.
+func (o *Op) Free() {
+	C.free(unsafe.Pointer(o.plan.work_data))
+	C.ggml_free(o.ctx)
+}
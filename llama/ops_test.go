@@ -0,0 +1,90 @@
+package llama
+
+import (
+	"fmt"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+type opCase struct {
+	op     string
+	dtypes []string
+	shapes [][]int
+}
+
+var opCases = []opCase{
+	// token generation and prompt processing through a 4096 wide projection
+	{"mul_mat", []string{"f32", "f16", "q8_0", "q4_0"}, [][]int{{4096, 4096, 1}, {4096, 4096, 32}}},
+	{"rope", []string{"f32", "f16"}, [][]int{{128, 32, 1}, {128, 32, 512}}},
+	{"soft_max", []string{"f32"}, [][]int{{4096, 32}, {32000, 1}}},
+	{"rms_norm", []string{"f32"}, [][]int{{4096, 1}, {4096, 512}}},
+	{"cpy", []string{"f16", "q8_0", "q4_0"}, [][]int{{4096, 1}, {4096, 512}}},
+}
+
+func shapeName(shape []int) string {
+	s := make([]string, len(shape))
+	for i, d := range shape {
+		s[i] = fmt.Sprint(d)
+	}
+
+	return strings.Join(s, "x")
+}
+
+func TestOps(t *testing.T) {
+	for _, c := range opCases {
+		for _, dtype := range c.dtypes {
+			t.Run(c.op+"/"+dtype, func(t *testing.T) {
+				// a small shape is enough to check the op can be built and run
+				shape := make([]int, len(c.shapes[0]))
+				for i := range shape {
+					shape[i] = 32
+				}
+
+				op, err := NewOp(c.op, dtype, shape, 1)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer op.Free()
+
+				if err := op.Compute(); err != nil {
+					t.Fatal(err)
+				}
+			})
+		}
+	}
+
+	if _, err := NewOp("conv", "f32", []int{32, 32}, 1); err == nil {
+		t.Error("expected error for unsupported op")
+	}
+
+	if _, err := NewOp("mul_mat", "f32", []int{32, 32}, 1); err == nil {
+		t.Error("expected error for wrong number of dimensions")
+	}
+}
+
+// BenchmarkOps measures the CPU kernels used by models. Compare runs against a
+// baseline with cmd/benchcheck to catch regressions.
+func BenchmarkOps(b *testing.B) {
+	threads := runtime.NumCPU()
+	for _, c := range opCases {
+		for _, dtype := range c.dtypes {
+			for _, shape := range c.shapes {
+				b.Run(c.op+"/"+dtype+"/"+shapeName(shape), func(b *testing.B) {
+					op, err := NewOp(c.op, dtype, shape, threads)
+					if err != nil {
+						b.Fatal(err)
+					}
+					defer op.Free()
+
+					b.ResetTimer()
+					for range b.N {
+						if err := op.Compute(); err != nil {
+							b.Fatal(err)
+						}
+					}
+				})
+			}
+		}
+	}
+}
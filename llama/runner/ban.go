@@ -0,0 +1,133 @@
+package runner
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// banList keeps banned tokens and strings out of a sequence's output by
+// removing the tokens that would produce them from the logits before each
+// token is sampled, however the strings are split into tokens. Strings are
+// matched case insensitively, anywhere in the output, so banning "ass" also
+// bans "class".
+type banList struct {
+	// tokens are never sampled
+	tokens []int
+
+	// words are the lowercased banned strings
+	words []string
+
+	// endings[i][k] are the tokens starting with words[i][k:], which are
+	// banned after output ending with words[i][:k]
+	endings [][][]int
+
+	// tail is the end of the lowercased output, long enough to hold the
+	// start of any of the words
+	tail    string
+	maxTail int
+}
+
+// newBanList compiles the banned strings and tokens against the pieces of
+// the vocabulary, which must be lowercased with lowerPiece. It returns nil
+// if nothing is banned.
+func newBanList(pieces []string, words []string, tokens []int) (*banList, error) {
+	if len(words) == 0 && len(tokens) == 0 {
+		return nil, nil
+	}
+
+	b := banList{endings: make([][][]int, len(words))}
+	banned := make(map[int]bool)
+	for _, t := range tokens {
+		if t < 0 || t >= len(pieces) {
+			return nil, fmt.Errorf("banned token %d is out of the vocabulary of %d tokens", t, len(pieces))
+		}
+
+		banned[t] = true
+	}
+
+	for i, word := range words {
+		if word == "" {
+			return nil, errors.New("banned strings can't be empty")
+		}
+
+		word = lowerPiece(word)
+		b.words = append(b.words, word)
+		b.maxTail = max(b.maxTail, len(word)-1)
+
+		b.endings[i] = make([][]int, len(word))
+		for t, piece := range pieces {
+			if strings.Contains(piece, word) {
+				banned[t] = true
+				continue
+			}
+
+			for k := 1; k < len(word); k++ {
+				if strings.HasPrefix(piece, word[k:]) {
+					b.endings[i][k] = append(b.endings[i][k], t)
+				}
+			}
+		}
+	}
+
+	for t := range banned {
+		b.tokens = append(b.tokens, t)
+	}
+
+	return &b, nil
+}
+
+// apply removes the banned tokens from the logits of the next token
+func (b *banList) apply(logits []float32) {
+	if b == nil {
+		return
+	}
+
+	inf := float32(math.Inf(-1))
+	for _, t := range b.tokens {
+		logits[t] = inf
+	}
+
+	for i, word := range b.words {
+		for k := 1; k < len(word); k++ {
+			if strings.HasSuffix(b.tail, word[:k]) {
+				for _, t := range b.endings[i][k] {
+					logits[t] = inf
+				}
+			}
+		}
+	}
+}
+
+// accept adds the piece of a sampled token to the output
+func (b *banList) accept(piece string) {
+	if b == nil || b.maxTail == 0 {
+		return
+	}
+
+	b.tail += lowerPiece(piece)
+	if len(b.tail) > b.maxTail {
+		b.tail = b.tail[len(b.tail)-b.maxTail:]
+	}
+}
+
+// lowerPiece lowercases s like strings.ToLower, except that it keeps bytes
+// which aren't valid UTF-8, as pieces may hold part of a character
+func lowerPiece(s string) string {
+	var sb strings.Builder
+	for len(s) > 0 {
+		r, size := utf8.DecodeRuneInString(s)
+		if r == utf8.RuneError && size == 1 {
+			sb.WriteByte(s[0])
+		} else {
+			sb.WriteRune(unicode.ToLower(r))
+		}
+
+		s = s[size:]
+	}
+
+	return sb.String()
+}
@@ -0,0 +1,77 @@
+package runner
+
+import (
+	"math"
+	"slices"
+	"testing"
+)
+
+func TestBanList(t *testing.T) {
+	pieces := []string{"a", " f", "oo", "bar", "foo", " football", "o", "b", "fo", lowerPiece("\xe2")}
+
+	b, err := newBanList(pieces, []string{"FOO"}, []int{3})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	banned := func() []int {
+		logits := make([]float32, len(pieces))
+		b.apply(logits)
+
+		var tokens []int
+		for t, l := range logits {
+			if math.IsInf(float64(l), -1) {
+				tokens = append(tokens, t)
+			}
+		}
+		return tokens
+	}
+
+	// tokens holding the whole string are always banned
+	if got := banned(); !slices.Equal(got, []int{3, 4, 5}) {
+		t.Errorf("expected tokens [3 4 5] to be banned, got %v", got)
+	}
+
+	b.accept(" F")
+	if got := banned(); !slices.Equal(got, []int{2, 3, 4, 5}) {
+		t.Errorf("expected tokens [2 3 4 5] to be banned after \" F\", got %v", got)
+	}
+
+	b.accept("o")
+	if got := banned(); !slices.Equal(got, []int{2, 3, 4, 5, 6}) {
+		t.Errorf("expected tokens [2 3 4 5 6] to be banned after \" Fo\", got %v", got)
+	}
+
+	b.accept("b")
+	if got := banned(); !slices.Equal(got, []int{3, 4, 5}) {
+		t.Errorf("expected tokens [3 4 5] to be banned after \" Fob\", got %v", got)
+	}
+
+	if _, err := newBanList(pieces, nil, []int{len(pieces)}); err == nil {
+		t.Error("expected an error for a token out of the vocabulary")
+	}
+
+	if _, err := newBanList(pieces, []string{""}, nil); err == nil {
+		t.Error("expected an error for an empty string")
+	}
+
+	if b, err := newBanList(pieces, nil, nil); b != nil || err != nil {
+		t.Errorf("expected no ban list, got %v %v", b, err)
+	}
+}
+
+func TestLowerPiece(t *testing.T) {
+	cases := map[string]string{
+		"Hello":      "hello",
+		"ÉCOLE":      "école",
+		"\xc3":       "\xc3",
+		"A\xe2\x82B": "a\xe2\x82b",
+		"":           "",
+	}
+
+	for s, expect := range cases {
+		if got := lowerPiece(s); got != expect {
+			t.Errorf("%q: expected %q, got %q", s, expect, got)
+		}
+	}
+}
@@ -1,10 +1,18 @@
 package runner
 
 import (
+	"bufio"
+	"encoding/binary"
 	"errors"
 	"fmt"
+	"hash/maphash"
+	"io"
 	"log/slog"
+	"math"
+	"os"
+	"path/filepath"
 	"reflect"
+	"regexp"
 	"time"
 
 	"github.com/ollama/ollama/llama"
@@ -20,10 +28,44 @@ type InputCache struct {
 	// optimize cache eviction for multiple users
 	multiUserCache bool
 
+	// snapshots of prompt prefixes, held in the sequences after the slots'
+	prefixes [maxPrefixes]*prefixSnapshot
+
+	// most inputs the prefixes hold altogether, which is space in the KV
+	// cache beyond that of the slots. Prefixes aren't kept if it's 0.
+	prefixSize int
+
+	prefixSeed maphash.Seed
+
+	// directory the KV caches of sessions are saved to when their slots are
+	// reused, or empty if they aren't saved
+	sessionDir string
+
 	lc *llama.Context
 }
 
-func NewInputCache(lc *llama.Context, kvSize int, numSlots int, multiUserCache bool) (*InputCache, error) {
+// maxPrefixes is the most prompt prefixes kept at once
+const maxPrefixes = 8
+
+// prefixSnapshot is the KV cache of a prompt prefix shared by many requests,
+// such as a system prompt, kept in a sequence of its own so it outlives the
+// slots that processed it. Slots loaded from a snapshot share its cells in
+// the KV cache rather than copying them.
+type prefixSnapshot struct {
+	// id is the sequence holding the prefix in the KV cache
+	id int
+
+	hash   uint64
+	inputs []input
+
+	// refs is the number of slots in use that were loaded from the
+	// snapshot, which keep it from being evicted
+	refs int
+
+	lastUsed time.Time
+}
+
+func NewInputCache(lc *llama.Context, kvSize int, numSlots int, multiUserCache bool, prefixSize int, sessionDir string) (*InputCache, error) {
 	if kvSize/numSlots < 1 {
 		return nil, fmt.Errorf("must have at least one kv cache entry per parallel sequence (kv: %v parallel: %v)", kvSize, numSlots)
 	}
@@ -41,6 +83,9 @@ func NewInputCache(lc *llama.Context, kvSize int, numSlots int, multiUserCache b
 		numCtx:         kvSize / numSlots,
 		slots:          slots,
 		multiUserCache: multiUserCache,
+		prefixSize:     prefixSize,
+		prefixSeed:     maphash.MakeSeed(),
+		sessionDir:     sessionDir,
 		lc:             lc,
 	}, nil
 }
@@ -56,14 +101,45 @@ type InputCacheSlot struct {
 	// Inputs that are stored in the KV cache
 	Inputs []input
 
+	// Offset is the position of the first input in the KV cache. Positions
+	// of the following inputs are consecutive from there.
+	Offset int
+
 	// is this cache actively being processed as part of a sequence?
 	InUse bool
 
 	// last time this cache was used (as of start of processing)
 	lastUsed time.Time
+
+	// prefix is the snapshot the slot was loaded from while it's in use
+	prefix *prefixSnapshot
+
+	// session whose conversation the slot holds, saved before the slot is
+	// used for anything else
+	session string
+
+	// paths to the LoRA adapters the inputs were processed with, joined by
+	// newlines
+	adapters string
+}
+
+// Pos returns the position in the KV cache of the input at index i
+func (s *InputCacheSlot) Pos(i int) int {
+	return s.Offset + i
 }
 
-func (c *InputCache) LoadCacheSlot(prompt []input, cachePrompt bool) (*InputCacheSlot, []input, error) {
+// LoadCacheSlot finds a slot for prompt, which starts at position offset,
+// and returns the inputs that aren't already in its cache. If share is set,
+// the prompt may be forked from a slot which is in use. The first prefix
+// inputs of the prompt are loaded from a snapshot if there's one for them.
+// Prompts of a session use the slot that holds it, or are loaded from its
+// saved KV cache. Inputs are only reused if they were processed with the same
+// adapters.
+func (c *InputCache) LoadCacheSlot(prompt []input, offset int, cachePrompt, share bool, prefix int, session, adapters string) (*InputCacheSlot, []input, error) {
+	if offset < 0 || offset > llama.MaxPos {
+		return nil, nil, fmt.Errorf("invalid position offset %d", offset)
+	}
+
 	var slot *InputCacheSlot
 	var numPast int
 	var err error
@@ -74,33 +150,68 @@ func (c *InputCache) LoadCacheSlot(prompt []input, cachePrompt bool) (*InputCach
 	// For multiple users, the "best" cache slot produces better input cache hit rates
 	// at the cost of worse performance when we miss the input cache (because it causes
 	// GPU L2 cache misses due to spreading out accesses across VRAM).
-	if !c.multiUserCache {
-		slot, numPast, err = c.findLongestCacheSlot(prompt)
+	// Requests sharing a prompt with one in progress also use the "best" slot,
+	// since it can fork the prompt from a slot that is in use.
+	if slot = c.findSessionSlot(session); slot != nil {
+		numPast = cachedPrefix(slot, prompt, adapters)
+	} else if !c.multiUserCache && !share {
+		slot, numPast, err = c.findLongestCacheSlot(prompt, adapters)
 	} else {
-		slot, numPast, err = c.findBestCacheSlot(prompt)
+		slot, numPast, err = c.findBestCacheSlot(prompt, adapters)
 	}
 	if err != nil {
 		return nil, nil, err
 	}
 
-	if !cachePrompt {
+	if slot.session != session {
+		c.saveSession(slot)
+	}
+
+	// cached inputs at other positions can't be reused
+	if !cachePrompt || slot.Offset != offset {
 		numPast = 0
 	}
 
 	slot.InUse = true
 	slot.lastUsed = time.Now()
+	slot.adapters = adapters
+
+	// saved sessions are processed without adapters
+	if session != "" && cachePrompt && offset == 0 && adapters == "" {
+		numPast = c.loadSession(slot, session, prompt, numPast)
+	}
+	slot.session = session
+
+	if cachePrompt && offset == 0 && numPast < prefix {
+		if snapshot := c.findPrefix(prompt[:prefix]); snapshot != nil {
+			slog.Debug("loading cache slot from prefix", "id", slot.Id, "prefix", snapshot.id, "inputs", prefix)
+			c.lc.KvCacheSeqRm(slot.Id, 0, -1)
+			c.lc.KvCacheSeqCp(snapshot.id, slot.Id, 0, prefix)
+
+			slot.Inputs = append(slot.Inputs[:0], snapshot.inputs...)
+			slot.Offset = 0
+			slot.prefix = snapshot
+			snapshot.refs++
+			snapshot.lastUsed = time.Now()
+			numPast = prefix
+		}
+	}
 
 	if numPast == len(prompt) {
 		// Leave one input to sample so we can get a response
 		numPast--
 	}
 
-	if !c.lc.KvCacheSeqRm(slot.Id, numPast, -1) {
+	if !c.lc.KvCacheSeqRm(slot.Id, slot.Pos(numPast), -1) {
 		// Some models don't support partial erasure
 		c.lc.KvCacheSeqRm(slot.Id, 0, -1)
 		numPast = 0
 	}
 
+	if numPast == 0 {
+		slot.Offset = offset
+	}
+
 	slog.Debug("loading cache slot", "id", slot.Id, "cache", len(slot.Inputs), "prompt", len(prompt),
 		"used", numPast, "remaining", len(prompt)-numPast)
 
@@ -110,7 +221,339 @@ func (c *InputCache) LoadCacheSlot(prompt []input, cachePrompt bool) (*InputCach
 	return slot, prompt, nil
 }
 
-func (c *InputCache) findLongestCacheSlot(prompt []input) (*InputCacheSlot, int, error) {
+// ReleaseCacheSlot marks the slot as no longer in use
+func (c *InputCache) ReleaseCacheSlot(slot *InputCacheSlot) {
+	if slot.prefix != nil {
+		slot.prefix.refs--
+		slot.prefix = nil
+	}
+
+	slot.InUse = false
+}
+
+// FindImage returns the embeddings of the image with hash if a slot or
+// prefix holds all of them, or nil otherwise
+func (c *InputCache) FindImage(hash uint64) [][]float32 {
+	find := func(inputs []input) [][]float32 {
+		var embed [][]float32
+		for _, in := range inputs {
+			switch {
+			case in.image.hash != hash:
+				embed = nil
+				continue
+			case in.image.index == 0:
+				embed = nil
+			case in.image.index != len(embed):
+				embed = nil
+				continue
+			}
+
+			embed = append(embed, in.embed)
+			if len(embed) == in.image.count {
+				return embed
+			}
+		}
+
+		return nil
+	}
+
+	for _, s := range c.slots {
+		if embed := find(s.Inputs); embed != nil {
+			slog.Debug("loading image embeddings from cache slot", "id", s.Id)
+			return embed
+		}
+	}
+
+	for _, p := range c.prefixes {
+		if p != nil {
+			if embed := find(p.inputs); embed != nil {
+				slog.Debug("loading image embeddings from prefix", "id", p.id)
+				return embed
+			}
+		}
+	}
+
+	return nil
+}
+
+func (c *InputCache) hashPrefix(inputs []input) uint64 {
+	var h maphash.Hash
+	h.SetSeed(c.prefixSeed)
+
+	var b [8]byte
+	for _, input := range inputs {
+		binary.LittleEndian.PutUint64(b[:], uint64(input.token))
+		h.Write(b[:])
+		for _, f := range input.embed {
+			binary.LittleEndian.PutUint32(b[:4], math.Float32bits(f))
+			h.Write(b[:4])
+		}
+	}
+
+	return h.Sum64()
+}
+
+// findPrefix returns the snapshot of the inputs of prefix, or nil if there
+// isn't one
+func (c *InputCache) findPrefix(prefix []input) *prefixSnapshot {
+	if c.prefixSize == 0 {
+		return nil
+	}
+
+	hash := c.hashPrefix(prefix)
+	for _, snapshot := range c.prefixes {
+		if snapshot != nil && snapshot.hash == hash && countCommonPrefix(snapshot.inputs, prefix) == len(prefix) {
+			return snapshot
+		}
+	}
+
+	return nil
+}
+
+// SavePrefix keeps a snapshot of the first n inputs of the slot, if there
+// isn't one already, so later prompts that start with them can be loaded
+// from it. Snapshots that aren't in use are evicted, least recently used
+// first, to make room for it.
+func (c *InputCache) SavePrefix(slot *InputCacheSlot, n int) {
+	if c.prefixSize == 0 || n <= 0 || n > c.prefixSize || n > len(slot.Inputs) || slot.Offset != 0 {
+		return
+	}
+
+	if c.findPrefix(slot.Inputs[:n]) != nil {
+		return
+	}
+
+	free := -1
+	size := 0
+	for i, snapshot := range c.prefixes {
+		if snapshot == nil {
+			free = i
+		} else {
+			size += len(snapshot.inputs)
+		}
+	}
+
+	for free < 0 || size+n > c.prefixSize {
+		evict := -1
+		for i, snapshot := range c.prefixes {
+			if snapshot != nil && snapshot.refs == 0 && (evict < 0 || snapshot.lastUsed.Before(c.prefixes[evict].lastUsed)) {
+				evict = i
+			}
+		}
+
+		if evict < 0 {
+			// every snapshot is in use
+			return
+		}
+
+		snapshot := c.prefixes[evict]
+		slog.Debug("evicting prefix", "id", snapshot.id, "inputs", len(snapshot.inputs), "used", snapshot.lastUsed)
+		if c.lc != nil {
+			c.lc.KvCacheSeqRm(snapshot.id, 0, -1)
+		}
+
+		c.prefixes[evict] = nil
+		size -= len(snapshot.inputs)
+		free = evict
+	}
+
+	snapshot := &prefixSnapshot{
+		id:       len(c.slots) + free,
+		hash:     c.hashPrefix(slot.Inputs[:n]),
+		inputs:   append([]input(nil), slot.Inputs[:n]...),
+		lastUsed: time.Now(),
+	}
+
+	slog.Debug("saving prefix", "id", snapshot.id, "slot", slot.Id, "inputs", n)
+	if c.lc != nil {
+		c.lc.KvCacheSeqCp(slot.Id, snapshot.id, 0, n)
+	}
+
+	c.prefixes[free] = snapshot
+}
+
+// findSessionSlot returns the slot holding the session if it isn't in use
+func (c *InputCache) findSessionSlot(session string) *InputCacheSlot {
+	if session == "" {
+		return nil
+	}
+
+	for i, s := range c.slots {
+		if s.session == session && !s.InUse {
+			return &c.slots[i]
+		}
+	}
+
+	return nil
+}
+
+// sessionNameRegexp matches the names of sessions, which name their files
+var sessionNameRegexp = regexp.MustCompile(`^[0-9a-f]{1,64}$`)
+
+func (c *InputCache) sessionPath(session string) string {
+	return filepath.Join(c.sessionDir, session+".session")
+}
+
+// saveSession saves the KV cache of the slot's session, which is about to be
+// replaced by another prompt, so the session can be loaded from it later. It
+// is written in the background.
+func (c *InputCache) saveSession(slot *InputCacheSlot) {
+	session := slot.session
+	slot.session = ""
+
+	// This is only nil for unit tests
+	if session == "" || c.sessionDir == "" || c.lc == nil || slot.Offset != 0 || len(slot.Inputs) == 0 || slot.adapters != "" {
+		return
+	}
+
+	tokens := make([]int32, len(slot.Inputs))
+	for i, input := range slot.Inputs {
+		if input.embed != nil {
+			// images aren't saved
+			return
+		}
+
+		tokens[i] = int32(input.token)
+	}
+
+	state := c.lc.StateSeqGetData(slot.Id)
+	if state == nil {
+		return
+	}
+
+	slog.Debug("saving session", "id", slot.Id, "session", session, "inputs", len(tokens), "size", len(state))
+	go func() {
+		if err := writeSession(c.sessionPath(session), tokens, state); err != nil {
+			slog.Warn("failed to save session", "session", session, "error", err)
+		}
+	}()
+}
+
+// loadSession loads the saved KV cache of a session into the slot if it holds
+// more of the prompt than the numPast inputs already in the slot. It returns
+// the number of inputs of the prompt the slot holds.
+func (c *InputCache) loadSession(slot *InputCacheSlot, session string, prompt []input, numPast int) int {
+	if c.sessionDir == "" || c.lc == nil {
+		return numPast
+	}
+
+	f, err := os.Open(c.sessionPath(session))
+	if errors.Is(err, os.ErrNotExist) {
+		return numPast
+	} else if err != nil {
+		slog.Warn("failed to load session", "session", session, "error", err)
+		return numPast
+	}
+	defer f.Close()
+
+	tokens, err := readSessionTokens(f, c.numCtx)
+	if err != nil {
+		slog.Warn("failed to load session", "session", session, "error", err)
+		return numPast
+	}
+
+	inputs := make([]input, len(tokens))
+	for i, t := range tokens {
+		inputs[i] = input{token: int(t)}
+	}
+
+	n := countCommonPrefix(inputs, prompt)
+	if n <= numPast {
+		return numPast
+	}
+
+	state, err := io.ReadAll(f)
+	if err != nil {
+		slog.Warn("failed to load session", "session", session, "error", err)
+		return numPast
+	}
+
+	slog.Debug("loading session", "id", slot.Id, "session", session, "inputs", len(inputs), "used", n)
+	c.lc.KvCacheSeqRm(slot.Id, 0, -1)
+	if !c.lc.StateSeqSetData(slot.Id, state) {
+		slog.Warn("failed to load session", "session", session, "error", "invalid KV cache")
+		c.lc.KvCacheSeqRm(slot.Id, 0, -1)
+		slot.Inputs = slot.Inputs[:0]
+		return 0
+	}
+
+	slot.Inputs = inputs
+	slot.Offset = 0
+	return n
+}
+
+// writeSession writes the tokens of a session followed by its KV cache,
+// replacing the file at path in one step so it's never read half written
+func writeSession(path string, tokens []int32, state []byte) error {
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	w := bufio.NewWriter(f)
+	if err := binary.Write(w, binary.LittleEndian, uint32(len(tokens))); err != nil {
+		return err
+	}
+
+	if err := binary.Write(w, binary.LittleEndian, tokens); err != nil {
+		return err
+	}
+
+	if _, err := w.Write(state); err != nil {
+		return err
+	}
+
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(f.Name(), path)
+}
+
+// readSessionTokens reads the tokens written by writeSession, leaving r at
+// the start of the KV cache. There can't be more than limit tokens.
+func readSessionTokens(r io.Reader, limit int) ([]int32, error) {
+	var n uint32
+	if err := binary.Read(r, binary.LittleEndian, &n); err != nil {
+		return nil, err
+	}
+
+	if int64(n) > int64(limit) {
+		return nil, fmt.Errorf("invalid number of tokens %d", n)
+	}
+
+	tokens := make([]int32, n)
+	if err := binary.Read(r, binary.LittleEndian, tokens); err != nil {
+		return nil, err
+	}
+
+	return tokens, nil
+}
+
+// TrimCacheSlot drops the inputs after the first n from the slot, so later
+// prompts can't reuse them
+func (c *InputCache) TrimCacheSlot(slot *InputCacheSlot, n int) {
+	if n >= len(slot.Inputs) {
+		return
+	}
+
+	if !c.lc.KvCacheSeqRm(slot.Id, slot.Pos(n), -1) {
+		// Some models don't support partial erasure
+		c.lc.KvCacheSeqRm(slot.Id, 0, -1)
+		n = 0
+	}
+
+	slog.Debug("trimming cache slot", "id", slot.Id, "cache", len(slot.Inputs), "kept", n)
+	slot.Inputs = slot.Inputs[:n]
+}
+
+func (c *InputCache) findLongestCacheSlot(prompt []input, adapters string) (*InputCacheSlot, int, error) {
 	longest := -1
 	var longestSlot *InputCacheSlot
 
@@ -119,7 +562,7 @@ func (c *InputCache) findLongestCacheSlot(prompt []input) (*InputCacheSlot, int,
 			continue
 		}
 
-		count := countCommonPrefix(s.Inputs, prompt)
+		count := cachedPrefix(&s, prompt, adapters)
 		if count > longest {
 			longest = count
 			longestSlot = &c.slots[i]
@@ -133,7 +576,7 @@ func (c *InputCache) findLongestCacheSlot(prompt []input) (*InputCacheSlot, int,
 	return longestSlot, longest, nil
 }
 
-func (c *InputCache) findBestCacheSlot(prompt []input) (*InputCacheSlot, int, error) {
+func (c *InputCache) findBestCacheSlot(prompt []input, adapters string) (*InputCacheSlot, int, error) {
 	oldest := time.Now()
 	var oldestSlot *InputCacheSlot
 
@@ -141,7 +584,7 @@ func (c *InputCache) findBestCacheSlot(prompt []input) (*InputCacheSlot, int, er
 	var longestSlot *InputCacheSlot
 
 	for i, s := range c.slots {
-		count := countCommonPrefix(s.Inputs, prompt)
+		count := cachedPrefix(&s, prompt, adapters)
 		if count > longest {
 			longest = count
 			longestSlot = &c.slots[i]
@@ -167,20 +610,33 @@ func (c *InputCache) findBestCacheSlot(prompt []input) (*InputCacheSlot, int, er
 	}
 
 	if longest > 0 && longestSlot != oldestSlot {
+		c.saveSession(oldestSlot)
+
 		slog.Debug("forking cache slot", "src", longestSlot.Id, "dst", oldestSlot.Id, "inputs", longest, "total",
 			len(longestSlot.Inputs))
 		oldestSlot.Inputs = make([]input, longest)
 		copy(oldestSlot.Inputs, longestSlot.Inputs[:longest])
+		oldestSlot.Offset = longestSlot.Offset
 		// This is only nil for unit tests
 		if c.lc != nil {
 			c.lc.KvCacheSeqRm(oldestSlot.Id, 0, -1)
-			c.lc.KvCacheSeqCp(longestSlot.Id, oldestSlot.Id, 0, longest)
+			c.lc.KvCacheSeqCp(longestSlot.Id, oldestSlot.Id, longestSlot.Pos(0), longestSlot.Pos(longest))
 		}
 	}
 
 	return oldestSlot, longest, nil
 }
 
+// cachedPrefix returns the number of inputs at the start of prompt that the
+// slot holds, which is none if they were processed with other adapters
+func cachedPrefix(s *InputCacheSlot, prompt []input, adapters string) int {
+	if s.adapters != adapters {
+		return 0
+	}
+
+	return countCommonPrefix(s.Inputs, prompt)
+}
+
 func countCommonPrefix(a []input, b []input) int {
 	var count int
 
@@ -232,10 +688,10 @@ func (c *InputCache) ShiftCacheSlot(slot *InputCacheSlot, numKeep int) error {
 		"keep", numKeep, "discard", discard)
 
 	// TODO (jessegross): KV cache removal can fail for certain types of models
-	if !c.lc.KvCacheSeqRm(slot.Id, numKeep, numKeep+discard) {
+	if !c.lc.KvCacheSeqRm(slot.Id, slot.Pos(numKeep), slot.Pos(numKeep+discard)) {
 		return fmt.Errorf("unable to remove old kv cache entries (id: %v, keep: %v discard: %v)", slot.Id, numKeep, discard)
 	}
-	c.lc.KvCacheSeqAdd(slot.Id, numKeep+discard, len(slot.Inputs), -discard)
+	c.lc.KvCacheSeqAdd(slot.Id, slot.Pos(numKeep+discard), slot.Pos(len(slot.Inputs)), -discard)
 
 	for i := numKeep + discard; i < len(slot.Inputs); i++ {
 		slot.Inputs[i-discard] = slot.Inputs[i]
@@ -244,3 +700,18 @@ func (c *InputCache) ShiftCacheSlot(slot *InputCacheSlot, numKeep int) error {
 
 	return nil
 }
+
+// RebaseCacheSlot moves the inputs in the KV cache to start at position 0.
+// Rope only depends on the distance between positions so this doesn't change
+// the output, but it lets sequences started at a large offset keep going
+// without overflowing the positions llama.cpp can represent.
+func (c *InputCache) RebaseCacheSlot(slot *InputCacheSlot) {
+	if slot.Offset == 0 {
+		return
+	}
+
+	slog.Debug("rebasing cache slot", "id", slot.Id, "offset", slot.Offset)
+
+	c.lc.KvCacheSeqAdd(slot.Id, slot.Offset, -1, -slot.Offset)
+	slot.Offset = 0
+}
@@ -1,6 +1,12 @@
 package runner
 
 import (
+	"hash/maphash"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
 	"testing"
 	"time"
 )
@@ -205,7 +211,7 @@ func TestFindCacheSlot(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run("Longest-"+tt.name, func(t *testing.T) {
-			result, resultLen, err := tt.cache.findLongestCacheSlot(tt.prompt)
+			result, resultLen, err := tt.cache.findLongestCacheSlot(tt.prompt, "")
 			if err != nil {
 				t.Errorf("findLongestCacheSlot: err %v", err)
 			} else if result.Id != tt.longest.result || resultLen != tt.longest.len {
@@ -217,7 +223,7 @@ func TestFindCacheSlot(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run("Best-"+tt.name, func(t *testing.T) {
-			result, resultLen, err := tt.cache.findBestCacheSlot(tt.prompt)
+			result, resultLen, err := tt.cache.findBestCacheSlot(tt.prompt, "")
 			if err != nil {
 				t.Errorf("findBestCacheSlot: err %v", err)
 			} else if result.Id != tt.best.result || resultLen != tt.best.len {
@@ -290,3 +296,227 @@ func TestShiftDiscard(t *testing.T) {
 		})
 	}
 }
+
+func TestCacheSlotOffset(t *testing.T) {
+	c := InputCache{slots: []InputCacheSlot{
+		{
+			Id:       0,
+			Inputs:   []input{{token: 1}, {token: 2}, {token: 3}},
+			Offset:   100,
+			InUse:    true,
+			lastUsed: time.Now(),
+		},
+		{
+			Id:       1,
+			Inputs:   []input{},
+			lastUsed: time.Time{},
+		},
+	}}
+
+	if pos := c.slots[0].Pos(2); pos != 102 {
+		t.Errorf("expected position 102, got %d", pos)
+	}
+
+	// forking a slot keeps the positions of its inputs
+	slot, numPast, err := c.findBestCacheSlot([]input{{token: 1}, {token: 2}, {token: 4}}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if slot.Id != 1 || numPast != 2 || slot.Offset != 100 {
+		t.Errorf("expected slot 1 with 2 inputs at offset 100, got slot %d with %d inputs at offset %d", slot.Id, numPast, slot.Offset)
+	}
+
+	if _, _, err := c.LoadCacheSlot([]input{{token: 1}}, -1, true, false, 0, "", ""); err == nil {
+		t.Error("expected error for negative offset")
+	}
+}
+
+func TestCacheSlotAdapters(t *testing.T) {
+	c := InputCache{slots: []InputCacheSlot{
+		{Id: 0, Inputs: []input{{token: 1}, {token: 2}, {token: 3}}, adapters: "a"},
+		{Id: 1, Inputs: []input{{token: 1}, {token: 2}}},
+	}}
+
+	prompt := []input{{token: 1}, {token: 2}, {token: 3}, {token: 4}}
+	cases := []struct {
+		adapters string
+		slot     int
+		numPast  int
+	}{
+		{"", 1, 2},
+		{"a", 0, 3},
+		{"b", 0, 0},
+	}
+
+	for _, tt := range cases {
+		slot, numPast, err := c.findLongestCacheSlot(prompt, tt.adapters)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if slot.Id != tt.slot || numPast != tt.numPast {
+			t.Errorf("adapters %q: expected slot %d with %d inputs, got slot %d with %d inputs", tt.adapters, tt.slot, tt.numPast, slot.Id, numPast)
+		}
+	}
+
+	// inputs processed with other adapters aren't forked
+	c.slots[0].InUse = true
+	c.slots[1].Inputs = nil
+	slot, numPast, err := c.findBestCacheSlot(prompt, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if slot.Id != 1 || numPast != 0 || len(slot.Inputs) != 0 {
+		t.Errorf("expected empty slot 1, got slot %d with %d inputs", slot.Id, numPast)
+	}
+}
+
+func TestSavePrefix(t *testing.T) {
+	c := InputCache{
+		slots: []InputCacheSlot{
+			{Id: 0, Inputs: []input{{token: 1}, {token: 2}, {token: 3}, {token: 4}}},
+			{Id: 1, Inputs: []input{{token: 5}, {token: 6}, {token: 7}}},
+		},
+		prefixSize: 5,
+		prefixSeed: maphash.MakeSeed(),
+	}
+
+	c.SavePrefix(&c.slots[0], 3)
+	if snapshot := c.findPrefix([]input{{token: 1}, {token: 2}, {token: 3}}); snapshot == nil || snapshot.id < len(c.slots) {
+		t.Fatalf("expected a snapshot after the slots, got %+v", snapshot)
+	}
+
+	if snapshot := c.findPrefix([]input{{token: 1}, {token: 2}, {token: 4}}); snapshot != nil {
+		t.Errorf("expected no snapshot, got %+v", snapshot)
+	}
+
+	// the first snapshot is in use so there isn't room for the second
+	first := c.findPrefix([]input{{token: 1}, {token: 2}, {token: 3}})
+	c.slots[0].prefix = first
+	first.refs++
+
+	c.SavePrefix(&c.slots[1], 3)
+	if c.findPrefix([]input{{token: 5}, {token: 6}, {token: 7}}) != nil {
+		t.Error("expected the snapshot in use not to be evicted")
+	}
+
+	c.ReleaseCacheSlot(&c.slots[0])
+	if first.refs != 0 || c.slots[0].prefix != nil {
+		t.Errorf("expected the snapshot to be released, got %d refs", first.refs)
+	}
+
+	c.SavePrefix(&c.slots[1], 3)
+	if c.findPrefix([]input{{token: 5}, {token: 6}, {token: 7}}) == nil {
+		t.Error("expected a snapshot of the second slot")
+	}
+
+	if c.findPrefix([]input{{token: 1}, {token: 2}, {token: 3}}) != nil {
+		t.Error("expected the first snapshot to be evicted")
+	}
+
+	// prefixes larger than the space for them aren't kept
+	c.SavePrefix(&c.slots[0], 4)
+	c.slots[0].Inputs = append(c.slots[0].Inputs, input{token: 8}, input{token: 9})
+	c.SavePrefix(&c.slots[0], 6)
+	if c.findPrefix(c.slots[0].Inputs[:6]) != nil {
+		t.Error("expected no snapshot larger than the prefix cache")
+	}
+}
+
+func TestSessionFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "abc.session")
+	if err := writeSession(path, []int32{1, 2, 3}, []byte("state")); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	if _, err := readSessionTokens(f, 2); err == nil {
+		t.Error("expected an error for more tokens than the limit")
+	}
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+
+	tokens, err := readSessionTokens(f, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !slices.Equal(tokens, []int32{1, 2, 3}) {
+		t.Errorf("expected tokens [1 2 3], got %v", tokens)
+	}
+
+	if state, err := io.ReadAll(f); err != nil || string(state) != "state" {
+		t.Errorf("expected state %q, got %q %v", "state", state, err)
+	}
+}
+
+func TestFindSessionSlot(t *testing.T) {
+	c := InputCache{slots: []InputCacheSlot{
+		{Id: 0, Inputs: []input{{token: 1}}, session: "a", InUse: true},
+		{Id: 1, Inputs: []input{{token: 2}}, session: "b"},
+	}}
+
+	if slot := c.findSessionSlot("b"); slot == nil || slot.Id != 1 {
+		t.Errorf("expected slot 1, got %+v", slot)
+	}
+
+	// a session's slot can't be used by two prompts at once
+	if slot := c.findSessionSlot("a"); slot != nil {
+		t.Errorf("expected no slot, got %+v", slot)
+	}
+
+	if slot := c.findSessionSlot(""); slot != nil {
+		t.Errorf("expected no slot, got %+v", slot)
+	}
+
+	// saving clears the session of a slot about to be reused
+	c.saveSession(&c.slots[1])
+	if c.slots[1].session != "" {
+		t.Errorf("expected no session, got %q", c.slots[1].session)
+	}
+}
+
+func TestFindImage(t *testing.T) {
+	image := func(hash uint64, embed ...[]float32) []input {
+		var inputs []input
+		for i, e := range embed {
+			inputs = append(inputs, input{embed: e, image: imagePart{hash: hash, index: i, count: len(embed)}})
+		}
+		return inputs
+	}
+
+	a := image(1, []float32{0.1}, []float32{0.2})
+	b := image(2, []float32{0.3}, []float32{0.4}, []float32{0.5})
+
+	c := InputCache{slots: []InputCacheSlot{
+		// the start of b was shifted out of the context
+		{Id: 0, Inputs: slices.Concat([]input{{token: 1}}, b[1:], []input{{token: 2}})},
+		{Id: 1, Inputs: slices.Concat([]input{{token: 1}}, a, []input{{token: 2}}, b)},
+	}}
+
+	if embed := c.FindImage(1); !reflect.DeepEqual(embed, [][]float32{{0.1}, {0.2}}) {
+		t.Errorf("unexpected embeddings %v", embed)
+	}
+
+	if embed := c.FindImage(2); !reflect.DeepEqual(embed, [][]float32{{0.3}, {0.4}, {0.5}}) {
+		t.Errorf("unexpected embeddings %v", embed)
+	}
+
+	c.slots[1].Inputs = c.slots[1].Inputs[:len(c.slots[1].Inputs)-1]
+	if embed := c.FindImage(2); embed != nil {
+		t.Errorf("expected no embeddings for a partial image, got %v", embed)
+	}
+
+	if embed := c.FindImage(3); embed != nil {
+		t.Errorf("expected no embeddings, got %v", embed)
+	}
+}
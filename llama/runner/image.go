@@ -72,11 +72,11 @@ func (c *ImageContext) NewEmbed(llamaContext *llama.Context, data []byte, aspect
 		return nil, errors.New("received zero length image")
 	}
 
-	hash := c.hashImage(data)
-
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
+	hash := c.hashImage(data)
+
 	embed, err := c.findImage(hash)
 	if err != nil {
 		if c.mllama != nil {
@@ -99,6 +99,13 @@ func (c *ImageContext) NewEmbed(llamaContext *llama.Context, data []byte, aspect
 	return embed, nil
 }
 
+// Hash returns the hash identifying the image data in the caches
+func (c *ImageContext) Hash(data []byte) uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.hashImage(data)
+}
+
 func (c *ImageContext) BatchSize(configuredBatchSize int) int {
 	// If images are not supported, we don't need to allocate embedding batches
 	if c == nil {
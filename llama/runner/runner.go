@@ -1,6 +1,7 @@
 package runner
 
 import (
+	"cmp"
 	"context"
 	"encoding/json"
 	"errors"
@@ -8,15 +9,18 @@ import (
 	"fmt"
 	"log"
 	"log/slog"
+	"math"
 	"net"
 	"net/http"
 	"os"
 	"path/filepath"
 	"regexp"
 	"runtime"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 	"unicode/utf8"
 
@@ -24,6 +28,7 @@ import (
 
 	"github.com/ollama/ollama/api"
 	"github.com/ollama/ollama/llama"
+	"github.com/ollama/ollama/logutil"
 )
 
 // input is an element of the prompt to process, either
@@ -33,6 +38,17 @@ type input struct {
 
 	// embed is an image embedding
 	embed []float32
+
+	// image is the part of an image the embedding is, so the embeddings of
+	// images already in the cache can be used again without processing them
+	image imagePart
+}
+
+// imagePart identifies an embedding as the one at index of the count
+// embeddings of the image with hash
+type imagePart struct {
+	hash         uint64
+	index, count int
 }
 
 type Sequence struct {
@@ -51,6 +67,15 @@ type Sequence struct {
 	// tokens that have been generated but not returned yet (e.g. for stop sequences)
 	pendingResponses []string
 
+	// log probabilities of the pending responses, when returned
+	pendingLogprobs []api.Logprob
+
+	// tokens of the pending responses, when returned
+	pendingTokens []int
+
+	// number of bytes of the responses sent so far
+	sentBytes int
+
 	// input cache being used by this sequence
 	cache *InputCacheSlot
 
@@ -59,7 +84,7 @@ type Sequence struct {
 	crossAttention bool
 
 	// channel to send responses over
-	responses chan string
+	responses chan response
 
 	// channel to stop decoding (such as if the remote connection is closed)
 	quit chan bool
@@ -67,8 +92,14 @@ type Sequence struct {
 	// number of tokens to predict
 	numPredict int
 
+	// time after which generation stops, zero if unbounded
+	deadline time.Time
+
 	samplingCtx *llama.SamplingContext
 
+	// tokens and strings that are never generated
+	ban *banList
+
 	// channel to send back the embedding if embedding only
 	embedding chan []float32
 
@@ -81,21 +112,86 @@ type Sequence struct {
 	// true if an embedding are to be returned instead of text generation
 	embeddingOnly bool
 
+	// raw output ("logits" or "hidden_states") to return instead of text
+	// generation, or "perplexity" to sum the log probabilities of each
+	// prompt token given the ones before it into logprob
+	rawOutput string
+
+	// raw values collected once the prompt has been processed
+	raw []float32
+
+	// sum the log probabilities of generated tokens into logprob
+	logprobs bool
+	logprob  float64
+
+	// log probabilities of each prompt token after the first given the ones
+	// before it, with perplexity
+	promptLogprobs []float32
+
+	// number of candidates to trace through sampling for each generated
+	// token into trace
+	traceSampling int
+	trace         []api.SampledToken
+
+	// return the log probability of each generated token, and of this many
+	// of the most likely tokens in its place, with the responses
+	tokenLogprobs bool
+	topLogprobs   int
+
+	// return the tokens of the responses and their offsets
+	returnTokens bool
+
 	doneReason string
 
+	// number of inputs kept in the cache once the sequence is done, or -1
+	// to keep all of them
+	cacheLimit int
+
+	// number of inputs at the start of the prompt shared with other
+	// requests, which are loaded from or saved to a prefix snapshot
+	prefix int
+
+	// paths to the LoRA adapters applied while processing the sequence
+	adapters []string
+
 	// Metrics
 	startProcessingTime time.Time
 	startGenerationTime time.Time
 	numDecoded          int
 	numPromptInputs     int
+	numCachedInputs     int
 }
 
 type NewSequenceParams struct {
 	numPredict     int
+	maxTime        time.Duration
 	stop           []string
 	numKeep        int
 	samplingParams *llama.SamplingParams
 	embedding      bool
+	rawOutput      string
+	logprobs       bool
+	traceSampling  int
+	tokenLogprobs  bool
+	topLogprobs    int
+	returnTokens   bool
+	ban            []string
+	banTokens      []int
+
+	// cacheLength is the length in bytes of the start of the prompt to keep
+	// in the cache, or nil to keep the whole sequence
+	cacheLength *int
+
+	// tokens, if set, are the prompt as token ids, used as is instead of
+	// tokenizing the prompt
+	tokens []int
+
+	// prefixLength is the length in bytes of the start of the prompt that's
+	// shared with other requests, such as a rendered system prompt
+	prefixLength int
+
+	// adapters are paths to LoRA adapters applied for the sequence
+	adapters []string
 }
 
 func (s *Server) NewSequence(prompt string, images []ImageData, params NewSequenceParams) (*Sequence, error) {
@@ -103,13 +199,42 @@ func (s *Server) NewSequence(prompt string, images []ImageData, params NewSequen
 
 	startTime := time.Now()
 
-	inputs, err := s.inputs(prompt, images)
+	var inputs []input
+	var err error
+	if params.tokens != nil {
+		inputs, err = s.tokenInputs(params.tokens)
+	} else {
+		inputs, err = s.inputs(prompt, images)
+	}
+
 	if err != nil {
 		return nil, fmt.Errorf("failed to process inputs: %w", err)
 	} else if len(inputs) == 0 {
 		return nil, errors.New("no input provided")
 	}
 
+	cacheLimit := -1
+	if params.cacheLength != nil && params.tokens == nil {
+		prefix, err := s.inputs(prompt[:min(max(*params.cacheLength, 0), len(prompt))], images)
+		if err != nil {
+			return nil, fmt.Errorf("failed to process inputs: %w", err)
+		}
+
+		// the prefix may be tokenized differently where it was cut off
+		cacheLimit = countCommonPrefix(prefix, inputs)
+	}
+
+	// prefix snapshots are only kept of the model without adapters
+	var numPrefix int
+	if params.prefixLength > 0 && params.tokens == nil && s.cache.prefixSize > 0 && len(params.adapters) == 0 {
+		prefix, err := s.inputs(prompt[:min(params.prefixLength, len(prompt))], images)
+		if err != nil {
+			return nil, fmt.Errorf("failed to process inputs: %w", err)
+		}
+
+		numPrefix = countCommonPrefix(prefix, inputs)
+	}
+
 	if params.numKeep < 0 {
 		params.numKeep = len(inputs)
 	}
@@ -118,8 +243,32 @@ func (s *Server) NewSequence(prompt string, images []ImageData, params NewSequen
 		params.numKeep += 1
 	}
 
+	// the virtual tokens of a soft prompt come before everything else and are
+	// never shifted out
+	if len(s.softPrompt) > 0 {
+		virtual := make([]input, len(s.softPrompt), len(s.softPrompt)+len(inputs))
+		for i, embed := range s.softPrompt {
+			virtual[i] = input{embed: embed}
+		}
+
+		inputs = append(virtual, inputs...)
+		params.numKeep += len(s.softPrompt)
+		if cacheLimit >= 0 {
+			cacheLimit += len(s.softPrompt)
+		}
+		if numPrefix > 0 {
+			numPrefix += len(s.softPrompt)
+		}
+	}
+
+	// the prefix can't be shifted as its cells are shared with the snapshot
+	params.numKeep = max(params.numKeep, numPrefix)
+
 	// Ensure that at least 1 input can be discarded during shift
 	params.numKeep = min(params.numKeep, s.cache.numCtx-1)
+	if numPrefix > params.numKeep {
+		numPrefix = 0
+	}
 
 	if len(inputs) > s.cache.numCtx {
 		discard := len(inputs) - s.cache.numCtx
@@ -128,10 +277,25 @@ func (s *Server) NewSequence(prompt string, images []ImageData, params NewSequen
 
 		slog.Warn("truncating input prompt", "limit", s.cache.numCtx, "prompt", len(inputs), "keep", params.numKeep, "new", len(newInputs))
 		inputs = newInputs
+		cacheLimit = discardedLimit(cacheLimit, params.numKeep, discard)
+	}
+
+	var ban *banList
+	if len(params.ban) > 0 || len(params.banTokens) > 0 {
+		ban, err = newBanList(s.vocabPieces(), params.ban, params.banTokens)
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	var sc *llama.SamplingContext
 	if params.samplingParams != nil {
+		for token := range params.samplingParams.LogitBias {
+			if n := s.model.NumVocab(); token < 0 || token >= n {
+				return nil, fmt.Errorf("biased token %d is out of the vocabulary of %d tokens", token, n)
+			}
+		}
+
 		sc, err = llama.NewSamplingContext(s.model, *params.samplingParams)
 		if err != nil {
 			return nil, err
@@ -143,22 +307,61 @@ func (s *Server) NewSequence(prompt string, images []ImageData, params NewSequen
 		}
 	}
 
+	var deadline time.Time
+	if params.maxTime > 0 {
+		deadline = startTime.Add(params.maxTime)
+	}
+
 	return &Sequence{
 		inputs:              inputs,
 		numPromptInputs:     len(inputs),
 		startProcessingTime: startTime,
 		numPredict:          params.numPredict,
+		deadline:            deadline,
 		pendingResponses:    make([]string, 0),
-		responses:           make(chan string, 100),
+		responses:           make(chan response, 100),
 		quit:                make(chan bool, 1),
 		embedding:           make(chan []float32, 1),
 		samplingCtx:         sc,
+		ban:                 ban,
 		embeddingOnly:       params.embedding,
+		rawOutput:           params.rawOutput,
+		logprobs:            params.logprobs,
+		traceSampling:       params.traceSampling,
+		tokenLogprobs:       params.tokenLogprobs,
+		topLogprobs:         params.topLogprobs,
+		returnTokens:        params.returnTokens,
 		stop:                params.stop,
 		numKeep:             params.numKeep,
+		cacheLimit:          cacheLimit,
+		prefix:              numPrefix,
+		adapters:            params.adapters,
 	}, nil
 }
 
+// discardedLimit returns the cache limit after the discard inputs following
+// the first numKeep are removed
+func discardedLimit(limit, numKeep, discard int) int {
+	if limit <= numKeep {
+		return limit
+	}
+
+	return max(numKeep, limit-discard)
+}
+
+// vocabPieces returns the lowercased pieces of every token in the
+// vocabulary, for matching banned strings
+func (s *Server) vocabPieces() []string {
+	s.piecesOnce.Do(func() {
+		s.pieces = make([]string, s.model.NumVocab())
+		for t := range s.pieces {
+			s.pieces[t] = lowerPiece(s.model.TokenToPiece(t))
+		}
+	})
+
+	return s.pieces
+}
+
 // inputs processes the prompt and images into a list of inputs
 // by splitting the prompt on [img-<n>] tags, tokenizing text and
 // generating image embeddings for each image
@@ -202,13 +405,22 @@ func (s *Server) inputs(prompt string, images []ImageData) ([]input, error) {
 				return nil, fmt.Errorf("invalid image index: %d", n)
 			}
 
-			embed, err := s.image.NewEmbed(s.lc, images[imageIndex].Data, images[imageIndex].AspectRatioID)
-			if err != nil {
-				return nil, err
+			// images from earlier turns of a conversation are usually still
+			// in the cache
+			hash := s.image.Hash(images[imageIndex].Data)
+			s.mu.Lock()
+			embed := s.cache.FindImage(hash)
+			s.mu.Unlock()
+
+			if embed == nil {
+				embed, err = s.image.NewEmbed(s.lc, images[imageIndex].Data, images[imageIndex].AspectRatioID)
+				if err != nil {
+					return nil, err
+				}
 			}
 
-			for _, e := range embed {
-				inputs = append(inputs, input{embed: e})
+			for j, e := range embed {
+				inputs = append(inputs, input{embed: e, image: imagePart{hash: hash, index: j, count: len(embed)}})
 			}
 		}
 	}
@@ -216,6 +428,21 @@ func (s *Server) inputs(prompt string, images []ImageData) ([]input, error) {
 	return inputs, nil
 }
 
+// tokenInputs returns the inputs of a prompt of token ids, checking that
+// they're in the model's vocabulary
+func (s *Server) tokenInputs(tokens []int) ([]input, error) {
+	inputs := make([]input, len(tokens))
+	for i, t := range tokens {
+		if t < 0 || t >= s.model.NumVocab() {
+			return nil, fmt.Errorf("token %d is out of the vocabulary of %d tokens", t, s.model.NumVocab())
+		}
+
+		inputs[i] = input{token: t}
+	}
+
+	return inputs, nil
+}
+
 type Server struct {
 	// is the server ready to process requests?
 	// protects access to model and image
@@ -227,6 +454,14 @@ type Server struct {
 	// image model context for multi-modal models
 	image *ImageContext
 
+	// learned embeddings prepended to every prompt as virtual tokens
+	softPrompt [][]float32
+
+	// lowercased pieces of the vocabulary, looked up the first time a
+	// request bans something
+	piecesOnce sync.Once
+	pieces     []string
+
 	// status for external health reporting - loading, ready to serve, etc.
 	status ServerStatus
 
@@ -262,6 +497,19 @@ type Server struct {
 
 	// next sequence for prompt processing to avoid starvation
 	nextSeq int
+
+	// LoRA adapters loaded for requests by path, and the paths of those
+	// applied to the context for the current batch. Adapters no sequence is
+	// using are unloaded once there are more than maxAdapters.
+	adapters        map[string]*residentAdapter
+	appliedAdapters []string
+	maxAdapters     int
+
+	// throttling requested by the server while the GPU is over its
+	// temperature or power limit: caps the number of inputs in a batch and
+	// paces decoding with a delay between batches
+	throttleBatchSize atomic.Int32
+	throttleDelay     atomic.Int64
 }
 
 func (s *Server) allNil() bool {
@@ -273,9 +521,31 @@ func (s *Server) allNil() bool {
 	return true
 }
 
+// response is a chunk of the text generated for a sequence
+type response struct {
+	content  string
+	logprobs []api.Logprob
+
+	// tokens of the content, and the offsets of their pieces in the
+	// responses of the sequence
+	tokens  []int
+	offsets []int
+}
+
 func flushPending(seq *Sequence) bool {
 	joined := strings.Join(seq.pendingResponses, "")
+	resp := response{logprobs: seq.pendingLogprobs, tokens: seq.pendingTokens}
+	if seq.returnTokens {
+		offset := seq.sentBytes
+		for _, piece := range seq.pendingResponses[:len(seq.pendingTokens)] {
+			resp.offsets = append(resp.offsets, offset)
+			offset += len(piece)
+		}
+	}
+
 	seq.pendingResponses = []string{}
+	seq.pendingLogprobs = nil
+	seq.pendingTokens = nil
 
 	// Check if there are any partial UTF-8 characters remaining.
 	// We already check and queue as we are generating but some may
@@ -287,12 +557,15 @@ func flushPending(seq *Sequence) bool {
 		joined = joined[:len(joined)-1]
 	}
 
-	if len(joined) == 0 {
+	if len(joined) == 0 && len(resp.logprobs) == 0 && len(resp.tokens) == 0 {
 		return true
 	}
 
+	resp.content = joined
+	seq.sentBytes += len(joined)
+
 	select {
-	case seq.responses <- joined:
+	case seq.responses <- resp:
 		return true
 	case <-seq.quit:
 		return false
@@ -306,7 +579,10 @@ func (s *Server) removeSequence(seqIndex int, reason string) {
 	seq.doneReason = reason
 	close(seq.responses)
 	close(seq.embedding)
-	seq.cache.InUse = false
+	if seq.cacheLimit >= 0 {
+		s.cache.TrimCacheSlot(seq.cache, seq.cacheLimit)
+	}
+	s.cache.ReleaseCacheSlot(seq.cache)
 	s.seqs[seqIndex] = nil
 	s.seqsSem.Release(1)
 }
@@ -324,6 +600,10 @@ func (s *Server) run(ctx context.Context) {
 
 	var embedBatch *llama.Batch
 	embedBatchSize := s.image.BatchSize(s.batchSize)
+	if embedBatchSize == 0 && len(s.softPrompt) > 0 {
+		embedBatchSize = s.batchSize
+	}
+
 	if embedBatchSize != 0 {
 		embedBatch, err = llama.NewBatch(embedBatchSize, len(s.seqs), s.image.EmbedSize(s.lc))
 		if err != nil {
@@ -346,6 +626,10 @@ func (s *Server) run(ctx context.Context) {
 
 			tokenBatch.Clear()
 			embedBatch.Clear()
+
+			if delay := time.Duration(s.throttleDelay.Load()); delay > 0 {
+				time.Sleep(delay)
+			}
 		}
 	}
 }
@@ -366,6 +650,7 @@ func (s *Server) processBatch(tokenBatch *llama.Batch, embedBatch *llama.Batch)
 
 	var batch *llama.Batch
 	crossAttention := false
+	var adapters []string
 
 	seqIdx := s.nextSeq - 1
 	for range s.seqs {
@@ -382,9 +667,16 @@ func (s *Server) processBatch(tokenBatch *llama.Batch, embedBatch *llama.Batch)
 			continue
 		}
 
+		// if past the time budget
+		if !seq.deadline.IsZero() && time.Now().After(seq.deadline) {
+			s.removeSequence(seqIdx, "timeout")
+			continue
+		}
+
 		for i, input := range seq.inputs {
 			if len(seq.cache.Inputs)+len(seq.pendingInputs)+1 > s.cache.numCtx {
 				if len(seq.pendingInputs) == 0 {
+					seq.cacheLimit = discardedLimit(seq.cacheLimit, seq.numKeep, s.cache.ShiftDiscard(len(seq.cache.Inputs), seq.numKeep))
 					err := s.cache.ShiftCacheSlot(seq.cache, seq.numKeep)
 					if err != nil {
 						return err
@@ -394,6 +686,16 @@ func (s *Server) processBatch(tokenBatch *llama.Batch, embedBatch *llama.Batch)
 				}
 			}
 
+			pos := seq.cache.Pos(len(seq.cache.Inputs) + len(seq.pendingInputs))
+			if pos > llama.MaxPos {
+				if len(seq.pendingInputs) == 0 {
+					s.cache.RebaseCacheSlot(seq.cache)
+					pos = seq.cache.Pos(len(seq.cache.Inputs))
+				} else {
+					break
+				}
+			}
+
 			embedding := input.embed != nil
 
 			// If we don't currently have a batch, use one of the correct type and
@@ -407,7 +709,7 @@ func (s *Server) processBatch(tokenBatch *llama.Batch, embedBatch *llama.Batch)
 					batch = embedBatch
 					seq.crossAttention = s.image.NeedCrossAttention(input)
 				}
-			} else if embedding != batch.IsEmbedding() || crossAttention != seq.crossAttention {
+			} else if embedding != batch.IsEmbedding() || crossAttention != seq.crossAttention || !slices.Equal(adapters, seq.adapters) {
 				s.nextSeq = seqIdx
 				break
 			}
@@ -416,8 +718,13 @@ func (s *Server) processBatch(tokenBatch *llama.Batch, embedBatch *llama.Batch)
 				break
 			}
 
+			if limit := int(s.throttleBatchSize.Load()); limit > 0 && batch.NumTokens() >= limit {
+				break
+			}
+
 			crossAttention = seq.crossAttention
-			batch.Add(input.token, input.embed, len(seq.cache.Inputs)+len(seq.pendingInputs), i+1 == len(seq.inputs), seq.cache.Id)
+			adapters = seq.adapters
+			batch.Add(input.token, input.embed, pos, i+1 == len(seq.inputs) || seq.rawOutput == "perplexity", seq.cache.Id)
 			seq.pendingInputs = append(seq.pendingInputs, input)
 			seq.iBatch = batch.NumTokens() - 1
 		}
@@ -431,6 +738,10 @@ func (s *Server) processBatch(tokenBatch *llama.Batch, embedBatch *llama.Batch)
 
 	s.lc.SetCrossAttention(crossAttention)
 
+	if err := s.applyAdapters(adapters); err != nil {
+		return err
+	}
+
 	err := s.lc.Decode(batch)
 	if err != nil {
 		return fmt.Errorf("failed to decode batch: %w", err)
@@ -448,12 +759,21 @@ func (s *Server) processBatch(tokenBatch *llama.Batch, embedBatch *llama.Batch)
 			continue
 		}
 
+		if seq.rawOutput == "perplexity" {
+			s.scorePending(seq)
+		}
+
 		// After calling Decode, pending inputs are now in the cache
 		if len(seq.pendingInputs) > 0 {
 			seq.cache.Inputs = append(seq.cache.Inputs, seq.pendingInputs...)
 			seq.pendingInputs = []input{}
 		}
 
+		if seq.prefix > 0 && len(seq.cache.Inputs) >= seq.prefix {
+			s.cache.SavePrefix(seq.cache, seq.prefix)
+			seq.prefix = 0
+		}
+
 		// don't sample prompt processing
 		if len(seq.inputs) != 0 {
 			continue
@@ -476,13 +796,46 @@ func (s *Server) processBatch(tokenBatch *llama.Batch, embedBatch *llama.Batch)
 			continue
 		}
 
+		// if done processing the prompt, collect the raw output and return
+		if seq.rawOutput != "" {
+			var raw []float32
+			switch seq.rawOutput {
+			case "logits":
+				raw = s.lc.GetLogitsIth(seq.iBatch)
+			case "hidden_states":
+				raw = s.lc.GetEmbeddingsSeq(seq.cache.Id)
+				if raw == nil {
+					raw = s.lc.GetEmbeddingsIth(seq.iBatch)
+				}
+			}
+
+			// the values are owned by the context and overwritten by the next batch
+			seq.raw = slices.Clone(raw)
+			s.removeSequence(i, "stop")
+			continue
+		}
+
+		seq.ban.apply(s.lc.GetLogitsIth(seq.iBatch))
+
 		// sample a token
-		token := seq.samplingCtx.Sample(s.lc, seq.iBatch)
+		var token int
+		if seq.traceSampling > 0 {
+			var candidates []llama.SamplingCandidate
+			token, candidates = seq.samplingCtx.SampleTrace(s.lc, seq.iBatch, seq.traceSampling)
+			seq.trace = append(seq.trace, s.sampledToken(token, candidates))
+		} else {
+			token = seq.samplingCtx.Sample(s.lc, seq.iBatch)
+		}
 		seq.samplingCtx.Accept(token, true)
 		piece := s.model.TokenToPiece(token)
+		seq.ban.accept(piece)
 
 		seq.numPredicted++
 
+		if seq.logprobs {
+			seq.logprob += logprob(s.lc.GetLogitsIth(seq.iBatch), token)
+		}
+
 		// if it's an end of sequence token, break
 		if s.model.TokenIsEog(token) {
 			// TODO (jmorganca): we should send this back
@@ -496,6 +849,14 @@ func (s *Server) processBatch(tokenBatch *llama.Batch, embedBatch *llama.Batch)
 		seq.inputs = []input{{token: token}}
 
 		seq.pendingResponses = append(seq.pendingResponses, piece)
+		if seq.tokenLogprobs {
+			seq.pendingLogprobs = append(seq.pendingLogprobs, s.tokenLogprob(s.lc.GetLogitsIth(seq.iBatch), token, seq.topLogprobs))
+		}
+
+		if seq.returnTokens {
+			seq.pendingTokens = append(seq.pendingTokens, token)
+		}
+
 		sequence := strings.Join(seq.pendingResponses, "")
 
 		if ok, stop := findStop(sequence, seq.stop); ok {
@@ -505,6 +866,13 @@ func (s *Server) processBatch(tokenBatch *llama.Batch, embedBatch *llama.Batch)
 			origLen := len(seq.pendingResponses)
 			seq.pendingResponses, tokenTruncated = truncateStop(seq.pendingResponses, stop)
 			newLen := len(seq.pendingResponses)
+			if len(seq.pendingLogprobs) > newLen {
+				seq.pendingLogprobs = seq.pendingLogprobs[:newLen]
+			}
+
+			if len(seq.pendingTokens) > newLen {
+				seq.pendingTokens = seq.pendingTokens[:newLen]
+			}
 
 			// Update the cache based on the tokens that will be returned:
 			// - We have 1 token more than is currently in the cache because
@@ -540,6 +908,223 @@ func (s *Server) processBatch(tokenBatch *llama.Batch, embedBatch *llama.Batch)
 	return nil
 }
 
+// residentAdapter is a LoRA adapter kept loaded between requests
+type residentAdapter struct {
+	*llama.LoraAdapter
+	lastUsed time.Time
+}
+
+// loadAdapters loads the LoRA adapters at paths that haven't been loaded for
+// an earlier request, first unloading the least recently used adapters that
+// aren't in use to keep at most maxAdapters loaded. s.mu must be held.
+func (s *Server) loadAdapters(paths []string) error {
+	now := time.Now()
+	for _, path := range paths {
+		if a, ok := s.adapters[path]; ok {
+			a.lastUsed = now
+			continue
+		}
+
+		for s.maxAdapters > 0 && len(s.adapters) >= s.maxAdapters {
+			evict := s.evictableAdapter(paths)
+			if evict == "" {
+				slog.Warn("all lora adapters are in use, loading more than the limit", "limit", s.maxAdapters)
+				break
+			}
+
+			s.unloadAdapter(evict)
+		}
+
+		slog.Info("loading lora adapter", "path", path)
+		a, err := s.model.NewLoraAdapter(path)
+		if err != nil {
+			return err
+		}
+
+		if s.adapters == nil {
+			s.adapters = make(map[string]*residentAdapter)
+		}
+		s.adapters[path] = &residentAdapter{LoraAdapter: a, lastUsed: now}
+	}
+
+	return nil
+}
+
+// adapterSequences returns the number of sequences using the adapter at path
+func (s *Server) adapterSequences(path string) int {
+	var n int
+	for _, seq := range s.seqs {
+		if seq != nil && slices.Contains(seq.adapters, path) {
+			n++
+		}
+	}
+
+	return n
+}
+
+// evictableAdapter returns the path of the least recently used adapter that
+// isn't in keep and that no sequence is using, or "" if there are none
+func (s *Server) evictableAdapter(keep []string) string {
+	var evict string
+	for path, a := range s.adapters {
+		if slices.Contains(keep, path) || s.adapterSequences(path) > 0 {
+			continue
+		}
+
+		if evict == "" || a.lastUsed.Before(s.adapters[evict].lastUsed) {
+			evict = path
+		}
+	}
+
+	return evict
+}
+
+// unloadAdapter frees the adapter at path, removing the adapters applied to
+// the context first if it's one of them. s.mu must be held.
+func (s *Server) unloadAdapter(path string) {
+	if slices.Contains(s.appliedAdapters, path) {
+		for _, p := range s.appliedAdapters {
+			s.lc.RemoveLoraAdapter(s.adapters[p].LoraAdapter)
+		}
+		s.appliedAdapters = nil
+	}
+
+	slog.Info("unloading lora adapter", "path", path)
+	s.adapters[path].Free()
+	delete(s.adapters, path)
+}
+
+// applyAdapters applies the loaded LoRA adapters at paths to the context in
+// place of those applied for the last batch. Adapters compute low-rank
+// updates alongside the weights they adapt, so switching them is cheap.
+func (s *Server) applyAdapters(paths []string) error {
+	if slices.Equal(paths, s.appliedAdapters) {
+		return nil
+	}
+
+	for _, path := range s.appliedAdapters {
+		s.lc.RemoveLoraAdapter(s.adapters[path].LoraAdapter)
+	}
+
+	s.appliedAdapters = nil
+	for _, path := range paths {
+		if err := s.lc.SetLoraAdapter(s.adapters[path].LoraAdapter, 1.0); err != nil {
+			return err
+		}
+
+		s.appliedAdapters = append(s.appliedAdapters, path)
+	}
+
+	return nil
+}
+
+// scorePending adds the log probabilities of the inputs following each of
+// the pending inputs of seq, which were just decoded, to its logprob and
+// promptLogprobs
+func (s *Server) scorePending(seq *Sequence) {
+	first := seq.iBatch - len(seq.pendingInputs) + 1
+	for i, in := range seq.pendingInputs {
+		var next input
+		if i+1 < len(seq.pendingInputs) {
+			next = seq.pendingInputs[i+1]
+		} else if len(seq.inputs) > 0 {
+			next = seq.inputs[0]
+		} else {
+			break
+		}
+
+		if in.embed != nil || next.embed != nil {
+			continue
+		}
+
+		lp := logprob(s.lc.GetLogitsIth(first+i), next.token)
+		seq.logprob += lp
+		seq.promptLogprobs = append(seq.promptLogprobs, float32(lp))
+	}
+}
+
+// sampledToken records the pieces of a sampled token and its candidates
+func (s *Server) sampledToken(token int, candidates []llama.SamplingCandidate) api.SampledToken {
+	sampled := api.SampledToken{Token: token, Piece: s.model.TokenToPiece(token)}
+	for _, c := range candidates {
+		sampled.Candidates = append(sampled.Candidates, api.SamplingCandidate{
+			Token:        c.Token,
+			Piece:        s.model.TokenToPiece(c.Token),
+			Logit:        c.Logit,
+			Penalized:    c.Penalized,
+			Probability:  c.Probability,
+			EliminatedBy: c.EliminatedBy,
+		})
+	}
+
+	return sampled
+}
+
+// logprob returns the log probability of token given the logits of the
+// model, before sampling parameters such as temperature are applied
+func logprob(logits []float32, token int) float64 {
+	maxLogit := float64(slices.Max(logits))
+
+	var sum float64
+	for _, l := range logits {
+		sum += math.Exp(float64(l) - maxLogit)
+	}
+
+	return float64(logits[token]) - maxLogit - math.Log(sum)
+}
+
+// tokenLogprob returns the log probability of token given the logits of the
+// model, along with those of the top most likely tokens
+func (s *Server) tokenLogprob(logits []float32, token, top int) api.Logprob {
+	maxLogit := float64(slices.Max(logits))
+
+	var sum float64
+	for _, l := range logits {
+		sum += math.Exp(float64(l) - maxLogit)
+	}
+
+	norm := maxLogit + math.Log(sum)
+	lp := api.Logprob{TokenLogprob: api.TokenLogprob{
+		Token:   s.model.TokenToPiece(token),
+		Logprob: float64(logits[token]) - norm,
+	}}
+
+	for _, id := range topLogits(logits, top) {
+		lp.TopLogprobs = append(lp.TopLogprobs, api.TokenLogprob{
+			Token:   s.model.TokenToPiece(id),
+			Logprob: float64(logits[id]) - norm,
+		})
+	}
+
+	return lp
+}
+
+// topLogits returns the ids of the n tokens with the highest logits, highest
+// first
+func topLogits(logits []float32, n int) []int {
+	n = min(n, len(logits))
+	top := make([]int, 0, n+1)
+	for id, l := range logits {
+		if len(top) == n && (n == 0 || l <= logits[top[n-1]]) {
+			continue
+		}
+
+		i, _ := slices.BinarySearchFunc(top, l, func(id int, l float32) int {
+			// descending, and after equal logits
+			if logits[id] >= l {
+				return -1
+			}
+			return 1
+		})
+		top = slices.Insert(top, i, id)
+		if len(top) > n {
+			top = top[:n]
+		}
+	}
+
+	return top
+}
+
 // TODO (jmorganca): use structs from the api package to avoid duplication
 // this way the api acts as a proxy instead of using a different api for the
 // runner
@@ -549,6 +1134,7 @@ type Options struct {
 	NumKeep          int      `json:"n_keep"`
 	Seed             int      `json:"seed"`
 	NumPredict       int      `json:"n_predict"`
+	MaxTimeMS        int      `json:"max_time_ms"`
 	TopK             int      `json:"top_k"`
 	TopP             float32  `json:"top_p"`
 	MinP             float32  `json:"min_p"`
@@ -563,6 +1149,31 @@ type Options struct {
 	MirostatEta      float32  `json:"mirostat_eta"`
 	PenalizeNewline  bool     `json:"penalize_nl"`
 	Stop             []string `json:"stop"`
+	SessionSeed      bool     `json:"session_seed"`
+	BestOf           int      `json:"best_of"`
+	Processors       []string `json:"processor"`
+	Ban              []string `json:"ban"`
+	BanTokens        []int    `json:"ban_token"`
+
+	LogitBias map[int]float32 `json:"logit_bias"`
+
+	DryMultiplier       float32  `json:"dry_multiplier"`
+	DryBase             float32  `json:"dry_base"`
+	DryAllowedLength    int      `json:"dry_allowed_length"`
+	DryPenaltyLastN     int      `json:"dry_penalty_last_n"`
+	DrySequenceBreakers []string `json:"dry_sequence_breakers"`
+	XTCProbability      float32  `json:"xtc_probability"`
+	XTCThreshold        float32  `json:"xtc_threshold"`
+	DynatempRange       float32  `json:"dynatemp_range"`
+	DynatempExponent    float32  `json:"dynatemp_exponent"`
+
+	SamplerOrder []string `json:"sampler_order"`
+
+	ReasoningEffort   string `json:"reasoning_effort"`
+	MaxThinkingTokens int    `json:"max_thinking_tokens"`
+	// Grammar is sent as CompletionRequest.Grammar
+	Grammar string `json:"-"`
+	Adapter string `json:"adapter"`
 }
 
 type ImageData struct {
@@ -573,9 +1184,52 @@ type ImageData struct {
 
 type CompletionRequest struct {
 	Prompt      string      `json:"prompt"`
+	Tokens      []int       `json:"tokens"`
 	Images      []ImageData `json:"image_data"`
 	Grammar     string      `json:"grammar"`
 	CachePrompt bool        `json:"cache_prompt"`
+	Return      string      `json:"return"`
+
+	// PositionOffset is the position of the first prompt token
+	PositionOffset int `json:"position_offset"`
+
+	// Logprobs sums the log probabilities of the generated tokens
+	Logprobs bool `json:"logprobs"`
+
+	// SharePrompt allows the prompt to be forked from a sequence in progress
+	SharePrompt bool `json:"share_prompt"`
+
+	// CacheLength is the length in bytes of the start of the prompt that's
+	// kept in the cache after the request. The whole sequence is kept if unset.
+	CacheLength *int `json:"cache_length,omitempty"`
+
+	// DiscardSamples advances the sampler as if this many tokens had been sampled
+	DiscardSamples int `json:"discard_samples"`
+
+	// TraceSampling is the number of candidates to trace for each token
+	TraceSampling int `json:"trace_sampling"`
+
+	// TokenLogprobs returns the log probability of each generated token
+	// with its response, along with those of the TopLogprobs most likely
+	// tokens in its place
+	TokenLogprobs bool `json:"token_logprobs"`
+	TopLogprobs   int  `json:"top_logprobs"`
+
+	// ReturnTokens returns the tokens of each response and the byte offsets
+	// of their pieces in the generated text
+	ReturnTokens bool `json:"return_tokens"`
+
+	// PrefixLength is the length in bytes of the start of the prompt that's
+	// shared with other requests, such as a rendered system prompt
+	PrefixLength int `json:"prefix_length"`
+
+	// Session names the chat session the prompt continues, whose KV cache
+	// is kept in a slot or saved to the session directory between requests
+	Session string `json:"session"`
+
+	// Adapters are paths to LoRA adapters applied for the request on top of
+	// those the model was loaded with
+	Adapters []string `json:"adapters"`
 
 	Options
 }
@@ -585,19 +1239,37 @@ type Timings struct {
 	PredictedMS float64 `json:"predicted_ms"`
 	PromptN     int     `json:"prompt_n"`
 	PromptMS    float64 `json:"prompt_ms"`
+
+	// PromptCached is the number of prompt inputs reused from the cache
+	PromptCached int `json:"prompt_cached"`
 }
 
 type CompletionResponse struct {
 	Content string `json:"content"`
 	Stop    bool   `json:"stop"`
 
-	Model        string  `json:"model,omitempty"`
-	Prompt       string  `json:"prompt,omitempty"`
-	StoppedLimit bool    `json:"stopped_limit,omitempty"`
-	PredictedN   int     `json:"predicted_n,omitempty"`
-	PredictedMS  float64 `json:"predicted_ms,omitempty"`
-	PromptN      int     `json:"prompt_n,omitempty"`
-	PromptMS     float64 `json:"prompt_ms,omitempty"`
+	Model          string    `json:"model,omitempty"`
+	Prompt         string    `json:"prompt,omitempty"`
+	StoppedLimit   bool      `json:"stopped_limit,omitempty"`
+	StoppedTimeout bool      `json:"stopped_timeout,omitempty"`
+	Logits         []float32 `json:"logits,omitempty"`
+	HiddenStates   []float32 `json:"hidden_states,omitempty"`
+	Logprob        float64   `json:"logprob,omitempty"`
+	PromptLogprobs []float32 `json:"prompt_logprobs,omitempty"`
+	PredictedN     int       `json:"predicted_n,omitempty"`
+	PredictedMS    float64   `json:"predicted_ms,omitempty"`
+	PromptN        int       `json:"prompt_n,omitempty"`
+	PromptMS       float64   `json:"prompt_ms,omitempty"`
+
+	SamplingTrace []api.SampledToken `json:"sampling_trace,omitempty"`
+
+	// Logprobs are the log probabilities of the tokens of Content
+	Logprobs []api.Logprob `json:"logprobs,omitempty"`
+
+	// Tokens are the tokens of Content, and Offsets the byte offsets of
+	// their pieces in the generated text
+	Tokens  []int `json:"tokens,omitempty"`
+	Offsets []int `json:"offsets,omitempty"`
 
 	Timings Timings `json:"timings"`
 }
@@ -610,6 +1282,27 @@ func (s *Server) completion(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	switch req.Return {
+	case "", "logits", "hidden_states":
+	case "perplexity":
+		if len(req.Images) > 0 {
+			http.Error(w, "perplexity can't be measured with images", http.StatusBadRequest)
+			return
+		}
+
+		// every token of the prompt is scored, so none can come from the cache
+		req.CachePrompt = false
+	default:
+		http.Error(w, fmt.Sprintf("invalid return %q", req.Return), http.StatusBadRequest)
+		return
+	}
+
+	// sessions name files in the session directory
+	if req.Session != "" && !sessionNameRegexp.MatchString(req.Session) {
+		http.Error(w, fmt.Sprintf("invalid session %q", req.Session), http.StatusBadRequest)
+		return
+	}
+
 	// Set the headers to indicate streaming
 	w.Header().Set("Content-Type", "application/json")
 	w.Header().Set("Transfer-Encoding", "chunked")
@@ -636,19 +1329,47 @@ func (s *Server) completion(w http.ResponseWriter, r *http.Request) {
 	samplingParams.PenalizeNl = req.PenalizeNewline
 	samplingParams.Seed = uint32(req.Seed)
 	samplingParams.Grammar = req.Grammar
+	samplingParams.LogitBias = req.LogitBias
+	samplingParams.DryMultiplier = req.DryMultiplier
+	samplingParams.DryBase = req.DryBase
+	samplingParams.DryAllowedLength = req.DryAllowedLength
+	samplingParams.DryPenaltyLastN = req.DryPenaltyLastN
+	samplingParams.DrySequenceBreakers = req.DrySequenceBreakers
+	samplingParams.XTCProbability = req.XTCProbability
+	samplingParams.XTCThreshold = req.XTCThreshold
+	samplingParams.DynatempRange = req.DynatempRange
+	samplingParams.DynatempExponent = req.DynatempExponent
+	samplingParams.SamplerOrder = req.SamplerOrder
 
 	seq, err := s.NewSequence(req.Prompt, req.Images, NewSequenceParams{
 		numPredict:     req.NumPredict,
+		maxTime:        time.Duration(req.MaxTimeMS) * time.Millisecond,
 		stop:           req.Stop,
 		numKeep:        req.NumKeep,
 		samplingParams: &samplingParams,
 		embedding:      false,
+		rawOutput:      req.Return,
+		logprobs:       req.Logprobs,
+		traceSampling:  req.TraceSampling,
+		tokenLogprobs:  req.TokenLogprobs,
+		topLogprobs:    req.TopLogprobs,
+		returnTokens:   req.ReturnTokens,
+		ban:            req.Ban,
+		banTokens:      req.BanTokens,
+		cacheLength:    req.CacheLength,
+		tokens:         req.Tokens,
+		prefixLength:   req.PrefixLength,
+		adapters:       req.Adapters,
 	})
 	if err != nil {
 		http.Error(w, fmt.Sprintf("Failed to create new sequence: %v", err), http.StatusInternalServerError)
 		return
 	}
 
+	if req.DiscardSamples > 0 {
+		seq.samplingCtx.Discard(req.DiscardSamples)
+	}
+
 	// Ensure there is a place to put the sequence, released when removed from s.seqs
 	if err := s.seqsSem.Acquire(r.Context(), 1); err != nil {
 		if errors.Is(err, context.Canceled) {
@@ -663,13 +1384,22 @@ func (s *Server) completion(w http.ResponseWriter, r *http.Request) {
 	found := false
 	for i, sq := range s.seqs {
 		if sq == nil {
-			seq.cache, seq.inputs, err = s.cache.LoadCacheSlot(seq.inputs, req.CachePrompt)
+			if err := s.loadAdapters(seq.adapters); err != nil {
+				s.mu.Unlock()
+				s.seqsSem.Release(1)
+				http.Error(w, fmt.Sprintf("Failed to load adapters: %v", err), http.StatusInternalServerError)
+				return
+			}
+
+			seq.cache, seq.inputs, err = s.cache.LoadCacheSlot(seq.inputs, req.PositionOffset, req.CachePrompt, req.SharePrompt, seq.prefix, req.Session, strings.Join(req.Adapters, "\n"))
 			if err != nil {
 				s.mu.Unlock()
 				http.Error(w, fmt.Sprintf("Failed to load cache: %v", err), http.StatusInternalServerError)
 				return
 			}
 
+			seq.numCachedInputs = seq.numPromptInputs - len(seq.inputs)
+
 			seq.crossAttention = s.image.NeedCrossAttention(seq.cache.Inputs...)
 
 			s.seqs[i] = seq
@@ -690,10 +1420,13 @@ func (s *Server) completion(w http.ResponseWriter, r *http.Request) {
 		case <-r.Context().Done():
 			close(seq.quit)
 			return
-		case content, ok := <-seq.responses:
+		case resp, ok := <-seq.responses:
 			if ok {
 				if err := json.NewEncoder(w).Encode(&CompletionResponse{
-					Content: content,
+					Content:  resp.content,
+					Logprobs: resp.logprobs,
+					Tokens:   resp.tokens,
+					Offsets:  resp.offsets,
 				}); err != nil {
 					http.Error(w, fmt.Sprintf("failed to encode response: %v", err), http.StatusInternalServerError)
 					close(seq.quit)
@@ -703,16 +1436,37 @@ func (s *Server) completion(w http.ResponseWriter, r *http.Request) {
 				flusher.Flush()
 			} else {
 				// Send the final response
-				if err := json.NewEncoder(w).Encode(&CompletionResponse{
-					Stop:         true,
-					StoppedLimit: seq.doneReason == "limit",
+				final := CompletionResponse{
+					Stop:           true,
+					StoppedLimit:   seq.doneReason == "limit",
+					StoppedTimeout: seq.doneReason == "timeout",
 					Timings: Timings{
-						PromptN:     seq.numPromptInputs,
-						PromptMS:    float64(seq.startGenerationTime.Sub(seq.startProcessingTime).Milliseconds()),
-						PredictedN:  seq.numDecoded,
-						PredictedMS: float64(time.Since(seq.startGenerationTime).Milliseconds()),
+						PromptN:      seq.numPromptInputs,
+						PromptMS:     float64(seq.startGenerationTime.Sub(seq.startProcessingTime).Milliseconds()),
+						PromptCached: seq.numCachedInputs,
+						PredictedN:   seq.numDecoded,
+						PredictedMS:  float64(time.Since(seq.startGenerationTime).Milliseconds()),
 					},
-				}); err != nil {
+				}
+
+				if seq.logprobs || seq.rawOutput == "perplexity" {
+					final.Logprob = seq.logprob
+				}
+
+				if seq.rawOutput == "perplexity" {
+					final.PromptLogprobs = seq.promptLogprobs
+				}
+
+				final.SamplingTrace = seq.trace
+
+				switch seq.rawOutput {
+				case "logits":
+					final.Logits = seq.raw
+				case "hidden_states":
+					final.HiddenStates = seq.raw
+				}
+
+				if err := json.NewEncoder(w).Encode(&final); err != nil {
 					http.Error(w, fmt.Sprintf("failed to encode final response: %v", err), http.StatusInternalServerError)
 				}
 
@@ -724,6 +1478,7 @@ func (s *Server) completion(w http.ResponseWriter, r *http.Request) {
 
 type EmbeddingRequest struct {
 	Content     string `json:"content"`
+	Tokens      []int  `json:"tokens"`
 	CachePrompt bool   `json:"cache_prompt"`
 }
 
@@ -742,7 +1497,7 @@ func (s *Server) embeddings(w http.ResponseWriter, r *http.Request) {
 
 	slog.Debug("embedding request", "content", req.Content)
 
-	seq, err := s.NewSequence(req.Content, nil, NewSequenceParams{embedding: true})
+	seq, err := s.NewSequence(req.Content, nil, NewSequenceParams{embedding: true, tokens: req.Tokens})
 	if err != nil {
 		http.Error(w, fmt.Sprintf("Failed to create new sequence: %v", err), http.StatusInternalServerError)
 		return
@@ -762,7 +1517,7 @@ func (s *Server) embeddings(w http.ResponseWriter, r *http.Request) {
 	found := false
 	for i, sq := range s.seqs {
 		if sq == nil {
-			seq.cache, seq.inputs, err = s.cache.LoadCacheSlot(seq.inputs, req.CachePrompt)
+			seq.cache, seq.inputs, err = s.cache.LoadCacheSlot(seq.inputs, 0, req.CachePrompt, false, 0, "", "")
 			if err != nil {
 				s.mu.Unlock()
 				http.Error(w, fmt.Sprintf("Failed to load cache: %v", err), http.StatusInternalServerError)
@@ -824,6 +1579,101 @@ func (s *Server) health(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+type ThrottleRequest struct {
+	// BatchSize caps the number of inputs in a batch, zero for no limit
+	BatchSize int `json:"batch_size"`
+
+	// DelayMS is the delay between batches in milliseconds
+	DelayMS int `json:"delay_ms"`
+}
+
+func (s *Server) throttle(w http.ResponseWriter, r *http.Request) {
+	var req ThrottleRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("bad request: %s", err), http.StatusBadRequest)
+		return
+	}
+
+	slog.Info("updating throttle", "batch_size", req.BatchSize, "delay", time.Duration(req.DelayMS)*time.Millisecond)
+	s.throttleBatchSize.Store(int32(req.BatchSize))
+	s.throttleDelay.Store(int64(time.Duration(req.DelayMS) * time.Millisecond))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type AdapterRequest struct {
+	// Path is the path to the adapter's file
+	Path string `json:"path"`
+}
+
+type AdapterStatus struct {
+	Path string `json:"path"`
+
+	// Sequences is the number of sequences using the adapter
+	Sequences int       `json:"sequences"`
+	LastUsed  time.Time `json:"last_used"`
+}
+
+type AdaptersResponse struct {
+	Adapters []AdapterStatus `json:"adapters"`
+}
+
+// manageAdapters lists the loaded LoRA adapters on GET, loads an adapter ahead of
+// the requests that use it on POST and unloads one on DELETE
+func (s *Server) manageAdapters(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet {
+		s.mu.Lock()
+		resp := AdaptersResponse{Adapters: make([]AdapterStatus, 0, len(s.adapters))}
+		for path, a := range s.adapters {
+			resp.Adapters = append(resp.Adapters, AdapterStatus{Path: path, Sequences: s.adapterSequences(path), LastUsed: a.lastUsed})
+		}
+		s.mu.Unlock()
+
+		slices.SortFunc(resp.Adapters, func(a, b AdapterStatus) int {
+			return strings.Compare(a.Path, b.Path)
+		})
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(&resp); err != nil {
+			http.Error(w, fmt.Sprintf("failed to encode response: %v", err), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	var req AdapterRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("bad request: %s", err), http.StatusBadRequest)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch r.Method {
+	case http.MethodPost:
+		if err := s.loadAdapters([]string{req.Path}); err != nil {
+			http.Error(w, fmt.Sprintf("failed to load adapter: %v", err), http.StatusInternalServerError)
+			return
+		}
+	case http.MethodDelete:
+		if _, ok := s.adapters[req.Path]; !ok {
+			http.Error(w, "adapter not loaded", http.StatusNotFound)
+			return
+		}
+
+		if s.adapterSequences(req.Path) > 0 {
+			http.Error(w, "adapter in use", http.StatusConflict)
+			return
+		}
+
+		s.unloadAdapter(req.Path)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
 type multiLPath []string
 
 func (m *multiLPath) Set(value string) error {
@@ -840,11 +1690,17 @@ func (s *Server) loadModel(
 	mpath string,
 	lpath multiLPath,
 	ppath string,
+	spath string,
 	kvSize int,
-	kvCacheType string,
+	cacheTypeK, cacheTypeV string,
+	rope llama.RopeParams,
 	flashAttention bool,
 	threads int,
 	multiUserCache bool,
+	prefixCache int,
+	sessionDir string,
+	tuneSizes []int,
+	tunePath string,
 ) {
 	llama.BackendInit()
 
@@ -854,7 +1710,26 @@ func (s *Server) loadModel(
 		panic(err)
 	}
 
-	ctxParams := llama.NewContextParams(kvSize, s.batchSize*s.parallel, s.parallel, threads, flashAttention, kvCacheType)
+	// batch sizes larger than the configured one may not fit in memory
+	tuneSizes = slices.DeleteFunc(tuneSizes, func(size int) bool { return size > s.batchSize })
+
+	// prefix snapshots are kept in sequences after the slots', in space
+	// beyond theirs
+	numSeqMax := s.parallel
+	if prefixCache > 0 {
+		numSeqMax += maxPrefixes
+	}
+
+	ctxParams := llama.NewContextParams(kvSize+prefixCache, s.batchSize*s.parallel, numSeqMax, threads, flashAttention, cacheTypeK, cacheTypeV)
+	if len(tuneSizes) > 0 {
+		// each batch measured must be computed at once
+		ctxParams.SetMicroBatchSize(slices.Max(tuneSizes))
+	}
+
+	if err := ctxParams.SetRope(rope); err != nil {
+		panic(err)
+	}
+
 	s.lc, err = llama.NewContextWithModel(s.model, ctxParams)
 	if err != nil {
 		panic(err)
@@ -877,7 +1752,26 @@ func (s *Server) loadModel(
 		}
 	}
 
-	s.cache, err = NewInputCache(s.lc, kvSize, s.parallel, multiUserCache)
+	if spath != "" {
+		embedSize := s.model.NEmbd()
+		if s.image.EmbedSize(s.lc) != embedSize {
+			panic(errors.New("soft prompts are not supported with this projector"))
+		}
+
+		s.softPrompt, err = llama.LoadSoftPrompt(spath, embedSize)
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	if len(tuneSizes) > 0 {
+		s.batchSize, err = s.tuneBatchSize(tuneSizes, kvSize, tunePath)
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	s.cache, err = NewInputCache(s.lc, kvSize, s.parallel, multiUserCache, prefixCache, sessionDir)
 	if err != nil {
 		panic(err)
 	}
@@ -893,13 +1787,25 @@ func Execute(args []string) error {
 	fs := flag.NewFlagSet("runner", flag.ExitOnError)
 	mpath := fs.String("model", "", "Path to model binary file")
 	ppath := fs.String("mmproj", "", "Path to projector binary file")
+	spath := fs.String("soft-prompt", "", "Path to soft prompt file")
 	parallel := fs.Int("parallel", 1, "Number of sequences to handle simultaneously")
 	batchSize := fs.Int("batch-size", 512, "Batch size")
 	nGpuLayers := fs.Int("n-gpu-layers", 0, "Number of layers to offload to GPU")
+	nCPUFFNLayers := fs.Int("n-cpu-ffn-layers", 0, "Number of offloaded layers, from the first, to keep the feed-forward weights of on the CPU")
 	mainGpu := fs.Int("main-gpu", 0, "Main GPU")
 	flashAttention := fs.Bool("flash-attn", false, "Enable flash attention")
 	kvSize := fs.Int("ctx-size", 2048, "Context (or KV cache) size")
 	kvCacheType := fs.String("kv-cache-type", "", "quantization type for KV cache (default: f16)")
+	cacheTypeK := fs.String("kv-cache-type-k", "", "quantization type for the K cache (default: kv-cache-type)")
+	cacheTypeV := fs.String("kv-cache-type-v", "", "quantization type for the V cache (default: kv-cache-type)")
+	ropeScaling := fs.String("rope-scaling", "", "RoPE scaling type, none, linear or yarn (default: from model)")
+	ropeFreqBase := fs.Float64("rope-freq-base", 0, "RoPE base frequency (default: from model)")
+	ropeFreqScale := fs.Float64("rope-freq-scale", 0, "RoPE frequency scaling factor (default: from model)")
+	yarnOrigCtx := fs.Int("yarn-orig-ctx", 0, "YaRN original context size (default: from model)")
+	yarnExtFactor := fs.Float64("yarn-ext-factor", 0, "YaRN extrapolation mix factor (default: from model)")
+	yarnAttnFactor := fs.Float64("yarn-attn-factor", 0, "YaRN magnitude scaling factor (default: 1.0)")
+	yarnBetaFast := fs.Float64("yarn-beta-fast", 0, "YaRN low correction dim (default: 32.0)")
+	yarnBetaSlow := fs.Float64("yarn-beta-slow", 0, "YaRN high correction dim (default: 1.0)")
 	port := fs.Int("port", 8080, "Port to expose the server on")
 	threads := fs.Int("threads", runtime.NumCPU(), "Number of threads to use during generation")
 	verbose := fs.Bool("verbose", false, "verbose output (default: disabled)")
@@ -907,6 +1813,13 @@ func Execute(args []string) error {
 	mlock := fs.Bool("mlock", false, "force system to keep model in RAM rather than swapping or compressing")
 	tensorSplit := fs.String("tensor-split", "", "fraction of the model to offload to each GPU, comma-separated list of proportions")
 	multiUserCache := fs.Bool("multiuser-cache", false, "optimize input cache algorithm for multiple users")
+	prefixCache := fs.Int("prefix-cache", 0, "number of inputs of the KV cache to keep prefixes shared between prompts in")
+	batchTune := fs.String("batch-tune", "", "comma-separated list of batch sizes to measure prompt throughput at, choosing the fastest")
+	batchTuneCache := fs.String("batch-tune-cache", "", "path to store the batch size chosen with --batch-tune")
+	sessionDir := fs.String("session-dir", "", "directory to save the KV caches of chat sessions to when their slots are reused")
+	maxAdapters := fs.Int("max-adapters", 0, "number of LoRA adapters to keep loaded for requests before unloading the least recently used, zero for no limit")
+	sandbox := fs.Bool("sandbox", false, "restrict the runner to reading its model files, without network access or privileged system calls")
+	adapterDir := fs.String("adapter-dir", "", "directory of the LoRA adapters applied for requests, readable when sandboxed")
 
 	var lpaths multiLPath
 	fs.Var(&lpaths, "lora", "Path to lora layer file (can be specified multiple times)")
@@ -934,16 +1847,55 @@ func Execute(args []string) error {
 			return attr
 		},
 	})
-	slog.SetDefault(slog.New(handler))
+	slog.SetDefault(slog.New(logutil.Redact(handler)))
+
+	if *sessionDir != "" {
+		if err := os.MkdirAll(*sessionDir, 0o700); err != nil {
+			slog.Warn("sessions won't be saved", "dir", *sessionDir, "error", err)
+			*sessionDir = ""
+		}
+	}
+
+	if *sandbox {
+		read := append([]string{*mpath, *ppath, *spath, *adapterDir}, lpaths...)
+
+		var write []string
+		if *batchTuneCache != "" {
+			dir := filepath.Dir(*batchTuneCache)
+			if err := os.MkdirAll(dir, 0o755); err != nil {
+				return err
+			}
+			write = append(write, dir)
+		}
+
+		if *sessionDir != "" {
+			write = append(write, *sessionDir)
+		}
+
+		if err := restrictFiles(read, write); err != nil {
+			return fmt.Errorf("failed to sandbox runner: %w", err)
+		}
+	}
+
 	slog.Info("starting go runner")
 	slog.Info("system", "info", llama.PrintSystemInfo(), "threads", *threads)
 
+	var tuneSizes []int
+	if *batchTune != "" {
+		var err error
+		if tuneSizes, err = parseBatchSizes(*batchTune); err != nil {
+			return err
+		}
+	}
+
 	server := &Server{
 		batchSize: *batchSize,
 		parallel:  *parallel,
 		seqs:      make([]*Sequence, *parallel),
 		seqsSem:   semaphore.NewWeighted(int64(*parallel)),
 		status:    ServerStatusLoadingModel,
+
+		maxAdapters: *maxAdapters,
 	}
 
 	var tensorSplitFloats []float32
@@ -963,13 +1915,26 @@ func Execute(args []string) error {
 		UseMmap:      !*noMmap && lpaths.String() == "",
 		UseMlock:     *mlock,
 		TensorSplit:  tensorSplitFloats,
+
+		NumCPUFFNLayers: *nCPUFFNLayers,
 		Progress: func(progress float32) {
 			server.progress = progress
 		},
 	}
 
+	rope := llama.RopeParams{
+		ScalingType:    *ropeScaling,
+		FreqBase:       float32(*ropeFreqBase),
+		FreqScale:      float32(*ropeFreqScale),
+		YarnOrigCtx:    *yarnOrigCtx,
+		YarnExtFactor:  float32(*yarnExtFactor),
+		YarnAttnFactor: float32(*yarnAttnFactor),
+		YarnBetaFast:   float32(*yarnBetaFast),
+		YarnBetaSlow:   float32(*yarnBetaSlow),
+	}
+
 	server.ready.Add(1)
-	go server.loadModel(params, *mpath, lpaths, *ppath, *kvSize, *kvCacheType, *flashAttention, *threads, *multiUserCache)
+	go server.loadModel(params, *mpath, lpaths, *ppath, *spath, *kvSize, cmp.Or(*cacheTypeK, *kvCacheType), cmp.Or(*cacheTypeV, *kvCacheType), rope, *flashAttention, *threads, *multiUserCache, *prefixCache, *sessionDir, tuneSizes, *batchTuneCache)
 
 	server.cond = sync.NewCond(&server.mu)
 
@@ -985,10 +1950,19 @@ func Execute(args []string) error {
 	}
 	defer listener.Close()
 
+	if *sandbox {
+		if err := restrictSyscalls(); err != nil {
+			cancel()
+			return fmt.Errorf("failed to sandbox runner: %w", err)
+		}
+	}
+
 	mux := http.NewServeMux()
 	mux.HandleFunc("/embedding", server.embeddings)
 	mux.HandleFunc("/completion", server.completion)
 	mux.HandleFunc("/health", server.health)
+	mux.HandleFunc("/throttle", server.throttle)
+	mux.HandleFunc("/adapters", server.manageAdapters)
 
 	httpServer := http.Server{
 		Handler: mux,
@@ -0,0 +1,312 @@
+package runner
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"math/rand/v2"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/sync/semaphore"
+
+	"github.com/ollama/ollama/llama"
+	"github.com/ollama/ollama/llm"
+)
+
+type tensor []float32
+
+func (t tensor) WriteTo(w io.Writer) (int64, error) {
+	if err := binary.Write(w, binary.LittleEndian, []float32(t)); err != nil {
+		return 0, err
+	}
+
+	return int64(len(t) * 4), nil
+}
+
+// writeModel writes a tiny llama model with random weights and a vocabulary
+// of 32 tokens, "<unk>", "<s>", "</s>" and then "▁t3" to "▁t31". Text made of
+// other characters can't be tokenized, so prompts are given as tokens.
+func writeModel(t *testing.T) string {
+	t.Helper()
+
+	const vocabSize, embedSize, ffnSize = 32, 16, 32
+
+	r := rand.New(rand.NewPCG(1, 2))
+	random := func(shape ...uint64) llm.Tensor {
+		data := make(tensor, shape[0]*shape[len(shape)-1])
+		for i := range data {
+			data[i] = float32(r.NormFloat64() / math.Sqrt(float64(shape[len(shape)-1])))
+		}
+
+		return llm.Tensor{Kind: 0, Shape: shape, WriterTo: data}
+	}
+
+	ones := func(n uint64) llm.Tensor {
+		data := make(tensor, n)
+		for i := range data {
+			data[i] = 1
+		}
+
+		return llm.Tensor{Kind: 0, Shape: []uint64{n}, WriterTo: data}
+	}
+
+	var tensors []llm.Tensor
+	add := func(name string, t llm.Tensor) {
+		t.Name = name
+		tensors = append(tensors, t)
+	}
+
+	add("token_embd.weight", random(vocabSize, embedSize))
+	add("output_norm.weight", ones(embedSize))
+	add("output.weight", random(vocabSize, embedSize))
+	add("blk.0.attn_norm.weight", ones(embedSize))
+	add("blk.0.attn_q.weight", random(embedSize, embedSize))
+	add("blk.0.attn_k.weight", random(embedSize, embedSize))
+	add("blk.0.attn_v.weight", random(embedSize, embedSize))
+	add("blk.0.attn_output.weight", random(embedSize, embedSize))
+	add("blk.0.ffn_norm.weight", ones(embedSize))
+	add("blk.0.ffn_gate.weight", random(ffnSize, embedSize))
+	add("blk.0.ffn_up.weight", random(ffnSize, embedSize))
+	add("blk.0.ffn_down.weight", random(embedSize, ffnSize))
+
+	tokens := make([]string, vocabSize)
+	scores := make([]float32, vocabSize)
+	types := make([]int32, vocabSize)
+	for i := range tokens {
+		tokens[i] = fmt.Sprintf("▁t%d", i)
+		scores[i] = -float32(i)
+		types[i] = 1
+	}
+
+	tokens[0], tokens[1], tokens[2] = "<unk>", "<s>", "</s>"
+	types[0], types[1], types[2] = 2, 3, 3
+
+	path := filepath.Join(t.TempDir(), "model.gguf")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	if err := llm.WriteGGUF(f, llm.KV{
+		"general.architecture":                   "llama",
+		"llama.context_length":                   uint32(64),
+		"llama.embedding_length":                 uint32(embedSize),
+		"llama.block_count":                      uint32(1),
+		"llama.feed_forward_length":              uint32(ffnSize),
+		"llama.attention.head_count":             uint32(4),
+		"llama.attention.head_count_kv":          uint32(4),
+		"llama.attention.layer_norm_rms_epsilon": float32(1e-5),
+		"tokenizer.ggml.model":                   "llama",
+		"tokenizer.ggml.tokens":                  tokens,
+		"tokenizer.ggml.scores":                  scores,
+		"tokenizer.ggml.token_type":              types,
+		"tokenizer.ggml.bos_token_id":            uint32(1),
+		"tokenizer.ggml.eos_token_id":            uint32(2),
+		"tokenizer.ggml.unknown_token_id":        uint32(0),
+	}, tensors); err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+// newTestServer loads the model at path on the CPU and starts processing
+// batches. Like the runner, it processes them until the process exits.
+func newTestServer(t *testing.T, path string) *Server {
+	t.Helper()
+
+	s := &Server{
+		batchSize: 512,
+		parallel:  1,
+		seqs:      make([]*Sequence, 1),
+		seqsSem:   semaphore.NewWeighted(1),
+		status:    ServerStatusLoadingModel,
+	}
+	s.cond = sync.NewCond(&s.mu)
+
+	s.ready.Add(1)
+	s.loadModel(llama.ModelParams{UseMmap: true}, path, nil, "", "", 64, "", "", llama.RopeParams{}, false, 1, false, 0, "", nil, "")
+	go s.run(context.Background())
+
+	return s
+}
+
+func TestLogprob(t *testing.T) {
+	cases := []struct {
+		logits []float32
+		token  int
+		expect float64
+	}{
+		{[]float32{0, 0}, 1, math.Log(0.5)},
+		{[]float32{1, 1, 1, 1}, 0, math.Log(0.25)},
+		{[]float32{float32(math.Log(3)), 0}, 0, math.Log(0.75)},
+		// large logits don't overflow
+		{[]float32{1000, 1000}, 0, math.Log(0.5)},
+	}
+
+	for _, tt := range cases {
+		if got := logprob(tt.logits, tt.token); math.Abs(got-tt.expect) > 1e-6 {
+			t.Errorf("logprob(%v, %d): expected %f, got %f", tt.logits, tt.token, tt.expect, got)
+		}
+	}
+}
+
+func TestDiscardedLimit(t *testing.T) {
+	cases := []struct {
+		limit, numKeep, discard int
+		expect                  int
+	}{
+		// no limit
+		{-1, 4, 10, -1},
+		// the limit is within the inputs that are kept
+		{3, 4, 10, 3},
+		// the limit moves back with the inputs after it
+		{20, 4, 10, 10},
+		// the cached inputs are all discarded
+		{8, 4, 10, 4},
+	}
+
+	for _, tt := range cases {
+		if got := discardedLimit(tt.limit, tt.numKeep, tt.discard); got != tt.expect {
+			t.Errorf("discardedLimit(%d, %d, %d): expected %d, got %d", tt.limit, tt.numKeep, tt.discard, tt.expect, got)
+		}
+	}
+}
+
+func TestEvictableAdapter(t *testing.T) {
+	now := time.Now()
+	s := Server{
+		adapters: map[string]*residentAdapter{
+			"a": {lastUsed: now.Add(-3 * time.Minute)},
+			"b": {lastUsed: now.Add(-2 * time.Minute)},
+			"c": {lastUsed: now.Add(-time.Minute)},
+		},
+		seqs: []*Sequence{{adapters: []string{"a"}}, nil},
+	}
+
+	// a is in use, so b is the least recently used
+	if got := s.evictableAdapter(nil); got != "b" {
+		t.Errorf("expected b, got %q", got)
+	}
+
+	if got := s.evictableAdapter([]string{"b"}); got != "c" {
+		t.Errorf("expected c, got %q", got)
+	}
+
+	if got := s.evictableAdapter([]string{"b", "c"}); got != "" {
+		t.Errorf("expected no adapter, got %q", got)
+	}
+}
+
+func TestTopLogits(t *testing.T) {
+	cases := []struct {
+		logits []float32
+		n      int
+		expect []int
+	}{
+		{[]float32{0.1, 0.5, 0.3, 0.9}, 2, []int{3, 1}},
+		{[]float32{0.1, 0.5, 0.3, 0.9}, 4, []int{3, 1, 2, 0}},
+		{[]float32{0.1, 0.5}, 5, []int{1, 0}},
+		{[]float32{0.1, 0.5}, 0, []int{}},
+		// ties keep the lower id first
+		{[]float32{1, 1, 1}, 2, []int{0, 1}},
+	}
+
+	for _, tt := range cases {
+		if got := topLogits(tt.logits, tt.n); !slices.Equal(got, tt.expect) {
+			t.Errorf("topLogits(%v, %d): expected %v, got %v", tt.logits, tt.n, tt.expect, got)
+		}
+	}
+}
+
+func TestFlushPendingOffsets(t *testing.T) {
+	seq := &Sequence{responses: make(chan response, 2), quit: make(chan bool), returnTokens: true}
+
+	seq.pendingResponses = []string{"Hel", "lo"}
+	seq.pendingTokens = []int{1, 2}
+	flushPending(seq)
+
+	seq.pendingResponses = []string{" world"}
+	seq.pendingTokens = []int{3}
+	flushPending(seq)
+
+	for _, expect := range []response{
+		{content: "Hello", tokens: []int{1, 2}, offsets: []int{0, 3}},
+		{content: " world", tokens: []int{3}, offsets: []int{5}},
+	} {
+		got := <-seq.responses
+		if got.content != expect.content || !slices.Equal(got.tokens, expect.tokens) || !slices.Equal(got.offsets, expect.offsets) {
+			t.Errorf("expected %+v, got %+v", expect, got)
+		}
+	}
+}
+
+func TestCompletionMaxTime(t *testing.T) {
+	s := newTestServer(t, writeModel(t))
+
+	// the end of sequence token is biased away so only the time budget stops
+	// generating, as the context is shifted when it fills up
+	body, err := json.Marshal(map[string]any{
+		"tokens":      []int{1, 3, 4, 5},
+		"temperature": 0,
+		"logit_bias":  map[string]float32{"2": -1000},
+		"max_time_ms": 200,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	r := httptest.NewRequestWithContext(ctx, http.MethodPost, "/completion", strings.NewReader(string(body)))
+	w := httptest.NewRecorder()
+
+	start := time.Now()
+	s.completion(w, r)
+	elapsed := time.Since(start)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+
+	var final CompletionResponse
+	var content strings.Builder
+	scanner := bufio.NewScanner(w.Body)
+	for scanner.Scan() {
+		var resp CompletionResponse
+		if err := json.Unmarshal(scanner.Bytes(), &resp); err != nil {
+			t.Fatal(err)
+		}
+
+		content.WriteString(resp.Content)
+		if resp.Stop {
+			final = resp
+		}
+	}
+
+	if !final.Stop || !final.StoppedTimeout || final.StoppedLimit {
+		t.Fatalf("expected the final response to stop for the time budget, got %+v", final)
+	}
+
+	if final.Timings.PredictedN == 0 || content.Len() == 0 {
+		t.Errorf("expected tokens to be generated before the time budget, got %d", final.Timings.PredictedN)
+	}
+
+	if elapsed < 200*time.Millisecond || elapsed > 5*time.Second {
+		t.Errorf("expected generating to stop at the time budget, took %s", elapsed)
+	}
+}
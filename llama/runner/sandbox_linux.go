@@ -0,0 +1,251 @@
+package runner
+
+import (
+	"debug/elf"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// sandboxedEnv marks a runner that was re-executed after restricting its
+// file access, so it doesn't try to restrict it again
+const sandboxedEnv = "OLLAMA_RUNNER_SANDBOXED"
+
+// systemDirs are read by the GPU drivers and libraries the runner loads
+var systemDirs = []string{"/usr", "/lib", "/lib64", "/opt", "/etc", "/proc", "/sys"}
+
+// restrictFiles limits the runner to reading the system libraries and the
+// given files, and writing to the given directories and GPU devices. Landlock
+// only restricts the calling thread, so the runner is executed again from it
+// for the restriction to cover every thread.
+func restrictFiles(read, write []string) error {
+	if os.Getenv(sandboxedEnv) != "" {
+		return nil
+	}
+
+	abi, _, errno := unix.Syscall(unix.SYS_LANDLOCK_CREATE_RULESET, 0, 0, unix.LANDLOCK_CREATE_RULESET_VERSION)
+	if errno != 0 {
+		slog.Warn("landlock isn't supported by the kernel, the runner can still access all files", "error", errno)
+		return nil
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	// the rights handled by each landlock ABI version, anything not handled stays allowed
+	handled := uint64(unix.LANDLOCK_ACCESS_FS_MAKE_SYM<<1 - 1)
+	if abi >= 2 {
+		handled |= unix.LANDLOCK_ACCESS_FS_REFER
+	}
+	if abi >= 3 {
+		handled |= unix.LANDLOCK_ACCESS_FS_TRUNCATE
+	}
+
+	runtime.LockOSThread()
+
+	attr := unix.LandlockRulesetAttr{Access_fs: handled}
+	fd, _, errno := unix.Syscall(unix.SYS_LANDLOCK_CREATE_RULESET, uintptr(unsafe.Pointer(&attr)), unsafe.Sizeof(attr), 0)
+	if errno != 0 {
+		return fmt.Errorf("landlock: %w", errno)
+	}
+	defer unix.Close(int(fd))
+
+	readFile := uint64(unix.LANDLOCK_ACCESS_FS_READ_FILE)
+	readDir := readFile | unix.LANDLOCK_ACCESS_FS_READ_DIR
+	writeDir := readDir | (handled &^ (unix.LANDLOCK_ACCESS_FS_EXECUTE | unix.LANDLOCK_ACCESS_FS_REFER))
+
+	dirs := append([]string{filepath.Dir(exe)}, systemDirs...)
+	dirs = append(dirs, filepath.SplitList(os.Getenv("LD_LIBRARY_PATH"))...)
+
+	rules := []struct {
+		paths  []string
+		access uint64
+	}{
+		{dirs, readDir},
+		{read, readFile},
+		{[]string{exe, interpreter(exe)}, readFile | unix.LANDLOCK_ACCESS_FS_EXECUTE},
+		{append([]string{"/dev"}, write...), writeDir},
+	}
+
+	for _, rule := range rules {
+		for _, path := range rule.paths {
+			if path == "" {
+				continue
+			}
+
+			if err := addLandlockRule(int(fd), path, rule.access&handled); err != nil {
+				if errors.Is(err, os.ErrNotExist) {
+					continue
+				}
+				return fmt.Errorf("landlock %s: %w", path, err)
+			}
+		}
+	}
+
+	if err := unix.Prctl(unix.PR_SET_NO_NEW_PRIVS, 1, 0, 0, 0); err != nil {
+		return err
+	}
+
+	if _, _, errno := unix.Syscall(unix.SYS_LANDLOCK_RESTRICT_SELF, fd, 0, 0); errno != 0 {
+		return fmt.Errorf("landlock: %w", errno)
+	}
+
+	slog.Info("restricted runner file access", "landlock_abi", abi, "read", read, "write", write)
+	return syscall.Exec(exe, os.Args, append(os.Environ(), sandboxedEnv+"=1"))
+}
+
+// interpreter returns the dynamic loader of exe, which also needs to be
+// executable to execute the runner again
+func interpreter(exe string) string {
+	f, err := elf.Open(exe)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+
+	for _, prog := range f.Progs {
+		if prog.Type == elf.PT_INTERP {
+			b, err := io.ReadAll(prog.Open())
+			if err != nil {
+				return ""
+			}
+			return strings.TrimRight(string(b), "\x00")
+		}
+	}
+
+	return ""
+}
+
+func addLandlockRule(ruleset int, path string, access uint64) error {
+	f, err := os.OpenFile(path, unix.O_PATH|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// rules on files can only grant rights that apply to files
+	if fi, err := f.Stat(); err == nil && !fi.IsDir() {
+		access &= unix.LANDLOCK_ACCESS_FS_EXECUTE | unix.LANDLOCK_ACCESS_FS_WRITE_FILE | unix.LANDLOCK_ACCESS_FS_READ_FILE | unix.LANDLOCK_ACCESS_FS_TRUNCATE
+	}
+
+	attr := unix.LandlockPathBeneathAttr{Allowed_access: access, Parent_fd: int32(f.Fd())}
+	if _, _, errno := unix.Syscall6(unix.SYS_LANDLOCK_ADD_RULE, uintptr(ruleset), unix.LANDLOCK_RULE_PATH_BENEATH, uintptr(unsafe.Pointer(&attr)), 0, 0, 0); errno != 0 {
+		return errno
+	}
+
+	return nil
+}
+
+// deniedSyscalls are never needed to run a model, but are commonly used to
+// escalate privileges or escape a sandbox. io_uring is denied since its
+// operations bypass the filter, including connecting sockets.
+var deniedSyscalls = []uint32{
+	unix.SYS_SOCKET,
+	unix.SYS_CONNECT,
+	unix.SYS_PTRACE,
+	unix.SYS_PROCESS_VM_READV,
+	unix.SYS_PROCESS_VM_WRITEV,
+	unix.SYS_MOUNT,
+	unix.SYS_UMOUNT2,
+	unix.SYS_PIVOT_ROOT,
+	unix.SYS_CHROOT,
+	unix.SYS_UNSHARE,
+	unix.SYS_SETNS,
+	unix.SYS_BPF,
+	unix.SYS_KEYCTL,
+	unix.SYS_ADD_KEY,
+	unix.SYS_REQUEST_KEY,
+	unix.SYS_USERFAULTFD,
+	unix.SYS_IO_URING_SETUP,
+	unix.SYS_IO_URING_ENTER,
+	unix.SYS_IO_URING_REGISTER,
+	unix.SYS_KEXEC_LOAD,
+	unix.SYS_INIT_MODULE,
+	unix.SYS_FINIT_MODULE,
+	unix.SYS_DELETE_MODULE,
+	unix.SYS_REBOOT,
+	unix.SYS_SWAPON,
+	unix.SYS_SWAPOFF,
+}
+
+// restrictSyscalls installs a seccomp filter on every thread, failing system
+// calls the runner has no use for. Creating sockets is one of them, so it has
+// to be called once the runner is listening.
+func restrictSyscalls() error {
+	var arch uint32
+	switch runtime.GOARCH {
+	case "amd64":
+		arch = unix.AUDIT_ARCH_X86_64
+	case "arm64":
+		arch = unix.AUDIT_ARCH_AARCH64
+	default:
+		slog.Warn("seccomp filter isn't supported on this architecture", "arch", runtime.GOARCH)
+		return nil
+	}
+
+	filter := seccompFilter(arch, deniedSyscalls)
+	prog := unix.SockFprog{Len: uint16(len(filter)), Filter: &filter[0]}
+
+	if err := unix.Prctl(unix.PR_SET_NO_NEW_PRIVS, 1, 0, 0, 0); err != nil {
+		return err
+	}
+
+	if _, _, errno := unix.Syscall(unix.SYS_SECCOMP, unix.SECCOMP_SET_MODE_FILTER, unix.SECCOMP_FILTER_FLAG_TSYNC, uintptr(unsafe.Pointer(&prog))); errno != 0 {
+		return fmt.Errorf("seccomp: %w", errno)
+	}
+
+	slog.Info("restricted runner system calls", "denied", len(deniedSyscalls))
+	return nil
+}
+
+// seccompFilter returns a BPF program that allows every system call except
+// denied, which fail with EPERM, and kills the process if it makes system
+// calls for an architecture other than arch. On x86_64, x32 system calls
+// share the architecture with their own numbers, so they're denied as well.
+func seccompFilter(arch uint32, denied []uint32) []unix.SockFilter {
+	const (
+		// offsets into struct seccomp_data
+		nrOffset   = 0
+		archOffset = 4
+	)
+
+	load := func(offset uint32) unix.SockFilter {
+		return unix.SockFilter{Code: unix.BPF_LD | unix.BPF_W | unix.BPF_ABS, K: offset}
+	}
+	ret := func(action uint32) unix.SockFilter {
+		return unix.SockFilter{Code: unix.BPF_RET | unix.BPF_K, K: action}
+	}
+
+	filter := []unix.SockFilter{
+		load(archOffset),
+		{Code: unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K, Jt: 1, K: arch},
+		ret(unix.SECCOMP_RET_KILL_PROCESS),
+		load(nrOffset),
+	}
+
+	if arch == unix.AUDIT_ARCH_X86_64 {
+		const x32SyscallBit = 0x40000000
+		filter = append(filter, unix.SockFilter{Code: unix.BPF_JMP | unix.BPF_JGE | unix.BPF_K, Jt: uint8(len(denied) + 1), K: x32SyscallBit})
+	}
+
+	// each match jumps past the remaining comparisons and the allow to the deny
+	for i, nr := range denied {
+		filter = append(filter, unix.SockFilter{Code: unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K, Jt: uint8(len(denied) - i), K: nr})
+	}
+
+	return append(filter,
+		ret(unix.SECCOMP_RET_ALLOW),
+		ret(unix.SECCOMP_RET_ERRNO|uint32(unix.EPERM)),
+	)
+}
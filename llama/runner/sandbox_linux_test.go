@@ -0,0 +1,91 @@
+package runner
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestRestrictFilesDirectory(t *testing.T) {
+	if dir := os.Getenv("TEST_RESTRICT_FILES_DIR"); dir != "" {
+		// the sandboxed process, executed again by restrictFiles
+		if err := restrictFiles([]string{filepath.Join(dir, "blobs")}, nil); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := os.ReadFile(filepath.Join(dir, "blobs", "adapter")); err != nil {
+			t.Errorf("expected files in the directory to be readable, got %v", err)
+		}
+
+		if _, err := os.ReadFile(filepath.Join(dir, "model")); !errors.Is(err, os.ErrPermission) {
+			t.Errorf("expected other files to be denied, got %v", err)
+		}
+		return
+	}
+
+	if _, _, errno := unix.Syscall(unix.SYS_LANDLOCK_CREATE_RULESET, 0, 0, unix.LANDLOCK_CREATE_RULESET_VERSION); errno != 0 {
+		t.Skipf("landlock isn't supported: %v", errno)
+	}
+
+	dir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(dir, "blobs"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{filepath.Join("blobs", "adapter"), "model"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte("gguf"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cmd := exec.Command(os.Args[0], "-test.run=^TestRestrictFilesDirectory$", "-test.v")
+	cmd.Env = append(os.Environ(), "TEST_RESTRICT_FILES_DIR="+dir)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("sandboxed test failed: %v\n%s", err, out)
+	}
+}
+
+func TestSeccompFilter(t *testing.T) {
+	denied := []uint32{unix.SYS_SOCKET, unix.SYS_CONNECT, unix.SYS_PTRACE}
+	filter := seccompFilter(unix.AUDIT_ARCH_X86_64, denied)
+
+	deny := unix.SockFilter{Code: unix.BPF_RET | unix.BPF_K, K: unix.SECCOMP_RET_ERRNO | uint32(unix.EPERM)}
+	if filter[len(filter)-1] != deny {
+		t.Fatalf("expected the filter to end by denying, got %+v", filter[len(filter)-1])
+	}
+
+	allow := unix.SockFilter{Code: unix.BPF_RET | unix.BPF_K, K: unix.SECCOMP_RET_ALLOW}
+	if filter[len(filter)-2] != allow {
+		t.Fatalf("expected unmatched system calls to be allowed, got %+v", filter[len(filter)-2])
+	}
+
+	for i, insn := range filter[len(filter)-2-len(denied) : len(filter)-2] {
+		if insn.K != denied[i] {
+			t.Errorf("expected comparison %d to match %d, got %d", i, denied[i], insn.K)
+		}
+
+		// jumps are relative to the next instruction
+		if target := len(filter) - 2 - len(denied) + i + 1 + int(insn.Jt); target != len(filter)-1 {
+			t.Errorf("expected %d to jump to the deny, jumps to %d", denied[i], target)
+		}
+	}
+
+	// x32 system calls jump to the deny before the comparisons
+	x32 := filter[len(filter)-3-len(denied)]
+	if x32.Code != unix.BPF_JMP|unix.BPF_JGE|unix.BPF_K || x32.K != 0x40000000 {
+		t.Fatalf("expected x32 system calls to be checked, got %+v", x32)
+	}
+
+	if target := len(filter) - 3 - len(denied) + 1 + int(x32.Jt); target != len(filter)-1 {
+		t.Errorf("expected x32 system calls to jump to the deny, jumps to %d", target)
+	}
+
+	arm := seccompFilter(unix.AUDIT_ARCH_AARCH64, denied)
+	if len(arm) != len(filter)-1 {
+		t.Errorf("expected no x32 check on arm64, got %d instructions", len(arm))
+	}
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+
+package runner
+
+import "log/slog"
+
+func restrictFiles(read, write []string) error {
+	slog.Warn("runner sandboxing is only supported on linux, the runner can still access all files")
+	return nil
+}
+
+func restrictSyscalls() error {
+	return nil
+}
@@ -0,0 +1,176 @@
+package runner
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ollama/ollama/llama"
+)
+
+// batchTuning is the result of measuring prompt throughput at each of a list
+// of batch sizes, stored so that later loads of the same model with the same
+// hardware and settings don't need to measure it again
+type batchTuning struct {
+	Sizes      []int     `json:"sizes"`
+	Throughput []float64 `json:"tokens_per_second"`
+	BatchSize  int       `json:"batch_size"`
+}
+
+// batchTolerance is how much slower than the fastest a smaller batch size can be
+// and still be chosen, since smaller batches interleave prompt processing
+// with generation for other sequences more often
+const batchTolerance = 0.05
+
+// fastest returns the smallest size with a throughput within batchTolerance
+// of the highest throughput
+func fastest(sizes []int, throughput []float64) int {
+	best := slices.Max(throughput)
+
+	size := 0
+	for i, t := range throughput {
+		if t >= best*(1-batchTolerance) && (size == 0 || sizes[i] < size) {
+			size = sizes[i]
+		}
+	}
+
+	return size
+}
+
+// parseBatchSizes parses a comma separated list of batch sizes
+func parseBatchSizes(s string) ([]int, error) {
+	var sizes []int
+	for _, f := range strings.Split(s, ",") {
+		n, err := strconv.Atoi(strings.TrimSpace(f))
+		if err != nil || n <= 0 {
+			return nil, fmt.Errorf("invalid batch size %q", f)
+		}
+
+		sizes = append(sizes, n)
+	}
+
+	slices.Sort(sizes)
+	return slices.Compact(sizes), nil
+}
+
+// loadBatchTuning reads a tuning of sizes from path, returning nil if it
+// doesn't exist or was measured at other sizes
+func loadBatchTuning(path string, sizes []int) (*batchTuning, error) {
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var t batchTuning
+	if err := json.Unmarshal(b, &t); err != nil {
+		return nil, err
+	}
+
+	if !slices.Equal(t.Sizes, sizes) {
+		return nil, nil
+	}
+
+	return &t, nil
+}
+
+func (t *batchTuning) save(path string) error {
+	b, err := json.Marshal(t)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+
+	return os.WriteFile(path, b, 0o644)
+}
+
+// measureBatchSizes returns the prompt throughput in tokens per second when
+// processing the same number of tokens in batches of each of sizes. It must
+// be called before any sequences are added since it uses the KV cache.
+func (s *Server) measureBatchSizes(sizes []int, kvSize int) ([]float64, error) {
+	total := min(2*slices.Max(sizes), kvSize)
+	vocab := s.model.NumVocab()
+
+	decode := func(size, count int) (time.Duration, error) {
+		batch, err := llama.NewBatch(size, 1, 0)
+		if err != nil {
+			return 0, err
+		}
+		defer batch.Free()
+		defer s.lc.KvCacheSeqRm(0, 0, -1)
+
+		start := time.Now()
+		for pos := 0; pos < count; pos += size {
+			batch.Clear()
+			for i := pos; i < min(pos+size, count); i++ {
+				batch.Add(i%vocab, nil, i, i+1 == min(pos+size, count), 0)
+			}
+
+			if err := s.lc.Decode(batch); err != nil {
+				return 0, err
+			}
+		}
+
+		s.lc.Synchronize()
+		return time.Since(start), nil
+	}
+
+	// the first batch allocates buffers which shouldn't count against it
+	if _, err := decode(sizes[0], sizes[0]); err != nil {
+		return nil, err
+	}
+
+	throughput := make([]float64, len(sizes))
+	for i, size := range sizes {
+		d, err := decode(size, total)
+		if err != nil {
+			return nil, err
+		}
+
+		throughput[i] = float64(total) / d.Seconds()
+		slog.Debug("measured batch size", "size", size, "tokens", total, "duration", d, "tokens_per_second", throughput[i])
+	}
+
+	return throughput, nil
+}
+
+// tuneBatchSize chooses the batch size with the highest prompt throughput out
+// of sizes, using the result stored at path if there is one
+func (s *Server) tuneBatchSize(sizes []int, kvSize int, path string) (int, error) {
+	if path != "" {
+		t, err := loadBatchTuning(path, sizes)
+		if err != nil {
+			slog.Warn("failed to load batch tuning", "path", path, "error", err)
+		} else if t != nil {
+			slog.Info("using stored batch size", "size", t.BatchSize, "path", path)
+			return t.BatchSize, nil
+		}
+	}
+
+	throughput, err := s.measureBatchSizes(sizes, kvSize)
+	if err != nil {
+		return 0, err
+	}
+
+	t := batchTuning{Sizes: sizes, Throughput: throughput, BatchSize: fastest(sizes, throughput)}
+	slog.Info("tuned batch size", "size", t.BatchSize, "sizes", sizes, "tokens_per_second", throughput)
+
+	if path != "" {
+		if err := t.save(path); err != nil {
+			slog.Warn("failed to store batch tuning", "path", path, "error", err)
+		}
+	}
+
+	return t.BatchSize, nil
+}
@@ -0,0 +1,74 @@
+package runner
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestFastest(t *testing.T) {
+	cases := []struct {
+		name       string
+		sizes      []int
+		throughput []float64
+		expect     int
+	}{
+		{"single", []int{512}, []float64{100}, 512},
+		{"largest", []int{128, 256, 512}, []float64{100, 200, 400}, 512},
+		{"middle", []int{128, 256, 512}, []float64{100, 400, 300}, 256},
+		{"close", []int{128, 256, 512}, []float64{100, 390, 400}, 256},
+		{"not close", []int{128, 256, 512}, []float64{100, 370, 400}, 512},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			if size := fastest(tt.sizes, tt.throughput); size != tt.expect {
+				t.Errorf("expected %d, got %d", tt.expect, size)
+			}
+		})
+	}
+}
+
+func TestParseBatchSizes(t *testing.T) {
+	sizes, err := parseBatchSizes("512, 128,256,128")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(sizes, []int{128, 256, 512}) {
+		t.Errorf("expected [128 256 512], got %v", sizes)
+	}
+
+	for _, s := range []string{"", "128,", "x", "0", "-1"} {
+		if _, err := parseBatchSizes(s); err == nil {
+			t.Errorf("%q: expected error", s)
+		}
+	}
+}
+
+func TestBatchTuningStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tuning", "model.json")
+
+	if tuning, err := loadBatchTuning(path, []int{128, 256}); err != nil || tuning != nil {
+		t.Fatalf("expected no tuning, got %v, %v", tuning, err)
+	}
+
+	expect := batchTuning{Sizes: []int{128, 256}, Throughput: []float64{100, 200}, BatchSize: 256}
+	if err := expect.save(path); err != nil {
+		t.Fatal(err)
+	}
+
+	tuning, err := loadBatchTuning(path, []int{128, 256})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(*tuning, expect) {
+		t.Errorf("expected %v, got %v", expect, *tuning)
+	}
+
+	// tuning measured at other sizes is ignored
+	if tuning, err := loadBatchTuning(path, []int{128, 256, 512}); err != nil || tuning != nil {
+		t.Errorf("expected no tuning, got %v, %v", tuning, err)
+	}
+}
@@ -28,6 +28,7 @@
 
 #include "common.h"
 
+#include <algorithm>
 #include <cmath>
 #include <unordered_map>
 
@@ -389,6 +390,125 @@ uint32_t common_sampler_get_seed(const struct common_sampler * gsmpl) {
     return llama_sampler_get_seed(gsmpl->chain);
 }
 
+void common_sampler_discard(struct common_sampler * gsmpl, int n) {
+    // a draw advances the RNG of the dist sampler by the same amount whatever the candidates are
+    llama_token_data cur[2];
+
+    for (int i = 0; i < llama_sampler_chain_n(gsmpl->chain); i++) {
+        struct llama_sampler * smpl = llama_sampler_chain_get(gsmpl->chain, i);
+        if (std::string(llama_sampler_name(smpl)) != "dist") {
+            continue;
+        }
+
+        for (int j = 0; j < n; j++) {
+            cur[0] = { 0, 0.0f, 0.5f };
+            cur[1] = { 1, 0.0f, 0.5f };
+            llama_token_data_array cur_p = { cur, 2, -1, false };
+            llama_sampler_apply(smpl, &cur_p);
+        }
+    }
+}
+
+// apply a sampler, marking the traced candidates it eliminated with stage
+static void common_sampler_apply_traced(struct llama_sampler * smpl, llama_token_data_array * cur_p, std::vector<common_sampler_trace> & trace, int stage) {
+    llama_sampler_apply(smpl, cur_p);
+
+    std::unordered_map<llama_token, common_sampler_trace *> traced;
+    for (auto & t : trace) {
+        if (t.stage < 0) {
+            traced[t.id] = &t;
+        }
+    }
+
+    const bool penalties = std::string(llama_sampler_name(smpl)) == "penalties";
+
+    std::vector<bool> kept(trace.size(), false);
+    for (size_t i = 0; i < cur_p->size; i++) {
+        auto it = traced.find(cur_p->data[i].id);
+        if (it == traced.end() || cur_p->data[i].logit == -INFINITY) {
+            continue;
+        }
+
+        auto * t = it->second;
+        kept[t - trace.data()] = true;
+        if (penalties) {
+            t->penalized = cur_p->data[i].logit;
+        }
+        t->p = cur_p->data[i].p;
+    }
+
+    for (size_t i = 0; i < trace.size(); i++) {
+        if (trace[i].stage < 0 && !kept[i]) {
+            trace[i].stage = stage;
+            trace[i].p     = 0.0f;
+        }
+    }
+}
+
+llama_token common_sampler_sample_trace(struct common_sampler * gsmpl, struct llama_context * ctx, int idx, std::vector<common_sampler_trace> & trace, size_t k) {
+    gsmpl->set_logits(ctx, idx);
+
+    auto & grmr  = gsmpl->grmr;
+    auto & chain = gsmpl->chain;
+    auto & cur_p = gsmpl->cur_p;
+
+    // trace the candidates with the highest logits before any sampler is applied
+    std::vector<llama_token_data> top(cur_p.data, cur_p.data + cur_p.size);
+    k = std::min(k, top.size());
+    std::partial_sort(top.begin(), top.begin() + k, top.end(), [](const llama_token_data & a, const llama_token_data & b) {
+        return a.logit > b.logit;
+    });
+
+    const auto reset = [&]() {
+        trace.clear();
+        for (size_t i = 0; i < k; i++) {
+            trace.push_back({ top[i].id, top[i].logit, top[i].logit, 0.0f, -1 });
+        }
+    };
+
+    // same as applying the chain, one sampler at a time
+    const auto apply_chain = [&]() {
+        for (int i = 0; i < llama_sampler_chain_n(chain); i++) {
+            common_sampler_apply_traced(llama_sampler_chain_get(chain, i), &cur_p, trace, i + 1);
+        }
+
+        GGML_ASSERT(cur_p.selected != -1 && "no selected token during sampling - check your sampling configuration");
+    };
+
+    reset();
+    apply_chain();
+
+    const llama_token id = cur_p.data[cur_p.selected].id;
+
+    // check if the sampled token fits the grammar, as in common_sampler_sample
+    {
+        llama_token_data       single_token_data       = { id, 1.0f, 0.0f };
+        llama_token_data_array single_token_data_array = { &single_token_data, 1, -1, false };
+
+        llama_sampler_apply(grmr, &single_token_data_array);
+
+        if (single_token_data_array.data[0].logit != -INFINITY) {
+            return id;
+        }
+    }
+
+    gsmpl->set_logits(ctx, idx);
+
+    reset();
+    common_sampler_apply_traced(grmr, &cur_p, trace, 0);
+    apply_chain();
+
+    return cur_p.data[cur_p.selected].id;
+}
+
+const char * common_sampler_stage_name(const struct common_sampler * gsmpl, int stage) {
+    if (stage == 0) {
+        return llama_sampler_name(gsmpl->grmr);
+    }
+
+    return llama_sampler_name(llama_sampler_chain_get(gsmpl->chain, stage - 1));
+}
+
 // helpers
 
 llama_token_data_array * common_sampler_get_candidates(struct common_sampler * gsmpl) {
@@ -109,6 +109,25 @@ std::vector<llama_token> common_sampler_sample_and_accept_n(struct common_sample
 
 uint32_t common_sampler_get_seed(const struct common_sampler * gsmpl);
 
+// advance the RNG of the sampler as if n tokens had been sampled
+void common_sampler_discard(struct common_sampler * gsmpl, int n);
+
+// a candidate token traced through the stages of sampling
+struct common_sampler_trace {
+    llama_token id;
+    float       logit;     // before any sampler is applied
+    float       penalized; // after the penalties sampler
+    float       p;         // probability once sampled, 0 if eliminated
+    int         stage;     // stage that eliminated it, -1 if it wasn't
+};
+
+// same as common_sampler_sample, also tracing the k candidates with the highest logits
+// stage 0 is the grammar and stage i > 0 is sampler i - 1 of the chain
+llama_token common_sampler_sample_trace(struct common_sampler * gsmpl, struct llama_context * ctx, int idx, std::vector<common_sampler_trace> & trace, size_t k);
+
+// get the name of a stage of sampling
+const char * common_sampler_stage_name(const struct common_sampler * gsmpl, int stage);
+
 // helpers
 
 // access the internal list of current candidate tokens
@@ -2,6 +2,7 @@
 #include "sampling.h"
 #include "sampling_ext.h"
 #include "json-schema-to-grammar.h"
+#include "llama-grammar.h"
 
 struct common_sampler *common_sampler_cinit(const struct llama_model *model, struct common_sampler_cparams *params) {
     try {
@@ -21,8 +22,22 @@ struct common_sampler *common_sampler_cinit(const struct llama_model *model, str
         sparams.penalize_nl = params->penalize_nl;
         sparams.seed = params->seed;
         sparams.grammar = params->grammar;
-        sparams.xtc_probability = 0.0;
-        sparams.xtc_threshold = 0.5;
+        sparams.logit_bias.assign(params->logit_bias, params->logit_bias + params->n_logit_bias);
+        sparams.dry_multiplier = params->dry_multiplier;
+        sparams.dry_base = params->dry_base;
+        sparams.dry_allowed_length = params->dry_allowed_length;
+        sparams.dry_penalty_last_n = params->dry_penalty_last_n;
+        if (params->n_dry_sequence_breakers > 0) {
+            sparams.dry_sequence_breakers.assign(params->dry_sequence_breakers, params->dry_sequence_breakers + params->n_dry_sequence_breakers);
+        }
+        sparams.xtc_probability = params->xtc_probability;
+        sparams.xtc_threshold = params->xtc_threshold;
+        sparams.dynatemp_range = params->dynatemp_range;
+        sparams.dynatemp_exponent = params->dynatemp_exponent;
+        if (params->n_samplers > 0) {
+            std::vector<std::string> names(params->samplers, params->samplers + params->n_samplers);
+            sparams.samplers = common_sampler_types_from_names(names, false);
+        }
         return common_sampler_init(model, sparams);
     } catch (const std::exception &err) {
         return nullptr;
@@ -41,10 +56,34 @@ void common_sampler_caccept(struct common_sampler *sampler, llama_token id, bool
     common_sampler_accept(sampler, id, apply_grammar);
 }
 
+void common_sampler_cdiscard(struct common_sampler *sampler, int n) {
+    common_sampler_discard(sampler, n);
+}
+
 llama_token common_sampler_csample(struct common_sampler *sampler, struct llama_context *ctx, int idx) {
     return common_sampler_sample(sampler, ctx, idx);
 }
 
+// trace must have room for k candidates, any left over have stage -2
+llama_token common_sampler_csample_trace(struct common_sampler *sampler, struct llama_context *ctx, int idx, struct common_sampler_ctrace *trace, int k) {
+    std::vector<common_sampler_trace> traced;
+    llama_token id = common_sampler_sample_trace(sampler, ctx, idx, traced, k);
+
+    for (int i = 0; i < k; i++) {
+        if (i < (int)traced.size()) {
+            trace[i] = {traced[i].id, traced[i].logit, traced[i].penalized, traced[i].p, traced[i].stage};
+        } else {
+            trace[i] = {-1, 0.0f, 0.0f, 0.0f, -2};
+        }
+    }
+
+    return id;
+}
+
+const char *common_sampler_cstage_name(struct common_sampler *sampler, int stage) {
+    return common_sampler_stage_name(sampler, stage);
+}
+
 int schema_to_grammar(const char *json_schema, char *grammar, size_t max_len)
 {
     try
@@ -52,11 +91,12 @@ int schema_to_grammar(const char *json_schema, char *grammar, size_t max_len)
         nlohmann::ordered_json schema = nlohmann::ordered_json::parse(json_schema);
         std::string grammar_str = json_schema_to_grammar(schema);
         size_t len = grammar_str.length();
-        if (len >= max_len)
-        {
-            len = max_len - 1;
-        }
-        strncpy(grammar, grammar_str.c_str(), len);
+
+        // return the full length so callers can retry with a larger buffer
+        // instead of using a truncated grammar
+        size_t n = len < max_len ? len : max_len - 1;
+        strncpy(grammar, grammar_str.c_str(), n);
+        grammar[n] = '\0';
         return len;
     }
     catch (const std::exception &e)
@@ -65,3 +105,17 @@ int schema_to_grammar(const char *json_schema, char *grammar, size_t max_len)
         return 0;
     }
 }
+
+bool validate_grammar(const char *grammar)
+{
+    // a null vocab is enough to parse the grammar and check it has a root
+    // rule without left recursion
+    struct llama_grammar *g = llama_grammar_init_impl(nullptr, grammar, "root");
+    if (g == nullptr)
+    {
+        return false;
+    }
+
+    llama_grammar_free_impl(g);
+    return true;
+}
@@ -26,6 +26,20 @@ extern "C"
         bool penalize_nl;
         uint32_t seed;
         char *grammar;
+        const llama_logit_bias *logit_bias;
+        int32_t n_logit_bias;
+        float dry_multiplier;
+        float dry_base;
+        int32_t dry_allowed_length;
+        int32_t dry_penalty_last_n;
+        const char **dry_sequence_breakers;
+        int32_t n_dry_sequence_breakers;
+        float xtc_probability;
+        float xtc_threshold;
+        float dynatemp_range;
+        float dynatemp_exponent;
+        const char **samplers;
+        int32_t n_samplers;
     };
 
     struct common_sampler *common_sampler_cinit(const struct llama_model *model, struct common_sampler_cparams *params);
@@ -33,8 +47,21 @@ extern "C"
     void common_sampler_creset(struct common_sampler *sampler);
     void common_sampler_caccept(struct common_sampler *sampler, llama_token id, bool apply_grammar);
     llama_token common_sampler_csample(struct common_sampler *sampler, struct llama_context *ctx, int idx);
+    void common_sampler_cdiscard(struct common_sampler *sampler, int n);
+
+    struct common_sampler_ctrace {
+        llama_token id;
+        float logit;
+        float penalized;
+        float p;
+        int32_t stage;
+    };
+
+    llama_token common_sampler_csample_trace(struct common_sampler *sampler, struct llama_context *ctx, int idx, struct common_sampler_ctrace *trace, int k);
+    const char *common_sampler_cstage_name(struct common_sampler *sampler, int stage);
 
     int schema_to_grammar(const char *json_schema, char *grammar, size_t max_len);
+    bool validate_grammar(const char *grammar);
 
 #ifdef __cplusplus
 }
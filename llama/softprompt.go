@@ -0,0 +1,67 @@
+package llama
+
+/*
+#include <stdlib.h>
+#include "ggml.h"
+
+static struct gguf_context *soft_prompt_init(const char *fname, struct ggml_context **ctx) {
+	struct gguf_init_params params = { .no_alloc = false, .ctx = ctx };
+	return gguf_init_from_file(fname, params);
+}
+*/
+import "C"
+
+import (
+	"fmt"
+	"unsafe"
+)
+
+// SoftPromptTensor is the name of the tensor in a soft prompt file holding the
+// embeddings of its virtual tokens
+const SoftPromptTensor = "prompt_embd.weight"
+
+// LoadSoftPrompt reads the learned embeddings of a soft prompt (prompt or
+// prefix tuning) from the GGUF file at path. Each embedding has embedSize
+// values and is prepended to prompts as a virtual token.
+func LoadSoftPrompt(path string, embedSize int) ([][]float32, error) {
+	cpath := C.CString(path)
+	defer C.free(unsafe.Pointer(cpath))
+
+	var ctx *C.struct_ggml_context
+	gctx := C.soft_prompt_init(cpath, &ctx)
+	if gctx == nil {
+		return nil, fmt.Errorf("unable to load soft prompt %s", path)
+	}
+	defer C.gguf_free(gctx)
+	defer C.ggml_free(ctx)
+
+	cname := C.CString(SoftPromptTensor)
+	defer C.free(unsafe.Pointer(cname))
+
+	t := C.ggml_get_tensor(ctx, cname)
+	if t == nil {
+		return nil, fmt.Errorf("soft prompt is missing %s tensor", SoftPromptTensor)
+	}
+
+	if int(t.ne[0]) != embedSize || t.ne[1] < 1 || t.ne[2] != 1 || t.ne[3] != 1 {
+		return nil, fmt.Errorf("soft prompt has shape %v, expected [%d, n]", t.ne, embedSize)
+	}
+
+	n := int(t.ne[1])
+	data := make([]float32, n*embedSize)
+	switch t._type {
+	case C.GGML_TYPE_F32:
+		copy(data, unsafe.Slice((*float32)(t.data), len(data)))
+	case C.GGML_TYPE_F16:
+		C.ggml_fp16_to_fp32_row((*C.ggml_fp16_t)(t.data), (*C.float)(&data[0]), C.int64_t(len(data)))
+	default:
+		return nil, fmt.Errorf("soft prompt has unsupported type %d", t._type)
+	}
+
+	embeds := make([][]float32, n)
+	for i := range embeds {
+		embeds[i] = data[i*embedSize : (i+1)*embedSize]
+	}
+
+	return embeds, nil
+}
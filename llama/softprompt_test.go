@@ -0,0 +1,69 @@
+package llama_test
+
+import (
+	"encoding/binary"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/ollama/ollama/llama"
+	"github.com/ollama/ollama/llm"
+)
+
+type tensor []float32
+
+func (t tensor) WriteTo(w io.Writer) (int64, error) {
+	if err := binary.Write(w, binary.LittleEndian, []float32(t)); err != nil {
+		return 0, err
+	}
+
+	return int64(len(t) * 4), nil
+}
+
+func writeSoftPrompt(t *testing.T, name string, shape []uint64, data []float32) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "softprompt.gguf")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	if err := llm.WriteGGUF(f, llm.KV{"general.architecture": "llama"}, []llm.Tensor{
+		{Name: name, Kind: 0, Shape: shape, WriterTo: tensor(data)},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+func TestLoadSoftPrompt(t *testing.T) {
+	// two virtual tokens with embeddings of 4
+	path := writeSoftPrompt(t, llama.SoftPromptTensor, []uint64{2, 4}, []float32{1, 2, 3, 4, 5, 6, 7, 8})
+
+	embeds, err := llama.LoadSoftPrompt(path, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if diff := cmp.Diff(embeds, [][]float32{{1, 2, 3, 4}, {5, 6, 7, 8}}); diff != "" {
+		t.Errorf("mismatch (-got +want):\n%s", diff)
+	}
+
+	if _, err := llama.LoadSoftPrompt(path, 8); err == nil {
+		t.Error("expected error for mismatched embedding size")
+	}
+
+	if _, err := llama.LoadSoftPrompt(writeSoftPrompt(t, "token_embd.weight", []uint64{2, 4}, make([]float32, 8)), 4); err == nil {
+		t.Error("expected error for missing tensor")
+	}
+
+	if _, err := llama.LoadSoftPrompt(filepath.Join(t.TempDir(), "missing.gguf"), 2); err == nil {
+		t.Error("expected error for missing file")
+	}
+}
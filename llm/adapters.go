@@ -0,0 +1,106 @@
+package llm
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"time"
+)
+
+// ErrAdapterInUse is returned when unloading an adapter a request is using
+var ErrAdapterInUse = errors.New("adapter in use")
+
+// AdapterStatus is a LoRA adapter loaded by a runner
+type AdapterStatus struct {
+	Path string `json:"path"`
+
+	// Sequences is the number of requests using the adapter
+	Sequences int       `json:"sequences"`
+	LastUsed  time.Time `json:"last_used"`
+}
+
+type adaptersResponse struct {
+	Adapters []AdapterStatus `json:"adapters"`
+}
+
+// Adapters returns the LoRA adapters loaded by the runner for requests
+func (s *llmServer) Adapters(ctx context.Context) ([]AdapterStatus, error) {
+	resp, err := s.adapterRequest(ctx, http.MethodGet, "")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var adapters adaptersResponse
+	if err := json.NewDecoder(resp.Body).Decode(&adapters); err != nil {
+		return nil, fmt.Errorf("unmarshal adapters response: %w", err)
+	}
+
+	return adapters.Adapters, nil
+}
+
+// LoadAdapter loads the LoRA adapter at path ahead of the requests that use
+// it. Loading it may unload the least recently used adapter that isn't in
+// use.
+func (s *llmServer) LoadAdapter(ctx context.Context, path string) error {
+	resp, err := s.adapterRequest(ctx, http.MethodPost, path)
+	if err != nil {
+		return err
+	}
+
+	return resp.Body.Close()
+}
+
+// UnloadAdapter unloads the LoRA adapter at path. It returns os.ErrNotExist
+// if the adapter isn't loaded and ErrAdapterInUse if a request is using it.
+func (s *llmServer) UnloadAdapter(ctx context.Context, path string) error {
+	resp, err := s.adapterRequest(ctx, http.MethodDelete, path)
+	if err != nil {
+		return err
+	}
+
+	return resp.Body.Close()
+}
+
+func (s *llmServer) adapterRequest(ctx context.Context, method, path string) (*http.Response, error) {
+	var body io.Reader
+	if path != "" {
+		data, err := json.Marshal(map[string]string{"path": path})
+		if err != nil {
+			return nil, err
+		}
+
+		body = bytes.NewBuffer(data)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, fmt.Sprintf("http://127.0.0.1:%d/adapters", s.port), body)
+	if err != nil {
+		return nil, fmt.Errorf("error creating adapters request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("do adapters request: %w", err)
+	}
+
+	if resp.StatusCode >= 400 {
+		defer resp.Body.Close()
+		msg, _ := io.ReadAll(resp.Body)
+		switch resp.StatusCode {
+		case http.StatusNotFound:
+			return nil, fmt.Errorf("%w: %s", os.ErrNotExist, path)
+		case http.StatusConflict:
+			return nil, fmt.Errorf("%w: %s", ErrAdapterInUse, path)
+		default:
+			return nil, fmt.Errorf("adapters request failed: %s", bytes.TrimSpace(msg))
+		}
+	}
+
+	return resp, nil
+}
@@ -37,6 +37,71 @@ func (kv KV) u64(key string) uint64 {
 	}
 }
 
+// Strings returns the elements of the string array at key
+func (kv KV) Strings(key string) []string {
+	a, ok := kv[key].(*array)
+	if !ok {
+		return nil
+	}
+
+	s := make([]string, 0, len(a.values))
+	for _, v := range a.values {
+		if v, ok := v.(string); ok {
+			s = append(s, v)
+		}
+	}
+
+	return s
+}
+
+// Floats returns the elements of the number array at key as float32s
+func (kv KV) Floats(key string) []float32 {
+	a, ok := kv[key].(*array)
+	if !ok {
+		return nil
+	}
+
+	f := make([]float32, 0, len(a.values))
+	for _, v := range a.values {
+		switch v := v.(type) {
+		case float32:
+			f = append(f, v)
+		case float64:
+			f = append(f, float32(v))
+		case int32:
+			f = append(f, float32(v))
+		case uint32:
+			f = append(f, float32(v))
+		}
+	}
+
+	return f
+}
+
+// Ints returns the elements of the integer array at key as int32s
+func (kv KV) Ints(key string) []int32 {
+	a, ok := kv[key].(*array)
+	if !ok {
+		return nil
+	}
+
+	n := make([]int32, 0, len(a.values))
+	for _, v := range a.values {
+		switch v := v.(type) {
+		case int32:
+			n = append(n, v)
+		case uint32:
+			n = append(n, int32(v))
+		case int64:
+			n = append(n, int32(v))
+		case float64:
+			n = append(n, int32(v))
+		}
+	}
+
+	return n
+}
+
 func (kv KV) Architecture() string {
 	if s, ok := kv["general.architecture"].(string); ok {
 		return s
@@ -165,6 +230,17 @@ func (l Layer) size() (size uint64) {
 	return size
 }
 
+// ffnSize is the size of the layer's feed-forward weights
+func (l Layer) ffnSize() (size uint64) {
+	for name, t := range l {
+		if strings.HasPrefix(name, "ffn_") {
+			size += t.Size()
+		}
+	}
+
+	return size
+}
+
 type Tensor struct {
 	Name   string `json:"name"`
 	Kind   uint32 `json:"kind"`
@@ -318,6 +394,18 @@ func DetectGGMLType(b []byte) string {
 // maxArraySize. If maxArraySize is 0, the default value of 1024 is used. If
 // the maxArraySize is negative, all arrays are collected.
 func DecodeGGML(rs io.ReadSeeker, maxArraySize int) (*GGML, int64, error) {
+	return decodeGGML(rs, maxArraySize, false)
+}
+
+// DecodeGGMLStrict decodes a GGML model like DecodeGGML, but rejects GGUF
+// files with counts, lengths or shapes beyond sane limits, and tensors that
+// are misaligned, overlap or extend past the end of the file, with an error
+// wrapping ErrInvalidGGUF.
+func DecodeGGMLStrict(rs io.ReadSeeker, maxArraySize int) (*GGML, int64, error) {
+	return decodeGGML(rs, maxArraySize, true)
+}
+
+func decodeGGML(rs io.ReadSeeker, maxArraySize int, strict bool) (*GGML, int64, error) {
 	if maxArraySize == 0 {
 		maxArraySize = 1024
 	}
@@ -336,9 +424,9 @@ func DecodeGGML(rs io.ReadSeeker, maxArraySize int) (*GGML, int64, error) {
 	case FILE_MAGIC_GGLA:
 		c = &containerGGLA{}
 	case FILE_MAGIC_GGUF_LE:
-		c = &containerGGUF{ByteOrder: binary.LittleEndian, maxArraySize: maxArraySize}
+		c = &containerGGUF{ByteOrder: binary.LittleEndian, maxArraySize: maxArraySize, strict: strict}
 	case FILE_MAGIC_GGUF_BE:
-		c = &containerGGUF{ByteOrder: binary.BigEndian, maxArraySize: maxArraySize}
+		c = &containerGGUF{ByteOrder: binary.BigEndian, maxArraySize: maxArraySize, strict: strict}
 	default:
 		return nil, 0, errors.New("invalid file magic")
 	}
@@ -360,7 +448,7 @@ func DecodeGGML(rs io.ReadSeeker, maxArraySize int) (*GGML, int64, error) {
 	}, offset, nil
 }
 
-func (llm GGML) GraphSize(context, batch uint64, kvCacheType string) (kv, partialOffload, fullOffload uint64) {
+func (llm GGML) GraphSize(context, batch uint64, cacheTypeK, cacheTypeV string) (kv, partialOffload, fullOffload uint64) {
 	embedding := llm.KV().EmbeddingLength()
 	heads := llm.KV().HeadCount()
 	headsKV := llm.KV().HeadCountKV()
@@ -372,8 +460,8 @@ func (llm GGML) GraphSize(context, batch uint64, kvCacheType string) (kv, partia
 
 	layers := llm.Tensors().Layers()
 
-	bytesPerElement := kvCacheBytesPerElement(kvCacheType)
-	kv = uint64(float64(context*llm.KV().BlockCount()*(embeddingHeadsK+embeddingHeadsV)*headsKV) * bytesPerElement)
+	kv = uint64(float64(context*llm.KV().BlockCount()*headsKV) *
+		(float64(embeddingHeadsK)*kvCacheBytesPerElement(cacheTypeK) + float64(embeddingHeadsV)*kvCacheBytesPerElement(cacheTypeV)))
 
 	switch llm.KV().Architecture() {
 	case "llama":
@@ -529,10 +617,12 @@ func (llm GGML) GraphSize(context, batch uint64, kvCacheType string) (kv, partia
 	return
 }
 
+// KVCacheTypes are the quantization types the K and V caches can have
+var KVCacheTypes = []string{"f16", "q8_0", "q4_0"}
+
 // SupportsKVCacheType checks if the requested cache type is supported
 func (ggml GGML) SupportsKVCacheType(cacheType string) bool {
-	validKVCacheTypes := []string{"f16", "q8_0", "q4_0"}
-	return slices.Contains(validKVCacheTypes, cacheType)
+	return slices.Contains(KVCacheTypes, cacheType)
 }
 
 // SupportsFlashAttention checks if the model supports flash attention
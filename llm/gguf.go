@@ -5,9 +5,12 @@ import (
 	"cmp"
 	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
+	"math"
+	"math/bits"
 	"slices"
 	"strings"
 
@@ -35,6 +38,27 @@ type containerGGUF struct {
 	}
 
 	maxArraySize int
+
+	// strict enforces the limits below, and checks tensor data ranges
+	strict bool
+}
+
+// Limits enforced by strict decoding, well beyond what real models use, so
+// malformed files fail cleanly instead of exhausting memory or pointing
+// tensors outside of the file
+const (
+	ggufMaxKVs          = 1 << 16
+	ggufMaxTensors      = 1 << 16
+	ggufMaxStringLength = 1 << 26
+	ggufMaxArrayLength  = 1 << 26
+	ggufMaxTensorDims   = 4  // GGML_MAX_DIMS
+	ggufMaxTensorName   = 63 // GGML_MAX_NAME, less the terminator
+)
+
+var ErrInvalidGGUF = errors.New("invalid gguf")
+
+func invalidGGUF(format string, args ...any) error {
+	return fmt.Errorf("%w: %s", ErrInvalidGGUF, fmt.Sprintf(format, args...))
 }
 
 func (c *containerGGUF) canCollectArray(size int) bool {
@@ -63,6 +87,16 @@ func (c *containerGGUF) Decode(rs io.ReadSeeker) (model, error) {
 		return nil, err
 	}
 
+	if c.strict {
+		model := newGGUF(c)
+		if n := model.numKV(); n > ggufMaxKVs {
+			return nil, invalidGGUF("%d key-values exceeds the limit of %d", n, ggufMaxKVs)
+		}
+		if n := model.numTensor(); n > ggufMaxTensors {
+			return nil, invalidGGUF("%d tensors exceeds the limit of %d", n, ggufMaxTensors)
+		}
+	}
+
 	model := newGGUF(c)
 	if err := model.Decode(rs); err != nil {
 		return nil, err
@@ -147,6 +181,12 @@ func (llm *gguf) Decode(rs io.ReadSeeker) error {
 			return err
 		}
 
+		if llm.strict {
+			if _, ok := llm.kv[k]; ok {
+				return invalidGGUF("duplicate key %q", k)
+			}
+		}
+
 		t, err := readGGUF[uint32](llm, rs)
 		if err != nil {
 			return err
@@ -204,6 +244,10 @@ func (llm *gguf) Decode(rs io.ReadSeeker) error {
 			return fmt.Errorf("failed to read tensor dimensions: %w", err)
 		}
 
+		if llm.strict && dims > ggufMaxTensorDims {
+			return invalidGGUF("tensor %q has %d dimensions, more than %d", name, dims, ggufMaxTensorDims)
+		}
+
 		shape := make([]uint64, dims)
 		for i := 0; uint32(i) < dims; i++ {
 			shape[i], err = readGGUF[uint64](llm, rs)
@@ -229,6 +273,12 @@ func (llm *gguf) Decode(rs io.ReadSeeker) error {
 			Shape:  shape[:],
 		}
 
+		if llm.strict {
+			if err := llm.checkTensor(&tensor); err != nil {
+				return err
+			}
+		}
+
 		llm.tensors = append(llm.tensors, &tensor)
 		llm.parameters += tensor.parameters()
 	}
@@ -246,9 +296,19 @@ func (llm *gguf) Decode(rs io.ReadSeeker) error {
 		return err
 	}
 
+	if llm.strict && (alignment == 0 || alignment&(alignment-1) != 0) {
+		return invalidGGUF("alignment %d isn't a power of two", alignment)
+	}
+
 	padding := ggufPadding(offset, int64(alignment))
 	llm.tensorOffset = uint64(offset + padding)
 
+	if llm.strict {
+		if err := llm.checkTensorData(rs, offset, uint64(alignment)); err != nil {
+			return err
+		}
+	}
+
 	for _, tensor := range llm.tensors {
 		offset, err := rs.Seek(0, io.SeekCurrent)
 		if err != nil {
@@ -268,6 +328,80 @@ func (llm *gguf) Decode(rs io.ReadSeeker) error {
 	return nil
 }
 
+// checkTensor checks the name, kind and shape of a tensor read strictly
+func (llm *gguf) checkTensor(t *Tensor) error {
+	if len(t.Name) > ggufMaxTensorName {
+		return invalidGGUF("tensor name %q is longer than %d bytes", t.Name, ggufMaxTensorName)
+	}
+
+	if slices.ContainsFunc(llm.tensors, func(o *Tensor) bool { return o.Name == t.Name }) {
+		return invalidGGUF("duplicate tensor %q", t.Name)
+	}
+
+	if t.typeSize() == 0 {
+		return invalidGGUF("tensor %q has unknown type %d", t.Name, t.Kind)
+	}
+
+	if len(t.Shape) > 0 && t.Shape[0]%t.blockSize() != 0 {
+		return invalidGGUF("tensor %q has %d columns, not a multiple of its block size %d", t.Name, t.Shape[0], t.blockSize())
+	}
+
+	// the size in bytes must fit in an int64 for the tensor to be addressable
+	n := t.typeSize()
+	for _, dim := range t.Shape {
+		hi, lo := bits.Mul64(n, dim)
+		if hi != 0 || lo > math.MaxInt64 {
+			return invalidGGUF("tensor %q with shape %v is too large", t.Name, t.Shape)
+		}
+		n = lo
+	}
+
+	return nil
+}
+
+// checkTensorData checks that every tensor is aligned, within the file and
+// doesn't overlap another. offset is the position after the tensor infos,
+// which is restored before returning.
+func (llm *gguf) checkTensorData(rs io.ReadSeeker, offset int64, alignment uint64) error {
+	end, err := rs.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+
+	if _, err := rs.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+
+	var size uint64
+	if uint64(end) > llm.tensorOffset {
+		size = uint64(end) - llm.tensorOffset
+	}
+
+	tensors := slices.Clone(llm.tensors)
+	slices.SortFunc(tensors, func(a, b *Tensor) int {
+		return cmp.Compare(a.Offset, b.Offset)
+	})
+
+	var prev *Tensor
+	for _, t := range tensors {
+		if t.Offset%alignment != 0 {
+			return invalidGGUF("tensor %q at offset %d isn't aligned to %d bytes", t.Name, t.Offset, alignment)
+		}
+
+		if t.Offset > size || t.Size() > size-t.Offset {
+			return invalidGGUF("tensor %q at offset %d with size %d extends past the end of the file", t.Name, t.Offset, t.Size())
+		}
+
+		if prev != nil && prev.Offset+prev.Size() > t.Offset {
+			return invalidGGUF("tensor %q overlaps tensor %q", t.Name, prev.Name)
+		}
+
+		prev = t
+	}
+
+	return nil
+}
+
 func readGGUF[T any](llm *gguf, r io.Reader) (T, error) {
 	var t T
 	err := binary.Read(r, llm.ByteOrder, &t)
@@ -288,6 +422,10 @@ func readGGUFV1String(llm *gguf, r io.Reader) (string, error) {
 		return "", err
 	}
 
+	if llm.strict && (length == 0 || length > ggufMaxStringLength) {
+		return "", invalidGGUF("string length %d is out of range", length)
+	}
+
 	var b bytes.Buffer
 	if _, err := io.CopyN(&b, r, int64(length)); err != nil {
 		return "", err
@@ -307,6 +445,10 @@ func discardGGUFString(llm *gguf, r io.Reader) error {
 	}
 
 	size := int(llm.ByteOrder.Uint64(buf))
+	if llm.strict && (size < 0 || size > ggufMaxStringLength) {
+		return invalidGGUF("string length %d exceeds the limit of %d", uint64(size), ggufMaxStringLength)
+	}
+
 	for size > 0 {
 		n, err := r.Read(llm.scratch[:min(size, cap(llm.scratch))])
 		if err != nil {
@@ -329,6 +471,10 @@ func readGGUFString(llm *gguf, r io.Reader) (string, error) {
 	}
 
 	length := int(llm.ByteOrder.Uint64(buf))
+	if llm.strict && (length < 0 || length > ggufMaxStringLength) {
+		return "", invalidGGUF("string length %d exceeds the limit of %d", uint64(length), ggufMaxStringLength)
+	}
+
 	if length > len(llm.scratch) {
 		buf = make([]byte, length)
 	} else {
@@ -359,6 +505,9 @@ func writeGGUFString(w io.Writer, s string) error {
 type array struct {
 	size   int
 	values []any
+
+	// t is the gguf type of the values
+	t uint32
 }
 
 func (a *array) MarshalJSON() ([]byte, error) {
@@ -376,7 +525,11 @@ func readGGUFV1Array(llm *gguf, r io.Reader) (*array, error) {
 		return nil, err
 	}
 
-	a := &array{size: int(n)}
+	if llm.strict && n > ggufMaxArrayLength {
+		return nil, invalidGGUF("array length %d exceeds the limit of %d", n, ggufMaxArrayLength)
+	}
+
+	a := &array{size: int(n), t: t}
 	if llm.canCollectArray(int(n)) {
 		a.values = make([]any, 0, int(n))
 	}
@@ -438,7 +591,11 @@ func readGGUFArray(llm *gguf, r io.Reader) (*array, error) {
 		return nil, err
 	}
 
-	a := &array{size: int(n)}
+	if llm.strict && n > ggufMaxArrayLength {
+		return nil, invalidGGUF("array length %d exceeds the limit of %d", n, ggufMaxArrayLength)
+	}
+
+	a := &array{size: int(n), t: t}
 	if llm.canCollectArray(int(n)) {
 		a.values = make([]any, int(n))
 	}
@@ -542,6 +699,8 @@ func WriteGGUF(ws io.WriteSeeker, kv KV, ts []Tensor) error {
 		}
 	})
 
+	var alignment int64 = 32
+
 	var s uint64
 	for _, t := range ts {
 		t.Offset = s
@@ -549,9 +708,9 @@ func WriteGGUF(ws io.WriteSeeker, kv KV, ts []Tensor) error {
 			return err
 		}
 		s += t.Size()
+		s += uint64(ggufPadding(int64(s), alignment))
 	}
 
-	var alignment int64 = 32
 	for _, t := range ts {
 		if err := ggufWriteTensor(ws, t, alignment); err != nil {
 			return err
@@ -573,10 +732,26 @@ func ggufWriteKV(ws io.WriteSeeker, k string, v any) error {
 
 	var err error
 	switch v := v.(type) {
+	case uint8:
+		err = writeGGUF(ws, ggufTypeUint8, v)
+	case int8:
+		err = writeGGUF(ws, ggufTypeInt8, v)
+	case uint16:
+		err = writeGGUF(ws, ggufTypeUint16, v)
+	case int16:
+		err = writeGGUF(ws, ggufTypeInt16, v)
 	case uint32:
 		err = writeGGUF(ws, ggufTypeUint32, v)
+	case int32:
+		err = writeGGUF(ws, ggufTypeInt32, v)
+	case uint64:
+		err = writeGGUF(ws, ggufTypeUint64, v)
+	case int64:
+		err = writeGGUF(ws, ggufTypeInt64, v)
 	case float32:
 		err = writeGGUF(ws, ggufTypeFloat32, v)
+	case float64:
+		err = writeGGUF(ws, ggufTypeFloat64, v)
 	case bool:
 		err = writeGGUF(ws, ggufTypeBool, v)
 	case string:
@@ -609,6 +784,8 @@ func ggufWriteKV(ws io.WriteSeeker, k string, v any) error {
 				return err
 			}
 		}
+	case *array:
+		err = writeGGUFDecodedArray(ws, k, v)
 	default:
 		return fmt.Errorf("improper type for '%s'", k)
 	}
@@ -616,6 +793,42 @@ func ggufWriteKV(ws io.WriteSeeker, k string, v any) error {
 	return err
 }
 
+// writeGGUFDecodedArray writes an array read by DecodeGGML back out, which
+// requires its values to have been collected
+func writeGGUFDecodedArray(w io.Writer, k string, a *array) error {
+	if a.values == nil && a.size > 0 {
+		return fmt.Errorf("values for '%s' weren't read", k)
+	}
+
+	if err := binary.Write(w, binary.LittleEndian, ggufTypeArray); err != nil {
+		return err
+	}
+
+	if err := binary.Write(w, binary.LittleEndian, a.t); err != nil {
+		return err
+	}
+
+	if err := binary.Write(w, binary.LittleEndian, uint64(len(a.values))); err != nil {
+		return err
+	}
+
+	for _, e := range a.values {
+		if s, ok := e.(string); ok {
+			if err := binary.Write(w, binary.LittleEndian, uint64(len(s))); err != nil {
+				return err
+			}
+
+			if _, err := io.WriteString(w, s); err != nil {
+				return err
+			}
+		} else if err := binary.Write(w, binary.LittleEndian, e); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
 func ggufWriteTensorInfo(ws io.WriteSeeker, t Tensor) error {
 	slog.Debug(t.Name, "kind", t.Kind, "shape", t.Shape, "offset", t.Offset)
 	if err := binary.Write(ws, binary.LittleEndian, uint64(len(t.Name))); err != nil {
@@ -0,0 +1,136 @@
+package llm
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"math"
+	"os"
+	"strings"
+	"testing"
+)
+
+type ggufTensorInfo struct {
+	name   string
+	shape  []uint64
+	kind   uint32
+	offset uint64
+}
+
+// rawGGUF writes a GGUF file without any of the checks WriteGGUF makes, so
+// malformed files can be built. kvs are written as uint32 values.
+func rawGGUF(keys []string, tensors []ggufTensorInfo, data int) []byte {
+	var b bytes.Buffer
+	write := func(v any) {
+		if err := binary.Write(&b, binary.LittleEndian, v); err != nil {
+			panic(err)
+		}
+	}
+
+	write([]byte("GGUF"))
+	write(uint32(3))
+	write(uint64(len(tensors)))
+	write(uint64(len(keys)))
+
+	for _, k := range keys {
+		write(uint64(len(k)))
+		write([]byte(k))
+		write(ggufTypeUint32)
+		write(uint32(1))
+	}
+
+	for _, t := range tensors {
+		write(uint64(len(t.name)))
+		write([]byte(t.name))
+		write(uint32(len(t.shape)))
+		write(t.shape)
+		write(t.kind)
+		write(t.offset)
+	}
+
+	write(bytes.Repeat([]byte{0}, int(ggufPadding(int64(b.Len()), 32))+data))
+	return b.Bytes()
+}
+
+func TestDecodeGGMLStrict(t *testing.T) {
+	valid := []ggufTensorInfo{
+		{"a", []uint64{8}, 0, 0},
+		{"b", []uint64{32, 2}, 8, 32},
+	}
+
+	cases := []struct {
+		name  string
+		input []byte
+		valid bool
+	}{
+		{"valid", rawGGUF([]string{"x", "y"}, valid, 32+68), true},
+		{"too many key-values", func() []byte {
+			b := rawGGUF(nil, nil, 0)
+			binary.LittleEndian.PutUint64(b[16:], ggufMaxKVs+1)
+			return b
+		}(), false},
+		{"too many tensors", func() []byte {
+			b := rawGGUF(nil, nil, 0)
+			binary.LittleEndian.PutUint64(b[8:], math.MaxUint64)
+			return b
+		}(), false},
+		{"string too long", func() []byte {
+			b := rawGGUF([]string{"x"}, nil, 0)
+			binary.LittleEndian.PutUint64(b[24:], math.MaxUint64)
+			return b
+		}(), false},
+		{"duplicate key", rawGGUF([]string{"x", "x"}, nil, 0), false},
+		{"too many dimensions", rawGGUF(nil, []ggufTensorInfo{{"a", []uint64{1, 1, 1, 1, 1}, 0, 0}}, 4), false},
+		{"name too long", rawGGUF(nil, []ggufTensorInfo{{strings.Repeat("a", 64), []uint64{1}, 0, 0}}, 4), false},
+		{"duplicate tensor", rawGGUF(nil, []ggufTensorInfo{{"a", []uint64{1}, 0, 0}, {"a", []uint64{1}, 0, 32}}, 36), false},
+		{"unknown type", rawGGUF(nil, []ggufTensorInfo{{"a", []uint64{1}, 4, 0}}, 4), false},
+		{"partial block", rawGGUF(nil, []ggufTensorInfo{{"a", []uint64{16}, 8, 0}}, 34), false},
+		{"too large", rawGGUF(nil, []ggufTensorInfo{{"a", []uint64{1 << 32, 1 << 32}, 0, 0}}, 4), false},
+		{"misaligned", rawGGUF(nil, []ggufTensorInfo{{"a", []uint64{1}, 0, 4}}, 8), false},
+		{"past the end", rawGGUF(nil, []ggufTensorInfo{{"a", []uint64{2}, 0, 0}}, 4), false},
+		{"overlapping", rawGGUF(nil, []ggufTensorInfo{{"a", []uint64{16}, 0, 0}, {"b", []uint64{1}, 0, 32}}, 68), false},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, err := DecodeGGMLStrict(bytes.NewReader(tt.input), 0)
+			if tt.valid && err != nil {
+				t.Fatalf("expected no error, got %v", err)
+			} else if !tt.valid && !errors.Is(err, ErrInvalidGGUF) {
+				t.Fatalf("expected %v, got %v", ErrInvalidGGUF, err)
+			}
+		})
+	}
+}
+
+func FuzzDecodeGGMLStrict(f *testing.F) {
+	f.Add(rawGGUF([]string{"x"}, []ggufTensorInfo{{"a", []uint64{8}, 0, 0}, {"b", []uint64{32, 2}, 8, 32}}, 100))
+
+	var b bytes.Buffer
+	temp, err := os.CreateTemp(f.TempDir(), "")
+	if err != nil {
+		f.Fatal(err)
+	}
+	defer temp.Close()
+
+	if err := WriteGGUF(temp, KV{"general.architecture": "llama", "tokenizer.ggml.tokens": []string{"a", ""}}, []Tensor{
+		{Name: "token_embd.weight", Shape: []uint64{2, 4}, WriterTo: bytes.NewReader(make([]byte, 32))},
+	}); err != nil {
+		f.Fatal(err)
+	}
+
+	if _, err := temp.Seek(0, 0); err != nil {
+		f.Fatal(err)
+	}
+
+	if _, err := b.ReadFrom(temp); err != nil {
+		f.Fatal(err)
+	}
+	f.Add(b.Bytes())
+
+	f.Fuzz(func(t *testing.T, input []byte) {
+		// malformed files must fail with an error rather than panicking or
+		// allocating without bound
+		DecodeGGMLStrict(bytes.NewReader(input), 0) //nolint:errcheck
+	})
+}
@@ -1,7 +1,19 @@
 package llm
 
 import (
+	"os"
 	"syscall"
 )
 
 var LlamaServerSysProcAttr = &syscall.SysProcAttr{}
+
+// sandboxSysProcAttr only drops privileges on linux
+func sandboxSysProcAttr(string) *syscall.SysProcAttr {
+	return LlamaServerSysProcAttr
+}
+
+// runnerSessionDir creates the directory runners save the KV caches of
+// sessions to
+func runnerSessionDir(dir string, _ *syscall.SysProcAttr) (string, error) {
+	return dir, os.MkdirAll(dir, 0o700)
+}
@@ -1,7 +1,111 @@
 package llm
 
 import (
+	"log/slog"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
 	"syscall"
+
+	"github.com/ollama/ollama/envconfig"
 )
 
 var LlamaServerSysProcAttr = &syscall.SysProcAttr{}
+
+// sandboxSysProcAttr drops the privileges of a runner when the server runs as
+// root, running it as the owner of the model with their groups instead, which
+// also keeps access to GPUs granted through groups such as render and video.
+// Models owned by root are run as OLLAMA_SANDBOX_USER, or nobody.
+func sandboxSysProcAttr(model string) *syscall.SysProcAttr {
+	attr := *LlamaServerSysProcAttr
+	if os.Geteuid() != 0 {
+		return &attr
+	}
+
+	var st *syscall.Stat_t
+	if fi, err := os.Stat(model); err != nil {
+		slog.Warn("unable to determine model owner", "error", err)
+	} else {
+		st, _ = fi.Sys().(*syscall.Stat_t)
+	}
+
+	if st != nil && st.Uid != 0 {
+		if u, err := user.LookupId(strconv.FormatUint(uint64(st.Uid), 10)); err == nil {
+			attr.Credential = credential(u)
+		} else {
+			attr.Credential = &syscall.Credential{Uid: st.Uid, Gid: st.Gid}
+		}
+		return &attr
+	}
+
+	name := envconfig.SandboxUser()
+	if name == "" {
+		name = "nobody"
+	}
+
+	u, err := user.Lookup(name)
+	if err != nil {
+		u, err = user.LookupId(name)
+	}
+
+	if err != nil {
+		// 65534 is nobody on most distributions
+		slog.Warn("unable to find sandbox user, runner will run as 65534", "user", name, "error", err)
+		attr.Credential = &syscall.Credential{Uid: 65534, Gid: 65534}
+		return &attr
+	}
+
+	cred := credential(u)
+	if cred.Uid == 0 {
+		slog.Warn("sandbox user is root, runner will run as 65534", "user", name)
+		cred = &syscall.Credential{Uid: 65534, Gid: 65534}
+	}
+
+	slog.Info("model isn't owned by a user, running runner as sandbox user", "model", model, "user", u.Username)
+	attr.Credential = cred
+	return &attr
+}
+
+// runnerSessionDir creates the directory a runner started with attr saves
+// the KV caches of sessions to. Runners that run as another user get a
+// directory of their own in dir, owned by that user, so dir stays private to
+// the server.
+func runnerSessionDir(dir string, attr *syscall.SysProcAttr) (string, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return "", err
+	}
+
+	cred := attr.Credential
+	if cred == nil || int(cred.Uid) == os.Geteuid() {
+		return dir, nil
+	}
+
+	dir = filepath.Join(dir, strconv.FormatUint(uint64(cred.Uid), 10))
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return "", err
+	}
+
+	if err := os.Chown(dir, int(cred.Uid), int(cred.Gid)); err != nil {
+		return "", err
+	}
+
+	return dir, os.Chmod(dir, 0o700)
+}
+
+// credential returns the uid, gid and supplementary groups of u
+func credential(u *user.User) *syscall.Credential {
+	uid, _ := strconv.ParseUint(u.Uid, 10, 32)
+	gid, _ := strconv.ParseUint(u.Gid, 10, 32)
+
+	cred := &syscall.Credential{Uid: uint32(uid), Gid: uint32(gid)}
+	if ids, err := u.GroupIds(); err == nil {
+		for _, id := range ids {
+			if gid, err := strconv.ParseUint(id, 10, 32); err == nil {
+				cred.Groups = append(cred.Groups, uint32(gid))
+			}
+		}
+	}
+
+	return cred
+}
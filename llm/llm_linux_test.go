@@ -0,0 +1,48 @@
+package llm
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestRunnerSessionDir(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "sessions")
+
+	got, err := runnerSessionDir(dir, &syscall.SysProcAttr{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got != dir {
+		t.Errorf("expected %s, got %s", dir, got)
+	}
+
+	if os.Geteuid() != 0 {
+		t.Skip("dropping privileges requires root")
+	}
+
+	// sandboxed runners get a directory of their own
+	got, err = runnerSessionDir(dir, &syscall.SysProcAttr{Credential: &syscall.Credential{Uid: 65534, Gid: 65534}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got != filepath.Join(dir, "65534") {
+		t.Errorf("expected %s, got %s", filepath.Join(dir, "65534"), got)
+	}
+
+	fi, err := os.Stat(got)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if st := fi.Sys().(*syscall.Stat_t); st.Uid != 65534 || fi.Mode().Perm() != 0o700 {
+		t.Errorf("expected a private directory owned by 65534, got %d with mode %04o", st.Uid, fi.Mode().Perm())
+	}
+
+	if fi, err := os.Stat(dir); err != nil || fi.Sys().(*syscall.Stat_t).Uid != 0 {
+		t.Errorf("expected the sessions directory to stay owned by root, got %v", err)
+	}
+}
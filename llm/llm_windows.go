@@ -1,6 +1,7 @@
 package llm
 
 import (
+	"os"
 	"syscall"
 )
 
@@ -20,3 +21,14 @@ var LlamaServerSysProcAttr = &syscall.SysProcAttr{
 	// with "programs" given best priority, we aren't starved of cpu cycles
 	CreationFlags: CREATE_DEFAULT_ERROR_MODE | ABOVE_NORMAL_PRIORITY_CLASS,
 }
+
+// sandboxSysProcAttr only drops privileges on linux
+func sandboxSysProcAttr(string) *syscall.SysProcAttr {
+	return LlamaServerSysProcAttr
+}
+
+// runnerSessionDir creates the directory runners save the KV caches of
+// sessions to
+func runnerSessionDir(dir string, _ *syscall.SysProcAttr) (string, error) {
+	return dir, os.MkdirAll(dir, 0o700)
+}
@@ -1,6 +1,7 @@
 package llm
 
 import (
+	"cmp"
 	"fmt"
 	"log/slog"
 	"os"
@@ -22,7 +23,8 @@ func PredictServerFit(allGpus discover.GpuInfoList, ggml *GGML, adapters, projec
 		estimate := EstimateGPULayers(gpus, ggml, projectors, opts)
 		layerCount, estimatedVRAM = estimate.Layers, estimate.VRAMSize
 		if opts.NumGPU < 0 {
-			if layerCount > 0 && layerCount >= int(ggml.KV().BlockCount()+1) {
+			// a model with feed-forward weights left on the CPU doesn't fit
+			if layerCount > 0 && layerCount >= int(ggml.KV().BlockCount()+1) && estimate.CPUFFNLayers == 0 {
 				return true, estimatedVRAM
 			}
 		} else {
@@ -38,6 +40,10 @@ type MemoryEstimate struct {
 	// How many layers we predict we can load
 	Layers int
 
+	// How many of the layers, from the first, keep their feed-forward
+	// weights on the CPU when layers are split by tensor type
+	CPUFFNLayers int
+
 	// The size of the graph which occupies the main GPU
 	Graph uint64
 
@@ -58,6 +64,7 @@ type MemoryEstimate struct {
 	layersRequested     int
 	layersModel         int
 	availableList       []string
+	overheadList        []string
 	kv                  uint64
 	allocationsList     []string
 	memoryWeights       uint64
@@ -68,6 +75,29 @@ type MemoryEstimate struct {
 	projectorWeights, projectorGraph uint64
 }
 
+// kvCacheTypes returns the quantization types of the K and V caches, set
+// with the cache_type_k and cache_type_v options or OLLAMA_KV_CACHE_TYPE.
+// The caches can only be quantized with flash attention, so without it they
+// are f16, the default of "".
+func kvCacheTypes(ggml *GGML, opts api.Options, flashAttention bool) (k, v string) {
+	if !flashAttention {
+		return "", ""
+	}
+
+	requested := envconfig.KvCacheType()
+	k = strings.ToLower(cmp.Or(opts.CacheTypeK, requested))
+	if !ggml.SupportsKVCacheType(k) {
+		k = ""
+	}
+
+	v = strings.ToLower(cmp.Or(opts.CacheTypeV, requested))
+	if !ggml.SupportsKVCacheType(v) {
+		v = ""
+	}
+
+	return k, v
+}
+
 // Given a model and one or more GPU targets, predict how many layers and bytes we can load, and the total size
 // The GPUs provided must all be the same Library
 func EstimateGPULayers(gpus []discover.GpuInfo, ggml *GGML, projectors []string, opts api.Options) MemoryEstimate {
@@ -99,9 +129,13 @@ func EstimateGPULayers(gpus []discover.GpuInfo, ggml *GGML, projectors []string,
 	// Overflow that didn't fit into the GPU
 	var overflow uint64
 
-	overhead := envconfig.GpuOverhead()
+	// VRAM set aside on each GPU
+	overheads := make([]uint64, len(gpus))
+	overheadList := make([]string, len(gpus))
 	availableList := make([]string, len(gpus))
 	for i, gpu := range gpus {
+		overheads[i] = envconfig.GpuOverhead(gpu.ID)
+		overheadList[i] = format.HumanBytes2(overheads[i])
 		availableList[i] = format.HumanBytes2(gpu.FreeMemory)
 	}
 	slog.Debug("evaluating", "library", gpus[0].Library, "gpu_count", len(gpus), "available", availableList)
@@ -127,15 +161,11 @@ func EstimateGPULayers(gpus []discover.GpuInfo, ggml *GGML, projectors []string,
 		discover.GetGPUInfo().FlashAttentionSupported() &&
 		ggml.SupportsFlashAttention()
 
-	var kvct string
-	if fa {
-		requested := strings.ToLower(envconfig.KvCacheType())
-		if requested != "" && ggml.SupportsKVCacheType(requested) {
-			kvct = requested
-		}
-	}
-
-	kv, graphPartialOffload, graphFullOffload := ggml.GraphSize(uint64(opts.NumCtx), uint64(min(opts.NumCtx, opts.NumBatch)), kvct)
+	cacheTypeK, cacheTypeV := kvCacheTypes(ggml, opts, fa)
+	// the KV cache has room for prefixes shared between prompts beyond the
+	// context of the sequences
+	numCtx := uint64(opts.NumCtx) + uint64(envconfig.PrefixCache())
+	kv, graphPartialOffload, graphFullOffload := ggml.GraphSize(numCtx, uint64(min(opts.NumCtx, opts.NumBatch)), cacheTypeK, cacheTypeV)
 
 	// KV is proportional to the number of layers
 	layerSize += kv / ggml.KV().BlockCount()
@@ -182,7 +212,7 @@ func EstimateGPULayers(gpus []discover.GpuInfo, ggml *GGML, projectors []string,
 			gzo = gpuZeroOverhead
 		}
 		// Only include GPUs that can fit the graph, gpu minimum, the layer buffer and at least more layer
-		if gpus[i].FreeMemory < overhead+gzo+max(graphPartialOffload, graphFullOffload)+gpus[i].MinimumMemory+2*layerSize {
+		if gpus[i].FreeMemory < overheads[i]+gzo+max(graphPartialOffload, graphFullOffload)+gpus[i].MinimumMemory+2*layerSize {
 			slog.Debug("gpu has too little memory to allocate any layers",
 				"id", gpus[i].ID,
 				"library", gpus[i].Library,
@@ -192,6 +222,7 @@ func EstimateGPULayers(gpus []discover.GpuInfo, ggml *GGML, projectors []string,
 				"name", gpus[i].Name,
 				"total", format.HumanBytes2(gpus[i].TotalMemory),
 				"available", format.HumanBytes2(gpus[i].FreeMemory),
+				"overhead", format.HumanBytes2(overheads[i]),
 				"minimum_memory", gpus[i].MinimumMemory,
 				"layer_size", format.HumanBytes2(layerSize),
 				"gpu_zer_overhead", format.HumanBytes2(gzo),
@@ -228,7 +259,7 @@ func EstimateGPULayers(gpus []discover.GpuInfo, ggml *GGML, projectors []string,
 		for j := len(gpusWithSpace); j > 0; j-- {
 			g := gpusWithSpace[i%j]
 			used := gpuAllocations[g.i] + max(graphPartialOffload, graphFullOffload)
-			if g.g.FreeMemory > overhead+used+layerSize {
+			if g.g.FreeMemory > overheads[g.i]+used+layerSize {
 				gpuAllocations[g.i] += layerSize
 				layerCounts[g.i]++
 				layerCount++
@@ -251,7 +282,7 @@ func EstimateGPULayers(gpus []discover.GpuInfo, ggml *GGML, projectors []string,
 		for j := len(gpusWithSpace); j > 0; j-- {
 			g := gpusWithSpace[layerCount%j]
 			used := gpuAllocations[g.i] + max(graphPartialOffload, graphFullOffload)
-			if g.g.FreeMemory > overhead+used+memoryLayerOutput {
+			if g.g.FreeMemory > overheads[g.i]+used+memoryLayerOutput {
 				gpuAllocations[g.i] += memoryLayerOutput
 				layerCounts[g.i]++
 				layerCount++
@@ -282,6 +313,22 @@ func EstimateGPULayers(gpus []discover.GpuInfo, ggml *GGML, projectors []string,
 		graphOffload = graphPartialOffload
 	}
 
+	// rather than offloading fewer whole layers, offload every layer but
+	// the feed-forward weights of the first ones if the rest fits
+	var cpuFFNLayers int
+	if envconfig.SplitFFN() && !fullyLoaded && opts.NumGPU < 0 && len(gpus) == 1 && gpus[0].Library != "cpu" && gpus[0].Library != "metal" {
+		fixed := gpus[0].MinimumMemory + gpuZeroOverhead + graphPartialOffload + memoryLayerOutput
+		available := gpus[0].FreeMemory - min(gpus[0].FreeMemory, overheads[0]+fixed)
+		if split, ok := splitFFN(layers, int(ggml.KV().BlockCount()), kv, available); ok {
+			cpuFFNLayers = split.layers
+			layerCount = int(ggml.KV().BlockCount()) + 1
+			layerCounts[0] = layerCount
+			gpuAllocations[0] = fixed + split.gpu
+			graphOffload = graphPartialOffload
+			overflow = split.cpu
+		}
+	}
+
 	// Summaries for the log
 	var memoryRequiredPartial, memoryRequiredTotal uint64
 	for i := range gpuAllocations {
@@ -313,6 +360,7 @@ func EstimateGPULayers(gpus []discover.GpuInfo, ggml *GGML, projectors []string,
 		layersRequested:     opts.NumGPU,
 		layersModel:         int(ggml.KV().BlockCount()) + 1,
 		availableList:       availableList,
+		overheadList:        overheadList,
 		kv:                  kv,
 		allocationsList:     allocationsList,
 		memoryWeights:       memoryWeights,
@@ -331,6 +379,7 @@ func EstimateGPULayers(gpus []discover.GpuInfo, ggml *GGML, projectors []string,
 		return estimate
 	}
 	estimate.Layers = layerCount
+	estimate.CPUFFNLayers = cpuFFNLayers
 	estimate.Graph = graphOffload
 	estimate.VRAMSize = memoryRequiredPartial
 	estimate.TotalSize = memoryRequiredTotal
@@ -339,9 +388,50 @@ func EstimateGPULayers(gpus []discover.GpuInfo, ggml *GGML, projectors []string,
 	return estimate
 }
 
-func (m MemoryEstimate) log() {
-	overhead := envconfig.GpuOverhead()
+type ffnSplit struct {
+	// layers is the number of layers, from the first, with feed-forward
+	// weights on the CPU
+	layers int
+
+	// gpu and cpu are the memory required on each
+	gpu, cpu uint64
+}
+
+// splitFFN finds how many layers need to keep their feed-forward weights on
+// the CPU for the rest of the model's layers and the KV cache to fit in
+// available. Attention and the KV cache are used for every token in the
+// context, so they're offloaded for every layer first. It returns false if
+// the rest doesn't fit even with all of the feed-forward weights on the CPU.
+func splitFFN(layers map[string]Layer, blocks int, kv, available uint64) (ffnSplit, bool) {
+	var split ffnSplit
+	ffn := make([]uint64, blocks)
+	for i := range blocks {
+		blk := layers[fmt.Sprintf("blk.%d", i)]
+		ffn[i] = blk.ffnSize()
+		split.gpu += blk.size() - ffn[i]
+	}
+
+	// as for whole layers, leave a layer's worth of memory as a buffer
+	split.gpu += kv + ffn[0]
+	if split.gpu > available {
+		return ffnSplit{}, false
+	}
 
+	// the runner offloads the feed-forward weights of the last layers
+	split.layers = blocks
+	for split.layers > 0 && split.gpu+ffn[split.layers-1] <= available {
+		split.layers--
+		split.gpu += ffn[split.layers]
+	}
+
+	for i := range split.layers {
+		split.cpu += ffn[i]
+	}
+
+	return split, true
+}
+
+func (m MemoryEstimate) log() {
 	log := slog.With()
 	if m.projectorWeights > 0 {
 		log = log.With(
@@ -363,6 +453,8 @@ func (m MemoryEstimate) log() {
 			"model", m.layersModel,
 			// estimated number of layers that can be offloaded
 			"offload", m.Layers,
+			// layers of those with feed-forward weights left on the CPU
+			"cpu_ffn", m.CPUFFNLayers,
 			// multi-gpu split for tensors
 			"split", m.TensorSplit,
 		),
@@ -370,7 +462,8 @@ func (m MemoryEstimate) log() {
 			"memory",
 			// memory available by GPU for offloading
 			"available", m.availableList,
-			"gpu_overhead", format.HumanBytes2(overhead),
+			// memory set aside by GPU with OLLAMA_GPU_OVERHEAD
+			"gpu_overhead", m.overheadList,
 			slog.Group(
 				"required",
 				// memory required for full offloading
@@ -126,4 +126,77 @@ func TestEstimateGPULayers(t *testing.T) {
 			}
 		})
 	}
+
+	t.Run("gpu overhead", func(t *testing.T) {
+		gpus[0].ID, gpus[1].ID = "0", "1"
+		for i := range gpus {
+			gpus[i].FreeMemory = gpuMinimumMemory + 3*layerSize + memoryLayerOutput + max(graphFullOffload, graphPartialOffload) + 1
+		}
+
+		estimate := EstimateGPULayers(gpus, ggml, projectors, opts)
+		assert.Equal(t, "2,2", estimate.TensorSplit)
+
+		// the second GPU no longer has room for a layer
+		t.Setenv("OLLAMA_GPU_OVERHEAD", fmt.Sprintf("1=%d", 2*layerSize))
+		estimate = EstimateGPULayers(gpus, ggml, projectors, opts)
+		assert.Equal(t, "2,0", estimate.TensorSplit)
+	})
+}
+
+func TestSplitFFN(t *testing.T) {
+	layers := make(map[string]Layer)
+	for i := range 4 {
+		layers[fmt.Sprintf("blk.%d", i)] = Layer{
+			"attn_q.weight": &Tensor{Kind: 0, Shape: []uint64{4}},
+			"ffn_up.weight": &Tensor{Kind: 0, Shape: []uint64{8}},
+		}
+	}
+
+	// the attention of every layer, the KV cache and a buffer of one
+	// layer's feed-forward weights
+	const minimum = 4*16 + 16 + 32
+
+	cases := []struct {
+		available uint64
+		ok        bool
+		split     ffnSplit
+	}{
+		{minimum - 1, false, ffnSplit{}},
+		{minimum, true, ffnSplit{layers: 4, gpu: minimum, cpu: 4 * 32}},
+		{minimum + 2*32 + 31, true, ffnSplit{layers: 2, gpu: minimum + 2*32, cpu: 2 * 32}},
+		{minimum + 4*32, true, ffnSplit{layers: 0, gpu: minimum + 4*32}},
+	}
+
+	for _, tt := range cases {
+		t.Run(fmt.Sprintf("%d", tt.available), func(t *testing.T) {
+			split, ok := splitFFN(layers, 4, 16, tt.available)
+			assert.Equal(t, tt.ok, ok)
+			assert.Equal(t, tt.split, split)
+		})
+	}
+}
+
+func TestKVCacheTypes(t *testing.T) {
+	t.Setenv("OLLAMA_KV_CACHE_TYPE", "q8_0")
+
+	cases := []struct {
+		name           string
+		runner         api.Runner
+		flashAttention bool
+		k, v           string
+	}{
+		{"environment", api.Runner{}, true, "q8_0", "q8_0"},
+		{"options", api.Runner{CacheTypeK: "f16", CacheTypeV: "Q4_0"}, true, "f16", "q4_0"},
+		{"only v", api.Runner{CacheTypeV: "q4_0"}, true, "q8_0", "q4_0"},
+		{"unsupported", api.Runner{CacheTypeK: "q2_k"}, true, "", "q8_0"},
+		{"no flash attention", api.Runner{CacheTypeK: "q4_0"}, false, "", ""},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			k, v := kvCacheTypes(&GGML{}, api.Options{Runner: tt.runner}, tt.flashAttention)
+			assert.Equal(t, tt.k, k)
+			assert.Equal(t, tt.v, v)
+		})
+	}
 }
@@ -0,0 +1,85 @@
+package llm
+
+import (
+	"cmp"
+	"math"
+	"strconv"
+
+	"github.com/ollama/ollama/api"
+)
+
+// RopeScalingTypes are the ways RoPE positions can be scaled to extend the
+// context of a model. "ntk" is NTK-aware scaling, which raises the base
+// frequency rather than scaling positions.
+var RopeScalingTypes = []string{"none", "linear", "yarn", "ntk"}
+
+func (kv KV) f32(key string) float32 {
+	switch v := kv[key].(type) {
+	case float32:
+		return v
+	case float64:
+		return float32(v)
+	default:
+		return 0
+	}
+}
+
+// ropeParams returns the runner flags that override the model's RoPE scaling
+// with opts, for a context of numCtx tokens per sequence. llama.cpp reads
+// whatever isn't overridden from the model, including its YaRN parameters.
+func ropeParams(kv KV, opts api.Options, numCtx int) []string {
+	var params []string
+	float := func(name string, f float32) {
+		if f != 0 {
+			params = append(params, name, strconv.FormatFloat(float64(f), 'f', -1, 32))
+		}
+	}
+
+	base, scale := opts.RopeFrequencyBase, opts.RopeFrequencyScale
+	switch opts.RopeScalingType {
+	case "":
+	case "ntk":
+		base, scale = ntkBase(kv, opts, numCtx), 1
+		params = append(params, "--rope-scaling", "none")
+	default:
+		params = append(params, "--rope-scaling", opts.RopeScalingType)
+	}
+
+	float("--rope-freq-base", base)
+	float("--rope-freq-scale", scale)
+
+	if opts.YarnOrigCtx > 0 {
+		params = append(params, "--yarn-orig-ctx", strconv.Itoa(opts.YarnOrigCtx))
+	}
+
+	float("--yarn-ext-factor", opts.YarnExtFactor)
+	float("--yarn-attn-factor", opts.YarnAttnFactor)
+	float("--yarn-beta-fast", opts.YarnBetaFast)
+	float("--yarn-beta-slow", opts.YarnBetaSlow)
+	return params
+}
+
+// ntkBase returns the RoPE base frequency that extends the model's context by
+// the scaling factor with NTK-aware scaling. The factor is 1 over
+// rope_frequency_scale if it's set, or else the model's scaling factor, or
+// else numCtx over the model's original context length.
+func ntkBase(kv KV, opts api.Options, numCtx int) float32 {
+	arch := kv.Architecture()
+	base := cmp.Or(opts.RopeFrequencyBase, kv.f32(arch+".rope.freq_base"), 10000)
+	dims := float64(cmp.Or(kv.u64(arch+".rope.dimension_count"), kv.EmbeddingHeadCountK()))
+
+	factor := float64(kv.f32(arch + ".rope.scaling.factor"))
+	if opts.RopeFrequencyScale > 0 {
+		factor = 1 / float64(opts.RopeFrequencyScale)
+	} else if factor == 0 {
+		if orig := cmp.Or(uint64(opts.YarnOrigCtx), kv.u64(arch+".rope.scaling.original_context_length"), kv.ContextLength()); orig > 0 {
+			factor = float64(numCtx) / float64(orig)
+		}
+	}
+
+	if factor <= 1 || dims <= 2 {
+		return base
+	}
+
+	return float32(float64(base) * math.Pow(factor, dims/(dims-2)))
+}
@@ -0,0 +1,49 @@
+package llm
+
+import (
+	"math"
+	"strconv"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/ollama/ollama/api"
+)
+
+func TestRopeParams(t *testing.T) {
+	kv := KV{
+		"general.architecture":       "llama",
+		"llama.rope.freq_base":       float32(500000),
+		"llama.rope.dimension_count": uint32(128),
+		"llama.context_length":       uint32(8192),
+	}
+
+	ntk := strconv.FormatFloat(float64(float32(500000*math.Pow(4, 128.0/126))), 'f', -1, 32)
+
+	cases := []struct {
+		name   string
+		runner api.Runner
+		numCtx int
+		expect []string
+	}{
+		{"from model", api.Runner{}, 32768, nil},
+		{
+			"yarn",
+			api.Runner{RopeScalingType: "yarn", RopeFrequencyScale: 0.25, YarnOrigCtx: 8192, YarnBetaFast: 16},
+			32768,
+			[]string{"--rope-scaling", "yarn", "--rope-freq-scale", "0.25", "--yarn-orig-ctx", "8192", "--yarn-beta-fast", "16"},
+		},
+		{"ntk from context", api.Runner{RopeScalingType: "ntk"}, 32768, []string{"--rope-scaling", "none", "--rope-freq-base", ntk, "--rope-freq-scale", "1"}},
+		{"ntk from scale", api.Runner{RopeScalingType: "ntk", RopeFrequencyScale: 0.25}, 2048, []string{"--rope-scaling", "none", "--rope-freq-base", ntk, "--rope-freq-scale", "1"}},
+		{"ntk within context", api.Runner{RopeScalingType: "ntk"}, 4096, []string{"--rope-scaling", "none", "--rope-freq-base", "500000", "--rope-freq-scale", "1"}},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			params := ropeParams(kv, api.Options{Runner: tt.runner}, tt.numCtx)
+			if diff := cmp.Diff(params, tt.expect); diff != "" {
+				t.Errorf("mismatch (-got +want):\n%s", diff)
+			}
+		})
+	}
+}
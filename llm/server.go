@@ -3,7 +3,9 @@ package llm
 import (
 	"bufio"
 	"bytes"
+	"cmp"
 	"context"
+	"crypto/sha256"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -29,6 +31,7 @@ import (
 	"github.com/ollama/ollama/envconfig"
 	"github.com/ollama/ollama/format"
 	"github.com/ollama/ollama/llama"
+	"github.com/ollama/ollama/logutil"
 	"github.com/ollama/ollama/runners"
 )
 
@@ -36,9 +39,12 @@ type LlamaServer interface {
 	Ping(ctx context.Context) error
 	WaitUntilRunning(ctx context.Context) error
 	Completion(ctx context.Context, req CompletionRequest, fn func(CompletionResponse)) error
-	Embedding(ctx context.Context, input string) ([]float32, error)
+	Embedding(ctx context.Context, req EmbeddingRequest) ([]float32, error)
 	Tokenize(ctx context.Context, content string) ([]int, error)
 	Detokenize(ctx context.Context, tokens []int) (string, error)
+	Adapters(ctx context.Context) ([]AdapterStatus, error)
+	LoadAdapter(ctx context.Context, path string) error
+	UnloadAdapter(ctx context.Context, path string) error
 	Close() error
 	EstimatedVRAM() uint64 // Total VRAM across all GPUs
 	EstimatedTotal() uint64
@@ -65,6 +71,9 @@ type llmServer struct {
 	loadProgress float32
 
 	sem *semaphore.Weighted
+
+	// stops thermal monitoring, if enabled
+	stopThermals context.CancelFunc
 }
 
 // LoadModel will load a model from disk. The model must be in the GGML format.
@@ -89,7 +98,7 @@ func LoadModel(model string, maxArraySize int) (*GGML, error) {
 
 // NewLlamaServer will run a server for the given GPUs
 // The gpu list must be a single family.
-func NewLlamaServer(gpus discover.GpuInfoList, model string, ggml *GGML, adapters, projectors []string, opts api.Options, numParallel int) (LlamaServer, error) {
+func NewLlamaServer(gpus discover.GpuInfoList, model string, ggml *GGML, adapters, projectors []string, softPrompt, sessionDir string, opts api.Options, numParallel int) (LlamaServer, error) {
 	var err error
 	var cpuRunner string
 	var estimate MemoryEstimate
@@ -131,6 +140,10 @@ func NewLlamaServer(gpus discover.GpuInfoList, model string, ggml *GGML, adapter
 	// Darwin has fully dynamic swap so has no direct concept of free swap space
 	if runtime.GOOS != "darwin" {
 		systemMemoryRequired := estimate.TotalSize - estimate.VRAMSize
+		if gpus[0].UnifiedMemory {
+			// what's offloaded to the GPU still comes out of system memory
+			systemMemoryRequired = estimate.TotalSize
+		}
 		available := systemFreeMemory + systemSwapFreeMemory
 		if systemMemoryRequired > available {
 			slog.Warn("model request too large for system", "requested", format.HumanBytes2(systemMemoryRequired), "available", available, "total", format.HumanBytes2(systemTotalMemory), "free", format.HumanBytes2(systemFreeMemory), "swap", format.HumanBytes2(systemSwapFreeMemory))
@@ -178,9 +191,14 @@ func NewLlamaServer(gpus discover.GpuInfoList, model string, ggml *GGML, adapter
 
 	if opts.NumGPU >= 0 {
 		params = append(params, "--n-gpu-layers", strconv.Itoa(opts.NumGPU))
+
+		// the split only applies to the layers the estimate offloads
+		if estimate.CPUFFNLayers > 0 && opts.NumGPU == estimate.Layers {
+			params = append(params, "--n-cpu-ffn-layers", strconv.Itoa(estimate.CPUFFNLayers))
+		}
 	}
 
-	if envconfig.Debug() {
+	if logutil.Enabled(logutil.Runner, slog.LevelDebug) {
 		params = append(params, "--verbose")
 	}
 
@@ -188,6 +206,8 @@ func NewLlamaServer(gpus discover.GpuInfoList, model string, ggml *GGML, adapter
 		params = append(params, "--main-gpu", strconv.Itoa(opts.MainGPU))
 	}
 
+	params = append(params, ropeParams(ggml.KV(), opts, opts.NumCtx/max(numParallel, 1))...)
+
 	if len(adapters) > 0 {
 		for _, adapter := range adapters {
 			params = append(params, "--lora", adapter)
@@ -199,6 +219,10 @@ func NewLlamaServer(gpus discover.GpuInfoList, model string, ggml *GGML, adapter
 		params = append(params, "--mmproj", projectors[0])
 	}
 
+	if softPrompt != "" {
+		params = append(params, "--soft-prompt", softPrompt)
+	}
+
 	defaultThreads := systemInfo.GetOptimalThreadCount()
 	if opts.NumThread > 0 {
 		params = append(params, "--threads", strconv.Itoa(opts.NumThread))
@@ -217,20 +241,20 @@ func NewLlamaServer(gpus discover.GpuInfoList, model string, ggml *GGML, adapter
 		fa = false
 	}
 
-	kvct := strings.ToLower(envconfig.KvCacheType())
+	// Flash Attention also supports kv cache quantization
+	cacheTypeK, cacheTypeV := kvCacheTypes(ggml, opts, fa)
 
 	if fa {
 		slog.Info("enabling flash attention")
 		params = append(params, "--flash-attn")
 
-		// Flash Attention also supports kv cache quantization
-		// Enable if the requested and kv cache type is supported by the model
-		if kvct != "" && ggml.SupportsKVCacheType(kvct) {
-			params = append(params, "--kv-cache-type", kvct)
-		} else {
-			slog.Warn("kv cache type not supported by model", "type", kvct)
+		if cacheTypeK != "" {
+			params = append(params, "--kv-cache-type-k", cacheTypeK)
+		}
+		if cacheTypeV != "" {
+			params = append(params, "--kv-cache-type-v", cacheTypeV)
 		}
-	} else if kvct != "" && kvct != "f16" {
+	} else if kvct := strings.ToLower(cmp.Or(opts.CacheTypeK, opts.CacheTypeV, envconfig.KvCacheType())); kvct != "" && kvct != "f16" {
 		slog.Warn("quantized kv cache requested but flash attention disabled", "type", kvct)
 	}
 
@@ -270,6 +294,44 @@ func NewLlamaServer(gpus discover.GpuInfoList, model string, ggml *GGML, adapter
 		params = append(params, "--multiuser-cache")
 	}
 
+	if prefixCache := envconfig.PrefixCache(); prefixCache > 0 {
+		params = append(params, "--prefix-cache", strconv.FormatUint(uint64(prefixCache), 10))
+	}
+
+	attr := LlamaServerSysProcAttr
+	if envconfig.Sandbox() {
+		attr = sandboxSysProcAttr(model)
+	}
+
+	if sessionDir != "" {
+		// the directory is made for the runner's user, which may not be
+		// able to create it; runners can be used without saving sessions
+		if dir, err := runnerSessionDir(sessionDir, attr); err != nil {
+			slog.Warn("runner won't save sessions", "dir", sessionDir, "error", err)
+		} else {
+			params = append(params, "--session-dir", dir)
+		}
+	}
+
+	params = append(params, "--max-adapters", strconv.FormatUint(uint64(envconfig.MaxAdapters()), 10))
+
+	if envconfig.Sandbox() {
+		// adapters for requests are blobs the runner didn't load at startup
+		params = append(params, "--sandbox", "--adapter-dir", filepath.Join(envconfig.Models(), "blobs"))
+	}
+
+	if sizes := envconfig.BatchTuning(); len(sizes) > 0 {
+		s := make([]string, len(sizes))
+		for i, size := range sizes {
+			s[i] = strconv.Itoa(size)
+		}
+
+		params = append(params,
+			"--batch-tune", strings.Join(s, ","),
+			"--batch-tune-cache", batchTuningPath(model, gpus, opts, numParallel, fa, cacheTypeK, cacheTypeV),
+		)
+	}
+
 	for i := range servers {
 		builtin := servers[i] == runners.BuiltinName()
 		server := availableServers[servers[i]]
@@ -338,7 +400,7 @@ func NewLlamaServer(gpus discover.GpuInfoList, model string, ggml *GGML, adapter
 		s.cmd.Env = os.Environ()
 		s.cmd.Stdout = os.Stdout
 		s.cmd.Stderr = s.status
-		s.cmd.SysProcAttr = LlamaServerSysProcAttr
+		s.cmd.SysProcAttr = attr
 
 		envWorkarounds := [][2]string{}
 		for _, gpu := range gpus {
@@ -374,7 +436,7 @@ func NewLlamaServer(gpus discover.GpuInfoList, model string, ggml *GGML, adapter
 		}
 
 		slog.Info("starting llama server", "cmd", s.cmd.String())
-		if envconfig.Debug() {
+		if logutil.Enabled(logutil.Runner, slog.LevelDebug) {
 			filteredEnv := []string{}
 			for _, ev := range s.cmd.Env {
 				if strings.HasPrefix(ev, "CUDA_") ||
@@ -423,6 +485,12 @@ func NewLlamaServer(gpus discover.GpuInfoList, model string, ggml *GGML, adapter
 			}
 		}()
 
+		if (envconfig.GpuTempLimit() > 0 || envconfig.GpuPowerLimit() > 0) && gpus[0].Library != "cpu" {
+			var ctx context.Context
+			ctx, s.stopThermals = context.WithCancel(context.Background())
+			go s.monitorThermals(ctx)
+		}
+
 		return s, nil
 	}
 
@@ -552,14 +620,14 @@ func (s *llmServer) WaitUntilRunning(ctx context.Context) error {
 	stallDuration := envconfig.LoadTimeout()    // If no progress happens
 	stallTimer := time.Now().Add(stallDuration) // give up if we stall
 
-	slog.Info("waiting for llama runner to start responding")
+	slog.InfoContext(ctx, "waiting for llama runner to start responding")
 	var lastStatus ServerStatus = -1
 	fullyLoaded := false
 
 	for {
 		select {
 		case <-ctx.Done():
-			slog.Warn("client connection closed before server finished loading, aborting load")
+			slog.WarnContext(ctx, "client connection closed before server finished loading, aborting load")
 			return fmt.Errorf("timed out waiting for llama runner to start: %w", ctx.Err())
 		case err := <-s.done:
 			return fmt.Errorf("llama runner process has terminated: %w", err)
@@ -586,21 +654,21 @@ func (s *llmServer) WaitUntilRunning(ctx context.Context) error {
 		status, _ := s.getServerStatus(ctx)
 		if lastStatus != status && status != ServerStatusReady {
 			// Only log on status changes
-			slog.Info("waiting for server to become available", "status", status.ToString())
+			slog.InfoContext(ctx, "waiting for server to become available", "status", status.ToString())
 		}
 		switch status {
 		case ServerStatusReady:
 			s.loadDuration = time.Since(start)
-			slog.Info(fmt.Sprintf("llama runner started in %0.2f seconds", s.loadDuration.Seconds()))
+			slog.InfoContext(ctx, fmt.Sprintf("llama runner started in %0.2f seconds", s.loadDuration.Seconds()))
 			return nil
 		default:
 			lastStatus = status
 			// Reset the timer as long as we're making forward progress on the load
 			if priorProgress != s.loadProgress {
-				slog.Debug(fmt.Sprintf("model load progress %0.2f", s.loadProgress))
+				slog.DebugContext(ctx, fmt.Sprintf("model load progress %0.2f", s.loadProgress))
 				stallTimer = time.Now().Add(stallDuration)
 			} else if !fullyLoaded && int(s.loadProgress*100.0) >= 100 {
-				slog.Debug("model load completed, waiting for server to become available", "status", status.ToString())
+				slog.DebugContext(ctx, "model load completed, waiting for server to become available", "status", status.ToString())
 				stallTimer = time.Now().Add(stallDuration)
 				fullyLoaded = true
 			}
@@ -610,6 +678,37 @@ func (s *llmServer) WaitUntilRunning(ctx context.Context) error {
 	}
 }
 
+// FormatGrammar returns the grammar that constrains responses to format,
+// "json" or a JSON schema, or "" if format isn't set. Sampling only ever
+// picks tokens the grammar allows, so responses that aren't cut short match
+// the schema, streamed or not.
+func FormatGrammar(format json.RawMessage) (string, error) {
+	if len(format) == 0 {
+		return "", nil
+	}
+
+	switch string(format) {
+	case `null`, `""`:
+		// Field was set, but "missing" a value. We accept
+		// these as "not set".
+		return "", nil
+	case `"json"`:
+		return grammarJSON, nil
+	}
+
+	if format[0] != '{' {
+		return "", fmt.Errorf("invalid format: %q; expected \"json\" or a valid JSON Schema object", format)
+	}
+
+	// User provided a JSON schema
+	g := llama.SchemaToGrammar(format)
+	if g == nil {
+		return "", errors.New("invalid JSON schema in format")
+	}
+
+	return string(g), nil
+}
+
 var grammarJSON = `
 root   ::= object
 value  ::= object | array | string | number | ("true" | "false" | "null") ws
@@ -633,7 +732,17 @@ number ::= ("-"? ([0-9] | [1-9] [0-9]*)) ("." [0-9]+)? ([eE] [-+]? [0-9]+)? ws
 ws ::= ([ \t\n] ws)?
 `
 
-const maxBufferSize = 512 * format.KiloByte
+const (
+	maxBufferSize = 512 * format.KiloByte
+
+	// maxRawValueSize is the most bytes a float32 of a raw output takes in
+	// the runner's JSON response
+	maxRawValueSize = 16
+)
+
+// ErrRawOutputTooLarge is returned when a raw output has more values than
+// OLLAMA_MAX_RAW_OUTPUT
+var ErrRawOutputTooLarge = errors.New("raw output exceeds the limit of OLLAMA_MAX_RAW_OUTPUT")
 
 type ImageData struct {
 	Data          []byte `json:"data"`
@@ -642,17 +751,30 @@ type ImageData struct {
 }
 
 type completion struct {
-	Content      string `json:"content"`
-	Model        string `json:"model"`
-	Prompt       string `json:"prompt"`
-	Stop         bool   `json:"stop"`
-	StoppedLimit bool   `json:"stopped_limit"`
+	Content        string `json:"content"`
+	Model          string `json:"model"`
+	Prompt         string `json:"prompt"`
+	Stop           bool   `json:"stop"`
+	StoppedLimit   bool   `json:"stopped_limit"`
+	StoppedTimeout bool   `json:"stopped_timeout"`
+
+	Logits       []float32 `json:"logits"`
+	HiddenStates []float32 `json:"hidden_states"`
+	Logprob      float64   `json:"logprob"`
+
+	PromptLogprobs []float32 `json:"prompt_logprobs"`
+
+	SamplingTrace []api.SampledToken `json:"sampling_trace"`
+	Logprobs      []api.Logprob      `json:"logprobs"`
+	Tokens        []int              `json:"tokens"`
+	Offsets       []int              `json:"offsets"`
 
 	Timings struct {
-		PredictedN  int     `json:"predicted_n"`
-		PredictedMS float64 `json:"predicted_ms"`
-		PromptN     int     `json:"prompt_n"`
-		PromptMS    float64 `json:"prompt_ms"`
+		PredictedN   int     `json:"predicted_n"`
+		PredictedMS  float64 `json:"predicted_ms"`
+		PromptN      int     `json:"prompt_n"`
+		PromptMS     float64 `json:"prompt_ms"`
+		PromptCached int     `json:"prompt_cached"`
 	}
 }
 
@@ -661,16 +783,87 @@ type CompletionRequest struct {
 	Format  json.RawMessage
 	Images  []ImageData
 	Options *api.Options
+
+	// Tokens, if set, are the prompt as token ids, used as is instead of
+	// tokenizing Prompt
+	Tokens []int
+
+	// PrefixLength is the length in bytes of the start of the prompt shared
+	// with other requests, such as the system prompt, which is kept in the
+	// prefix cache
+	PrefixLength int
+
+	// Session names the chat session the prompt continues, whose KV cache
+	// the runner keeps between requests
+	Session string
+
+	// Return selects a raw output ("logits" or "hidden_states") to be
+	// returned for the prompt instead of generated text. With "perplexity",
+	// Logprob is the sum of the log probabilities of each prompt token after
+	// the first given the ones before it, with none taken from the cache,
+	// and PromptLogprobs are their log probabilities in order.
+	Return string
+
+	// PositionOffset is the position of the first prompt token, for example to
+	// resume a session whose earlier tokens have been dropped from the prompt
+	PositionOffset int
+
+	// Logprobs sums the log probabilities of the generated tokens
+	Logprobs bool
+
+	// SharePrompt reuses the cache of a request in progress with the same
+	// prompt, such as another candidate for the same generation
+	SharePrompt bool
+
+	// CacheLength, if set, is the length in bytes of the start of the prompt
+	// that's kept in the cache for later requests. The rest of the prompt and
+	// the response are dropped from the cache when the request is done.
+	CacheLength *int
+
+	// DiscardSamples advances the sampler's random number generator as if
+	// this many tokens had already been sampled, to continue a generation
+	// started on another runner
+	DiscardSamples int
+
+	// TraceSampling is the number of candidates with the highest logits to
+	// trace through sampling for each generated token
+	TraceSampling int
+
+	// TokenLogprobs returns the log probability of each generated token
+	// with its content, along with those of the TopLogprobs most likely
+	// tokens in its place
+	TokenLogprobs bool
+	TopLogprobs   int
+
+	// ReturnTokens returns the tokens of each content and the byte offsets
+	// of their pieces in the generated text
+	ReturnTokens bool
+
+	// Adapters are paths to LoRA adapters applied for the request on top of
+	// those the model was loaded with
+	Adapters []string
 }
 
 type CompletionResponse struct {
 	Content            string
 	DoneReason         string
 	Done               bool
+	Logits             []float32
+	HiddenStates       []float32
+	Logprob            float64
+	SamplingTrace      []api.SampledToken
+	Logprobs           []api.Logprob
+	Tokens             []int
+	Offsets            []int
+	PromptLogprobs     []float32
 	PromptEvalCount    int
 	PromptEvalDuration time.Duration
+	PromptCachedCount  int
 	EvalCount          int
 	EvalDuration       time.Duration
+
+	// Energy is the estimated energy used by the GPUs in joules
+	Energy float64
 }
 
 func (s *llmServer) Completion(ctx context.Context, req CompletionRequest, fn func(CompletionResponse)) error {
@@ -678,6 +871,7 @@ func (s *llmServer) Completion(ctx context.Context, req CompletionRequest, fn fu
 		"prompt":            req.Prompt,
 		"stream":            true,
 		"n_predict":         req.Options.NumPredict,
+		"max_time_ms":       req.Options.MaxTimeMS,
 		"n_keep":            req.Options.NumKeep,
 		"main_gpu":          req.Options.MainGPU,
 		"temperature":       req.Options.Temperature,
@@ -699,33 +893,112 @@ func (s *llmServer) Completion(ctx context.Context, req CompletionRequest, fn fu
 		"cache_prompt":      true,
 	}
 
-	if len(req.Format) > 0 {
-		switch string(req.Format) {
-		case `null`, `""`:
-			// Field was set, but "missing" a value. We accept
-			// these as "not set".
-			break
-		case `"json"`:
-			request["grammar"] = grammarJSON
-		default:
-			if req.Format[0] != '{' {
-				return fmt.Errorf("invalid format: %q; expected \"json\" or a valid JSON Schema object", req.Format)
-			}
+	if len(req.Tokens) > 0 {
+		request["tokens"] = req.Tokens
+	}
 
-			// User provided a JSON schema
-			g := llama.SchemaToGrammar(req.Format)
-			if g == nil {
-				return fmt.Errorf("invalid JSON schema in format")
-			}
-			request["grammar"] = string(g)
+	if req.PrefixLength > 0 {
+		request["prefix_length"] = req.PrefixLength
+	}
+
+	if req.Session != "" {
+		request["session"] = req.Session
+	}
+
+	if len(req.Options.Ban) > 0 {
+		request["ban"] = req.Options.Ban
+	}
+
+	if len(req.Options.BanTokens) > 0 {
+		request["ban_token"] = req.Options.BanTokens
+	}
+
+	if len(req.Options.LogitBias) > 0 {
+		request["logit_bias"] = req.Options.LogitBias
+	}
+
+	if req.Options.DryMultiplier > 0 {
+		request["dry_multiplier"] = req.Options.DryMultiplier
+		request["dry_base"] = req.Options.DryBase
+		request["dry_allowed_length"] = req.Options.DryAllowedLength
+		request["dry_penalty_last_n"] = req.Options.DryPenaltyLastN
+		request["dry_sequence_breakers"] = req.Options.DrySequenceBreakers
+	}
+
+	if req.Options.XTCProbability > 0 {
+		request["xtc_probability"] = req.Options.XTCProbability
+		request["xtc_threshold"] = req.Options.XTCThreshold
+	}
+
+	if req.Options.DynatempRange > 0 {
+		request["dynatemp_range"] = req.Options.DynatempRange
+		request["dynatemp_exponent"] = req.Options.DynatempExponent
+	}
+
+	if len(req.Options.SamplerOrder) > 0 {
+		request["sampler_order"] = req.Options.SamplerOrder
+	}
+
+	if req.Return != "" {
+		request["return"] = req.Return
+	}
+
+	if req.PositionOffset != 0 {
+		request["position_offset"] = req.PositionOffset
+	}
+
+	if req.Logprobs {
+		request["logprobs"] = true
+	}
+
+	if req.SharePrompt {
+		request["share_prompt"] = true
+	}
+
+	if req.CacheLength != nil {
+		request["cache_length"] = *req.CacheLength
+	}
+
+	if req.DiscardSamples > 0 {
+		request["discard_samples"] = req.DiscardSamples
+	}
+
+	if req.TraceSampling > 0 {
+		request["trace_sampling"] = req.TraceSampling
+	}
+
+	if req.TokenLogprobs {
+		request["token_logprobs"] = true
+		request["top_logprobs"] = req.TopLogprobs
+	}
+
+	if req.ReturnTokens {
+		request["return_tokens"] = true
+	}
+
+	if len(req.Adapters) > 0 {
+		request["adapters"] = req.Adapters
+	}
+
+	if g, err := FormatGrammar(req.Format); err != nil {
+		return err
+	} else if g != "" {
+		request["grammar"] = g
+	}
+
+	if req.Options.Grammar != "" {
+		if _, ok := request["grammar"]; ok {
+			return errors.New("grammar can't be used with format")
 		}
+
+		request["grammar"] = req.Options.Grammar
 	}
 
 	if err := s.sem.Acquire(ctx, 1); err != nil {
 		if errors.Is(err, context.Canceled) {
-			slog.Info("aborting completion request due to client closing the connection")
+			slog.InfoContext(ctx, "aborting completion request due to client closing the connection")
 		} else {
-			slog.Error("Failed to acquire semaphore", "error", err)
+			slog.ErrorContext(ctx, "Failed to acquire semaphore", "error", err)
 		}
 		return err
 	}
@@ -753,6 +1026,9 @@ func (s *llmServer) Completion(ctx context.Context, req CompletionRequest, fn fu
 		return fmt.Errorf("failed to marshal data: %v", err)
 	}
 
+	meter := s.measureEnergy()
+	defer meter.Stop()
+
 	endpoint := fmt.Sprintf("http://127.0.0.1:%d/completion", s.port)
 	serverReq, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, buffer)
 	if err != nil {
@@ -777,7 +1053,14 @@ func (s *llmServer) Completion(ctx context.Context, req CompletionRequest, fn fu
 
 	scanner := bufio.NewScanner(res.Body)
 	buf := make([]byte, 0, maxBufferSize)
-	scanner.Buffer(buf, maxBufferSize)
+	if req.Return != "" {
+		// raw outputs are sent as a single line which can be much larger than
+		// a regular response, so it's read up to the size of the most values
+		// allowed instead of buffering any size
+		scanner.Buffer(buf, maxBufferSize+maxRawValueSize*int(envconfig.MaxRawOutput()))
+	} else {
+		scanner.Buffer(buf, maxBufferSize)
+	}
 
 	// keep track of the last token generated, this is used to abort if the model starts looping
 	var lastToken string
@@ -814,13 +1097,16 @@ func (s *llmServer) Completion(ctx context.Context, req CompletionRequest, fn fu
 
 			// 30 picked as an arbitrary max token repeat limit, modify as needed
 			if tokenRepeat > 30 {
-				slog.Debug("prediction aborted, token repeat limit reached")
+				slog.DebugContext(ctx, "prediction aborted, token repeat limit reached")
 				return ctx.Err()
 			}
 
-			if c.Content != "" {
+			if c.Content != "" || len(c.Logprobs) > 0 || len(c.Tokens) > 0 {
 				fn(CompletionResponse{
-					Content: c.Content,
+					Content:  c.Content,
+					Logprobs: c.Logprobs,
+					Tokens:   c.Tokens,
+					Offsets:  c.Offsets,
 				})
 			}
 
@@ -828,6 +1114,8 @@ func (s *llmServer) Completion(ctx context.Context, req CompletionRequest, fn fu
 				doneReason := "stop"
 				if c.StoppedLimit {
 					doneReason = "length"
+				} else if c.StoppedTimeout {
+					doneReason = "timeout"
 				}
 
 				fn(CompletionResponse{
@@ -835,8 +1123,15 @@ func (s *llmServer) Completion(ctx context.Context, req CompletionRequest, fn fu
 					DoneReason:         doneReason,
 					PromptEvalCount:    c.Timings.PromptN,
 					PromptEvalDuration: parseDurationMs(c.Timings.PromptMS),
+					PromptCachedCount:  c.Timings.PromptCached,
 					EvalCount:          c.Timings.PredictedN,
 					EvalDuration:       parseDurationMs(c.Timings.PredictedMS),
+					Logits:             c.Logits,
+					HiddenStates:       c.HiddenStates,
+					Logprob:            c.Logprob,
+					PromptLogprobs:     c.PromptLogprobs,
+					SamplingTrace:      c.SamplingTrace,
+					Energy:             meter.Stop(),
 				})
 				return nil
 			}
@@ -844,6 +1139,10 @@ func (s *llmServer) Completion(ctx context.Context, req CompletionRequest, fn fu
 	}
 
 	if err := scanner.Err(); err != nil {
+		if req.Return != "" && errors.Is(err, bufio.ErrTooLong) {
+			return fmt.Errorf("%w of %d values", ErrRawOutputTooLarge, envconfig.MaxRawOutput())
+		}
+
 		if strings.Contains(err.Error(), "unexpected EOF") || strings.Contains(err.Error(), "forcibly closed") {
 			s.Close()
 			var msg string
@@ -863,18 +1162,21 @@ func (s *llmServer) Completion(ctx context.Context, req CompletionRequest, fn fu
 
 type EmbeddingRequest struct {
 	Content string `json:"content"`
+
+	// Tokens, if set, are the input as token ids, used instead of Content
+	Tokens []int `json:"tokens,omitempty"`
 }
 
 type EmbeddingResponse struct {
 	Embedding []float32 `json:"embedding"`
 }
 
-func (s *llmServer) Embedding(ctx context.Context, input string) ([]float32, error) {
+func (s *llmServer) Embedding(ctx context.Context, req EmbeddingRequest) ([]float32, error) {
 	if err := s.sem.Acquire(ctx, 1); err != nil {
 		if errors.Is(err, context.Canceled) {
-			slog.Info("aborting embedding request due to client closing the connection")
+			slog.InfoContext(ctx, "aborting embedding request due to client closing the connection")
 		} else {
-			slog.Error("Failed to acquire semaphore", "error", err)
+			slog.ErrorContext(ctx, "Failed to acquire semaphore", "error", err)
 		}
 		return nil, err
 	}
@@ -888,7 +1190,7 @@ func (s *llmServer) Embedding(ctx context.Context, input string) ([]float32, err
 		return nil, fmt.Errorf("unexpected server status: %s", status.ToString())
 	}
 
-	data, err := json.Marshal(EmbeddingRequest{Content: input})
+	data, err := json.Marshal(req)
 	if err != nil {
 		return nil, fmt.Errorf("error marshaling embed data: %w", err)
 	}
@@ -964,7 +1266,7 @@ func (s *llmServer) Tokenize(ctx context.Context, content string) ([]int, error)
 	defer resp.Body.Close()
 	if resp.StatusCode == http.StatusNotFound {
 		if s.model == nil {
-			slog.Debug("new runner detected, loading model for cgo tokenization")
+			slog.DebugContext(ctx, "new runner detected, loading model for cgo tokenization")
 			m, err := llama.LoadModelFromFile(s.modelPath, llama.ModelParams{VocabOnly: true})
 			if err != nil {
 				return nil, err
@@ -1069,6 +1371,10 @@ func (s *llmServer) Detokenize(ctx context.Context, tokens []int) (string, error
 }
 
 func (s *llmServer) Close() error {
+	if s.stopThermals != nil {
+		s.stopThermals()
+	}
+
 	s.modelLock.Lock()
 	if s.model != nil {
 		llama.FreeModel(s.model)
@@ -1112,6 +1418,18 @@ func (s *llmServer) EstimatedVRAMByGPU(gpuID string) uint64 {
 	return 0
 }
 
+// batchTuningPath returns where the batch size tuned for model is stored. It
+// is only reused with the same GPUs and settings that affect throughput.
+func batchTuningPath(model string, gpus discover.GpuInfoList, opts api.Options, numParallel int, flashAttention bool, cacheTypeK, cacheTypeV string) string {
+	h := sha256.New()
+	for _, g := range gpus {
+		fmt.Fprintf(h, "%s %s %s %s\n", g.Library, g.Variant, g.ID, g.Name)
+	}
+
+	fmt.Fprintf(h, "%d %d %d %d %v %s %s\n", opts.NumGPU, opts.NumBatch, opts.NumCtx, numParallel, flashAttention, cacheTypeK, cacheTypeV)
+	return filepath.Join(envconfig.Models(), "tuning", fmt.Sprintf("%s-%x.json", filepath.Base(model), h.Sum(nil)[:8]))
+}
+
 func parseDurationMs(ms float64) time.Duration {
 	dur, err := time.ParseDuration(fmt.Sprintf("%fms", ms))
 	if err != nil {
@@ -2,12 +2,19 @@ package llm
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os/exec"
+	"path/filepath"
 	"strings"
 	"testing"
 
 	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/discover"
 	"golang.org/x/sync/semaphore"
 )
 
@@ -70,3 +77,75 @@ func TestLLMServerCompletionFormat(t *testing.T) {
 	}, nil)
 	checkValid(err)
 }
+
+func TestLLMServerCompletionRawOutputLimit(t *testing.T) {
+	t.Setenv("OLLAMA_MAX_RAW_OUTPUT", "4096")
+
+	var logits []float32
+	runner := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/health":
+			fmt.Fprint(w, `{"status":"ok"}`)
+		case "/completion":
+			json.NewEncoder(w).Encode(map[string]any{"stop": true, "logits": logits})
+		}
+	}))
+	defer runner.Close()
+
+	s := &llmServer{
+		port: runner.Listener.Addr().(*net.TCPAddr).Port,
+		cmd:  &exec.Cmd{},
+		sem:  semaphore.NewWeighted(1),
+	}
+
+	complete := func(n int) ([]float32, error) {
+		logits = make([]float32, n)
+		for i := range logits {
+			logits[i] = -1.2345678e-12
+		}
+
+		var got []float32
+		err := s.Completion(context.Background(), CompletionRequest{Options: new(api.Options), Return: "logits"}, func(r CompletionResponse) {
+			got = r.Logits
+		})
+		return got, err
+	}
+
+	if got, err := complete(4096); err != nil || len(got) != 4096 {
+		t.Fatalf("expected 4096 logits, got %d: %v", len(got), err)
+	}
+
+	// the response stops being read once it's larger than the limit allows
+	if _, err := complete(1 << 20); !errors.Is(err, ErrRawOutputTooLarge) {
+		t.Errorf("expected ErrRawOutputTooLarge, got %v", err)
+	}
+}
+
+func TestBatchTuningPath(t *testing.T) {
+	t.Setenv("OLLAMA_MODELS", "/models")
+
+	gpus := discover.GpuInfoList{{Library: "cuda", ID: "GPU-0", Name: "NVIDIA GeForce RTX 4090"}}
+	opts := api.DefaultOptions()
+
+	path := batchTuningPath("/models/blobs/sha256-abc", gpus, opts, 1, false, "", "")
+	if dir := filepath.Dir(path); dir != filepath.Join("/models", "tuning") {
+		t.Errorf("expected path in /models/tuning, got %s", path)
+	}
+
+	if base := filepath.Base(path); !strings.HasPrefix(base, "sha256-abc-") || !strings.HasSuffix(base, ".json") {
+		t.Errorf("expected path named after the model, got %s", path)
+	}
+
+	if other := batchTuningPath("/models/blobs/sha256-abc", gpus, opts, 1, false, "", ""); other != path {
+		t.Errorf("expected the same path, got %s and %s", path, other)
+	}
+
+	other := discover.GpuInfoList{{Library: "cuda", ID: "GPU-1", Name: "NVIDIA GeForce RTX 3060"}}
+	if p := batchTuningPath("/models/blobs/sha256-abc", other, opts, 1, false, "", ""); p == path {
+		t.Errorf("expected a different path for another GPU, got %s", p)
+	}
+
+	if p := batchTuningPath("/models/blobs/sha256-abc", gpus, opts, 4, false, "", ""); p == path {
+		t.Errorf("expected a different path for another number of parallel requests, got %s", p)
+	}
+}
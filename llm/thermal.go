@@ -0,0 +1,222 @@
+package llm
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/ollama/ollama/discover"
+	"github.com/ollama/ollama/envconfig"
+)
+
+const (
+	// thermalInterval is how often GPU sensors are read while a model is loaded
+	thermalInterval = 2 * time.Second
+
+	// maxThrottleLevel bounds how far generation is slowed down. Each level
+	// halves the batch size and adds throttleDelay between batches.
+	maxThrottleLevel = 4
+	throttleDelay    = 50 * time.Millisecond
+
+	// throttling is relaxed once readings fall this far below the limits so
+	// the level doesn't flap around the limit
+	tempHysteresis  = 5
+	powerHysteresis = 0.9
+)
+
+// throttleLevel returns the throttle level following level given the latest
+// sensor readings. Limits of zero are ignored and power is in milliwatts.
+func throttleLevel(level int, readings []discover.GpuThermal, tempLimit, powerLimit uint64) int {
+	over, cool := false, true
+	for _, r := range readings {
+		if tempLimit > 0 {
+			over = over || r.Temperature > tempLimit
+			cool = cool && r.Temperature+tempHysteresis <= tempLimit
+		}
+
+		if powerLimit > 0 {
+			over = over || r.Power > powerLimit
+			cool = cool && float64(r.Power) <= float64(powerLimit)*powerHysteresis
+		}
+	}
+
+	switch {
+	case over:
+		return min(level+1, maxThrottleLevel)
+	case cool:
+		return max(level-1, 0)
+	default:
+		return level
+	}
+}
+
+// monitorThermals throttles the runner while any of its GPUs are over the
+// configured temperature or power limits, for example to avoid a laptop
+// shutting down during a long generation
+func (s *llmServer) monitorThermals(ctx context.Context) {
+	tempLimit, powerLimit := uint64(envconfig.GpuTempLimit()), uint64(envconfig.GpuPowerLimit())*1000
+
+	ticker := time.NewTicker(thermalInterval)
+	defer ticker.Stop()
+
+	level := 0
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			readings := s.thermals()
+			next := throttleLevel(level, readings, tempLimit, powerLimit)
+			if next == level {
+				continue
+			}
+
+			if err := s.setThrottle(ctx, next); err != nil {
+				slog.Debug("failed to update throttle", "error", err)
+				continue
+			}
+
+			if next > level {
+				slog.Warn("GPU over thermal limits, throttling generation", "level", next, "readings", readings)
+			} else {
+				slog.Info("GPU within thermal limits, relaxing throttle", "level", next, "readings", readings)
+			}
+
+			level = next
+		}
+	}
+}
+
+// thermals returns sensor readings for the GPUs the runner was loaded on
+func (s *llmServer) thermals() []discover.GpuThermal {
+	var readings []discover.GpuThermal
+	for _, r := range discover.GetGPUThermals() {
+		for _, gpu := range s.gpus {
+			if gpu.ID == r.ID && gpu.Library == r.Library {
+				readings = append(readings, r)
+				break
+			}
+		}
+	}
+
+	return readings
+}
+
+func (s *llmServer) setThrottle(ctx context.Context, level int) error {
+	var batchSize int
+	if level > 0 {
+		batchSize = max(s.options.NumBatch>>level, 1)
+	}
+
+	data, err := json.Marshal(map[string]any{
+		"batch_size": batchSize,
+		"delay_ms":   (time.Duration(level) * throttleDelay).Milliseconds(),
+	})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, fmt.Sprintf("http://127.0.0.1:%d/throttle", s.port), bytes.NewBuffer(data))
+	if err != nil {
+		return fmt.Errorf("error creating throttle request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("do throttle request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 400 {
+		return fmt.Errorf("throttle request failed: %s", resp.Status)
+	}
+
+	return nil
+}
+
+// energyInterval is how often power draw is sampled during a request
+const energyInterval = 250 * time.Millisecond
+
+// energyMeter estimates the energy used by a request by integrating the power
+// draw of the runner's GPUs over time. The estimate covers everything running
+// on those GPUs, including other requests being processed in parallel.
+type energyMeter struct {
+	mu     sync.Mutex
+	joules float64
+
+	// time and total power in milliwatts of the previous sample
+	last  time.Time
+	power uint64
+
+	stop chan struct{}
+	done chan struct{}
+	once sync.Once
+}
+
+// measureEnergy starts sampling the power draw of the runner's GPUs. It
+// returns nil if the runner isn't using a GPU.
+func (s *llmServer) measureEnergy() *energyMeter {
+	if len(s.gpus) == 0 || s.gpus[0].Library == "cpu" {
+		return nil
+	}
+
+	m := &energyMeter{stop: make(chan struct{}), done: make(chan struct{})}
+	go func() {
+		defer close(m.done)
+
+		ticker := time.NewTicker(energyInterval)
+		defer ticker.Stop()
+
+		for {
+			m.sample(time.Now(), s.thermals())
+
+			select {
+			case <-m.stop:
+				m.sample(time.Now(), s.thermals())
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+
+	return m
+}
+
+func (m *energyMeter) sample(t time.Time, readings []discover.GpuThermal) {
+	var power uint64
+	for _, r := range readings {
+		power += r.Power
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.last.IsZero() {
+		// trapezoidal estimate between the two samples
+		m.joules += float64(m.power+power) / 2 / 1000 * t.Sub(m.last).Seconds()
+	}
+
+	m.last, m.power = t, power
+}
+
+// Stop stops sampling and returns the estimated energy used in joules. It is
+// safe to call more than once.
+func (m *energyMeter) Stop() float64 {
+	if m == nil {
+		return 0
+	}
+
+	m.once.Do(func() {
+		close(m.stop)
+		<-m.done
+	})
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.joules
+}
@@ -0,0 +1,59 @@
+package llm
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/ollama/ollama/discover"
+)
+
+func TestThrottleLevel(t *testing.T) {
+	cases := []struct {
+		name       string
+		level      int
+		readings   []discover.GpuThermal
+		tempLimit  uint64
+		powerLimit uint64
+		expect     int
+	}{
+		{"no limits", 0, []discover.GpuThermal{{Temperature: 95, Power: 200000}}, 0, 0, 0},
+		{"no limits relaxes", 2, []discover.GpuThermal{{Temperature: 95}}, 0, 0, 1},
+		{"under temp", 0, []discover.GpuThermal{{Temperature: 70}}, 80, 0, 0},
+		{"over temp", 0, []discover.GpuThermal{{Temperature: 85}}, 80, 0, 1},
+		{"over temp max", maxThrottleLevel, []discover.GpuThermal{{Temperature: 85}}, 80, 0, maxThrottleLevel},
+		{"within hysteresis", 2, []discover.GpuThermal{{Temperature: 77}}, 80, 0, 2},
+		{"cooled", 2, []discover.GpuThermal{{Temperature: 75}}, 80, 0, 1},
+		{"over power", 1, []discover.GpuThermal{{Temperature: 60, Power: 120000}}, 80, 100000, 2},
+		{"power within hysteresis", 1, []discover.GpuThermal{{Power: 95000}}, 0, 100000, 1},
+		{"one gpu over", 0, []discover.GpuThermal{{Temperature: 60}, {Temperature: 90}}, 80, 0, 1},
+		{"one gpu warm", 1, []discover.GpuThermal{{Temperature: 60}, {Temperature: 78}}, 80, 0, 1},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			if level := throttleLevel(tt.level, tt.readings, tt.tempLimit, tt.powerLimit); level != tt.expect {
+				t.Errorf("expected level %d, got %d", tt.expect, level)
+			}
+		})
+	}
+}
+
+func TestEnergyMeter(t *testing.T) {
+	start := time.Now()
+	m := &energyMeter{}
+
+	// 100W for 2s then ramping up to 200W over 1s
+	m.sample(start, []discover.GpuThermal{{Power: 60000}, {Power: 40000}})
+	m.sample(start.Add(2*time.Second), []discover.GpuThermal{{Power: 60000}, {Power: 40000}})
+	m.sample(start.Add(3*time.Second), []discover.GpuThermal{{Power: 100000}, {Power: 100000}})
+
+	if expect := 200.0 + 150.0; math.Abs(m.joules-expect) > 1e-9 {
+		t.Errorf("expected %f joules, got %f", expect, m.joules)
+	}
+
+	var nilMeter *energyMeter
+	if joules := nilMeter.Stop(); joules != 0 {
+		t.Errorf("expected nil meter to report 0 joules, got %f", joules)
+	}
+}
@@ -0,0 +1,407 @@
+package local
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/llama"
+	"github.com/ollama/ollama/template"
+)
+
+var errFormat = errors.New("structured outputs aren't supported in-process")
+
+// Generate generates a response for req, calling fn with each part of the
+// response as it's generated and a final response with Done set. The model
+// of req is ignored.
+func (m *Model) Generate(ctx context.Context, req *api.GenerateRequest, fn api.GenerateResponseFunc) error {
+	if len(req.Format) > 0 {
+		return errFormat
+	}
+
+	if len(req.Images) > 0 {
+		return errors.New("images aren't supported in-process")
+	}
+
+	opts, err := m.requestOptions(req.Options)
+	if err != nil {
+		return err
+	}
+
+	prompt := req.Prompt
+	if !req.Raw {
+		tmpl := m.template
+		if req.Template != "" {
+			if tmpl, err = template.Parse(req.Template); err != nil {
+				return err
+			}
+		}
+
+		var msgs []api.Message
+		if system := cmp.Or(req.System, m.system); system != "" {
+			msgs = append(msgs, api.Message{Role: "system", Content: system})
+		}
+
+		var b bytes.Buffer
+		values := template.Values{Messages: append(msgs, api.Message{Role: "user", Content: req.Prompt})}
+		if req.Suffix != "" {
+			values = template.Values{Prompt: req.Prompt, Suffix: req.Suffix}
+		}
+
+		if err := tmpl.Execute(&b, values); err != nil {
+			return err
+		}
+
+		prompt = b.String()
+	}
+
+	tokens, metrics, reason, err := m.completion(ctx, req.Context, prompt, opts, func(piece string) error {
+		return fn(api.GenerateResponse{Model: m.name, CreatedAt: time.Now().UTC(), Response: piece})
+	})
+	if err != nil {
+		return err
+	}
+
+	return fn(api.GenerateResponse{
+		Model:      m.name,
+		CreatedAt:  time.Now().UTC(),
+		Done:       true,
+		DoneReason: reason,
+		Context:    tokens,
+		Metrics:    metrics,
+	})
+}
+
+// Chat generates the next message in the chat req, calling fn with each part
+// of the message as it's generated and a final response with Done set. The
+// model of req is ignored.
+func (m *Model) Chat(ctx context.Context, req *api.ChatRequest, fn api.ChatResponseFunc) error {
+	if len(req.Format) > 0 {
+		return errFormat
+	}
+
+	if len(req.Tools) > 0 {
+		return errors.New("tools aren't supported in-process")
+	}
+
+	opts, err := m.requestOptions(req.Options)
+	if err != nil {
+		return err
+	}
+
+	msgs := req.Messages
+	if m.system != "" && !slices.ContainsFunc(msgs, func(msg api.Message) bool { return msg.Role == "system" }) {
+		msgs = append([]api.Message{{Role: "system", Content: m.system}}, msgs...)
+	}
+
+	for _, msg := range msgs {
+		if len(msg.Images) > 0 {
+			return errors.New("images aren't supported in-process")
+		}
+	}
+
+	tmpl := m.template
+	if req.Template != "" {
+		if tmpl, err = template.Parse(req.Template); err != nil {
+			return err
+		}
+	}
+
+	var b bytes.Buffer
+	if err := tmpl.Execute(&b, template.Values{Messages: msgs}); err != nil {
+		return err
+	}
+
+	_, metrics, reason, err := m.completion(ctx, nil, b.String(), opts, func(piece string) error {
+		return fn(api.ChatResponse{Model: m.name, CreatedAt: time.Now().UTC(), Message: api.Message{Role: "assistant", Content: piece}})
+	})
+	if err != nil {
+		return err
+	}
+
+	return fn(api.ChatResponse{
+		Model:      m.name,
+		CreatedAt:  time.Now().UTC(),
+		Message:    api.Message{Role: "assistant"},
+		Done:       true,
+		DoneReason: reason,
+		Metrics:    metrics,
+	})
+}
+
+// Embed returns normalized embeddings of each input
+func (m *Model) Embed(ctx context.Context, input []string) ([][]float32, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.model == nil {
+		return nil, errClosed
+	}
+
+	embeddings := make([][]float32, len(input))
+	for i, text := range input {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		tokens, err := m.model.Tokenize(text, m.model.AddBOSToken(), true)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(tokens) > m.options.NumCtx {
+			return nil, fmt.Errorf("input %d of %d tokens exceeds the context length of %d", i, len(tokens), m.options.NumCtx)
+		}
+
+		m.lc.KvCacheClear()
+		if err := m.decode(ctx, tokens, 0); err != nil {
+			return nil, err
+		}
+
+		embedding := m.lc.GetEmbeddingsSeq(0)
+		if embedding == nil {
+			embedding = m.lc.GetEmbeddingsIth(m.batch.NumTokens() - 1)
+		}
+
+		if embedding == nil {
+			return nil, errors.New("model doesn't support embeddings")
+		}
+
+		// the embedding is owned by the context and overwritten by the next batch
+		embeddings[i] = normalize(slices.Clone(embedding))
+	}
+
+	return embeddings, nil
+}
+
+// Logits returns the final-layer logits the model computes at each position
+// of tokens, for example to compare outputs across builds
+func (m *Model) Logits(ctx context.Context, tokens []int) ([][]float32, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.model == nil {
+		return nil, errClosed
+	}
+
+	if len(tokens) > m.options.NumCtx {
+		return nil, fmt.Errorf("input of %d tokens exceeds the context length of %d", len(tokens), m.options.NumCtx)
+	}
+
+	m.lc.KvCacheClear()
+
+	logits := make([][]float32, 0, len(tokens))
+	for i := 0; i < len(tokens); i += m.batch.Size() {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		m.batch.Clear()
+		for j, t := range tokens[i:min(i+m.batch.Size(), len(tokens))] {
+			m.batch.Add(t, nil, i+j, true, 0)
+		}
+
+		if err := m.lc.Decode(m.batch); err != nil {
+			return nil, err
+		}
+
+		for j := range m.batch.NumTokens() {
+			// the logits are owned by the context and overwritten by the next batch
+			logits = append(logits, slices.Clone(m.lc.GetLogitsIth(j)))
+		}
+	}
+
+	return logits, nil
+}
+
+// requestOptions returns the model's options with those of a request
+// applied. Options that affect how the model is loaded are ignored.
+func (m *Model) requestOptions(options map[string]any) (api.Options, error) {
+	opts := m.options
+	if err := fromMap(&opts, options); err != nil {
+		return api.Options{}, err
+	}
+
+	opts.Runner = m.options.Runner
+	return opts, nil
+}
+
+// completion generates text following prompt, which is appended to the
+// tokens of a previous response if there are any, calling fn with each piece
+// of text. It returns the tokens of the prompt and response.
+func (m *Model) completion(ctx context.Context, previous []int, prompt string, opts api.Options, fn func(string) error) ([]int, api.Metrics, string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.model == nil {
+		return nil, api.Metrics{}, "", errClosed
+	}
+
+	start := time.Now()
+	tokens, err := m.model.Tokenize(prompt, len(previous) == 0 && m.model.AddBOSToken(), true)
+	if err != nil {
+		return nil, api.Metrics{}, "", err
+	}
+
+	tokens = append(slices.Clone(previous), tokens...)
+	if len(tokens) >= m.options.NumCtx {
+		return nil, api.Metrics{}, "", fmt.Errorf("prompt of %d tokens exceeds the context length of %d", len(tokens), m.options.NumCtx)
+	}
+
+	sampler, err := llama.NewSamplingContext(m.model, llama.SamplingParams{
+		TopK:           opts.TopK,
+		TopP:           opts.TopP,
+		MinP:           opts.MinP,
+		TypicalP:       opts.TypicalP,
+		Temp:           opts.Temperature,
+		RepeatLastN:    opts.RepeatLastN,
+		PenaltyRepeat:  opts.RepeatPenalty,
+		PenaltyFreq:    opts.FrequencyPenalty,
+		PenaltyPresent: opts.PresencePenalty,
+		Mirostat:       opts.Mirostat,
+		MirostatTau:    opts.MirostatTau,
+		MirostatEta:    opts.MirostatEta,
+		PenalizeNl:     opts.PenalizeNewline,
+		Seed:           uint32(opts.Seed),
+	})
+	if err != nil {
+		return nil, api.Metrics{}, "", err
+	}
+
+	for _, t := range tokens {
+		sampler.Accept(t, false)
+	}
+
+	m.lc.KvCacheClear()
+	if err := m.decode(ctx, tokens, 0); err != nil {
+		return nil, api.Metrics{}, "", err
+	}
+
+	metrics := api.Metrics{PromptEvalCount: len(tokens), PromptEvalDuration: time.Since(start)}
+	evalStart := time.Now()
+
+	var pending string
+	reason := "length"
+	for opts.NumPredict < 0 || metrics.EvalCount < opts.NumPredict {
+		if len(tokens) >= m.options.NumCtx {
+			break
+		}
+
+		token := sampler.Sample(m.lc, m.batch.NumTokens()-1)
+		sampler.Accept(token, true)
+		metrics.EvalCount++
+
+		if m.model.TokenIsEog(token) {
+			reason = "stop"
+			break
+		}
+
+		tokens = append(tokens, token)
+		pending += m.model.TokenToPiece(token)
+
+		var piece string
+		var stopped bool
+		piece, pending, stopped = splitPending(pending, opts.Stop)
+		if piece != "" {
+			if err := fn(piece); err != nil {
+				return nil, metrics, "", err
+			}
+		}
+
+		if stopped {
+			pending, reason = "", "stop"
+			break
+		}
+
+		if err := m.decode(ctx, []int{token}, len(tokens)-1); err != nil {
+			return nil, metrics, "", err
+		}
+	}
+
+	// drop partial characters left at the end of the response
+	for !utf8.ValidString(pending) {
+		pending = pending[:len(pending)-1]
+	}
+
+	if pending != "" {
+		if err := fn(pending); err != nil {
+			return nil, metrics, "", err
+		}
+	}
+
+	metrics.EvalDuration = time.Since(evalStart)
+	metrics.TotalDuration = time.Since(start)
+	return tokens, metrics, reason, nil
+}
+
+// decode processes tokens starting at position pos in batches, computing
+// logits for the final token only
+func (m *Model) decode(ctx context.Context, tokens []int, pos int) error {
+	for i := 0; i < len(tokens); i += m.batch.Size() {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		m.batch.Clear()
+		for j, t := range tokens[i:min(i+m.batch.Size(), len(tokens))] {
+			m.batch.Add(t, nil, pos+i+j, i+j == len(tokens)-1, 0)
+		}
+
+		if err := m.lc.Decode(m.batch); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// splitPending returns the part of pending that can be sent and the part
+// that must be held back, either because it's a partial character or might
+// be the start of a stop sequence. If pending contains a stop sequence the
+// text before it is returned and stopped is true.
+func splitPending(pending string, stops []string) (send, hold string, stopped bool) {
+	for _, stop := range stops {
+		if i := strings.Index(pending, stop); i >= 0 {
+			return pending[:i], "", true
+		}
+	}
+
+	for _, stop := range stops {
+		for i := 1; i < len(stop); i++ {
+			if strings.HasSuffix(pending, stop[:i]) {
+				return "", pending, false
+			}
+		}
+	}
+
+	if !utf8.ValidString(pending) {
+		return "", pending, false
+	}
+
+	return pending, "", false
+}
+
+func normalize(vec []float32) []float32 {
+	var sum float32
+	for _, v := range vec {
+		sum += v * v
+	}
+
+	norm := float32(0.0)
+	if sum > 0 {
+		norm = float32(1.0 / math.Sqrt(float64(sum)))
+	}
+
+	for i := range vec {
+		vec[i] *= norm
+	}
+	return vec
+}
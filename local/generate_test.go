@@ -0,0 +1,355 @@
+package local
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/llm"
+)
+
+type tensor []float32
+
+func (t tensor) WriteTo(w io.Writer) (int64, error) {
+	if err := binary.Write(w, binary.LittleEndian, []float32(t)); err != nil {
+		return 0, err
+	}
+
+	return int64(len(t) * 4), nil
+}
+
+// load loads a tiny llama model with random weights, whose vocabulary has
+// byte tokens so any text can be tokenized
+func load(t *testing.T) *Model {
+	t.Helper()
+
+	tokens := []string{"<unk>", "<s>", "</s>"}
+	types := []int32{2, 3, 3}
+	for b := range 256 {
+		tokens = append(tokens, fmt.Sprintf("<0x%02X>", b))
+		types = append(types, 6)
+	}
+
+	for _, piece := range []string{"▁", "▁hi", "▁there", "▁user", ":"} {
+		tokens = append(tokens, piece)
+		types = append(types, 1)
+	}
+
+	scores := make([]float32, len(tokens))
+	for i := range scores {
+		scores[i] = -float32(i)
+	}
+
+	const embedSize, ffnSize = 16, 32
+	vocabSize := uint64(len(tokens))
+
+	r := rand.New(rand.NewPCG(1, 2))
+	random := func(rows, cols uint64) llm.Tensor {
+		data := make(tensor, rows*cols)
+		for i := range data {
+			data[i] = float32(r.NormFloat64() / math.Sqrt(float64(cols)))
+		}
+
+		return llm.Tensor{Kind: 0, Shape: []uint64{rows, cols}, WriterTo: data}
+	}
+
+	ones := func(n uint64) llm.Tensor {
+		data := make(tensor, n)
+		for i := range data {
+			data[i] = 1
+		}
+
+		return llm.Tensor{Kind: 0, Shape: []uint64{n}, WriterTo: data}
+	}
+
+	var tensors []llm.Tensor
+	add := func(name string, t llm.Tensor) {
+		t.Name = name
+		tensors = append(tensors, t)
+	}
+
+	add("token_embd.weight", random(vocabSize, embedSize))
+	add("output_norm.weight", ones(embedSize))
+	add("output.weight", random(vocabSize, embedSize))
+	add("blk.0.attn_norm.weight", ones(embedSize))
+	add("blk.0.attn_q.weight", random(embedSize, embedSize))
+	add("blk.0.attn_k.weight", random(embedSize, embedSize))
+	add("blk.0.attn_v.weight", random(embedSize, embedSize))
+	add("blk.0.attn_output.weight", random(embedSize, embedSize))
+	add("blk.0.ffn_norm.weight", ones(embedSize))
+	add("blk.0.ffn_gate.weight", random(ffnSize, embedSize))
+	add("blk.0.ffn_up.weight", random(ffnSize, embedSize))
+	add("blk.0.ffn_down.weight", random(embedSize, ffnSize))
+
+	path := filepath.Join(t.TempDir(), "model.gguf")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	if err := llm.WriteGGUF(f, llm.KV{
+		"general.architecture":                   "llama",
+		"llama.context_length":                   uint32(256),
+		"llama.embedding_length":                 uint32(embedSize),
+		"llama.block_count":                      uint32(1),
+		"llama.feed_forward_length":              uint32(ffnSize),
+		"llama.attention.head_count":             uint32(4),
+		"llama.attention.head_count_kv":          uint32(4),
+		"llama.attention.layer_norm_rms_epsilon": float32(1e-5),
+		"tokenizer.ggml.model":                   "llama",
+		"tokenizer.ggml.tokens":                  tokens,
+		"tokenizer.ggml.scores":                  scores,
+		"tokenizer.ggml.token_type":              types,
+		"tokenizer.ggml.bos_token_id":            uint32(1),
+		"tokenizer.ggml.eos_token_id":            uint32(2),
+		"tokenizer.ggml.unknown_token_id":        uint32(0),
+	}, tensors); err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := Load(path, map[string]any{"num_ctx": 256, "num_gpu": 0, "num_thread": 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { m.Close() })
+
+	return m
+}
+
+// options generate up to n tokens without sampling, so responses repeat
+func options(n int) map[string]any {
+	return map[string]any{"num_predict": n, "temperature": 0, "seed": 1}
+}
+
+func TestGenerate(t *testing.T) {
+	m := load(t)
+
+	var responses []api.GenerateResponse
+	if err := m.Generate(context.Background(), &api.GenerateRequest{
+		Prompt:   "hi there",
+		Template: "user: {{ .Prompt }}",
+		Options:  options(4),
+	}, func(r api.GenerateResponse) error {
+		responses = append(responses, r)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	final := responses[len(responses)-1]
+	if !final.Done {
+		t.Fatalf("expected the last response to be done, got %+v", final)
+	}
+
+	// the prompt is the request's template applied to its prompt
+	prompt, err := m.Tokenize("user: hi there")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if final.PromptEvalCount != len(prompt) {
+		t.Errorf("expected %d prompt tokens, got %d", len(prompt), final.PromptEvalCount)
+	}
+
+	if diff := cmp.Diff(final.Context[:min(len(prompt), len(final.Context))], prompt); diff != "" {
+		t.Errorf("mismatch (-got +want):\n%s", diff)
+	}
+
+	// the context continues with the generated tokens, which are the text of
+	// the responses other than a partial character at the end
+	var sb strings.Builder
+	for _, r := range responses[:len(responses)-1] {
+		if r.Done || r.Model != final.Model {
+			t.Errorf("unexpected response %+v", r)
+		}
+		sb.WriteString(r.Response)
+	}
+
+	generated, err := m.Detokenize(final.Context[len(prompt):])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if rest, ok := strings.CutPrefix(generated, sb.String()); !ok || utf8.ValidString(rest) && rest != "" {
+		t.Errorf("expected responses %q, got %q", generated, sb.String())
+	}
+
+	if final.EvalCount > 4 || final.EvalCount < len(final.Context)-len(prompt) {
+		t.Errorf("expected up to 4 generated tokens, got %d with %d in the context", final.EvalCount, len(final.Context)-len(prompt))
+	}
+
+	// a raw prompt is used as is, and continues the previous context
+	var next api.GenerateResponse
+	if err := m.Generate(context.Background(), &api.GenerateRequest{
+		Prompt:  " there",
+		Raw:     true,
+		Context: final.Context,
+		Options: options(1),
+	}, func(r api.GenerateResponse) error {
+		next = r
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	raw, err := m.model.Tokenize(" there", false, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if next.PromptEvalCount != len(final.Context)+len(raw) {
+		t.Errorf("expected %d prompt tokens, got %d", len(final.Context)+len(raw), next.PromptEvalCount)
+	}
+}
+
+func TestChat(t *testing.T) {
+	m := load(t)
+
+	chat := func(req *api.ChatRequest) (string, api.ChatResponse) {
+		t.Helper()
+
+		var sb strings.Builder
+		var final api.ChatResponse
+		if err := m.Chat(context.Background(), req, func(r api.ChatResponse) error {
+			if r.Message.Role != "assistant" {
+				t.Errorf("expected assistant messages, got %q", r.Message.Role)
+			}
+
+			sb.WriteString(r.Message.Content)
+			final = r
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+
+		if !final.Done {
+			t.Fatalf("expected the last response to be done, got %+v", final)
+		}
+
+		return sb.String(), final
+	}
+
+	messages := []api.Message{{Role: "user", Content: "hi"}, {Role: "assistant", Content: "hi there"}, {Role: "user", Content: "hi"}}
+	content, final := chat(&api.ChatRequest{
+		Messages: messages,
+		Template: "{{ range .Messages }}{{ .Role }}: {{ .Content }}\n{{ end }}",
+		Options:  options(4),
+	})
+
+	// the prompt is the request's template applied to the messages
+	prompt, err := m.Tokenize("user: hi\nassistant: hi there\nuser: hi\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if final.PromptEvalCount != len(prompt) {
+		t.Errorf("expected %d prompt tokens, got %d", len(prompt), final.PromptEvalCount)
+	}
+
+	if final.EvalCount == 0 || final.EvalCount > 4 {
+		t.Errorf("expected up to 4 generated tokens, got %d", final.EvalCount)
+	}
+
+	// generating is deterministic without sampling
+	if again, _ := chat(&api.ChatRequest{Messages: messages, Template: "{{ range .Messages }}{{ .Role }}: {{ .Content }}\n{{ end }}", Options: options(4)}); again != content {
+		t.Errorf("expected %q again, got %q", content, again)
+	}
+
+	if _, final := chat(&api.ChatRequest{Messages: messages, Options: options(1)}); final.PromptEvalCount == len(prompt) {
+		t.Errorf("expected the model's template to make a different prompt than %d tokens", len(prompt))
+	}
+
+	if err := m.Chat(context.Background(), &api.ChatRequest{Messages: messages, Template: "{{ .Invalid"}, func(api.ChatResponse) error { return nil }); err == nil {
+		t.Error("expected an error for an invalid template")
+	}
+}
+
+func TestEmbed(t *testing.T) {
+	m := load(t)
+
+	embeddings, err := m.Embed(context.Background(), []string{"hi", "hi there", "hi"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(embeddings) != 3 {
+		t.Fatalf("expected 3 embeddings, got %d", len(embeddings))
+	}
+
+	for i, e := range embeddings {
+		if len(e) != 16 {
+			t.Fatalf("embedding %d: expected 16 values, got %d", i, len(e))
+		}
+
+		var norm float64
+		for _, v := range e {
+			norm += float64(v * v)
+		}
+
+		if math.Abs(norm-1) > 1e-4 {
+			t.Errorf("embedding %d: expected to be normalized, has a norm of %f", i, math.Sqrt(norm))
+		}
+	}
+
+	if diff := cmp.Diff(embeddings[0], embeddings[2]); diff != "" {
+		t.Errorf("expected the same input to have the same embedding (-got +want):\n%s", diff)
+	}
+
+	if cmp.Equal(embeddings[0], embeddings[1]) {
+		t.Error("expected different inputs to have different embeddings")
+	}
+}
+
+func TestSplitPending(t *testing.T) {
+	cases := []struct {
+		name    string
+		pending string
+		stops   []string
+		send    string
+		hold    string
+		stopped bool
+	}{
+		{"no stops", "hello", nil, "hello", "", false},
+		{"unrelated stop", "hello", []string{"</s>"}, "hello", "", false},
+		{"partial stop", "hello <", []string{"</s>"}, "", "hello <", false},
+		{"stop", "hello </s> world", []string{"</s>"}, "hello ", "", true},
+		{"second stop", "hello\n\nworld", []string{"</s>", "\n\n"}, "hello", "", true},
+		{"partial character", "caf\xc3", nil, "", "caf\xc3", false},
+		{"complete character", "caf\xc3\xa9", nil, "café", "", false},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			send, hold, stopped := splitPending(tt.pending, tt.stops)
+			if send != tt.send || hold != tt.hold || stopped != tt.stopped {
+				t.Errorf("expected (%q, %q, %v), got (%q, %q, %v)", tt.send, tt.hold, tt.stopped, send, hold, stopped)
+			}
+		})
+	}
+}
+
+func TestParseTensorSplit(t *testing.T) {
+	if split := parseTensorSplit(""); split != nil {
+		t.Errorf("expected no split, got %v", split)
+	}
+
+	if split := parseTensorSplit("3,1"); len(split) != 2 || split[0] != 3 || split[1] != 1 {
+		t.Errorf("expected [3 1], got %v", split)
+	}
+
+	if split := parseTensorSplit("3,x"); split != nil {
+		t.Errorf("expected invalid split to be ignored, got %v", split)
+	}
+}
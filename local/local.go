@@ -0,0 +1,238 @@
+// Package local runs models in-process, for Go applications that want to
+// embed inference without running the Ollama server.
+//
+// Models are loaded from the local model store by name, or from a GGUF file
+// by path, and use the same llama.cpp engine as the server:
+//
+//	m, err := local.Load("llama3.2", nil)
+//	if err != nil {
+//		return err
+//	}
+//	defer m.Close()
+//
+//	err = m.Chat(ctx, &api.ChatRequest{Messages: messages}, func(r api.ChatResponse) error {
+//		fmt.Print(r.Message.Content)
+//		return nil
+//	})
+//
+// A Model processes one request at a time. Images, tools and structured
+// outputs aren't supported yet.
+package local
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/discover"
+	"github.com/ollama/ollama/llama"
+	"github.com/ollama/ollama/llm"
+	"github.com/ollama/ollama/server"
+	"github.com/ollama/ollama/template"
+)
+
+var errClosed = errors.New("model is closed")
+
+// Model is a model loaded into this process
+type Model struct {
+	name     string
+	system   string
+	template *template.Template
+	options  api.Options
+
+	mu    sync.Mutex
+	model *llama.Model
+	lc    *llama.Context
+	batch *llama.Batch
+}
+
+// Load loads the model name, which is either the name of a model in the local
+// store or the path to a GGUF file. Options override the model's default
+// options and those that affect how the model is loaded, such as num_ctx and
+// num_gpu, can only be set here.
+func Load(name string, options map[string]any) (*Model, error) {
+	m := &Model{name: name, template: template.DefaultTemplate, options: api.DefaultOptions()}
+
+	path := name
+	var adapters []string
+	if _, err := os.Stat(name); err != nil {
+		sm, err := server.GetModel(name)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+
+		if len(sm.ProjectorPaths) > 0 {
+			return nil, fmt.Errorf("%s: multimodal models aren't supported in-process", name)
+		}
+
+		if sm.SoftPromptPath != "" {
+			return nil, fmt.Errorf("%s: soft prompts aren't supported in-process", name)
+		}
+
+		if err := m.options.FromMap(sm.Options); err != nil {
+			return nil, err
+		}
+
+		path, adapters = sm.ModelPath, sm.AdapterPaths
+		m.name, m.system, m.template = sm.ShortName, sm.System, sm.Template
+	}
+
+	if err := fromMap(&m.options, options); err != nil {
+		return nil, err
+	}
+
+	ggml, err := llm.LoadModel(path, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	params := llama.ModelParams{
+		NumGpuLayers: m.options.NumGPU,
+		MainGpu:      m.options.MainGPU,
+		UseMmap:      m.options.UseMMap == nil || *m.options.UseMMap,
+		UseMlock:     m.options.UseMLock,
+	}
+
+	if params.NumGpuLayers < 0 {
+		gpus := discover.GetGPUInfo()
+		if len(gpus) == 0 || gpus[0].Library == "cpu" {
+			params.NumGpuLayers = 0
+		} else {
+			estimate := llm.EstimateGPULayers(gpus, ggml, nil, m.options)
+			params.NumGpuLayers = estimate.Layers
+			params.TensorSplit = parseTensorSplit(estimate.TensorSplit)
+		}
+	}
+
+	threads := m.options.NumThread
+	if threads <= 0 {
+		threads = max(discover.GetSystemInfo().GetOptimalThreadCount(), 1)
+	}
+
+	llama.BackendInit()
+
+	slog.Info("loading model in-process", "model", path, "gpu_layers", params.NumGpuLayers, "threads", threads)
+	m.model, err = llama.LoadModelFromFile(path, params)
+	if err != nil {
+		return nil, err
+	}
+
+	m.lc, err = llama.NewContextWithModel(m.model, llama.NewContextParams(m.options.NumCtx, m.options.NumBatch, 1, threads, false, "", ""))
+	if err != nil {
+		llama.FreeModel(m.model)
+		return nil, err
+	}
+
+	for _, adapter := range adapters {
+		if err := m.model.ApplyLoraFromFile(m.lc, adapter, 1.0, threads); err != nil {
+			m.Close()
+			return nil, err
+		}
+	}
+
+	m.batch, err = llama.NewBatch(m.options.NumBatch, 1, 0)
+	if err != nil {
+		m.Close()
+		return nil, err
+	}
+
+	return m, nil
+}
+
+// Close frees the model. It is safe to call more than once.
+func (m *Model) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.batch != nil {
+		m.batch.Free()
+		m.batch = nil
+	}
+
+	if m.lc != nil {
+		m.lc.Free()
+		m.lc = nil
+	}
+
+	if m.model != nil {
+		llama.FreeModel(m.model)
+		m.model = nil
+	}
+
+	return nil
+}
+
+// Tokenize returns the tokens of text, including any special tokens it
+// contains
+func (m *Model) Tokenize(text string) ([]int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.model == nil {
+		return nil, errClosed
+	}
+
+	return m.model.Tokenize(text, m.model.AddBOSToken(), true)
+}
+
+// Detokenize returns the text of tokens
+func (m *Model) Detokenize(tokens []int) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.model == nil {
+		return "", errClosed
+	}
+
+	var sb strings.Builder
+	for _, t := range tokens {
+		sb.WriteString(m.model.TokenToPiece(t))
+	}
+
+	return sb.String(), nil
+}
+
+// fromMap applies options to opts. Options are round tripped through JSON so
+// they can be given as any Go numeric type rather than only those JSON
+// decodes to.
+func fromMap(opts *api.Options, options map[string]any) error {
+	if len(options) == 0 {
+		return nil
+	}
+
+	b, err := json.Marshal(options)
+	if err != nil {
+		return err
+	}
+
+	var m map[string]any
+	if err := json.Unmarshal(b, &m); err != nil {
+		return err
+	}
+
+	return opts.FromMap(m)
+}
+
+func parseTensorSplit(s string) []float32 {
+	if s == "" {
+		return nil
+	}
+
+	var split []float32
+	for _, f := range strings.Split(s, ",") {
+		v, err := strconv.ParseFloat(f, 32)
+		if err != nil {
+			return nil
+		}
+
+		split = append(split, float32(v))
+	}
+
+	return split
+}
@@ -0,0 +1,367 @@
+// Package logutil filters the server's slog output by subsystem, with levels
+// which can be changed while the server is running, and tags records with the
+// ID and metadata of the request they were logged for.
+package logutil
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/ollama/ollama/envconfig"
+)
+
+// Subsystems which can be given their own level
+const (
+	Scheduler = "scheduler"
+	Runner    = "runner"
+	Server    = "server"
+	Registry  = "registry"
+	ML        = "ml"
+)
+
+// Subsystems lists every subsystem
+var Subsystems = []string{Scheduler, Runner, Server, Registry, ML}
+
+// sources maps a source file, or the files of a package, relative to the
+// module to the subsystem it logs for. The first match wins.
+var sources = []struct {
+	prefix    string
+	subsystem string
+}{
+	{"server/sched.go", Scheduler},
+	{"server/download.go", Registry},
+	{"server/upload.go", Registry},
+	{"server/auth.go", Registry},
+	{"server/", Server},
+	{"llm/", Runner},
+	{"llama/runner/", Runner},
+	{"llama/", ML},
+	{"discover/", ML},
+}
+
+const module = "github.com/ollama/ollama/"
+
+// Config is the level of each subsystem. Subsystems without their own level
+// use Level.
+type Config struct {
+	Level      slog.Level
+	Subsystems map[string]slog.Level
+}
+
+// For returns the level of subsystem
+func (c Config) For(subsystem string) slog.Level {
+	if level, ok := c.Subsystems[subsystem]; ok {
+		return level
+	}
+
+	return c.Level
+}
+
+// String formats c in the form accepted by Parse
+func (c Config) String() string {
+	entries := []string{c.Level.String()}
+	for _, name := range slices.Sorted(maps.Keys(c.Subsystems)) {
+		entries = append(entries, name+"="+c.Subsystems[name].String())
+	}
+
+	return strings.Join(entries, ",")
+}
+
+// min returns the lowest level of any subsystem
+func (c Config) min() slog.Level {
+	level := c.Level
+	for _, l := range c.Subsystems {
+		level = min(level, l)
+	}
+
+	return level
+}
+
+// Parse parses a comma separated list of levels such as
+// "info,scheduler=debug,registry=warn". An entry without a subsystem sets the
+// default level, which is info if not given.
+func Parse(s string) (Config, error) {
+	c := Config{Level: slog.LevelInfo, Subsystems: make(map[string]slog.Level)}
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		name, value, ok := strings.Cut(entry, "=")
+		if !ok {
+			name, value = "", name
+		}
+
+		level, err := ParseLevel(value)
+		if err != nil {
+			return Config{}, err
+		}
+
+		if name == "" {
+			c.Level = level
+			continue
+		}
+
+		if err := validSubsystem(name); err != nil {
+			return Config{}, err
+		}
+
+		c.Subsystems[strings.TrimSpace(name)] = level
+	}
+
+	return c, nil
+}
+
+// ParseLevel parses a level name such as "debug" or "warn"
+func ParseLevel(s string) (slog.Level, error) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(strings.TrimSpace(s))); err != nil {
+		return 0, fmt.Errorf("invalid log level %q", s)
+	}
+
+	return level, nil
+}
+
+func validSubsystem(name string) error {
+	if !slices.Contains(Subsystems, strings.TrimSpace(name)) {
+		return fmt.Errorf("unknown subsystem %q, expected one of %s", name, strings.Join(Subsystems, ", "))
+	}
+
+	return nil
+}
+
+// FromEnv returns the levels set by OLLAMA_LOG_LEVEL. OLLAMA_DEBUG lowers the
+// default level to debug.
+func FromEnv() (Config, error) {
+	c, err := Parse(envconfig.LogLevel())
+	if err != nil {
+		return Config{}, err
+	}
+
+	if envconfig.Debug() {
+		c.Level = min(c.Level, slog.LevelDebug)
+	}
+
+	return c, nil
+}
+
+var (
+	mu     sync.RWMutex
+	config = Config{Level: slog.LevelInfo}
+)
+
+func init() {
+	// invalid levels are reported by the server when it starts
+	if c, err := FromEnv(); err == nil {
+		config = c
+	}
+}
+
+// Current returns the levels in use
+func Current() Config {
+	mu.RLock()
+	defer mu.RUnlock()
+
+	return Config{Level: config.Level, Subsystems: maps.Clone(config.Subsystems)}
+}
+
+// Set replaces the levels in use
+func Set(c Config) error {
+	for name := range c.Subsystems {
+		if err := validSubsystem(name); err != nil {
+			return err
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	config = Config{Level: c.Level, Subsystems: maps.Clone(c.Subsystems)}
+	return nil
+}
+
+// Enabled reports whether subsystem logs records at level
+func Enabled(subsystem string, level slog.Level) bool {
+	mu.RLock()
+	defer mu.RUnlock()
+
+	return level >= config.For(subsystem)
+}
+
+type requestIDKey struct{}
+
+// WithRequestID returns a copy of ctx carrying the request ID id
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// RequestID returns the request ID carried by ctx, if any
+func RequestID(ctx context.Context) string {
+	if ctx == nil {
+		return ""
+	}
+
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+type metadataKey struct{}
+
+// WithMetadata returns a copy of ctx carrying the client's metadata for a
+// request
+func WithMetadata(ctx context.Context, metadata map[string]string) context.Context {
+	return context.WithValue(ctx, metadataKey{}, metadata)
+}
+
+// Metadata returns the request metadata carried by ctx, if any
+func Metadata(ctx context.Context) map[string]string {
+	if ctx == nil {
+		return nil
+	}
+
+	metadata, _ := ctx.Value(metadataKey{}).(map[string]string)
+	return metadata
+}
+
+// metadataAttr returns metadata as a group with its keys in order
+func metadataAttr(metadata map[string]string) slog.Attr {
+	var args []any
+	for _, k := range slices.Sorted(maps.Keys(metadata)) {
+		args = append(args, slog.String(k, metadata[k]))
+	}
+
+	return slog.Group("metadata", args...)
+}
+
+// Handler filters records by the level of the subsystem which logged them,
+// redacts request content when OLLAMA_PRIVATE_LOGS is set, and adds the
+// request ID and metadata from the record's context
+type Handler struct {
+	handler slog.Handler
+}
+
+// NewHandler returns a Handler passing records to h, which must log every
+// level
+func NewHandler(h slog.Handler) *Handler {
+	return &Handler{handler: h}
+}
+
+// NewTextHandler returns a Handler writing text records with their source to
+// w, as the server logs
+func NewTextHandler(w io.Writer) *Handler {
+	return NewHandler(slog.NewTextHandler(w, &slog.HandlerOptions{
+		Level:     minLevel{},
+		AddSource: true,
+		ReplaceAttr: func(_ []string, attr slog.Attr) slog.Attr {
+			if attr.Key == slog.SourceKey {
+				source := attr.Value.Any().(*slog.Source)
+				source.File = filepath.Base(source.File)
+			}
+
+			return attr
+		},
+	}))
+}
+
+// minLevel is the lowest level of any subsystem, so the wrapped handler
+// doesn't filter anything the Handler allows
+type minLevel struct{}
+
+func (minLevel) Level() slog.Level {
+	mu.RLock()
+	defer mu.RUnlock()
+
+	return config.min()
+}
+
+func (h *Handler) Enabled(ctx context.Context, level slog.Level) bool {
+	// the subsystem isn't known until the record's source is, so only
+	// records no subsystem would log are skipped here
+	return level >= minLevel{}.Level() && h.handler.Enabled(ctx, level)
+}
+
+func (h *Handler) Handle(ctx context.Context, r slog.Record) error {
+	if !Enabled(subsystem(r.PC), r.Level) {
+		return nil
+	}
+
+	if private {
+		r = redactRecord(r)
+	}
+
+	if id, metadata := RequestID(ctx), Metadata(ctx); id != "" || len(metadata) > 0 {
+		r = r.Clone()
+		if id != "" {
+			r.AddAttrs(slog.String("request", id))
+		}
+
+		if len(metadata) > 0 {
+			r.AddAttrs(metadataAttr(metadata))
+		}
+	}
+
+	return h.handler.Handle(ctx, r)
+}
+
+func (h *Handler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &Handler{handler: h.handler.WithAttrs(redactAttrs(attrs))}
+}
+
+func (h *Handler) WithGroup(name string) slog.Handler {
+	return &Handler{handler: h.handler.WithGroup(name)}
+}
+
+// callers caches the subsystem of each call site
+var callers sync.Map
+
+// subsystem returns the subsystem of the code at pc, or Server if it's not
+// part of one
+func subsystem(pc uintptr) string {
+	if pc == 0 {
+		return Server
+	}
+
+	if s, ok := callers.Load(pc); ok {
+		return s.(string)
+	}
+
+	frame, _ := runtime.CallersFrames([]uintptr{pc}).Next()
+	s := sourceSubsystem(frame.Function, frame.File)
+	callers.Store(pc, s)
+	return s
+}
+
+// sourceSubsystem returns the subsystem of file, in the package of the fully
+// qualified function name fn
+func sourceSubsystem(fn, file string) string {
+	// the package is everything before the first dot after the last slash
+	pkg := fn
+	if i := strings.LastIndex(pkg, "/"); i >= 0 {
+		if j := strings.Index(pkg[i:], "."); j >= 0 {
+			pkg = pkg[:i+j]
+		}
+	}
+
+	path, ok := strings.CutPrefix(pkg+"/", module)
+	if !ok {
+		return Server
+	}
+
+	path += filepath.Base(file)
+	for _, s := range sources {
+		if strings.HasPrefix(path, s.prefix) {
+			return s.subsystem
+		}
+	}
+
+	return Server
+}
@@ -0,0 +1,166 @@
+package logutil
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestParse(t *testing.T) {
+	cases := []struct {
+		input  string
+		expect Config
+		err    bool
+	}{
+		{"", Config{Level: slog.LevelInfo, Subsystems: map[string]slog.Level{}}, false},
+		{"debug", Config{Level: slog.LevelDebug, Subsystems: map[string]slog.Level{}}, false},
+		{"warn, scheduler=debug,registry=ERROR", Config{Level: slog.LevelWarn, Subsystems: map[string]slog.Level{Scheduler: slog.LevelDebug, Registry: slog.LevelError}}, false},
+		{"runner=debug", Config{Level: slog.LevelInfo, Subsystems: map[string]slog.Level{Runner: slog.LevelDebug}}, false},
+		{"loud", Config{}, true},
+		{"gpu=debug", Config{}, true},
+		{"server=", Config{}, true},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.input, func(t *testing.T) {
+			c, err := Parse(tt.input)
+			if tt.err {
+				if err == nil {
+					t.Fatalf("expected error, got %v", c)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if diff := cmp.Diff(c, tt.expect); diff != "" {
+				t.Errorf("mismatch (-got +want):\n%s", diff)
+			}
+
+			if roundtrip, err := Parse(c.String()); err != nil || !cmp.Equal(roundtrip, c) {
+				t.Errorf("%q didn't round trip: %v %v", c.String(), roundtrip, err)
+			}
+		})
+	}
+}
+
+func TestSourceSubsystem(t *testing.T) {
+	cases := []struct {
+		fn, file, expect string
+	}{
+		{"github.com/ollama/ollama/server.(*Scheduler).processPending.func1", "/src/ollama/server/sched.go", Scheduler},
+		{"github.com/ollama/ollama/server.(*blobDownload).Prepare", "server/download.go", Registry},
+		{"github.com/ollama/ollama/server.GenerateRoutes", "/src/ollama/server/routes.go", Server},
+		{"github.com/ollama/ollama/llm.(*llmServer).Completion", "/src/ollama/llm/server.go", Runner},
+		{"github.com/ollama/ollama/llama/runner.(*Server).run", "/src/ollama/llama/runner/runner.go", Runner},
+		{"github.com/ollama/ollama/llama.LoadModelFromFile", "/src/ollama/llama/llama.go", ML},
+		{"github.com/ollama/ollama/discover.GetGPUInfo", "/src/ollama/discover/gpu.go", ML},
+		{"github.com/ollama/ollama/envconfig.Uint.func1", "/src/ollama/envconfig/config.go", Server},
+		{"log.(*Logger).output", "/usr/lib/go/src/log/log.go", Server},
+	}
+
+	for _, tt := range cases {
+		if s := sourceSubsystem(tt.fn, tt.file); s != tt.expect {
+			t.Errorf("%s: expected %s, got %s", tt.fn, tt.expect, s)
+		}
+	}
+}
+
+func TestHandler(t *testing.T) {
+	prev := Current()
+	t.Cleanup(func() { Set(prev) })
+
+	var b bytes.Buffer
+	logger := slog.New(NewHandler(slog.NewTextHandler(&b, &slog.HandlerOptions{Level: slog.LevelDebug})))
+
+	if err := Set(Config{Level: slog.LevelInfo, Subsystems: map[string]slog.Level{Server: slog.LevelDebug}}); err != nil {
+		t.Fatal(err)
+	}
+
+	// this file isn't part of a subsystem, so logs as the server
+	logger.Debug("first")
+	logger.DebugContext(WithMetadata(WithRequestID(context.Background(), "abc123"), map[string]string{"tenant": "a", "session": "b"}), "second")
+
+	if err := Set(Config{Level: slog.LevelDebug, Subsystems: map[string]slog.Level{Server: slog.LevelWarn}}); err != nil {
+		t.Fatal(err)
+	}
+
+	logger.Info("third")
+	logger.Warn("fourth")
+
+	lines := strings.Split(strings.TrimSpace(b.String()), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("expected 3 lines, got %q", lines)
+	}
+
+	for i, msg := range []string{"msg=first", "msg=second", "msg=fourth"} {
+		if !strings.Contains(lines[i], msg) {
+			t.Errorf("expected line %d to contain %s, got %q", i, msg, lines[i])
+		}
+	}
+
+	if !strings.Contains(lines[1], "request=abc123") {
+		t.Errorf("expected request ID, got %q", lines[1])
+	}
+
+	if !strings.Contains(lines[1], "metadata.session=b metadata.tenant=a") {
+		t.Errorf("expected metadata, got %q", lines[1])
+	}
+
+	if strings.Contains(lines[0], "request=") {
+		t.Errorf("expected no request ID, got %q", lines[0])
+	}
+
+	if Enabled(Server, slog.LevelInfo) || !Enabled(Scheduler, slog.LevelDebug) {
+		t.Errorf("unexpected levels %v", Current())
+	}
+
+	if err := Set(Config{Subsystems: map[string]slog.Level{"gpu": slog.LevelDebug}}); err == nil {
+		t.Error("expected error for unknown subsystem")
+	}
+}
+
+func TestRedact(t *testing.T) {
+	prevPrivate := private
+	t.Cleanup(func() { private = prevPrivate })
+
+	var b bytes.Buffer
+	text := slog.NewTextHandler(&b, &slog.HandlerOptions{Level: slog.LevelDebug})
+
+	private = false
+	slog.New(Redact(text)).Info("generate request", "prompt", "why is the sky blue?")
+	if !strings.Contains(b.String(), `prompt="why is the sky blue?"`) {
+		t.Errorf("expected prompt, got %q", b.String())
+	}
+
+	private = true
+	for _, logger := range []*slog.Logger{slog.New(NewHandler(text)), slog.New(Redact(text))} {
+		b.Reset()
+		logger.With("system", "you are a test").Info("generate request",
+			"prompt", "why is the sky blue?",
+			"input", []int{1, 2, 3},
+			slog.Group("embedding", "content", []byte("secret")),
+			"model", "llama3.2",
+			"images", 1,
+		)
+
+		line := b.String()
+		for _, content := range []string{"sky", "you are a test", "secret"} {
+			if strings.Contains(line, content) {
+				t.Errorf("expected %q to be redacted, got %q", content, line)
+			}
+		}
+
+		for _, attr := range []string{"system.sha256=", "prompt.sha256=", "prompt.length=20", "input=3", "embedding.content.length=6", "model=llama3.2", "images=1"} {
+			if !strings.Contains(line, attr) {
+				t.Errorf("expected %s, got %q", attr, line)
+			}
+		}
+	}
+}
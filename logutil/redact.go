@@ -0,0 +1,125 @@
+package logutil
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"log/slog"
+	"reflect"
+	"slices"
+
+	"github.com/ollama/ollama/envconfig"
+)
+
+// contentKeys are the keys of attributes which may hold prompts, responses or
+// other content of requests
+var contentKeys = []string{
+	"prompt",
+	"system",
+	"suffix",
+	"messages",
+	"content",
+	"response",
+	"input",
+	"text",
+	"pending",
+	"stop",
+	"tools",
+}
+
+// private is set by OLLAMA_PRIVATE_LOGS
+var private = envconfig.PrivateLogs()
+
+// redact replaces the value of a with its hash and length if a holds request
+// content. Counts, durations and other numbers are kept, since they can't
+// reveal content.
+func redact(a slog.Attr) slog.Attr {
+	v := a.Value.Resolve()
+	switch v.Kind() {
+	case slog.KindGroup:
+		attrs := v.Group()
+		redacted := make([]slog.Attr, len(attrs))
+		for i, attr := range attrs {
+			redacted[i] = redact(attr)
+		}
+
+		return slog.Attr{Key: a.Key, Value: slog.GroupValue(redacted...)}
+	case slog.KindString, slog.KindAny:
+		if !slices.Contains(contentKeys, a.Key) {
+			return a
+		}
+
+		if v.Kind() == slog.KindAny {
+			// token IDs and other slices are logged as their length
+			if rv := reflect.ValueOf(v.Any()); rv.Kind() == reflect.Slice && rv.Type().Elem().Kind() != reflect.Uint8 {
+				return slog.Int(a.Key, rv.Len())
+			}
+		}
+
+		s := v.String()
+		if b, ok := v.Any().([]byte); ok {
+			s = string(b)
+		}
+
+		sum := sha256.Sum256([]byte(s))
+		return slog.Group(a.Key, slog.String("sha256", hex.EncodeToString(sum[:8])), slog.Int("length", len(s)))
+	default:
+		return a
+	}
+}
+
+// redactRecord returns a copy of r with its content redacted
+func redactRecord(r slog.Record) slog.Record {
+	redacted := slog.NewRecord(r.Time, r.Level, r.Message, r.PC)
+	r.Attrs(func(a slog.Attr) bool {
+		redacted.AddAttrs(redact(a))
+		return true
+	})
+
+	return redacted
+}
+
+// Redact returns a handler passing records to h with request content replaced
+// by its hash and length when OLLAMA_PRIVATE_LOGS is set. Records logged with a
+// Handler are always redacted this way, so Redact is for processes such as the
+// runner which don't filter records by subsystem.
+func Redact(h slog.Handler) slog.Handler {
+	return &redactHandler{handler: h}
+}
+
+type redactHandler struct {
+	handler slog.Handler
+}
+
+func (h *redactHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.handler.Enabled(ctx, level)
+}
+
+func (h *redactHandler) Handle(ctx context.Context, r slog.Record) error {
+	if private {
+		r = redactRecord(r)
+	}
+
+	return h.handler.Handle(ctx, r)
+}
+
+func (h *redactHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &redactHandler{handler: h.handler.WithAttrs(redactAttrs(attrs))}
+}
+
+func (h *redactHandler) WithGroup(name string) slog.Handler {
+	return &redactHandler{handler: h.handler.WithGroup(name)}
+}
+
+func redactAttrs(attrs []slog.Attr) []slog.Attr {
+	if !private {
+		return attrs
+	}
+
+	redacted := make([]slog.Attr, len(attrs))
+	for i, a := range attrs {
+		redacted[i] = redact(a)
+	}
+
+	return redacted
+}
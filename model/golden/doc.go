@@ -0,0 +1,10 @@
+// Package golden checks that model architectures produce the same logits
+// across backends and changes to the runtime. Each architecture is covered by
+// a tiny checkpoint with random weights generated from a fixed seed, and its
+// logits for fixed inputs are compared against references in testdata.
+//
+// After an intended change to model outputs, or when adding an architecture,
+// update the references with:
+//
+//	go test ./model/golden -run Golden -update
+package golden
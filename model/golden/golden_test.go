@@ -0,0 +1,303 @@
+package golden
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ollama/ollama/discover"
+	"github.com/ollama/ollama/llm"
+	"github.com/ollama/ollama/local"
+)
+
+var update = flag.Bool("update", false, "update the reference logits in testdata")
+
+const (
+	// outputs may differ by this much between backends and builds
+	tolerance = 1e-3
+
+	vocabSize = 32
+	embedSize = 16
+	ffnSize   = 32
+	numHeads  = 4
+	numLayers = 2
+)
+
+// inputs are the token sequences run through each checkpoint
+var inputs = [][]int{
+	{1, 5, 9, 13},
+	{1, 31, 30, 29, 28, 3, 4, 5},
+}
+
+// checkpoint describes a tiny model with random weights. Checkpoints are
+// generated from a fixed seed rather than stored so they're easy to review.
+type checkpoint struct {
+	arch string
+
+	// kv is merged into the common metadata
+	kv llm.KV
+
+	// headsKV is the number of key and value heads
+	headsKV int
+
+	// bias adds biases to the attention projections
+	bias bool
+
+	// tied uses the token embeddings for the output projection
+	tied bool
+}
+
+var checkpoints = []checkpoint{
+	{arch: "llama", headsKV: numHeads},
+	{arch: "llama", headsKV: 2, kv: llm.KV{"general.name": "llama-gqa"}},
+	{arch: "qwen2", headsKV: 2, bias: true},
+	{arch: "gemma", headsKV: 1, tied: true},
+}
+
+func (c checkpoint) name() string {
+	if name, ok := c.kv["general.name"].(string); ok {
+		return name
+	}
+
+	return c.arch
+}
+
+type tensor struct {
+	data []float32
+}
+
+func (t tensor) WriteTo(w io.Writer) (int64, error) {
+	if err := binary.Write(w, binary.LittleEndian, t.data); err != nil {
+		return 0, err
+	}
+
+	return int64(len(t.data) * 4), nil
+}
+
+// write writes the checkpoint as a GGUF file in dir
+func (c checkpoint) write(t *testing.T, dir string) string {
+	t.Helper()
+
+	r := rand.New(rand.NewPCG(1, uint64(len(c.name()))))
+	random := func(shape ...uint64) llm.Tensor {
+		n := uint64(1)
+		for _, d := range shape {
+			n *= d
+		}
+
+		// scaled so activations stay in a reasonable range
+		scale := 1 / math.Sqrt(float64(shape[len(shape)-1]))
+		data := make([]float32, n)
+		for i := range data {
+			data[i] = float32(r.NormFloat64() * scale)
+		}
+
+		return llm.Tensor{Kind: 0, Shape: shape, WriterTo: tensor{data}}
+	}
+
+	ones := func(n uint64) llm.Tensor {
+		data := make([]float32, n)
+		for i := range data {
+			data[i] = 1
+		}
+
+		return llm.Tensor{Kind: 0, Shape: []uint64{n}, WriterTo: tensor{data}}
+	}
+
+	headSize := uint64(embedSize / numHeads)
+	kvSize := headSize * uint64(c.headsKV)
+
+	var tensors []llm.Tensor
+	add := func(name string, t llm.Tensor) {
+		t.Name = name
+		tensors = append(tensors, t)
+	}
+
+	add("token_embd.weight", random(vocabSize, embedSize))
+	add("output_norm.weight", ones(embedSize))
+	if !c.tied {
+		add("output.weight", random(vocabSize, embedSize))
+	}
+
+	for i := range numLayers {
+		blk := fmt.Sprintf("blk.%d.", i)
+		add(blk+"attn_norm.weight", ones(embedSize))
+		add(blk+"attn_q.weight", random(embedSize, embedSize))
+		add(blk+"attn_k.weight", random(kvSize, embedSize))
+		add(blk+"attn_v.weight", random(kvSize, embedSize))
+		add(blk+"attn_output.weight", random(embedSize, embedSize))
+		if c.bias {
+			add(blk+"attn_q.bias", random(embedSize))
+			add(blk+"attn_k.bias", random(kvSize))
+			add(blk+"attn_v.bias", random(kvSize))
+		}
+
+		add(blk+"ffn_norm.weight", ones(embedSize))
+		add(blk+"ffn_gate.weight", random(ffnSize, embedSize))
+		add(blk+"ffn_up.weight", random(ffnSize, embedSize))
+		add(blk+"ffn_down.weight", random(embedSize, ffnSize))
+	}
+
+	tokens := make([]string, vocabSize)
+	scores := make([]float32, vocabSize)
+	types := make([]int32, vocabSize)
+	for i := range tokens {
+		tokens[i] = fmt.Sprintf("▁t%d", i)
+		scores[i] = -float32(i)
+		types[i] = 1
+	}
+
+	tokens[0], tokens[1], tokens[2] = "<unk>", "<s>", "</s>"
+	types[0], types[1], types[2] = 2, 3, 3
+
+	kv := llm.KV{
+		"general.architecture":                       c.arch,
+		"general.name":                               c.name(),
+		c.arch + ".context_length":                   uint32(64),
+		c.arch + ".embedding_length":                 uint32(embedSize),
+		c.arch + ".block_count":                      uint32(numLayers),
+		c.arch + ".feed_forward_length":              uint32(ffnSize),
+		c.arch + ".attention.head_count":             uint32(numHeads),
+		c.arch + ".attention.head_count_kv":          uint32(c.headsKV),
+		c.arch + ".attention.layer_norm_rms_epsilon": float32(1e-5),
+		c.arch + ".rope.freq_base":                   float32(10000),
+		"tokenizer.ggml.model":                       "llama",
+		"tokenizer.ggml.tokens":                      tokens,
+		"tokenizer.ggml.scores":                      scores,
+		"tokenizer.ggml.token_type":                  types,
+		"tokenizer.ggml.bos_token_id":                uint32(1),
+		"tokenizer.ggml.eos_token_id":                uint32(2),
+		"tokenizer.ggml.unknown_token_id":            uint32(0),
+	}
+
+	for k, v := range c.kv {
+		kv[k] = v
+	}
+
+	path := filepath.Join(dir, c.name()+".gguf")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	if err := llm.WriteGGUF(f, kv, tensors); err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+// backends returns the num_gpu settings to run each checkpoint with
+func backends() map[string]int {
+	backends := map[string]int{"cpu": 0}
+	if gpus := discover.GetGPUInfo(); len(gpus) > 0 && gpus[0].Library != "cpu" {
+		backends["gpu"] = 999
+	}
+
+	return backends
+}
+
+func TestGolden(t *testing.T) {
+	dir := t.TempDir()
+	for _, c := range checkpoints {
+		t.Run(c.name(), func(t *testing.T) {
+			path := c.write(t, dir)
+			reference := filepath.Join("testdata", c.name()+".json")
+
+			for backend, numGPU := range backends() {
+				t.Run(backend, func(t *testing.T) {
+					m, err := local.Load(path, map[string]any{"num_gpu": numGPU, "num_ctx": 64, "num_thread": 1})
+					if err != nil {
+						t.Fatal(err)
+					}
+					defer m.Close()
+
+					var got [][][]float32
+					for _, input := range inputs {
+						logits, err := m.Logits(context.Background(), input)
+						if err != nil {
+							t.Fatal(err)
+						}
+
+						got = append(got, logits)
+					}
+
+					if *update && backend == "cpu" {
+						writeReference(t, reference, got)
+						return
+					}
+
+					compare(t, got, readReference(t, reference))
+				})
+			}
+		})
+	}
+}
+
+func compare(t *testing.T, got, expect [][][]float32) {
+	t.Helper()
+
+	if len(got) != len(expect) {
+		t.Fatalf("expected %d inputs, got %d", len(expect), len(got))
+	}
+
+	for i := range expect {
+		if len(got[i]) != len(expect[i]) {
+			t.Fatalf("input %d: expected %d positions, got %d", i, len(expect[i]), len(got[i]))
+		}
+
+		for pos := range expect[i] {
+			if len(got[i][pos]) != len(expect[i][pos]) {
+				t.Fatalf("input %d position %d: expected %d logits, got %d", i, pos, len(expect[i][pos]), len(got[i][pos]))
+			}
+
+			for j, v := range expect[i][pos] {
+				if diff := math.Abs(float64(got[i][pos][j] - v)); diff > tolerance*max(1, math.Abs(float64(v))) {
+					t.Errorf("input %d position %d token %d: expected %f, got %f", i, pos, j, v, got[i][pos][j])
+				}
+			}
+		}
+	}
+}
+
+func readReference(t *testing.T, path string) [][][]float32 {
+	t.Helper()
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("%v, run with -update to create it", err)
+	}
+
+	var logits [][][]float32
+	if err := json.Unmarshal(b, &logits); err != nil {
+		t.Fatal(err)
+	}
+
+	return logits
+}
+
+func writeReference(t *testing.T, path string, logits [][][]float32) {
+	t.Helper()
+
+	b, err := json.Marshal(logits)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(path, append(b, '\n'), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,203 @@
+package imageproc
+
+import (
+	"fmt"
+	"image"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"math"
+
+	"golang.org/x/image/draw"
+)
+
+// Layout describes how an image is resized and split into tiles for a
+// vision model
+type Layout struct {
+	// Size is the size the image is resized to
+	Size image.Point
+
+	// Canvas is the size of the canvas the resized image is padded to, or
+	// zero to not pad it
+	Canvas image.Point
+
+	// Center centers the resized image on the canvas instead of placing it
+	// in the top left corner
+	Center bool
+
+	// Tiles is the grid the canvas is split into, or zero for a single tile
+	Tiles image.Point
+
+	// Thumbnail is the size of a thumbnail of the whole image added before
+	// the tiles, or zero for none
+	Thumbnail image.Point
+}
+
+// A Strategy chooses the layout of an image from its size
+type Strategy interface {
+	Layout(size image.Point) Layout
+}
+
+// Config is how a vision model preprocesses images
+type Config struct {
+	Strategy Strategy
+
+	// Method is the resizing method, ResizeBilinear by default
+	Method int
+
+	Mean, STD [3]float32
+
+	// ChannelFirst returns each channel of a tile in turn instead of the
+	// channels of each pixel
+	ChannelFirst bool
+}
+
+// Preprocess decodes an image and returns the normalized values of its
+// thumbnail, if it has one, followed by each tile in row order
+func (c Config) Preprocess(r io.Reader) ([]float32, Layout, error) {
+	img, format, err := image.Decode(r)
+	if err != nil {
+		return nil, Layout{}, fmt.Errorf("failed to decode image: %w", err)
+	}
+
+	if format == "png" {
+		img = Composite(img)
+	}
+
+	l := c.Strategy.Layout(img.Bounds().Size())
+
+	var data []float32
+	if l.Thumbnail != (image.Point{}) {
+		data = append(data, Normalize(Resize(img, l.Thumbnail, c.Method), c.Mean, c.STD, true, c.ChannelFirst)...)
+	}
+
+	img = Resize(img, l.Size, c.Method)
+	if l.Canvas != (image.Point{}) {
+		img = Pad(img, l.Canvas, l.Center)
+	}
+
+	for _, tile := range Tiles(img, l.Tiles) {
+		data = append(data, Normalize(tile, c.Mean, c.STD, true, c.ChannelFirst)...)
+	}
+
+	return data, l, nil
+}
+
+// Pad returns img on a black canvas of size, either in the top left corner
+// or centered
+func Pad(img image.Image, size image.Point, center bool) image.Image {
+	dst := image.NewRGBA(image.Rect(0, 0, size.X, size.Y))
+
+	b := img.Bounds()
+	r := b.Sub(b.Min)
+	if center {
+		r = r.Add(size.Sub(r.Size()).Div(2))
+	}
+
+	draw.Draw(dst, r, img, b.Min, draw.Over)
+	return dst
+}
+
+// Tiles splits img into a grid of equally sized tiles in row order. A zero
+// grid is a single tile.
+func Tiles(img image.Image, grid image.Point) []image.Image {
+	if grid.X == 0 || grid.Y == 0 {
+		return []image.Image{img}
+	}
+
+	b := img.Bounds()
+	w, h := b.Dx()/grid.X, b.Dy()/grid.Y
+
+	sub, ok := img.(interface {
+		SubImage(image.Rectangle) image.Image
+	})
+	if !ok {
+		sub = Composite(img).(*image.RGBA)
+	}
+
+	tiles := make([]image.Image, 0, grid.X*grid.Y)
+	for y := range grid.Y {
+		for x := range grid.X {
+			tiles = append(tiles, sub.SubImage(image.Rect(w*x, h*y, w*(x+1), h*(y+1)).Add(b.Min)))
+		}
+	}
+
+	return tiles
+}
+
+// Fixed resizes images to a fixed size, as for CLIP and LLaVA
+type Fixed struct {
+	Size image.Point
+}
+
+func (s Fixed) Layout(image.Point) Layout {
+	return Layout{Size: s.Size}
+}
+
+// AnyRes splits high resolution images into tiles of TileSize, as for
+// LLaVA-Next. Images are resized to fit the grid of Pinpoints, sizes in
+// pixels that are multiples of TileSize, that keeps the most of their
+// resolution while wasting the least of the grid, and a thumbnail of the
+// whole image comes first.
+type AnyRes struct {
+	TileSize  int
+	Pinpoints []image.Point
+}
+
+func (s AnyRes) Layout(size image.Point) Layout {
+	tile := image.Point{s.TileSize, s.TileSize}
+
+	best := tile
+	var bestEffective, bestWasted int
+	for _, p := range s.Pinpoints {
+		scale := min(float64(p.X)/float64(size.X), float64(p.Y)/float64(size.Y))
+		w, h := int(float64(size.X)*scale), int(float64(size.Y)*scale)
+
+		effective := min(w*h, size.X*size.Y)
+		wasted := p.X*p.Y - effective
+		if effective > bestEffective || effective == bestEffective && wasted < bestWasted {
+			best, bestEffective, bestWasted = p, effective, wasted
+		}
+	}
+
+	scaleX := float64(best.X) / float64(size.X)
+	scaleY := float64(best.Y) / float64(size.Y)
+
+	resized := best
+	if scaleX < scaleY {
+		resized.Y = min(int(math.Ceil(float64(size.Y)*scaleX)), best.Y)
+	} else {
+		resized.X = min(int(math.Ceil(float64(size.X)*scaleY)), best.X)
+	}
+
+	return Layout{
+		Size:      resized,
+		Canvas:    best,
+		Center:    true,
+		Tiles:     image.Point{best.X / s.TileSize, best.Y / s.TileSize},
+		Thumbnail: tile,
+	}
+}
+
+// Metadata is the metadata of a vision projector, such as llm.KV
+type Metadata interface {
+	Floats(key string) []float32
+}
+
+// Normalization returns the mean and standard deviation of the projector
+// under prefix, such as clip.vision, or mean and std if it doesn't set them
+func Normalization(md Metadata, prefix string, mean, std [3]float32) ([3]float32, [3]float32) {
+	if md == nil {
+		return mean, std
+	}
+
+	if m := md.Floats(prefix + ".image_mean"); len(m) == 3 {
+		mean = [3]float32(m)
+	}
+
+	if s := md.Floats(prefix + ".image_std"); len(s) == 3 {
+		std = [3]float32(s)
+	}
+
+	return mean, std
+}
@@ -0,0 +1,244 @@
+package imageproc
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"image"
+	"image/color"
+	"image/png"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+var update = flag.Bool("update", false, "update the reference outputs in testdata")
+
+func TestPad(t *testing.T) {
+	red := color.RGBA{255, 0, 0, 255}
+	black := color.RGBA{0, 0, 0, 0}
+
+	cases := []struct {
+		name   string
+		img    image.Image
+		size   image.Point
+		center bool
+		expect []color.RGBA
+	}{
+		{"top left", createImage(10, 10, red), image.Point{20, 10}, false, []color.RGBA{red, red, black}},
+		{"centered", createImage(10, 10, red), image.Point{20, 10}, true, []color.RGBA{black, red, black}},
+		{"sub image", createImage(20, 10, red).(*image.RGBA).SubImage(image.Rect(10, 0, 20, 10)), image.Point{20, 10}, false, []color.RGBA{red, red, black}},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			padded := Pad(tt.img, tt.size, tt.center)
+			if padded.Bounds() != image.Rect(0, 0, tt.size.X, tt.size.Y) {
+				t.Fatalf("unexpected bounds %v", padded.Bounds())
+			}
+
+			var got []color.RGBA
+			for _, x := range []int{0, 9, 15} {
+				got = append(got, padded.At(x, 5).(color.RGBA))
+			}
+
+			if diff := cmp.Diff(got, tt.expect); diff != "" {
+				t.Errorf("mismatch (-got +want):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestTiles(t *testing.T) {
+	cases := []struct {
+		img    image.Image
+		grid   image.Point
+		expect []image.Rectangle
+	}{
+		{
+			img:    image.NewRGBA(image.Rect(0, 0, 1024, 768)),
+			grid:   image.Point{1, 1},
+			expect: []image.Rectangle{image.Rect(0, 0, 1024, 768)},
+		},
+		{
+			img:    image.NewRGBA(image.Rect(0, 0, 1024, 768)),
+			expect: []image.Rectangle{image.Rect(0, 0, 1024, 768)},
+		},
+		{
+			img:    image.NewRGBA(image.Rect(0, 0, 1000, 500)),
+			grid:   image.Point{2, 1},
+			expect: []image.Rectangle{image.Rect(0, 0, 500, 500), image.Rect(500, 0, 1000, 500)},
+		},
+		{
+			img:  image.NewRGBA(image.Rect(0, 0, 1000, 1000)),
+			grid: image.Point{2, 2},
+			expect: []image.Rectangle{
+				image.Rect(0, 0, 500, 500),
+				image.Rect(500, 0, 1000, 500),
+				image.Rect(0, 500, 500, 1000),
+				image.Rect(500, 500, 1000, 1000),
+			},
+		},
+	}
+
+	for _, tt := range cases {
+		var got []image.Rectangle
+		for _, tile := range Tiles(tt.img, tt.grid) {
+			got = append(got, tile.Bounds())
+		}
+
+		if diff := cmp.Diff(got, tt.expect); diff != "" {
+			t.Errorf("mismatch (-got +want):\n%s", diff)
+		}
+	}
+}
+
+func TestAnyRes(t *testing.T) {
+	s := AnyRes{TileSize: 16, Pinpoints: []image.Point{{32, 32}, {64, 32}, {32, 64}}}
+
+	cases := []struct {
+		size   image.Point
+		expect Layout
+	}{
+		{
+			size:   image.Point{48, 32},
+			expect: Layout{Size: image.Point{48, 32}, Canvas: image.Point{64, 32}, Center: true, Tiles: image.Point{4, 2}, Thumbnail: image.Point{16, 16}},
+		},
+		{
+			size:   image.Point{100, 100},
+			expect: Layout{Size: image.Point{32, 32}, Canvas: image.Point{32, 32}, Center: true, Tiles: image.Point{2, 2}, Thumbnail: image.Point{16, 16}},
+		},
+		{
+			size:   image.Point{40, 200},
+			expect: Layout{Size: image.Point{13, 64}, Canvas: image.Point{32, 64}, Center: true, Tiles: image.Point{2, 4}, Thumbnail: image.Point{16, 16}},
+		},
+	}
+
+	for _, tt := range cases {
+		if diff := cmp.Diff(s.Layout(tt.size), tt.expect); diff != "" {
+			t.Errorf("%v: mismatch (-got +want):\n%s", tt.size, diff)
+		}
+	}
+}
+
+type metadata map[string][]float32
+
+func (md metadata) Floats(key string) []float32 {
+	return md[key]
+}
+
+func TestNormalization(t *testing.T) {
+	mean, std := Normalization(nil, "clip.vision", ClipDefaultMean, ClipDefaultSTD)
+	if mean != ClipDefaultMean || std != ClipDefaultSTD {
+		t.Errorf("expected the defaults, got %v %v", mean, std)
+	}
+
+	md := metadata{"clip.vision.image_mean": {0.5, 0.5, 0.5}, "clip.vision.image_std": {0.1, 0.2}}
+	mean, std = Normalization(md, "clip.vision", ClipDefaultMean, ClipDefaultSTD)
+	if mean != ImageNetStandardMean || std != ClipDefaultSTD {
+		t.Errorf("expected the mean from metadata, got %v %v", mean, std)
+	}
+}
+
+// gradient returns a test image with different values in each channel
+func gradient(width, height int) []byte {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := range height {
+		for x := range width {
+			img.Set(x, y, color.RGBA{uint8(x * 255 / width), uint8(y * 255 / height), uint8((x + y) * 3), 255})
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		panic(err)
+	}
+
+	return buf.Bytes()
+}
+
+// TestPreprocess compares the output of the pipeline against references in
+// testdata. After an intended change, update them with:
+//
+//	go test ./model/imageproc -run Preprocess -update
+func TestPreprocess(t *testing.T) {
+	cases := []struct {
+		name   string
+		config Config
+		image  []byte
+		expect int
+	}{
+		{
+			name:   "fixed",
+			config: Config{Strategy: Fixed{image.Point{16, 16}}, Mean: ClipDefaultMean, STD: ClipDefaultSTD, ChannelFirst: true},
+			image:  gradient(40, 30),
+			expect: 16 * 16 * 3,
+		},
+		{
+			name:   "fixed-channel-last",
+			config: Config{Strategy: Fixed{image.Point{8, 12}}, Method: ResizeNearestNeighbor, Mean: ImageNetStandardMean, STD: ImageNetStandardSTD},
+			image:  gradient(40, 30),
+			expect: 8 * 12 * 3,
+		},
+		{
+			name:   "anyres",
+			config: Config{Strategy: AnyRes{TileSize: 8, Pinpoints: []image.Point{{16, 8}, {8, 16}, {16, 16}}}, Mean: ClipDefaultMean, STD: ClipDefaultSTD, ChannelFirst: true},
+			image:  gradient(24, 20),
+			expect: (1 + 4) * 8 * 8 * 3,
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			got, _, err := tt.config.Preprocess(bytes.NewReader(tt.image))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(got) != tt.expect {
+				t.Fatalf("expected %d values, got %d", tt.expect, len(got))
+			}
+
+			reference := filepath.Join("testdata", tt.name+".json")
+			if *update {
+				b, err := json.Marshal(got)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if err := os.MkdirAll("testdata", 0o755); err != nil {
+					t.Fatal(err)
+				}
+
+				if err := os.WriteFile(reference, append(b, '\n'), 0o644); err != nil {
+					t.Fatal(err)
+				}
+
+				return
+			}
+
+			b, err := os.ReadFile(reference)
+			if err != nil {
+				t.Fatalf("%v, run with -update to create it", err)
+			}
+
+			var expect []float32
+			if err := json.Unmarshal(b, &expect); err != nil {
+				t.Fatal(err)
+			}
+
+			for i := range expect {
+				if math.Abs(float64(got[i]-expect[i])) > 1e-5 {
+					t.Fatalf("value %d: expected %f, got %f", i, expect[i], got[i])
+				}
+			}
+		})
+	}
+
+	if _, _, err := (Config{Strategy: Fixed{image.Point{8, 8}}}).Preprocess(bytes.NewReader([]byte("not an image"))); err == nil {
+		t.Error("expected an error for an invalid image")
+	}
+}
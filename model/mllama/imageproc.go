@@ -1,16 +1,11 @@
 package mllama
 
 import (
-	"fmt"
 	"image"
-	_ "image/jpeg"
-	_ "image/png"
 	"io"
 	"math"
 	"slices"
 
-	"golang.org/x/image/draw"
-
 	"github.com/ollama/ollama/model/imageproc"
 )
 
@@ -114,88 +109,45 @@ func getImageSizeFitToCanvas(imageSize, canvasSize image.Point, tileSize int) im
 	return image.Point{w, h}
 }
 
-func resizeImage(img image.Image, format string, outputSize image.Point, maxImageTiles int) (image.Image, image.Point) {
-	if format == "png" {
-		img = imageproc.Composite(img)
-	}
-
-	b := img.Bounds()
-	tileSize := outputSize.Y
-
-	canvasSize := getOptimalTiledCanvas(b.Max, maxImageTiles, tileSize)
-	aspectRatio := image.Point{canvasSize.X / tileSize, canvasSize.Y / tileSize}
-	newSize := getImageSizeFitToCanvas(b.Max, canvasSize, tileSize)
-
-	return imageproc.Resize(img, newSize, imageproc.ResizeBilinear), aspectRatio
-}
-
-func padImage(img image.Image, outputSize, aspectRatio image.Point) image.Image {
-	paddedSize := image.Point{
-		X: outputSize.X * aspectRatio.X,
-		Y: outputSize.Y * aspectRatio.Y,
-	}
-
-	dst := image.NewRGBA(image.Rect(0, 0, paddedSize.X, paddedSize.Y))
-	draw.Draw(dst, img.Bounds(), img, image.Point{0, 0}, draw.Over)
-
-	return dst
+// Processor preprocesses images for mllama. Images are fit to the grid of up
+// to 4 tiles of 560x560 pixels that scales them the least.
+type Processor struct {
+	tileSize, maxTiles int
+	mean, std          [3]float32
 }
 
-func splitToTiles(img image.Image, numTilesSize image.Point) []image.Image {
-	b := img.Bounds()
-	width := b.Max.X - b.Min.X
-	height := b.Max.Y - b.Min.Y
-	tileHeight := height / numTilesSize.Y
-	tileWidth := width / numTilesSize.X
-
-	images := []image.Image{}
-
-	for h := range numTilesSize.Y {
-		for w := range numTilesSize.X {
-			rect := image.Rect(tileWidth*w, tileHeight*h, tileWidth*(w+1), tileHeight*(h+1))
-			images = append(images, img.(interface {
-				SubImage(image.Rectangle) image.Image
-			}).SubImage(rect))
-		}
-	}
-
-	return images
+// NewProcessor returns the processor of a vision projector, taking its
+// normalization from md if it's set
+func NewProcessor(md imageproc.Metadata) Processor {
+	mean, std := imageproc.Normalization(md, "mllama.vision", imageproc.ClipDefaultMean, imageproc.ClipDefaultSTD)
+	return Processor{tileSize: 560, maxTiles: 4, mean: mean, std: std}
 }
 
-func packImages(img image.Image, aspectRatio image.Point) []float32 {
-	subImages := splitToTiles(img, aspectRatio)
-
-	var pixelVals []float32
-
-	rescale := true
-	channelFirst := true
-
-	for _, subImg := range subImages {
-		vals := imageproc.Normalize(subImg, imageproc.ClipDefaultMean, imageproc.ClipDefaultSTD, rescale, channelFirst)
-		pixelVals = append(pixelVals, vals...)
+func (p Processor) Layout(size image.Point) imageproc.Layout {
+	canvas := getOptimalTiledCanvas(size, p.maxTiles, p.tileSize)
+	return imageproc.Layout{
+		Size:   getImageSizeFitToCanvas(size, canvas, p.tileSize),
+		Canvas: canvas,
+		Tiles:  canvas.Div(p.tileSize),
 	}
-
-	return pixelVals
 }
 
-func Preprocess(imageData io.Reader) ([]float32, map[string]any, error) {
-	outputSize := image.Point{560, 560}
-	maxTiles := 4
-
-	img, format, err := image.Decode(imageData)
+// Preprocess returns the values of each tile of the image and the index of
+// its aspect ratio, as aspectRatioIndex
+func (p Processor) Preprocess(imageData io.Reader) ([]float32, map[string]any, error) {
+	c := imageproc.Config{Strategy: p, Mean: p.mean, STD: p.std, ChannelFirst: true}
+	data, l, err := c.Preprocess(imageData)
 	if err != nil {
-		return nil, nil, fmt.Errorf("failed to decode image: %w", err)
+		return nil, nil, err
 	}
 
-	newImage, aspectRatio := resizeImage(img, format, outputSize, maxTiles)
-	newImage = padImage(newImage, outputSize, aspectRatio)
-
-	data := packImages(newImage, aspectRatio)
-	aspectRatioIndex := slices.Index(getSupportedAspectRatios(maxTiles), aspectRatio) + 1
-
 	opts := map[string]any{
-		"aspectRatioIndex": aspectRatioIndex,
+		"aspectRatioIndex": slices.Index(getSupportedAspectRatios(p.maxTiles), l.Tiles) + 1,
 	}
 
 	return data, opts, nil
 }
+
+func Preprocess(imageData io.Reader) ([]float32, map[string]any, error) {
+	return NewProcessor(nil).Preprocess(imageData)
+}
@@ -1,10 +1,7 @@
 package pixtral
 
 import (
-	"fmt"
 	"image"
-	_ "image/jpeg"
-	_ "image/png"
 	"io"
 	"math"
 
@@ -18,17 +15,16 @@ func getNumImageTokens(imageSize, patchSize image.Point) image.Point {
 	}
 }
 
-func getResizeOutputImageSize(img image.Image, longestEdge int, patchSize image.Point) image.Point {
-	b := img.Bounds()
+func getResizeOutputImageSize(size image.Point, longestEdge int, patchSize image.Point) image.Point {
 	le := float64(longestEdge)
-	ratio := math.Max(float64(b.Max.Y)/le, float64(b.Max.X)/le)
+	ratio := math.Max(float64(size.Y)/le, float64(size.X)/le)
 
-	newSize := img.Bounds().Max
+	newSize := size
 
 	if ratio > 1.0 {
 		newSize = image.Point{
-			int(math.Ceil(float64(b.Max.X) / ratio)),
-			int(math.Ceil(float64(b.Max.Y) / ratio)),
+			int(math.Ceil(float64(size.X) / ratio)),
+			int(math.Ceil(float64(size.Y) / ratio)),
 		}
 	}
 
@@ -39,30 +35,36 @@ func getResizeOutputImageSize(img image.Image, longestEdge int, patchSize image.
 	}
 }
 
-func resizeImage(img image.Image, format string, longestEdge int, patchSize image.Point) image.Image {
-	if format == "png" {
-		img = imageproc.Composite(img)
-	}
+// Processor preprocesses images for pixtral. Images are scaled down to fit
+// 1024 pixels on their longest edge and rounded up to 16x16 patches.
+type Processor struct {
+	longestEdge int
+	patchSize   image.Point
+	mean, std   [3]float32
+}
 
-	newSize := getResizeOutputImageSize(img, longestEdge, patchSize)
+// NewProcessor returns the processor of a vision projector, taking its
+// normalization from md if it's set
+func NewProcessor(md imageproc.Metadata) Processor {
+	mean, std := imageproc.Normalization(md, "pixtral.vision", imageproc.ClipDefaultMean, imageproc.ClipDefaultSTD)
+	return Processor{longestEdge: 1024, patchSize: image.Point{16, 16}, mean: mean, std: std}
+}
 
-	// todo should be ResizeBicubic, but it doesn't exist
-	return imageproc.Resize(img, newSize, imageproc.ResizeBilinear)
+func (p Processor) Layout(size image.Point) imageproc.Layout {
+	return imageproc.Layout{Size: getResizeOutputImageSize(size, p.longestEdge, p.patchSize)}
 }
 
-func Preprocess(imageData io.Reader) ([]float32, map[string]any, error) {
-	img, format, err := image.Decode(imageData)
+func (p Processor) Preprocess(imageData io.Reader) ([]float32, map[string]any, error) {
+	// todo should be ResizeBicubic, but it doesn't exist
+	c := imageproc.Config{Strategy: p, Method: imageproc.ResizeBilinear, Mean: p.mean, STD: p.std, ChannelFirst: true}
+	data, _, err := c.Preprocess(imageData)
 	if err != nil {
-		return nil, nil, fmt.Errorf("failed to decode image: %w", err)
+		return nil, nil, err
 	}
 
-	longestEdge := 1024
-	patchSize := image.Point{16, 16}
-
-	img = resizeImage(img, format, longestEdge, patchSize)
-
-	data := imageproc.Normalize(img, imageproc.ClipDefaultMean, imageproc.ClipDefaultSTD, true, true)
+	return data, map[string]any{}, nil
+}
 
-	opts := map[string]any{}
-	return data, opts, nil
+func Preprocess(imageData io.Reader) ([]float32, map[string]any, error) {
+	return NewProcessor(nil).Preprocess(imageData)
 }
@@ -112,7 +112,7 @@ func TestGetResizeOutputImageSize(t *testing.T) {
 	}
 
 	for _, c := range cases {
-		actual := getResizeOutputImageSize(c.Image, c.LongestEdge, c.PatchSize)
+		actual := getResizeOutputImageSize(c.Image.Bounds().Max, c.LongestEdge, c.PatchSize)
 
 		if diff := cmp.Diff(actual, c.Expected); diff != "" {
 			t.Errorf("mismatch (-got +want):\n%s", diff)
@@ -120,7 +120,7 @@ func TestGetResizeOutputImageSize(t *testing.T) {
 	}
 }
 
-func TestResize(t *testing.T) {
+func TestLayout(t *testing.T) {
 	type resizeCase struct {
 		Image       image.Image
 		LongestEdge int
@@ -144,10 +144,11 @@ func TestResize(t *testing.T) {
 	}
 
 	for _, c := range cases {
-		actual := resizeImage(c.Image, "png", c.LongestEdge, c.PatchSize)
+		p := Processor{longestEdge: c.LongestEdge, patchSize: c.PatchSize}
+		actual := p.Layout(c.Image.Bounds().Size())
 
-		if actual.Bounds() != c.Expected.Bounds() {
-			t.Errorf("image size incorrect: '%#v': expected: '%#v'", actual.Bounds(), c.Expected.Bounds())
+		if actual.Size != c.Expected.Bounds().Size() {
+			t.Errorf("image size incorrect: '%#v': expected: '%#v'", actual.Size, c.Expected.Bounds().Size())
 		}
 	}
 }
@@ -1,10 +1,7 @@
 package qwen2vl
 
 import (
-	"fmt"
 	"image"
-	_ "image/jpeg"
-	_ "image/png"
 	"io"
 	"math"
 
@@ -50,25 +47,41 @@ func smartResize(size image.Point, factor, minPixels, maxPixels int) image.Point
 	return image.Point{int(xBar), int(yBar)}
 }
 
-func resizeImage(img image.Image, format string, size image.Point) image.Image {
-	if format == "png" {
-		img = imageproc.Composite(img)
+// Processor preprocesses images for qwen2vl. Images are resized to a
+// multiple of the factor with a number of pixels within limits, keeping
+// their aspect ratio as close as possible.
+type Processor struct {
+	factor, minPixels, maxPixels int
+	mean, std                    [3]float32
+}
+
+// NewProcessor returns the processor of a vision projector, taking its
+// normalization from md if it's set
+func NewProcessor(md imageproc.Metadata) Processor {
+	mean, std := imageproc.Normalization(md, "qwen2vl.vision", imageproc.ClipDefaultMean, imageproc.ClipDefaultSTD)
+	return Processor{
+		factor:    DefaultFactor,
+		minPixels: DefaultMinPixels,
+		maxPixels: DefaultMaxPixels,
+		mean:      mean,
+		std:       std,
 	}
+}
 
-	return imageproc.Resize(img, size, imageproc.ResizeBilinear)
+func (p Processor) Layout(size image.Point) imageproc.Layout {
+	return imageproc.Layout{Size: smartResize(size, p.factor, p.minPixels, p.maxPixels)}
 }
 
-func Preprocess(imageData io.Reader) ([]float32, map[string]any, error) {
-	img, format, err := image.Decode(imageData)
+func (p Processor) Preprocess(imageData io.Reader) ([]float32, map[string]any, error) {
+	c := imageproc.Config{Strategy: p, Mean: p.mean, STD: p.std, ChannelFirst: true}
+	data, _, err := c.Preprocess(imageData)
 	if err != nil {
-		return nil, nil, fmt.Errorf("failed to decode image: %w", err)
+		return nil, nil, err
 	}
 
-	size := smartResize(img.Bounds().Max, DefaultFactor, DefaultMinPixels, DefaultMaxPixels)
-	img = resizeImage(img, format, size)
-
-	data := imageproc.Normalize(img, imageproc.ClipDefaultMean, imageproc.ClipDefaultSTD, true, true)
+	return data, map[string]any{}, nil
+}
 
-	opts := map[string]any{}
-	return data, opts, nil
+func Preprocess(imageData io.Reader) ([]float32, map[string]any, error) {
+	return NewProcessor(nil).Preprocess(imageData)
 }
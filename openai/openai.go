@@ -11,6 +11,7 @@ import (
 	"log/slog"
 	"math/rand"
 	"net/http"
+	"strconv"
 	"strings"
 	"time"
 
@@ -34,31 +35,122 @@ type ErrorResponse struct {
 type Message struct {
 	Role      string     `json:"role"`
 	Content   any        `json:"content"`
+	Reasoning string     `json:"reasoning,omitempty"`
 	ToolCalls []ToolCall `json:"tool_calls,omitempty"`
 }
 
 type Choice struct {
-	Index        int     `json:"index"`
-	Message      Message `json:"message"`
-	FinishReason *string `json:"finish_reason"`
+	Index        int             `json:"index"`
+	Message      Message         `json:"message"`
+	Logprobs     *ChoiceLogprobs `json:"logprobs,omitempty"`
+	FinishReason *string         `json:"finish_reason"`
 }
 
 type ChunkChoice struct {
-	Index        int     `json:"index"`
-	Delta        Message `json:"delta"`
-	FinishReason *string `json:"finish_reason"`
+	Index        int             `json:"index"`
+	Delta        Message         `json:"delta"`
+	Logprobs     *ChoiceLogprobs `json:"logprobs,omitempty"`
+	FinishReason *string         `json:"finish_reason"`
 }
 
 type CompleteChunkChoice struct {
-	Text         string  `json:"text"`
-	Index        int     `json:"index"`
-	FinishReason *string `json:"finish_reason"`
+	Text         string              `json:"text"`
+	Index        int                 `json:"index"`
+	Logprobs     *CompletionLogprobs `json:"logprobs,omitempty"`
+	FinishReason *string             `json:"finish_reason"`
+}
+
+// ChoiceLogprobs are the log probabilities of the tokens of a chat choice
+type ChoiceLogprobs struct {
+	Content []TokenLogprob `json:"content"`
+}
+
+type TokenLogprob struct {
+	Token       string       `json:"token"`
+	Logprob     float64      `json:"logprob"`
+	Bytes       []int        `json:"bytes"`
+	TopLogprobs []TopLogprob `json:"top_logprobs"`
+}
+
+type TopLogprob struct {
+	Token   string  `json:"token"`
+	Logprob float64 `json:"logprob"`
+	Bytes   []int   `json:"bytes"`
+}
+
+// CompletionLogprobs are the log probabilities of the tokens of a legacy
+// completion choice. Text offsets aren't returned.
+type CompletionLogprobs struct {
+	Tokens        []string             `json:"tokens"`
+	TokenLogprobs []float64            `json:"token_logprobs"`
+	TopLogprobs   []map[string]float64 `json:"top_logprobs"`
+}
+
+func toBytes(s string) []int {
+	b := make([]int, len(s))
+	for i := range len(s) {
+		b[i] = int(s[i])
+	}
+
+	return b
+}
+
+func toChoiceLogprobs(logprobs []api.Logprob) *ChoiceLogprobs {
+	if len(logprobs) == 0 {
+		return nil
+	}
+
+	content := make([]TokenLogprob, len(logprobs))
+	for i, lp := range logprobs {
+		top := make([]TopLogprob, len(lp.TopLogprobs))
+		for j, t := range lp.TopLogprobs {
+			top[j] = TopLogprob{Token: t.Token, Logprob: t.Logprob, Bytes: toBytes(t.Token)}
+		}
+
+		content[i] = TokenLogprob{Token: lp.Token, Logprob: lp.Logprob, Bytes: toBytes(lp.Token), TopLogprobs: top}
+	}
+
+	return &ChoiceLogprobs{Content: content}
+}
+
+func toCompletionLogprobs(logprobs []api.Logprob) *CompletionLogprobs {
+	if len(logprobs) == 0 {
+		return nil
+	}
+
+	var c CompletionLogprobs
+	for _, lp := range logprobs {
+		c.Tokens = append(c.Tokens, lp.Token)
+		c.TokenLogprobs = append(c.TokenLogprobs, lp.Logprob)
+
+		top := make(map[string]float64, len(lp.TopLogprobs))
+		for _, t := range lp.TopLogprobs {
+			top[t.Token] = t.Logprob
+		}
+		c.TopLogprobs = append(c.TopLogprobs, top)
+	}
+
+	return &c
 }
 
 type Usage struct {
 	PromptTokens     int `json:"prompt_tokens"`
 	CompletionTokens int `json:"completion_tokens"`
 	TotalTokens      int `json:"total_tokens"`
+
+	PromptTokensDetails *PromptTokensDetails `json:"prompt_tokens_details,omitempty"`
+}
+
+type PromptTokensDetails struct {
+	CachedTokens int `json:"cached_tokens"`
+}
+
+func toPromptTokensDetails(m api.Metrics) *PromptTokensDetails {
+	if m.PromptCachedCount == 0 {
+		return nil
+	}
+
+	return &PromptTokensDetails{CachedTokens: m.PromptCachedCount}
 }
 
 type ResponseFormat struct {
@@ -75,6 +167,11 @@ type EmbedRequest struct {
 	Model string `json:"model"`
 }
 
+type Reasoning struct {
+	Effort    string `json:"effort,omitempty"`
+	MaxTokens int    `json:"max_tokens,omitempty"`
+}
+
 type StreamOptions struct {
 	IncludeUsage bool `json:"include_usage"`
 }
@@ -93,6 +190,14 @@ type ChatCompletionRequest struct {
 	TopP             *float64        `json:"top_p"`
 	ResponseFormat   *ResponseFormat `json:"response_format"`
 	Tools            []api.Tool      `json:"tools"`
+	ReasoningEffort  *string         `json:"reasoning_effort"`
+	Reasoning        *Reasoning      `json:"reasoning"`
+
+	// LogitBias maps token ids to biases from -100 to 100
+	LogitBias map[string]float64 `json:"logit_bias"`
+
+	Logprobs    *bool `json:"logprobs"`
+	TopLogprobs *int  `json:"top_logprobs"`
 }
 
 type ChatCompletion struct {
@@ -129,6 +234,10 @@ type CompletionRequest struct {
 	Temperature      *float32       `json:"temperature"`
 	TopP             float32        `json:"top_p"`
 	Suffix           string         `json:"suffix"`
+
+	// Logprobs is the number of most likely tokens to return the log
+	// probabilities of along with each generated token
+	Logprobs *int `json:"logprobs"`
 }
 
 type Completion struct {
@@ -166,6 +275,11 @@ type Model struct {
 	Object  string `json:"object"`
 	Created int64  `json:"created"`
 	OwnedBy string `json:"owned_by"`
+
+	// extensions to the OpenAI model object so clients can filter models
+	Capabilities    []string `json:"capabilities,omitempty"`
+	ContextLength   int      `json:"context_length,omitempty"`
+	TokenizerDigest string   `json:"tokenizer_digest,omitempty"`
 }
 
 type Embedding struct {
@@ -210,6 +324,8 @@ func toUsage(r api.ChatResponse) Usage {
 		PromptTokens:     r.PromptEvalCount,
 		CompletionTokens: r.EvalCount,
 		TotalTokens:      r.PromptEvalCount + r.EvalCount,
+
+		PromptTokensDetails: toPromptTokensDetails(r.Metrics),
 	}
 }
 
@@ -250,8 +366,9 @@ func toChatCompletion(id string, r api.ChatResponse) ChatCompletion {
 		Model:             r.Model,
 		SystemFingerprint: "fp_ollama",
 		Choices: []Choice{{
-			Index:   0,
-			Message: Message{Role: r.Message.Role, Content: r.Message.Content, ToolCalls: toolCalls},
+			Index:    0,
+			Message:  Message{Role: r.Message.Role, Content: r.Message.Content, Reasoning: r.Message.Thinking, ToolCalls: toolCalls},
+			Logprobs: toChoiceLogprobs(r.Logprobs),
 			FinishReason: func(reason string) *string {
 				if len(toolCalls) > 0 {
 					reason = "tool_calls"
@@ -275,8 +392,9 @@ func toChunk(id string, r api.ChatResponse) ChatCompletionChunk {
 		Model:             r.Model,
 		SystemFingerprint: "fp_ollama",
 		Choices: []ChunkChoice{{
-			Index: 0,
-			Delta: Message{Role: "assistant", Content: r.Message.Content, ToolCalls: toolCalls},
+			Index:    0,
+			Delta:    Message{Role: "assistant", Content: r.Message.Content, Reasoning: r.Message.Thinking, ToolCalls: toolCalls},
+			Logprobs: toChoiceLogprobs(r.Logprobs),
 			FinishReason: func(reason string) *string {
 				if len(reason) > 0 {
 					return &reason
@@ -292,6 +410,8 @@ func toUsageGenerate(r api.GenerateResponse) Usage {
 		PromptTokens:     r.PromptEvalCount,
 		CompletionTokens: r.EvalCount,
 		TotalTokens:      r.PromptEvalCount + r.EvalCount,
+
+		PromptTokensDetails: toPromptTokensDetails(r.Metrics),
 	}
 }
 
@@ -303,8 +423,9 @@ func toCompletion(id string, r api.GenerateResponse) Completion {
 		Model:             r.Model,
 		SystemFingerprint: "fp_ollama",
 		Choices: []CompleteChunkChoice{{
-			Text:  r.Response,
-			Index: 0,
+			Text:     r.Response,
+			Index:    0,
+			Logprobs: toCompletionLogprobs(r.Logprobs),
 			FinishReason: func(reason string) *string {
 				if len(reason) > 0 {
 					return &reason
@@ -324,8 +445,9 @@ func toCompleteChunk(id string, r api.GenerateResponse) CompletionChunk {
 		Model:             r.Model,
 		SystemFingerprint: "fp_ollama",
 		Choices: []CompleteChunkChoice{{
-			Text:  r.Response,
-			Index: 0,
+			Text:     r.Response,
+			Index:    0,
+			Logprobs: toCompletionLogprobs(r.Logprobs),
 			FinishReason: func(reason string) *string {
 				if len(reason) > 0 {
 					return &reason
@@ -344,6 +466,10 @@ func toListCompletion(r api.ListResponse) ListCompletion {
 			Object:  "model",
 			Created: m.ModifiedAt.Unix(),
 			OwnedBy: model.ParseName(m.Name).Namespace,
+
+			Capabilities:    m.Capabilities,
+			ContextLength:   m.ContextLength,
+			TokenizerDigest: m.TokenizerDigest,
 		})
 	}
 
@@ -384,6 +510,10 @@ func toModel(r api.ShowResponse, m string) Model {
 		Object:  "model",
 		Created: r.ModifiedAt.Unix(),
 		OwnedBy: model.ParseName(m).Namespace,
+
+		Capabilities:    r.Capabilities,
+		ContextLength:   r.ContextLength,
+		TokenizerDigest: r.TokenizerDigest,
 	}
 }
 
@@ -503,6 +633,34 @@ func fromChatRequest(r ChatCompletionRequest) (*api.ChatRequest, error) {
 		options["top_p"] = 1.0
 	}
 
+	if r.ReasoningEffort != nil {
+		options["reasoning_effort"] = *r.ReasoningEffort
+	}
+
+	if r.Reasoning != nil {
+		if r.Reasoning.Effort != "" {
+			options["reasoning_effort"] = r.Reasoning.Effort
+		}
+
+		if r.Reasoning.MaxTokens > 0 {
+			options["max_thinking_tokens"] = r.Reasoning.MaxTokens
+		}
+	}
+
+	if len(r.LogitBias) > 0 {
+		for token, bias := range r.LogitBias {
+			if _, err := strconv.Atoi(token); err != nil {
+				return nil, fmt.Errorf("invalid token id %q in logit_bias", token)
+			}
+
+			if bias < -100 || bias > 100 {
+				return nil, fmt.Errorf("invalid bias %v for token %s in logit_bias; expected a value from -100 to 100", bias, token)
+			}
+		}
+
+		options["logit_bias"] = r.LogitBias
+	}
+
 	var format json.RawMessage
 	if r.ResponseFormat != nil {
 		switch strings.ToLower(strings.TrimSpace(r.ResponseFormat.Type)) {
@@ -510,20 +668,35 @@ func fromChatRequest(r ChatCompletionRequest) (*api.ChatRequest, error) {
 		case "json_object":
 			format = json.RawMessage(`"json"`)
 		case "json_schema":
-			if r.ResponseFormat.JsonSchema != nil {
-				format = r.ResponseFormat.JsonSchema.Schema
+			if r.ResponseFormat.JsonSchema == nil || len(r.ResponseFormat.JsonSchema.Schema) == 0 {
+				return nil, errors.New("response_format of type json_schema requires json_schema.schema")
 			}
+
+			format = r.ResponseFormat.JsonSchema.Schema
+		case "text", "":
+		default:
+			return nil, fmt.Errorf("invalid response_format type %q; expected \"text\", \"json_object\" or \"json_schema\"", r.ResponseFormat.Type)
 		}
 	}
 
-	return &api.ChatRequest{
+	req := api.ChatRequest{
 		Model:    r.Model,
 		Messages: messages,
 		Format:   format,
 		Options:  options,
 		Stream:   &r.Stream,
 		Tools:    r.Tools,
-	}, nil
+	}
+
+	if r.Logprobs != nil {
+		req.Logprobs = *r.Logprobs
+	}
+
+	if r.TopLogprobs != nil {
+		req.TopLogprobs = *r.TopLogprobs
+	}
+
+	return &req, nil
 }
 
 func fromCompleteRequest(r CompletionRequest) (api.GenerateRequest, error) {
@@ -568,13 +741,20 @@ func fromCompleteRequest(r CompletionRequest) (api.GenerateRequest, error) {
 		options["top_p"] = 1.0
 	}
 
-	return api.GenerateRequest{
+	req := api.GenerateRequest{
 		Model:   r.Model,
 		Prompt:  r.Prompt,
 		Options: options,
 		Stream:  &r.Stream,
 		Suffix:  r.Suffix,
-	}, nil
+	}
+
+	if r.Logprobs != nil {
+		req.Logprobs = true
+		req.TopLogprobs = *r.Logprobs
+	}
+
+	return req, nil
 }
 
 type BaseWriter struct {
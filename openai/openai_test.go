@@ -112,6 +112,33 @@ func TestChatMiddleware(t *testing.T) {
 				Stream: &True,
 			},
 		},
+		{
+			name: "chat handler with reasoning",
+			body: `{
+				"model": "test-model",
+				"messages": [
+					{"role": "user", "content": "Hello"}
+				],
+				"reasoning_effort": "high",
+				"reasoning":        {"effort": "low", "max_tokens": 500}
+			}`,
+			req: api.ChatRequest{
+				Model: "test-model",
+				Messages: []api.Message{
+					{
+						Role:    "user",
+						Content: "Hello",
+					},
+				},
+				Options: map[string]any{
+					"temperature":         1.0,
+					"top_p":               1.0,
+					"reasoning_effort":    "low",
+					"max_thinking_tokens": 500.0,
+				},
+				Stream: &False,
+			},
+		},
 		{
 			name: "chat handler with streaming usage",
 			body: `{
@@ -315,6 +342,115 @@ func TestChatMiddleware(t *testing.T) {
 				Stream: &True,
 			},
 		},
+		{
+			name: "chat handler with json schema",
+			body: `{
+				"model": "test-model",
+				"messages": [
+					{"role": "user", "content": "Hello"}
+				],
+				"response_format": {"type": "json_schema", "json_schema": {"name": "answer", "strict": true, "schema": {"type": "object"}}}
+			}`,
+			req: api.ChatRequest{
+				Model: "test-model",
+				Messages: []api.Message{
+					{
+						Role:    "user",
+						Content: "Hello",
+					},
+				},
+				Options: map[string]any{
+					"temperature": 1.0,
+					"top_p":       1.0,
+				},
+				Format: json.RawMessage(`{"type":"object"}`),
+				Stream: &False,
+			},
+		},
+		{
+			name: "chat handler json schema without schema",
+			body: `{
+				"model": "test-model",
+				"messages": [
+					{"role": "user", "content": "Hello"}
+				],
+				"response_format": {"type": "json_schema", "json_schema": {"name": "answer"}}
+			}`,
+			err: ErrorResponse{
+				Error: Error{
+					Message: "response_format of type json_schema requires json_schema.schema",
+					Type:    "invalid_request_error",
+				},
+			},
+		},
+		{
+			name: "chat handler with logit bias",
+			body: `{
+				"model": "test-model",
+				"messages": [
+					{"role": "user", "content": "Hello"}
+				],
+				"logit_bias": {"42": -100, "7": 2.5}
+			}`,
+			req: api.ChatRequest{
+				Model: "test-model",
+				Messages: []api.Message{
+					{
+						Role:    "user",
+						Content: "Hello",
+					},
+				},
+				Options: map[string]any{
+					"temperature": 1.0,
+					"top_p":       1.0,
+					"logit_bias":  map[string]any{"42": -100.0, "7": 2.5},
+				},
+				Stream: &False,
+			},
+		},
+		{
+			name: "chat handler with invalid logit bias",
+			body: `{
+				"model": "test-model",
+				"messages": [
+					{"role": "user", "content": "Hello"}
+				],
+				"logit_bias": {"42": -200}
+			}`,
+			err: ErrorResponse{
+				Error: Error{
+					Message: "invalid bias -200 for token 42 in logit_bias; expected a value from -100 to 100",
+					Type:    "invalid_request_error",
+				},
+			},
+		},
+		{
+			name: "chat handler with logprobs",
+			body: `{
+				"model": "test-model",
+				"messages": [
+					{"role": "user", "content": "Hello"}
+				],
+				"logprobs": true,
+				"top_logprobs": 3
+			}`,
+			req: api.ChatRequest{
+				Model: "test-model",
+				Messages: []api.Message{
+					{
+						Role:    "user",
+						Content: "Hello",
+					},
+				},
+				Options: map[string]any{
+					"temperature": 1.0,
+					"top_p":       1.0,
+				},
+				Stream:      &False,
+				Logprobs:    true,
+				TopLogprobs: 3,
+			},
+		},
 		{
 			name: "chat handler error forwarding",
 			body: `{
@@ -402,6 +538,27 @@ func TestCompletionsMiddleware(t *testing.T) {
 				Stream: &False,
 			},
 		},
+		{
+			name: "completions handler with logprobs",
+			body: `{
+				"model": "test-model",
+				"prompt": "Hello",
+				"logprobs": 2
+			}`,
+			req: api.GenerateRequest{
+				Model:  "test-model",
+				Prompt: "Hello",
+				Options: map[string]any{
+					"frequency_penalty": 0.0,
+					"presence_penalty":  0.0,
+					"temperature":       1.0,
+					"top_p":             1.0,
+				},
+				Stream:      &False,
+				Logprobs:    true,
+				TopLogprobs: 2,
+			},
+		},
 		{
 			name: "completions handler stream",
 			body: `{
@@ -622,6 +779,36 @@ func TestListMiddleware(t *testing.T) {
 				]
 			}`,
 		},
+		{
+			name: "list handler capabilities",
+			endpoint: func(c *gin.Context) {
+				c.JSON(http.StatusOK, api.ListResponse{
+					Models: []api.ListModelResponse{
+						{
+							Name:            "test-model",
+							ModifiedAt:      time.Unix(int64(1686935002), 0).UTC(),
+							Capabilities:    []string{"completion", "tools"},
+							ContextLength:   8192,
+							TokenizerDigest: "sha256:abc",
+						},
+					},
+				})
+			},
+			resp: `{
+				"object": "list",
+				"data": [
+					{
+						"id": "test-model",
+						"object": "model",
+						"created": 1686935002,
+						"owned_by": "library",
+						"capabilities": ["completion", "tools"],
+						"context_length": 8192,
+						"tokenizer_digest": "sha256:abc"
+					}
+				]
+			}`,
+		},
 		{
 			name: "list handler empty output",
 			endpoint: func(c *gin.Context) {
@@ -727,3 +914,34 @@ func TestRetrieveMiddleware(t *testing.T) {
 		}
 	}
 }
+
+func TestLogprobs(t *testing.T) {
+	logprobs := []api.Logprob{
+		{
+			TokenLogprob: api.TokenLogprob{Token: "Hi", Logprob: -0.1},
+			TopLogprobs:  []api.TokenLogprob{{Token: "Hi", Logprob: -0.1}, {Token: "Hey", Logprob: -2.5}},
+		},
+		{TokenLogprob: api.TokenLogprob{Token: "!", Logprob: -0.5}},
+	}
+
+	chat := toChunk("id", api.ChatResponse{Message: api.Message{Content: "Hi!"}, Logprobs: logprobs}).Choices[0].Logprobs
+	if diff := cmp.Diff(chat, &ChoiceLogprobs{Content: []TokenLogprob{
+		{Token: "Hi", Logprob: -0.1, Bytes: []int{72, 105}, TopLogprobs: []TopLogprob{{Token: "Hi", Logprob: -0.1, Bytes: []int{72, 105}}, {Token: "Hey", Logprob: -2.5, Bytes: []int{72, 101, 121}}}},
+		{Token: "!", Logprob: -0.5, Bytes: []int{33}, TopLogprobs: []TopLogprob{}},
+	}}); diff != "" {
+		t.Errorf("mismatch (-got +want):\n%s", diff)
+	}
+
+	completion := toCompletion("id", api.GenerateResponse{Response: "Hi!", Logprobs: logprobs}).Choices[0].Logprobs
+	if diff := cmp.Diff(completion, &CompletionLogprobs{
+		Tokens:        []string{"Hi", "!"},
+		TokenLogprobs: []float64{-0.1, -0.5},
+		TopLogprobs:   []map[string]float64{{"Hi": -0.1, "Hey": -2.5}, {}},
+	}); diff != "" {
+		t.Errorf("mismatch (-got +want):\n%s", diff)
+	}
+
+	if lp := toChunk("id", api.ChatResponse{Message: api.Message{Content: "Hi!"}}).Choices[0].Logprobs; lp != nil {
+		t.Errorf("expected no logprobs, got %+v", lp)
+	}
+}
@@ -552,6 +552,9 @@ func TestParseFileFormatParseFile(t *testing.T) {
 		`
 FROM foo
 ADAPTER adapter1
+SOFTPROMPT softprompt1
+HEAD head1
+TOKENIZER tokenizer1
 LICENSE MIT
 PARAMETER param1 value1
 PARAMETER param2 value2
@@ -0,0 +1,233 @@
+package server
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/envconfig"
+	"github.com/ollama/ollama/llm"
+	"github.com/ollama/ollama/types/model"
+)
+
+// runtimeAdapters returns the paths to the LoRA adapters of the model named
+// by the adapter option, which must be created from the same model as m and
+// aren't already part of it
+func runtimeAdapters(t *tenant, m *Model, name string) ([]string, error) {
+	n := model.ParseName(name)
+	if !n.IsValid() {
+		return nil, fmt.Errorf("%w: invalid adapter %q", errBadOption, name)
+	}
+
+	if err := t.checkModel(n); err != nil {
+		return nil, err
+	}
+
+	a, err := GetModel(name)
+	if err != nil {
+		return nil, fmt.Errorf("%w: adapter %s: %w", errBadOption, name, err)
+	}
+
+	if len(a.AdapterPaths) == 0 {
+		return nil, fmt.Errorf("%w: %s has no adapters", errBadOption, name)
+	}
+
+	if a.ModelPath != m.ModelPath {
+		return nil, fmt.Errorf("%w: the adapters of %s are for another model than %s", errBadOption, name, m.ShortName)
+	}
+
+	// the sandboxed runner can only read the files it was loaded with
+	if envconfig.Sandbox() {
+		return nil, fmt.Errorf("%w: adapters can't be loaded by sandboxed runners", errBadOption)
+	}
+
+	var paths []string
+	for _, p := range a.AdapterPaths {
+		if !slices.Contains(m.AdapterPaths, p) {
+			paths = append(paths, p)
+		}
+	}
+
+	return paths, nil
+}
+
+// adapterNames returns the names of the models t owns by the digests of
+// their adapters
+func adapterNames(t *tenant) map[string][]string {
+	ms, err := Manifests(true)
+	if err != nil {
+		return nil
+	}
+
+	names := make(map[string][]string)
+	for n, m := range ms {
+		if !t.owns(n) {
+			continue
+		}
+
+		for _, l := range m.Layers {
+			if l.MediaType == "application/vnd.ollama.image.adapter" {
+				names[l.Digest] = append(names[l.Digest], n.DisplayShortest())
+			}
+		}
+	}
+
+	for _, v := range names {
+		slices.Sort(v)
+	}
+
+	return names
+}
+
+func (s *Server) ListAdaptersHandler(c *gin.Context) {
+	t := tenantFromContext(c.Request.Context())
+
+	s.sched.loadedMu.Lock()
+	runners := make([]*runnerRef, 0, len(s.sched.loaded))
+	for _, r := range s.sched.loaded {
+		if t.owns(model.ParseName(r.model.Name)) {
+			runners = append(runners, r)
+		}
+	}
+	s.sched.loadedMu.Unlock()
+
+	names := adapterNames(t)
+	adapters := []api.AdapterResponse{}
+	for _, r := range runners {
+		loaded, err := r.llama.Adapters(c.Request.Context())
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		for _, a := range loaded {
+			// blobs are named with the digest of their content
+			digest := strings.Replace(filepath.Base(a.Path), "-", ":", 1)
+			adapters = append(adapters, api.AdapterResponse{
+				Model:    r.model.ShortName,
+				Adapters: names[digest],
+				Digest:   digest,
+				Requests: a.Sequences,
+				LastUsed: a.LastUsed,
+			})
+		}
+	}
+
+	slices.SortStableFunc(adapters, func(a, b api.AdapterResponse) int {
+		return cmp.Or(strings.Compare(a.Model, b.Model), b.LastUsed.Compare(a.LastUsed))
+	})
+
+	c.JSON(http.StatusOK, api.ListAdaptersResponse{Adapters: adapters})
+}
+
+// bindAdapterRequest binds the request to load or unload the adapter of a
+// model, writing an error response if it fails
+func bindAdapterRequest(c *gin.Context) (api.AdapterRequest, bool) {
+	var req api.AdapterRequest
+	if err := bindRequest(c, &req); errors.Is(err, io.EOF) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "missing request body"})
+		return req, false
+	} else if err != nil {
+		c.AbortWithStatusJSON(bindStatus(err), gin.H{"error": err.Error()})
+		return req, false
+	}
+
+	if req.Model == "" || req.Adapter == "" {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "model and adapter are required"})
+		return req, false
+	}
+
+	return req, true
+}
+
+// LoadAdapterHandler loads a model and the adapter of another model created
+// from it ahead of the requests that use it. Runners keep the adapters they
+// load for requests until there are more than OLLAMA_MAX_ADAPTERS, when the
+// least recently used one that isn't in use is unloaded.
+func (s *Server) LoadAdapterHandler(c *gin.Context) {
+	req, ok := bindAdapterRequest(c)
+	if !ok {
+		return
+	}
+
+	r, m, _, err := s.scheduleRunner(c.Request.Context(), req.Model, nil, map[string]any{"adapter": req.Adapter}, req.KeepAlive)
+	if err != nil {
+		handleScheduleError(c, req.Model, err)
+		return
+	}
+
+	for _, p := range m.RuntimeAdapterPaths {
+		if err := r.LoadAdapter(c.Request.Context(), p); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	c.Status(http.StatusOK)
+}
+
+// UnloadAdapterHandler unloads the adapter of a running model if no request
+// is using it
+func (s *Server) UnloadAdapterHandler(c *gin.Context) {
+	req, ok := bindAdapterRequest(c)
+	if !ok {
+		return
+	}
+
+	t := tenantFromContext(c.Request.Context())
+	n := model.ParseName(req.Model)
+	if !n.IsValid() {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("invalid model %q", req.Model)})
+		return
+	}
+
+	if err := t.checkModel(n); err != nil {
+		handleScheduleError(c, req.Model, err)
+		return
+	}
+
+	m, err := GetModel(req.Model)
+	if err != nil {
+		handleScheduleError(c, req.Model, err)
+		return
+	}
+
+	paths, err := runtimeAdapters(t, m, req.Adapter)
+	if err != nil {
+		handleScheduleError(c, req.Model, err)
+		return
+	}
+
+	s.sched.loadedMu.Lock()
+	r := s.sched.loaded[m.ModelPath]
+	s.sched.loadedMu.Unlock()
+	if r == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("model %q is not running", req.Model)})
+		return
+	}
+
+	for _, p := range paths {
+		switch err := r.llama.UnloadAdapter(c.Request.Context(), p); {
+		case errors.Is(err, os.ErrNotExist):
+			c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("adapter %q is not loaded", req.Adapter)})
+			return
+		case errors.Is(err, llm.ErrAdapterInUse):
+			c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("adapter %q is in use", req.Adapter)})
+			return
+		case err != nil:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	c.Status(http.StatusOK)
+}
@@ -0,0 +1,116 @@
+package server
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/envconfig"
+	"github.com/ollama/ollama/types/model"
+)
+
+// affinityHeader is the response header generate and chat requests return
+// their affinity token in
+const affinityHeader = "X-Ollama-Affinity"
+
+// affinityPrefix is the length in bytes of the start of a prompt that
+// requests without a session are routed by. Prompts sharing it, such as a
+// long system prompt, share the KV cache the runner keeps for it.
+const affinityPrefix = 256
+
+// serverID returns the name this server gives itself in affinity tokens
+func serverID() string {
+	if id := envconfig.ServerID(); id != "" {
+		return id
+	}
+
+	if host, err := os.Hostname(); err == nil && host != "" {
+		return host
+	}
+
+	return "ollama"
+}
+
+// affinityToken returns the token of the KV cache a request would use, the
+// tenant's session with sessionID or else the prefix of prompt, as a key
+// followed by the server holding it. Load balancers in front of several
+// servers can route requests with the same key to the same server with
+// consistent hashing, or follow-up requests to the server they name.
+func affinityToken(t *tenant, model, sessionID, prompt string) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\x00%s\x00", tenantName(t), model)
+	if sessionID != "" {
+		fmt.Fprintf(h, "session\x00%s", sessionID)
+	} else {
+		fmt.Fprintf(h, "prefix\x00%s", prompt[:min(len(prompt), affinityPrefix)])
+	}
+
+	return fmt.Sprintf("%x@%s", h.Sum(nil)[:8], serverID())
+}
+
+// chatPrefix returns the start of msgs that the prompt of a chat starts with
+func chatPrefix(msgs []api.Message) string {
+	var sb strings.Builder
+	for _, msg := range msgs {
+		if sb.Len() >= affinityPrefix {
+			break
+		}
+
+		fmt.Fprintf(&sb, "%s\x00%s\x00", msg.Role, msg.Content)
+	}
+
+	return sb.String()
+}
+
+func (s *Server) AffinityHandler(c *gin.Context) {
+	var req api.AffinityRequest
+	if err := bindRequest(c, &req); errors.Is(err, io.EOF) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "missing request body"})
+		return
+	} else if err != nil {
+		c.AbortWithStatusJSON(bindStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+
+	if req.Prompt != "" && len(req.Messages) > 0 {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "prompt can't be used with messages"})
+		return
+	}
+
+	t := tenantFromContext(c.Request.Context())
+	name, err := getExistingName(model.ParseName(req.Model))
+	if err != nil || t.checkModel(name) != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("model '%s' not found", req.Model)})
+		return
+	}
+
+	m, err := GetModel(name.String())
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("model '%s' not found", req.Model)})
+		return
+	}
+
+	prompt := req.System + req.Prompt
+	if len(req.Messages) > 0 {
+		prompt = chatPrefix(req.Messages)
+	}
+
+	resp := api.AffinityResponse{
+		Token:  affinityToken(t, name.String(), req.SessionID, prompt),
+		Server: serverID(),
+		Loaded: s.sched.isLoaded(m),
+	}
+
+	if req.SessionID != "" {
+		resp.Session = s.sessions.exists(t, req.SessionID)
+	}
+
+	c.JSON(http.StatusOK, resp)
+}
@@ -0,0 +1,105 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/ollama/ollama/api"
+)
+
+func TestAffinityToken(t *testing.T) {
+	t.Setenv("OLLAMA_SERVER_ID", "gpu-node-2")
+
+	a, b := &tenant{name: "team-a"}, &tenant{name: "team-b"}
+	long := strings.Repeat("You are a helpful assistant. ", 20)
+
+	token := affinityToken(a, "llama3.2:latest", "chat", "Hi")
+	if !strings.HasSuffix(token, "@gpu-node-2") {
+		t.Errorf("expected the token to name the server, got %q", token)
+	}
+
+	for _, tt := range []struct {
+		name  string
+		a, b  string
+		equal bool
+	}{
+		{"session", token, affinityToken(a, "llama3.2:latest", "chat", "Hello again"), true},
+		{"other session", token, affinityToken(a, "llama3.2:latest", "chat-2", "Hi"), false},
+		{"other tenant", token, affinityToken(b, "llama3.2:latest", "chat", "Hi"), false},
+		{"prefix", affinityToken(a, "llama3.2:latest", "", long+"Hi"), affinityToken(a, "llama3.2:latest", "", long+"Bye"), true},
+		{"other prefix", affinityToken(a, "llama3.2:latest", "", "Hi"), affinityToken(a, "llama3.2:latest", "", "Bye"), false},
+		{"other model", affinityToken(a, "llama3.2:latest", "", "Hi"), affinityToken(a, "mistral:latest", "", "Hi"), false},
+	} {
+		if (tt.a == tt.b) != tt.equal {
+			t.Errorf("%s: expected %q and %q to be equal: %v", tt.name, tt.a, tt.b, tt.equal)
+		}
+	}
+}
+
+func TestAffinityHandler(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+	t.Setenv("OLLAMA_SERVER_ID", "gpu-node-2")
+
+	var s Server
+	w := createRequest(t, s.CreateHandler, api.CreateRequest{
+		Model:     "test",
+		Modelfile: "FROM " + createBinFile(t, nil, nil),
+		Stream:    &stream,
+	})
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+
+	affinity := func(t *testing.T, req api.AffinityRequest) api.AffinityResponse {
+		t.Helper()
+		w := createRequest(t, s.AffinityHandler, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+
+		var resp api.AffinityResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatal(err)
+		}
+
+		return resp
+	}
+
+	resp := affinity(t, api.AffinityRequest{Model: "test", SessionID: "chat"})
+	if resp.Server != "gpu-node-2" || resp.Loaded || resp.Session {
+		t.Errorf("unexpected response %+v", resp)
+	}
+
+	sess, err := s.sessions.get(nil, "chat", "test:latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.sessions.add(sess, api.Message{Role: "user", Content: "Hi"})
+
+	if again := affinity(t, api.AffinityRequest{Model: "test", SessionID: "chat"}); !again.Session || again.Token != resp.Token {
+		t.Errorf("expected the session on the server with the same token, got %+v", again)
+	}
+
+	msgs := []api.Message{{Role: "system", Content: "Be brief."}, {Role: "user", Content: "Hi"}}
+	if chat := affinity(t, api.AffinityRequest{Model: "test", Messages: msgs}); chat.Token == resp.Token || chat.Session {
+		t.Errorf("expected a token for the messages, got %+v", chat)
+	}
+
+	for _, tt := range []struct {
+		req  api.AffinityRequest
+		code int
+	}{
+		{api.AffinityRequest{Model: "missing"}, http.StatusNotFound},
+		{api.AffinityRequest{Model: "test", Prompt: "Hi", Messages: msgs}, http.StatusBadRequest},
+	} {
+		if w := createRequest(t, s.AffinityHandler, tt.req); w.Code != tt.code {
+			t.Errorf("%+v: expected status %d, got %d", tt.req, tt.code, w.Code)
+		}
+	}
+}
@@ -0,0 +1,219 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/llm"
+	"github.com/ollama/ollama/template"
+	"github.com/ollama/ollama/types/model"
+)
+
+// maxBatchPrompts is the most prompts a generate request can have
+const maxBatchPrompts = 256
+
+// generateBatch generates a response to each of the prompts of req at once.
+// They're all sent to the runner together so it can schedule them in its
+// parallel slots, as it does for concurrent requests, and streamed back
+// interleaved with the index of their prompt.
+func (s *Server) generateBatch(c *gin.Context, req api.GenerateRequest, name model.Name, checkpointStart time.Time) {
+	if len(req.Prompts) == 0 || len(req.Prompts) > maxBatchPrompts {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("prompt must have between 1 and %d prompts", maxBatchPrompts)})
+		return
+	}
+
+	if req.InputTokens != nil || req.Suffix != "" || len(req.Context) > 0 || len(req.Images) > 0 || req.Return != "" || req.Head != "" || req.Reranker != "" || req.TraceSampling > 0 || req.Logprobs || req.ReturnTokens || req.PositionOffset != 0 || req.Compressor != "" {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "a batch of prompts can't be used with input_tokens, suffix, context, images, return, head, reranker, trace_sampling, logprobs, return_tokens, position_offset or compressor"})
+		return
+	}
+
+	r, m, opts, err := s.scheduleRunner(c.Request.Context(), name.String(), []Capability{CapabilityCompletion}, req.Options, req.KeepAlive)
+	if errors.Is(err, errCapabilityCompletion) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("%q does not support generate", req.Model)})
+		return
+	} else if err != nil {
+		handleScheduleError(c, req.Model, err)
+		return
+	}
+
+	if opts.BestOf > 1 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "best_of can't be used with a batch of prompts"})
+		return
+	}
+
+	numCtx := reducedContext(m, req.Options, opts)
+
+	// each prompt is processed on its own, so this only checks the options
+	procs, err := parseProcessors(opts.Processors)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if _, err := newThinkingBudget(*opts, &procs); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	tmpl := m.Template
+	if req.Template != "" {
+		if tmpl, err = template.Parse(req.Template); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	checkpointLoaded := time.Now()
+
+	ctx := c.Request.Context()
+	ch := make(chan any)
+	send := func(v any) {
+		select {
+		case ch <- v:
+		case <-ctx.Done():
+		}
+	}
+
+	var wg sync.WaitGroup
+	for i, p := range req.Prompts {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := generatePrompt(ctx, r, m, tmpl, opts, req, i, p, func(res api.GenerateResponse) {
+				if res.Done {
+					res.TotalDuration = time.Since(checkpointStart)
+					res.LoadDuration = checkpointLoaded.Sub(checkpointStart)
+					res.ContextLength = numCtx
+					res.Metadata = req.Metadata
+					usage.record(m.ShortName, req.Metadata, res.Metrics)
+				}
+
+				send(res)
+			}); err != nil {
+				send(gin.H{"error": err.Error(), "index": i})
+			}
+		}()
+	}
+
+	go func() {
+		wg.Wait()
+		close(ch)
+	}()
+
+	if req.Stream != nil && !*req.Stream {
+		responses := make([]api.GenerateResponse, len(req.Prompts))
+		sbs := make([]strings.Builder, len(req.Prompts))
+		thinking := make([]strings.Builder, len(req.Prompts))
+		for rr := range ch {
+			switch t := rr.(type) {
+			case api.GenerateResponse:
+				i := *t.Index
+				sbs[i].WriteString(t.Response)
+				thinking[i].WriteString(t.Thinking)
+				responses[i] = t
+			case gin.H:
+				msg, ok := t["error"].(string)
+				if !ok {
+					msg = "unexpected error format in response"
+				}
+
+				c.JSON(http.StatusInternalServerError, gin.H{"error": msg, "index": t["index"]})
+				return
+			default:
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "unexpected response"})
+				return
+			}
+		}
+
+		for i := range responses {
+			responses[i].Response = sbs[i].String()
+			responses[i].Thinking = thinking[i].String()
+		}
+
+		c.JSON(http.StatusOK, responses)
+		return
+	}
+
+	streamResponse(c, ch)
+}
+
+// generatePrompt generates the response to prompt i of a batch, calling fn
+// with each chunk of it
+func generatePrompt(ctx context.Context, r llm.LlamaServer, m *Model, tmpl *template.Template, opts *api.Options, req api.GenerateRequest, i int, prompt string, fn func(api.GenerateResponse)) error {
+	procs, err := parseProcessors(opts.Processors)
+	if err != nil {
+		return err
+	}
+
+	budget, err := newThinkingBudget(*opts, &procs)
+	if err != nil {
+		return err
+	}
+
+	if !req.Raw {
+		var msgs []api.Message
+		if req.System != "" {
+			msgs = append(msgs, api.Message{Role: "system", Content: req.System})
+		} else if m.System != "" {
+			msgs = append(msgs, api.Message{Role: "system", Content: m.System})
+		}
+
+		msgs = append(msgs, m.Messages...)
+
+		var b bytes.Buffer
+		if err := tmpl.Execute(&b, template.Values{
+			Messages: append(msgs, api.Message{Role: "user", Content: prompt}),
+			Tokenize: countTokens(ctx, r.Tokenize),
+		}); err != nil {
+			return err
+		}
+
+		prompt = b.String()
+	}
+
+	return budget.complete(ctx, r, llm.CompletionRequest{
+		Prompt:   prompt,
+		Format:   req.Format,
+		Options:  opts,
+		Adapters: m.RuntimeAdapterPaths,
+	}, func(cr llm.CompletionResponse) {
+		processed := procs.process(cr.Content, cr.Done)
+		if !cr.Done && processed.Content == "" && processed.Thinking == "" && cr.Content != "" {
+			// held back by a processor
+			return
+		}
+
+		res := api.GenerateResponse{
+			Model:      req.Model,
+			CreatedAt:  time.Now().UTC(),
+			Index:      &i,
+			Response:   processed.Content,
+			Thinking:   processed.Thinking,
+			Done:       cr.Done,
+			DoneReason: cr.DoneReason,
+			Metrics: api.Metrics{
+				PromptEvalCount:    cr.PromptEvalCount,
+				PromptEvalDuration: cr.PromptEvalDuration,
+				PromptCachedCount:  cr.PromptCachedCount,
+				EvalCount:          cr.EvalCount,
+				EvalDuration:       cr.EvalDuration,
+				EnergyJoules:       cr.Energy,
+			},
+		}
+
+		if cr.Done {
+			res.Code = processed.Code
+		}
+
+		fn(res)
+	})
+}
@@ -0,0 +1,167 @@
+package server
+
+import (
+	"cmp"
+	"context"
+	"slices"
+	"strings"
+	"sync"
+
+	"golang.org/x/sync/errgroup"
+
+	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/llm"
+	"github.com/ollama/ollama/types/model"
+)
+
+// maxBestOf is the most candidates that can be generated for a request
+const maxBestOf = 16
+
+// candidate is a response generated with the best_of option
+type candidate struct {
+	api.Candidate
+	api.Metrics
+
+	// context is tokenized before the runner is released for a reranker
+	context []int
+}
+
+// generateCandidates generates n responses to req. The first is started on
+// its own and the others once it has processed the prompt, so they can fork
+// the prompt from its cache instead of processing it again.
+func generateCandidates(ctx context.Context, r llm.LlamaServer, req llm.CompletionRequest, n int, logprobs bool) ([]candidate, error) {
+	candidates := make([]candidate, n)
+
+	started := make(chan struct{})
+	var once sync.Once
+
+	g, ctx := errgroup.WithContext(ctx)
+	generate := func(i int) error {
+		req := req
+		opts := *req.Options
+		if opts.Seed >= 0 {
+			// candidates sampled with the same seed would all be the same
+			opts.Seed += i
+		}
+
+		req.Options = &opts
+		req.Logprobs = logprobs
+		req.SharePrompt = i > 0
+
+		var sb strings.Builder
+		c := &candidates[i]
+		return r.Completion(ctx, req, func(cr llm.CompletionResponse) {
+			if i == 0 {
+				once.Do(func() { close(started) })
+			}
+
+			sb.WriteString(cr.Content)
+			if cr.Done {
+				c.Response = sb.String()
+				c.DoneReason = cr.DoneReason
+				c.Score = cr.Logprob
+				c.Metrics = api.Metrics{
+					PromptEvalCount:    cr.PromptEvalCount,
+					PromptEvalDuration: cr.PromptEvalDuration,
+					PromptCachedCount:  cr.PromptCachedCount,
+					EvalCount:          cr.EvalCount,
+					EvalDuration:       cr.EvalDuration,
+					EnergyJoules:       cr.Energy,
+				}
+			}
+		})
+	}
+
+	g.Go(func() error {
+		defer once.Do(func() { close(started) })
+		return generate(0)
+	})
+
+	select {
+	case <-started:
+	case <-ctx.Done():
+	}
+
+	for i := 1; i < n; i++ {
+		g.Go(func() error { return generate(i) })
+	}
+
+	if err := g.Wait(); err != nil {
+		return nil, err
+	}
+
+	return candidates, nil
+}
+
+// reranker is a reward model which scores candidates in place of their log
+// probabilities
+type reranker struct {
+	name string
+	head *outputHead
+}
+
+func loadReranker(name string) (*reranker, error) {
+	n, err := getExistingName(model.ParseName(name))
+	if err != nil {
+		return nil, err
+	}
+
+	m, err := GetModel(n.String())
+	if err != nil {
+		return nil, err
+	}
+
+	head, err := m.rewardHead("")
+	if err != nil {
+		return nil, err
+	}
+
+	return &reranker{name: n.String(), head: head}, nil
+}
+
+// rerank replaces the scores of candidates to prompt with their rewards
+func (s *Server) rerank(ctx context.Context, rr *reranker, prompt string, candidates []candidate) error {
+	r, m, opts, err := s.scheduleRunner(ctx, rr.name, []Capability{}, nil, nil)
+	if err != nil {
+		return err
+	}
+
+	prompts := make([]string, len(candidates))
+	for i, c := range candidates {
+		if prompts[i], err = rewardPrompt(m, "", prompt, c.Response); err != nil {
+			return err
+		}
+	}
+
+	scores, _, err := score(ctx, r, opts, rr.head, prompts)
+	if err != nil {
+		return err
+	}
+
+	for i := range candidates {
+		candidates[i].Score = float64(scores[i])
+	}
+
+	return nil
+}
+
+// best returns the candidate with the highest score and the metrics of
+// generating all of them. The prompt is only processed once so its metrics
+// are those of the first candidate.
+func best(candidates []candidate) (candidate, api.Metrics) {
+	metrics := api.Metrics{
+		PromptEvalCount:    candidates[0].PromptEvalCount,
+		PromptEvalDuration: candidates[0].PromptEvalDuration,
+		PromptCachedCount:  candidates[0].PromptCachedCount,
+	}
+
+	for _, c := range candidates {
+		metrics.EvalCount += c.EvalCount
+		metrics.EvalDuration += c.EvalDuration
+		metrics.EnergyJoules += c.EnergyJoules
+	}
+
+	return slices.MaxFunc(candidates, func(a, b candidate) int {
+		return cmp.Compare(a.Score, b.Score)
+	}), metrics
+}
@@ -0,0 +1,350 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/discover"
+	"github.com/ollama/ollama/llm"
+)
+
+func TestGenerateBestOf(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+
+	var mu sync.Mutex
+	var requests []llm.CompletionRequest
+
+	mock := mockRunner{
+		CompletionFn: func(ctx context.Context, r llm.CompletionRequest, fn func(llm.CompletionResponse)) error {
+			mu.Lock()
+			requests = append(requests, r)
+			mu.Unlock()
+
+			// scoring with the reward head, the hidden state is 1 for the
+			// second candidate and 0 otherwise
+			if r.Return == "hidden_states" {
+				hidden := make([]float32, 4096)
+				if strings.Contains(r.Prompt, "assistant: candidate 1") {
+					for i := range hidden {
+						hidden[i] = 1
+					}
+				}
+
+				fn(llm.CompletionResponse{Done: true, HiddenStates: hidden})
+				return nil
+			}
+
+			// the last candidate is the most likely
+			fn(llm.CompletionResponse{Content: fmt.Sprintf("candidate %d", r.Options.Seed)})
+			fn(llm.CompletionResponse{
+				Done:            true,
+				DoneReason:      "stop",
+				Logprob:         float64(r.Options.Seed),
+				PromptEvalCount: 5,
+				EvalCount:       2,
+			})
+			return nil
+		},
+	}
+
+	s := Server{
+		sched: &Scheduler{
+			pendingReqCh:  make(chan *LlmRequest, 1),
+			finishedReqCh: make(chan *LlmRequest, 1),
+			expiredCh:     make(chan *runnerRef, 1),
+			unloadedCh:    make(chan any, 1),
+			loaded:        make(map[string]*runnerRef),
+			newServerFn:   newMockServer(&mock),
+			getGpuFn:      discover.GetGPUInfo,
+			getCpuFn:      discover.GetCPUInfo,
+			reschedDelay:  250 * time.Millisecond,
+			loadFn: func(req *LlmRequest, ggml *llm.GGML, gpus discover.GpuInfoList, numParallel int) {
+				req.successCh <- &runnerRef{
+					llama: &mock,
+				}
+			},
+		},
+	}
+
+	go s.sched.Run(context.TODO())
+
+	weight := make([]float32, 4096)
+	for i := range weight {
+		weight[i] = 0.5
+	}
+
+	w := createRequest(t, s.CreateHandler, api.CreateRequest{
+		Model: "test",
+		Modelfile: fmt.Sprintf("FROM %s\nTEMPLATE \"{{ range .Messages }}{{ .Role }}: {{ .Content }}\n{{ end }}\"\nHEAD %s",
+			createBinFile(t, llm.KV{
+				"general.architecture":          "llama",
+				"llama.block_count":             uint32(1),
+				"llama.context_length":          uint32(8192),
+				"llama.embedding_length":        uint32(4096),
+				"llama.attention.head_count":    uint32(32),
+				"llama.attention.head_count_kv": uint32(8),
+				"tokenizer.ggml.tokens":         []string{""},
+				"tokenizer.ggml.scores":         []float32{0},
+				"tokenizer.ggml.token_type":     []int32{0},
+			}, []llm.Tensor{
+				{Name: "token_embd.weight", Shape: []uint64{1}, WriterTo: bytes.NewReader(make([]byte, 4))},
+			}),
+			createHeadFile(t, llm.KV{"general.architecture": "llama", "head.name": "reward"}, [][]float32{weight}),
+		),
+		Stream: &stream,
+	})
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+
+	generate := func(t *testing.T, req api.GenerateRequest) api.GenerateResponse {
+		t.Helper()
+
+		requests = nil
+		w := createRequest(t, s.GenerateHandler, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+
+		var resp api.GenerateResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+
+		return resp
+	}
+
+	t.Run("logprobs", func(t *testing.T) {
+		resp := generate(t, api.GenerateRequest{
+			Model:   "test",
+			Prompt:  "Hello!",
+			Stream:  &stream,
+			Options: map[string]any{"best_of": 3, "seed": 0},
+		})
+
+		if resp.Response != "candidate 2" {
+			t.Errorf("expected candidate 2, got %q", resp.Response)
+		}
+
+		if resp.Candidates != nil {
+			t.Errorf("expected no candidates, got %v", resp.Candidates)
+		}
+
+		if resp.PromptEvalCount != 5 || resp.EvalCount != 6 {
+			t.Errorf("expected prompt eval count 5 and eval count 6, got %d and %d", resp.PromptEvalCount, resp.EvalCount)
+		}
+
+		if len(requests) != 3 {
+			t.Fatalf("expected 3 requests, got %d", len(requests))
+		}
+
+		// the first candidate processes the prompt for the others
+		slices.SortFunc(requests, func(a, b llm.CompletionRequest) int { return a.Options.Seed - b.Options.Seed })
+		for i, r := range requests {
+			if !r.Logprobs || r.SharePrompt != (i > 0) {
+				t.Errorf("candidate %d: expected logprobs and share prompt %v, got %v and %v", i, i > 0, r.Logprobs, r.SharePrompt)
+			}
+		}
+	})
+
+	t.Run("reranker", func(t *testing.T) {
+		resp := generate(t, api.GenerateRequest{
+			Model:            "test",
+			Prompt:           "Hello!",
+			Stream:           &stream,
+			Reranker:         "test",
+			ReturnCandidates: true,
+			Options:          map[string]any{"best_of": 3, "seed": 0},
+		})
+
+		if resp.Response != "candidate 1" {
+			t.Errorf("expected candidate 1, got %q", resp.Response)
+		}
+
+		if diff := cmp.Diff(resp.Candidates, []api.Candidate{
+			{Response: "candidate 0", DoneReason: "stop", Score: 1},
+			{Response: "candidate 1", DoneReason: "stop", Score: 2049},
+			{Response: "candidate 2", DoneReason: "stop", Score: 1},
+		}); diff != "" {
+			t.Errorf("mismatch (-got +want):\n%s", diff)
+		}
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		cases := []struct {
+			name string
+			req  api.GenerateRequest
+			code int
+			err  string
+		}{
+			{
+				name: "too many",
+				req:  api.GenerateRequest{Model: "test", Prompt: "Hello!", Options: map[string]any{"best_of": 17}},
+				code: http.StatusBadRequest,
+				err:  `{"error":"best_of must be between 1 and 16"}`,
+			},
+			{
+				name: "head",
+				req:  api.GenerateRequest{Model: "test", Prompt: "Hello!", Head: "reward", Options: map[string]any{"best_of": 2}},
+				code: http.StatusBadRequest,
+				err:  `{"error":"best_of can't be used with head or return"}`,
+			},
+			{
+				name: "missing reranker",
+				req:  api.GenerateRequest{Model: "test", Prompt: "Hello!", Reranker: "missing", Options: map[string]any{"best_of": 2}},
+				code: http.StatusNotFound,
+				err:  `{"error":"model 'missing' not found"}`,
+			},
+		}
+
+		for _, tt := range cases {
+			t.Run(tt.name, func(t *testing.T) {
+				w := createRequest(t, s.GenerateHandler, tt.req)
+				if w.Code != tt.code {
+					t.Errorf("expected status %d, got %d", tt.code, w.Code)
+				}
+
+				if diff := cmp.Diff(w.Body.String(), tt.err); diff != "" {
+					t.Errorf("mismatch (-got +want):\n%s", diff)
+				}
+			})
+		}
+	})
+}
+
+// residentRunner is a mock runner which can be unloaded by the scheduler
+type residentRunner struct {
+	*mockRunner
+}
+
+func (residentRunner) Ping(context.Context) error { return nil }
+
+func (residentRunner) Close() error { return nil }
+
+func TestGenerateBestOfRerankerOneModel(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+	t.Setenv("OLLAMA_MAX_LOADED_MODELS", "1")
+
+	mock := mockRunner{
+		CompletionFn: func(ctx context.Context, r llm.CompletionRequest, fn func(llm.CompletionResponse)) error {
+			if r.Return == "hidden_states" {
+				fn(llm.CompletionResponse{Done: true, HiddenStates: make([]float32, 4096)})
+				return nil
+			}
+
+			fn(llm.CompletionResponse{Content: fmt.Sprintf("candidate %d", r.Options.Seed)})
+			fn(llm.CompletionResponse{Done: true, DoneReason: "stop"})
+			return nil
+		},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	s := Server{sched: InitScheduler(ctx)}
+	s.sched.getGpuFn = discover.GetGPUInfo
+	s.sched.getCpuFn = discover.GetCPUInfo
+	s.sched.loadFn = func(req *LlmRequest, ggml *llm.GGML, gpus discover.GpuInfoList, numParallel int) {
+		runner := &runnerRef{
+			model:       req.model,
+			modelPath:   req.model.ModelPath,
+			llama:       residentRunner{&mock},
+			Options:     &req.opts,
+			refCount:    1,
+			numParallel: 1,
+		}
+
+		s.sched.loadedMu.Lock()
+		s.sched.loaded[req.model.ModelPath] = runner
+		s.sched.loadedMu.Unlock()
+
+		go func() {
+			<-req.ctx.Done()
+			s.sched.finishedReqCh <- req
+		}()
+		req.successCh <- runner
+	}
+
+	s.sched.Run(ctx)
+
+	create := func(name, modelfile string) {
+		w := createRequest(t, s.CreateHandler, api.CreateRequest{Model: name, Modelfile: modelfile, Stream: &stream})
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+	}
+
+	bin := func(name string) string {
+		return createBinFile(t, llm.KV{
+			"general.architecture":          "llama",
+			"general.name":                  name,
+			"llama.block_count":             uint32(1),
+			"llama.context_length":          uint32(8192),
+			"llama.embedding_length":        uint32(4096),
+			"llama.attention.head_count":    uint32(32),
+			"llama.attention.head_count_kv": uint32(8),
+			"tokenizer.ggml.tokens":         []string{""},
+			"tokenizer.ggml.scores":         []float32{0},
+			"tokenizer.ggml.token_type":     []int32{0},
+		}, []llm.Tensor{
+			{Name: "token_embd.weight", Shape: []uint64{1}, WriterTo: bytes.NewReader(make([]byte, 4))},
+		})
+	}
+
+	create("test", fmt.Sprintf("FROM %s\nTEMPLATE \"{{ .Prompt }}\"", bin("test")))
+	create("reward", fmt.Sprintf("FROM %s\nTEMPLATE \"{{ range .Messages }}{{ .Role }}: {{ .Content }}\n{{ end }}\"\nHEAD %s", bin("reward"),
+		createHeadFile(t, llm.KV{"general.architecture": "llama", "head.name": "reward"}, [][]float32{make([]float32, 4096)})))
+
+	// the generating model is unloaded to make room for the reranker, which
+	// would wait forever if it were still in use
+	done := make(chan *httptest.ResponseRecorder)
+	go func() {
+		done <- createRequest(t, s.GenerateHandler, api.GenerateRequest{
+			Model:    "test",
+			Prompt:   "Hello!",
+			Reranker: "reward",
+			Stream:   &stream,
+			Options:  map[string]any{"best_of": 2, "seed": 0},
+		})
+	}()
+
+	select {
+	case w := <-done:
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+
+		var resp api.GenerateResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+
+		if !strings.HasPrefix(resp.Response, "candidate") || len(resp.Context) == 0 {
+			t.Errorf("unexpected response %q with context %v", resp.Response, resp.Context)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the reranker")
+	}
+
+	s.sched.loadedMu.Lock()
+	defer s.sched.loadedMu.Unlock()
+	if len(s.sched.loaded) != 1 {
+		t.Errorf("expected 1 loaded model, got %d", len(s.sched.loaded))
+	}
+}
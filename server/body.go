@@ -0,0 +1,152 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/format"
+)
+
+// requestTooLargeError is returned when reading a request body over the
+// limit set by OLLAMA_MAX_REQUEST_SIZE
+type requestTooLargeError struct {
+	limit int64
+}
+
+func (e *requestTooLargeError) Error() string {
+	return fmt.Sprintf("request body is larger than %s, the limit set by OLLAMA_MAX_REQUEST_SIZE", format.HumanBytes(e.limit))
+}
+
+// limitedBody reports reads past the limit of a http.MaxBytesReader as a
+// requestTooLargeError
+type limitedBody struct {
+	io.ReadCloser
+}
+
+func (b limitedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+
+	var maxErr *http.MaxBytesError
+	if errors.As(err, &maxErr) {
+		err = &requestTooLargeError{limit: maxErr.Limit}
+	}
+
+	return n, err
+}
+
+// bodyLimitMiddleware rejects request bodies larger than limit bytes, other
+// than blob uploads. Bodies without a length, such as chunked uploads, fail
+// once limit bytes have been read.
+func bodyLimitMiddleware(limit int64) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if limit <= 0 || c.FullPath() == "/api/blobs/:digest" {
+			c.Next()
+			return
+		}
+
+		if c.Request.ContentLength > limit {
+			c.AbortWithStatusJSON(http.StatusRequestEntityTooLarge, gin.H{"error": (&requestTooLargeError{limit: limit}).Error()})
+			return
+		}
+
+		c.Request.Body = limitedBody{http.MaxBytesReader(c.Writer, c.Request.Body, limit)}
+		c.Next()
+	}
+}
+
+// bindStatus returns the status code for an error reading a request body
+func bindStatus(err error) int {
+	var tooLarge *requestTooLargeError
+	if errors.As(err, &tooLarge) {
+		return http.StatusRequestEntityTooLarge
+	}
+
+	return http.StatusBadRequest
+}
+
+// bindRequest decodes a generate or chat request from a JSON body, or from a
+// multipart form. A form's "request" part holds the JSON request, while large
+// inputs can be sent as separate parts so they're read directly rather than
+// base64 encoded in JSON: "prompt" for a generate request or "content" for the
+// last chat message, and any number of "images".
+func bindRequest(c *gin.Context, v any) error {
+	mediaType, params, err := mime.ParseMediaType(c.GetHeader("Content-Type"))
+	if err != nil || mediaType != "multipart/form-data" {
+		return c.ShouldBindJSON(v)
+	}
+
+	var request, text bool
+	var content strings.Builder
+	var images []api.ImageData
+
+	mr := multipart.NewReader(c.Request.Body, params["boundary"])
+	for {
+		part, err := mr.NextPart()
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return err
+		}
+
+		switch name := part.FormName(); name {
+		case "request":
+			if err := json.NewDecoder(part).Decode(v); err != nil {
+				return fmt.Errorf("request: %w", err)
+			}
+
+			request = true
+		case "prompt", "content":
+			if _, err := io.Copy(&content, part); err != nil {
+				return err
+			}
+
+			text = true
+		case "images":
+			image, err := io.ReadAll(part)
+			if err != nil {
+				return err
+			}
+
+			images = append(images, image)
+		default:
+			return fmt.Errorf("unexpected form part %q", name)
+		}
+	}
+
+	if !request {
+		return errors.New("missing request part")
+	}
+
+	switch req := v.(type) {
+	case *api.GenerateRequest:
+		if text {
+			req.Prompt = content.String()
+		}
+
+		req.Images = append(req.Images, images...)
+	case *api.ChatRequest:
+		if text || len(images) > 0 {
+			if len(req.Messages) == 0 {
+				return errors.New("content and images parts require a message")
+			}
+
+			msg := &req.Messages[len(req.Messages)-1]
+			if text {
+				msg.Content = content.String()
+			}
+
+			msg.Images = append(msg.Images, images...)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,183 @@
+package server
+
+import (
+	"bytes"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/ollama/ollama/api"
+)
+
+func TestBodyLimitMiddleware(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	router := gin.New()
+	router.Use(bodyLimitMiddleware(16))
+	router.POST("/api/generate", func(c *gin.Context) {
+		var req api.GenerateRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.AbortWithStatusJSON(bindStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+
+		c.Status(http.StatusOK)
+	})
+	router.POST("/api/blobs/:digest", func(c *gin.Context) {
+		n, _ := io.Copy(io.Discard, c.Request.Body)
+		c.String(http.StatusOK, "%d", n)
+	})
+
+	cases := []struct {
+		name   string
+		path   string
+		body   string
+		length bool
+		status int
+	}{
+		{"small", "/api/generate", `{"model":"a"}`, true, http.StatusOK},
+		{"large", "/api/generate", `{"model":"` + strings.Repeat("a", 16) + `"}`, true, http.StatusRequestEntityTooLarge},
+		{"small chunked", "/api/generate", `{"model":"a"}`, false, http.StatusOK},
+		{"large chunked", "/api/generate", `{"model":"` + strings.Repeat("a", 16) + `"}`, false, http.StatusRequestEntityTooLarge},
+		{"blob", "/api/blobs/sha256:abc", strings.Repeat("a", 64), true, http.StatusOK},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			var body io.Reader = strings.NewReader(tt.body)
+			if !tt.length {
+				// hide the length so the body is read as if it was chunked
+				body = io.MultiReader(body)
+			}
+
+			r := httptest.NewRequest(http.MethodPost, tt.path, body)
+			if !tt.length {
+				r.ContentLength = -1
+			}
+
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, r)
+			if w.Code != tt.status {
+				t.Fatalf("expected status code %d, actual %d: %s", tt.status, w.Code, w.Body.String())
+			}
+
+			if tt.status == http.StatusRequestEntityTooLarge && !strings.Contains(w.Body.String(), "OLLAMA_MAX_REQUEST_SIZE") {
+				t.Errorf("expected error to mention OLLAMA_MAX_REQUEST_SIZE, got %s", w.Body.String())
+			}
+		})
+	}
+}
+
+func TestBindRequest(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	type part struct {
+		name, value string
+	}
+
+	form := func(parts ...part) (*bytes.Buffer, string) {
+		var b bytes.Buffer
+		mw := multipart.NewWriter(&b)
+		for _, p := range parts {
+			if err := mw.WriteField(p.name, p.value); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if err := mw.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		return &b, mw.FormDataContentType()
+	}
+
+	bind := func(body io.Reader, contentType string, v any) error {
+		c, _ := gin.CreateTestContext(httptest.NewRecorder())
+		c.Request = httptest.NewRequest(http.MethodPost, "/", body)
+		c.Request.Header.Set("Content-Type", contentType)
+		return bindRequest(c, v)
+	}
+
+	t.Run("json", func(t *testing.T) {
+		var req api.GenerateRequest
+		if err := bind(strings.NewReader(`{"model":"test","prompt":"hi"}`), "application/json", &req); err != nil {
+			t.Fatal(err)
+		}
+
+		if diff := cmp.Diff(req, api.GenerateRequest{Model: "test", Prompt: "hi"}); diff != "" {
+			t.Errorf("mismatch (-got +want):\n%s", diff)
+		}
+	})
+
+	t.Run("generate", func(t *testing.T) {
+		body, contentType := form(
+			part{"images", "first"},
+			part{"request", `{"model":"test","prompt":"ignored","images":["AAAA"]}`},
+			part{"prompt", strings.Repeat("a long prompt ", 1000)},
+			part{"images", "second"},
+		)
+
+		var req api.GenerateRequest
+		if err := bind(body, contentType, &req); err != nil {
+			t.Fatal(err)
+		}
+
+		expect := api.GenerateRequest{
+			Model:  "test",
+			Prompt: strings.Repeat("a long prompt ", 1000),
+			Images: []api.ImageData{{0, 0, 0}, []byte("first"), []byte("second")},
+		}
+
+		if diff := cmp.Diff(req, expect); diff != "" {
+			t.Errorf("mismatch (-got +want):\n%s", diff)
+		}
+	})
+
+	t.Run("chat", func(t *testing.T) {
+		body, contentType := form(
+			part{"request", `{"model":"test","messages":[{"role":"system","content":"be brief"},{"role":"user"}]}`},
+			part{"content", "describe this"},
+			part{"images", "image"},
+		)
+
+		var req api.ChatRequest
+		if err := bind(body, contentType, &req); err != nil {
+			t.Fatal(err)
+		}
+
+		expect := []api.Message{
+			{Role: "system", Content: "be brief"},
+			{Role: "user", Content: "describe this", Images: []api.ImageData{[]byte("image")}},
+		}
+
+		if diff := cmp.Diff(req.Messages, expect); diff != "" {
+			t.Errorf("mismatch (-got +want):\n%s", diff)
+		}
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		cases := []struct {
+			name  string
+			parts []part
+			v     any
+		}{
+			{"missing request", []part{{"prompt", "hi"}}, &api.GenerateRequest{}},
+			{"invalid request", []part{{"request", "{"}}, &api.GenerateRequest{}},
+			{"unexpected part", []part{{"request", `{"model":"test"}`}, {"file", "x"}}, &api.GenerateRequest{}},
+			{"no messages", []part{{"request", `{"model":"test"}`}, {"images", "x"}}, &api.ChatRequest{}},
+		}
+
+		for _, tt := range cases {
+			body, contentType := form(tt.parts...)
+			if err := bind(body, contentType, tt.v); err == nil {
+				t.Errorf("%s: expected error", tt.name)
+			}
+		}
+	})
+}
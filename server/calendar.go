@@ -0,0 +1,415 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/envconfig"
+	"github.com/ollama/ollama/types/model"
+)
+
+const (
+	policyQuiet   = "quiet"
+	policyPreload = "preload"
+	policyGroup   = "group"
+	policySwitch  = "switch"
+)
+
+var (
+	errQuietHours   = errors.New("server is in quiet hours, try again later")
+	errUnknownGroup = errors.New("unknown model group")
+)
+
+// calendar runs time-based policies such as quiet hours, during which all
+// models are unloaded and requests are refused, scheduled preloads, and
+// switches between groups of models
+type calendar struct {
+	mu       sync.Mutex
+	policies []api.SchedulePolicy
+
+	// group is the model group last switched to
+	group string
+
+	// switchMu serializes group switches so their loads and unloads don't
+	// interleave
+	switchMu sync.Mutex
+
+	// quiet is the state at the last tick, used to detect the start of
+	// quiet hours
+	quiet bool
+
+	// fired records the last day each preload policy ran on
+	fired map[int]string
+}
+
+func newCalendar(policies []api.SchedulePolicy) (*calendar, error) {
+	var c calendar
+	if err := c.Set(policies); err != nil {
+		return nil, err
+	}
+
+	return &c, nil
+}
+
+// parseSchedule parses policies from a semicolon separated list such as
+// "quiet 09:00-17:00; preload 08:45 llama3.2" or
+// "group day llama3.2,all-minilm; switch 08:00 day"
+func parseSchedule(s string) ([]api.SchedulePolicy, error) {
+	var policies []api.SchedulePolicy
+	for _, rule := range strings.Split(s, ";") {
+		fields := strings.Fields(rule)
+		if len(fields) == 0 {
+			continue
+		}
+
+		var p api.SchedulePolicy
+		switch {
+		case fields[0] == policyQuiet && len(fields) == 2:
+			start, end, ok := strings.Cut(fields[1], "-")
+			if !ok {
+				return nil, fmt.Errorf("invalid quiet hours %q, expected HH:MM-HH:MM", fields[1])
+			}
+
+			p = api.SchedulePolicy{Action: policyQuiet, Start: start, End: end}
+		case fields[0] == policyPreload && len(fields) == 3:
+			// the window is optional, the model stays loaded until its end
+			start, end, _ := strings.Cut(fields[1], "-")
+			p = api.SchedulePolicy{Action: policyPreload, Start: start, End: end, Model: fields[2]}
+		case fields[0] == policyGroup && len(fields) == 3:
+			p = api.SchedulePolicy{Action: policyGroup, Group: fields[1], Models: strings.Split(fields[2], ",")}
+		case fields[0] == policySwitch && len(fields) == 3:
+			p = api.SchedulePolicy{Action: policySwitch, Start: fields[1], Group: fields[2]}
+		default:
+			return nil, fmt.Errorf("invalid schedule policy %q", strings.TrimSpace(rule))
+		}
+
+		if err := validatePolicy(p); err != nil {
+			return nil, err
+		}
+
+		policies = append(policies, p)
+	}
+
+	return policies, nil
+}
+
+func validatePolicy(p api.SchedulePolicy) error {
+	if p.Action != policyGroup {
+		if _, err := parseClock(p.Start); err != nil {
+			return err
+		}
+	}
+
+	switch p.Action {
+	case policyQuiet:
+		if _, err := parseClock(p.End); err != nil {
+			return err
+		}
+	case policyPreload:
+		if p.End != "" {
+			if _, err := parseClock(p.End); err != nil {
+				return err
+			}
+		}
+
+		if !model.ParseName(p.Model).IsValid() {
+			return fmt.Errorf("invalid model name %q", p.Model)
+		}
+	case policyGroup:
+		if p.Group == "" || len(p.Models) == 0 {
+			return errors.New("a model group needs a name and models")
+		}
+
+		for _, m := range p.Models {
+			if !model.ParseName(m).IsValid() {
+				return fmt.Errorf("invalid model name %q in group %q", m, p.Group)
+			}
+		}
+	case policySwitch:
+		if p.Group == "" {
+			return errors.New("a group switch needs a group")
+		}
+	default:
+		return fmt.Errorf("unknown schedule action %q", p.Action)
+	}
+
+	return nil
+}
+
+// parseClock parses a 24-hour HH:MM clock time into the duration since midnight
+func parseClock(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q, expected HH:MM", s)
+	}
+
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+func sinceMidnight(t time.Time) time.Duration {
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute + time.Duration(t.Second())*time.Second
+}
+
+// Set replaces the calendar's policies
+func (c *calendar) Set(policies []api.SchedulePolicy) error {
+	groups := make(map[string]bool)
+	for _, p := range policies {
+		if err := validatePolicy(p); err != nil {
+			return err
+		}
+
+		if p.Action == policyGroup {
+			if groups[p.Group] {
+				return fmt.Errorf("model group %q is defined more than once", p.Group)
+			}
+			groups[p.Group] = true
+		}
+	}
+
+	for _, p := range policies {
+		if p.Action == policySwitch && !groups[p.Group] {
+			return fmt.Errorf("%w %q", errUnknownGroup, p.Group)
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.policies = slices.Clone(policies)
+	c.fired = make(map[int]string)
+	return nil
+}
+
+// Policies returns the calendar's policies
+func (c *calendar) Policies() []api.SchedulePolicy {
+	if c == nil {
+		return nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return slices.Clone(c.policies)
+}
+
+// Group returns the models of the named group
+func (c *calendar) Group(name string) ([]string, bool) {
+	if c == nil {
+		return nil, false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, p := range c.policies {
+		if p.Action == policyGroup && p.Group == name {
+			return slices.Clone(p.Models), true
+		}
+	}
+
+	return nil, false
+}
+
+// Active returns the model group last switched to
+func (c *calendar) Active() string {
+	if c == nil {
+		return ""
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.group
+}
+
+// Quiet reports whether t falls within quiet hours
+func (c *calendar) Quiet(t time.Time) bool {
+	if c == nil {
+		return false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.quietLocked(t)
+}
+
+func (c *calendar) quietLocked(t time.Time) bool {
+	now := sinceMidnight(t)
+	for _, p := range c.policies {
+		if p.Action != policyQuiet {
+			continue
+		}
+
+		start, _ := parseClock(p.Start)
+		end, _ := parseClock(p.End)
+		if start <= end && now >= start && now < end {
+			return true
+		} else if start > end && (now >= start || now < end) {
+			// wraps past midnight
+			return true
+		}
+	}
+
+	return false
+}
+
+// scheduledLoad is a model due to be preloaded, and how long it's kept loaded
+type scheduledLoad struct {
+	model     string
+	keepAlive time.Duration
+}
+
+// preloadKeepAlive returns how long a preload policy keeps its model loaded:
+// until the end of its window, which may wrap past midnight, or for the
+// default keep alive without one
+func preloadKeepAlive(p api.SchedulePolicy) time.Duration {
+	if p.End == "" {
+		return envconfig.KeepAlive()
+	}
+
+	start, _ := parseClock(p.Start)
+	end, _ := parseClock(p.End)
+	if end <= start {
+		end += 24 * time.Hour
+	}
+
+	return end - start
+}
+
+// tick advances the calendar to t and reports whether quiet hours have just
+// started, which models are due to be preloaded and which group is due to be
+// switched to
+func (c *calendar) tick(t time.Time) (unload bool, preload []scheduledLoad, group string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	quiet := c.quietLocked(t)
+	unload = quiet && !c.quiet
+	c.quiet = quiet
+
+	day := t.Format(time.DateOnly)
+	now := sinceMidnight(t)
+	for i, p := range c.policies {
+		if (p.Action != policyPreload && p.Action != policySwitch) || c.fired[i] == day {
+			continue
+		}
+
+		// fire within a minute of the start time so a missed tick doesn't
+		// load models hours late
+		start, _ := parseClock(p.Start)
+		if now >= start && now < start+time.Minute {
+			c.fired[i] = day
+			if p.Action == policySwitch {
+				group = p.Group
+			} else {
+				preload = append(preload, scheduledLoad{p.Model, preloadKeepAlive(p)})
+			}
+		}
+	}
+
+	return unload, preload, group
+}
+
+// runCalendar runs the calendar's policies until ctx is done
+func (s *Server) runCalendar(ctx context.Context) {
+	ticker := time.NewTicker(15 * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case t := <-ticker.C:
+			unload, preload, group := s.calendar.tick(t)
+			if unload {
+				slog.Info("quiet hours started, unloading all models")
+				s.sched.expireAllRunners()
+			}
+
+			if group != "" {
+				go func() {
+					slog.Info("switching to scheduled model group", "group", group)
+					if err := s.switchGroup(ctx, group); err != nil {
+						slog.Warn("failed to switch to scheduled model group", "group", group, "error", err)
+					}
+				}()
+			}
+
+			for _, load := range preload {
+				go func() {
+					slog.Info("preloading scheduled model", "model", load.model, "keep_alive", load.keepAlive)
+					if err := s.preloadModel(ctx, load.model, &api.Duration{Duration: load.keepAlive}); err != nil {
+						slog.Warn("failed to preload scheduled model", "model", load.model, "error", err)
+					}
+				}()
+			}
+		}
+	}
+}
+
+// preloadModel loads the named model with its default options, keeping it
+// loaded for keepAlive or the default keep alive if it's nil
+func (s *Server) preloadModel(ctx context.Context, name string, keepAlive *api.Duration) error {
+	n, err := getExistingName(model.ParseName(name))
+	if err != nil {
+		return err
+	}
+
+	// the runner is released once the context is done
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// no capabilities are required so embedding models can be preloaded too
+	_, _, _, err = s.scheduleRunner(ctx, n.String(), nil, nil, keepAlive)
+	return err
+}
+
+// switchGroup loads the models of the named group, keeping them loaded until
+// the next switch, and unloads every other model. All of the group's models
+// are looked up before anything is unloaded, so a switch to a group with a
+// missing model changes nothing.
+func (s *Server) switchGroup(ctx context.Context, name string) error {
+	models, ok := s.calendar.Group(name)
+	if !ok {
+		return fmt.Errorf("%w %q", errUnknownGroup, name)
+	}
+
+	s.calendar.switchMu.Lock()
+	defer s.calendar.switchMu.Unlock()
+
+	keep := make(map[string]bool)
+	for _, m := range models {
+		n, err := getExistingName(model.ParseName(m))
+		if err != nil {
+			return fmt.Errorf("%s: %w", m, err)
+		}
+
+		mm, err := GetModel(n.String())
+		if err != nil {
+			return fmt.Errorf("%s: %w", m, err)
+		}
+
+		keep[mm.ModelPath] = true
+	}
+
+	s.sched.expireRunnersExcept(keep)
+
+	s.calendar.mu.Lock()
+	s.calendar.group = name
+	s.calendar.mu.Unlock()
+
+	forever := &api.Duration{Duration: time.Duration(math.MaxInt64)}
+
+	var errs []error
+	for _, m := range models {
+		if err := s.preloadModel(ctx, m, forever); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", m, err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
@@ -0,0 +1,256 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/ollama/ollama/api"
+)
+
+func TestParseSchedule(t *testing.T) {
+	cases := map[string]struct {
+		value  string
+		expect []api.SchedulePolicy
+		err    bool
+	}{
+		"empty": {"", nil, false},
+		"quiet": {"quiet 09:00-17:00", []api.SchedulePolicy{
+			{Action: "quiet", Start: "09:00", End: "17:00"},
+		}, false},
+		"quiet and preload": {"quiet 09:00-17:00; preload 08:45 llama3.2", []api.SchedulePolicy{
+			{Action: "quiet", Start: "09:00", End: "17:00"},
+			{Action: "preload", Start: "08:45", Model: "llama3.2"},
+		}, false},
+		"preload window": {"preload 22:00-06:00 llama3.2", []api.SchedulePolicy{
+			{Action: "preload", Start: "22:00", End: "06:00", Model: "llama3.2"},
+		}, false},
+		"trailing separator": {"preload 08:45 llama3.2;", []api.SchedulePolicy{
+			{Action: "preload", Start: "08:45", Model: "llama3.2"},
+		}, false},
+		"groups": {"group day llama3.2,all-minilm; group batch llama3.3:70b; switch 08:00 day; switch 20:00 batch", []api.SchedulePolicy{
+			{Action: "group", Group: "day", Models: []string{"llama3.2", "all-minilm"}},
+			{Action: "group", Group: "batch", Models: []string{"llama3.3:70b"}},
+			{Action: "switch", Start: "08:00", Group: "day"},
+			{Action: "switch", Start: "20:00", Group: "batch"},
+		}, false},
+		"group without models":     {"group day", nil, true},
+		"group with invalid model": {"group day llama3.2,../model", nil, true},
+		"switch without group":     {"switch 08:00", nil, true},
+		"switch with invalid time": {"switch 8am day", nil, true},
+		"missing end":              {"quiet 09:00", nil, true},
+		"invalid time":             {"quiet 9am-5pm", nil, true},
+		"out of range":             {"quiet 09:00-25:00", nil, true},
+		"missing model":            {"preload 08:45", nil, true},
+		"unknown action":           {"unload 08:45", nil, true},
+		"invalid model":            {"preload 08:45 ../model", nil, true},
+		"too many fields":          {"quiet 09:00-17:00 weekdays", nil, true},
+	}
+
+	for name, tt := range cases {
+		t.Run(name, func(t *testing.T) {
+			policies, err := parseSchedule(tt.value)
+			if tt.err {
+				if err == nil {
+					t.Fatal("expected error")
+				}
+				return
+			} else if err != nil {
+				t.Fatal(err)
+			}
+
+			if diff := cmp.Diff(policies, tt.expect); diff != "" {
+				t.Errorf("mismatch (-got +want):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestCalendarQuiet(t *testing.T) {
+	at := func(clock string) time.Time {
+		t.Helper()
+		tm, err := time.Parse(time.DateTime, "2024-01-02 "+clock+":00")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tm
+	}
+
+	cal, err := newCalendar([]api.SchedulePolicy{
+		{Action: "quiet", Start: "09:00", End: "17:00"},
+		{Action: "quiet", Start: "23:00", End: "01:00"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := map[string]bool{
+		"08:59": false,
+		"09:00": true,
+		"12:30": true,
+		"17:00": false,
+		"22:59": false,
+		"23:30": true,
+		"00:30": true,
+		"01:00": false,
+	}
+
+	for clock, expect := range cases {
+		if quiet := cal.Quiet(at(clock)); quiet != expect {
+			t.Errorf("%s: expected quiet %v, got %v", clock, expect, quiet)
+		}
+	}
+
+	var nilCal *calendar
+	if nilCal.Quiet(at("12:00")) {
+		t.Error("expected nil calendar to never be quiet")
+	}
+}
+
+func TestCalendarTick(t *testing.T) {
+	base, err := time.Parse(time.DateTime, "2024-01-02 08:44:50")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cal, err := newCalendar([]api.SchedulePolicy{
+		{Action: "preload", Start: "08:45", Model: "llama3.2"},
+		{Action: "preload", Start: "08:45", End: "12:00", Model: "mistral"},
+		{Action: "quiet", Start: "09:00", End: "17:00"},
+		{Action: "group", Group: "batch", Models: []string{"llama3.3:70b"}},
+		{Action: "switch", Start: "17:30", Group: "batch"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// models are kept loaded until the end of their window, or for the
+	// default keep alive
+	preloads := []scheduledLoad{{"llama3.2", 5 * time.Minute}, {"mistral", 3*time.Hour + 15*time.Minute}}
+
+	type result struct {
+		unload  bool
+		preload []scheduledLoad
+		group   string
+	}
+
+	cases := []struct {
+		at     time.Duration
+		expect result
+	}{
+		{0, result{}},
+		{15 * time.Second, result{preload: preloads}},
+		// preloads run once a day
+		{30 * time.Second, result{}},
+		{16 * time.Minute, result{unload: true}},
+		// unload only at the start of quiet hours
+		{17 * time.Minute, result{}},
+		{8*time.Hour + 45*time.Minute + 15*time.Second, result{group: "batch"}},
+		{8*time.Hour + 46*time.Minute, result{}},
+		{24 * time.Hour, result{}},
+		{24*time.Hour + 15*time.Second, result{preload: preloads}},
+	}
+
+	for _, tt := range cases {
+		unload, preload, group := cal.tick(base.Add(tt.at))
+		if unload != tt.expect.unload || !slices.Equal(preload, tt.expect.preload) || group != tt.expect.group {
+			t.Errorf("%s: expected %+v, got %+v", tt.at, tt.expect, result{unload, preload, group})
+		}
+	}
+}
+
+func TestScheduleHandler(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	cal, err := newCalendar(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := Server{calendar: cal}
+
+	w := createRequest(t, s.SetScheduleHandler, api.ScheduleRequest{
+		Policies: []api.SchedulePolicy{{Action: "quiet", Start: "00:00", End: "23:59"}},
+	})
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("expected status code 403, actual %d", w.Code)
+	}
+
+	if err := cal.Set([]api.SchedulePolicy{{Action: "quiet", Start: "00:00", End: "23:59"}, {Action: "quiet", Start: "23:59", End: "00:00"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, _, err := s.scheduleRunner(context.TODO(), "test", nil, nil, nil); err != errQuietHours {
+		t.Fatalf("expected quiet hours error, got %v", err)
+	}
+
+	w = createRequest(t, s.ScheduleHandler, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status code 200, actual %d", w.Code)
+	}
+
+	if diff := cmp.Diff(w.Body.String(), `{"policies":[{"action":"quiet","start":"00:00","end":"23:59"},{"action":"quiet","start":"23:59","end":"00:00"}],"quiet":true}`); diff != "" {
+		t.Errorf("mismatch (-got +want):\n%s", diff)
+	}
+}
+
+func TestSwitchGroupHandler(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+
+	if _, err := newCalendar([]api.SchedulePolicy{{Action: "switch", Start: "08:00", Group: "day"}}); !errors.Is(err, errUnknownGroup) {
+		t.Fatalf("expected unknown group error, got %v", err)
+	}
+
+	cal, err := newCalendar([]api.SchedulePolicy{
+		{Action: "group", Group: "day", Models: []string{"missing"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := Server{calendar: cal}
+	router := s.GenerateRoutes()
+
+	request := func(body, remote string) *httptest.ResponseRecorder {
+		t.Helper()
+
+		r := httptest.NewRequest(http.MethodPost, "/api/schedule/switch", strings.NewReader(body))
+		r.RemoteAddr = remote
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		return w
+	}
+
+	cases := []struct {
+		name   string
+		body   string
+		remote string
+		code   int
+	}{
+		{"remote", `{"group":"day"}`, "192.0.2.1:1234", http.StatusForbidden},
+		{"unknown group", `{"group":"night"}`, "127.0.0.1:1234", http.StatusNotFound},
+		{"missing model", `{"group":"day"}`, "127.0.0.1:1234", http.StatusNotFound},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			if w := request(tt.body, tt.remote); w.Code != tt.code {
+				t.Fatalf("expected status code %d, actual %d: %s", tt.code, w.Code, w.Body.String())
+			}
+		})
+	}
+
+	// nothing is switched unless all of the group's models exist
+	if group := cal.Active(); group != "" {
+		t.Errorf("expected no active group, got %q", group)
+	}
+}
@@ -0,0 +1,87 @@
+package server
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"slices"
+	"sync"
+
+	"github.com/ollama/ollama/llm"
+)
+
+// weightsInfo is what a model's capabilities need from its weights
+type weightsInfo struct {
+	embedding       bool
+	contextLength   int
+	tokenizerDigest string
+}
+
+// weightsInfos caches weightsInfo by blob path. Blobs are content
+// addressed, so their info never changes once read.
+var weightsInfos sync.Map
+
+func readWeightsInfo(path string) (weightsInfo, error) {
+	if info, ok := weightsInfos.Load(path); ok {
+		return info.(weightsInfo), nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return weightsInfo{}, err
+	}
+	defer f.Close()
+
+	// the digest covers every token so the whole vocabulary is read
+	ggml, _, err := llm.DecodeGGML(f, -1)
+	if err != nil {
+		return weightsInfo{}, err
+	}
+
+	kv := ggml.KV()
+	info := weightsInfo{contextLength: int(kv.ContextLength())}
+	_, info.embedding = kv[fmt.Sprintf("%s.pooling_type", kv.Architecture())]
+
+	if tokens := kv.Strings("tokenizer.ggml.tokens"); len(tokens) > 0 {
+		h := sha256.New()
+		model, _ := kv["tokenizer.ggml.model"].(string)
+		fmt.Fprintf(h, "%s\x00", model)
+		for _, token := range tokens {
+			fmt.Fprintf(h, "%s\x00", token)
+		}
+		info.tokenizerDigest = fmt.Sprintf("sha256:%x", h.Sum(nil))
+	}
+
+	weightsInfos.Store(path, info)
+	return info, nil
+}
+
+// capabilities returns what the model can be used for, along with the
+// context length and tokenizer digest read from its weights
+func (m *Model) capabilities() ([]string, weightsInfo, error) {
+	info, err := readWeightsInfo(m.ModelPath)
+	if err != nil {
+		return nil, weightsInfo{}, err
+	}
+
+	if info.embedding {
+		return []string{string(CapabilityEmbedding)}, info, nil
+	}
+
+	caps := []string{string(CapabilityCompletion)}
+
+	vars := m.Template.Vars()
+	if slices.Contains(vars, "tools") {
+		caps = append(caps, string(CapabilityTools))
+	}
+
+	if slices.Contains(vars, "suffix") {
+		caps = append(caps, string(CapabilityInsert))
+	}
+
+	if len(m.ProjectorPaths) > 0 {
+		caps = append(caps, string(CapabilityVision))
+	}
+
+	return caps, info, nil
+}
@@ -0,0 +1,116 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/llm"
+)
+
+func TestCapabilities(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+
+	var s Server
+
+	kv := func(extra llm.KV) llm.KV {
+		kv := llm.KV{
+			"general.architecture":  "llama",
+			"llama.context_length":  uint32(8192),
+			"tokenizer.ggml.model":  "gpt2",
+			"tokenizer.ggml.tokens": []string{"a", "b", "c"},
+		}
+		for k, v := range extra {
+			kv[k] = v
+		}
+		return kv
+	}
+
+	models := map[string]string{
+		"tools":     fmt.Sprintf("FROM %s\nTEMPLATE {{ .Tools }}{{ .Prompt }}", createBinFile(t, kv(nil), nil)),
+		"insert":    fmt.Sprintf("FROM %s\nTEMPLATE {{ .Prompt }}{{ .Suffix }}", createBinFile(t, kv(llm.KV{"general.name": "insert"}), nil)),
+		"vision":    fmt.Sprintf("FROM %s\nFROM %s", createBinFile(t, kv(llm.KV{"general.name": "vision"}), nil), createBinFile(t, llm.KV{"general.type": "projector", "general.architecture": "clip"}, nil)),
+		"embedding": fmt.Sprintf("FROM %s", createBinFile(t, kv(llm.KV{"llama.pooling_type": uint32(1), "tokenizer.ggml.tokens": []string{"x", "y", "z"}}), nil)),
+	}
+
+	for name, modelfile := range models {
+		w := createRequest(t, s.CreateHandler, api.CreateRequest{Name: name, Modelfile: modelfile, Stream: &stream})
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status code 200, actual %d: %s", w.Code, w.Body.String())
+		}
+	}
+
+	type capabilities struct {
+		Capabilities  []string
+		ContextLength int
+	}
+
+	expect := map[string]capabilities{
+		"tools":     {[]string{"completion", "tools"}, 8192},
+		"insert":    {[]string{"completion", "insert"}, 8192},
+		"vision":    {[]string{"completion", "vision"}, 8192},
+		"embedding": {[]string{"embedding"}, 8192},
+	}
+
+	t.Run("show", func(t *testing.T) {
+		digests := make(map[string]string)
+		for name, want := range expect {
+			w := createRequest(t, s.ShowHandler, api.ShowRequest{Model: name})
+			if w.Code != http.StatusOK {
+				t.Fatalf("expected status code 200, actual %d: %s", w.Code, w.Body.String())
+			}
+
+			var resp api.ShowResponse
+			if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+				t.Fatal(err)
+			}
+
+			if diff := cmp.Diff(capabilities{resp.Capabilities, resp.ContextLength}, want); diff != "" {
+				t.Errorf("%s mismatch (-got +want):\n%s", name, diff)
+			}
+
+			digests[name] = resp.TokenizerDigest
+		}
+
+		if digests["tools"] == "" || digests["tools"] != digests["vision"] {
+			t.Errorf("expected models with the same vocabulary to have the same tokenizer digest, got %q and %q", digests["tools"], digests["vision"])
+		}
+
+		if digests["tools"] == digests["embedding"] {
+			t.Error("expected models with different vocabularies to have different tokenizer digests")
+		}
+	})
+
+	t.Run("list", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		c.Request = httptest.NewRequest(http.MethodGet, "/api/tags", nil)
+		s.ListHandler(c)
+
+		var resp api.ListResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+
+		got := make(map[string]capabilities)
+		for _, m := range resp.Models {
+			got[m.Model] = capabilities{m.Capabilities, m.ContextLength}
+		}
+
+		want := make(map[string]capabilities)
+		for name, caps := range expect {
+			want[name+":latest"] = caps
+		}
+
+		if diff := cmp.Diff(got, want); diff != "" {
+			t.Errorf("mismatch (-got +want):\n%s", diff)
+		}
+	})
+}
@@ -0,0 +1,138 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"slices"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// scopes a client certificate identity can be granted
+const (
+	scopeRead     = "read"
+	scopeGenerate = "generate"
+	scopeManage   = "manage"
+	scopeAll      = "*"
+)
+
+// clientPolicy maps client certificate identities to the scopes they're
+// allowed. The "*" identity applies to clients without an entry of their own.
+type clientPolicy map[string][]string
+
+func loadClientPolicy(path string) (clientPolicy, error) {
+	if path == "" {
+		return nil, nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var policy clientPolicy
+	if err := json.NewDecoder(f).Decode(&policy); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	for identity, scopes := range policy {
+		for _, scope := range scopes {
+			switch scope {
+			case scopeRead, scopeGenerate, scopeManage, scopeAll:
+			default:
+				return nil, fmt.Errorf("%s: unknown scope %q for %q", path, scope, identity)
+			}
+		}
+	}
+
+	return policy, nil
+}
+
+// allowed reports whether identity is granted scope. A nil policy allows
+// every authenticated client.
+func (p clientPolicy) allowed(identity, scope string) bool {
+	if p == nil {
+		return true
+	}
+
+	scopes, ok := p[identity]
+	if !ok {
+		scopes = p[scopeAll]
+	}
+
+	return slices.Contains(scopes, scope) || slices.Contains(scopes, scopeAll)
+}
+
+// requestScope returns the scope needed to make a request
+func requestScope(method, path string) string {
+	switch path {
+	case "/api/generate", "/api/chat", "/api/embed", "/api/embeddings",
+		"/v1/chat/completions", "/v1/completions", "/v1/embeddings":
+		return scopeGenerate
+	case "/api/show", "/api/files":
+		return scopeRead
+	}
+
+	if method == http.MethodGet || method == http.MethodHead {
+		return scopeRead
+	}
+
+	return scopeManage
+}
+
+// clientIdentity returns the identity of the verified client certificate used
+// to make r, or an empty string if there isn't one. This is the certificate's
+// common name, or its first email or DNS name if it has none.
+func clientIdentity(r *http.Request) string {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return ""
+	}
+
+	cert := r.TLS.VerifiedChains[0][0]
+	switch {
+	case cert.Subject.CommonName != "":
+		return cert.Subject.CommonName
+	case len(cert.EmailAddresses) > 0:
+		return cert.EmailAddresses[0]
+	case len(cert.DNSNames) > 0:
+		return cert.DNSNames[0]
+	default:
+		return cert.SerialNumber.String()
+	}
+}
+
+// clientAuthMiddleware authorizes requests made with a client certificate
+// against policy and records them in the audit log
+func clientAuthMiddleware(policy clientPolicy) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		identity := clientIdentity(c.Request)
+		if identity == "" {
+			c.Next()
+			return
+		}
+
+		start := time.Now()
+		scope := requestScope(c.Request.Method, c.Request.URL.Path)
+		if !policy.allowed(identity, scope) {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": fmt.Sprintf("%s is not allowed to %s", identity, scope)})
+		} else {
+			c.Next()
+		}
+
+		// handlers add request metadata to the context, so it's logged too
+		slog.InfoContext(c.Request.Context(), "audit",
+			"identity", identity,
+			"remote", c.Request.RemoteAddr,
+			"method", c.Request.Method,
+			"path", c.Request.URL.Path,
+			"scope", scope,
+			"status", c.Writer.Status(),
+			"duration", time.Since(start),
+		)
+	}
+}
@@ -0,0 +1,100 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestLoadClientPolicy(t *testing.T) {
+	dir := t.TempDir()
+
+	valid := filepath.Join(dir, "valid.json")
+	if err := os.WriteFile(valid, []byte(`{"alice": ["read", "generate"], "*": ["read"]}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	policy, err := loadClientPolicy(valid)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(policy) != 2 {
+		t.Errorf("expected 2 identities, got %d", len(policy))
+	}
+
+	invalid := filepath.Join(dir, "invalid.json")
+	if err := os.WriteFile(invalid, []byte(`{"alice": ["admin"]}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := loadClientPolicy(invalid); err == nil {
+		t.Error("expected error for unknown scope")
+	}
+
+	if policy, err := loadClientPolicy(""); err != nil || policy != nil {
+		t.Errorf("expected no policy, got %v %v", policy, err)
+	}
+}
+
+func TestClientAuthMiddleware(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	policy := clientPolicy{
+		"alice":  {scopeRead, scopeGenerate},
+		"ci-bot": {scopeAll},
+		"*":      {scopeRead},
+	}
+
+	r := gin.New()
+	r.Use(clientAuthMiddleware(policy))
+	for _, route := range []struct{ method, path string }{
+		{http.MethodPost, "/api/chat"},
+		{http.MethodGet, "/api/tags"},
+		{http.MethodPost, "/api/pull"},
+	} {
+		r.Handle(route.method, route.path, func(c *gin.Context) {
+			c.Status(http.StatusOK)
+		})
+	}
+
+	cases := []struct {
+		identity string
+		method   string
+		path     string
+		expect   int
+	}{
+		{"alice", http.MethodPost, "/api/chat", http.StatusOK},
+		{"alice", http.MethodGet, "/api/tags", http.StatusOK},
+		{"alice", http.MethodPost, "/api/pull", http.StatusForbidden},
+		{"ci-bot", http.MethodPost, "/api/pull", http.StatusOK},
+		{"mallory", http.MethodGet, "/api/tags", http.StatusOK},
+		{"mallory", http.MethodPost, "/api/chat", http.StatusForbidden},
+		// requests without a client certificate aren't subject to the policy
+		{"", http.MethodPost, "/api/pull", http.StatusOK},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.identity+" "+tt.path, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.path, nil)
+			if tt.identity != "" {
+				req.TLS = &tls.ConnectionState{
+					VerifiedChains: [][]*x509.Certificate{{{Subject: pkix.Name{CommonName: tt.identity}}}},
+				}
+			}
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+			if w.Code != tt.expect {
+				t.Errorf("expected status code %d, actual %d", tt.expect, w.Code)
+			}
+		})
+	}
+}
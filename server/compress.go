@@ -0,0 +1,158 @@
+package server
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+	"time"
+
+	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/llm"
+	"github.com/ollama/ollama/types/model"
+)
+
+// defaultCompressionRate is the fraction of tokens prompt compression keeps
+// unless the request sets one
+const defaultCompressionRate = 0.5
+
+// compressionChunk is the number of tokens the compressor scores together.
+// Each chunk is scored without the ones before it, as for perplexity.
+const compressionChunk = 512
+
+// compressor is a small model which compresses parts of prompts by dropping
+// the tokens it predicts best, which carry the least information, in the
+// manner of LLMLingua
+type compressor struct {
+	name string
+	rate float64
+}
+
+func loadCompressor(name string, rate float64) (*compressor, error) {
+	if rate == 0 {
+		rate = defaultCompressionRate
+	} else if rate < 0 || rate > 1 {
+		return nil, fmt.Errorf("%w: compression_rate must be between 0 and 1", errBadOption)
+	}
+
+	n, err := getExistingName(model.ParseName(name))
+	if err != nil {
+		return nil, err
+	}
+
+	m, err := GetModel(n.String())
+	if err != nil {
+		return nil, err
+	}
+
+	if err := m.CheckCapabilities(CapabilityCompletion); err != nil {
+		return nil, fmt.Errorf("%s %w", name, err)
+	}
+
+	return &compressor{name: n.String(), rate: rate}, nil
+}
+
+// compress compresses each of segments in place. The compressor is
+// scheduled with a context of its own, so its runner is released as soon as
+// compression is done rather than held with the request, which may need the
+// slot to schedule the model it compressed the prompt for.
+func (s *Server) compress(ctx context.Context, cp *compressor, segments []*string) (*api.CompressionStats, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	start := time.Now()
+	r, _, opts, err := s.scheduleRunner(ctx, cp.name, []Capability{CapabilityCompletion}, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	stats := api.CompressionStats{Segments: len(segments)}
+	for _, segment := range segments {
+		tokens, err := r.Tokenize(ctx, *segment)
+		if err != nil {
+			return nil, err
+		}
+
+		info, err := selfInformation(ctx, r, opts, tokens)
+		if err != nil {
+			return nil, err
+		}
+
+		kept := prune(tokens, info, cp.rate)
+		if *segment, err = r.Detokenize(ctx, kept); err != nil {
+			return nil, err
+		}
+
+		stats.Tokens += len(tokens)
+		stats.CompressedTokens += len(kept)
+	}
+
+	stats.Duration = time.Since(start)
+	return &stats, nil
+}
+
+// selfInformation returns the negative log probability of each token given
+// the ones before it in its chunk. The first token of each chunk has nothing
+// to be predicted from, so it's infinite and always kept.
+func selfInformation(ctx context.Context, r llm.LlamaServer, opts *api.Options, tokens []int) ([]float64, error) {
+	info := make([]float64, len(tokens))
+	for i := 0; i < len(tokens); i += compressionChunk {
+		chunk := tokens[i:min(i+compressionChunk, len(tokens))]
+		info[i] = math.Inf(1)
+		if len(chunk) < 2 {
+			continue
+		}
+
+		var logprobs []float32
+		if err := r.Completion(ctx, llm.CompletionRequest{
+			Tokens:  chunk,
+			Options: opts,
+			Return:  "perplexity",
+		}, func(cr llm.CompletionResponse) {
+			if cr.Done {
+				logprobs = cr.PromptLogprobs
+			}
+		}); err != nil {
+			return nil, err
+		}
+
+		if len(logprobs) != len(chunk)-1 {
+			return nil, errors.New("compressor didn't score every token")
+		}
+
+		for j, lp := range logprobs {
+			info[i+1+j] = -float64(lp)
+		}
+	}
+
+	return info, nil
+}
+
+// prune keeps the rate of tokens with the most information, in order
+func prune(tokens []int, info []float64, rate float64) []int {
+	n := max(1, int(math.Ceil(rate*float64(len(tokens)))))
+	if n >= len(tokens) {
+		return tokens
+	}
+
+	order := make([]int, len(tokens))
+	for i := range order {
+		order[i] = i
+	}
+
+	slices.SortStableFunc(order, func(a, b int) int {
+		return cmp.Compare(info[b], info[a])
+	})
+
+	kept := order[:n]
+	slices.Sort(kept)
+
+	pruned := make([]int, n)
+	for i, k := range kept {
+		pruned[i] = tokens[k]
+	}
+
+	return pruned
+}
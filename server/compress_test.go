@@ -0,0 +1,30 @@
+package server
+
+import (
+	"math"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestPrune(t *testing.T) {
+	tokens := []int{10, 11, 12, 13, 14, 15}
+	info := []float64{math.Inf(1), 0.5, 3, 0.1, 2, 0.5}
+
+	cases := []struct {
+		rate   float64
+		expect []int
+	}{
+		{0.5, []int{10, 12, 14}},
+		{0.1, []int{10}},
+		{1, tokens},
+		// ties keep the earlier token
+		{4.0 / 6, []int{10, 11, 12, 14}},
+	}
+
+	for _, tt := range cases {
+		if diff := cmp.Diff(prune(tokens, info, tt.rate), tt.expect); diff != "" {
+			t.Errorf("%v: mismatch (-got +want):\n%s", tt.rate, diff)
+		}
+	}
+}
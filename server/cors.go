@@ -0,0 +1,185 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/envconfig"
+)
+
+// corsMaxAge is how long browsers may cache preflight results for policies
+// that don't set their own max age
+const corsMaxAge = 12 * time.Hour
+
+var (
+	corsMethods = []string{"GET", "POST", "PUT", "PATCH", "DELETE", "HEAD", "OPTIONS"}
+	corsHeaders = []string{"Authorization", "Content-Type", "User-Agent", "Accept", "X-Requested-With", requestIDHeader}
+)
+
+func init() {
+	openAIProperties := []string{"lang", "package-version", "os", "arch", "retry-count", "runtime", "runtime-version", "async"}
+	for _, prop := range openAIProperties {
+		corsHeaders = append(corsHeaders, "x-stainless-"+prop)
+	}
+}
+
+// corsPolicies holds the cross-origin policies, which can be replaced while
+// the server is running
+type corsPolicies struct {
+	mu       sync.RWMutex
+	policies []api.CORSPolicy
+}
+
+func newCORSPolicies(policies []api.CORSPolicy) (*corsPolicies, error) {
+	var p corsPolicies
+	if err := p.Set(policies); err != nil {
+		return nil, err
+	}
+
+	return &p, nil
+}
+
+// defaultCORSPolicies allows the origins in OLLAMA_ORIGINS, and local origins,
+// to use every endpoint without credentials
+func defaultCORSPolicies() []api.CORSPolicy {
+	var policies []api.CORSPolicy
+	for _, origin := range envconfig.Origins() {
+		policies = append(policies, api.CORSPolicy{Origin: strings.TrimSpace(origin)})
+	}
+
+	return policies
+}
+
+// Set validates and replaces the policies
+func (p *corsPolicies) Set(policies []api.CORSPolicy) error {
+	for _, policy := range policies {
+		switch {
+		case policy.Origin == "":
+			return errors.New("policy is missing an origin")
+		case strings.Count(policy.Origin, "*") > 1:
+			return fmt.Errorf("origin %q has more than one wildcard", policy.Origin)
+		case policy.Origin != "*" && !strings.Contains(policy.Origin, "://"):
+			return fmt.Errorf("origin %q is missing a scheme", policy.Origin)
+		case policy.Origin == "*" && policy.Credentials:
+			return errors.New("credentials can't be allowed for every origin")
+		case policy.MaxAge < 0:
+			return fmt.Errorf("origin %q has a negative max age", policy.Origin)
+		}
+
+		for _, endpoint := range policy.Endpoints {
+			if !strings.HasPrefix(endpoint, "/") {
+				return fmt.Errorf("origin %q has invalid endpoint %q", policy.Origin, endpoint)
+			}
+		}
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.policies = slices.Clone(policies)
+	return nil
+}
+
+// Policies returns a copy of the current policies
+func (p *corsPolicies) Policies() []api.CORSPolicy {
+	if p == nil {
+		return nil
+	}
+
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return slices.Clone(p.policies)
+}
+
+// match returns the first policy allowing origin to access path
+func (p *corsPolicies) match(origin, path string) (api.CORSPolicy, bool) {
+	if p == nil {
+		return api.CORSPolicy{}, false
+	}
+
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	for _, policy := range p.policies {
+		if matchOrigin(policy.Origin, origin) && matchEndpoint(policy.Endpoints, path) {
+			return policy, true
+		}
+	}
+
+	return api.CORSPolicy{}, false
+}
+
+func matchOrigin(pattern, origin string) bool {
+	prefix, suffix, ok := strings.Cut(pattern, "*")
+	if !ok {
+		return pattern == origin
+	}
+
+	return len(origin) >= len(prefix)+len(suffix) && strings.HasPrefix(origin, prefix) && strings.HasSuffix(origin, suffix)
+}
+
+func matchEndpoint(endpoints []string, path string) bool {
+	if len(endpoints) == 0 {
+		return true
+	}
+
+	for _, endpoint := range endpoints {
+		if prefix, ok := strings.CutSuffix(endpoint, "*"); ok && strings.HasPrefix(path, prefix) {
+			return true
+		} else if endpoint == path {
+			return true
+		}
+	}
+
+	return false
+}
+
+// corsMiddleware answers preflight requests and sets the CORS headers of
+// cross-origin requests allowed by policies. Other cross-origin requests are
+// refused.
+func corsMiddleware(policies *corsPolicies) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		origin := c.GetHeader("Origin")
+		if origin == "" || origin == "http://"+c.Request.Host || origin == "https://"+c.Request.Host {
+			c.Next()
+			return
+		}
+
+		policy, ok := policies.match(origin, c.Request.URL.Path)
+		if !ok {
+			c.AbortWithStatus(http.StatusForbidden)
+			return
+		}
+
+		h := c.Writer.Header()
+		h.Set("Access-Control-Allow-Origin", origin)
+		h.Add("Vary", "Origin")
+		if policy.Credentials {
+			h.Set("Access-Control-Allow-Credentials", "true")
+		}
+
+		if c.Request.Method != http.MethodOptions {
+			c.Next()
+			return
+		}
+
+		maxAge := time.Duration(policy.MaxAge) * time.Second
+		if maxAge == 0 {
+			maxAge = corsMaxAge
+		}
+
+		h.Add("Vary", "Access-Control-Request-Method")
+		h.Add("Vary", "Access-Control-Request-Headers")
+		h.Set("Access-Control-Allow-Methods", strings.Join(corsMethods, ","))
+		h.Set("Access-Control-Allow-Headers", strings.Join(corsHeaders, ","))
+		h.Set("Access-Control-Max-Age", strconv.Itoa(int(maxAge.Seconds())))
+		c.AbortWithStatus(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,143 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/ollama/ollama/api"
+)
+
+func TestCORSPoliciesSet(t *testing.T) {
+	cases := []struct {
+		name     string
+		policies []api.CORSPolicy
+		err      bool
+	}{
+		{"empty", nil, false},
+		{"defaults", defaultCORSPolicies(), false},
+		{"endpoints", []api.CORSPolicy{{Origin: "https://example.com", Endpoints: []string{"/api/tags", "/api/*"}, Credentials: true, MaxAge: 60}}, false},
+		{"any origin", []api.CORSPolicy{{Origin: "*"}}, false},
+		{"missing origin", []api.CORSPolicy{{Endpoints: []string{"/api/tags"}}}, true},
+		{"missing scheme", []api.CORSPolicy{{Origin: "example.com"}}, true},
+		{"two wildcards", []api.CORSPolicy{{Origin: "https://*.example.*"}}, true},
+		{"any origin credentials", []api.CORSPolicy{{Origin: "*", Credentials: true}}, true},
+		{"negative max age", []api.CORSPolicy{{Origin: "https://example.com", MaxAge: -1}}, true},
+		{"relative endpoint", []api.CORSPolicy{{Origin: "https://example.com", Endpoints: []string{"api/tags"}}}, true},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := newCORSPolicies(tt.policies)
+			if tt.err && err == nil {
+				t.Error("expected error")
+			} else if !tt.err && err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestCORSMiddleware(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	policies, err := newCORSPolicies([]api.CORSPolicy{
+		{Origin: "https://app.example.com", Endpoints: []string{"/api/tags", "/api/chat"}, Credentials: true, MaxAge: 600},
+		{Origin: "http://localhost:*"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := gin.New()
+	r.Use(corsMiddleware(policies))
+	r.GET("/api/tags", func(c *gin.Context) { c.Status(http.StatusOK) })
+	r.POST("/api/pull", func(c *gin.Context) { c.Status(http.StatusOK) })
+
+	cases := []struct {
+		name        string
+		method      string
+		path        string
+		origin      string
+		status      int
+		allowOrigin string
+		credentials string
+		maxAge      string
+	}{
+		{"no origin", http.MethodGet, "/api/tags", "", http.StatusOK, "", "", ""},
+		{"same origin", http.MethodGet, "/api/tags", "http://ollama.local", http.StatusOK, "", "", ""},
+		{"allowed", http.MethodGet, "/api/tags", "https://app.example.com", http.StatusOK, "https://app.example.com", "true", ""},
+		{"endpoint not allowed", http.MethodPost, "/api/pull", "https://app.example.com", http.StatusForbidden, "", "", ""},
+		{"unknown origin", http.MethodGet, "/api/tags", "https://evil.example.com", http.StatusForbidden, "", "", ""},
+		{"wildcard", http.MethodPost, "/api/pull", "http://localhost:3000", http.StatusOK, "http://localhost:3000", "", ""},
+		{"preflight", http.MethodOptions, "/api/chat", "https://app.example.com", http.StatusNoContent, "https://app.example.com", "true", "600"},
+		{"preflight default max age", http.MethodOptions, "/api/chat", "http://localhost:8080", http.StatusNoContent, "http://localhost:8080", "", "43200"},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.path, nil)
+			req.Host = "ollama.local"
+			if tt.origin != "" {
+				req.Header.Set("Origin", tt.origin)
+			}
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+
+			if w.Code != tt.status {
+				t.Errorf("expected status code %d, actual %d", tt.status, w.Code)
+			}
+
+			if got := w.Header().Get("Access-Control-Allow-Origin"); got != tt.allowOrigin {
+				t.Errorf("expected allowed origin %q, actual %q", tt.allowOrigin, got)
+			}
+
+			if got := w.Header().Get("Access-Control-Allow-Credentials"); got != tt.credentials {
+				t.Errorf("expected credentials %q, actual %q", tt.credentials, got)
+			}
+
+			if got := w.Header().Get("Access-Control-Max-Age"); got != tt.maxAge {
+				t.Errorf("expected max age %q, actual %q", tt.maxAge, got)
+			}
+		})
+	}
+
+	// policies can be replaced while serving
+	if err := policies.Set([]api.CORSPolicy{{Origin: "https://evil.example.com"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/api/tags", nil)
+	req.Header.Set("Origin", "https://evil.example.com")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Errorf("expected status code 200, actual %d", w.Code)
+	}
+}
+
+func TestSetCORSHandler(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	policies, err := newCORSPolicies(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := Server{cors: policies}
+
+	// createRequest doesn't set a remote address so it isn't local
+	w := createRequest(t, s.SetCORSHandler, api.CORSRequest{
+		Policies: []api.CORSPolicy{{Origin: "https://example.com"}},
+	})
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("expected status code 403, actual %d", w.Code)
+	}
+
+	if got := policies.Policies(); len(got) != 0 {
+		t.Fatalf("expected no policies, got %v", got)
+	}
+}
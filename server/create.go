@@ -0,0 +1,304 @@
+package server
+
+import (
+	"archive/zip"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/parser"
+)
+
+var errFromAndFiles = errors.New("from and files are mutually exclusive")
+
+// hasStructuredCreate reports whether a create request describes the model
+// with structured fields rather than a Modelfile
+func hasStructuredCreate(r api.CreateRequest) bool {
+	return r.From != "" || len(r.Files) > 0
+}
+
+// modelfileFromRequest converts the structured fields of a create request into
+// the equivalent Modelfile commands. Files and adapters are referenced by the
+// digests of blobs previously uploaded with CreateBlobHandler.
+func modelfileFromRequest(r api.CreateRequest) (*parser.File, error) {
+	if r.From != "" && len(r.Files) > 0 {
+		return nil, errFromAndFiles
+	}
+
+	var f parser.File
+	if r.From != "" {
+		f.Commands = append(f.Commands, parser.Command{Name: "model", Args: r.From})
+	}
+
+	if len(r.Files) > 0 {
+		digest, err := blobFromFiles(r.Files)
+		if err != nil {
+			return nil, err
+		}
+
+		f.Commands = append(f.Commands, parser.Command{Name: "model", Args: "@" + digest})
+	}
+
+	if len(r.Adapters) > 0 {
+		digest, err := blobFromFiles(r.Adapters)
+		if err != nil {
+			return nil, err
+		}
+
+		f.Commands = append(f.Commands, parser.Command{Name: "adapter", Args: "@" + digest})
+	}
+
+	if r.Template != "" {
+		f.Commands = append(f.Commands, parser.Command{Name: "template", Args: r.Template})
+	}
+
+	if r.System != "" {
+		f.Commands = append(f.Commands, parser.Command{Name: "system", Args: r.System})
+	}
+
+	switch license := r.License.(type) {
+	case nil:
+	case string:
+		f.Commands = append(f.Commands, parser.Command{Name: "license", Args: license})
+	case []any:
+		for _, l := range license {
+			s, ok := l.(string)
+			if !ok {
+				return nil, fmt.Errorf("invalid license: %v", l)
+			}
+
+			f.Commands = append(f.Commands, parser.Command{Name: "license", Args: s})
+		}
+	default:
+		return nil, fmt.Errorf("invalid license: %v", license)
+	}
+
+	for _, k := range slices.Sorted(maps.Keys(r.Parameters)) {
+		switch v := r.Parameters[k].(type) {
+		case []any:
+			for _, e := range v {
+				f.Commands = append(f.Commands, parser.Command{Name: k, Args: formatParameter(e)})
+			}
+		default:
+			f.Commands = append(f.Commands, parser.Command{Name: k, Args: formatParameter(v)})
+		}
+	}
+
+	for _, msg := range r.Messages {
+		f.Commands = append(f.Commands, parser.Command{Name: "message", Args: fmt.Sprintf("%s: %s", msg.Role, msg.Content)})
+	}
+
+	return &f, nil
+}
+
+// formatParameter formats a parameter value decoded from JSON as a Modelfile
+// argument. Numbers are written without exponents so large integers such as
+// seeds still parse as integers.
+func formatParameter(v any) string {
+	if f, ok := v.(float64); ok {
+		return strconv.FormatFloat(f, 'f', -1, 64)
+	}
+
+	return fmt.Sprint(v)
+}
+
+// blobFromFiles returns the digest of the blob holding files. A single file is
+// used as is while multiple files, such as safetensors weights and their
+// configuration, are archived into a new zip blob.
+func blobFromFiles(files map[string]string) (string, error) {
+	for name, digest := range files {
+		if !filepath.IsLocal(name) {
+			return "", fmt.Errorf("invalid file name: %q", name)
+		}
+
+		p, err := GetBlobsPath(digest)
+		if err != nil {
+			return "", err
+		}
+
+		if _, err := os.Stat(p); err != nil {
+			return "", fmt.Errorf("file %q: %w", name, err)
+		}
+
+		if len(files) == 1 {
+			return digest, nil
+		}
+	}
+
+	blobs, err := GetBlobsPath("")
+	if err != nil {
+		return "", err
+	}
+
+	temp, err := os.CreateTemp(blobs, "files")
+	if err != nil {
+		return "", err
+	}
+	defer temp.Close()
+	defer os.Remove(temp.Name())
+
+	zw := zip.NewWriter(temp)
+	for _, name := range slices.Sorted(maps.Keys(files)) {
+		if err := zipBlob(zw, name, files[name]); err != nil {
+			return "", err
+		}
+	}
+
+	if err := zw.Close(); err != nil {
+		return "", err
+	}
+
+	if _, err := temp.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+
+	layer, err := NewLayer(temp, "")
+	if err != nil {
+		return "", err
+	}
+
+	return layer.Digest, nil
+}
+
+func zipBlob(zw *zip.Writer, name, digest string) error {
+	p, err := GetBlobsPath(digest)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	w, err := zw.CreateHeader(&zip.FileHeader{Name: filepath.ToSlash(name), Method: zip.Store})
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(w, f)
+	return err
+}
+
+// blobUploads holds a lock for each blob with a chunked upload in progress
+var blobUploads sync.Map
+
+// createBlobChunk writes one chunk of a resumable blob upload. Chunks carry a
+// Content-Range header and are appended to a partial file which is verified
+// against digest and moved into place once the last chunk is received.
+// Responses include a Range header with the bytes received so far so clients
+// can resume an interrupted upload.
+func createBlobChunk(c *gin.Context, digest, path string) {
+	var start, end, total int64
+	if n, err := fmt.Sscanf(c.GetHeader("Content-Range"), "bytes %d-%d/%d", &start, &end, &total); err != nil || n != 3 || start < 0 || start > end || end >= total {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("invalid content range %q", c.GetHeader("Content-Range"))})
+		return
+	}
+
+	mu, _ := blobUploads.LoadOrStore(path, &sync.Mutex{})
+	mu.(*sync.Mutex).Lock()
+	defer mu.(*sync.Mutex).Unlock()
+
+	partial := path + "-upload"
+	f, err := os.OpenFile(partial, os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	if start > fi.Size() {
+		setUploadRange(c, fi.Size())
+		c.AbortWithStatusJSON(http.StatusRequestedRangeNotSatisfiable, gin.H{"error": fmt.Sprintf("chunk starts at %d but only %d bytes have been received", start, fi.Size())})
+		return
+	}
+
+	if _, err := f.Seek(start, io.SeekStart); err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	if _, err := io.CopyN(f, c.Request.Body, end-start+1); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("error reading chunk: %v", err)})
+		return
+	}
+
+	size := max(fi.Size(), end+1)
+	if size < total {
+		setUploadRange(c, size)
+		c.Status(http.StatusAccepted)
+		return
+	}
+
+	if err := f.Close(); err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	if got, err := fileDigest(partial); err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	} else if got != digest {
+		os.Remove(partial)
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("digest mismatch, expected %q, got %q", digest, got)})
+		return
+	}
+
+	if err := os.Rename(partial, path); err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	blobUploads.Delete(path)
+	c.Status(http.StatusCreated)
+}
+
+// uploadedSize returns the number of bytes received for a chunked upload of
+// the blob at path, or zero if there is none
+func uploadedSize(path string) int64 {
+	fi, err := os.Stat(path + "-upload")
+	if err != nil {
+		return 0
+	}
+
+	return fi.Size()
+}
+
+func setUploadRange(c *gin.Context, size int64) {
+	if size > 0 {
+		c.Header("Range", fmt.Sprintf("bytes=0-%d", size-1))
+	}
+}
+
+func fileDigest(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("sha256:%x", h.Sum(nil)), nil
+}
@@ -0,0 +1,446 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/llm"
+	"github.com/ollama/ollama/tokenizer"
+	"github.com/ollama/ollama/types/errtypes"
+	"github.com/ollama/ollama/types/model"
+)
+
+// token types of the vocabulary, as in convert
+const (
+	tokenTypeUnknown     = 2
+	tokenTypeControl     = 3
+	tokenTypeUserDefined = 4
+)
+
+// modelFile is a file of a model in the format of a Hugging Face repository
+type modelFile struct {
+	name        string
+	contentType string
+
+	// build returns the file, or nil if the model doesn't have it
+	build func(m *Model, kv llm.KV) ([]byte, error)
+}
+
+var modelFiles = []modelFile{
+	{"template", "text/plain; charset=utf-8", templateFile},
+	{"chat_template.jinja", "text/plain; charset=utf-8", chatTemplateFile},
+	{"tokenizer.json", "application/json", tokenizerFile},
+	{"tokenizer_config.json", "application/json", tokenizerConfigFile},
+	{"generation_config.json", "application/json", generationConfigFile},
+}
+
+// ModelFileHandler returns a file of a model, such as its tokenizer.json,
+// rebuilt from the model so other tools can tokenize and prompt it the same
+// way, or lists its files if none is requested
+func (s *Server) ModelFileHandler(c *gin.Context) {
+	var req api.ModelFileRequest
+	if err := c.ShouldBindJSON(&req); errors.Is(err, io.EOF) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "missing request body"})
+		return
+	} else if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	name := model.ParseName(req.Model)
+	if !name.IsValid() {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": errtypes.InvalidModelNameErrMsg})
+		return
+	}
+
+	name, err := getExistingName(name)
+	if err != nil || tenantFromContext(c.Request.Context()).checkModel(name) != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("model '%s' not found", req.Model)})
+		return
+	}
+
+	m, err := GetModel(name.String())
+	if errors.Is(err, fs.ErrNotExist) {
+		c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("model '%s' not found", req.Model)})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	ggml, err := llm.LoadModel(m.ModelPath, -1)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	if req.File == "" {
+		files := []string{}
+		for _, f := range modelFiles {
+			if b, err := f.build(m, ggml.KV()); err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			} else if b != nil {
+				files = append(files, f.name)
+			}
+		}
+
+		c.JSON(http.StatusOK, api.ModelFilesResponse{Files: files})
+		return
+	}
+
+	for _, f := range modelFiles {
+		if f.name != req.File {
+			continue
+		}
+
+		b, err := f.build(m, ggml.KV())
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		} else if b == nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("model '%s' has no %s", req.Model, req.File)})
+			return
+		}
+
+		c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%q", f.name))
+		c.Data(http.StatusOK, f.contentType, b)
+		return
+	}
+
+	c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("invalid file %q", req.File)})
+}
+
+// marshalFile marshals v as the indented JSON of a file, without escaping
+// the HTML characters common in special tokens
+func marshalFile(v any) ([]byte, error) {
+	var b bytes.Buffer
+	enc := json.NewEncoder(&b)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+
+	return b.Bytes(), nil
+}
+
+// templateFile is the Go template Ollama prompts the model with
+func templateFile(m *Model, _ llm.KV) ([]byte, error) {
+	if m.Template == nil || m.Template.String() == "" {
+		return nil, nil
+	}
+
+	return []byte(m.Template.String()), nil
+}
+
+// chatTemplateFile is the Jinja chat template the model was converted with
+func chatTemplateFile(_ *Model, kv llm.KV) ([]byte, error) {
+	if kv.ChatTemplate() == "" {
+		return nil, nil
+	}
+
+	return []byte(kv.ChatTemplate()), nil
+}
+
+type addedToken struct {
+	ID         int    `json:"id"`
+	Content    string `json:"content"`
+	SingleWord bool   `json:"single_word"`
+	LStrip     bool   `json:"lstrip"`
+	RStrip     bool   `json:"rstrip"`
+	Normalized bool   `json:"normalized"`
+	Special    bool   `json:"special"`
+}
+
+type tokenizerJSON struct {
+	Version       string       `json:"version"`
+	Truncation    any          `json:"truncation"`
+	Padding       any          `json:"padding"`
+	AddedTokens   []addedToken `json:"added_tokens"`
+	Normalizer    any          `json:"normalizer"`
+	PreTokenizer  any          `json:"pre_tokenizer"`
+	PostProcessor any          `json:"post_processor"`
+	Decoder       any          `json:"decoder"`
+	Model         any          `json:"model"`
+}
+
+// specialToken returns the id and content of the special token of kind,
+// such as bos, if the model has one
+func specialToken(kv llm.KV, tokens []string, kind string) (int, string, bool) {
+	id, ok := kv[fmt.Sprintf("tokenizer.ggml.%s_token_id", kind)].(uint32)
+	if !ok || int(id) >= len(tokens) {
+		return 0, "", false
+	}
+
+	return int(id), tokens[id], true
+}
+
+// addSpecialToken returns whether the special token of kind is added to
+// prompts, or def if the model doesn't say
+func addSpecialToken(kv llm.KV, kind string, def bool) bool {
+	if add, ok := kv[fmt.Sprintf("tokenizer.ggml.add_%s_token", kind)].(bool); ok {
+		return add
+	}
+
+	return def
+}
+
+// stripsSpace reports whether an added token strips the whitespace to its
+// left and right, which llama.cpp decides by the model's name and
+// pre-tokenizer
+func stripsSpace(kv llm.KV, token string) (lstrip, rstrip bool) {
+	pre, _ := kv["tokenizer.ggml.pre"].(string)
+	name, _ := kv["general.name"].(string)
+	name = strings.ToLower(name)
+
+	switch {
+	case slices.Contains([]string{"jina-v2-de", "jina-v2-es", "jina-v2-code"}, pre):
+		return token == "<mask>", false
+	case strings.Contains(name, "phi-3") || strings.Contains(name, "phi3"):
+		return false, !slices.Contains([]string{"<unk>", "<s>", "<|endoftext|>"}, token)
+	default:
+		return false, false
+	}
+}
+
+// postProcessor adds the BOS and EOS tokens to prompts as the model does
+func postProcessor(kv llm.KV, tokens []string, addBOS bool) any {
+	type piece map[string]map[string]any
+	special := map[string]any{}
+
+	// sequence returns the pieces of a sequence with the special tokens
+	// around it
+	sequence := func(id string, typeID int) []piece {
+		var pieces []piece
+		add := func(kind string, enabled bool) {
+			if id, content, ok := specialToken(kv, tokens, kind); ok && enabled {
+				pieces = append(pieces, piece{"SpecialToken": {"id": content, "type_id": typeID}})
+				special[content] = map[string]any{"id": content, "ids": []int{id}, "tokens": []string{content}}
+			}
+		}
+
+		add("bos", addBOS)
+		pieces = append(pieces, piece{"Sequence": {"id": id, "type_id": typeID}})
+		add("eos", addSpecialToken(kv, "eos", false))
+		return pieces
+	}
+
+	single := sequence("A", 0)
+	pair := append(slices.Clone(single), sequence("B", 1)...)
+
+	return map[string]any{
+		"type":           "TemplateProcessing",
+		"single":         single,
+		"pair":           pair,
+		"special_tokens": special,
+	}
+}
+
+// tokenizerFile rebuilds the tokenizer.json of a BPE or SentencePiece
+// vocabulary
+func tokenizerFile(_ *Model, kv llm.KV) ([]byte, error) {
+	tokens := kv.Strings("tokenizer.ggml.tokens")
+	if len(tokens) == 0 {
+		return nil, nil
+	}
+
+	types := kv.Ints("tokenizer.ggml.token_type")
+
+	t := tokenizerJSON{Version: "1.0", AddedTokens: []addedToken{}}
+	for i, tt := range types {
+		if i < len(tokens) && (tt == tokenTypeUnknown || tt == tokenTypeControl || tt == tokenTypeUserDefined) {
+			lstrip, rstrip := stripsSpace(kv, tokens[i])
+			t.AddedTokens = append(t.AddedTokens, addedToken{
+				ID:         i,
+				Content:    tokens[i],
+				LStrip:     lstrip,
+				RStrip:     rstrip,
+				Normalized: tt == tokenTypeUserDefined,
+				Special:    tt != tokenTypeUserDefined,
+			})
+		}
+	}
+
+	switch model, _ := kv["tokenizer.ggml.model"].(string); model {
+	case "gpt2":
+		vocab := make(map[string]int, len(tokens))
+		for i, token := range tokens {
+			vocab[token] = i
+		}
+
+		merges := kv.Strings("tokenizer.ggml.merges")
+		if merges == nil {
+			merges = []string{}
+		}
+
+		// the pre-tokenizers are named as in llama.cpp, which also merges
+		// whole words in the vocabulary and adds BOS by default for Llama 3
+		var ignoreMerges bool
+		byteLevel := map[string]any{"type": "ByteLevel", "add_prefix_space": false, "trim_offsets": true, "use_regex": true}
+		switch pre, _ := kv["tokenizer.ggml.pre"].(string); pre {
+		case "llama3", "llama-v3", "llama-bpe", "dbrx", "smaug-bpe":
+			ignoreMerges = pre != "dbrx" && pre != "smaug-bpe"
+			byteLevel["use_regex"] = false
+			t.PreTokenizer = map[string]any{
+				"type": "Sequence",
+				"pretokenizers": []any{
+					map[string]any{"type": "Split", "pattern": map[string]string{"Regex": tokenizer.Llama3Pattern}, "behavior": "Isolated", "invert": false},
+					byteLevel,
+				},
+			}
+		case "gpt-2", "phi-2", "mpt", "olmo", "jais", "jina-es", "jina-de", "jina-v1-en", "jina-v2-es", "jina-v2-de", "jina-v2-code":
+			t.PreTokenizer = byteLevel
+		default:
+			// other pre-tokenizers, including the default one used without a
+			// name, split text with patterns of their own, and approximating
+			// them with GPT-2's would tokenize text differently from the model
+			return nil, nil
+		}
+
+		t.PostProcessor = postProcessor(kv, tokens, addSpecialToken(kv, "bos", ignoreMerges))
+		t.Decoder = map[string]any{"type": "ByteLevel", "add_prefix_space": true, "trim_offsets": true, "use_regex": true}
+		t.Model = map[string]any{
+			"type":                      "BPE",
+			"dropout":                   nil,
+			"unk_token":                 nil,
+			"continuing_subword_prefix": nil,
+			"end_of_word_suffix":        nil,
+			"fuse_unk":                  false,
+			"byte_fallback":             false,
+			"ignore_merges":             ignoreMerges,
+			"vocab":                     vocab,
+			"merges":                    merges,
+		}
+	case "llama":
+		scores := kv.Floats("tokenizer.ggml.scores")
+		vocab := make([][2]any, len(tokens))
+		for i, token := range tokens {
+			var score float32
+			if i < len(scores) {
+				score = scores[i]
+			}
+
+			vocab[i] = [2]any{token, score}
+		}
+
+		normalizers := []any{map[string]string{"type": "Replace", "pattern": " ", "content": "▁"}}
+		decoders := []any{
+			map[string]any{"type": "Replace", "pattern": map[string]string{"String": "▁"}, "content": " "},
+			map[string]any{"type": "ByteFallback"},
+			map[string]any{"type": "Fuse"},
+		}
+
+		if addPrefix, ok := kv["tokenizer.ggml.add_space_prefix"].(bool); !ok || addPrefix {
+			normalizers = append([]any{map[string]string{"type": "Prepend", "prepend": "▁"}}, normalizers...)
+			decoders = append(decoders, map[string]any{"type": "Strip", "content": " ", "start": 1, "stop": 0})
+		}
+
+		unk, _, _ := specialToken(kv, tokens, "unknown")
+		t.Normalizer = map[string]any{"type": "Sequence", "normalizers": normalizers}
+		t.PostProcessor = postProcessor(kv, tokens, addSpecialToken(kv, "bos", true))
+		t.Decoder = map[string]any{"type": "Sequence", "decoders": decoders}
+		t.Model = map[string]any{
+			"type":          "Unigram",
+			"unk_id":        unk,
+			"vocab":         vocab,
+			"byte_fallback": true,
+		}
+	default:
+		// WordPiece and other vocabularies aren't supported
+		return nil, nil
+	}
+
+	return marshalFile(t)
+}
+
+// tokenizerConfigFile is the tokenizer_config.json with the special tokens
+// and chat template of the model
+func tokenizerConfigFile(_ *Model, kv llm.KV) ([]byte, error) {
+	tokens := kv.Strings("tokenizer.ggml.tokens")
+	if len(tokens) == 0 {
+		return nil, nil
+	}
+
+	config := map[string]any{
+		"tokenizer_class":              "PreTrainedTokenizerFast",
+		"clean_up_tokenization_spaces": false,
+	}
+
+	model, _ := kv["tokenizer.ggml.model"].(string)
+	config["add_bos_token"] = addSpecialToken(kv, "bos", model == "llama")
+	config["add_eos_token"] = addSpecialToken(kv, "eos", false)
+
+	for kind, key := range map[string]string{"bos": "bos_token", "eos": "eos_token", "unknown": "unk_token", "padding": "pad_token"} {
+		if _, content, ok := specialToken(kv, tokens, kind); ok {
+			config[key] = content
+		}
+	}
+
+	if n := kv.ContextLength(); n > 0 {
+		config["model_max_length"] = n
+	}
+
+	if t := kv.ChatTemplate(); t != "" {
+		config["chat_template"] = t
+	}
+
+	return marshalFile(config)
+}
+
+// generationConfigFile is the generation_config.json with the special
+// tokens of the model and its default sampling options
+func generationConfigFile(m *Model, kv llm.KV) ([]byte, error) {
+	opts, err := modelOptions(m, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	config := map[string]any{
+		"do_sample":          opts.Temperature > 0,
+		"temperature":        opts.Temperature,
+		"top_k":              opts.TopK,
+		"top_p":              opts.TopP,
+		"min_p":              opts.MinP,
+		"repetition_penalty": opts.RepeatPenalty,
+	}
+
+	if opts.NumPredict > 0 {
+		config["max_new_tokens"] = opts.NumPredict
+	}
+
+	if id, ok := kv["tokenizer.ggml.bos_token_id"].(uint32); ok {
+		config["bos_token_id"] = id
+	}
+
+	var eos []uint32
+	for _, key := range []string{"tokenizer.ggml.eos_token_id", "tokenizer.ggml.eot_token_id", "tokenizer.ggml.eom_token_id"} {
+		if id, ok := kv[key].(uint32); ok && !slices.Contains(eos, id) {
+			eos = append(eos, id)
+		}
+	}
+
+	switch len(eos) {
+	case 0:
+	case 1:
+		config["eos_token_id"] = eos[0]
+	default:
+		config["eos_token_id"] = eos
+	}
+
+	if id, ok := kv["tokenizer.ggml.padding_token_id"].(uint32); ok {
+		config["pad_token_id"] = id
+	}
+
+	return marshalFile(config)
+}
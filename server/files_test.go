@@ -0,0 +1,418 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/llama"
+	"github.com/ollama/ollama/llm"
+	"github.com/ollama/ollama/tokenizer"
+)
+
+func TestModelFiles(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+
+	var s Server
+
+	models := map[string]llm.KV{
+		"bpe": {
+			"tokenizer.ggml.model":         "gpt2",
+			"tokenizer.ggml.pre":           "llama-bpe",
+			"tokenizer.ggml.tokens":        []string{"<|begin_of_text|>", "<|eot_id|>", "a", "b", "ab"},
+			"tokenizer.ggml.token_type":    []int32{3, 3, 1, 1, 1},
+			"tokenizer.ggml.merges":        []string{"a b"},
+			"tokenizer.ggml.bos_token_id":  uint32(0),
+			"tokenizer.ggml.eos_token_id":  uint32(1),
+			"tokenizer.ggml.eot_token_id":  uint32(1),
+			"tokenizer.ggml.add_bos_token": true,
+			"tokenizer.chat_template":      "{{ bos_token }}{{ messages[0]['content'] }}",
+		},
+		"qwen2": {
+			"tokenizer.ggml.model":      "gpt2",
+			"tokenizer.ggml.pre":        "qwen2",
+			"tokenizer.ggml.tokens":     []string{"a", "b", "ab"},
+			"tokenizer.ggml.token_type": []int32{1, 1, 1},
+			"tokenizer.ggml.merges":     []string{"a b"},
+		},
+		"spm": {
+			"tokenizer.ggml.model":            "llama",
+			"tokenizer.ggml.tokens":           []string{"<unk>", "<s>", "</s>", "▁a"},
+			"tokenizer.ggml.scores":           []float32{0, 0, 0, -1},
+			"tokenizer.ggml.token_type":       []int32{2, 3, 3, 1},
+			"tokenizer.ggml.bos_token_id":     uint32(1),
+			"tokenizer.ggml.eos_token_id":     uint32(2),
+			"tokenizer.ggml.unknown_token_id": uint32(0),
+		},
+	}
+
+	for name, kv := range models {
+		kv["general.architecture"] = "llama"
+		kv["llama.context_length"] = uint32(8192)
+		w := createRequest(t, s.CreateHandler, api.CreateRequest{
+			Model:     name,
+			Modelfile: fmt.Sprintf("FROM %s\nTEMPLATE {{ .Prompt }}\nPARAMETER temperature 0.6", createBinFile(t, kv, nil)),
+			Stream:    &stream,
+		})
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+	}
+
+	file := func(t *testing.T, model, name string, v any) {
+		t.Helper()
+		w := createRequest(t, s.ModelFileHandler, api.ModelFileRequest{Model: model, File: name})
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+
+		if err := json.Unmarshal(w.Body.Bytes(), v); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	t.Run("list", func(t *testing.T) {
+		for name, expect := range map[string][]string{
+			"bpe":   {"template", "chat_template.jinja", "tokenizer.json", "tokenizer_config.json", "generation_config.json"},
+			"spm":   {"template", "tokenizer.json", "tokenizer_config.json", "generation_config.json"},
+			"qwen2": {"template", "tokenizer_config.json", "generation_config.json"},
+		} {
+			var resp api.ModelFilesResponse
+			file(t, name, "", &resp)
+			if diff := cmp.Diff(resp.Files, expect); diff != "" {
+				t.Errorf("%s: mismatch (-got +want):\n%s", name, diff)
+			}
+		}
+	})
+
+	t.Run("bpe tokenizer", func(t *testing.T) {
+		var tok struct {
+			AddedTokens []struct {
+				ID      int    `json:"id"`
+				Content string `json:"content"`
+				Special bool   `json:"special"`
+			} `json:"added_tokens"`
+			PreTokenizer struct {
+				PreTokenizers []struct {
+					Type    string `json:"type"`
+					Pattern struct {
+						Regex string `json:"Regex"`
+					} `json:"pattern"`
+				} `json:"pretokenizers"`
+			} `json:"pre_tokenizer"`
+			PostProcessor struct {
+				Single []map[string]map[string]any `json:"single"`
+			} `json:"post_processor"`
+			Model struct {
+				Type         string         `json:"type"`
+				Vocab        map[string]int `json:"vocab"`
+				Merges       []string       `json:"merges"`
+				IgnoreMerges bool           `json:"ignore_merges"`
+			} `json:"model"`
+		}
+		file(t, "bpe", "tokenizer.json", &tok)
+
+		if tok.Model.Type != "BPE" || !tok.Model.IgnoreMerges {
+			t.Errorf("expected a BPE model ignoring merges, got %q %v", tok.Model.Type, tok.Model.IgnoreMerges)
+		}
+
+		if diff := cmp.Diff(tok.Model.Vocab, map[string]int{"<|begin_of_text|>": 0, "<|eot_id|>": 1, "a": 2, "b": 3, "ab": 4}); diff != "" {
+			t.Errorf("mismatch (-got +want):\n%s", diff)
+		}
+
+		if diff := cmp.Diff(tok.Model.Merges, []string{"a b"}); diff != "" {
+			t.Errorf("mismatch (-got +want):\n%s", diff)
+		}
+
+		if len(tok.AddedTokens) != 2 || tok.AddedTokens[1].Content != "<|eot_id|>" || !tok.AddedTokens[1].Special {
+			t.Errorf("unexpected added tokens %+v", tok.AddedTokens)
+		}
+
+		if len(tok.PreTokenizer.PreTokenizers) != 2 || tok.PreTokenizer.PreTokenizers[0].Pattern.Regex != tokenizer.Llama3Pattern {
+			t.Errorf("unexpected pre-tokenizer %+v", tok.PreTokenizer)
+		}
+
+		if len(tok.PostProcessor.Single) != 2 || tok.PostProcessor.Single[0]["SpecialToken"]["id"] != "<|begin_of_text|>" {
+			t.Errorf("expected the BOS token to be added, got %+v", tok.PostProcessor.Single)
+		}
+	})
+
+	t.Run("unsupported pre-tokenizer", func(t *testing.T) {
+		w := createRequest(t, s.ModelFileHandler, api.ModelFileRequest{Model: "qwen2", File: "tokenizer.json"})
+		if w.Code != http.StatusNotFound {
+			t.Errorf("expected status 404, got %d: %s", w.Code, w.Body.String())
+		}
+	})
+
+	t.Run("spm tokenizer", func(t *testing.T) {
+		var tok struct {
+			AddedTokens []struct {
+				ID      int    `json:"id"`
+				Content string `json:"content"`
+				Special bool   `json:"special"`
+			} `json:"added_tokens"`
+			Model struct {
+				Type  string  `json:"type"`
+				UnkID int     `json:"unk_id"`
+				Vocab [][]any `json:"vocab"`
+			} `json:"model"`
+		}
+		file(t, "spm", "tokenizer.json", &tok)
+
+		if len(tok.AddedTokens) != 3 || tok.AddedTokens[0].Content != "<unk>" || !tok.AddedTokens[0].Special {
+			t.Errorf("unexpected added tokens %+v", tok.AddedTokens)
+		}
+
+		if diff := cmp.Diff(tok.Model.Vocab, [][]any{{"<unk>", 0.0}, {"<s>", 0.0}, {"</s>", 0.0}, {"▁a", -1.0}}); diff != "" {
+			t.Errorf("mismatch (-got +want):\n%s", diff)
+		}
+
+		if tok.Model.Type != "Unigram" || tok.Model.UnkID != 0 {
+			t.Errorf("unexpected model %+v", tok.Model)
+		}
+	})
+
+	t.Run("configs", func(t *testing.T) {
+		var config map[string]any
+		file(t, "bpe", "tokenizer_config.json", &config)
+		for k, v := range map[string]any{
+			"bos_token":        "<|begin_of_text|>",
+			"eos_token":        "<|eot_id|>",
+			"add_bos_token":    true,
+			"model_max_length": 8192.0,
+			"chat_template":    "{{ bos_token }}{{ messages[0]['content'] }}",
+		} {
+			if config[k] != v {
+				t.Errorf("expected %s %v, got %v", k, v, config[k])
+			}
+		}
+
+		var generation map[string]any
+		file(t, "bpe", "generation_config.json", &generation)
+		for k, v := range map[string]any{
+			"bos_token_id": 0.0,
+			"eos_token_id": 1.0,
+			"temperature":  0.6,
+		} {
+			if fmt.Sprint(generation[k]) != fmt.Sprint(v) {
+				t.Errorf("expected %s %v, got %v", k, v, generation[k])
+			}
+		}
+
+		w := createRequest(t, s.ModelFileHandler, api.ModelFileRequest{Model: "bpe", File: "template"})
+		if w.Code != http.StatusOK || w.Body.String() != "{{ .Prompt }}" {
+			t.Errorf("unexpected template %d %q", w.Code, w.Body.String())
+		}
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		for _, tt := range []struct {
+			req  api.ModelFileRequest
+			code int
+		}{
+			{api.ModelFileRequest{Model: "spm", File: "chat_template.jinja"}, http.StatusNotFound},
+			{api.ModelFileRequest{Model: "bpe", File: "model.safetensors"}, http.StatusBadRequest},
+			{api.ModelFileRequest{Model: "missing"}, http.StatusNotFound},
+		} {
+			w := createRequest(t, s.ModelFileHandler, tt.req)
+			if w.Code != tt.code {
+				t.Errorf("%+v: expected status %d, got %d", tt.req, tt.code, w.Code)
+			}
+		}
+	})
+}
+
+// byteLevel returns the byte-level vocabulary of GPT-2 style tokenizers: the
+// characters standing for each byte
+func byteLevel() []string {
+	var tokens []string
+	n := 0
+	for b := range 256 {
+		if b >= '!' && b <= '~' || b >= 0xa1 && b <= 0xac || b >= 0xae {
+			tokens = append(tokens, string(rune(b)))
+		} else {
+			tokens = append(tokens, string(rune(256+n)))
+			n++
+		}
+	}
+
+	return tokens
+}
+
+// chainMerges returns the merges building each word from its first
+// character, and the tokens they make, in order
+func chainMerges(words ...string) (merges, tokens []string) {
+	for _, word := range words {
+		runes := []rune(word)
+		for i := 2; i <= len(runes); i++ {
+			token := string(runes[:i])
+			if !slices.Contains(tokens, token) {
+				merges = append(merges, string(runes[:i-1])+" "+string(runes[i-1]))
+				tokens = append(tokens, token)
+			}
+		}
+	}
+
+	return merges, tokens
+}
+
+// TestTokenizerFileLlamaCpp checks that the tokenizer.json served for a model
+// tokenizes text the same as llama.cpp does in the runner
+func TestTokenizerFileLlamaCpp(t *testing.T) {
+	bpe := func(pre string, addBOS bool) llm.KV {
+		merges, merged := chainMerges(
+			"Ġthe", "hello", "Ġworld", "'s", "'t", "'re", "'ll", "Ġdon", "12", "123", "Ġ1",
+			"ĠĠ", "ĠĠĠĠ", "ĊĊ", "čĊ", "čĊčĊ", "ĉĉ",
+		)
+
+		tokens := append([]string{"<|begin_of_text|>", "<|eot_id|>"}, byteLevel()...)
+		tokens = append(tokens, merged...)
+		// a word which merges don't reach
+		tokens = append(tokens, "Ġzebra")
+
+		types := make([]int32, len(tokens))
+		for i := range types {
+			types[i] = 1
+		}
+		types[0], types[1] = 3, 3
+
+		return llm.KV{
+			"tokenizer.ggml.model":         "gpt2",
+			"tokenizer.ggml.pre":           pre,
+			"tokenizer.ggml.tokens":        tokens,
+			"tokenizer.ggml.token_type":    types,
+			"tokenizer.ggml.merges":        merges,
+			"tokenizer.ggml.bos_token_id":  uint32(0),
+			"tokenizer.ggml.eos_token_id":  uint32(1),
+			"tokenizer.ggml.add_bos_token": addBOS,
+		}
+	}
+
+	spm := func() llm.KV {
+		tokens := []string{"<unk>", "<s>", "</s>"}
+		types := []int32{2, 3, 3}
+		scores := []float32{0, 0, 0}
+		for b := range 256 {
+			tokens = append(tokens, fmt.Sprintf("<0x%02X>", b))
+			types = append(types, 6)
+			scores = append(scores, 0)
+		}
+
+		pieces := []string{
+			"▁", "e", "h", "l", "o", "t", "w", "r", "d", "s", "n", "'", "1", "2", "3",
+			"▁t", "he", "▁the", "ll", "llo", "▁he", "▁w", "or", "▁wor", "▁world", "'s", "▁don",
+			"12", "123", "▁1", "▁▁", "▁▁▁▁",
+		}
+		for i, piece := range pieces {
+			tokens = append(tokens, piece)
+			types = append(types, 1)
+			scores = append(scores, -float32(i))
+		}
+
+		return llm.KV{
+			"tokenizer.ggml.model":            "llama",
+			"tokenizer.ggml.tokens":           tokens,
+			"tokenizer.ggml.token_type":       types,
+			"tokenizer.ggml.scores":           scores,
+			"tokenizer.ggml.bos_token_id":     uint32(1),
+			"tokenizer.ggml.eos_token_id":     uint32(2),
+			"tokenizer.ggml.unknown_token_id": uint32(0),
+		}
+	}
+
+	vocabs := map[string]llm.KV{
+		"llama3": bpe("llama-bpe", true),
+		"gpt2":   bpe("gpt-2", false),
+		"spm":    spm(),
+	}
+
+	texts := []string{
+		"hello world",
+		"Hello World",
+		"the world the",
+		"it's we're they'll don't IT'S I'M",
+		"1 12 123 1234 1234567 3.14",
+		"a\r\nb\r\n\r\nc\n\n\nd",
+		"trailing   ",
+		"trailing\n",
+		"  leading spaces",
+		"tabs\t\tand\t spaces",
+		" zebra zebras",
+		"café 日本語 🦙",
+		"hello<|begin_of_text|>world<|eot_id|>",
+		"",
+	}
+
+	dir := t.TempDir()
+	for name, kv := range vocabs {
+		t.Run(name, func(t *testing.T) {
+			// llama.cpp loads the vocabulary of a model without its weights
+			kv["general.architecture"] = "llama"
+			kv["llama.context_length"] = uint32(64)
+			kv["llama.embedding_length"] = uint32(16)
+			kv["llama.block_count"] = uint32(1)
+			kv["llama.feed_forward_length"] = uint32(32)
+			kv["llama.attention.head_count"] = uint32(4)
+			kv["llama.attention.layer_norm_rms_epsilon"] = float32(1e-5)
+
+			path := filepath.Join(dir, name+".gguf")
+			f, err := os.Create(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if err := llm.WriteGGUF(f, kv, nil); err != nil {
+				t.Fatal(err)
+			}
+
+			if _, err := f.Seek(0, io.SeekStart); err != nil {
+				t.Fatal(err)
+			}
+
+			ggml, _, err := llm.DecodeGGML(f, -1)
+			f.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			b, err := tokenizerFile(nil, ggml.KV())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			tok, err := tokenizer.Parse(b)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			m, err := llama.LoadModelFromFile(path, llama.ModelParams{VocabOnly: true})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer llama.FreeModel(m)
+
+			for _, text := range texts {
+				expect, err := m.Tokenize(text, true, true)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if diff := cmp.Diff(tok.Encode(text, true), expect); diff != "" {
+					t.Errorf("%q: mismatch (-got +want):\n%s", strings.ReplaceAll(text, "\n", `\n`), diff)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,203 @@
+package server
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"sync"
+
+	"github.com/x448/float16"
+
+	"github.com/ollama/ollama/llm"
+)
+
+var errHeadNotFound = errors.New("head not found")
+
+// outputHead is an alternative output layer, such as a classification or
+// reward head, applied to the final hidden state of the model in place of
+// the language modeling head. Heads are small so they're applied by the
+// server while the backbone stays loaded in the runner.
+type outputHead struct {
+	Name   string
+	Labels []string
+
+	// weight is row major with one row of embedSize values per output
+	weight    []float32
+	bias      []float32
+	embedSize int
+}
+
+// heads caches loaded heads by path. Blobs are content addressed so a head
+// never changes once loaded.
+var heads sync.Map
+
+// readHead reads a head from a GGUF file with a "head.name" key, a
+// "head.weight" tensor of embedding length by number of outputs and an
+// optional "head.bias" tensor. Classification heads may name their outputs
+// with "head.labels".
+func readHead(f *os.File) (*outputHead, error) {
+	ggml, _, err := llm.DecodeGGML(f, -1)
+	if err != nil {
+		return nil, fmt.Errorf("invalid head: %w", err)
+	}
+
+	name, _ := ggml.KV()["head.name"].(string)
+	if name == "" {
+		return nil, errors.New("invalid head: missing head.name")
+	}
+
+	h := outputHead{Name: name, Labels: ggml.KV().Strings("head.labels")}
+
+	var weight, bias *llm.Tensor
+	for _, t := range ggml.Tensors().Items {
+		switch t.Name {
+		case "head.weight":
+			weight = t
+		case "head.bias":
+			bias = t
+		}
+	}
+
+	if weight == nil || len(weight.Shape) != 2 {
+		return nil, errors.New("invalid head: head.weight must be a 2 dimensional tensor")
+	}
+
+	h.embedSize = int(weight.Shape[0])
+	outputs := int(weight.Shape[1])
+	if h.weight, err = readTensor(f, ggml.Tensors().Offset, weight); err != nil {
+		return nil, err
+	}
+
+	if bias != nil {
+		if len(bias.Shape) != 1 || int(bias.Shape[0]) != outputs {
+			return nil, fmt.Errorf("invalid head: head.bias must have %d values", outputs)
+		}
+
+		if h.bias, err = readTensor(f, ggml.Tensors().Offset, bias); err != nil {
+			return nil, err
+		}
+	}
+
+	if h.Labels != nil && len(h.Labels) != outputs {
+		return nil, fmt.Errorf("invalid head: expected %d labels, got %d", outputs, len(h.Labels))
+	}
+
+	return &h, nil
+}
+
+// readTensor reads the values of an F32 or F16 tensor
+func readTensor(f *os.File, offset uint64, t *llm.Tensor) ([]float32, error) {
+	n := 1
+	for _, d := range t.Shape {
+		n *= int(d)
+	}
+
+	r := io.NewSectionReader(f, int64(offset+t.Offset), int64(t.Size()))
+	values := make([]float32, n)
+	switch t.Kind {
+	case 0:
+		if err := binary.Read(r, binary.LittleEndian, values); err != nil {
+			return nil, fmt.Errorf("%s: %w", t.Name, err)
+		}
+	case 1:
+		f16 := make([]uint16, n)
+		if err := binary.Read(r, binary.LittleEndian, f16); err != nil {
+			return nil, fmt.Errorf("%s: %w", t.Name, err)
+		}
+
+		for i, v := range f16 {
+			values[i] = float16.Frombits(v).Float32()
+		}
+	default:
+		return nil, fmt.Errorf("invalid head: %s must be F32 or F16", t.Name)
+	}
+
+	return values, nil
+}
+
+// loadHead returns the head at path, reading it on first use
+func loadHead(path string) (*outputHead, error) {
+	if h, ok := heads.Load(path); ok {
+		return h.(*outputHead), nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	h, err := readHead(f)
+	if err != nil {
+		return nil, err
+	}
+
+	heads.Store(path, h)
+	return h, nil
+}
+
+// Head returns the model's output head called name. Heads added later
+// replace earlier ones with the same name.
+func (m *Model) Head(name string) (*outputHead, error) {
+	for _, path := range slices.Backward(m.HeadPaths) {
+		h, err := loadHead(path)
+		if err != nil {
+			return nil, err
+		}
+
+		if h.Name == name {
+			return h, nil
+		}
+	}
+
+	return nil, fmt.Errorf("%w: %q", errHeadNotFound, name)
+}
+
+// headLayer checks f is a head for a model with kv and creates a layer for it
+func headLayer(f *os.File, kv llm.KV) (Layer, error) {
+	if kv == nil {
+		return Layer{}, errors.New("no base model specified for the head")
+	}
+
+	h, err := readHead(f)
+	if err != nil {
+		return Layer{}, err
+	}
+
+	if uint64(h.embedSize) != kv.EmbeddingLength() {
+		return Layer{}, fmt.Errorf("head embedding length %d doesn't match the model's %d", h.embedSize, kv.EmbeddingLength())
+	}
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return Layer{}, err
+	}
+
+	return NewLayer(f, "application/vnd.ollama.image.head")
+}
+
+// apply returns the head's outputs for the hidden state of the last token
+func (h *outputHead) apply(hidden []float32) ([]float32, error) {
+	if len(hidden) != h.embedSize {
+		return nil, fmt.Errorf("head %q expects hidden states of %d values, got %d", h.Name, h.embedSize, len(hidden))
+	}
+
+	outputs := len(h.weight) / h.embedSize
+	scores := make([]float32, outputs)
+	for i := range scores {
+		var sum float32
+		for j, w := range h.weight[i*h.embedSize : (i+1)*h.embedSize] {
+			sum += w * hidden[j]
+		}
+
+		if h.bias != nil {
+			sum += h.bias[i]
+		}
+
+		scores[i] = sum
+	}
+
+	return scores, nil
+}
@@ -0,0 +1,115 @@
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/ollama/ollama/llm"
+)
+
+func float32Bytes(t *testing.T, values []float32) *bytes.Reader {
+	t.Helper()
+
+	var b bytes.Buffer
+	if err := binary.Write(&b, binary.LittleEndian, values); err != nil {
+		t.Fatal(err)
+	}
+
+	return bytes.NewReader(b.Bytes())
+}
+
+// createHeadFile writes a head with outputs rows of weight and a bias of
+// one for each output
+func createHeadFile(t *testing.T, kv llm.KV, weight [][]float32) string {
+	t.Helper()
+
+	var w []float32
+	for _, row := range weight {
+		w = append(w, row...)
+	}
+
+	bias := make([]float32, len(weight))
+	for i := range bias {
+		bias[i] = 1
+	}
+
+	return createBinFile(t, kv, []llm.Tensor{
+		{Name: "head.weight", Shape: []uint64{uint64(len(weight)), uint64(len(weight[0]))}, WriterTo: float32Bytes(t, w)},
+		{Name: "head.bias", Shape: []uint64{uint64(len(weight))}, WriterTo: float32Bytes(t, bias)},
+	})
+}
+
+func TestReadHead(t *testing.T) {
+	path := createHeadFile(t, llm.KV{
+		"general.architecture": "llama",
+		"head.name":            "sentiment",
+		"head.labels":          []string{"negative", "positive"},
+	}, [][]float32{
+		{1, 0, 0, 0, 0, 0, 0, 0},
+		{0, 1, 2, 3, 4, 5, 6, 7},
+	})
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	h, err := readHead(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if h.Name != "sentiment" {
+		t.Errorf("expected name sentiment, got %q", h.Name)
+	}
+
+	if diff := cmp.Diff(h.Labels, []string{"negative", "positive"}); diff != "" {
+		t.Errorf("mismatch (-got +want):\n%s", diff)
+	}
+
+	scores, err := h.apply([]float32{2, 1, 1, 1, 1, 1, 1, 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if diff := cmp.Diff(scores, []float32{3, 29}); diff != "" {
+		t.Errorf("mismatch (-got +want):\n%s", diff)
+	}
+
+	if _, err := h.apply([]float32{1, 2}); err == nil {
+		t.Error("expected error for mismatched hidden states")
+	}
+
+	t.Run("missing name", func(t *testing.T) {
+		f, err := os.Open(createHeadFile(t, llm.KV{"general.architecture": "llama"}, [][]float32{{1, 2, 3, 4, 5, 6, 7, 8}}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+
+		if _, err := readHead(f); err == nil {
+			t.Error("expected error")
+		}
+	})
+
+	t.Run("mismatched labels", func(t *testing.T) {
+		f, err := os.Open(createHeadFile(t, llm.KV{
+			"general.architecture": "llama",
+			"head.name":            "sentiment",
+			"head.labels":          []string{"negative", "neutral", "positive"},
+		}, [][]float32{{1, 2, 3, 4, 5, 6, 7, 8}}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+
+		if _, err := readHead(f); err == nil {
+			t.Error("expected error")
+		}
+	})
+}
@@ -12,6 +12,7 @@ import (
 	"io"
 	"log"
 	"log/slog"
+	"maps"
 	"net"
 	"net/http"
 	"net/url"
@@ -46,6 +47,8 @@ const (
 	CapabilityCompletion = Capability("completion")
 	CapabilityTools      = Capability("tools")
 	CapabilityInsert     = Capability("insert")
+	CapabilityVision     = Capability("vision")
+	CapabilityEmbedding  = Capability("embedding")
 )
 
 type registryOptions struct {
@@ -55,6 +58,18 @@ type registryOptions struct {
 	Token    string
 
 	CheckRedirect func(req *http.Request, via []*http.Request) error
+
+	// checkConfig, if set, is called with the config of a model before its
+	// layers are pulled and before it's created
+	checkConfig func(model.Name, ConfigV2) error
+
+	// checkLayers, if set, is called with the layers of a model before
+	// they're pulled and before its manifest is written
+	checkLayers func(model.Name, []Layer) error
+
+	// added, if set, is called with the name of a model once its manifest
+	// is written
+	added func(model.Name) error
 }
 
 type Model struct {
@@ -65,6 +80,13 @@ type Model struct {
 	ParentModel    string
 	AdapterPaths   []string
 	ProjectorPaths []string
+
+	// RuntimeAdapterPaths are the adapters selected with the adapter option,
+	// which the runner applies for a request on top of AdapterPaths
+	RuntimeAdapterPaths []string
+
+	SoftPromptPath string
+	HeadPaths      []string
 	System         string
 	License        []string
 	Digest         string
@@ -142,6 +164,20 @@ func (m *Model) String() string {
 		})
 	}
 
+	if m.SoftPromptPath != "" {
+		modelfile.Commands = append(modelfile.Commands, parser.Command{
+			Name: "softprompt",
+			Args: m.SoftPromptPath,
+		})
+	}
+
+	for _, head := range m.HeadPaths {
+		modelfile.Commands = append(modelfile.Commands, parser.Command{
+			Name: "head",
+			Args: head,
+		})
+	}
+
 	if m.Template != nil {
 		modelfile.Commands = append(modelfile.Commands, parser.Command{
 			Name: "template",
@@ -165,6 +201,13 @@ func (m *Model) String() string {
 					Args: fmt.Sprintf("%v", s),
 				})
 			}
+		case map[string]any:
+			for _, token := range slices.Sorted(maps.Keys(v)) {
+				modelfile.Commands = append(modelfile.Commands, parser.Command{
+					Name: k,
+					Args: fmt.Sprintf("%s:%v", token, v[token]),
+				})
+			}
 		default:
 			modelfile.Commands = append(modelfile.Commands, parser.Command{
 				Name: k,
@@ -197,6 +240,10 @@ type ConfigV2 struct {
 	ModelType     string   `json:"model_type"`
 	FileType      string   `json:"file_type"`
 
+	Labels map[string]string `json:"labels,omitempty"`
+
+	Provenance *api.Provenance `json:"provenance,omitempty"`
+
 	// required by spec
 	Architecture string `json:"architecture"`
 	OS           string `json:"os"`
@@ -279,6 +326,10 @@ func GetModel(name string) (*Model, error) {
 			model.AdapterPaths = append(model.AdapterPaths, filename)
 		case "application/vnd.ollama.image.projector":
 			model.ProjectorPaths = append(model.ProjectorPaths, filename)
+		case "application/vnd.ollama.image.softprompt":
+			model.SoftPromptPath = filename
+		case "application/vnd.ollama.image.head":
+			model.HeadPaths = append(model.HeadPaths, filename)
 		case "application/vnd.ollama.image.prompt",
 			"application/vnd.ollama.image.template":
 			bts, err := os.ReadFile(filename)
@@ -355,13 +406,23 @@ func realpath(rel, from string) string {
 	return abspath
 }
 
-func CreateModel(ctx context.Context, name model.Name, modelFileDir, quantization string, modelfile *parser.File, fn func(resp api.ProgressResponse)) (err error) {
+// CreateModel creates the model called name from modelfile. If perplexity
+// isn't nil, models which are quantized are measured with it before and
+// after quantization.
+func CreateModel(ctx context.Context, name model.Name, modelFileDir, quantization string, perplexity perplexityFunc, modelfile *parser.File, regOpts *registryOptions, fn func(resp api.ProgressResponse)) (err error) {
+	unlock, err := lockStore(false, true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
 	config := ConfigV2{
 		OS:           "linux",
 		Architecture: "amd64",
 		RootFS: RootFS{
 			Type: "layers",
 		},
+		Provenance: newProvenance(),
 	}
 
 	var messages []*api.Message
@@ -369,6 +430,7 @@ func CreateModel(ctx context.Context, name model.Name, modelFileDir, quantizatio
 
 	var layers []Layer
 	var baseLayers []*layerGGML
+	var baseKV llm.KV
 	for _, c := range modelfile.Commands {
 		mediatype := fmt.Sprintf("application/vnd.ollama.image.%s", c.Name)
 		command := c.Name
@@ -380,12 +442,23 @@ func CreateModel(ctx context.Context, name model.Name, modelFileDir, quantizatio
 				if err != nil {
 					return err
 				}
-				baseLayers, err = parseFromModel(ctx, name, fn)
+				baseLayers, err = parseFromModel(ctx, name, regOpts, fn)
+				if err != nil {
+					return err
+				}
+
+				parent, err := parentModel(command, name)
 				if err != nil {
 					return err
 				}
+
+				config.Provenance.Parents = append(config.Provenance.Parents, parent)
+				if parent.Provenance != nil {
+					config.Provenance.Source = cmp.Or(config.Provenance.Source, parent.Provenance.Source)
+				}
 			} else if strings.HasPrefix(c.Args, "@") {
 				digest := strings.TrimPrefix(c.Args, "@")
+				source, converted := digest, false
 				if ib, ok := intermediateBlobs[digest]; ok {
 					p, err := GetBlobsPath(ib)
 					if err != nil {
@@ -399,6 +472,7 @@ func CreateModel(ctx context.Context, name model.Name, modelFileDir, quantizatio
 					} else {
 						fn(api.ProgressResponse{Status: fmt.Sprintf("using cached layer %s", ib)})
 						digest = ib
+						converted = true
 					}
 				}
 
@@ -413,6 +487,13 @@ func CreateModel(ctx context.Context, name model.Name, modelFileDir, quantizatio
 				}
 				defer blob.Close()
 
+				parent, err := parentFile(command, source, blob, converted)
+				if err != nil {
+					return err
+				}
+
+				config.Provenance.Parents = append(config.Provenance.Parents, parent)
+
 				baseLayers, err = parseFromFile(ctx, command, baseLayers, blob, digest, fn)
 				if err != nil {
 					return err
@@ -420,6 +501,13 @@ func CreateModel(ctx context.Context, name model.Name, modelFileDir, quantizatio
 			} else if file, err := os.Open(realpath(modelFileDir, c.Args)); err == nil {
 				defer file.Close()
 
+				parent, err := parentFile(command, "", file, false)
+				if err != nil {
+					return err
+				}
+
+				config.Provenance.Parents = append(config.Provenance.Parents, parent)
+
 				baseLayers, err = parseFromFile(ctx, command, baseLayers, file, "", fn)
 				if err != nil {
 					return err
@@ -476,9 +564,42 @@ func CreateModel(ctx context.Context, name model.Name, modelFileDir, quantizatio
 
 						baseLayer.Layer = layer
 						baseLayer.GGML = ggml
+
+						config.Provenance.Quantization = &api.ProvenanceQuantization{
+							From: ft.String(),
+							To:   want.String(),
+							Tool: "llama.cpp " + llama.Commit(),
+						}
+
+						if perplexity != nil {
+							quantized, err := GetBlobsPath(layer.Digest)
+							if err != nil {
+								return err
+							}
+
+							fn(api.ProgressResponse{Status: fmt.Sprintf("measuring perplexity of %s model", ft)})
+							from, tokens, err := perplexity(ctx, blob)
+							if err != nil {
+								return fmt.Errorf("measuring perplexity: %w", err)
+							}
+
+							fn(api.ProgressResponse{Status: fmt.Sprintf("measuring perplexity of %s model", want)})
+							to, _, err := perplexity(ctx, quantized)
+							if err != nil {
+								return fmt.Errorf("measuring perplexity: %w", err)
+							}
+
+							config.Provenance.Quantization.Perplexity = &api.QuantizationPerplexity{From: from, To: to, Tokens: tokens}
+							fn(api.ProgressResponse{Status: fmt.Sprintf("perplexity %.3f to %.3f (%+.1f%%)", from, to, 100*(to/from-1))})
+						}
 					}
 				}
 
+				if baseLayer.GGML != nil && baseLayer.MediaType == "application/vnd.ollama.image.model" {
+					baseKV = baseLayer.GGML.KV()
+					config.Provenance.Source = cmp.Or(modelSource(baseKV), config.Provenance.Source)
+				}
+
 				if baseLayer.GGML != nil {
 					config.ModelFormat = cmp.Or(config.ModelFormat, baseLayer.GGML.Name())
 					config.ModelFamily = cmp.Or(config.ModelFamily, baseLayer.GGML.KV().Architecture())
@@ -489,6 +610,79 @@ func CreateModel(ctx context.Context, name model.Name, modelFileDir, quantizatio
 
 				layers = append(layers, baseLayer.Layer)
 			}
+		case "softprompt", "head":
+			blobpath := realpath(modelFileDir, c.Args)
+			if digest, ok := strings.CutPrefix(c.Args, "@"); ok {
+				if blobpath, err = GetBlobsPath(digest); err != nil {
+					return err
+				}
+			}
+
+			file, err := os.Open(blobpath)
+			if err != nil {
+				return err
+			}
+			defer file.Close()
+
+			if command == "head" {
+				layer, err := headLayer(file, baseKV)
+				if err != nil {
+					return err
+				}
+
+				layers = append(layers, layer)
+				break
+			}
+
+			layer, err := softPromptLayer(file, baseKV)
+			if err != nil {
+				return err
+			}
+
+			// replace
+			layers = slices.DeleteFunc(layers, func(l Layer) bool {
+				return l.MediaType == layer.MediaType
+			})
+
+			layers = append(layers, layer)
+		case "tokenizer":
+			i := slices.IndexFunc(layers, func(l Layer) bool {
+				return l.MediaType == "application/vnd.ollama.image.model"
+			})
+			if i < 0 {
+				return fmt.Errorf("%w: TOKENIZER requires a model", errBadTokenizer)
+			}
+
+			blobpath, digest := realpath(modelFileDir, c.Args), ""
+			if d, ok := strings.CutPrefix(c.Args, "@"); ok {
+				if blobpath, err = GetBlobsPath(d); err != nil {
+					return err
+				}
+
+				digest = d
+			}
+
+			file, err := os.Open(blobpath)
+			if err != nil {
+				return err
+			}
+			defer file.Close()
+
+			fn(api.ProgressResponse{Status: "replacing tokenizer"})
+			layer, ggml, err := tokenizerLayer(file, layers[i])
+			if err != nil {
+				return err
+			}
+
+			parent, err := parentFile(command, digest, file, false)
+			if err != nil {
+				return err
+			}
+
+			config.Provenance.Parents = append(config.Provenance.Parents, parent)
+
+			layers[i] = layer
+			baseKV = ggml.KV()
 		case "license", "template", "system":
 			if c.Name == "template" {
 				if _, err := template.Parse(c.Args); err != nil {
@@ -518,6 +712,16 @@ func CreateModel(ctx context.Context, name model.Name, modelFileDir, quantizatio
 			}
 
 			layers = append(layers, layer)
+		case "label":
+			k, v, ok := strings.Cut(c.Args, "=")
+			if !ok || k == "" {
+				return fmt.Errorf("invalid label: %s", c.Args)
+			}
+
+			if config.Labels == nil {
+				config.Labels = make(map[string]string)
+			}
+			config.Labels[k] = v
 		case "message":
 			role, content, ok := strings.Cut(c.Args, ": ")
 			if !ok {
@@ -531,9 +735,17 @@ func CreateModel(ctx context.Context, name model.Name, modelFileDir, quantizatio
 				return err
 			}
 
+			if c.Name == "processor" {
+				if _, err := parseProcessors([]string{c.Args}); err != nil {
+					return err
+				}
+			}
+
 			for k, v := range ps {
 				if ks, ok := parameters[k].([]string); ok {
 					parameters[k] = append(ks, v.([]string)...)
+				} else if m, ok := parameters[k].(map[string]interface{}); ok {
+					maps.Copy(m, v.(map[string]interface{}))
 				} else if vs, ok := v.([]string); ok {
 					parameters[k] = vs
 				} else {
@@ -619,6 +831,12 @@ func CreateModel(ctx context.Context, name model.Name, modelFileDir, quantizatio
 
 	config.RootFS.DiffIDs = digests
 
+	if regOpts.checkConfig != nil {
+		if err := regOpts.checkConfig(name, config); err != nil {
+			return err
+		}
+	}
+
 	var b bytes.Buffer
 	if err := json.NewEncoder(&b).Encode(config); err != nil {
 		return err
@@ -635,6 +853,12 @@ func CreateModel(ctx context.Context, name model.Name, modelFileDir, quantizatio
 		}
 	}
 
+	if regOpts.checkLayers != nil {
+		if err := regOpts.checkLayers(name, append(layers, configLayer)); err != nil {
+			return err
+		}
+	}
+
 	old, _ := ParseNamedManifest(name)
 
 	fn(api.ProgressResponse{Status: "writing manifest"})
@@ -642,6 +866,13 @@ func CreateModel(ctx context.Context, name model.Name, modelFileDir, quantizatio
 		return err
 	}
 
+	if regOpts.added != nil {
+		if err := regOpts.added(name); err != nil {
+			return err
+		}
+	}
+
+	unlock()
 	if !envconfig.NoPrune() && old != nil {
 		if err := old.RemoveLayers(); err != nil {
 			return err
@@ -669,29 +900,38 @@ func CopyModel(src, dst model.Name) error {
 		return err
 	}
 
-	dstpath := filepath.Join(manifests, dst.Filepath())
-	if err := os.MkdirAll(filepath.Dir(dstpath), 0o755); err != nil {
+	unlock, err := lockStore(false, true)
+	if err != nil {
 		return err
 	}
+	defer unlock()
 
-	srcpath := filepath.Join(manifests, src.Filepath())
-	srcfile, err := os.Open(srcpath)
+	b, err := os.ReadFile(filepath.Join(manifests, src.Filepath()))
 	if err != nil {
 		return err
 	}
-	defer srcfile.Close()
 
-	dstfile, err := os.Create(dstpath)
-	if err != nil {
+	return writeManifestFile(filepath.Join(manifests, dst.Filepath()), b)
+}
+
+// deleteUnusedLayers removes the blobs in deleteMap that no manifest uses. It
+// skips removing them if the model store is in use, leaving them for a later
+// prune.
+func deleteUnusedLayers(deleteMap map[string]struct{}) error {
+	unlock, err := lockStore(true, false)
+	if errors.Is(err, errStoreBusy) {
+		slog.Info("model store is in use, skipping removing unused layers")
+		clear(deleteMap)
+		return nil
+	} else if err != nil {
 		return err
 	}
-	defer dstfile.Close()
+	defer unlock()
 
-	_, err = io.Copy(dstfile, srcfile)
-	return err
+	return removeUnusedLayers(deleteMap)
 }
 
-func deleteUnusedLayers(deleteMap map[string]struct{}) error {
+func removeUnusedLayers(deleteMap map[string]struct{}) error {
 	// Ignore corrupt manifests to avoid blocking deletion of layers that are freshly orphaned
 	manifests, err := Manifests(true)
 	if err != nil {
@@ -717,12 +957,26 @@ func deleteUnusedLayers(deleteMap map[string]struct{}) error {
 			slog.Info(fmt.Sprintf("couldn't remove file '%s': %v", fp, err))
 			continue
 		}
+
+		checkedBlobs.Delete(k)
+		if err := os.Remove(sampledDigestPath(k)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			slog.Info(fmt.Sprintf("couldn't remove file '%s': %v", sampledDigestPath(k), err))
+		}
 	}
 
 	return nil
 }
 
 func PruneLayers() error {
+	unlock, err := lockStore(true, false)
+	if errors.Is(err, errStoreBusy) {
+		slog.Info("model store is in use, skipping pruning unused layers")
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer unlock()
+
 	deleteMap := make(map[string]struct{})
 	p, err := GetBlobsPath("")
 	if err != nil {
@@ -756,7 +1010,7 @@ func PruneLayers() error {
 
 	slog.Info(fmt.Sprintf("total blobs: %d", len(deleteMap)))
 
-	if err := deleteUnusedLayers(deleteMap); err != nil {
+	if err := removeUnusedLayers(deleteMap); err != nil {
 		slog.Error(fmt.Sprintf("couldn't remove unused layers: %v", err))
 		return nil
 	}
@@ -821,7 +1075,7 @@ func PushModel(ctx context.Context, name string, regOpts *registryOptions, fn fu
 
 	for _, layer := range layers {
 		if err := uploadBlob(ctx, mp, layer, regOpts, fn); err != nil {
-			slog.Info(fmt.Sprintf("error uploading blob: %v", err))
+			slog.InfoContext(ctx, fmt.Sprintf("error uploading blob: %v", err))
 			return err
 		}
 	}
@@ -851,13 +1105,19 @@ func PushModel(ctx context.Context, name string, regOpts *registryOptions, fn fu
 func PullModel(ctx context.Context, name string, regOpts *registryOptions, fn func(api.ProgressResponse)) error {
 	mp := ParseModelPath(name)
 
+	unlock, err := lockStore(false, true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
 	// build deleteMap to prune unused layers
 	deleteMap := make(map[string]struct{})
 	manifest, _, err := GetManifest(mp)
 	if errors.Is(err, os.ErrNotExist) {
 		// noop
 	} else if err != nil {
-		slog.Warn("pulling model with bad existing manifest", "name", name, "error", err)
+		slog.WarnContext(ctx, "pulling model with bad existing manifest", "name", name, "error", err)
 	} else {
 		for _, l := range manifest.Layers {
 			deleteMap[l.Digest] = struct{}{}
@@ -879,13 +1139,23 @@ func PullModel(ctx context.Context, name string, regOpts *registryOptions, fn fu
 	}
 
 	var layers []Layer
-	layers = append(layers, manifest.Layers...)
 	if manifest.Config.Digest != "" {
+		// the config is pulled first so the model can be checked before
+		// its weights are downloaded
 		layers = append(layers, manifest.Config)
 	}
+	layers = append(layers, manifest.Layers...)
+
+	if regOpts.checkLayers != nil {
+		if err := regOpts.checkLayers(model.ParseName(name), layers); err != nil {
+			return err
+		}
+	}
 
 	skipVerify := make(map[string]bool)
 	for _, layer := range layers {
+		repairBlob(ctx, layer)
+
 		cacheHit, err := downloadBlob(ctx, downloadOpts{
 			mp:      mp,
 			digest:  layer.Digest,
@@ -897,6 +1167,12 @@ func PullModel(ctx context.Context, name string, regOpts *registryOptions, fn fu
 		}
 		skipVerify[layer.Digest] = cacheHit
 		delete(deleteMap, layer.Digest)
+
+		if layer.Digest == manifest.Config.Digest && regOpts.checkConfig != nil {
+			if err := checkPulledConfig(model.ParseName(name), layer, regOpts.checkConfig); err != nil {
+				return err
+			}
+		}
 	}
 	delete(deleteMap, manifest.Config.Digest)
 
@@ -905,8 +1181,12 @@ func PullModel(ctx context.Context, name string, regOpts *registryOptions, fn fu
 		if skipVerify[layer.Digest] {
 			continue
 		}
-		if err := verifyBlob(layer.Digest); err != nil {
-			if errors.Is(err, errDigestMismatch) {
+		err := verifyBlob(layer.Digest)
+		if err == nil {
+			err = verifyWeights(layer)
+		}
+		if err != nil {
+			if errors.Is(err, errDigestMismatch) || errors.Is(err, llm.ErrInvalidGGUF) {
 				// something went wrong, delete the blob
 				fp, err := GetBlobsPath(layer.Digest)
 				if err != nil {
@@ -914,11 +1194,15 @@ func PullModel(ctx context.Context, name string, regOpts *registryOptions, fn fu
 				}
 				if err := os.Remove(fp); err != nil {
 					// log this, but return the original error
-					slog.Info(fmt.Sprintf("couldn't remove file with digest mismatch '%s': %v", fp, err))
+					slog.InfoContext(ctx, fmt.Sprintf("couldn't remove invalid file '%s': %v", fp, err))
 				}
 			}
 			return err
 		}
+
+		if err := recordBlob(layer.Digest); err != nil {
+			slog.WarnContext(ctx, "couldn't record sampled digest", "digest", layer.Digest, "error", err)
+		}
 	}
 
 	fn(api.ProgressResponse{Status: "writing manifest"})
@@ -932,16 +1216,21 @@ func PullModel(ctx context.Context, name string, regOpts *registryOptions, fn fu
 	if err != nil {
 		return err
 	}
-	if err := os.MkdirAll(filepath.Dir(fp), 0o755); err != nil {
-		return err
-	}
 
-	err = os.WriteFile(fp, manifestJSON, 0o644)
+	err = writeManifestFile(fp, manifestJSON)
 	if err != nil {
-		slog.Info(fmt.Sprintf("couldn't write to %s", fp))
+		slog.InfoContext(ctx, fmt.Sprintf("couldn't write to %s", fp))
 		return err
 	}
 
+	if regOpts.added != nil {
+		if err := regOpts.added(model.ParseName(name)); err != nil {
+			return err
+		}
+	}
+
+	unlock()
+
 	if !envconfig.NoPrune() && len(deleteMap) > 0 {
 		fn(api.ProgressResponse{Status: "removing unused layers"})
 		if err := deleteUnusedLayers(deleteMap); err != nil {
@@ -991,7 +1280,7 @@ func makeRequestWithRetry(ctx context.Context, method string, requestURL *url.UR
 		resp, err := makeRequest(ctx, method, requestURL, headers, body, regOpts)
 		if err != nil {
 			if !errors.Is(err, context.Canceled) {
-				slog.Info(fmt.Sprintf("request failed: %v", err))
+				slog.InfoContext(ctx, fmt.Sprintf("request failed: %v", err))
 			}
 
 			return nil, err
@@ -1145,3 +1434,33 @@ func verifyBlob(digest string) error {
 
 	return nil
 }
+
+// verifyWeights strictly decodes the model, projector and adapter layers, so
+// malformed files are rejected when they're pulled rather than when they're
+// loaded by the runner
+func verifyWeights(layer Layer) error {
+	switch layer.MediaType {
+	case "application/vnd.ollama.image.model", "application/vnd.ollama.image.projector", "application/vnd.ollama.image.adapter":
+	default:
+		return nil
+	}
+
+	fp, err := GetBlobsPath(layer.Digest)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Open(fp)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if _, _, err := llm.DecodeGGMLStrict(f, 0); errors.Is(err, llm.ErrInvalidGGUF) {
+		return fmt.Errorf("%s: %w", layer.Digest, err)
+	} else if err != nil {
+		slog.Warn("couldn't decode layer", "digest", layer.Digest, "error", err)
+	}
+
+	return nil
+}
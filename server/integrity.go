@@ -0,0 +1,296 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ollama/ollama/envconfig"
+)
+
+var errModelCorrupted = errors.New("model corrupted")
+
+const (
+	// blob samples are evenly spaced chunks of a blob hashed for its sampled
+	// digest, which is much faster to compute than the full digest of a
+	// blob several gigabytes in size
+	blobSamples    = 64
+	blobSampleSize = 64 << 10
+)
+
+type blobState struct {
+	size    int64
+	modTime time.Time
+}
+
+// checkedBlobs holds the state of each blob when it was last checked, so
+// blobs that haven't changed since aren't sampled again
+var checkedBlobs sync.Map
+
+// sampledDigest hashes the size of a blob along with evenly spaced chunks
+// of it, including its start and end
+func sampledDigest(f *os.File, size int64) (string, error) {
+	h := sha256.New()
+	fmt.Fprintf(h, "%d\x00", size)
+
+	buf := make([]byte, blobSampleSize)
+	for i := range int64(blobSamples) {
+		offset := max(size-blobSampleSize, 0) * i / (blobSamples - 1)
+		n, err := f.ReadAt(buf, offset)
+		if err != nil && !errors.Is(err, io.EOF) {
+			return "", err
+		}
+
+		h.Write(buf[:n])
+	}
+
+	return fmt.Sprintf("sha256:%x", h.Sum(nil)), nil
+}
+
+// sampledDigestPath returns the path the sampled digest of a blob is kept at
+func sampledDigestPath(digest string) string {
+	return filepath.Join(envconfig.Models(), "verified", strings.ReplaceAll(digest, ":", "-"))
+}
+
+// recordBlob records the sampled digest of a blob, which later checks
+// compare against
+func recordBlob(digest string) error {
+	fp, err := GetBlobsPath(digest)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Open(fp)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	sampled, err := sampledDigest(f, fi.Size())
+	if err != nil {
+		return err
+	}
+
+	p := sampledDigestPath(digest)
+	if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+		return err
+	}
+
+	if err := os.WriteFile(p, []byte(sampled), 0o644); err != nil {
+		return err
+	}
+
+	checkedBlobs.Store(digest, blobState{fi.Size(), fi.ModTime()})
+	return nil
+}
+
+// checkBlob checks that the blob of a layer has the size in the manifest,
+// and that its sampled digest matches the one recorded when it was pulled.
+// Blobs without a sampled digest, such as those from before they were
+// recorded, are hashed in full and checked against their digest first.
+func checkBlob(layer Layer) error {
+	fp, err := GetBlobsPath(layer.Digest)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Open(fp)
+	if errors.Is(err, os.ErrNotExist) {
+		return errors.New("is missing")
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	if fi.Size() != layer.Size {
+		return fmt.Errorf("is %d bytes, expected %d", fi.Size(), layer.Size)
+	}
+
+	if state, ok := checkedBlobs.Load(layer.Digest); ok && state == (blobState{fi.Size(), fi.ModTime()}) {
+		return nil
+	}
+
+	recorded, err := os.ReadFile(sampledDigestPath(layer.Digest))
+	if errors.Is(err, os.ErrNotExist) {
+		if err := verifyBlob(layer.Digest); errors.Is(err, errDigestMismatch) {
+			return errors.New("doesn't match its digest")
+		} else if err != nil {
+			return err
+		}
+
+		if envconfig.ReadOnly() {
+			checkedBlobs.Store(layer.Digest, blobState{fi.Size(), fi.ModTime()})
+			return nil
+		}
+
+		return recordBlob(layer.Digest)
+	} else if err != nil {
+		return err
+	}
+
+	sampled, err := sampledDigest(f, fi.Size())
+	if err != nil {
+		return err
+	}
+
+	if sampled != string(recorded) {
+		return errors.New("has changed since it was pulled")
+	}
+
+	checkedBlobs.Store(layer.Digest, blobState{fi.Size(), fi.ModTime()})
+	return nil
+}
+
+// repairBlob removes the blob of a layer that's about to be pulled if it no
+// longer passes its check, so it's downloaded again
+func repairBlob(ctx context.Context, layer Layer) {
+	fp, err := GetBlobsPath(layer.Digest)
+	if err != nil {
+		return
+	}
+
+	if _, err := os.Stat(fp); err != nil {
+		return
+	}
+
+	if err := checkBlob(layer); err != nil {
+		slog.InfoContext(ctx, "downloading corrupted blob again", "digest", layer.Digest, "error", err)
+		checkedBlobs.Delete(layer.Digest)
+		if err := os.Remove(fp); err != nil {
+			slog.WarnContext(ctx, "couldn't remove corrupted blob", "digest", layer.Digest, "error", err)
+		}
+	}
+}
+
+// manifestDigestPath returns the path the digest of the manifest at p is
+// kept at
+func manifestDigestPath(p string) (string, error) {
+	manifests, err := GetManifestPath()
+	if err != nil {
+		return "", err
+	}
+
+	rel, err := filepath.Rel(manifests, p)
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(envconfig.Models(), "verified", "manifests", rel), nil
+}
+
+// recordManifest records the digest of a manifest written to p, which later
+// checks compare against
+func recordManifest(p string, b []byte) error {
+	dp, err := manifestDigestPath(p)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(dp), 0o755); err != nil {
+		return err
+	}
+
+	return os.WriteFile(dp, []byte(fmt.Sprintf("%x", sha256.Sum256(b))), 0o644)
+}
+
+// writeManifestFile writes a manifest to p and records its digest
+func writeManifestFile(p string, b []byte) error {
+	if err := writeFileAtomic(p, b); err != nil {
+		return err
+	}
+
+	return recordManifest(p, b)
+}
+
+// checkManifest checks that the manifest of a model matches the digest
+// recorded when it was written. It returns false if none was recorded, for
+// manifests written before their digests were.
+func checkManifest(mp ModelPath, digest string) (bool, error) {
+	fp, err := mp.GetManifestPath()
+	if err != nil {
+		return false, err
+	}
+
+	dp, err := manifestDigestPath(fp)
+	if err != nil {
+		return false, err
+	}
+
+	recorded, err := os.ReadFile(dp)
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	if string(recorded) != digest {
+		return false, errors.New("manifest has changed since it was written")
+	}
+
+	return true, nil
+}
+
+// checkModelBlobs checks the manifest and the blobs of every layer of a
+// model before it's loaded, so a corrupted model fails with an error naming
+// the layer rather than partway through loading
+func checkModelBlobs(mp ModelPath) error {
+	manifest, digest, err := GetManifest(mp)
+	if err != nil {
+		return err
+	}
+
+	recorded, err := checkManifest(mp, digest)
+	if err != nil {
+		slog.Error("model manifest failed its integrity check", "model", mp.GetShortTagname(), "error", err)
+		return fmt.Errorf("%w: %v, run 'ollama pull %s' to repair it", errModelCorrupted, err, mp.GetShortTagname())
+	}
+
+	for _, layer := range append(manifest.Layers, manifest.Config) {
+		if layer.Digest == "" {
+			continue
+		}
+
+		if err := checkBlob(layer); err != nil {
+			slog.Error("model blob failed its integrity check", "model", mp.GetShortTagname(), "digest", layer.Digest, "error", err)
+			return fmt.Errorf("%w: layer %s %v, run 'ollama pull %s' to repair it", errModelCorrupted, layer.Digest, err, mp.GetShortTagname())
+		}
+	}
+
+	// every blob of a manifest from before digests were recorded matches
+	// its digest by now, so the manifest is recorded as it is
+	if !recorded && !envconfig.ReadOnly() {
+		fp, err := mp.GetManifestPath()
+		if err != nil {
+			return err
+		}
+
+		b, err := os.ReadFile(fp)
+		if err != nil {
+			return err
+		}
+
+		if err := recordManifest(fp, b); err != nil {
+			slog.Warn("couldn't record manifest digest", "model", mp.GetShortTagname(), "error", err)
+		}
+	}
+
+	return nil
+}
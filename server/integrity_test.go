@@ -0,0 +1,141 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/ollama/ollama/types/model"
+)
+
+func TestCheckBlob(t *testing.T) {
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+
+	data := make([]byte, 8*blobSampleSize)
+	layer, err := NewLayer(bytes.NewReader(data), "application/vnd.ollama.image.model")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config, err := NewLayer(bytes.NewReader([]byte("{}")), "application/vnd.docker.container.image.v1+json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := WriteManifest(model.ParseName("test"), config, []Layer{layer}); err != nil {
+		t.Fatal(err)
+	}
+
+	fp, err := GetBlobsPath(layer.Digest)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("recorded on first check", func(t *testing.T) {
+		if err := checkBlob(layer); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := os.Stat(sampledDigestPath(layer.Digest)); err != nil {
+			t.Fatalf("expected sampled digest to be recorded, got %v", err)
+		}
+	})
+
+	t.Run("not matching its digest", func(t *testing.T) {
+		other, err := NewLayer(bytes.NewReader([]byte("weights")), "application/vnd.ollama.image.model")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		p, err := GetBlobsPath(other.Digest)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// replaced before its sampled digest was recorded
+		if err := os.WriteFile(p, []byte("WEIGHTS"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := checkBlob(other); err == nil {
+			t.Fatal("expected error for a blob not matching its digest")
+		}
+
+		if _, err := os.Stat(sampledDigestPath(other.Digest)); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("expected no sampled digest to be recorded, got %v", err)
+		}
+	})
+
+	t.Run("manifest changed", func(t *testing.T) {
+		mp := ParseModelPath("test")
+		p, err := mp.GetManifestPath()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		b, err := os.ReadFile(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := checkModelBlobs(mp); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := os.WriteFile(p, append(b, ' '), 0o644); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := checkModelBlobs(mp); !errors.Is(err, errModelCorrupted) {
+			t.Fatalf("expected %v, got %v", errModelCorrupted, err)
+		}
+
+		if err := os.WriteFile(p, b, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("wrong size", func(t *testing.T) {
+		wrong := layer
+		wrong.Size++
+		if err := checkBlob(wrong); err == nil {
+			t.Fatal("expected error for a blob of the wrong size")
+		}
+	})
+
+	t.Run("changed", func(t *testing.T) {
+		f, err := os.OpenFile(fp, os.O_WRONLY, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// the last chunk is always sampled
+		if _, err := f.WriteAt([]byte{1}, int64(len(data))-1); err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+
+		later := time.Now().Add(time.Minute)
+		if err := os.Chtimes(fp, later, later); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := checkBlob(layer); err == nil {
+			t.Fatal("expected error for a changed blob")
+		}
+
+		if err := checkModelBlobs(ParseModelPath("test")); !errors.Is(err, errModelCorrupted) {
+			t.Fatalf("expected %v, got %v", errModelCorrupted, err)
+		}
+	})
+
+	t.Run("repaired", func(t *testing.T) {
+		repairBlob(context.Background(), layer)
+		if _, err := os.Stat(fp); !errors.Is(err, os.ErrNotExist) {
+			t.Fatalf("expected corrupted blob to be removed, got %v", err)
+		}
+	})
+}
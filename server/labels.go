@@ -0,0 +1,78 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"maps"
+	"strings"
+
+	"github.com/ollama/ollama/types/model"
+)
+
+// setModelLabels merges labels into the labels of the named model, removing
+// any label with an empty value, and rewrites its config and manifest
+func setModelLabels(name model.Name, labels map[string]string) (map[string]string, error) {
+	m, err := ParseNamedManifest(name)
+	if err != nil {
+		return nil, err
+	}
+
+	var config ConfigV2
+	if m.Config.Digest != "" {
+		f, err := m.Config.Open()
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+
+		if err := json.NewDecoder(f).Decode(&config); err != nil {
+			return nil, err
+		}
+	}
+
+	if config.Labels == nil {
+		config.Labels = make(map[string]string)
+	}
+
+	for k, v := range labels {
+		if v == "" {
+			delete(config.Labels, k)
+		} else {
+			config.Labels[k] = v
+		}
+	}
+
+	if len(config.Labels) == 0 {
+		config.Labels = nil
+	}
+
+	var b bytes.Buffer
+	if err := json.NewEncoder(&b).Encode(config); err != nil {
+		return nil, err
+	}
+
+	layer, err := NewLayer(&b, "application/vnd.docker.container.image.v1+json")
+	if err != nil {
+		return nil, err
+	}
+
+	if err := WriteManifest(name, layer, m.Layers); err != nil {
+		return nil, err
+	}
+
+	return maps.Clone(config.Labels), nil
+}
+
+// matchLabels reports whether labels satisfy every selector. A selector is
+// either "key=value", matching a label with that value, or "key", matching
+// any label with that key.
+func matchLabels(labels map[string]string, selectors []string) bool {
+	for _, selector := range selectors {
+		k, v, hasValue := strings.Cut(selector, "=")
+		if got, ok := labels[k]; !ok || (hasValue && got != v) {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,175 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/sync/semaphore"
+
+	"github.com/ollama/ollama/envconfig"
+)
+
+const (
+	classCompletion = "completion"
+	classEmbedding  = "embedding"
+	classManagement = "management"
+)
+
+// endpointClasses are the classes with independent limits, so that a burst
+// of one kind of request can't starve the others
+var endpointClasses = []string{classCompletion, classEmbedding, classManagement}
+
+// routeClasses maps routes to their class. Other routes aren't limited.
+var routeClasses = map[string]string{
+	"/api/generate":        classCompletion,
+	"/api/chat":            classCompletion,
+	"/v1/chat/completions": classCompletion,
+	"/v1/completions":      classCompletion,
+	"/api/embed":           classEmbedding,
+	"/api/embeddings":      classEmbedding,
+	"/api/reward":          classEmbedding,
+	"/v1/embeddings":       classEmbedding,
+	"/api/pull":            classManagement,
+	"/api/push":            classManagement,
+	"/api/create":          classManagement,
+	"/api/copy":            classManagement,
+	"/api/delete":          classManagement,
+	"/api/blobs/:digest":   classManagement,
+}
+
+// classLimit limits how many requests of a class run at once and how many
+// more wait to run
+type classLimit struct {
+	// sem is nil if the class is unlimited
+	sem   *semaphore.Weighted
+	queue int64
+
+	running  atomic.Int64
+	queued   atomic.Int64
+	requests atomic.Uint64
+	rejected atomic.Uint64
+
+	// waited is the total time requests have waited to run in nanoseconds
+	waited atomic.Int64
+}
+
+type endpointLimits struct {
+	classes map[string]*classLimit
+}
+
+// parseEndpointLimits parses limits from a comma separated list such as
+// "completion=4/16,embedding=2", where each class runs up to the first number
+// of requests at once and queues up to the second, or OLLAMA_MAX_QUEUE if
+// it's omitted. Classes which aren't listed are unlimited.
+func parseEndpointLimits(s string) (*endpointLimits, error) {
+	l := endpointLimits{classes: make(map[string]*classLimit)}
+	for _, class := range endpointClasses {
+		l.classes[class] = &classLimit{}
+	}
+
+	for _, limit := range strings.Split(s, ",") {
+		limit = strings.TrimSpace(limit)
+		if limit == "" {
+			continue
+		}
+
+		class, value, ok := strings.Cut(limit, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid limit %q, expected class=concurrency[/queue]", limit)
+		}
+
+		cl, ok := l.classes[class]
+		if !ok {
+			return nil, fmt.Errorf("unknown class %q, expected one of %s", class, strings.Join(endpointClasses, ", "))
+		}
+
+		concurrency, queue, hasQueue := strings.Cut(value, "/")
+		n, err := strconv.Atoi(concurrency)
+		if err != nil || n <= 0 {
+			return nil, fmt.Errorf("invalid concurrency %q for %s", concurrency, class)
+		}
+
+		cl.sem = semaphore.NewWeighted(int64(n))
+		cl.queue = int64(envconfig.MaxQueue())
+		if hasQueue {
+			if cl.queue, err = strconv.ParseInt(queue, 10, 64); err != nil || cl.queue < 0 {
+				return nil, fmt.Errorf("invalid queue %q for %s", queue, class)
+			}
+		}
+	}
+
+	return &l, nil
+}
+
+// limitMiddleware holds requests to limited routes until their class has
+// capacity, refusing them if too many are already waiting
+func limitMiddleware(l *endpointLimits) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		cl, ok := l.classes[routeClasses[c.FullPath()]]
+		if !ok {
+			c.Next()
+			return
+		}
+
+		cl.requests.Add(1)
+		if cl.sem != nil {
+			if !cl.sem.TryAcquire(1) {
+				if cl.queued.Add(1) > cl.queue {
+					cl.queued.Add(-1)
+					cl.rejected.Add(1)
+					c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{"error": ErrMaxQueue.Error()})
+					return
+				}
+
+				start := time.Now()
+				err := cl.sem.Acquire(c.Request.Context(), 1)
+				cl.queued.Add(-1)
+				cl.waited.Add(int64(time.Since(start)))
+				if err != nil {
+					c.AbortWithStatusJSON(499, gin.H{"error": "request canceled"})
+					return
+				}
+			}
+
+			defer cl.sem.Release(1)
+		}
+
+		cl.running.Add(1)
+		defer cl.running.Add(-1)
+
+		c.Next()
+	}
+}
+
+// writeMetrics writes the state of each class in the Prometheus text
+// exposition format
+func (l *endpointLimits) writeMetrics(sb *strings.Builder) {
+	metric := func(name, typ, help string, value func(*classLimit) string) {
+		fmt.Fprintf(sb, "# HELP %s %s\n", name, help)
+		fmt.Fprintf(sb, "# TYPE %s %s\n", name, typ)
+		for _, class := range endpointClasses {
+			fmt.Fprintf(sb, "%s{class=%q} %s\n", name, class, value(l.classes[class]))
+		}
+	}
+
+	metric("ollama_class_requests_total", "counter", "Requests received by endpoint class.", func(cl *classLimit) string {
+		return fmt.Sprint(cl.requests.Load())
+	})
+	metric("ollama_class_rejected_total", "counter", "Requests refused because the queue of their endpoint class was full.", func(cl *classLimit) string {
+		return fmt.Sprint(cl.rejected.Load())
+	})
+	metric("ollama_class_running", "gauge", "Requests running by endpoint class.", func(cl *classLimit) string {
+		return fmt.Sprint(cl.running.Load())
+	})
+	metric("ollama_class_queued", "gauge", "Requests waiting to run by endpoint class.", func(cl *classLimit) string {
+		return fmt.Sprint(cl.queued.Load())
+	})
+	metric("ollama_class_wait_seconds_total", "counter", "Time requests have waited to run by endpoint class.", func(cl *classLimit) string {
+		return fmt.Sprintf("%g", time.Duration(cl.waited.Load()).Seconds())
+	})
+}
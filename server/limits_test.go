@@ -0,0 +1,121 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestParseEndpointLimits(t *testing.T) {
+	t.Setenv("OLLAMA_MAX_QUEUE", "8")
+
+	l, err := parseEndpointLimits("completion=4/16, embedding=2")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cl := l.classes[classCompletion]; cl.sem == nil || cl.queue != 16 {
+		t.Errorf("completion: expected a limit with a queue of 16, got %v", cl.queue)
+	}
+
+	if cl := l.classes[classEmbedding]; cl.sem == nil || cl.queue != 8 {
+		t.Errorf("embedding: expected a limit with the default queue of 8, got %v", cl.queue)
+	}
+
+	if cl := l.classes[classManagement]; cl.sem != nil {
+		t.Error("management: expected no limit")
+	}
+
+	for _, s := range []string{"completion", "chat=1", "completion=0", "completion=x", "completion=1/-1", "completion=1/x"} {
+		if _, err := parseEndpointLimits(s); err == nil {
+			t.Errorf("%q: expected error", s)
+		}
+	}
+}
+
+func TestLimitMiddleware(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	l, err := parseEndpointLimits("completion=1/1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	release := make(chan struct{})
+	r := gin.New()
+	r.Use(limitMiddleware(l))
+	r.POST("/api/generate", func(c *gin.Context) {
+		<-release
+		c.Status(http.StatusOK)
+	})
+	r.POST("/api/embed", func(c *gin.Context) {
+		c.Status(http.StatusOK)
+	})
+
+	serve := func(path string) chan int {
+		ch := make(chan int, 1)
+		go func() {
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, path, nil))
+			ch <- w.Code
+		}()
+
+		return ch
+	}
+
+	wait := func(fn func() bool) {
+		t.Helper()
+		for range 100 {
+			if fn() {
+				return
+			}
+
+			time.Sleep(10 * time.Millisecond)
+		}
+
+		t.Fatal("timed out")
+	}
+
+	cl := l.classes[classCompletion]
+
+	// the first request runs and the second waits for it
+	first := serve("/api/generate")
+	wait(func() bool { return cl.running.Load() == 1 })
+	second := serve("/api/generate")
+	wait(func() bool { return cl.queued.Load() == 1 })
+
+	// the queue is full
+	if code := <-serve("/api/generate"); code != http.StatusServiceUnavailable {
+		t.Errorf("expected status 503, got %d", code)
+	}
+
+	// other classes aren't affected
+	if code := <-serve("/api/embed"); code != http.StatusOK {
+		t.Errorf("expected status 200, got %d", code)
+	}
+
+	close(release)
+	for _, ch := range []chan int{first, second} {
+		if code := <-ch; code != http.StatusOK {
+			t.Errorf("expected status 200, got %d", code)
+		}
+	}
+
+	var sb strings.Builder
+	l.writeMetrics(&sb)
+	for _, expect := range []string{
+		`ollama_class_requests_total{class="completion"} 3`,
+		`ollama_class_rejected_total{class="completion"} 1`,
+		`ollama_class_requests_total{class="embedding"} 1`,
+		`ollama_class_running{class="completion"} 0`,
+		`ollama_class_queued{class="completion"} 0`,
+	} {
+		if !strings.Contains(sb.String(), expect+"\n") {
+			t.Errorf("expected metrics to contain %q, got:\n%s", expect, sb.String())
+		}
+	}
+}
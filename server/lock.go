@@ -0,0 +1,69 @@
+package server
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/ollama/ollama/envconfig"
+)
+
+var errStoreBusy = errors.New("model store is in use")
+
+// storeMu locks the model store within this process. Locks on files can be
+// held per process rather than per file, such as on network filesystems, so
+// they don't keep out other goroutines.
+var storeMu sync.RWMutex
+
+// lockStore locks the model store against other processes sharing it, such
+// as the app and a server run from the command line, or servers sharing it
+// on a network filesystem. Pulls, creates and copies hold it shared while
+// they write blobs and manifests, and removing unused blobs holds it
+// exclusively, so it can't remove the blobs of a model that doesn't have a
+// manifest yet. Without wait, it fails with errStoreBusy rather than waiting
+// for the lock. unlock can be called more than once.
+func lockStore(exclusive, wait bool) (unlock func(), _ error) {
+	switch {
+	case exclusive && wait:
+		storeMu.Lock()
+	case exclusive:
+		if !storeMu.TryLock() {
+			return nil, errStoreBusy
+		}
+	case wait:
+		storeMu.RLock()
+	default:
+		if !storeMu.TryRLock() {
+			return nil, errStoreBusy
+		}
+	}
+
+	unlockMu := storeMu.RUnlock
+	if exclusive {
+		unlockMu = storeMu.Unlock
+	}
+
+	if err := os.MkdirAll(envconfig.Models(), 0o755); err != nil {
+		unlockMu()
+		return nil, err
+	}
+
+	f, err := os.OpenFile(filepath.Join(envconfig.Models(), ".lock"), os.O_CREATE|os.O_RDWR, 0o644)
+	if err != nil {
+		unlockMu()
+		return nil, err
+	}
+
+	if err := lockFile(f, exclusive, wait); err != nil {
+		f.Close()
+		unlockMu()
+		return nil, err
+	}
+
+	return sync.OnceFunc(func() {
+		// closing the file releases its lock
+		f.Close()
+		unlockMu()
+	}), nil
+}
@@ -0,0 +1,118 @@
+package server
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestLockStore(t *testing.T) {
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+
+	unlock, err := lockStore(false, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	shared, err := lockStore(false, false)
+	if err != nil {
+		t.Fatalf("shared lock while shared: %v", err)
+	}
+	shared()
+
+	if _, err := lockStore(true, false); !errors.Is(err, errStoreBusy) {
+		t.Fatalf("expected %v, got %v", errStoreBusy, err)
+	}
+
+	unlock()
+	// unlocking again is a no-op
+	unlock()
+
+	exclusive, err := lockStore(true, false)
+	if err != nil {
+		t.Fatalf("exclusive lock after unlock: %v", err)
+	}
+
+	if _, err := lockStore(false, false); !errors.Is(err, errStoreBusy) {
+		t.Fatalf("expected %v, got %v", errStoreBusy, err)
+	}
+
+	exclusive()
+}
+
+func TestDeleteUnusedLayersBusy(t *testing.T) {
+	p := t.TempDir()
+	t.Setenv("OLLAMA_MODELS", p)
+
+	digest := "sha256:e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+	blob, err := GetBlobsPath(digest)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(blob, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	unlock, err := lockStore(false, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a pull is in progress, so the blob may be about to be used
+	if err := deleteUnusedLayers(map[string]struct{}{digest: {}}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(blob); err != nil {
+		t.Fatalf("expected blob to be kept: %v", err)
+	}
+
+	unlock()
+
+	if err := deleteUnusedLayers(map[string]struct{}{digest: {}}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(blob); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("expected blob to be removed, got %v", err)
+	}
+}
+
+func TestWriteFileAtomic(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "manifests", "library", "test", "latest")
+
+	if err := writeFileAtomic(p, []byte("old\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := writeFileAtomic(p, []byte("new\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := os.ReadFile(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if diff := cmp.Diff(string(b), "new\n"); diff != "" {
+		t.Errorf("mismatch (-got +want):\n%s", diff)
+	}
+
+	entries, err := os.ReadDir(filepath.Dir(p))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+
+	if diff := cmp.Diff(names, []string{"latest"}); diff != "" {
+		t.Errorf("temporary files left behind (-got +want):\n%s", diff)
+	}
+}
@@ -0,0 +1,123 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/logutil"
+)
+
+const requestIDHeader = "X-Request-Id"
+
+// requestIDMiddleware gives each request an ID, the client's if it sent a
+// valid one, which is returned in the response and added to everything logged
+// while handling the request
+func requestIDMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := c.GetHeader(requestIDHeader)
+		if !validRequestID(id) {
+			id = newRequestID()
+		}
+
+		c.Header(requestIDHeader, id)
+		c.Request = c.Request.WithContext(logutil.WithRequestID(c.Request.Context(), id))
+		c.Next()
+	}
+}
+
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 64 {
+		return false
+	}
+
+	for _, r := range id {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_' || r == '.') {
+			return false
+		}
+	}
+
+	return true
+}
+
+func newRequestID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "unknown"
+	}
+
+	return hex.EncodeToString(b)
+}
+
+func logResponse(c logutil.Config) api.LogResponse {
+	resp := api.LogResponse{Level: c.Level.String(), Subsystems: make(map[string]string)}
+	for _, name := range logutil.Subsystems {
+		resp.Subsystems[name] = c.For(name).String()
+	}
+
+	return resp
+}
+
+func (s *Server) LogHandler(c *gin.Context) {
+	c.JSON(http.StatusOK, logResponse(logutil.Current()))
+}
+
+func (s *Server) SetLogHandler(c *gin.Context) {
+	if !isLocalRequest(c.Request) {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "log levels can only be changed by local clients"})
+		return
+	}
+
+	var r api.LogRequest
+	if err := c.ShouldBindJSON(&r); errors.Is(err, io.EOF) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "missing request body"})
+		return
+	} else if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	levels := logutil.Current()
+	if r.Level != "" {
+		level, err := logutil.ParseLevel(r.Level)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		levels.Level = level
+	}
+
+	if levels.Subsystems == nil {
+		levels.Subsystems = make(map[string]slog.Level)
+	}
+
+	for name, value := range r.Subsystems {
+		if value == "" {
+			delete(levels.Subsystems, name)
+			continue
+		}
+
+		level, err := logutil.ParseLevel(value)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		levels.Subsystems[name] = level
+	}
+
+	if err := logutil.Set(levels); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	slog.InfoContext(c.Request.Context(), "log levels changed", "levels", levels)
+	s.LogHandler(c)
+}
@@ -0,0 +1,122 @@
+package server
+
+import (
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/ollama/ollama/logutil"
+)
+
+func TestLogHandler(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	prev := logutil.Current()
+	t.Cleanup(func() { logutil.Set(prev) })
+
+	if err := logutil.Set(logutil.Config{Level: slog.LevelInfo}); err != nil {
+		t.Fatal(err)
+	}
+
+	var s Server
+	router := s.GenerateRoutes()
+
+	request := func(method, body, remote string) *httptest.ResponseRecorder {
+		t.Helper()
+
+		r := httptest.NewRequest(method, "/api/log", strings.NewReader(body))
+		r.RemoteAddr = remote
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		return w
+	}
+
+	t.Run("remote", func(t *testing.T) {
+		w := request(http.MethodPost, `{"level":"debug"}`, "192.0.2.1:1234")
+		if w.Code != http.StatusForbidden {
+			t.Fatalf("expected status code 403, actual %d", w.Code)
+		}
+	})
+
+	t.Run("set", func(t *testing.T) {
+		w := request(http.MethodPost, `{"level":"warn","subsystems":{"scheduler":"debug","registry":"error"}}`, "127.0.0.1:1234")
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status code 200, actual %d: %s", w.Code, w.Body.String())
+		}
+
+		if diff := cmp.Diff(w.Body.String(), `{"level":"WARN","subsystems":{"ml":"WARN","registry":"ERROR","runner":"WARN","scheduler":"DEBUG","server":"WARN"}}`); diff != "" {
+			t.Errorf("mismatch (-got +want):\n%s", diff)
+		}
+	})
+
+	t.Run("reset", func(t *testing.T) {
+		w := request(http.MethodPost, `{"subsystems":{"registry":""}}`, "127.0.0.1:1234")
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status code 200, actual %d: %s", w.Code, w.Body.String())
+		}
+
+		w = request(http.MethodGet, "", "192.0.2.1:1234")
+		if diff := cmp.Diff(w.Body.String(), `{"level":"WARN","subsystems":{"ml":"WARN","registry":"WARN","runner":"WARN","scheduler":"DEBUG","server":"WARN"}}`); diff != "" {
+			t.Errorf("mismatch (-got +want):\n%s", diff)
+		}
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		for _, body := range []string{`{"level":"loud"}`, `{"subsystems":{"gpu":"debug"}}`, `{"subsystems":{"runner":"loud"}}`} {
+			if w := request(http.MethodPost, body, "127.0.0.1:1234"); w.Code != http.StatusBadRequest {
+				t.Errorf("%s: expected status code 400, actual %d", body, w.Code)
+			}
+		}
+
+		if !logutil.Enabled(logutil.Scheduler, slog.LevelDebug) || logutil.Enabled(logutil.Runner, slog.LevelInfo) {
+			t.Errorf("levels changed by invalid requests: %v", logutil.Current())
+		}
+	})
+}
+
+func TestRequestIDMiddleware(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	router := gin.New()
+	router.Use(requestIDMiddleware())
+	router.GET("/", func(c *gin.Context) {
+		c.String(http.StatusOK, logutil.RequestID(c.Request.Context()))
+	})
+
+	cases := []struct {
+		name   string
+		header string
+		keep   bool
+	}{
+		{"none", "", false},
+		{"client", "trace-42.a_b", true},
+		{"invalid", "bad id\n", false},
+		{"long", strings.Repeat("a", 65), false},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tt.header != "" {
+				r.Header.Set(requestIDHeader, tt.header)
+			}
+
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, r)
+
+			id := w.Header().Get(requestIDHeader)
+			if id == "" || id != w.Body.String() {
+				t.Fatalf("expected the response header %q to match the context %q", id, w.Body.String())
+			}
+
+			if (id == tt.header) != tt.keep {
+				t.Errorf("expected client ID kept %v, got %q", tt.keep, id)
+			}
+		})
+	}
+}
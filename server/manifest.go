@@ -10,6 +10,7 @@ import (
 	"log/slog"
 	"os"
 	"path/filepath"
+	"strings"
 
 	"github.com/ollama/ollama/types/model"
 )
@@ -38,6 +39,12 @@ func (m *Manifest) Remove() error {
 		return err
 	}
 
+	if dp, err := manifestDigestPath(m.filepath); err == nil {
+		if err := os.Remove(dp); err != nil && !errors.Is(err, os.ErrNotExist) {
+			slog.Warn("couldn't remove manifest digest", "path", dp, "error", err)
+		}
+	}
+
 	manifests, err := GetManifestPath()
 	if err != nil {
 		return err
@@ -46,7 +53,18 @@ func (m *Manifest) Remove() error {
 	return PruneDirectory(manifests)
 }
 
+// RemoveLayers removes the layers of m that no other manifest uses. It skips
+// removing them if the model store is in use, leaving them for a later prune.
 func (m *Manifest) RemoveLayers() error {
+	unlock, err := lockStore(true, false)
+	if errors.Is(err, errStoreBusy) {
+		slog.Info("model store is in use, skipping removing layers", "model", m.filepath)
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer unlock()
+
 	for _, layer := range append(m.Layers, m.Config) {
 		if layer.Digest != "" {
 			if err := layer.Remove(); errors.Is(err, os.ErrNotExist) {
@@ -102,25 +120,55 @@ func WriteManifest(name model.Name, config Layer, layers []Layer) error {
 		return err
 	}
 
-	p := filepath.Join(manifests, name.Filepath())
+	m := Manifest{
+		SchemaVersion: 2,
+		MediaType:     "application/vnd.docker.distribution.manifest.v2+json",
+		Config:        config,
+		Layers:        layers,
+	}
+
+	b, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+
+	return writeManifestFile(filepath.Join(manifests, name.Filepath()), append(b, '\n'))
+}
+
+// writeFileAtomic writes b to a hidden temporary file next to p, then
+// renames it over p, so readers in any process see either the whole old file
+// or the whole new one
+func writeFileAtomic(p string, b []byte) error {
 	if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
 		return err
 	}
 
-	f, err := os.Create(p)
+	f, err := os.CreateTemp(filepath.Dir(p), "."+filepath.Base(p)+"-*")
 	if err != nil {
 		return err
 	}
-	defer f.Close()
+	defer os.Remove(f.Name())
 
-	m := Manifest{
-		SchemaVersion: 2,
-		MediaType:     "application/vnd.docker.distribution.manifest.v2+json",
-		Config:        config,
-		Layers:        layers,
+	if err := f.Chmod(0o644); err != nil {
+		f.Close()
+		return err
+	}
+
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		return err
 	}
 
-	return json.NewEncoder(f).Encode(m)
+	return os.Rename(f.Name(), p)
 }
 
 func Manifests(continueOnError bool) (map[model.Name]*Manifest, error) {
@@ -142,7 +190,8 @@ func Manifests(continueOnError bool) (map[model.Name]*Manifest, error) {
 			return nil, err
 		}
 
-		if !fi.IsDir() {
+		// manifests being written are hidden
+		if !fi.IsDir() && !strings.HasPrefix(fi.Name(), ".") {
 			rel, err := filepath.Rel(manifests, match)
 			if err != nil {
 				if !continueOnError {
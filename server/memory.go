@@ -0,0 +1,169 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/envconfig"
+	"github.com/ollama/ollama/llm"
+	"github.com/ollama/ollama/template"
+)
+
+// memoryLength is the most tokens a session's memory is summarized into
+const memoryLength = 512
+
+// summarizeTimeout is how long summarizing a session can take, including
+// loading the model. The runner is released when it's done.
+const summarizeTimeout = 10 * time.Minute
+
+const summarizePrompt = `Summarize the conversation below into a compact memory for continuing it later. Keep the facts, names, numbers, decisions and preferences it established, and any open questions, and merge in the earlier memory if there is one. Reply with the summary only.`
+
+// memoryMessage is the message a session's memory is given to the model in,
+// after its system prompt
+func memoryMessage(memory string) api.Message {
+	return api.Message{Role: "system", Content: "Summary of the earlier conversation:\n\n" + memory}
+}
+
+// withMemory returns msgs with the memory of a session after their system
+// prompt, if they have one
+func withMemory(msgs []api.Message, memory string) []api.Message {
+	if memory == "" {
+		return msgs
+	}
+
+	var i int
+	if len(msgs) > 0 && msgs[0].Role == "system" {
+		i = 1
+	}
+
+	return append(msgs[:i:i], append([]api.Message{memoryMessage(memory)}, msgs[i:]...)...)
+}
+
+// olderTurns returns the range of messages to summarize once their tokens
+// exceed limit. The most recent turns, up to half of limit, are kept, along
+// with a leading system prompt, and the range ends before a user message so
+// the kept turns start with one.
+func olderTurns(ctx context.Context, tokenize func(context.Context, string) ([]int, error), msgs []api.Message, limit int) (int, int, error) {
+	counts := make([]int, len(msgs))
+	var total int
+	for i, msg := range msgs {
+		tokens, err := tokenize(ctx, msg.Content)
+		if err != nil {
+			return 0, 0, err
+		}
+
+		counts[i] = len(tokens)
+		total += counts[i]
+	}
+
+	if total <= limit {
+		return 0, 0, nil
+	}
+
+	var start int
+	if len(msgs) > 0 && msgs[0].Role == "system" {
+		start = 1
+	}
+
+	end := len(msgs)
+	var kept int
+	for end > start && kept+counts[end-1] <= limit/2 {
+		kept += counts[end-1]
+		end--
+	}
+
+	for end < len(msgs) && msgs[end].Role != "user" {
+		end++
+	}
+
+	if end <= start {
+		return 0, 0, nil
+	}
+
+	return start, end, nil
+}
+
+// summarizeSession summarizes the older turns of sess into its memory once
+// its history exceeds OLLAMA_SESSION_MEMORY tokens. It takes the session's
+// turn, so it's run after the request has released it and before the next
+// request goes ahead. The runner is scheduled with a context that ends with
+// the summary, since the scheduler holds it until its context is done.
+func (s *Server) summarizeSession(ctx context.Context, sess *session) {
+	ctx, cancel := context.WithTimeout(ctx, summarizeTimeout)
+	defer cancel()
+
+	sess.busy.Lock()
+	defer sess.busy.Unlock()
+
+	r, m, opts, err := s.scheduleRunner(ctx, sess.model, []Capability{CapabilityCompletion}, nil, nil)
+	if err != nil {
+		slog.Warn("failed to summarize session", "session", sess.id, "error", err)
+		return
+	}
+
+	msgs, memory := s.sessions.history(sess)
+	start, end, err := olderTurns(ctx, r.Tokenize, msgs, int(envconfig.SessionMemory()))
+	if err != nil {
+		slog.Warn("failed to summarize session", "session", sess.id, "error", err)
+		return
+	} else if start == end {
+		return
+	}
+
+	summary, err := summarize(ctx, r, m, opts, memory, msgs[start:end])
+	if err != nil {
+		slog.Warn("failed to summarize session", "session", sess.id, "error", err)
+		return
+	}
+
+	slog.Debug("summarized session", "session", sess.id, "messages", end-start)
+	s.sessions.remember(sess, summary, start, end)
+}
+
+// summarize returns a summary of memory and msgs generated by the model
+func summarize(ctx context.Context, r llm.LlamaServer, m *Model, opts *api.Options, memory string, msgs []api.Message) (string, error) {
+	var transcript strings.Builder
+	if memory != "" {
+		fmt.Fprintf(&transcript, "Earlier memory:\n\n%s\n\nConversation:\n\n", memory)
+	}
+
+	for _, msg := range msgs {
+		fmt.Fprintf(&transcript, "%s: %s\n\n", msg.Role, msg.Content)
+	}
+
+	var b bytes.Buffer
+	if err := m.Template.Execute(&b, template.Values{Messages: []api.Message{
+		{Role: "system", Content: summarizePrompt},
+		{Role: "user", Content: transcript.String()},
+	}}); err != nil {
+		return "", err
+	}
+
+	procs, err := parseProcessors(opts.Processors)
+	if err != nil {
+		return "", err
+	}
+
+	o := *opts
+	o.NumPredict = memoryLength
+
+	var summary strings.Builder
+	if err := r.Completion(ctx, llm.CompletionRequest{Prompt: b.String(), Options: &o}, func(cr llm.CompletionResponse) {
+		// thinking moved out by the think processor isn't part of the summary
+		summary.WriteString(procs.process(cr.Content, cr.Done).Content)
+	}); err != nil {
+		return "", err
+	}
+
+	if strings.TrimSpace(summary.String()) == "" {
+		return "", errors.New("empty summary")
+	}
+
+	return strings.TrimSpace(summary.String()), nil
+}
@@ -0,0 +1,97 @@
+package server
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/llm"
+	"github.com/ollama/ollama/template"
+)
+
+func TestOlderTurns(t *testing.T) {
+	msgs := []api.Message{
+		{Role: "system", Content: "be brief"},
+		{Role: "user", Content: "one two three four"},
+		{Role: "assistant", Content: "five six seven eight"},
+		{Role: "user", Content: "nine ten"},
+		{Role: "assistant", Content: "eleven twelve"},
+	}
+
+	cases := []struct {
+		limit      int
+		start, end int
+	}{
+		// under the limit
+		{20, 0, 0},
+		// the last turn fits in half of the limit
+		{8, 1, 3},
+		// the kept turns start with a user message
+		{5, 1, 5},
+	}
+
+	for _, tt := range cases {
+		start, end, err := olderTurns(context.Background(), mockRunner{}.Tokenize, msgs, tt.limit)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if start != tt.start || end != tt.end {
+			t.Errorf("%d: expected %d-%d, got %d-%d", tt.limit, tt.start, tt.end, start, end)
+		}
+	}
+}
+
+func TestWithMemory(t *testing.T) {
+	msgs := []api.Message{{Role: "system", Content: "be brief"}, {Role: "user", Content: "Hi"}}
+	if diff := cmp.Diff(withMemory(msgs, "The user is called Ada."), []api.Message{msgs[0], memoryMessage("The user is called Ada."), msgs[1]}); diff != "" {
+		t.Errorf("mismatch (-got +want):\n%s", diff)
+	}
+
+	if diff := cmp.Diff(withMemory(msgs[1:], "The user is called Ada."), []api.Message{memoryMessage("The user is called Ada."), msgs[1]}); diff != "" {
+		t.Errorf("mismatch (-got +want):\n%s", diff)
+	}
+
+	if diff := cmp.Diff(withMemory(msgs, ""), msgs); diff != "" {
+		t.Errorf("mismatch (-got +want):\n%s", diff)
+	}
+}
+
+func TestSummarize(t *testing.T) {
+	tmpl, err := template.Parse("{{ range .Messages }}{{ .Role }}: {{ .Content }}\n{{ end }}")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mock := mockRunner{CompletionFn: func(ctx context.Context, r llm.CompletionRequest, fn func(llm.CompletionResponse)) error {
+		fn(llm.CompletionResponse{Content: " The user is called Ada"})
+		fn(llm.CompletionResponse{Content: " and likes tea.\n", Done: true})
+		return nil
+	}}
+
+	opts := api.DefaultOptions()
+	summary, err := summarize(context.Background(), &mock, &Model{Template: tmpl}, &opts, "The user is called Ada.", []api.Message{
+		{Role: "user", Content: "I like tea"},
+		{Role: "assistant", Content: "Noted"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if summary != "The user is called Ada and likes tea." {
+		t.Errorf("unexpected summary %q", summary)
+	}
+
+	for _, s := range []string{summarizePrompt, "Earlier memory:\n\nThe user is called Ada.", "user: I like tea\n\nassistant: Noted"} {
+		if !strings.Contains(mock.CompletionRequest.Prompt, s) {
+			t.Errorf("expected the prompt to contain %q, got %q", s, mock.CompletionRequest.Prompt)
+		}
+	}
+
+	if mock.CompletionRequest.Options.NumPredict != memoryLength {
+		t.Errorf("expected the summary to be limited to %d tokens, got %d", memoryLength, mock.CompletionRequest.Options.NumPredict)
+	}
+}
@@ -0,0 +1,70 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/ollama/ollama/envconfig"
+	"github.com/ollama/ollama/logutil"
+)
+
+// limits on request metadata, which is copied into every log record for
+// the request
+const (
+	maxMetadataKeys   = 16
+	maxMetadataLength = 256
+)
+
+// labelName matches valid Prometheus label names
+var labelName = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// bindMetadata checks a request's metadata and adds it to the context the
+// request is logged with
+func bindMetadata(c *gin.Context, metadata map[string]string) error {
+	if len(metadata) == 0 {
+		return nil
+	}
+
+	if len(metadata) > maxMetadataKeys {
+		return fmt.Errorf("metadata has %d keys, more than the limit of %d", len(metadata), maxMetadataKeys)
+	}
+
+	for k, v := range metadata {
+		if k == "" {
+			return errors.New("metadata keys can't be empty")
+		}
+
+		if len(k) > maxMetadataLength || len(v) > maxMetadataLength {
+			return fmt.Errorf("metadata %q is longer than the limit of %d bytes", k, maxMetadataLength)
+		}
+	}
+
+	c.Request = c.Request.WithContext(logutil.WithMetadata(c.Request.Context(), metadata))
+	return nil
+}
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// metricsLabels formats the metadata keys listed in OLLAMA_METRICS_METADATA
+// as Prometheus labels to follow the model label, with keys that aren't
+// valid label names skipped. Requests without one of the keys are labelled
+// with an empty value so every series of a metric has the same labels.
+func metricsLabels(metadata map[string]string) string {
+	keys := slices.DeleteFunc(envconfig.MetricsMetadata(), func(k string) bool {
+		return k == "model" || !labelName.MatchString(k)
+	})
+
+	slices.Sort(keys)
+
+	var sb strings.Builder
+	for _, k := range slices.Compact(keys) {
+		fmt.Fprintf(&sb, `,%s="%s"`, k, labelValueEscaper.Replace(metadata[k]))
+	}
+
+	return sb.String()
+}
@@ -0,0 +1,104 @@
+package server
+
+import (
+	"cmp"
+	"fmt"
+	"maps"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/ollama/ollama/api"
+)
+
+// modelUsage is the cumulative usage of a model since the server started
+type modelUsage struct {
+	requests     uint64
+	promptTokens uint64
+	cachedTokens uint64
+	evalTokens   uint64
+	energyJoules float64
+}
+
+// usageKey identifies a series of usage metrics, by model and the labels
+// from request metadata formatted by metricsLabels
+type usageKey struct {
+	model  string
+	labels string
+}
+
+type usageMetrics struct {
+	mu     sync.Mutex
+	models map[usageKey]*modelUsage
+}
+
+// usage accumulates the metrics of completed generate and chat requests
+var usage usageMetrics
+
+func (u *usageMetrics) record(model string, metadata map[string]string, m api.Metrics) {
+	key := usageKey{model: model, labels: metricsLabels(metadata)}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if u.models == nil {
+		u.models = make(map[usageKey]*modelUsage)
+	}
+
+	stats, ok := u.models[key]
+	if !ok {
+		stats = &modelUsage{}
+		u.models[key] = stats
+	}
+
+	stats.requests++
+	stats.promptTokens += uint64(m.PromptEvalCount)
+	stats.cachedTokens += uint64(m.PromptCachedCount)
+	stats.evalTokens += uint64(m.EvalCount)
+	stats.energyJoules += m.EnergyJoules
+}
+
+// MetricsHandler reports cumulative usage per model in the Prometheus text
+// exposition format
+func (s *Server) MetricsHandler(c *gin.Context) {
+	usage.mu.Lock()
+	defer usage.mu.Unlock()
+
+	keys := slices.SortedFunc(maps.Keys(usage.models), func(a, b usageKey) int {
+		return cmp.Or(strings.Compare(a.model, b.model), strings.Compare(a.labels, b.labels))
+	})
+
+	var sb strings.Builder
+	metric := func(name, help string, value func(*modelUsage) string) {
+		fmt.Fprintf(&sb, "# HELP %s %s\n", name, help)
+		fmt.Fprintf(&sb, "# TYPE %s counter\n", name)
+		for _, key := range keys {
+			fmt.Fprintf(&sb, "%s{model=%q%s} %s\n", name, key.model, key.labels, value(usage.models[key]))
+		}
+	}
+
+	metric("ollama_requests_total", "Completed generate and chat requests.", func(u *modelUsage) string {
+		return fmt.Sprint(u.requests)
+	})
+	metric("ollama_prompt_tokens_total", "Prompt tokens evaluated.", func(u *modelUsage) string {
+		return fmt.Sprint(u.promptTokens)
+	})
+	metric("ollama_prompt_cached_tokens_total", "Prompt tokens reused from the prompt cache.", func(u *modelUsage) string {
+		return fmt.Sprint(u.cachedTokens)
+	})
+	metric("ollama_eval_tokens_total", "Tokens generated.", func(u *modelUsage) string {
+		return fmt.Sprint(u.evalTokens)
+	})
+	metric("ollama_energy_joules_total", "Estimated GPU energy used in joules.", func(u *modelUsage) string {
+		return fmt.Sprintf("%g", u.energyJoules)
+	})
+
+	if s.limits != nil {
+		s.limits.writeMetrics(&sb)
+	}
+
+	c.Data(http.StatusOK, "text/plain; version=0.0.4; charset=utf-8", []byte(sb.String()))
+}
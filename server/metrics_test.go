@@ -0,0 +1,83 @@
+package server
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/ollama/ollama/api"
+)
+
+func TestMetricsHandler(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	usage = usageMetrics{}
+	t.Cleanup(func() { usage = usageMetrics{} })
+
+	usage.record("test:latest", nil, api.Metrics{PromptEvalCount: 10, PromptCachedCount: 6, EvalCount: 5, EnergyJoules: 12.5})
+	usage.record("test:latest", nil, api.Metrics{PromptEvalCount: 4, EvalCount: 2, EnergyJoules: 0.25})
+	usage.record("other:latest", nil, api.Metrics{PromptEvalCount: 1, EvalCount: 1})
+
+	var s Server
+	w := createRequest(t, s.MetricsHandler, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status code 200, actual %d", w.Code)
+	}
+
+	expect := `# HELP ollama_requests_total Completed generate and chat requests.
+# TYPE ollama_requests_total counter
+ollama_requests_total{model="other:latest"} 1
+ollama_requests_total{model="test:latest"} 2
+# HELP ollama_prompt_tokens_total Prompt tokens evaluated.
+# TYPE ollama_prompt_tokens_total counter
+ollama_prompt_tokens_total{model="other:latest"} 1
+ollama_prompt_tokens_total{model="test:latest"} 14
+# HELP ollama_prompt_cached_tokens_total Prompt tokens reused from the prompt cache.
+# TYPE ollama_prompt_cached_tokens_total counter
+ollama_prompt_cached_tokens_total{model="other:latest"} 0
+ollama_prompt_cached_tokens_total{model="test:latest"} 6
+# HELP ollama_eval_tokens_total Tokens generated.
+# TYPE ollama_eval_tokens_total counter
+ollama_eval_tokens_total{model="other:latest"} 1
+ollama_eval_tokens_total{model="test:latest"} 7
+# HELP ollama_energy_joules_total Estimated GPU energy used in joules.
+# TYPE ollama_energy_joules_total counter
+ollama_energy_joules_total{model="other:latest"} 0
+ollama_energy_joules_total{model="test:latest"} 12.75
+`
+
+	if diff := cmp.Diff(w.Body.String(), expect); diff != "" {
+		t.Errorf("mismatch (-got +want):\n%s", diff)
+	}
+}
+
+func TestMetricsMetadataLabels(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	t.Setenv("OLLAMA_METRICS_METADATA", "tenant,not-a-label,model")
+
+	usage = usageMetrics{}
+	t.Cleanup(func() { usage = usageMetrics{} })
+
+	usage.record("test:latest", map[string]string{"tenant": "a", "session": "1"}, api.Metrics{EvalCount: 1})
+	usage.record("test:latest", map[string]string{"tenant": "a", "session": "2"}, api.Metrics{EvalCount: 2})
+	usage.record("test:latest", map[string]string{"tenant": `b"`}, api.Metrics{EvalCount: 4})
+	usage.record("test:latest", nil, api.Metrics{EvalCount: 8})
+
+	var s Server
+	w := createRequest(t, s.MetricsHandler, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status code 200, actual %d", w.Code)
+	}
+
+	expect := `ollama_eval_tokens_total{model="test:latest",tenant=""} 8
+ollama_eval_tokens_total{model="test:latest",tenant="a"} 3
+ollama_eval_tokens_total{model="test:latest",tenant="b\""} 4
+`
+
+	if !strings.Contains(w.Body.String(), expect) {
+		t.Errorf("expected %s, got %s", expect, w.Body.String())
+	}
+}
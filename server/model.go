@@ -30,11 +30,11 @@ type layerGGML struct {
 	*llm.GGML
 }
 
-func parseFromModel(ctx context.Context, name model.Name, fn func(api.ProgressResponse)) (layers []*layerGGML, err error) {
+func parseFromModel(ctx context.Context, name model.Name, regOpts *registryOptions, fn func(api.ProgressResponse)) (layers []*layerGGML, err error) {
 	m, err := ParseNamedManifest(name)
 	switch {
 	case errors.Is(err, os.ErrNotExist):
-		if err := PullModel(ctx, name.String(), &registryOptions{}, fn); err != nil {
+		if err := PullModel(ctx, name.String(), regOpts, fn); err != nil {
 			return nil, err
 		}
 
@@ -223,6 +223,44 @@ func parseFromFile(ctx context.Context, command string, baseLayers []*layerGGML,
 	return detectChatTemplate(layers)
 }
 
+// softPromptTensor holds the learned embeddings of a soft prompt, one row per
+// virtual token
+const softPromptTensor = "prompt_embd.weight"
+
+// softPromptLayer checks f is a GGUF soft prompt for a model with kv and
+// creates a layer for it
+func softPromptLayer(f *os.File, kv llm.KV) (Layer, error) {
+	if kv == nil {
+		return Layer{}, errors.New("no base model specified for the soft prompt")
+	}
+
+	ggml, _, err := llm.DecodeGGML(f, 0)
+	if err != nil {
+		return Layer{}, fmt.Errorf("invalid soft prompt: %w", err)
+	}
+
+	i := slices.IndexFunc(ggml.Tensors().Items, func(t *llm.Tensor) bool { return t.Name == softPromptTensor })
+	if i < 0 {
+		return Layer{}, fmt.Errorf("invalid soft prompt: missing %s tensor", softPromptTensor)
+	}
+
+	// F32 or F16
+	t := ggml.Tensors().Items[i]
+	if len(t.Shape) != 2 || t.Kind > 1 {
+		return Layer{}, fmt.Errorf("invalid soft prompt: %s must be a 2 dimensional F32 or F16 tensor", softPromptTensor)
+	}
+
+	if t.Shape[0] != kv.EmbeddingLength() {
+		return Layer{}, fmt.Errorf("soft prompt embedding length %d doesn't match the model's %d", t.Shape[0], kv.EmbeddingLength())
+	}
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return Layer{}, err
+	}
+
+	return NewLayer(f, "application/vnd.ollama.image.softprompt")
+}
+
 func detectChatTemplate(layers []*layerGGML) ([]*layerGGML, error) {
 	for _, layer := range layers {
 		if s := layer.GGML.KV().ChatTemplate(); s != "" {
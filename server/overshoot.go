@@ -0,0 +1,94 @@
+package server
+
+import (
+	"context"
+	"log/slog"
+	"slices"
+	"sync"
+
+	"github.com/ollama/ollama/discover"
+	"github.com/ollama/ollama/llm"
+)
+
+type overshootKey struct {
+	model string
+	gpu   string
+}
+
+// vramOvershoot learns how much more VRAM each model uses on a GPU than it's
+// estimated to, from the free memory reported before and after it loads, so
+// the estimate can be corrected the next time it's loaded. Correcting it
+// avoids running out of memory when the estimate is too low, and offloading
+// layers to the CPU needlessly when it's too high.
+type vramOvershoot struct {
+	mu     sync.Mutex
+	models map[overshootKey]int64
+}
+
+// record averages the latest overshoot of model on gpu with what was learned
+// before. Some memory is only allocated once the model starts generating, so
+// an estimate that looks too high is only corrected by half as much.
+func (o *vramOvershoot) record(model, gpu string, overshoot int64) int64 {
+	if overshoot < 0 {
+		overshoot /= 2
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if o.models == nil {
+		o.models = make(map[overshootKey]int64)
+	}
+
+	key := overshootKey{model, gpu}
+	if learned, ok := o.models[key]; ok {
+		overshoot = (learned + overshoot) / 2
+	}
+
+	o.models[key] = overshoot
+	return overshoot
+}
+
+// apply returns a copy of gpus with the free memory of each reduced by the
+// overshoot learned for model on it
+func (o *vramOvershoot) apply(model string, gpus discover.GpuInfoList) discover.GpuInfoList {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	gpus = slices.Clone(gpus)
+	for i := range gpus {
+		overshoot, ok := o.models[overshootKey{model, gpus[i].ID}]
+		if !ok {
+			continue
+		}
+
+		free := int64(gpus[i].FreeMemory) - overshoot
+		gpus[i].FreeMemory = uint64(min(max(free, 0), int64(gpus[i].TotalMemory)))
+	}
+
+	return gpus
+}
+
+// learn compares the VRAM the runner is estimated to use on each GPU with
+// the free memory reported before it loaded and now
+func (o *vramOvershoot) learn(ctx context.Context, model string, before, after discover.GpuInfoList, llama llm.LlamaServer) {
+	for _, b := range before {
+		estimate := llama.EstimatedVRAMByGPU(b.ID)
+		// free memory on unified memory GPUs also changes with system memory use
+		if b.Library == "cpu" || b.UnreliableFreeMemory || b.UnifiedMemory || estimate == 0 {
+			continue
+		}
+
+		i := slices.IndexFunc(after, func(a discover.GpuInfo) bool {
+			return a.Library == b.Library && a.ID == b.ID
+		})
+		if i < 0 {
+			continue
+		}
+
+		used := int64(b.FreeMemory) - int64(after[i].FreeMemory)
+		learned := o.record(model, b.ID, used-int64(estimate))
+		// in bytes, since the overshoot can be negative
+		slog.InfoContext(ctx, "measured VRAM usage", "model", model, "gpu", b.ID, "estimate", estimate, "used", used, "overshoot", learned)
+	}
+}
@@ -0,0 +1,66 @@
+package server
+
+import (
+	"context"
+	"testing"
+
+	"github.com/ollama/ollama/discover"
+	"github.com/ollama/ollama/format"
+)
+
+func TestVRAMOvershoot(t *testing.T) {
+	var o vramOvershoot
+
+	gpu := func(free uint64) discover.GpuInfoList {
+		var g discover.GpuInfo
+		g.Library = "cuda"
+		g.ID = "0"
+		g.TotalMemory = 16 * format.GibiByte
+		g.FreeMemory = free
+		return discover.GpuInfoList{g}
+	}
+
+	llama := &mockLlm{estimatedVRAMByGPU: map[string]uint64{"0": 3 * format.GibiByte}}
+	free := func(model string) uint64 {
+		return o.apply(model, gpu(10*format.GibiByte))[0].FreeMemory
+	}
+
+	if actual := free("a"); actual != 10*format.GibiByte {
+		t.Errorf("expected free memory to be unchanged before learning, got %d", actual)
+	}
+
+	cases := []struct {
+		name  string
+		after uint64
+		free  uint64
+	}{
+		// used 4 GiB, 1 GiB over the estimate
+		{"over", 6 * format.GibiByte, 9 * format.GibiByte},
+		// used 3.5 GiB, averaged with what was learned before
+		{"average", 6*format.GibiByte + 512*format.MebiByte, 9*format.GibiByte + 256*format.MebiByte},
+		// used 2 GiB, under the estimate, which is only credited by half
+		{"under", 8 * format.GibiByte, 9*format.GibiByte + 896*format.MebiByte},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			o.learn(context.Background(), "a", gpu(10*format.GibiByte), gpu(tt.after), llama)
+			if actual := free("a"); actual != tt.free {
+				t.Errorf("expected %d free, got %d", tt.free, actual)
+			}
+		})
+	}
+
+	t.Run("other model", func(t *testing.T) {
+		if actual := free("b"); actual != 10*format.GibiByte {
+			t.Errorf("expected free memory of another model to be unchanged, got %d", actual)
+		}
+	})
+
+	t.Run("clamped", func(t *testing.T) {
+		o.record("c", "0", -64*format.GibiByte)
+		if actual := free("c"); actual != 16*format.GibiByte {
+			t.Errorf("expected free memory to be at most the total, got %d", actual)
+		}
+	})
+}
@@ -0,0 +1,86 @@
+package server
+
+import (
+	"context"
+	_ "embed"
+	"errors"
+	"math"
+	"path/filepath"
+	"slices"
+
+	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/llm"
+)
+
+// perplexityText is the text models are scored on to compare them before and
+// after quantization. It mixes narrative, dialogue, instructions, numbers and
+// explanations so no single kind of text dominates.
+//
+//go:embed perplexity.txt
+var perplexityText string
+
+// perplexityChunk is the number of tokens scored together. Each chunk starts
+// without context from the previous one, so it's the same for every model
+// whatever context length it supports.
+const perplexityChunk = 256
+
+// perplexityFunc returns the perplexity of the model at path on
+// perplexityText, and the number of tokens scored
+type perplexityFunc func(ctx context.Context, path string) (float64, int, error)
+
+// perplexity loads the model at path and measures its perplexity. The model
+// is unloaded once it's done.
+func (s *Server) perplexity(ctx context.Context, path string) (float64, int, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	opts := api.DefaultOptions()
+	opts.NumCtx = 2 * perplexityChunk
+
+	m := &Model{Name: path, ShortName: filepath.Base(path), ModelPath: path}
+	runnerCh, errCh := s.sched.GetRunner(ctx, m, opts, &api.Duration{})
+	var runner *runnerRef
+	select {
+	case runner = <-runnerCh:
+	case err := <-errCh:
+		return 0, 0, err
+	}
+
+	return measurePerplexity(ctx, runner.llama, &opts)
+}
+
+// measurePerplexity scores perplexityText with r in chunks of
+// perplexityChunk tokens
+func measurePerplexity(ctx context.Context, r llm.LlamaServer, opts *api.Options) (float64, int, error) {
+	tokens, err := r.Tokenize(ctx, perplexityText)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var logprob float64
+	var n int
+	for chunk := range slices.Chunk(tokens, perplexityChunk) {
+		if len(chunk) < 2 {
+			continue
+		}
+
+		if err := r.Completion(ctx, llm.CompletionRequest{
+			Tokens:  chunk,
+			Options: opts,
+			Return:  "perplexity",
+		}, func(cr llm.CompletionResponse) {
+			logprob += cr.Logprob
+		}); err != nil {
+			return 0, 0, err
+		}
+
+		// the first token of a chunk has nothing to be predicted from
+		n += len(chunk) - 1
+	}
+
+	if n == 0 {
+		return 0, 0, errors.New("no tokens to measure perplexity with")
+	}
+
+	return math.Exp(-logprob / float64(n)), n, nil
+}
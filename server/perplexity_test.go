@@ -0,0 +1,42 @@
+package server
+
+import (
+	"context"
+	"math"
+	"strings"
+	"testing"
+
+	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/llm"
+)
+
+func TestMeasurePerplexity(t *testing.T) {
+	// each scored token has a probability of 1/4
+	var requests int
+	mock := mockRunner{
+		CompletionFn: func(_ context.Context, r llm.CompletionRequest, fn func(llm.CompletionResponse)) error {
+			requests++
+			if r.Return != "perplexity" || len(r.Tokens) > perplexityChunk {
+				t.Errorf("unexpected request %+v", r)
+			}
+
+			fn(llm.CompletionResponse{Done: true, Logprob: float64(len(r.Tokens)-1) * math.Log(0.25)})
+			return nil
+		},
+	}
+
+	opts := api.DefaultOptions()
+	ppl, n, err := measurePerplexity(context.Background(), &mock, &opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	words := len(strings.Fields(perplexityText))
+	if chunks := (words + perplexityChunk - 1) / perplexityChunk; requests != chunks || n != words-chunks {
+		t.Errorf("expected %d chunks of %d tokens, got %d of %d", chunks, words-chunks, requests, n)
+	}
+
+	if math.Abs(ppl-4) > 1e-9 {
+		t.Errorf("expected perplexity 4, got %f", ppl)
+	}
+}
@@ -0,0 +1,247 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"slices"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/ollama/ollama/format"
+	"github.com/ollama/ollama/types/model"
+)
+
+var errPolicy = errors.New("not allowed by policy")
+
+// principals an endpoint can be granted to, other than client certificate
+// identities
+const (
+	principalLocal = "local"
+	principalAll   = "*"
+)
+
+// policy restricts the models the server will pull, create and run, and the
+// clients that can call each endpoint. A nil policy allows everything.
+type policy struct {
+	// Allow and Deny are model name patterns. A model must match a pattern
+	// in Allow, if there are any, and none in Deny.
+	Allow []string `json:"allow,omitempty"`
+	Deny  []string `json:"deny,omitempty"`
+
+	// MaxParameters is the parameter count of the largest model allowed,
+	// such as "70B"
+	MaxParameters string `json:"max_parameters,omitempty"`
+
+	// Endpoints maps request paths to the clients that can call them:
+	// "local" for clients on this machine, client certificate identities,
+	// or "*" for any client. Endpoints without an entry are open.
+	Endpoints map[string][]string `json:"endpoints,omitempty"`
+
+	maxParameters uint64
+}
+
+func loadPolicy(path string) (*policy, error) {
+	if path == "" {
+		return nil, nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var p policy
+	d := json.NewDecoder(f)
+	d.DisallowUnknownFields()
+	if err := d.Decode(&p); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	if err := p.validate(); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	return &p, nil
+}
+
+func (p *policy) validate() error {
+	for _, pattern := range slices.Concat(p.Allow, p.Deny) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid model pattern %q", pattern)
+		}
+	}
+
+	if p.MaxParameters != "" {
+		n, err := format.ParseHumanNumber(p.MaxParameters)
+		if err != nil {
+			return fmt.Errorf("max_parameters: %w", err)
+		}
+
+		p.maxParameters = n
+	}
+
+	for endpoint := range p.Endpoints {
+		if !strings.HasPrefix(endpoint, "/") {
+			return fmt.Errorf("invalid endpoint %q", endpoint)
+		}
+	}
+
+	return nil
+}
+
+// matchModel reports whether n matches pattern. Patterns without a tag match
+// every tag of a model, so "llama3.1" matches "llama3.1:405b".
+func matchModel(pattern string, n model.Name) bool {
+	name := n.DisplayShortest()
+	if !strings.Contains(pattern, ":") {
+		name, _, _ = strings.Cut(name, ":")
+	}
+
+	ok, _ := path.Match(pattern, name)
+	return ok
+}
+
+// checkModel returns an error if the name n isn't allowed
+func (p *policy) checkModel(n model.Name) error {
+	if p == nil {
+		return nil
+	}
+
+	if len(p.Allow) > 0 && !slices.ContainsFunc(p.Allow, func(pattern string) bool { return matchModel(pattern, n) }) ||
+		slices.ContainsFunc(p.Deny, func(pattern string) bool { return matchModel(pattern, n) }) {
+		return fmt.Errorf("%w: model %s", errPolicy, n.DisplayShortest())
+	}
+
+	return nil
+}
+
+// checkConfig returns an error if the model n, with config, isn't allowed
+func (p *policy) checkConfig(n model.Name, config ConfigV2) error {
+	if err := p.checkModel(n); err != nil {
+		return err
+	}
+
+	if p == nil || p.maxParameters == 0 || config.ModelType == "" {
+		return nil
+	}
+
+	parameters, err := format.ParseHumanNumber(config.ModelType)
+	if err != nil {
+		return err
+	}
+
+	if parameters > p.maxParameters {
+		return fmt.Errorf("%w: model %s has %s parameters, more than %s", errPolicy, n.DisplayShortest(), config.ModelType, p.MaxParameters)
+	}
+
+	return nil
+}
+
+// allowed reports whether a client with principals can call endpoint
+func (p *policy) allowed(endpoint string, principals []string) bool {
+	if p == nil {
+		return true
+	}
+
+	granted, ok := p.Endpoints[endpoint]
+	if !ok {
+		return true
+	}
+
+	return slices.ContainsFunc(principals, func(principal string) bool {
+		return slices.Contains(granted, principal)
+	})
+}
+
+// identities returns the client certificate identities endpoints are
+// granted to
+func (p *policy) identities() []string {
+	if p == nil {
+		return nil
+	}
+
+	var identities []string
+	for _, granted := range p.Endpoints {
+		for _, principal := range granted {
+			if principal != principalLocal && principal != principalAll && !slices.Contains(identities, principal) {
+				identities = append(identities, principal)
+			}
+		}
+	}
+
+	slices.Sort(identities)
+	return identities
+}
+
+// endpointAliases maps the compatibility endpoints to the endpoints whose
+// handlers they share, so they're granted to the same clients
+var endpointAliases = map[string]string{
+	"/v1/chat/completions": "/api/chat",
+	"/v1/completions":      "/api/generate",
+	"/v1/embeddings":       "/api/embed",
+	"/v1/models":           "/api/tags",
+	"/v1/models/:model":    "/api/show",
+}
+
+// policyMiddleware rejects requests to endpoints the client isn't granted
+func policyMiddleware(p *policy) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		principals := []string{principalAll}
+		if isLocalRequest(c.Request) {
+			principals = append(principals, principalLocal)
+		}
+
+		if identity := clientIdentity(c.Request); identity != "" {
+			principals = append(principals, identity)
+		}
+
+		endpoint := c.FullPath()
+		if !p.allowed(endpoint, principals) || endpointAliases[endpoint] != "" && !p.allowed(endpointAliases[endpoint], principals) {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": fmt.Sprintf("%s: %s", errPolicy, c.FullPath())})
+			return
+		}
+
+		c.Next()
+	}
+}
+
+// checkPulledConfig decodes the config layer of the model n and calls check
+// with it
+func checkPulledConfig(n model.Name, layer Layer, check func(model.Name, ConfigV2) error) error {
+	f, err := layer.Open()
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var config ConfigV2
+	if err := json.NewDecoder(f).Decode(&config); err != nil {
+		return err
+	}
+
+	return check(n, config)
+}
+
+// registryOptions returns the options for pulling and creating models, which
+// check models against the server's policy and the storage limit of the
+// tenant making the request, and add them to the tenant's models
+func (s *Server) registryOptions(ctx context.Context) *registryOptions {
+	var regOpts registryOptions
+	if p := s.config().policy; p != nil {
+		regOpts.checkConfig = p.checkConfig
+	}
+
+	if t := tenantFromContext(ctx); t != nil {
+		regOpts.checkLayers = t.checkLayers
+		regOpts.added = t.add
+	}
+
+	return &regOpts
+}
@@ -0,0 +1,289 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/llm"
+	"github.com/ollama/ollama/types/model"
+)
+
+func TestLoadPolicy(t *testing.T) {
+	cases := []struct {
+		name string
+		body string
+		err  bool
+	}{
+		{"valid", `{"allow":["llama3.*","hf.co/*/*"],"deny":["*:405b"],"max_parameters":"70B","endpoints":{"/api/pull":["local"]}}`, false},
+		{"empty", `{}`, false},
+		{"bad pattern", `{"deny":["[llama"]}`, true},
+		{"bad max", `{"max_parameters":"big"}`, true},
+		{"bad endpoint", `{"endpoints":{"api/pull":["local"]}}`, true},
+		{"unknown field", `{"allowed":["llama3.2"]}`, true},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "policy.json")
+			if err := os.WriteFile(path, []byte(tt.body), 0o644); err != nil {
+				t.Fatal(err)
+			}
+
+			_, err := loadPolicy(path)
+			if tt.err != (err != nil) {
+				t.Errorf("expected error %v, got %v", tt.err, err)
+			}
+		})
+	}
+
+	if p, err := loadPolicy(""); p != nil || err != nil {
+		t.Errorf("expected no policy, got %v %v", p, err)
+	}
+}
+
+func TestPolicyCheckModel(t *testing.T) {
+	p := &policy{
+		Allow: []string{"llama3.1", "qwen2.5:*b", "hf.co/example/*"},
+		Deny:  []string{"llama3.1:405b*"},
+	}
+
+	cases := []struct {
+		name    string
+		allowed bool
+	}{
+		{"llama3.1", true},
+		{"llama3.1:8b", true},
+		{"llama3.1:405b", false},
+		{"llama3.1:405b-instruct-q4_0", false},
+		{"qwen2.5:7b", true},
+		{"qwen2.5:latest", false},
+		{"hf.co/example/model:Q4_K_M", true},
+		{"hf.co/other/model", false},
+		{"mistral", false},
+	}
+
+	for _, tt := range cases {
+		err := p.checkModel(model.ParseName(tt.name))
+		if tt.allowed != (err == nil) {
+			t.Errorf("%s: expected allowed %v, got %v", tt.name, tt.allowed, err)
+		}
+
+		if err != nil && !errors.Is(err, errPolicy) {
+			t.Errorf("%s: expected policy error, got %v", tt.name, err)
+		}
+	}
+
+	var none *policy
+	if err := none.checkConfig(model.ParseName("llama3.1:405b"), ConfigV2{ModelType: "405B"}); err != nil {
+		t.Errorf("expected a nil policy to allow everything, got %v", err)
+	}
+}
+
+func TestPolicyCheckConfig(t *testing.T) {
+	p := &policy{MaxParameters: "70B"}
+	if err := p.validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	for modelType, allowed := range map[string]bool{"8.0B": true, "70B": true, "70.6B": false, "405B": false, "": true} {
+		err := p.checkConfig(model.ParseName("llama3.1"), ConfigV2{ModelType: modelType})
+		if allowed != (err == nil) {
+			t.Errorf("%q: expected allowed %v, got %v", modelType, allowed, err)
+		}
+	}
+}
+
+func TestPolicyMiddleware(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	p := &policy{Endpoints: map[string][]string{
+		"/api/pull":   {principalLocal},
+		"/api/delete": {},
+		"/api/show":   {principalAll},
+		"/api/chat":   {principalLocal},
+	}}
+
+	router := gin.New()
+	router.Use(policyMiddleware(p))
+	for _, path := range []string{"/api/pull", "/api/delete", "/api/show", "/api/chat", "/api/generate", "/v1/chat/completions", "/v1/completions"} {
+		router.POST(path, func(c *gin.Context) { c.Status(http.StatusOK) })
+	}
+
+	cases := []struct {
+		path, remote string
+		status       int
+	}{
+		{"/api/pull", "127.0.0.1:1234", http.StatusOK},
+		{"/api/pull", "192.0.2.1:1234", http.StatusForbidden},
+		{"/api/delete", "127.0.0.1:1234", http.StatusForbidden},
+		{"/api/show", "192.0.2.1:1234", http.StatusOK},
+		{"/api/chat", "192.0.2.1:1234", http.StatusForbidden},
+		{"/api/generate", "192.0.2.1:1234", http.StatusOK},
+		// compatibility endpoints are granted like the endpoints they share
+		// handlers with
+		{"/v1/chat/completions", "127.0.0.1:1234", http.StatusOK},
+		{"/v1/chat/completions", "192.0.2.1:1234", http.StatusForbidden},
+		{"/v1/completions", "192.0.2.1:1234", http.StatusOK},
+	}
+
+	for _, tt := range cases {
+		r := httptest.NewRequest(http.MethodPost, tt.path, nil)
+		r.RemoteAddr = tt.remote
+
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		if w.Code != tt.status {
+			t.Errorf("%s from %s: expected status code %d, actual %d", tt.path, tt.remote, tt.status, w.Code)
+		}
+	}
+}
+
+func TestCreatePolicy(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	p := t.TempDir()
+	t.Setenv("OLLAMA_MODELS", p)
+
+	pol := &policy{Deny: []string{"denied"}, MaxParameters: "1K"}
+	if err := pol.validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	var s Server
+	s.cfg.Store(&serverConfig{policy: pol})
+
+	// parameter counts come from the size of the model's tensors
+	create := func(name string, parameters uint64) *httptest.ResponseRecorder {
+		t.Helper()
+		return createRequest(t, s.CreateHandler, api.CreateRequest{
+			Name: name,
+			Modelfile: fmt.Sprintf("FROM %s", createBinFile(t, llm.KV{"general.architecture": "llama"}, []llm.Tensor{
+				{Name: "token_embd.weight", Shape: []uint64{parameters}, WriterTo: bytes.NewReader(make([]byte, 4*parameters))},
+			})),
+			Stream: &stream,
+		})
+	}
+
+	if w := create("test", 500); w.Code != http.StatusOK {
+		t.Fatalf("expected status code 200, actual %d: %s", w.Code, w.Body.String())
+	}
+
+	if w := create("denied", 500); w.Code != http.StatusForbidden {
+		t.Errorf("expected status code 403, actual %d", w.Code)
+	}
+
+	w := create("large", 2000)
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("expected status code 403, actual %d", w.Code)
+	}
+
+	if !strings.Contains(w.Body.String(), "more than 1K") {
+		t.Errorf("expected parameter limit error, got %s", w.Body.String())
+	}
+
+	w = createRequest(t, s.CreateHandler, api.CreateRequest{
+		Name:      "test2",
+		Modelfile: "FROM denied",
+		Stream:    &stream,
+	})
+
+	if w.Code != http.StatusForbidden {
+		t.Errorf("expected status code 403, actual %d", w.Code)
+	}
+
+	checkFileExists(t, filepath.Join(p, "manifests", "*", "*", "*", "*"), []string{
+		filepath.Join(p, "manifests", "registry.ollama.ai", "library", "test", "latest"),
+	})
+}
+
+func TestPullPolicy(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+
+	blob := func(b []byte) Layer {
+		return Layer{Digest: fmt.Sprintf("sha256:%x", sha256.Sum256(b)), Size: int64(len(b))}
+	}
+
+	config := []byte(`{"model_format":"gguf","model_type":"405B"}`)
+	weights := bytes.Repeat([]byte{1}, 1024)
+
+	configLayer := blob(config)
+	configLayer.MediaType = "application/vnd.docker.container.image.v1+json"
+	weightsLayer := blob(weights)
+	weightsLayer.MediaType = "application/vnd.ollama.image.model"
+
+	var pulledWeights atomic.Bool
+	var r *httptest.Server
+	r = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		blobs := map[string][]byte{configLayer.Digest: config, weightsLayer.Digest: weights}
+
+		switch digest := filepath.Base(req.URL.Path); {
+		case strings.HasSuffix(req.URL.Path, "/manifests/tag"):
+			json.NewEncoder(w).Encode(Manifest{SchemaVersion: 2, Config: configLayer, Layers: []Layer{weightsLayer}}) //nolint:errcheck
+		case blobs[digest] != nil:
+			if digest == weightsLayer.Digest {
+				pulledWeights.Store(true)
+			}
+
+			// registries redirect blob downloads to another host, this
+			// server's own address rather than the model's
+			if req.Method == http.MethodGet && req.Host != r.Listener.Addr().String() {
+				http.Redirect(w, req, r.URL+"/"+digest, http.StatusTemporaryRedirect)
+				return
+			}
+
+			http.ServeContent(w, req, digest, time.Time{}, bytes.NewReader(blobs[digest]))
+		default:
+			http.NotFound(w, req)
+		}
+	}))
+	defer r.Close()
+
+	testMakeRequestDialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+		var d net.Dialer
+		return d.DialContext(ctx, "tcp", r.Listener.Addr().String())
+	}
+	t.Cleanup(func() { testMakeRequestDialContext = nil })
+
+	p := &policy{MaxParameters: "70B"}
+	if err := p.validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	var s Server
+	s.cfg.Store(&serverConfig{policy: p})
+
+	w := createRequest(t, s.PullHandler, api.PullRequest{
+		Name:     "example/namespace/model:tag",
+		Stream:   &stream,
+		Insecure: true,
+	})
+
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("expected status code 403, actual %d: %s", w.Code, w.Body.String())
+	}
+
+	if pulledWeights.Load() {
+		t.Error("expected the weights not to be pulled")
+	}
+
+	if _, err := ParseNamedManifest(model.ParseName("example/namespace/model:tag")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected no manifest, got %v", err)
+	}
+}
@@ -0,0 +1,29 @@
+//go:build !windows
+
+package server
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// checkPrivate returns an error unless path is owned by the server's user and
+// has no permissions beyond perm, so files other users can write or replace
+// aren't trusted
+func checkPrivate(path string, perm os.FileMode) error {
+	fi, err := os.Lstat(path)
+	if err != nil {
+		return err
+	}
+
+	if st, ok := fi.Sys().(*syscall.Stat_t); !ok || int(st.Uid) != os.Geteuid() {
+		return fmt.Errorf("%s isn't owned by the server's user", path)
+	}
+
+	if fi.Mode()&os.ModeSymlink != 0 || fi.Mode().Perm()&^perm != 0 {
+		return fmt.Errorf("%s has mode %04o, expected at most %04o", path, fi.Mode().Perm(), perm)
+	}
+
+	return nil
+}
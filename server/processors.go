@@ -0,0 +1,237 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode"
+
+	"github.com/ollama/ollama/api"
+)
+
+var errBadProcessor = errors.New("invalid processor")
+
+// processed is a chunk of a response as it's passed through each processor
+type processed struct {
+	Content  string
+	Thinking string
+	Code     []api.CodeBlock
+}
+
+// A processor post-processes the text of a response as it's generated. It's
+// called with each chunk of the response in turn, with done set for the
+// final one, and may hold back content it can't process yet.
+type processor interface {
+	process(p *processed, done bool)
+}
+
+type processors []processor
+
+// parseProcessors parses the processor option of a request, creating fresh
+// processors for each response. Each is a name followed by its arguments:
+//
+//	think [open close]              moves a leading <think> block to thinking
+//	code                            extracts fenced code blocks into code
+//	regex /pattern/replacement/     replaces pattern in each line of content
+func parseProcessors(specs []string) (processors, error) {
+	var ps processors
+	for _, spec := range specs {
+		name, args, _ := strings.Cut(strings.TrimSpace(spec), " ")
+		args = strings.TrimSpace(args)
+
+		switch name {
+		case "think":
+			p := thinkProcessor{open: "<think>", close: "</think>"}
+			if args != "" {
+				tags := strings.Fields(args)
+				if len(tags) != 2 {
+					return nil, fmt.Errorf("%w %q: expected an opening and closing tag", errBadProcessor, spec)
+				}
+
+				p.open, p.close = tags[0], tags[1]
+			}
+
+			ps = append(ps, &p)
+		case "code":
+			if args != "" {
+				return nil, fmt.Errorf("%w %q: code takes no arguments", errBadProcessor, spec)
+			}
+
+			ps = append(ps, &codeProcessor{})
+		case "regex":
+			p, err := parseRegexProcessor(args)
+			if err != nil {
+				return nil, fmt.Errorf("%w %q: %v", errBadProcessor, spec, err)
+			}
+
+			ps = append(ps, p)
+		default:
+			return nil, fmt.Errorf("%w %q: expected \"think\", \"code\" or \"regex\"", errBadProcessor, spec)
+		}
+	}
+
+	return ps, nil
+}
+
+// process passes a chunk of content through each processor in turn
+func (ps processors) process(content string, done bool) processed {
+	p := processed{Content: content}
+	for _, proc := range ps {
+		proc.process(&p, done)
+	}
+
+	return p
+}
+
+const (
+	thinkStart = iota
+	thinkInside
+	thinkClosed
+	thinkAfter
+)
+
+// thinkProcessor moves the reasoning of a model, enclosed in tags at the
+// start of its response, out of the content and into thinking
+type thinkProcessor struct {
+	open, close string
+
+	state int
+	held  string
+}
+
+func (t *thinkProcessor) process(p *processed, done bool) {
+	s := t.held + p.Content
+	t.held, p.Content = "", ""
+
+	for s != "" {
+		switch t.state {
+		case thinkStart:
+			trimmed := strings.TrimLeftFunc(s, unicode.IsSpace)
+			if strings.HasPrefix(trimmed, t.open) {
+				s = trimmed[len(t.open):]
+				t.state = thinkInside
+				continue
+			}
+
+			if strings.HasPrefix(t.open, trimmed) && !done {
+				// the response may still start with the tag
+				t.held = s
+				return
+			}
+
+			t.state = thinkAfter
+		case thinkInside:
+			if i := strings.Index(s, t.close); i >= 0 {
+				p.Thinking += s[:i]
+				s = s[i+len(t.close):]
+				t.state = thinkClosed
+				continue
+			}
+
+			n := 0
+			if !done {
+				n = partialSuffix(s, t.close)
+			}
+
+			p.Thinking += s[:len(s)-n]
+			t.held = s[len(s)-n:]
+			return
+		case thinkClosed:
+			// drop the whitespace separating thinking from the response
+			s = strings.TrimLeftFunc(s, unicode.IsSpace)
+			if s != "" {
+				t.state = thinkAfter
+			}
+		case thinkAfter:
+			p.Content += s
+			return
+		}
+	}
+}
+
+// partialSuffix returns the length of the longest end of s that tag starts
+// with, short of the whole tag
+func partialSuffix(s, tag string) int {
+	for n := min(len(s), len(tag)-1); n > 0; n-- {
+		if strings.HasSuffix(s, tag[:n]) {
+			return n
+		}
+	}
+
+	return 0
+}
+
+var fencedCode = regexp.MustCompile("(?ms)^```([^\\s`]*)[ \\t]*\\n(.*?)^```")
+
+// codeProcessor extracts the fenced code blocks of a response once it's done,
+// leaving its content as is
+type codeProcessor struct {
+	sb strings.Builder
+}
+
+func (c *codeProcessor) process(p *processed, done bool) {
+	c.sb.WriteString(p.Content)
+	if !done {
+		return
+	}
+
+	for _, m := range fencedCode.FindAllStringSubmatch(c.sb.String(), -1) {
+		p.Code = append(p.Code, api.CodeBlock{Language: m[1], Code: strings.TrimSuffix(m[2], "\n")})
+	}
+}
+
+// regexProcessor replaces a pattern in each line of the content of a
+// response, holding back each line until it's complete
+type regexProcessor struct {
+	re          *regexp.Regexp
+	replacement string
+
+	held string
+}
+
+// parseRegexProcessor parses /pattern/replacement/, where any character
+// that isn't in the pattern or replacement can be used in place of /
+func parseRegexProcessor(args string) (*regexProcessor, error) {
+	if args == "" {
+		return nil, errors.New("expected /pattern/replacement/")
+	}
+
+	parts := strings.Split(args[1:], args[:1])
+	if len(parts) != 3 || parts[2] != "" {
+		return nil, errors.New("expected /pattern/replacement/")
+	}
+
+	re, err := regexp.Compile(parts[0])
+	if err != nil {
+		return nil, err
+	}
+
+	return &regexProcessor{re: re, replacement: parts[1]}, nil
+}
+
+func (r *regexProcessor) process(p *processed, done bool) {
+	s := r.held + p.Content
+	r.held = ""
+
+	end := len(s)
+	if !done {
+		end = strings.LastIndexByte(s, '\n') + 1
+		r.held = s[end:]
+	}
+
+	var sb strings.Builder
+	for _, line := range strings.SplitAfter(s[:end], "\n") {
+		if line == "" {
+			continue
+		}
+
+		text, newline := strings.CutSuffix(line, "\n")
+		sb.WriteString(r.re.ReplaceAllString(text, r.replacement))
+		if newline {
+			sb.WriteByte('\n')
+		}
+	}
+
+	p.Content = sb.String()
+}
@@ -0,0 +1,131 @@
+package server
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/ollama/ollama/api"
+)
+
+func TestProcessors(t *testing.T) {
+	cases := []struct {
+		name     string
+		specs    []string
+		chunks   []string
+		content  string
+		thinking string
+		code     []api.CodeBlock
+	}{
+		{
+			name:     "think",
+			specs:    []string{"think"},
+			chunks:   []string{"<think>", "Let me", " think</think>", "\n\n", "Hello"},
+			content:  "Hello",
+			thinking: "Let me think",
+		},
+		{
+			name:     "think split tags",
+			specs:    []string{"think"},
+			chunks:   []string{"\n<th", "ink>a <", "b</th", "ink> c"},
+			content:  "c",
+			thinking: "a <b",
+		},
+		{
+			name:    "think without tags",
+			specs:   []string{"think"},
+			chunks:  []string{"<th", "e end", " <think>x</think>"},
+			content: "<the end <think>x</think>",
+		},
+		{
+			name:    "think partial tag at the end",
+			specs:   []string{"think"},
+			chunks:  []string{"<thi"},
+			content: "<thi",
+		},
+		{
+			name:     "think unclosed",
+			specs:    []string{"think"},
+			chunks:   []string{"<think>still", " going</"},
+			thinking: "still going</",
+		},
+		{
+			name:     "think custom tags",
+			specs:    []string{"think [R] [/R]"},
+			chunks:   []string{"[R]hmm[/R]", "ok"},
+			content:  "ok",
+			thinking: "hmm",
+		},
+		{
+			name:    "code",
+			specs:   []string{"code"},
+			chunks:  []string{"Try:\n```py", "thon\nprint(1)\n", "```\nor\n```\nls\n```"},
+			content: "Try:\n```python\nprint(1)\n```\nor\n```\nls\n```",
+			code: []api.CodeBlock{
+				{Language: "python", Code: "print(1)"},
+				{Code: "ls"},
+			},
+		},
+		{
+			name:    "regex",
+			specs:   []string{"regex /\\[(\\d+)\\]/(ref $1)/"},
+			chunks:  []string{"see [1", "2]\nand [3]", " too"},
+			content: "see (ref 12)\nand (ref 3) too",
+		},
+		{
+			name:    "regex other delimiter",
+			specs:   []string{"regex |a/b|c|"},
+			chunks:  []string{"a/b\n"},
+			content: "c\n",
+		},
+		{
+			name:     "in order",
+			specs:    []string{"think", "regex /^Answer: //", "code"},
+			chunks:   []string{"<think>```\nnot code\n```</think>Answer: ", "```\nx\n```"},
+			content:  "```\nx\n```",
+			thinking: "```\nnot code\n```",
+			code:     []api.CodeBlock{{Code: "x"}},
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			ps, err := parseProcessors(tt.specs)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var got processed
+			for i, chunk := range tt.chunks {
+				p := ps.process(chunk, i == len(tt.chunks)-1)
+				got.Content += p.Content
+				got.Thinking += p.Thinking
+				got.Code = append(got.Code, p.Code...)
+			}
+
+			if diff := cmp.Diff(got, processed{tt.content, tt.thinking, tt.code}); diff != "" {
+				t.Errorf("mismatch (-got +want):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestParseProcessorsInvalid(t *testing.T) {
+	for _, spec := range []string{
+		"",
+		"unknown",
+		"think <think>",
+		"code python",
+		"regex",
+		"regex /a/",
+		"regex /a/b/g",
+		"regex /(/b/",
+	} {
+		t.Run(spec, func(t *testing.T) {
+			if _, err := parseProcessors([]string{spec}); !errors.Is(err, errBadProcessor) {
+				t.Errorf("expected %v, got %v", errBadProcessor, err)
+			}
+		})
+	}
+}
@@ -7,7 +7,11 @@ import (
 	"errors"
 	"fmt"
 	"log/slog"
+	"regexp"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
 
 	"github.com/ollama/ollama/api"
 	"github.com/ollama/ollama/llm"
@@ -17,14 +21,29 @@ import (
 
 type tokenizeFunc func(context.Context, string) ([]int, error)
 
+// countTokens counts the tokens in a string with tokenize, for templates
+// that call the tokens function
+func countTokens(ctx context.Context, tokenize tokenizeFunc) func(string) (int, error) {
+	return func(s string) (int, error) {
+		tokens, err := tokenize(ctx, s)
+		return len(tokens), err
+	}
+}
+
 var errTooManyImages = errors.New("vision model only supports a single image per message")
 
+var errImageReference = errors.New("messages can only refer to images of earlier messages")
+
+// imageReferenceRegexp matches references to images of earlier messages,
+// numbered from 0 through the conversation
+var imageReferenceRegexp = regexp.MustCompile(`\[img-(\d+)\]`)
+
 // chatPrompt accepts a list of messages and returns the prompt and images that should be used for the next chat turn.
 // chatPrompt truncates any messages that exceed the context window of the model, making sure to always include 1) the
-// latest message and 2) system messages
+// latest message and 2) system messages. Truncated conversations keep their earliest turns, up to half the context
+// window, and drop messages after them, so the start of the prompt stays the same from one turn to the next and the
+// runner can reuse its cache for it.
 func chatPrompt(ctx context.Context, m *Model, tokenize tokenizeFunc, opts *api.Options, msgs []api.Message, tools []api.Tool) (prompt string, images []llm.ImageData, _ error) {
-	var system []api.Message
-
 	isMllama := checkMllamaModelFamily(m)
 
 	var imageNumTokens int
@@ -37,6 +56,41 @@ func chatPrompt(ctx context.Context, m *Model, tokenize tokenizeFunc, opts *api.
 		imageNumTokens = 768
 	}
 
+	// keep returns the messages msgs[:k] and msgs[i:], along with the system
+	// messages between them
+	keep := func(k, i int) []api.Message {
+		kept := slices.Clone(msgs[:k])
+		for _, msg := range msgs[k:i] {
+			if msg.Role == "system" {
+				kept = append(kept, msg)
+			}
+		}
+
+		return append(kept, msgs[i:]...)
+	}
+
+	// fits reports whether msgs fit into limit tokens
+	fits := func(msgs []api.Message, limit int) (bool, error) {
+		var b bytes.Buffer
+		if err := m.Template.Execute(&b, template.Values{Messages: msgs, Tools: tools, Tokenize: countTokens(ctx, tokenize)}); err != nil {
+			return false, err
+		}
+
+		s, err := tokenize(ctx, b.String())
+		if err != nil {
+			return false, err
+		}
+
+		ctxLen := len(s)
+		if m.ProjectorPaths != nil {
+			for _, m := range msgs {
+				ctxLen += imageNumTokens * (len(m.Images) + len(imageReferenceRegexp.FindAllString(m.Content, -1)))
+			}
+		}
+
+		return ctxLen <= limit, nil
+	}
+
 	n := len(msgs) - 1
 	// in reverse, find all messages that fit into context window
 	for i := n; i >= 0; i-- {
@@ -49,78 +103,154 @@ func chatPrompt(ctx context.Context, m *Model, tokenize tokenizeFunc, opts *api.
 			continue
 		}
 
-		system = make([]api.Message, 0)
-		for j := range i {
-			if msgs[j].Role == "system" {
-				system = append(system, msgs[j])
-			}
+		ok, err := fits(keep(0, i), opts.NumCtx)
+		if err != nil {
+			return "", nil, err
 		}
 
-		var b bytes.Buffer
-		if err := m.Template.Execute(&b, template.Values{Messages: append(system, msgs[i:]...), Tools: tools}); err != nil {
-			return "", nil, err
+		if !ok {
+			slog.Debug("truncating input messages which exceed context length", "truncated", len(msgs[i:]))
+			break
+		} else {
+			n = i
+		}
+	}
+
+	// when truncating, keep the earliest turns, ending with a response, that
+	// fit in half the context window along with the latest messages that fit
+	// after them
+	var k int
+	for i := 1; i < n; i++ {
+		if isMllama && len(msgs[i-1].Images) > 1 {
+			return "", nil, errTooManyImages
 		}
 
-		s, err := tokenize(ctx, b.String())
+		if msgs[i-1].Role != "assistant" {
+			continue
+		}
+
+		ok, err := fits(msgs[:i], opts.NumCtx/2)
 		if err != nil {
 			return "", nil, err
+		} else if !ok {
+			break
 		}
 
-		ctxLen := len(s)
-		if m.ProjectorPaths != nil {
-			for _, m := range msgs[i:] {
-				ctxLen += imageNumTokens * len(m.Images)
+		k = i
+	}
+
+	if k > 0 {
+		latest := -1
+		for i := len(msgs) - 1; i > k; i-- {
+			ok, err := fits(keep(k, i), opts.NumCtx)
+			if err != nil {
+				return "", nil, err
+			} else if !ok {
+				break
 			}
+
+			latest = i
 		}
 
-		if ctxLen > opts.NumCtx {
-			slog.Debug("truncating input messages which exceed context length", "truncated", len(msgs[i:]))
-			break
+		if latest < 0 {
+			k = 0
 		} else {
-			n = i
+			slog.Debug("keeping earliest input messages to reuse cache", "kept", k, "truncated", latest-k)
+			n = latest
+		}
+	}
+
+	// image returns the image data of i for the runner, which refers to it
+	// by id
+	image := func(i api.ImageData, id int) (llm.ImageData, error) {
+		if !isMllama {
+			return llm.ImageData{ID: id, Data: i}, nil
+		}
+
+		data, opts, err := mllamaProcessor(m).Preprocess(bytes.NewReader(i))
+		if err != nil {
+			return llm.ImageData{}, err
+		}
+
+		buf := new(bytes.Buffer)
+		err = binary.Write(buf, binary.LittleEndian, data)
+		if err != nil {
+			return llm.ImageData{}, err
+		}
+
+		ar, ok := opts["aspectRatioIndex"].(int)
+		if !ok {
+			return llm.ImageData{}, fmt.Errorf("missing aspect ratio for image")
 		}
+
+		return llm.ImageData{ID: id, Data: buf.Bytes(), AspectRatioID: ar}, nil
 	}
 
-	currMsgIdx := n
+	// images are numbered through the conversation where messages refer to
+	// them, as [img-N], and are given ids for the runner in the order
+	// they're added to the prompt. An image referred to again is the same
+	// image data, so the runner only processes it once.
+	var all []api.ImageData
+	first := make([]int, len(msgs))
+	for i, msg := range msgs {
+		first[i] = len(all)
+		all = append(all, msg.Images...)
+	}
+
+	ids := make(map[int]int)
+	for cnt, msg := range msgs {
+		if cnt >= k && cnt < n {
+			continue
+		}
 
-	for cnt, msg := range msgs[currMsgIdx:] {
 		prefix := ""
 		imgPrompt := ""
 		prompt := msg.Content
 
-		for _, i := range msg.Images {
-			var imgData llm.ImageData
-
-			if isMllama {
-				data, opts, err := mllama.Preprocess(bytes.NewReader(i))
-				if err != nil {
-					return "", nil, err
-				}
-
-				buf := new(bytes.Buffer)
-				err = binary.Write(buf, binary.LittleEndian, data)
-				if err != nil {
-					return "", nil, err
+		if m.ProjectorPaths != nil {
+			var err error
+			prompt = imageReferenceRegexp.ReplaceAllStringFunc(prompt, func(ref string) string {
+				j, _ := strconv.Atoi(imageReferenceRegexp.FindStringSubmatch(ref)[1])
+				if j >= first[cnt] {
+					err = fmt.Errorf("%w: %s", errImageReference, ref)
+					return ref
 				}
 
-				ar, ok := opts["aspectRatioIndex"].(int)
+				id, ok := ids[j]
 				if !ok {
-					return "", nil, fmt.Errorf("missing aspect ratio for image")
+					var imgData llm.ImageData
+					if imgData, err = image(all[j], len(images)); err != nil {
+						return ref
+					}
+
+					id = imgData.ID
+					ids[j] = id
+					images = append(images, imgData)
 				}
 
-				imgData = llm.ImageData{
-					ID:            len(images),
-					Data:          buf.Bytes(),
-					AspectRatioID: ar,
+				tag := fmt.Sprintf("[img-%d]", id)
+				if isMllama {
+					tag += "<|image|>"
 				}
+
+				return tag
+			})
+			if err != nil {
+				return "", nil, err
+			}
+		}
+
+		for j, i := range msg.Images {
+			imgData, err := image(i, len(images))
+			if err != nil {
+				return "", nil, err
+			}
+
+			if isMllama {
 				imgPrompt = "<|image|>"
-			} else {
-				imgData = llm.ImageData{
-					ID:   len(images),
-					Data: i,
-				}
 			}
 
+			ids[first[cnt]+j] = imgData.ID
 			imgTag := fmt.Sprintf("[img-%d]", imgData.ID)
 			if !strings.Contains(prompt, "[img]") {
 				prefix += imgTag
@@ -130,18 +260,98 @@ func chatPrompt(ctx context.Context, m *Model, tokenize tokenizeFunc, opts *api.
 
 			images = append(images, imgData)
 		}
-		msgs[currMsgIdx+cnt].Content = prefix + imgPrompt + prompt
+		msgs[cnt].Content = prefix + imgPrompt + prompt
 	}
 
 	// truncate any messages that do not fit into the context window
 	var b bytes.Buffer
-	if err := m.Template.Execute(&b, template.Values{Messages: append(system, msgs[currMsgIdx:]...), Tools: tools}); err != nil {
+	if err := m.Template.Execute(&b, template.Values{Messages: keep(k, n), Tools: tools, Tokenize: countTokens(ctx, tokenize)}); err != nil {
 		return "", nil, err
 	}
 
 	return b.String(), images, nil
 }
 
+// cacheLength returns the length of the start of prompt, rendered from msgs,
+// that can be kept in the prompt cache, which ends where the first message
+// with Cache set to false is rendered. It's nil if all of prompt can be kept.
+func cacheLength(tmpl *template.Template, msgs []api.Message, tools []api.Tool, prompt string) (*int, error) {
+	i := slices.IndexFunc(msgs, func(msg api.Message) bool {
+		return msg.Cache != nil && !*msg.Cache
+	})
+	if i < 0 {
+		return nil, nil
+	}
+
+	var b bytes.Buffer
+	if err := tmpl.Execute(&b, template.Values{Messages: msgs[:i], Tools: tools}); err != nil {
+		return nil, err
+	}
+
+	// templates can end the earlier messages differently, such as by
+	// prompting for a response, so only the part in common with the prompt
+	// is kept, which also stops it at any messages truncated from the prompt
+	n := commonPrefix(b.String(), prompt)
+	return &n, nil
+}
+
+// prefixLength returns the length of the start of prompt, rendered from msgs,
+// made of the system messages before any others, such as the model's system
+// prompt, which many requests share. It's 0 if msgs don't start with a
+// system message.
+func prefixLength(tmpl *template.Template, msgs []api.Message, tools []api.Tool, prompt string) (int, error) {
+	i := slices.IndexFunc(msgs, func(msg api.Message) bool {
+		return msg.Role != "system"
+	})
+	if i == 0 {
+		return 0, nil
+	} else if i < 0 {
+		i = len(msgs)
+	}
+
+	var b bytes.Buffer
+	if err := tmpl.Execute(&b, template.Values{Messages: msgs[:i], Tools: tools}); err != nil {
+		return 0, err
+	}
+
+	return commonPrefix(b.String(), prompt), nil
+}
+
+func commonPrefix(a, b string) int {
+	var n int
+	for n < len(a) && n < len(b) && a[n] == b[n] {
+		n++
+	}
+
+	return n
+}
+
+// imageProcessors are the mllama image processors of vision projectors by
+// path, so their metadata is only read once
+var imageProcessors sync.Map
+
+// mllamaProcessor returns the image processor of the model's projector
+func mllamaProcessor(m *Model) mllama.Processor {
+	if len(m.ProjectorPaths) == 0 {
+		return mllama.NewProcessor(nil)
+	}
+
+	path := m.ProjectorPaths[0]
+	if p, ok := imageProcessors.Load(path); ok {
+		return p.(mllama.Processor)
+	}
+
+	p := mllama.NewProcessor(nil)
+	if ggml, err := llm.LoadModel(path, 0); err != nil {
+		slog.Debug("using default image preprocessing", "projector", path, "error", err)
+	} else {
+		p = mllama.NewProcessor(ggml.KV())
+	}
+
+	imageProcessors.Store(path, p)
+	return p
+}
+
 func checkMllamaModelFamily(m *Model) bool {
 	for _, arch := range m.Config.ModelFamilies {
 		if arch == "mllama" {
@@ -3,6 +3,7 @@ package server
 import (
 	"bytes"
 	"context"
+	"errors"
 	"image"
 	"image/png"
 	"testing"
@@ -85,6 +86,23 @@ func TestChatPrompt(t *testing.T) {
 				prompt: "A test. And a thumping good one at that, I'd wager. ",
 			},
 		},
+		{
+			name:  "truncate messages keeping earliest turns",
+			model: visionModel,
+			limit: 14,
+			msgs: []api.Message{
+				{Role: "user", Content: "You're a test, Harry!"},
+				{Role: "assistant", Content: "I-I'm a what?"},
+				{Role: "user", Content: "A test. And a thumping good one at that, I'd wager."},
+				{Role: "assistant", Content: "Thanks, I think."},
+				{Role: "user", Content: "Will there be cake?"},
+				{Role: "assistant", Content: "Probably."},
+				{Role: "user", Content: "Good."},
+			},
+			expect: expect{
+				prompt: "You're a test, Harry! I-I'm a what? Will there be cake? Probably. Good. ",
+			},
+		},
 		{
 			name:  "truncate messages with image",
 			model: visionModel,
@@ -228,6 +246,49 @@ func TestChatPrompt(t *testing.T) {
 				images: [][]byte{[]byte("one hotdog"), []byte("two hotdogs")},
 			},
 		},
+		{
+			name:  "messages referring to earlier images",
+			model: visionModel,
+			limit: 4096,
+			msgs: []api.Message{
+				{Role: "user", Content: "Here's one hotdog", Images: []api.ImageData{[]byte("one hotdog")}},
+				{Role: "assistant", Content: "Nice."},
+				{Role: "user", Content: "And two", Images: []api.ImageData{[]byte("two hotdogs")}},
+				{Role: "assistant", Content: "Even nicer."},
+				{Role: "user", Content: "Is [img-0] bigger than [img-1]?"},
+			},
+			expect: expect{
+				prompt: "[img-0]Here's one hotdog Nice. [img-1]And two Even nicer. Is [img-0] bigger than [img-1]? ",
+				images: [][]byte{[]byte("one hotdog"), []byte("two hotdogs")},
+			},
+		},
+		{
+			name:  "truncated message referring to earlier image",
+			model: visionModel,
+			limit: 800,
+			msgs: []api.Message{
+				{Role: "user", Content: "Here's one hotdog", Images: []api.ImageData{[]byte("one hotdog")}},
+				{Role: "assistant", Content: "Nice."},
+				{Role: "user", Content: "And two", Images: []api.ImageData{[]byte("two hotdogs")}},
+				{Role: "assistant", Content: "Even nicer."},
+				{Role: "user", Content: "Is [img-1] bigger?"},
+			},
+			expect: expect{
+				prompt: "Even nicer. Is [img-0] bigger? ",
+				images: [][]byte{[]byte("two hotdogs")},
+			},
+		},
+		{
+			name:  "message referring to its own image",
+			model: visionModel,
+			limit: 2048,
+			msgs: []api.Message{
+				{Role: "user", Content: "What's in [img-0]?", Images: []api.ImageData{[]byte("one hotdog")}},
+			},
+			expect: expect{
+				error: errImageReference,
+			},
+		},
 		{
 			name:  "messages with mllama (no images)",
 			model: mllamaModel,
@@ -299,6 +360,21 @@ func TestChatPrompt(t *testing.T) {
 				aspectRatioID: 1,
 			},
 		},
+		{
+			name:  "message referring to earlier image with mllama",
+			model: mllamaModel,
+			limit: 2048,
+			msgs: []api.Message{
+				{Role: "user", Content: "How many hotdogs are in this image?", Images: []api.ImageData{imgBuf}},
+				{Role: "assistant", Content: "There are four hotdogs."},
+				{Role: "user", Content: "Which ones in [img-0] have mustard?"},
+			},
+			expect: expect{
+				prompt:        "[img-0]<|image|>How many hotdogs are in this image? There are four hotdogs. Which ones in [img-0]<|image|> have mustard? ",
+				images:        [][]byte{imgBuf},
+				aspectRatioID: 1,
+			},
+		},
 		{
 			name:  "too many images with mllama",
 			model: mllamaModel,
@@ -321,7 +397,7 @@ func TestChatPrompt(t *testing.T) {
 			prompt, images, err := chatPrompt(context.TODO(), &model, mockRunner{}.Tokenize, &opts, tt.msgs, nil)
 			if tt.error == nil && err != nil {
 				t.Fatal(err)
-			} else if tt.error != nil && err != tt.error {
+			} else if tt.error != nil && !errors.Is(err, tt.error) {
 				t.Fatalf("expected err '%q', got '%q'", tt.error, err)
 			}
 
@@ -351,3 +427,46 @@ func TestChatPrompt(t *testing.T) {
 		})
 	}
 }
+
+func TestPrefixLength(t *testing.T) {
+	tmpl, err := template.Parse(`
+{{- range .Messages }}[{{ .Role }}]{{ .Content }}{{ end }}A:`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name   string
+		msgs   []api.Message
+		expect int
+	}{
+		{
+			name:   "system",
+			msgs:   []api.Message{{Role: "system", Content: "Be brief."}, {Role: "user", Content: "Hi"}},
+			expect: len("[system]Be brief."),
+		},
+		{
+			name:   "no system",
+			msgs:   []api.Message{{Role: "user", Content: "Hi"}},
+			expect: 0,
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			var b bytes.Buffer
+			if err := tmpl.Execute(&b, template.Values{Messages: tt.msgs}); err != nil {
+				t.Fatal(err)
+			}
+
+			n, err := prefixLength(tmpl, tt.msgs, nil, b.String())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if n != tt.expect {
+				t.Errorf("expected %d, got %d", tt.expect, n)
+			}
+		})
+	}
+}
@@ -0,0 +1,112 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"os"
+
+	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/llm"
+	"github.com/ollama/ollama/types/model"
+	"github.com/ollama/ollama/version"
+)
+
+// sourceKeys are the GGUF metadata keys that may name the repository weights
+// were published in, in order of preference
+var sourceKeys = []string{
+	"general.source.huggingface.repository",
+	"general.source.url",
+	"general.source.repo_url",
+	"general.repo_url",
+	"general.url",
+}
+
+func newProvenance() *api.Provenance {
+	return &api.Provenance{Tool: "ollama " + version.Version}
+}
+
+// modelSource returns the repository named in the metadata of kv, if any
+func modelSource(kv llm.KV) string {
+	for _, k := range sourceKeys {
+		if s, ok := kv[k].(string); ok && s != "" {
+			return s
+		}
+	}
+
+	return ""
+}
+
+// parentModel records the existing model name as a parent, along with
+// its own provenance
+func parentModel(command string, name model.Name) (api.ProvenanceParent, error) {
+	parent := api.ProvenanceParent{Type: command, Name: name.DisplayShortest()}
+
+	m, err := ParseNamedManifest(name)
+	if err != nil {
+		return parent, err
+	}
+
+	parent.Digest = "sha256:" + m.digest
+
+	if m.Config.Digest != "" {
+		f, err := m.Config.Open()
+		if err != nil {
+			return parent, err
+		}
+		defer f.Close()
+
+		var config ConfigV2
+		if err := json.NewDecoder(f).Decode(&config); err != nil {
+			return parent, err
+		}
+
+		parent.Provenance = config.Provenance
+	}
+
+	return parent, nil
+}
+
+// parentFile records file as a parent, hashing it if its digest isn't known.
+// Zip files hold safetensors weights, which are converted as the model is
+// created, so converted marks a blob that was replaced by the result of an
+// earlier conversion.
+func parentFile(command, digest string, file *os.File, converted bool) (api.ProvenanceParent, error) {
+	if digest == "" {
+		sha256sum := sha256.New()
+		if _, err := io.Copy(sha256sum, io.NewSectionReader(file, 0, math.MaxInt64)); err != nil {
+			return api.ProvenanceParent{}, err
+		}
+
+		digest = fmt.Sprintf("sha256:%x", sha256sum.Sum(nil))
+	}
+
+	parent := api.ProvenanceParent{Type: command, Digest: digest}
+	if command == "tokenizer" {
+		parent.Format = "tokenizer"
+		return parent, nil
+	}
+
+	if converted {
+		parent.Format = "safetensors"
+		parent.Converter = "ollama " + version.Version
+		return parent, nil
+	}
+
+	contentType, err := detectContentType(io.NewSectionReader(file, 0, 512))
+	if err != nil {
+		return parent, err
+	}
+
+	switch contentType {
+	case "application/zip":
+		parent.Format = "safetensors"
+		parent.Converter = "ollama " + version.Version
+	default:
+		parent.Format = contentType
+	}
+
+	return parent, nil
+}
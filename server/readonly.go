@@ -0,0 +1,36 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+
+	"github.com/gin-gonic/gin"
+)
+
+var errReadOnly = errors.New("models directory is read only")
+
+// readOnlyEndpoints write to the models directory
+var readOnlyEndpoints = []string{
+	"/api/pull",
+	"/api/create",
+	"/api/copy",
+	"/api/delete",
+	"/api/labels",
+	"/api/blobs/:digest",
+}
+
+// readOnlyMiddleware rejects requests that would write to the models
+// directory when it's read only, such as when models are baked into a
+// container image. Checking whether a blob exists is still allowed.
+func readOnlyMiddleware(readOnly bool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if readOnly && c.Request.Method != http.MethodHead && slices.Contains(readOnlyEndpoints, c.FullPath()) {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": fmt.Sprintf("%s: %s isn't allowed", errReadOnly, c.FullPath())})
+			return
+		}
+
+		c.Next()
+	}
+}
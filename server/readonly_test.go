@@ -0,0 +1,63 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestReadOnlyMiddleware(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	router := gin.New()
+	router.Use(readOnlyMiddleware(true))
+	for _, path := range []string{"/api/pull", "/api/delete", "/api/blobs/:digest", "/api/chat"} {
+		router.Handle(http.MethodPost, path, func(c *gin.Context) { c.Status(http.StatusOK) })
+	}
+	router.HEAD("/api/blobs/:digest", func(c *gin.Context) { c.Status(http.StatusOK) })
+
+	cases := []struct {
+		method, path string
+		status       int
+	}{
+		{http.MethodPost, "/api/pull", http.StatusForbidden},
+		{http.MethodPost, "/api/delete", http.StatusForbidden},
+		{http.MethodPost, "/api/blobs/sha256-abc", http.StatusForbidden},
+		{http.MethodHead, "/api/blobs/sha256-abc", http.StatusOK},
+		{http.MethodPost, "/api/chat", http.StatusOK},
+	}
+
+	for _, tt := range cases {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(tt.method, tt.path, nil))
+		if w.Code != tt.status {
+			t.Errorf("%s %s: expected status code %d, actual %d", tt.method, tt.path, tt.status, w.Code)
+		}
+	}
+}
+
+func TestCheckBlobReadOnly(t *testing.T) {
+	p := t.TempDir()
+	t.Setenv("OLLAMA_MODELS", p)
+	t.Setenv("OLLAMA_READ_ONLY", "1")
+
+	layer, err := NewLayer(bytes.NewReader([]byte("blob")), "application/vnd.ollama.image.model")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := checkBlob(layer); err != nil {
+		t.Fatal(err)
+	}
+
+	// nothing is recorded in a read only models directory
+	if _, err := os.Stat(filepath.Join(p, "verified")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected no sampled digests, got %v", err)
+	}
+}
@@ -0,0 +1,130 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/llm"
+)
+
+// reasoningEfforts are the most tokens a reasoning model thinks for at each
+// reasoning effort, where -1 is unlimited
+var reasoningEfforts = map[string]int{
+	"none":   0,
+	"low":    1024,
+	"medium": 4096,
+	"high":   -1,
+}
+
+// thinkingBudget limits how many tokens a reasoning model thinks for before
+// it answers, without a limit if tokens is -1
+type thinkingBudget struct {
+	think  *thinkProcessor
+	tokens int
+}
+
+// newThinkingBudget returns the budget set with the reasoning_effort or
+// max_thinking_tokens options, or nil if neither is set. Either sets the
+// model apart as a reasoning model, so a think processor is added to procs
+// to separate its thinking if it doesn't have one.
+func newThinkingBudget(opts api.Options, procs *processors) (*thinkingBudget, error) {
+	if opts.MaxThinkingTokens == 0 && opts.ReasoningEffort == "" {
+		return nil, nil
+	}
+
+	tokens := -1
+	if opts.MaxThinkingTokens < 0 {
+		return nil, errors.New("max_thinking_tokens must be positive")
+	} else if opts.MaxThinkingTokens > 0 {
+		tokens = opts.MaxThinkingTokens
+	} else if opts.ReasoningEffort != "" {
+		var ok bool
+		if tokens, ok = reasoningEfforts[opts.ReasoningEffort]; !ok {
+			return nil, fmt.Errorf("reasoning_effort must be \"none\", \"low\", \"medium\" or \"high\", got %q", opts.ReasoningEffort)
+		}
+	}
+
+	for _, p := range *procs {
+		if t, ok := p.(*thinkProcessor); ok {
+			return &thinkingBudget{think: t, tokens: tokens}, nil
+		}
+	}
+
+	t := &thinkProcessor{open: "<think>", close: "</think>"}
+	*procs = append(processors{t}, *procs...)
+	return &thinkingBudget{think: t, tokens: tokens}, nil
+}
+
+// complete runs a completion within the budget. Once the model has thought
+// for as many tokens as it can, its thinking is closed and it's prompted to
+// continue from there, which reuses the prompt cache, so it answers instead.
+// Without any budget, the thinking is closed before the model starts.
+func (b *thinkingBudget) complete(ctx context.Context, r llm.LlamaServer, req llm.CompletionRequest, fn func(llm.CompletionResponse)) error {
+	if b == nil || b.tokens < 0 {
+		return r.Completion(ctx, req, fn)
+	}
+
+	end := b.think.close + "\n\n"
+	if b.tokens == 0 {
+		if err := appendPrompt(ctx, r, &req, b.think.open+"\n\n"+end); err != nil {
+			return err
+		}
+
+		return r.Completion(ctx, req, fn)
+	}
+
+	thinkingCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var sb strings.Builder
+	var thought int
+	var truncated bool
+	err := r.Completion(thinkingCtx, req, func(cr llm.CompletionResponse) {
+		if truncated {
+			return
+		}
+
+		sb.WriteString(cr.Content)
+		fn(cr)
+
+		if b.think.state == thinkInside && !cr.Done {
+			if thought++; thought >= b.tokens {
+				truncated = true
+				cancel()
+			}
+		}
+	})
+	if !truncated || ctx.Err() != nil {
+		return err
+	}
+
+	fn(llm.CompletionResponse{Content: end})
+
+	if err := appendPrompt(ctx, r, &req, sb.String()+end); err != nil {
+		return err
+	}
+
+	req.DiscardSamples = 0
+	return r.Completion(ctx, req, fn)
+}
+
+// appendPrompt appends s to the prompt of req, tokenizing it if the prompt is
+// token ids
+func appendPrompt(ctx context.Context, r llm.LlamaServer, req *llm.CompletionRequest, s string) error {
+	if req.Tokens == nil {
+		req.Prompt += s
+		return nil
+	}
+
+	tokens, err := r.Tokenize(ctx, s)
+	if err != nil {
+		return err
+	}
+
+	req.Tokens = append(slices.Clip(req.Tokens), tokens...)
+	return nil
+}
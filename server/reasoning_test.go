@@ -0,0 +1,92 @@
+package server
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/llm"
+)
+
+func TestThinkingBudget(t *testing.T) {
+	cases := []struct {
+		name     string
+		opts     api.Options
+		prompts  []string
+		content  string
+		thinking string
+	}{
+		{
+			name:     "unlimited",
+			opts:     api.Options{ReasoningEffort: "high"},
+			prompts:  []string{"Q:"},
+			content:  "A",
+			thinking: "a a a a a",
+		},
+		{
+			name:     "truncated",
+			opts:     api.Options{MaxThinkingTokens: 3},
+			prompts:  []string{"Q:", "Q:<think> a a</think>\n\n"},
+			content:  "A",
+			thinking: " a a",
+		},
+		{
+			name:    "none",
+			opts:    api.Options{ReasoningEffort: "none"},
+			prompts: []string{"Q:<think>\n\n</think>\n\n"},
+			content: "A",
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			var prompts []string
+			mock := mockRunner{CompletionFn: func(ctx context.Context, r llm.CompletionRequest, fn func(llm.CompletionResponse)) error {
+				prompts = append(prompts, r.Prompt)
+				if !strings.HasSuffix(r.Prompt, "</think>\n\n") {
+					fn(llm.CompletionResponse{Content: "<think>"})
+					for range 5 {
+						if ctx.Err() != nil {
+							return ctx.Err()
+						}
+						fn(llm.CompletionResponse{Content: " a"})
+					}
+					fn(llm.CompletionResponse{Content: "</think>"})
+				}
+				fn(llm.CompletionResponse{Content: "A", Done: true})
+				return nil
+			}}
+
+			var procs processors
+			budget, err := newThinkingBudget(tt.opts, &procs)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var got processed
+			if err := budget.complete(context.Background(), &mock, llm.CompletionRequest{Prompt: "Q:"}, func(cr llm.CompletionResponse) {
+				p := procs.process(cr.Content, cr.Done)
+				got.Content += p.Content
+				got.Thinking += p.Thinking
+			}); err != nil {
+				t.Fatal(err)
+			}
+
+			if diff := cmp.Diff(prompts, tt.prompts); diff != "" {
+				t.Errorf("prompts mismatch (-got +want):\n%s", diff)
+			}
+
+			if got.Content != tt.content || strings.TrimSpace(got.Thinking) != strings.TrimSpace(tt.thinking) {
+				t.Errorf("expected content %q and thinking %q, got %q and %q", tt.content, tt.thinking, got.Content, got.Thinking)
+			}
+		})
+	}
+
+	var procs processors
+	if _, err := newThinkingBudget(api.Options{ReasoningEffort: "extreme"}, &procs); err == nil {
+		t.Error("expected an error for an unknown reasoning effort")
+	}
+}
@@ -0,0 +1,129 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/ollama/ollama/envconfig"
+)
+
+// serverConfig is the configuration the server reads from the files named
+// by OLLAMA_TLS_CLIENT_POLICY, OLLAMA_POLICY, OLLAMA_TENANTS and
+// OLLAMA_UPSTREAMS. It's read again when the server is reloaded, and
+// replaced as a whole. Requests in progress keep the tenant they were
+// authenticated as.
+type serverConfig struct {
+	// clientPolicy authorizes requests made with client certificates
+	clientPolicy clientPolicy
+
+	// policy restricts models and endpoints
+	policy *policy
+
+	// tenants authenticates clients by API key and limits the models they
+	// see
+	tenants *tenants
+
+	// upstreams are the APIs chat requests are proxied to
+	upstreams upstreams
+
+	clientAuth, tenantAuth, authorize gin.HandlerFunc
+}
+
+func newConfig(cp clientPolicy, p *policy, ts *tenants, us upstreams) *serverConfig {
+	return &serverConfig{
+		clientPolicy: cp,
+		policy:       p,
+		tenants:      ts,
+		upstreams:    us,
+		clientAuth:   clientAuthMiddleware(cp),
+		tenantAuth:   tenantMiddleware(ts),
+		authorize:    policyMiddleware(p),
+	}
+}
+
+func loadConfig() (*serverConfig, error) {
+	cp, err := loadClientPolicy(envconfig.TLSClientPolicy())
+	if err != nil {
+		return nil, fmt.Errorf("OLLAMA_TLS_CLIENT_POLICY: %w", err)
+	}
+
+	p, err := loadPolicy(envconfig.Policy())
+	if err != nil {
+		return nil, fmt.Errorf("OLLAMA_POLICY: %w", err)
+	}
+
+	ts, err := loadTenants(envconfig.Tenants())
+	if err != nil {
+		return nil, fmt.Errorf("OLLAMA_TENANTS: %w", err)
+	}
+
+	us, err := loadUpstreams(envconfig.Upstreams())
+	if err != nil {
+		return nil, fmt.Errorf("OLLAMA_UPSTREAMS: %w", err)
+	}
+
+	// clients only have identities with client certificates, so without them
+	// these would silently grant nothing
+	if envconfig.TLSClientCA() == "" {
+		if cp != nil {
+			return nil, errors.New("OLLAMA_TLS_CLIENT_POLICY requires OLLAMA_TLS_CLIENT_CA")
+		}
+
+		if identities := p.identities(); len(identities) > 0 {
+			return nil, fmt.Errorf("OLLAMA_POLICY: endpoints granted to %s require OLLAMA_TLS_CLIENT_CA", strings.Join(identities, ", "))
+		}
+	}
+
+	return newConfig(cp, p, ts, us), nil
+}
+
+// config returns the server's current configuration
+func (s *Server) config() *serverConfig {
+	if c := s.cfg.Load(); c != nil {
+		return c
+	}
+
+	return &serverConfig{}
+}
+
+// configMiddleware runs the middleware of the server's current configuration
+// returned by fn
+func (s *Server) configMiddleware(fn func(*serverConfig) gin.HandlerFunc) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		fn(s.config())(c)
+	}
+}
+
+// reload reads the server's configuration again, keeping the current one if
+// any of it is invalid. Loaded models and requests in progress aren't
+// affected.
+func (s *Server) reload() error {
+	cfg, err := loadConfig()
+	if err != nil {
+		return err
+	}
+
+	cfg.tenants.keepModels(s.config().tenants)
+	s.cfg.Store(cfg)
+	slog.Info("reloaded configuration")
+	return nil
+}
+
+func (s *Server) ReloadHandler(c *gin.Context) {
+	if !isLocalRequest(c.Request) {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "the configuration can only be reloaded by local clients"})
+		return
+	}
+
+	if err := s.reload(); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.Status(http.StatusOK)
+}
@@ -0,0 +1,138 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/ollama/ollama/types/model"
+)
+
+func TestReload(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+
+	p := filepath.Join(t.TempDir(), "tenants.json")
+	t.Setenv("OLLAMA_TENANTS", p)
+
+	write := func(tenants string) {
+		t.Helper()
+		if err := os.WriteFile(p, []byte(tenants), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write(`{"team-a": {"keys": ["old"]}}`)
+
+	var s Server
+	s.cfg.Store(newConfig(nil, nil, nil, nil))
+	if err := s.reload(); err != nil {
+		t.Fatal(err)
+	}
+
+	router := gin.New()
+	router.Use(s.configMiddleware(func(c *serverConfig) gin.HandlerFunc { return c.tenantAuth }))
+	router.GET("/api/tags", func(c *gin.Context) { c.Status(http.StatusOK) })
+	router.POST("/api/reload", s.ReloadHandler)
+
+	request := func(method, path, key, remote string) int {
+		t.Helper()
+		req := httptest.NewRequest(method, path, nil)
+		req.RemoteAddr = remote
+		if key != "" {
+			req.Header.Set("Authorization", "Bearer "+key)
+		}
+
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	if code := request(http.MethodGet, "/api/tags", "old", "192.0.2.1:1234"); code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", code)
+	}
+
+	write(`{"team-a": {"keys": ["new"]}}`)
+
+	old := s.config().tenants.tenants["team-a"]
+
+	if code := request(http.MethodPost, "/api/reload", "old", "192.0.2.1:1234"); code != http.StatusForbidden {
+		t.Errorf("expected remote reloads to be forbidden, got %d", code)
+	}
+
+	if code := request(http.MethodPost, "/api/reload", "", "127.0.0.1:1234"); code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", code)
+	}
+
+	for key, status := range map[string]int{"old": http.StatusUnauthorized, "new": http.StatusOK} {
+		if code := request(http.MethodGet, "/api/tags", key, "192.0.2.1:1234"); code != status {
+			t.Errorf("%s: expected status %d, got %d", key, status, code)
+		}
+	}
+
+	// models added by requests that authenticated before the reload are kept
+	if err := old.add(model.ParseName("team-a/mymodel")); err != nil {
+		t.Fatal(err)
+	}
+
+	if !s.config().tenants.tenants["team-a"].owns(model.ParseName("team-a/mymodel")) {
+		t.Error("expected the tenant to keep its models")
+	}
+
+	// an invalid configuration keeps the current one
+	write(`{"team-a": {"keys": [""]}}`)
+
+	if code := request(http.MethodPost, "/api/reload", "", "127.0.0.1:1234"); code != http.StatusBadRequest {
+		t.Errorf("expected status 400, got %d", code)
+	}
+
+	if code := request(http.MethodGet, "/api/tags", "new", "192.0.2.1:1234"); code != http.StatusOK {
+		t.Errorf("expected status 200, got %d", code)
+	}
+}
+
+func TestLoadConfigClientCA(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) string {
+		t.Helper()
+		p := filepath.Join(dir, name)
+		if err := os.WriteFile(p, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+
+	policy := write("policy.json", `{"endpoints": {"/api/pull": ["local", "build-server"]}}`)
+	local := write("local.json", `{"endpoints": {"/api/pull": ["local"], "/api/create": ["*"]}}`)
+	clientPolicy := write("client-policy.json", `{"*": ["read"]}`)
+	ca := write("ca.pem", "")
+
+	cases := []struct {
+		name                 string
+		policy, clientPolicy string
+		clientCA             string
+		expectErr            bool
+	}{
+		{"identities without client ca", policy, "", "", true},
+		{"identities with client ca", policy, "", ca, false},
+		{"local and any client without client ca", local, "", "", false},
+		{"client policy without client ca", "", clientPolicy, "", true},
+		{"client policy with client ca", "", clientPolicy, ca, false},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("OLLAMA_POLICY", tt.policy)
+			t.Setenv("OLLAMA_TLS_CLIENT_POLICY", tt.clientPolicy)
+			t.Setenv("OLLAMA_TLS_CLIENT_CA", tt.clientCA)
+
+			if _, err := loadConfig(); (err != nil) != tt.expectErr {
+				t.Errorf("expected error %t, got %v", tt.expectErr, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,172 @@
+package server
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/sync/errgroup"
+
+	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/llm"
+	"github.com/ollama/ollama/template"
+	"github.com/ollama/ollama/types/model"
+)
+
+// rewardHead is the head used to score responses unless the request names
+// another
+const rewardHead = "reward"
+
+// rewardHead returns the reward head called name of m, which must have a
+// single output
+func (m *Model) rewardHead(name string) (*outputHead, error) {
+	h, err := m.Head(cmp.Or(name, rewardHead))
+	if err != nil {
+		return nil, err
+	}
+
+	if outputs := len(h.weight) / h.embedSize; outputs != 1 {
+		return nil, fmt.Errorf("head %q has %d outputs, a reward head must have 1", h.Name, outputs)
+	}
+
+	return h, nil
+}
+
+// rewardPrompt renders a prompt and response as a conversation with the
+// model's template
+func rewardPrompt(m *Model, system, prompt, response string) (string, error) {
+	var msgs []api.Message
+	if system := cmp.Or(system, m.System); system != "" {
+		msgs = append(msgs, api.Message{Role: "system", Content: system})
+	}
+
+	msgs = append(msgs,
+		api.Message{Role: "user", Content: prompt},
+		api.Message{Role: "assistant", Content: response},
+	)
+
+	var b strings.Builder
+	if err := m.Template.Execute(&b, template.Values{Messages: msgs}); err != nil {
+		return "", err
+	}
+
+	return b.String(), nil
+}
+
+// score runs each prompt through r and returns the rewards from head, and the
+// total number of prompt tokens evaluated
+func score(ctx context.Context, r llm.LlamaServer, opts *api.Options, head *outputHead, prompts []string) ([]float32, int, error) {
+	var count atomic.Int64
+	var g errgroup.Group
+	scores := make([]float32, len(prompts))
+	for i, prompt := range prompts {
+		g.Go(func() error {
+			var hidden []float32
+			if err := r.Completion(ctx, llm.CompletionRequest{
+				Prompt:  prompt,
+				Options: opts,
+				Return:  "hidden_states",
+			}, func(cr llm.CompletionResponse) {
+				hidden = cr.HiddenStates
+				count.Add(int64(cr.PromptEvalCount))
+			}); err != nil {
+				return err
+			}
+
+			s, err := head.apply(hidden)
+			if err != nil {
+				return err
+			}
+
+			scores[i] = s[0]
+			return nil
+		})
+	}
+
+	if err := g.Wait(); err != nil {
+		return nil, 0, err
+	}
+
+	return scores, int(count.Load()), nil
+}
+
+func (s *Server) RewardHandler(c *gin.Context) {
+	checkpointStart := time.Now()
+	var req api.RewardRequest
+	err := c.ShouldBindJSON(&req)
+	switch {
+	case errors.Is(err, io.EOF):
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "missing request body"})
+		return
+	case err != nil:
+		c.AbortWithStatusJSON(bindStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+
+	name, err := getExistingName(model.ParseName(req.Model))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("model '%s' not found", req.Model)})
+		return
+	}
+
+	if err := tenantFromContext(c.Request.Context()).checkModel(name); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("model '%s' not found", req.Model)})
+		return
+	}
+
+	m, err := GetModel(name.String())
+	if errors.Is(err, fs.ErrNotExist) {
+		c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("model '%s' not found", req.Model)})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	head, err := m.rewardHead(req.Head)
+	if errors.Is(err, errHeadNotFound) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("%q does not have a head %q", req.Model, cmp.Or(req.Head, rewardHead))})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	r, m, opts, err := s.scheduleRunner(c.Request.Context(), name.String(), []Capability{}, req.Options, req.KeepAlive)
+	if err != nil {
+		handleScheduleError(c, req.Model, err)
+		return
+	}
+
+	checkpointLoaded := time.Now()
+
+	prompts := make([]string, len(req.Responses))
+	for i, response := range req.Responses {
+		if prompts[i], err = rewardPrompt(m, req.System, req.Prompt, response); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	scores, count, err := score(c.Request.Context(), r, opts, head, prompts)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("failed to score responses: %v", err)})
+		return
+	}
+
+	c.JSON(http.StatusOK, api.RewardResponse{
+		Model:           req.Model,
+		Scores:          scores,
+		TotalDuration:   time.Since(checkpointStart),
+		LoadDuration:    checkpointLoaded.Sub(checkpointStart),
+		PromptEvalCount: count,
+	})
+}
@@ -0,0 +1,180 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/discover"
+	"github.com/ollama/ollama/llm"
+	"github.com/ollama/ollama/template"
+)
+
+func TestReward(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+
+	mock := mockRunner{
+		CompletionFn: func(ctx context.Context, r llm.CompletionRequest, fn func(llm.CompletionResponse)) error {
+			// the hidden state is 1 for a good response and 0 otherwise
+			hidden := make([]float32, 4096)
+			if strings.Contains(r.Prompt, "assistant: good") {
+				for i := range hidden {
+					hidden[i] = 1
+				}
+			}
+
+			fn(llm.CompletionResponse{Done: true, PromptEvalCount: 3, HiddenStates: hidden})
+			return nil
+		},
+	}
+
+	s := Server{
+		sched: &Scheduler{
+			pendingReqCh:  make(chan *LlmRequest, 1),
+			finishedReqCh: make(chan *LlmRequest, 1),
+			expiredCh:     make(chan *runnerRef, 1),
+			unloadedCh:    make(chan any, 1),
+			loaded:        make(map[string]*runnerRef),
+			newServerFn:   newMockServer(&mock),
+			getGpuFn:      discover.GetGPUInfo,
+			getCpuFn:      discover.GetCPUInfo,
+			reschedDelay:  250 * time.Millisecond,
+			loadFn: func(req *LlmRequest, ggml *llm.GGML, gpus discover.GpuInfoList, numParallel int) {
+				req.successCh <- &runnerRef{
+					llama: &mock,
+				}
+			},
+		},
+	}
+
+	go s.sched.Run(context.TODO())
+
+	kv := llm.KV{
+		"general.architecture":          "llama",
+		"llama.block_count":             uint32(1),
+		"llama.context_length":          uint32(8192),
+		"llama.embedding_length":        uint32(4096),
+		"llama.attention.head_count":    uint32(32),
+		"llama.attention.head_count_kv": uint32(8),
+		"tokenizer.ggml.tokens":         []string{""},
+		"tokenizer.ggml.scores":         []float32{0},
+		"tokenizer.ggml.token_type":     []int32{0},
+	}
+
+	weight := make([]float32, 4096)
+	for i := range weight {
+		weight[i] = 0.5
+	}
+
+	w := createRequest(t, s.CreateHandler, api.CreateRequest{
+		Model: "test",
+		Modelfile: fmt.Sprintf("FROM %s\nTEMPLATE \"{{ range .Messages }}{{ .Role }}: {{ .Content }}\n{{ end }}\"\nHEAD %s",
+			createBinFile(t, kv, []llm.Tensor{
+				{Name: "token_embd.weight", Shape: []uint64{1}, WriterTo: bytes.NewReader(make([]byte, 4))},
+			}),
+			createHeadFile(t, llm.KV{"general.architecture": "llama", "head.name": "reward"}, [][]float32{weight}),
+		),
+		Stream: &stream,
+	})
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+
+	t.Run("score", func(t *testing.T) {
+		w := createRequest(t, s.RewardHandler, api.RewardRequest{
+			Model:     "test",
+			Prompt:    "Hello!",
+			Responses: []string{"bad", "good", "worse"},
+		})
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+
+		var resp api.RewardResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+
+		if diff := cmp.Diff(resp.Scores, []float32{1, 2049, 1}); diff != "" {
+			t.Errorf("mismatch (-got +want):\n%s", diff)
+		}
+
+		if resp.PromptEvalCount != 9 {
+			t.Errorf("expected prompt eval count 9, got %d", resp.PromptEvalCount)
+		}
+	})
+
+	t.Run("prompt", func(t *testing.T) {
+		tmpl, err := template.Parse("{{ range .Messages }}{{ .Role }}: {{ .Content }}\n{{ end }}")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		got, err := rewardPrompt(&Model{Template: tmpl}, "Be brief.", "Hello!", "Hi.")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if diff := cmp.Diff(got, "system: Be brief.\nuser: Hello!\nassistant: Hi.\n"); diff != "" {
+			t.Errorf("mismatch (-got +want):\n%s", diff)
+		}
+	})
+
+	t.Run("missing head", func(t *testing.T) {
+		w := createRequest(t, s.RewardHandler, api.RewardRequest{
+			Model:     "test",
+			Prompt:    "Hello!",
+			Responses: []string{"good"},
+			Head:      "sentiment",
+		})
+
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("expected status 400, got %d", w.Code)
+		}
+
+		if diff := cmp.Diff(w.Body.String(), `{"error":"\"test\" does not have a head \"sentiment\""}`); diff != "" {
+			t.Errorf("mismatch (-got +want):\n%s", diff)
+		}
+	})
+
+	t.Run("other tenant's model", func(t *testing.T) {
+		// the model's heads aren't revealed to tenants that can't use it
+		w := createRequest(t, func(c *gin.Context) {
+			c.Request = c.Request.WithContext(context.WithValue(c.Request.Context(), tenantKey{}, &tenant{name: "team-a", models: &tenantModels{}}))
+			s.RewardHandler(c)
+		}, api.RewardRequest{
+			Model:     "test",
+			Prompt:    "Hello!",
+			Responses: []string{"good"},
+			Head:      "sentiment",
+		})
+
+		if w.Code != http.StatusNotFound {
+			t.Errorf("expected status 404, got %d: %s", w.Code, w.Body.String())
+		}
+	})
+
+	t.Run("missing model", func(t *testing.T) {
+		w := createRequest(t, s.RewardHandler, api.RewardRequest{
+			Model:     "missing",
+			Prompt:    "Hello!",
+			Responses: []string{"good"},
+		})
+
+		if w.Code != http.StatusNotFound {
+			t.Errorf("expected status 404, got %d", w.Code)
+		}
+	})
+}
@@ -11,6 +11,7 @@ import (
 	"io"
 	"io/fs"
 	"log/slog"
+	"maps"
 	"math"
 	"net"
 	"net/http"
@@ -20,18 +21,20 @@ import (
 	"path/filepath"
 	"slices"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
-	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
 	"golang.org/x/sync/errgroup"
 
 	"github.com/ollama/ollama/api"
 	"github.com/ollama/ollama/discover"
 	"github.com/ollama/ollama/envconfig"
+	"github.com/ollama/ollama/llama"
 	"github.com/ollama/ollama/llm"
-	"github.com/ollama/ollama/model/mllama"
+	"github.com/ollama/ollama/logutil"
 	"github.com/ollama/ollama/openai"
 	"github.com/ollama/ollama/parser"
 	"github.com/ollama/ollama/runners"
@@ -44,8 +47,22 @@ import (
 var mode string = gin.DebugMode
 
 type Server struct {
-	addr  net.Addr
-	sched *Scheduler
+	addr     net.Addr
+	sched    *Scheduler
+	calendar *calendar
+	cors     *corsPolicies
+	limits   *endpointLimits
+
+	// cfg is the configuration that's read again when the server is
+	// reloaded, returned by config
+	cfg atomic.Pointer[serverConfig]
+
+	// sessions are the chat conversations kept between requests
+	sessions sessions
+
+	// deleting holds the lowercased names of models being deleted, which
+	// can't be scheduled
+	deleting sync.Map
 }
 
 func init() {
@@ -61,20 +78,74 @@ func init() {
 }
 
 var (
-	errRequired    = errors.New("is required")
-	errBadTemplate = errors.New("template error")
+	errRequired      = errors.New("is required")
+	errBadTemplate   = errors.New("template error")
+	errModelDeleting = errors.New("is being deleted")
+	errBadOption     = errors.New("invalid option")
 )
 
+// maxTraceSampling is the most candidates that can be traced for each token
+const maxTraceSampling = 20
+
+// maxTopLogprobs is the most alternatives that can be returned for each token
+const maxTopLogprobs = 20
+
 func modelOptions(model *Model, requestOpts map[string]interface{}) (api.Options, error) {
 	opts := api.DefaultOptions()
 	if err := opts.FromMap(model.Options); err != nil {
 		return api.Options{}, err
 	}
 
+	// requests add to what the model bans and biases rather than replacing it
+	ban, banTokens, logitBias := opts.Ban, opts.BanTokens, opts.LogitBias
+
 	if err := opts.FromMap(requestOpts); err != nil {
 		return api.Options{}, err
 	}
 
+	opts.Ban = slices.Concat(ban, slices.DeleteFunc(slices.Clone(opts.Ban), func(s string) bool {
+		return slices.Contains(ban, s)
+	}))
+	opts.BanTokens = slices.Concat(banTokens, slices.DeleteFunc(slices.Clone(opts.BanTokens), func(t int) bool {
+		return slices.Contains(banTokens, t)
+	}))
+	if logitBias != nil && opts.LogitBias != nil {
+		requested := opts.LogitBias
+		opts.LogitBias = maps.Clone(logitBias)
+		maps.Copy(opts.LogitBias, requested)
+	}
+
+	for _, o := range []struct{ name, cacheType string }{{"cache_type_k", opts.CacheTypeK}, {"cache_type_v", opts.CacheTypeV}} {
+		if o.cacheType != "" && !slices.Contains(llm.KVCacheTypes, strings.ToLower(o.cacheType)) {
+			return api.Options{}, fmt.Errorf("%w: %s must be one of %s", errBadOption, o.name, strings.Join(llm.KVCacheTypes, ", "))
+		}
+	}
+
+	if opts.RopeScalingType != "" && !slices.Contains(llm.RopeScalingTypes, opts.RopeScalingType) {
+		return api.Options{}, fmt.Errorf("%w: rope_scaling_type must be one of %s", errBadOption, strings.Join(llm.RopeScalingTypes, ", "))
+	}
+
+	if opts.DynatempRange < 0 {
+		return api.Options{}, fmt.Errorf("%w: dynatemp_range can't be negative", errBadOption)
+	}
+
+	if opts.DynatempRange > 0 && opts.DynatempExponent <= 0 {
+		return api.Options{}, fmt.Errorf("%w: dynatemp_exponent must be positive", errBadOption)
+	}
+
+	for i, name := range opts.SamplerOrder {
+		if _, ok := llama.Samplers[name]; !ok {
+			samplers := slices.Sorted(maps.Keys(llama.Samplers))
+			return api.Options{}, fmt.Errorf("%w: sampler_order %q isn't one of %s", errBadOption, name, strings.Join(samplers, ", "))
+		} else if slices.Contains(opts.SamplerOrder[:i], name) {
+			return api.Options{}, fmt.Errorf("%w: sampler_order has %s more than once", errBadOption, name)
+		}
+	}
+
+	if opts.Grammar != "" && !llama.ValidGrammar(opts.Grammar) {
+		return api.Options{}, fmt.Errorf("%w: grammar isn't a valid GBNF grammar with a root rule", errBadOption)
+	}
+
 	return opts, nil
 }
 
@@ -85,11 +156,37 @@ func (s *Server) scheduleRunner(ctx context.Context, name string, caps []Capabil
 		return nil, nil, nil, fmt.Errorf("model %w", errRequired)
 	}
 
+	if s.calendar.Quiet(time.Now()) {
+		return nil, nil, nil, errQuietHours
+	}
+
+	n := model.ParseName(name)
+	if _, ok := s.deleting.Load(strings.ToLower(n.String())); ok {
+		return nil, nil, nil, fmt.Errorf("%s %w", name, errModelDeleting)
+	}
+
+	t := tenantFromContext(ctx)
+	if err := t.checkModel(n); err != nil {
+		return nil, nil, nil, err
+	}
+
 	model, err := GetModel(name)
 	if err != nil {
 		return nil, nil, nil, err
 	}
 
+	if err := checkModelBlobs(ParseModelPath(name)); err != nil {
+		return nil, nil, nil, err
+	}
+
+	if err := t.checkVRAM(s.sched, n, model); err != nil {
+		return nil, nil, nil, err
+	}
+
+	if err := s.config().policy.checkConfig(n, model.Config); err != nil {
+		return nil, nil, nil, err
+	}
+
 	if err := model.CheckCapabilities(caps...); err != nil {
 		return nil, nil, nil, fmt.Errorf("%s %w", name, err)
 	}
@@ -99,6 +196,12 @@ func (s *Server) scheduleRunner(ctx context.Context, name string, caps []Capabil
 		return nil, nil, nil, err
 	}
 
+	if opts.Adapter != "" {
+		if model.RuntimeAdapterPaths, err = runtimeAdapters(t, model, opts.Adapter); err != nil {
+			return nil, nil, nil, err
+		}
+	}
+
 	runnerCh, errCh := s.sched.GetRunner(ctx, model, opts, keepAlive)
 	var runner *runnerRef
 	select {
@@ -107,16 +210,37 @@ func (s *Server) scheduleRunner(ctx context.Context, name string, caps []Capabil
 		return nil, nil, nil, err
 	}
 
+	// the runner may have been loaded with a smaller context to fit in memory
+	if runner.requestedNumCtx != 0 && runner.numParallel > 0 {
+		opts.NumCtx = runner.Options.NumCtx / runner.numParallel
+	}
+
 	return runner.llama, model, &opts, nil
 }
 
+// reducedContext returns the context length of opts, as returned by
+// scheduleRunner, if it's less than the one requested with requestOpts
+func reducedContext(m *Model, requestOpts map[string]any, opts *api.Options) int {
+	requested, err := modelOptions(m, requestOpts)
+	if err != nil || opts.NumCtx >= requested.NumCtx {
+		return 0
+	}
+
+	return opts.NumCtx
+}
+
 func (s *Server) GenerateHandler(c *gin.Context) {
 	checkpointStart := time.Now()
 	var req api.GenerateRequest
-	if err := c.ShouldBindJSON(&req); errors.Is(err, io.EOF) {
+	if err := bindRequest(c, &req); errors.Is(err, io.EOF) {
 		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "missing request body"})
 		return
 	} else if err != nil {
+		c.AbortWithStatusJSON(bindStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := bindMetadata(c, req.Metadata); err != nil {
 		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
@@ -137,6 +261,13 @@ func (s *Server) GenerateHandler(c *gin.Context) {
 		return
 	}
 
+	if err := tenantFromContext(c.Request.Context()).checkModel(name); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("model '%s' not found", req.Model)})
+		return
+	}
+
+	c.Header(affinityHeader, affinityToken(tenantFromContext(c.Request.Context()), name.String(), "", req.System+req.Prompt))
+
 	model, err := GetModel(name.String())
 	if err != nil {
 		switch {
@@ -151,7 +282,7 @@ func (s *Server) GenerateHandler(c *gin.Context) {
 	}
 
 	// expire the runner
-	if req.Prompt == "" && req.KeepAlive != nil && int(req.KeepAlive.Seconds()) == 0 {
+	if req.Prompt == "" && req.Prompts == nil && req.InputTokens == nil && req.KeepAlive != nil && int(req.KeepAlive.Seconds()) == 0 {
 		s.sched.expireRunner(model)
 
 		c.JSON(http.StatusOK, api.GenerateResponse{
@@ -160,6 +291,7 @@ func (s *Server) GenerateHandler(c *gin.Context) {
 			Response:   "",
 			Done:       true,
 			DoneReason: "unload",
+			Metadata:   req.Metadata,
 		})
 		return
 	}
@@ -169,12 +301,114 @@ func (s *Server) GenerateHandler(c *gin.Context) {
 		return
 	}
 
+	if req.InputTokens != nil && (req.Prompt != "" || req.Suffix != "" || req.Template != "" || req.System != "" || len(req.Context) > 0 || len(req.Images) > 0 || req.Reranker != "") {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "input_tokens can't be used with prompt, suffix, template, system, context, images or reranker"})
+		return
+	}
+
+	switch req.Return {
+	case "":
+	case "logits", "hidden_states":
+		if !isLocalRequest(c.Request) {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": fmt.Sprintf("return %q is only available to local clients", req.Return)})
+			return
+		}
+	default:
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("invalid return %q; expected \"logits\" or \"hidden_states\"", req.Return)})
+		return
+	}
+
+	if req.TraceSampling < 0 || req.TraceSampling > maxTraceSampling {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("trace_sampling must be between 0 and %d", maxTraceSampling)})
+		return
+	}
+
+	if req.PositionOffset < 0 || req.PositionOffset > llama.MaxPos {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("position_offset must be between 0 and %d", llama.MaxPos)})
+		return
+	}
+
+	if req.TopLogprobs < 0 || req.TopLogprobs > maxTopLogprobs {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("top_logprobs must be between 0 and %d", maxTopLogprobs)})
+		return
+	} else if req.TopLogprobs > 0 && !req.Logprobs {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "top_logprobs requires logprobs"})
+		return
+	}
+
+	if _, err := llm.FormatGrammar(req.Format); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if req.Prompts != nil {
+		s.generateBatch(c, req, name, checkpointStart)
+		return
+	}
+
+	var head *outputHead
+	if req.Head != "" {
+		if req.Return != "" {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "head and return can't be used together"})
+			return
+		}
+
+		head, err = model.Head(req.Head)
+		if errors.Is(err, errHeadNotFound) {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("%q does not have a head %q", req.Model, req.Head)})
+			return
+		} else if err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	var rr *reranker
+	if req.Reranker != "" {
+		rr, err = loadReranker(req.Reranker)
+		switch {
+		case errors.Is(err, fs.ErrNotExist):
+			c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("model '%s' not found", req.Reranker)})
+			return
+		case errors.Is(err, errHeadNotFound):
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("%q is not a reward model", req.Reranker)})
+			return
+		case err != nil:
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	var compression *api.CompressionStats
+	if req.Compressor != "" {
+		if req.Raw || req.InputTokens != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "compressor can't be used with raw or input_tokens"})
+			return
+		}
+
+		cp, err := loadCompressor(req.Compressor, req.CompressionRate)
+		if err != nil {
+			handleScheduleError(c, req.Compressor, err)
+			return
+		}
+
+		if compression, err = s.compress(c.Request.Context(), cp, []*string{&req.Prompt}); err != nil {
+			handleScheduleError(c, req.Compressor, err)
+			return
+		}
+	}
+
 	caps := []Capability{CapabilityCompletion}
 	if req.Suffix != "" {
 		caps = append(caps, CapabilityInsert)
 	}
 
-	r, m, opts, err := s.scheduleRunner(c.Request.Context(), name.String(), caps, req.Options, req.KeepAlive)
+	// the runner is scheduled with a context of its own so it can be released
+	// before a reranker is scheduled, which may need its slot
+	runnerCtx, release := context.WithCancel(c.Request.Context())
+	defer release()
+
+	r, m, opts, err := s.scheduleRunner(runnerCtx, name.String(), caps, req.Options, req.KeepAlive)
 	if errors.Is(err, errCapabilityCompletion) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("%q does not support generate", req.Model)})
 		return
@@ -183,15 +417,44 @@ func (s *Server) GenerateHandler(c *gin.Context) {
 		return
 	}
 
+	numCtx := reducedContext(m, req.Options, opts)
+
+	if opts.BestOf < 0 || opts.BestOf > maxBestOf {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("best_of must be between 1 and %d", maxBestOf)})
+		return
+	} else if opts.BestOf > 1 && (req.Return != "" || head != nil) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "best_of can't be used with head or return"})
+		return
+	} else if opts.BestOf > 1 && (req.TraceSampling > 0 || req.Logprobs || req.ReturnTokens) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "best_of can't be used with trace_sampling, logprobs or return_tokens"})
+		return
+	}
+
+	procs, err := parseProcessors(opts.Processors)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	budget, err := newThinkingBudget(*opts, &procs)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	} else if opts.BestOf > 1 && budget != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "best_of can't be used with reasoning_effort or max_thinking_tokens"})
+		return
+	}
+
 	checkpointLoaded := time.Now()
 
 	// load the model
-	if req.Prompt == "" {
+	if req.Prompt == "" && len(req.InputTokens) == 0 {
 		c.JSON(http.StatusOK, api.GenerateResponse{
 			Model:      req.Model,
 			CreatedAt:  time.Now().UTC(),
 			Done:       true,
 			DoneReason: "load",
+			Metadata:   req.Metadata,
 		})
 		return
 	}
@@ -205,7 +468,7 @@ func (s *Server) GenerateHandler(c *gin.Context) {
 	images := make([]llm.ImageData, len(req.Images))
 	for i := range req.Images {
 		if isMllama {
-			data, opts, err := mllama.Preprocess(bytes.NewReader(req.Images[i]))
+			data, opts, err := mllamaProcessor(model).Preprocess(bytes.NewReader(req.Images[i]))
 			if err != nil {
 				c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "error processing image"})
 				return
@@ -230,8 +493,19 @@ func (s *Server) GenerateHandler(c *gin.Context) {
 		}
 	}
 
+	// raw prompts and suffixes have nothing before the prompt to cache
+	var cached *int
+	if req.Cache != nil && !*req.Cache {
+		cached = new(int)
+	}
+
+	var prefix int
+
+	// token ids are sent as is, like a raw prompt
+	raw := req.Raw || req.InputTokens != nil
+
 	prompt := req.Prompt
-	if !req.Raw {
+	if !raw {
 		tmpl := m.Template
 		if req.Template != "" {
 			tmpl, err = template.Parse(req.Template)
@@ -262,15 +536,15 @@ func (s *Server) GenerateHandler(c *gin.Context) {
 				if isMllama {
 					imgPrompt = "<|image|>"
 				}
-				msgs = append(msgs, api.Message{Role: "user", Content: fmt.Sprintf("[img-%d]"+imgPrompt, i.ID)})
+				msgs = append(msgs, api.Message{Role: "user", Content: fmt.Sprintf("[img-%d]"+imgPrompt, i.ID), Cache: req.Cache})
 			}
 
-			values.Messages = append(msgs, api.Message{Role: "user", Content: req.Prompt})
+			values.Messages = append(msgs, api.Message{Role: "user", Content: req.Prompt, Cache: req.Cache})
 		}
 
 		var b bytes.Buffer
 		if req.Context != nil {
-			slog.Warn("the context field is deprecated and will be removed in a future version of Ollama")
+			slog.WarnContext(c.Request.Context(), "the context field is deprecated and will be removed in a future version of Ollama")
 			s, err := r.Detokenize(c.Request.Context(), req.Context)
 			if err != nil {
 				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
@@ -279,41 +553,197 @@ func (s *Server) GenerateHandler(c *gin.Context) {
 			b.WriteString(s)
 		}
 
+		offset := b.Len()
+		values.Tokenize = countTokens(c.Request.Context(), r.Tokenize)
 		if err := tmpl.Execute(&b, values); err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 			return
 		}
 
 		prompt = b.String()
+
+		if cached != nil && len(values.Messages) > 0 {
+			if cached, err = cacheLength(tmpl, values.Messages, nil, prompt[offset:]); err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+
+			// the context is kept along with the messages before the prompt
+			*cached += offset
+		}
+
+		if envconfig.PrefixCache() > 0 && offset == 0 && len(values.Messages) > 0 {
+			if prefix, err = prefixLength(tmpl, values.Messages, nil, prompt); err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+		}
 	}
 
-	slog.Debug("generate request", "images", len(images), "prompt", prompt)
+	slog.DebugContext(c.Request.Context(), "generate request", "images", len(images), "prompt", prompt)
+
+	if opts.BestOf > 1 {
+		candidates, err := generateCandidates(c.Request.Context(), r, llm.CompletionRequest{
+			Prompt:         prompt,
+			Tokens:         req.InputTokens,
+			Images:         images,
+			Format:         req.Format,
+			Options:        opts,
+			CacheLength:    cached,
+			PrefixLength:   prefix,
+			PositionOffset: req.PositionOffset,
+			Adapters:       m.RuntimeAdapterPaths,
+		}, opts.BestOf, rr == nil)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		if rr != nil {
+			// the runner isn't used once it's released, so the contexts of
+			// the candidates are tokenized first
+			if !raw {
+				for i := range candidates {
+					if candidates[i].context, err = r.Tokenize(c.Request.Context(), prompt+candidates[i].Response); err != nil {
+						c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+						return
+					}
+				}
+			}
+
+			release()
+			if err := s.rerank(c.Request.Context(), rr, req.Prompt, candidates); err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("failed to rerank candidates: %v", err)})
+				return
+			}
+		}
+
+		chosen, metrics := best(candidates)
+		processed := procs.process(chosen.Response, true)
+		res := api.GenerateResponse{
+			Model:      req.Model,
+			CreatedAt:  time.Now().UTC(),
+			Response:   processed.Content,
+			Thinking:   processed.Thinking,
+			Code:       processed.Code,
+			Done:       true,
+			DoneReason: chosen.DoneReason,
+			Metadata:   req.Metadata,
+			Metrics:    metrics,
+		}
+
+		if req.ReturnCandidates {
+			for _, c := range candidates {
+				res.Candidates = append(res.Candidates, c.Candidate)
+			}
+		}
+
+		res.TotalDuration = time.Since(checkpointStart)
+		res.LoadDuration = checkpointLoaded.Sub(checkpointStart)
+		usage.record(m.ShortName, req.Metadata, res.Metrics)
+
+		if res.Context = chosen.context; !raw && rr == nil {
+			if res.Context, err = r.Tokenize(c.Request.Context(), prompt+chosen.Response); err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+		}
+
+		if req.Stream != nil && !*req.Stream {
+			c.JSON(http.StatusOK, res)
+			return
+		}
+
+		ch := make(chan any, 1)
+		ch <- res
+		close(ch)
+		streamResponse(c, ch)
+		return
+	}
 
 	ch := make(chan any)
 	go func() {
 		// TODO (jmorganca): avoid building the response twice both here and below
 		var sb strings.Builder
+		var logprobs []api.Logprob
+		var tokens, offsets []int
 		defer close(ch)
-		if err := r.Completion(c.Request.Context(), llm.CompletionRequest{
-			Prompt:  prompt,
-			Images:  images,
-			Format:  req.Format,
-			Options: opts,
+		ret := req.Return
+		if head != nil {
+			// heads are applied to the final hidden state
+			ret = "hidden_states"
+		}
+
+		if err := budget.complete(c.Request.Context(), r, llm.CompletionRequest{
+			Prompt:         prompt,
+			Tokens:         req.InputTokens,
+			Images:         images,
+			Format:         req.Format,
+			Options:        opts,
+			Return:         ret,
+			CacheLength:    cached,
+			PrefixLength:   prefix,
+			PositionOffset: req.PositionOffset,
+			TraceSampling:  req.TraceSampling,
+			TokenLogprobs:  req.Logprobs,
+			TopLogprobs:    req.TopLogprobs,
+			ReturnTokens:   req.ReturnTokens,
+			Adapters:       m.RuntimeAdapterPaths,
 		}, func(cr llm.CompletionResponse) {
+			var scores []float32
+			if head != nil && cr.Done {
+				var err error
+				if scores, err = head.apply(cr.HiddenStates); err != nil {
+					ch <- gin.H{"error": err.Error()}
+					return
+				}
+
+				cr.HiddenStates = nil
+			}
+
+			if n := max(len(cr.Logits), len(cr.HiddenStates)); n > int(envconfig.MaxRawOutput()) {
+				ch <- gin.H{"error": fmt.Sprintf("raw output of %d values exceeds the limit of %d", n, envconfig.MaxRawOutput()), "status": http.StatusRequestEntityTooLarge}
+				return
+			}
+
+			logprobs = append(logprobs, cr.Logprobs...)
+			tokens = append(tokens, cr.Tokens...)
+			offsets = append(offsets, cr.Offsets...)
+			processed := procs.process(cr.Content, cr.Done)
+			if !cr.Done && processed.Content == "" && processed.Thinking == "" && cr.Content != "" {
+				// held back by a processor
+				return
+			}
+
 			res := api.GenerateResponse{
-				Model:      req.Model,
-				CreatedAt:  time.Now().UTC(),
-				Response:   cr.Content,
-				Done:       cr.Done,
-				DoneReason: cr.DoneReason,
+				Model:        req.Model,
+				CreatedAt:    time.Now().UTC(),
+				Response:     processed.Content,
+				Thinking:     processed.Thinking,
+				Logprobs:     logprobs,
+				Tokens:       tokens,
+				Offsets:      offsets,
+				Done:         cr.Done,
+				DoneReason:   cr.DoneReason,
+				Logits:       cr.Logits,
+				HiddenStates: cr.HiddenStates,
+				Scores:       scores,
 				Metrics: api.Metrics{
 					PromptEvalCount:    cr.PromptEvalCount,
 					PromptEvalDuration: cr.PromptEvalDuration,
+					PromptCachedCount:  cr.PromptCachedCount,
 					EvalCount:          cr.EvalCount,
 					EvalDuration:       cr.EvalDuration,
+					EnergyJoules:       cr.Energy,
 				},
 			}
 
+			if scores != nil {
+				res.Labels = head.Labels
+			}
+
+			logprobs, tokens, offsets = nil, nil, nil
+
 			if _, err := sb.WriteString(cr.Content); err != nil {
 				ch <- gin.H{"error": err.Error()}
 			}
@@ -321,8 +751,14 @@ func (s *Server) GenerateHandler(c *gin.Context) {
 			if cr.Done {
 				res.TotalDuration = time.Since(checkpointStart)
 				res.LoadDuration = checkpointLoaded.Sub(checkpointStart)
-
-				if !req.Raw {
+				res.ContextLength = numCtx
+				res.Metadata = req.Metadata
+				res.SamplingTrace = cr.SamplingTrace
+				res.Compression = compression
+				res.Code = processed.Code
+				usage.record(m.ShortName, req.Metadata, res.Metrics)
+
+				if !raw {
 					tokens, err := r.Tokenize(c.Request.Context(), prompt+sb.String())
 					if err != nil {
 						ch <- gin.H{"error": err.Error()}
@@ -333,18 +769,26 @@ func (s *Server) GenerateHandler(c *gin.Context) {
 			}
 
 			ch <- res
-		}); err != nil {
+		}); errors.Is(err, llm.ErrRawOutputTooLarge) {
+			ch <- gin.H{"error": err.Error(), "status": http.StatusRequestEntityTooLarge}
+		} else if err != nil {
 			ch <- gin.H{"error": err.Error()}
 		}
 	}()
 
 	if req.Stream != nil && !*req.Stream {
 		var r api.GenerateResponse
-		var sb strings.Builder
+		var sb, thinking strings.Builder
+		var logprobs []api.Logprob
+		var tokens, offsets []int
 		for rr := range ch {
 			switch t := rr.(type) {
 			case api.GenerateResponse:
 				sb.WriteString(t.Response)
+				thinking.WriteString(t.Thinking)
+				logprobs = append(logprobs, t.Logprobs...)
+				tokens = append(tokens, t.Tokens...)
+				offsets = append(offsets, t.Offsets...)
 				r = t
 			case gin.H:
 				msg, ok := t["error"].(string)
@@ -352,7 +796,12 @@ func (s *Server) GenerateHandler(c *gin.Context) {
 					msg = "unexpected error format in response"
 				}
 
-				c.JSON(http.StatusInternalServerError, gin.H{"error": msg})
+				status, ok := t["status"].(int)
+				if !ok {
+					status = http.StatusInternalServerError
+				}
+
+				c.JSON(status, gin.H{"error": msg})
 				return
 			default:
 				c.JSON(http.StatusInternalServerError, gin.H{"error": "unexpected response"})
@@ -361,6 +810,10 @@ func (s *Server) GenerateHandler(c *gin.Context) {
 		}
 
 		r.Response = sb.String()
+		r.Thinking = thinking.String()
+		r.Logprobs = logprobs
+		r.Tokens = tokens
+		r.Offsets = offsets
 		c.JSON(http.StatusOK, r)
 		return
 	}
@@ -377,6 +830,11 @@ func (s *Server) EmbedHandler(c *gin.Context) {
 		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "missing request body"})
 		return
 	case err != nil:
+		c.AbortWithStatusJSON(bindStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := bindMetadata(c, req.Metadata); err != nil {
 		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
@@ -409,6 +867,25 @@ func (s *Server) EmbedHandler(c *gin.Context) {
 		}
 	}
 
+	if len(input) > 0 && req.InputTokens != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "input and input_tokens can't be used together"})
+		return
+	}
+
+	embeds := make([]llm.EmbeddingRequest, 0, len(input)+len(req.InputTokens))
+	for _, s := range input {
+		embeds = append(embeds, llm.EmbeddingRequest{Content: s})
+	}
+
+	for _, tokens := range req.InputTokens {
+		if len(tokens) == 0 {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "input_tokens can't be empty"})
+			return
+		}
+
+		embeds = append(embeds, llm.EmbeddingRequest{Tokens: tokens})
+	}
+
 	name, err := getExistingName(model.ParseName(req.Model))
 	if err != nil {
 		c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("model '%s' not found", req.Model)})
@@ -423,8 +900,8 @@ func (s *Server) EmbedHandler(c *gin.Context) {
 
 	checkpointLoaded := time.Now()
 
-	if len(input) == 0 {
-		c.JSON(http.StatusOK, api.EmbedResponse{Model: req.Model, Embeddings: [][]float32{}})
+	if len(embeds) == 0 {
+		c.JSON(http.StatusOK, api.EmbedResponse{Model: req.Model, Embeddings: [][]float32{}, Metadata: req.Metadata})
 		return
 	}
 
@@ -435,11 +912,13 @@ func (s *Server) EmbedHandler(c *gin.Context) {
 	}
 
 	var count int
-	for i, s := range input {
-		tokens, err := r.Tokenize(c.Request.Context(), s)
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-			return
+	for i, e := range embeds {
+		tokens := e.Tokens
+		if tokens == nil {
+			if tokens, err = r.Tokenize(c.Request.Context(), e.Content); err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
 		}
 
 		ctxLen := min(opts.NumCtx, int(kvData.ContextLength()))
@@ -450,8 +929,9 @@ func (s *Server) EmbedHandler(c *gin.Context) {
 			}
 
 			tokens = tokens[:ctxLen]
-			s, err = r.Detokenize(c.Request.Context(), tokens)
-			if err != nil {
+			if e.Tokens != nil {
+				e.Tokens = tokens
+			} else if e.Content, err = r.Detokenize(c.Request.Context(), tokens); err != nil {
 				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 				return
 			}
@@ -459,14 +939,14 @@ func (s *Server) EmbedHandler(c *gin.Context) {
 
 		count += len(tokens)
 
-		input[i] = s
+		embeds[i] = e
 	}
 
 	var g errgroup.Group
-	embeddings := make([][]float32, len(input))
-	for i, text := range input {
+	embeddings := make([][]float32, len(embeds))
+	for i, e := range embeds {
 		g.Go(func() error {
-			embedding, err := r.Embedding(c.Request.Context(), text)
+			embedding, err := r.Embedding(c.Request.Context(), e)
 			if err != nil {
 				return err
 			}
@@ -476,7 +956,7 @@ func (s *Server) EmbedHandler(c *gin.Context) {
 	}
 
 	if err := g.Wait(); err != nil {
-		slog.Error("embedding generation failed", "error", err)
+		slog.ErrorContext(c.Request.Context(), "embedding generation failed", "error", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Errorf("failed to generate embeddings: %v", err)})
 		return
 	}
@@ -487,6 +967,7 @@ func (s *Server) EmbedHandler(c *gin.Context) {
 		TotalDuration:   time.Since(checkpointStart),
 		LoadDuration:    checkpointLoaded.Sub(checkpointStart),
 		PromptEvalCount: count,
+		Metadata:        req.Metadata,
 	}
 	c.JSON(http.StatusOK, resp)
 }
@@ -514,7 +995,7 @@ func (s *Server) EmbeddingsHandler(c *gin.Context) {
 		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "missing request body"})
 		return
 	} else if err != nil {
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		c.AbortWithStatusJSON(bindStatus(err), gin.H{"error": err.Error()})
 		return
 	}
 
@@ -536,9 +1017,9 @@ func (s *Server) EmbeddingsHandler(c *gin.Context) {
 		return
 	}
 
-	embedding, err := r.Embedding(c.Request.Context(), req.Prompt)
+	embedding, err := r.Embedding(c.Request.Context(), llm.EmbeddingRequest{Content: req.Prompt})
 	if err != nil {
-		slog.Info(fmt.Sprintf("embedding generation failed: %v", err))
+		slog.InfoContext(c.Request.Context(), fmt.Sprintf("embedding generation failed: %v", err))
 		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Errorf("failed to generate embedding: %v", err)})
 		return
 	}
@@ -578,6 +1059,17 @@ func (s *Server) PullHandler(c *gin.Context) {
 		return
 	}
 
+	if err := s.config().policy.checkModel(name); err != nil {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": err.Error()})
+		return
+	}
+
+	t := tenantFromContext(c.Request.Context())
+	if err := s.config().tenants.checkPull(t, name); err != nil {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": err.Error()})
+		return
+	}
+
 	ch := make(chan any)
 	go func() {
 		defer close(ch)
@@ -585,14 +1077,15 @@ func (s *Server) PullHandler(c *gin.Context) {
 			ch <- r
 		}
 
-		regOpts := &registryOptions{
-			Insecure: req.Insecure,
-		}
+		regOpts := s.registryOptions(c.Request.Context())
+		regOpts.Insecure = req.Insecure
 
 		ctx, cancel := context.WithCancel(c.Request.Context())
 		defer cancel()
 
-		if err := PullModel(ctx, name.DisplayShortest(), regOpts, fn); err != nil {
+		if err := PullModel(ctx, name.DisplayShortest(), regOpts, fn); errors.Is(err, errPolicy) {
+			ch <- gin.H{"error": err.Error(), "status": http.StatusForbidden}
+		} else if err != nil {
 			ch <- gin.H{"error": err.Error()}
 		}
 	}()
@@ -647,6 +1140,11 @@ func (s *Server) PushHandler(c *gin.Context) {
 			return
 		}
 
+		if err := tenantFromContext(ctx).checkModel(name); err != nil {
+			ch <- gin.H{"error": fmt.Sprintf("model %q not found", mname), "status": http.StatusNotFound}
+			return
+		}
+
 		if err := PushModel(ctx, name.DisplayShortest(), regOpts, fn); err != nil {
 			ch <- gin.H{"error": err.Error()}
 		}
@@ -710,42 +1208,102 @@ func (s *Server) CreateHandler(c *gin.Context) {
 		return
 	}
 
-	if r.Path == "" && r.Modelfile == "" {
+	var f *parser.File
+	switch {
+	case r.Path == "" && r.Modelfile == "" && hasStructuredCreate(r):
+		f, err = modelfileFromRequest(r)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	case r.Path == "" && r.Modelfile == "":
 		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "path or Modelfile are required"})
 		return
-	}
+	default:
+		var sr io.Reader = strings.NewReader(r.Modelfile)
+		if r.Path != "" && r.Modelfile == "" {
+			f, err := os.Open(r.Path)
+			if err != nil {
+				c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("error reading modelfile: %s", err)})
+				return
+			}
+			defer f.Close()
 
-	var sr io.Reader = strings.NewReader(r.Modelfile)
-	if r.Path != "" && r.Modelfile == "" {
-		f, err := os.Open(r.Path)
+			sr = f
+		}
+
+		f, err = parser.ParseFile(sr)
 		if err != nil {
-			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("error reading modelfile: %s", err)})
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 			return
 		}
-		defer f.Close()
-
-		sr = f
 	}
 
-	f, err := parser.ParseFile(sr)
-	if err != nil {
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	if r.CheckPerplexity && r.Quantize == "" && r.Quantization == "" {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "check_perplexity requires quantize"})
 		return
 	}
 
-	ch := make(chan any)
-	go func() {
-		defer close(ch)
-		fn := func(resp api.ProgressResponse) {
-			ch <- resp
+	for _, k := range slices.Sorted(maps.Keys(r.Labels)) {
+		if k == "" || strings.Contains(k, "=") {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("invalid label %q", k)})
+			return
 		}
 
-		ctx, cancel := context.WithCancel(c.Request.Context())
+		f.Commands = append(f.Commands, parser.Command{Name: "label", Args: k + "=" + r.Labels[k]})
+	}
+
+	if err := s.config().policy.checkModel(name); err != nil {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": err.Error()})
+		return
+	}
+
+	t := tenantFromContext(c.Request.Context())
+	if err := t.checkCreate(name); err != nil {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": err.Error()})
+		return
+	}
+
+	for _, cmd := range f.Commands {
+		if from := model.ParseName(cmd.Args); cmd.Name == "model" && from.IsValid() {
+			if err := s.config().policy.checkModel(from); err != nil {
+				c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": err.Error()})
+				return
+			}
+
+			// tenants create from their own models, or pull new ones
+			if _, err := ParseNamedManifest(from); err == nil {
+				if err := t.checkModel(from); err != nil {
+					c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("model %q not found", cmd.Args)})
+					return
+				}
+			} else if err := s.config().tenants.checkPull(t, from); err != nil {
+				c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": err.Error()})
+				return
+			}
+		}
+	}
+
+	ch := make(chan any)
+	go func() {
+		defer close(ch)
+		fn := func(resp api.ProgressResponse) {
+			ch <- resp
+		}
+
+		ctx, cancel := context.WithCancel(c.Request.Context())
 		defer cancel()
 
+		var perplexity perplexityFunc
+		if r.CheckPerplexity {
+			perplexity = s.perplexity
+		}
+
 		quantization := cmp.Or(r.Quantize, r.Quantization)
-		if err := CreateModel(ctx, name, filepath.Dir(r.Path), strings.ToUpper(quantization), f, fn); errors.Is(err, errBadTemplate) {
+		if err := CreateModel(ctx, name, filepath.Dir(r.Path), strings.ToUpper(quantization), perplexity, f, s.registryOptions(ctx), fn); errors.Is(err, errBadTemplate) || errors.Is(err, errBadProcessor) {
 			ch <- gin.H{"error": err.Error(), "status": http.StatusBadRequest}
+		} else if errors.Is(err, errPolicy) {
+			ch <- gin.H{"error": err.Error(), "status": http.StatusForbidden}
 		} else if err != nil {
 			ch <- gin.H{"error": err.Error()}
 		}
@@ -792,17 +1350,85 @@ func (s *Server) DeleteHandler(c *gin.Context) {
 		return
 	}
 
+	t := tenantFromContext(c.Request.Context())
+	if err := t.checkModel(n); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("model '%s' not found", cmp.Or(r.Model, r.Name))})
+		return
+	}
+
+	// a model other tenants have is only removed from this tenant's models
+	if t != nil && s.config().tenants.shared(t, n) {
+		if err := t.remove(n); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
+		return
+	}
+
+	// new requests for the model fail while its runner is unloaded, so
+	// nothing is using it by the time its manifest is removed
+	key := strings.ToLower(n.String())
+	if _, ok := s.deleting.LoadOrStore(key, struct{}{}); ok {
+		c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("model '%s' %s", cmp.Or(r.Model, r.Name), errModelDeleting)})
+		return
+	}
+	defer s.deleting.Delete(key)
+
+	// runners are shared by every name of a model file, so one is only
+	// unloaded when the last of them is deleted
+	if model, err := GetModel(n.String()); err == nil && !sharesModelFile(n, model) {
+		if err := s.sched.unloadModel(c.Request.Context(), model, r.Force); errors.Is(err, errModelInUse) {
+			c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("model '%s' %s", cmp.Or(r.Model, r.Name), err)})
+			return
+		} else if err != nil {
+			handleScheduleError(c, cmp.Or(r.Model, r.Name), err)
+			return
+		}
+	}
+
+	// blobs are only removed once no manifest refers to them
 	if err := m.Remove(); err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 
+	if err := s.config().tenants.remove(n); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
 	if err := m.RemoveLayers(); err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 }
 
+// sharesModelFile reports whether a model other than n uses the model file of
+// m, such as a copy of it
+func sharesModelFile(n model.Name, m *Model) bool {
+	ms, err := Manifests(true)
+	if err != nil {
+		return false
+	}
+
+	for name, mf := range ms {
+		if strings.EqualFold(name.String(), n.String()) {
+			continue
+		}
+
+		for _, layer := range mf.Layers {
+			if layer.MediaType != "application/vnd.ollama.image.model" {
+				continue
+			}
+
+			if p, err := GetBlobsPath(layer.Digest); err == nil && p == m.ModelPath {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
 func (s *Server) ShowHandler(c *gin.Context) {
 	var req api.ShowRequest
 	err := c.ShouldBindJSON(&req)
@@ -824,6 +1450,13 @@ func (s *Server) ShowHandler(c *gin.Context) {
 		return
 	}
 
+	if n := model.ParseName(req.Model); n.IsValid() {
+		if n, err := getExistingName(n); err == nil && tenantFromContext(c.Request.Context()).checkModel(n) != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("model '%s' not found", req.Model)})
+			return
+		}
+	}
+
 	resp, err := GetModelInfo(req)
 	if err != nil {
 		switch {
@@ -885,8 +1518,18 @@ func GetModelInfo(req api.ShowRequest) (*api.ShowResponse, error) {
 		Details:    modelDetails,
 		Messages:   msgs,
 		ModifiedAt: manifest.fi.ModTime(),
+		Labels:     m.Config.Labels,
+		Provenance: m.Config.Provenance,
 	}
 
+	caps, info, err := m.capabilities()
+	if err != nil {
+		return nil, err
+	}
+	resp.Capabilities = caps
+	resp.ContextLength = info.contextLength
+	resp.TokenizerDigest = info.tokenizerDigest
+
 	var params []string
 	cs := 30
 	for k, v := range m.Options {
@@ -895,6 +1538,10 @@ func GetModelInfo(req api.ShowRequest) (*api.ShowResponse, error) {
 			for _, nv := range val {
 				params = append(params, fmt.Sprintf("%-*s %#v", cs, k, nv))
 			}
+		case map[string]interface{}:
+			for _, token := range slices.Sorted(maps.Keys(val)) {
+				params = append(params, fmt.Sprintf("%-*s %#v", cs, k, fmt.Sprintf("%s:%v", token, val[token])))
+			}
 		default:
 			params = append(params, fmt.Sprintf("%-*s %#v", cs, k, v))
 		}
@@ -963,26 +1610,37 @@ func (s *Server) ListHandler(c *gin.Context) {
 		return
 	}
 
+	selectors := c.QueryArray("label")
+	t := tenantFromContext(c.Request.Context())
+
 	models := []api.ListModelResponse{}
 	for n, m := range ms {
+		if !t.owns(n) {
+			continue
+		}
+
 		var cf ConfigV2
 
 		if m.Config.Digest != "" {
 			f, err := m.Config.Open()
 			if err != nil {
-				slog.Warn("bad manifest filepath", "name", n, "error", err)
+				slog.WarnContext(c.Request.Context(), "bad manifest filepath", "name", n, "error", err)
 				continue
 			}
 			defer f.Close()
 
 			if err := json.NewDecoder(f).Decode(&cf); err != nil {
-				slog.Warn("bad manifest config", "name", n, "error", err)
+				slog.WarnContext(c.Request.Context(), "bad manifest config", "name", n, "error", err)
 				continue
 			}
 		}
 
+		if !matchLabels(cf.Labels, selectors) {
+			continue
+		}
+
 		// tag should never be masked
-		models = append(models, api.ListModelResponse{
+		resp := api.ListModelResponse{
 			Model:      n.DisplayShortest(),
 			Name:       n.DisplayShortest(),
 			Size:       m.Size(),
@@ -995,7 +1653,21 @@ func (s *Server) ListHandler(c *gin.Context) {
 				ParameterSize:     cf.ModelType,
 				QuantizationLevel: cf.FileType,
 			},
-		})
+			Labels: cf.Labels,
+		}
+
+		// a model that can't be read is still listed, without capabilities
+		if model, err := GetModel(n.String()); err != nil {
+			slog.WarnContext(c.Request.Context(), "couldn't read model", "name", n, "error", err)
+		} else if caps, info, err := model.capabilities(); err != nil {
+			slog.WarnContext(c.Request.Context(), "couldn't read model capabilities", "name", n, "error", err)
+		} else {
+			resp.Capabilities = caps
+			resp.ContextLength = info.contextLength
+			resp.TokenizerDigest = info.tokenizerDigest
+		}
+
+		models = append(models, resp)
 	}
 
 	slices.SortStableFunc(models, func(i, j api.ListModelResponse) int {
@@ -1006,6 +1678,154 @@ func (s *Server) ListHandler(c *gin.Context) {
 	c.JSON(http.StatusOK, api.ListResponse{Models: models})
 }
 
+func (s *Server) LabelHandler(c *gin.Context) {
+	var r api.LabelRequest
+	if err := c.ShouldBindJSON(&r); errors.Is(err, io.EOF) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "missing request body"})
+		return
+	} else if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	for k := range r.Labels {
+		if k == "" || strings.Contains(k, "=") {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("invalid label %q", k)})
+			return
+		}
+	}
+
+	name := model.ParseName(r.Model)
+	if !name.IsValid() {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("model %q is invalid", r.Model)})
+		return
+	}
+	name, err := getExistingName(name)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// labels change the model's manifest, so tenants can only label the
+	// models in their namespace rather than models they share
+	t := tenantFromContext(c.Request.Context())
+	if err := t.checkModel(name); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("model '%s' not found", r.Model)})
+		return
+	} else if err := t.checkCreate(name); err != nil {
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+		return
+	}
+
+	labels, err := setModelLabels(name, r.Labels)
+	if errors.Is(err, os.ErrNotExist) {
+		c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("model '%s' not found", r.Model)})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, api.LabelResponse{Labels: labels})
+}
+
+func (s *Server) ScheduleHandler(c *gin.Context) {
+	c.JSON(http.StatusOK, api.ScheduleResponse{
+		Policies: s.calendar.Policies(),
+		Quiet:    s.calendar.Quiet(time.Now()),
+		Group:    s.calendar.Active(),
+	})
+}
+
+func (s *Server) SwitchGroupHandler(c *gin.Context) {
+	if !isLocalRequest(c.Request) {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "model groups can only be switched by local clients"})
+		return
+	}
+
+	var r api.SwitchGroupRequest
+	if err := c.ShouldBindJSON(&r); errors.Is(err, io.EOF) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "missing request body"})
+		return
+	} else if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := s.switchGroup(c.Request.Context(), r.Group); errors.Is(err, errUnknownGroup) || errors.Is(err, os.ErrNotExist) {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	} else if errors.Is(err, errQuietHours) {
+		c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+		return
+	} else if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	s.ScheduleHandler(c)
+}
+
+func (s *Server) SetScheduleHandler(c *gin.Context) {
+	if !isLocalRequest(c.Request) {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "the schedule can only be changed by local clients"})
+		return
+	}
+
+	var r api.ScheduleRequest
+	if err := c.ShouldBindJSON(&r); errors.Is(err, io.EOF) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "missing request body"})
+		return
+	} else if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if s.calendar == nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "scheduling is not available"})
+		return
+	}
+
+	if err := s.calendar.Set(r.Policies); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	s.ScheduleHandler(c)
+}
+
+func (s *Server) CORSHandler(c *gin.Context) {
+	c.JSON(http.StatusOK, api.CORSResponse{Policies: s.cors.Policies()})
+}
+
+func (s *Server) SetCORSHandler(c *gin.Context) {
+	if !isLocalRequest(c.Request) {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "cross-origin policies can only be changed by local clients"})
+		return
+	}
+
+	var r api.CORSRequest
+	if err := c.ShouldBindJSON(&r); errors.Is(err, io.EOF) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "missing request body"})
+		return
+	} else if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if s.cors == nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "cross-origin policies are not available"})
+		return
+	}
+
+	if err := s.cors.Set(r.Policies); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	s.CORSHandler(c)
+}
+
 func (s *Server) CopyHandler(c *gin.Context) {
 	var r api.CopyRequest
 	if err := c.ShouldBindJSON(&r); errors.Is(err, io.EOF) {
@@ -1038,10 +1858,28 @@ func (s *Server) CopyHandler(c *gin.Context) {
 		return
 	}
 
+	if err := s.config().policy.checkModel(dst); err != nil {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": err.Error()})
+		return
+	}
+
+	t := tenantFromContext(c.Request.Context())
+	if err := t.checkModel(src); err != nil {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("model %q not found", r.Source)})
+		return
+	}
+
+	if err := t.checkCreate(dst); err != nil {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": err.Error()})
+		return
+	}
+
 	if err := CopyModel(src, dst); errors.Is(err, os.ErrNotExist) {
 		c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("model %q not found", r.Source)})
 	} else if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	} else if err := t.add(dst); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 	}
 }
 
@@ -1053,6 +1891,7 @@ func (s *Server) HeadBlobHandler(c *gin.Context) {
 	}
 
 	if _, err := os.Stat(path); err != nil {
+		setUploadRange(c, uploadedSize(path))
 		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("blob %q not found", c.Param("digest"))})
 		return
 	}
@@ -1069,7 +1908,7 @@ func (s *Server) CreateBlobHandler(c *gin.Context) {
 		}
 
 		if _, err := os.Stat(p); errors.Is(err, os.ErrNotExist) {
-			slog.Info("evicting intermediate blob which no longer exists", "digest", ib)
+			slog.InfoContext(c.Request.Context(), "evicting intermediate blob which no longer exists", "digest", ib)
 			delete(intermediateBlobs, c.Param("digest"))
 		} else if err != nil {
 			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
@@ -1098,6 +1937,11 @@ func (s *Server) CreateBlobHandler(c *gin.Context) {
 		return
 	}
 
+	if c.GetHeader("Content-Range") != "" {
+		createBlobChunk(c, c.Param("digest"), path)
+		return
+	}
+
 	layer, err := NewLayer(c.Request.Body, "")
 	if err != nil {
 		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
@@ -1133,6 +1977,30 @@ func isLocalIP(ip netip.Addr) bool {
 	return false
 }
 
+// localConnKey marks requests received over a unix socket, which can only come
+// from this machine
+type localConnKey struct{}
+
+// isLocalRequest reports whether r was made from this machine, either over a
+// unix socket or from a loopback address
+func isLocalRequest(r *http.Request) bool {
+	if local, _ := r.Context().Value(localConnKey{}).(bool); local {
+		return true
+	}
+
+	return isLoopbackAddr(r.RemoteAddr)
+}
+
+// isLoopbackAddr reports whether a request's remote address is a loopback address
+func isLoopbackAddr(remoteAddr string) bool {
+	addr, err := netip.ParseAddrPort(remoteAddr)
+	if err != nil {
+		return false
+	}
+
+	return addr.Addr().Unmap().IsLoopback()
+}
+
 func allowedHost(host string) bool {
 	host = strings.ToLower(host)
 
@@ -1199,35 +2067,62 @@ func allowedHostsMiddleware(addr net.Addr) gin.HandlerFunc {
 }
 
 func (s *Server) GenerateRoutes() http.Handler {
-	config := cors.DefaultConfig()
-	config.AllowWildcard = true
-	config.AllowBrowserExtensions = true
-	config.AllowHeaders = []string{"Authorization", "Content-Type", "User-Agent", "Accept", "X-Requested-With"}
-	openAIProperties := []string{"lang", "package-version", "os", "arch", "retry-count", "runtime", "runtime-version", "async"}
-	for _, prop := range openAIProperties {
-		config.AllowHeaders = append(config.AllowHeaders, "x-stainless-"+prop)
+	if s.cors == nil {
+		s.cors = &corsPolicies{policies: defaultCORSPolicies()}
+	}
+
+	if s.limits == nil {
+		s.limits, _ = parseEndpointLimits("")
+	}
+
+	if s.cfg.Load() == nil {
+		s.cfg.Store(newConfig(nil, nil, nil, nil))
 	}
-	config.AllowOrigins = envconfig.Origins()
 
 	r := gin.Default()
 	r.Use(
-		cors.New(config),
+		requestIDMiddleware(),
+		corsMiddleware(s.cors),
 		allowedHostsMiddleware(s.addr),
+		s.configMiddleware(func(c *serverConfig) gin.HandlerFunc { return c.clientAuth }),
+		s.configMiddleware(func(c *serverConfig) gin.HandlerFunc { return c.tenantAuth }),
+		s.configMiddleware(func(c *serverConfig) gin.HandlerFunc { return c.authorize }),
+		readOnlyMiddleware(envconfig.ReadOnly()),
+		bodyLimitMiddleware(int64(envconfig.MaxRequestSize())),
+		limitMiddleware(s.limits),
 	)
 
 	r.POST("/api/pull", s.PullHandler)
 	r.POST("/api/generate", s.GenerateHandler)
 	r.POST("/api/chat", s.ChatHandler)
 	r.POST("/api/embed", s.EmbedHandler)
+	r.POST("/api/reward", s.RewardHandler)
 	r.POST("/api/embeddings", s.EmbeddingsHandler)
 	r.POST("/api/create", s.CreateHandler)
 	r.POST("/api/push", s.PushHandler)
 	r.POST("/api/copy", s.CopyHandler)
+	r.POST("/api/labels", s.LabelHandler)
+	r.GET("/api/schedule", s.ScheduleHandler)
+	r.POST("/api/schedule", s.SetScheduleHandler)
+	r.POST("/api/schedule/switch", s.SwitchGroupHandler)
+	r.GET("/api/cors", s.CORSHandler)
+	r.POST("/api/cors", s.SetCORSHandler)
+	r.POST("/api/reload", s.ReloadHandler)
+	r.GET("/api/log", s.LogHandler)
+	r.POST("/api/log", s.SetLogHandler)
 	r.DELETE("/api/delete", s.DeleteHandler)
 	r.POST("/api/show", s.ShowHandler)
+	r.POST("/api/files", s.ModelFileHandler)
 	r.POST("/api/blobs/:digest", s.CreateBlobHandler)
 	r.HEAD("/api/blobs/:digest", s.HeadBlobHandler)
 	r.GET("/api/ps", s.PsHandler)
+	r.GET("/api/sessions", s.ListSessionsHandler)
+	r.DELETE("/api/sessions", s.DeleteSessionHandler)
+	r.POST("/api/affinity", s.AffinityHandler)
+	r.GET("/api/adapters", s.ListAdaptersHandler)
+	r.POST("/api/adapters", s.LoadAdapterHandler)
+	r.DELETE("/api/adapters", s.UnloadAdapterHandler)
+	r.GET("/metrics", s.MetricsHandler)
 
 	// Compatibility endpoints
 	r.POST("/v1/chat/completions", openai.ChatMiddleware(), s.ChatHandler)
@@ -1251,36 +2146,37 @@ func (s *Server) GenerateRoutes() http.Handler {
 }
 
 func Serve(ln net.Listener) error {
-	level := slog.LevelInfo
-	if envconfig.Debug() {
-		level = slog.LevelDebug
-	}
+	return ServeContext(context.Background(), ln)
+}
 
-	slog.Info("server config", "env", envconfig.Values())
-	handler := slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{
-		Level:     level,
-		AddSource: true,
-		ReplaceAttr: func(_ []string, attr slog.Attr) slog.Attr {
-			if attr.Key == slog.SourceKey {
-				source := attr.Value.Any().(*slog.Source)
-				source.File = filepath.Base(source.File)
-			}
+// ServeContext is like Serve but also shuts the server down, unloading any
+// models, once stop is done. This is used where the server is stopped by
+// something other than a signal such as the Windows service manager.
+func ServeContext(stop context.Context, ln net.Listener) error {
+	levels, err := logutil.FromEnv()
+	if err != nil {
+		return fmt.Errorf("OLLAMA_LOG_LEVEL: %w", err)
+	}
 
-			return attr
-		},
-	})
+	if err := logutil.Set(levels); err != nil {
+		return err
+	}
 
-	slog.SetDefault(slog.New(handler))
+	slog.Info("server config", "env", envconfig.Values())
+	slog.SetDefault(slog.New(logutil.NewTextHandler(os.Stderr)))
 
 	blobsDir, err := GetBlobsPath("")
 	if err != nil {
 		return err
 	}
-	if err := fixBlobs(blobsDir); err != nil {
+
+	if envconfig.ReadOnly() {
+		slog.Info("models directory is read only, skipping pruning unused blobs", "path", envconfig.Models())
+	} else if err := fixBlobs(blobsDir); err != nil {
 		return err
 	}
 
-	if !envconfig.NoPrune() {
+	if !envconfig.NoPrune() && !envconfig.ReadOnly() {
 		if _, err := Manifests(false); err != nil {
 			slog.Warn("corrupt manifests detected, skipping prune operation.  Re-pull or delete to clear", "error", err)
 		} else {
@@ -1300,10 +2196,37 @@ func Serve(ln net.Listener) error {
 		}
 	}
 
+	policies, err := parseSchedule(envconfig.Schedule())
+	if err != nil {
+		return fmt.Errorf("OLLAMA_SCHEDULE: %w", err)
+	}
+
+	cal, err := newCalendar(policies)
+	if err != nil {
+		return err
+	}
+
+	cors, err := newCORSPolicies(defaultCORSPolicies())
+	if err != nil {
+		return fmt.Errorf("OLLAMA_ORIGINS: %w", err)
+	}
+
+	limits, err := parseEndpointLimits(envconfig.EndpointLimits())
+	if err != nil {
+		return fmt.Errorf("OLLAMA_ENDPOINT_LIMITS: %w", err)
+	}
+
+	cfg, err := loadConfig()
+	if err != nil {
+		return err
+	}
+
 	ctx, done := context.WithCancel(context.Background())
 	schedCtx, schedDone := context.WithCancel(ctx)
 	sched := InitScheduler(schedCtx)
-	s := &Server{addr: ln.Addr(), sched: sched}
+	s := &Server{addr: ln.Addr(), sched: sched, calendar: cal, cors: cors, limits: limits}
+	s.cfg.Store(cfg)
+	s.sessions.restore()
 
 	http.Handle("/", s.GenerateRoutes())
 
@@ -1318,19 +2241,46 @@ func Serve(ln net.Listener) error {
 		// and easy way to get pprof, but it may not be the best
 		// way.
 		Handler: nil,
+		ConnContext: func(ctx context.Context, c net.Conn) context.Context {
+			if _, ok := c.(*net.UnixConn); ok {
+				return context.WithValue(ctx, localConnKey{}, true)
+			}
+
+			return ctx
+		},
 	}
 
 	// listen for a ctrl+c and stop any loaded llm
 	signals := make(chan os.Signal, 1)
 	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
 	go func() {
-		<-signals
+		select {
+		case <-signals:
+		case <-stop.Done():
+		}
 		srvr.Close()
 		schedDone()
 		sched.unloadAllRunners()
 		done()
 	}()
 
+	// reload the configuration on SIGHUP
+	reloads := make(chan os.Signal, 1)
+	signal.Notify(reloads, syscall.SIGHUP)
+	go func() {
+		for {
+			select {
+			case <-reloads:
+				if err := s.reload(); err != nil {
+					slog.Error("failed to reload configuration", "error", err)
+				}
+			case <-ctx.Done():
+				signal.Stop(reloads)
+				return
+			}
+		}
+	}()
+
 	// Locate and log what runners are present at startup
 	var runnerNames []string
 	for v := range runners.GetAvailableServers() {
@@ -1340,6 +2290,7 @@ func Serve(ln net.Listener) error {
 	slog.Debug("Override detection logic by setting OLLAMA_LLM_LIBRARY")
 
 	s.sched.Run(schedCtx)
+	go s.runCalendar(schedCtx)
 
 	// At startup we retrieve GPU information so we can get log messages before loading a model
 	// This will log warnings to the log in case we have problems with detected GPUs
@@ -1395,14 +2346,14 @@ func streamResponse(c *gin.Context, ch chan any) {
 
 		bts, err := json.Marshal(val)
 		if err != nil {
-			slog.Info(fmt.Sprintf("streamResponse: json.Marshal failed with %s", err))
+			slog.InfoContext(c.Request.Context(), fmt.Sprintf("streamResponse: json.Marshal failed with %s", err))
 			return false
 		}
 
 		// Delineate chunks with new-line delimiter
 		bts = append(bts, '\n')
 		if _, err := w.Write(bts); err != nil {
-			slog.Info(fmt.Sprintf("streamResponse: w.Write failed with %s", err))
+			slog.InfoContext(c.Request.Context(), fmt.Sprintf("streamResponse: w.Write failed with %s", err))
 			return false
 		}
 
@@ -1412,8 +2363,13 @@ func streamResponse(c *gin.Context, ch chan any) {
 
 func (s *Server) PsHandler(c *gin.Context) {
 	models := []api.ProcessModelResponse{}
+	t := tenantFromContext(c.Request.Context())
 
 	for _, v := range s.sched.loaded {
+		if !t.owns(model.ParseName(v.model.Name)) {
+			continue
+		}
+
 		model := v.model
 		modelDetails := api.ModelDetails{
 			Format:            model.Config.ModelFormat,
@@ -1451,20 +2407,106 @@ func (s *Server) PsHandler(c *gin.Context) {
 	c.JSON(http.StatusOK, api.ProcessResponse{Models: models})
 }
 
+// checkMigration checks that a chat can be migrated from the model named from
+// to name: its last message is the partial response to continue, and both
+// models have the same vocabulary so the response tokenizes the same way
+func checkMigration(from string, name model.Name, msgs []api.Message) error {
+	if len(msgs) == 0 || msgs[len(msgs)-1].Role != "assistant" {
+		return errors.New("migrate_from requires the last message to be the assistant response to continue")
+	}
+
+	src, err := GetModel(from)
+	if err != nil {
+		return err
+	}
+
+	dst, err := GetModel(name.String())
+	if err != nil {
+		return err
+	}
+
+	srcInfo, err := readWeightsInfo(src.ModelPath)
+	if err != nil {
+		return err
+	}
+
+	dstInfo, err := readWeightsInfo(dst.ModelPath)
+	if err != nil {
+		return err
+	}
+
+	if srcInfo.tokenizerDigest == "" || srcInfo.tokenizerDigest != dstInfo.tokenizerDigest {
+		return fmt.Errorf("%q and %q don't have the same vocabulary", from, name.DisplayShortest())
+	}
+
+	return nil
+}
+
+// sessionSeed derives the seed for the next assistant turn of a conversation
+// from the base seed and the number of assistant messages so far. The first
+// turn uses the base seed unchanged.
+func sessionSeed(seed int, msgs []api.Message) int {
+	var turn uint64
+	for _, msg := range msgs {
+		if msg.Role == "assistant" {
+			turn++
+		}
+	}
+
+	if turn == 0 {
+		return seed
+	}
+
+	// splitmix64
+	z := uint64(seed) + turn*0x9e3779b97f4a7c15
+	z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+	z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+	z ^= z >> 31
+	return int(z & math.MaxInt32)
+}
+
 func (s *Server) ChatHandler(c *gin.Context) {
 	checkpointStart := time.Now()
 
 	var req api.ChatRequest
-	if err := c.ShouldBindJSON(&req); errors.Is(err, io.EOF) {
+	if err := bindRequest(c, &req); errors.Is(err, io.EOF) {
 		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "missing request body"})
 		return
 	} else if err != nil {
+		c.AbortWithStatusJSON(bindStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := bindMetadata(c, req.Metadata); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if req.TraceSampling < 0 || req.TraceSampling > maxTraceSampling {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("trace_sampling must be between 0 and %d", maxTraceSampling)})
+		return
+	}
+
+	if req.TopLogprobs < 0 || req.TopLogprobs > maxTopLogprobs {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("top_logprobs must be between 0 and %d", maxTopLogprobs)})
+		return
+	} else if req.TopLogprobs > 0 && !req.Logprobs {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "top_logprobs requires logprobs"})
+		return
+	}
+
+	if _, err := llm.FormatGrammar(req.Format); err != nil {
 		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
 	// expire the runner
 	if len(req.Messages) == 0 && req.KeepAlive != nil && int(req.KeepAlive.Seconds()) == 0 {
+		if err := tenantFromContext(c.Request.Context()).checkModel(model.ParseName(req.Model)); err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("model '%s' not found", req.Model)})
+			return
+		}
+
 		model, err := GetModel(req.Model)
 		if err != nil {
 			switch {
@@ -1485,6 +2527,7 @@ func (s *Server) ChatHandler(c *gin.Context) {
 			Message:    api.Message{Role: "assistant"},
 			Done:       true,
 			DoneReason: "unload",
+			Metadata:   req.Metadata,
 		})
 		return
 	}
@@ -1499,21 +2542,136 @@ func (s *Server) ChatHandler(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "model is required"})
 		return
 	}
+
+	var compression *api.CompressionStats
+	if req.Compressor != "" {
+		var segments []*string
+		for i := range req.Messages {
+			if req.Messages[i].Compress {
+				segments = append(segments, &req.Messages[i].Content)
+			}
+		}
+
+		cp, err := loadCompressor(req.Compressor, req.CompressionRate)
+		if err != nil {
+			handleScheduleError(c, req.Compressor, err)
+			return
+		}
+
+		if len(segments) > 0 {
+			if compression, err = s.compress(c.Request.Context(), cp, segments); err != nil {
+				handleScheduleError(c, req.Compressor, err)
+				return
+			}
+		}
+
+		// upstreams are sent the compressed messages
+		req.Compressor = ""
+	}
+
+	if u := s.config().upstreams.match(name, false); u != nil {
+		if req.SessionID != "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "session_id can't be used with upstream models"})
+			return
+		}
+
+		s.proxyChat(c, u, name, req)
+		return
+	}
+
 	name, err := getExistingName(name)
 	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "model is required"})
 		return
 	}
 
-	r, m, opts, err := s.scheduleRunner(c.Request.Context(), name.String(), caps, req.Options, req.KeepAlive)
+	var sess *session
+	if req.SessionID != "" {
+		if req.MigrateFrom != "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "session_id can't be used with migrate_from"})
+			return
+		}
+
+		sess, err = s.sessions.get(tenantFromContext(c.Request.Context()), req.SessionID, name.DisplayShortest())
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		sess.busy.Lock()
+		defer sess.busy.Unlock()
+	}
+
+	c.Header(affinityHeader, affinityToken(tenantFromContext(c.Request.Context()), name.String(), req.SessionID, chatPrefix(req.Messages)))
+
+	var tmpl *template.Template
+	if req.Template != "" {
+		tmpl, err = template.Parse(req.Template)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	if req.MigrateFrom != "" {
+		err := tenantFromContext(c.Request.Context()).checkModel(model.ParseName(req.MigrateFrom))
+		if err == nil {
+			err = checkMigration(req.MigrateFrom, name, req.Messages)
+		}
+
+		if errors.Is(err, os.ErrNotExist) {
+			c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("model '%s' not found", req.MigrateFrom)})
+			return
+		} else if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	ctx := c.Request.Context()
+	if sess != nil {
+		ctx = withSessions(ctx)
+	}
+
+	r, m, opts, err := s.scheduleRunner(ctx, name.String(), caps, req.Options, req.KeepAlive)
 	if errors.Is(err, errCapabilityCompletion) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("%q does not support chat", req.Model)})
 		return
+	} else if u := s.config().upstreams.match(name, true); u != nil && sess == nil && errors.Is(err, ErrMaxQueue) {
+		s.proxyChat(c, u, name, req)
+		return
 	} else if err != nil {
 		handleScheduleError(c, req.Model, err)
 		return
 	}
 
+	numCtx := reducedContext(m, req.Options, opts)
+
+	// a model's best_of only applies to generate requests
+	if _, ok := req.Options["best_of"]; ok && opts.BestOf > 1 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "best_of can't be used with chat"})
+		return
+	}
+
+	procs, err := parseProcessors(opts.Processors)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	budget, err := newThinkingBudget(*opts, &procs)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if tmpl != nil {
+		// the model is shared with the scheduler so copy it before overriding
+		mc := *m
+		mc.Template = tmpl
+		m = &mc
+	}
+
 	checkpointLoaded := time.Now()
 
 	if len(req.Messages) == 0 {
@@ -1523,59 +2681,141 @@ func (s *Server) ChatHandler(c *gin.Context) {
 			Message:    api.Message{Role: "assistant"},
 			Done:       true,
 			DoneReason: "load",
+			Metadata:   req.Metadata,
 		})
 		return
 	}
 
+	// the new messages, added to the session once the response is done
+	added := req.Messages
+
+	var cacheSession, memory string
+	if sess != nil {
+		var history []api.Message
+		history, memory = s.sessions.history(sess)
+		req.Messages = append(history, req.Messages...)
+		cacheSession = sess.key
+	}
+
 	msgs := append(m.Messages, req.Messages...)
 	if req.Messages[0].Role != "system" && m.System != "" {
 		msgs = append([]api.Message{{Role: "system", Content: m.System}}, msgs...)
 	}
+	msgs = withMemory(msgs, memory)
+
+	if opts.SessionSeed && opts.Seed >= 0 {
+		turn := msgs
+		if req.MigrateFrom != "" {
+			// the partial response is part of the turn being generated
+			turn = msgs[:len(msgs)-1]
+		}
+		opts.Seed = sessionSeed(opts.Seed, turn)
+	}
+
+	var discard int
+	if req.MigrateFrom != "" && opts.Seed >= 0 {
+		tokens, err := r.Tokenize(c.Request.Context(), msgs[len(msgs)-1].Content)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		discard = len(tokens)
+	}
 
 	prompt, images, err := chatPrompt(c.Request.Context(), m, r.Tokenize, opts, msgs, req.Tools)
+	if errors.Is(err, errImageReference) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	} else if err != nil {
+		slog.ErrorContext(c.Request.Context(), "chat prompt error", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	cached, err := cacheLength(m.Template, msgs, req.Tools, prompt)
 	if err != nil {
-		slog.Error("chat prompt error", "error", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 
-	slog.Debug("chat request", "images", len(images), "prompt", prompt)
+	var prefix int
+	if envconfig.PrefixCache() > 0 {
+		if prefix, err = prefixLength(m.Template, msgs, req.Tools, prompt); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	slog.DebugContext(c.Request.Context(), "chat request", "images", len(images), "prompt", prompt)
 
 	ch := make(chan any)
 	go func() {
 		defer close(ch)
-		var sb strings.Builder
+		var sb, reply, replyThinking strings.Builder
 		var toolCallIndex int = 0
-		if err := r.Completion(c.Request.Context(), llm.CompletionRequest{
-			Prompt:  prompt,
-			Images:  images,
-			Format:  req.Format,
-			Options: opts,
+		var logprobs []api.Logprob
+		send := func(res api.ChatResponse) {
+			// chunks held back for tool calls send their logprobs later
+			res.Logprobs, logprobs = logprobs, nil
+			ch <- res
+		}
+		if err := budget.complete(c.Request.Context(), r, llm.CompletionRequest{
+			Prompt:         prompt,
+			Images:         images,
+			Format:         req.Format,
+			Options:        opts,
+			CacheLength:    cached,
+			PrefixLength:   prefix,
+			Session:        cacheSession,
+			DiscardSamples: discard,
+			TraceSampling:  req.TraceSampling,
+			TokenLogprobs:  req.Logprobs,
+			TopLogprobs:    req.TopLogprobs,
+			Adapters:       m.RuntimeAdapterPaths,
 		}, func(r llm.CompletionResponse) {
+			logprobs = append(logprobs, r.Logprobs...)
+			processed := procs.process(r.Content, r.Done)
+			if !r.Done && processed.Content == "" && processed.Thinking == "" && r.Content != "" {
+				// held back by a processor
+				return
+			}
+			r.Content = processed.Content
+			reply.WriteString(r.Content)
+			replyThinking.WriteString(processed.Thinking)
+
 			res := api.ChatResponse{
 				Model:      req.Model,
 				CreatedAt:  time.Now().UTC(),
-				Message:    api.Message{Role: "assistant", Content: r.Content},
+				Message:    api.Message{Role: "assistant", Content: r.Content, Thinking: processed.Thinking},
 				Done:       r.Done,
 				DoneReason: r.DoneReason,
 				Metrics: api.Metrics{
 					PromptEvalCount:    r.PromptEvalCount,
 					PromptEvalDuration: r.PromptEvalDuration,
+					PromptCachedCount:  r.PromptCachedCount,
 					EvalCount:          r.EvalCount,
 					EvalDuration:       r.EvalDuration,
+					EnergyJoules:       r.Energy,
 				},
 			}
 
 			if r.Done {
 				res.TotalDuration = time.Since(checkpointStart)
 				res.LoadDuration = checkpointLoaded.Sub(checkpointStart)
+				res.ContextLength = numCtx
+				res.Metadata = req.Metadata
+				res.SamplingTrace = r.SamplingTrace
+				res.Compression = compression
+				res.Code = processed.Code
+				usage.record(m.ShortName, req.Metadata, res.Metrics)
 			}
 
 			// TODO: tool call checking and filtering should be moved outside of this callback once streaming
 			// however this was a simple change for now without reworking streaming logic of this (and other)
 			// handlers
 			if req.Stream != nil && !*req.Stream || len(req.Tools) == 0 {
-				ch <- res
+				send(res)
 				return
 			}
 
@@ -1591,7 +2831,7 @@ func (s *Server) ChatHandler(c *gin.Context) {
 				}
 				res.Message.Content = ""
 				sb.Reset()
-				ch <- res
+				send(res)
 				return
 			}
 
@@ -1600,20 +2840,40 @@ func (s *Server) ChatHandler(c *gin.Context) {
 				if toolCallIndex == 0 {
 					res.Message.Content = sb.String()
 				}
-				ch <- res
+				send(res)
+			} else if res.Message.Thinking != "" {
+				// thinking isn't parsed for tool calls so it's sent as it's generated
+				res.Message.Content = ""
+				send(res)
 			}
 		}); err != nil {
 			ch <- gin.H{"error": err.Error()}
+		} else if sess != nil {
+			msg := api.Message{Role: "assistant", Content: reply.String(), Thinking: replyThinking.String()}
+			if len(req.Tools) > 0 {
+				if toolCalls, ok := m.parseToolCalls(msg.Content); ok {
+					msg.ToolCalls = toolCalls
+					msg.Content = ""
+				}
+			}
+
+			s.sessions.add(sess, append(added, msg)...)
+			if envconfig.SessionMemory() > 0 {
+				go s.summarizeSession(context.WithoutCancel(c.Request.Context()), sess)
+			}
 		}
 	}()
 
 	if req.Stream != nil && !*req.Stream {
 		var resp api.ChatResponse
-		var sb strings.Builder
+		var sb, thinking strings.Builder
+		var logprobs []api.Logprob
 		for rr := range ch {
 			switch t := rr.(type) {
 			case api.ChatResponse:
 				sb.WriteString(t.Message.Content)
+				thinking.WriteString(t.Message.Thinking)
+				logprobs = append(logprobs, t.Logprobs...)
 				resp = t
 			case gin.H:
 				msg, ok := t["error"].(string)
@@ -1630,6 +2890,8 @@ func (s *Server) ChatHandler(c *gin.Context) {
 		}
 
 		resp.Message.Content = sb.String()
+		resp.Message.Thinking = thinking.String()
+		resp.Logprobs = logprobs
 
 		if len(req.Tools) > 0 {
 			if toolCalls, ok := m.parseToolCalls(sb.String()); ok {
@@ -1647,12 +2909,16 @@ func (s *Server) ChatHandler(c *gin.Context) {
 
 func handleScheduleError(c *gin.Context, name string, err error) {
 	switch {
-	case errors.Is(err, errCapabilities), errors.Is(err, errRequired):
+	case errors.Is(err, errCapabilities), errors.Is(err, errRequired), errors.Is(err, errBadOption):
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 	case errors.Is(err, context.Canceled):
 		c.JSON(499, gin.H{"error": "request canceled"})
-	case errors.Is(err, ErrMaxQueue):
+	case errors.Is(err, ErrMaxQueue), errors.Is(err, errQuietHours):
 		c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+	case errors.Is(err, errPolicy):
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+	case errors.Is(err, errModelDeleting):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
 	case errors.Is(err, os.ErrNotExist):
 		c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("model %q not found, try pulling it first", name)})
 	default:
@@ -3,11 +3,13 @@ package server
 import (
 	"bytes"
 	"cmp"
+	"crypto/sha256"
 	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
 	"path/filepath"
 	"slices"
@@ -17,6 +19,8 @@ import (
 
 	"github.com/ollama/ollama/api"
 	"github.com/ollama/ollama/llm"
+	"github.com/ollama/ollama/types/model"
+	"github.com/ollama/ollama/version"
 )
 
 var stream bool = false
@@ -67,6 +71,7 @@ func createRequest(t *testing.T, fn func(*gin.Context), body any) *httptest.Resp
 
 	c.Request = &http.Request{
 		Body: io.NopCloser(&b),
+		URL:  &url.URL{},
 	}
 
 	fn(c)
@@ -108,8 +113,8 @@ func TestCreateFromBin(t *testing.T) {
 	})
 
 	checkFileExists(t, filepath.Join(p, "blobs", "*"), []string{
+		filepath.Join(p, "blobs", "sha256-5fc8de4128b05c10b1dc4c258778b7a6bfd713569af6d202a2027d09258563d4"),
 		filepath.Join(p, "blobs", "sha256-a4e5e156ddec27e286f75328784d7106b60a4eb1d246e950a001a3f944fbda99"),
-		filepath.Join(p, "blobs", "sha256-ca239d7bd8ea90e4a5d2e6bf88f8d74a47b14336e73eb4e18bed4dd325018116"),
 	})
 }
 
@@ -150,8 +155,9 @@ func TestCreateFromModel(t *testing.T) {
 	})
 
 	checkFileExists(t, filepath.Join(p, "blobs", "*"), []string{
+		filepath.Join(p, "blobs", "sha256-5fc8de4128b05c10b1dc4c258778b7a6bfd713569af6d202a2027d09258563d4"),
 		filepath.Join(p, "blobs", "sha256-a4e5e156ddec27e286f75328784d7106b60a4eb1d246e950a001a3f944fbda99"),
-		filepath.Join(p, "blobs", "sha256-ca239d7bd8ea90e4a5d2e6bf88f8d74a47b14336e73eb4e18bed4dd325018116"),
+		filepath.Join(p, "blobs", "sha256-a6cb5ad18c29ed82712688f24ca24a20ca6e106d18f49ef00d6aafae51a9140c"),
 	})
 }
 
@@ -177,9 +183,9 @@ func TestCreateRemovesLayers(t *testing.T) {
 	})
 
 	checkFileExists(t, filepath.Join(p, "blobs", "*"), []string{
+		filepath.Join(p, "blobs", "sha256-3c0eaaf09feef8b4f4a0eaefdf25a1f0c79c10aed97575feb1ad21dd6cc8d90a"),
 		filepath.Join(p, "blobs", "sha256-a4e5e156ddec27e286f75328784d7106b60a4eb1d246e950a001a3f944fbda99"),
 		filepath.Join(p, "blobs", "sha256-b507b9c2f6ca642bffcd06665ea7c91f235fd32daeefdf875a0f938db05fb315"),
-		filepath.Join(p, "blobs", "sha256-bc80b03733773e0728011b2f4adf34c458b400e1aad48cb28d61170f3a2ad2d6"),
 	})
 
 	w = createRequest(t, s.CreateHandler, api.CreateRequest{
@@ -197,8 +203,8 @@ func TestCreateRemovesLayers(t *testing.T) {
 	})
 
 	checkFileExists(t, filepath.Join(p, "blobs", "*"), []string{
-		filepath.Join(p, "blobs", "sha256-8f2c2167d789c6b2302dff965160fa5029f6a24096d262c1cbb469f21a045382"),
 		filepath.Join(p, "blobs", "sha256-a4e5e156ddec27e286f75328784d7106b60a4eb1d246e950a001a3f944fbda99"),
+		filepath.Join(p, "blobs", "sha256-fa75e1e251078c760560062073fb30454d2eb2bd5c7453824fc263e939a2c4f9"),
 		filepath.Join(p, "blobs", "sha256-fe7ac77b725cda2ccad03f88a880ecdfd7a33192d6cae08fce2c0ee1455991ed"),
 	})
 }
@@ -225,7 +231,7 @@ func TestCreateUnsetsSystem(t *testing.T) {
 	})
 
 	checkFileExists(t, filepath.Join(p, "blobs", "*"), []string{
-		filepath.Join(p, "blobs", "sha256-8585df945d1069bc78b79bd10bb73ba07fbc29b0f5479a31a601c0d12731416e"),
+		filepath.Join(p, "blobs", "sha256-0535f13dbee9cd2f652be7b56473f6c146470e8469f4894743b96c5f104be97a"),
 		filepath.Join(p, "blobs", "sha256-a4e5e156ddec27e286f75328784d7106b60a4eb1d246e950a001a3f944fbda99"),
 		filepath.Join(p, "blobs", "sha256-f29e82a8284dbdf5910b1555580ff60b04238b8da9d5e51159ada67a4d0d5851"),
 	})
@@ -245,7 +251,7 @@ func TestCreateUnsetsSystem(t *testing.T) {
 	})
 
 	checkFileExists(t, filepath.Join(p, "blobs", "*"), []string{
-		filepath.Join(p, "blobs", "sha256-67d4b8d106af2a5b100a46e9bdc038c71eef2a35c9abac784092654212f97cf5"),
+		filepath.Join(p, "blobs", "sha256-6573ad1a241552c0c579691da28621c1f5d0a911a1c3cca276c10bcd070663cb"),
 		filepath.Join(p, "blobs", "sha256-a4e5e156ddec27e286f75328784d7106b60a4eb1d246e950a001a3f944fbda99"),
 		filepath.Join(p, "blobs", "sha256-e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"),
 	})
@@ -283,8 +289,8 @@ func TestCreateMergeParameters(t *testing.T) {
 
 	checkFileExists(t, filepath.Join(p, "blobs", "*"), []string{
 		filepath.Join(p, "blobs", "sha256-1d0ad71299d48c2fb7ae2b98e683643e771f8a5b72be34942af90d97a91c1e37"),
-		filepath.Join(p, "blobs", "sha256-4a384beaf47a9cbe452dfa5ab70eea691790f3b35a832d12933a1996685bf2b6"),
 		filepath.Join(p, "blobs", "sha256-a4e5e156ddec27e286f75328784d7106b60a4eb1d246e950a001a3f944fbda99"),
+		filepath.Join(p, "blobs", "sha256-eee6a6d133f10a0151fcbc09e04c9a02ba4f19e21b5f46e7b470d37210a4499b"),
 	})
 
 	// in order to merge parameters, the second model must be created FROM the first
@@ -305,10 +311,10 @@ func TestCreateMergeParameters(t *testing.T) {
 
 	checkFileExists(t, filepath.Join(p, "blobs", "*"), []string{
 		filepath.Join(p, "blobs", "sha256-1d0ad71299d48c2fb7ae2b98e683643e771f8a5b72be34942af90d97a91c1e37"),
-		filepath.Join(p, "blobs", "sha256-4a384beaf47a9cbe452dfa5ab70eea691790f3b35a832d12933a1996685bf2b6"),
-		filepath.Join(p, "blobs", "sha256-4cd9d4ba6b734d9b4cbd1e5caa60374c00722e993fce5e1e2d15a33698f71187"),
 		filepath.Join(p, "blobs", "sha256-a4e5e156ddec27e286f75328784d7106b60a4eb1d246e950a001a3f944fbda99"),
 		filepath.Join(p, "blobs", "sha256-e29a7b3c47287a2489c895d21fe413c20f859a85d20e749492f52a838e36e1ba"),
+		filepath.Join(p, "blobs", "sha256-eee6a6d133f10a0151fcbc09e04c9a02ba4f19e21b5f46e7b470d37210a4499b"),
+		filepath.Join(p, "blobs", "sha256-f1f971c9caca05531c41500c38430543f463df91d9322dcbe0d89d88ff99e52f"),
 	})
 
 	actual, err := os.ReadFile(filepath.Join(p, "blobs", "sha256-e29a7b3c47287a2489c895d21fe413c20f859a85d20e749492f52a838e36e1ba"))
@@ -342,11 +348,11 @@ func TestCreateMergeParameters(t *testing.T) {
 	})
 
 	checkFileExists(t, filepath.Join(p, "blobs", "*"), []string{
+		filepath.Join(p, "blobs", "sha256-086800afb5ea1dcabe820382bf4ffe9c522ae20b98fa3ac330c8608d058a6a2c"),
 		filepath.Join(p, "blobs", "sha256-12f58bb75cb3042d69a7e013ab87fb3c3c7088f50ddc62f0c77bd332f0d44d35"),
 		filepath.Join(p, "blobs", "sha256-1d0ad71299d48c2fb7ae2b98e683643e771f8a5b72be34942af90d97a91c1e37"),
-		filepath.Join(p, "blobs", "sha256-257aa726584f24970a4f240765e75a7169bfbe7f4966c1f04513d6b6c860583a"),
-		filepath.Join(p, "blobs", "sha256-4a384beaf47a9cbe452dfa5ab70eea691790f3b35a832d12933a1996685bf2b6"),
 		filepath.Join(p, "blobs", "sha256-a4e5e156ddec27e286f75328784d7106b60a4eb1d246e950a001a3f944fbda99"),
+		filepath.Join(p, "blobs", "sha256-eee6a6d133f10a0151fcbc09e04c9a02ba4f19e21b5f46e7b470d37210a4499b"),
 	})
 
 	actual, err = os.ReadFile(filepath.Join(p, "blobs", "sha256-12f58bb75cb3042d69a7e013ab87fb3c3c7088f50ddc62f0c77bd332f0d44d35"))
@@ -388,7 +394,7 @@ func TestCreateReplacesMessages(t *testing.T) {
 	checkFileExists(t, filepath.Join(p, "blobs", "*"), []string{
 		filepath.Join(p, "blobs", "sha256-298baeaf6928a60cf666d88d64a1ba606feb43a2865687c39e40652e407bffc4"),
 		filepath.Join(p, "blobs", "sha256-a4e5e156ddec27e286f75328784d7106b60a4eb1d246e950a001a3f944fbda99"),
-		filepath.Join(p, "blobs", "sha256-e0e27d47045063ccb167ae852c51d49a98eab33fabaee4633fdddf97213e40b5"),
+		filepath.Join(p, "blobs", "sha256-bbffaa50350aa7b46f162449a2e6913df5b1fbb4ede275811103b2658403a3e3"),
 	})
 
 	w = createRequest(t, s.CreateHandler, api.CreateRequest{
@@ -408,10 +414,10 @@ func TestCreateReplacesMessages(t *testing.T) {
 
 	checkFileExists(t, filepath.Join(p, "blobs", "*"), []string{
 		filepath.Join(p, "blobs", "sha256-298baeaf6928a60cf666d88d64a1ba606feb43a2865687c39e40652e407bffc4"),
-		filepath.Join(p, "blobs", "sha256-4f48b25fe9969564c82f58eb1cedbdff6484cc0baf474bc6c2a9b37c8da3362a"),
+		filepath.Join(p, "blobs", "sha256-348aad7099eb7264002fb8825f1e54d3b1b2df71504b53d8623a51f3d2a1dee7"),
 		filepath.Join(p, "blobs", "sha256-a4e5e156ddec27e286f75328784d7106b60a4eb1d246e950a001a3f944fbda99"),
 		filepath.Join(p, "blobs", "sha256-a60ecc9da299ec7ede453f99236e5577fd125e143689b646d9f0ddc9971bf4db"),
-		filepath.Join(p, "blobs", "sha256-e0e27d47045063ccb167ae852c51d49a98eab33fabaee4633fdddf97213e40b5"),
+		filepath.Join(p, "blobs", "sha256-bbffaa50350aa7b46f162449a2e6913df5b1fbb4ede275811103b2658403a3e3"),
 	})
 
 	type message struct {
@@ -463,7 +469,7 @@ func TestCreateTemplateSystem(t *testing.T) {
 	})
 
 	checkFileExists(t, filepath.Join(p, "blobs", "*"), []string{
-		filepath.Join(p, "blobs", "sha256-2b5e330885117c82f3fd75169ea323e141070a2947c11ddb9f79ee0b01c589c1"),
+		filepath.Join(p, "blobs", "sha256-36abcdd900c4c38767fc329e46a9ccd06c67b157d2fb120438cfe8c5c4319211"),
 		filepath.Join(p, "blobs", "sha256-4c5f51faac758fecaff8db42f0b7382891a4d0c0bb885f7b86be88c814a7cc86"),
 		filepath.Join(p, "blobs", "sha256-a4e5e156ddec27e286f75328784d7106b60a4eb1d246e950a001a3f944fbda99"),
 		filepath.Join(p, "blobs", "sha256-fe7ac77b725cda2ccad03f88a880ecdfd7a33192d6cae08fce2c0ee1455991ed"),
@@ -547,8 +553,8 @@ func TestCreateLicenses(t *testing.T) {
 
 	checkFileExists(t, filepath.Join(p, "blobs", "*"), []string{
 		filepath.Join(p, "blobs", "sha256-2af71558e438db0b73a20beab92dc278a94e1bbe974c00c1a33e3ab62d53a608"),
-		filepath.Join(p, "blobs", "sha256-79a39c37536ddee29cbadd5d5e2dcba8ed7f03e431f626ff38432c1c866bb7e2"),
 		filepath.Join(p, "blobs", "sha256-a4e5e156ddec27e286f75328784d7106b60a4eb1d246e950a001a3f944fbda99"),
+		filepath.Join(p, "blobs", "sha256-d01ba4740946091c715a220d0b69e4710509424651bc2fac21910bfa7add3d65"),
 		filepath.Join(p, "blobs", "sha256-e5dcffe836b6ec8a58e492419b550e65fb8cbdc308503979e5dacb33ac7ea3b7"),
 	})
 
@@ -595,7 +601,7 @@ func TestCreateDetectTemplate(t *testing.T) {
 			filepath.Join(p, "blobs", "sha256-0d79f567714c62c048378f2107fb332dabee0135d080c302d884317da9433cc5"),
 			filepath.Join(p, "blobs", "sha256-35360843d0c84fb1506952a131bbef13cd2bb4a541251f22535170c05b56e672"),
 			filepath.Join(p, "blobs", "sha256-553c4a3f747b3d22a4946875f1cc8ed011c2930d83f864a0c7265f9ec0a20413"),
-			filepath.Join(p, "blobs", "sha256-de3959f841e9ef6b4b6255fa41cb9e0a45da89c3066aa72bdd07a4747f848990"),
+			filepath.Join(p, "blobs", "sha256-d76386db8a9dfc89cb6db1a48b32cefb2b94151575f7615e2d23e5beb817ea72"),
 		})
 	})
 
@@ -611,8 +617,357 @@ func TestCreateDetectTemplate(t *testing.T) {
 		}
 
 		checkFileExists(t, filepath.Join(p, "blobs", "*"), []string{
+			filepath.Join(p, "blobs", "sha256-5fc8de4128b05c10b1dc4c258778b7a6bfd713569af6d202a2027d09258563d4"),
 			filepath.Join(p, "blobs", "sha256-a4e5e156ddec27e286f75328784d7106b60a4eb1d246e950a001a3f944fbda99"),
-			filepath.Join(p, "blobs", "sha256-ca239d7bd8ea90e4a5d2e6bf88f8d74a47b14336e73eb4e18bed4dd325018116"),
 		})
 	})
 }
+
+func uploadBlobChunks(t *testing.T, s *Server, bts []byte, chunk int) string {
+	t.Helper()
+
+	digest := fmt.Sprintf("sha256:%x", sha256.Sum256(bts))
+	for start := 0; start < len(bts); start += chunk {
+		end := min(start+chunk, len(bts))
+
+		w := NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		c.Params = gin.Params{{Key: "digest", Value: digest}}
+		c.Request = httptest.NewRequest(http.MethodPost, "/api/blobs/"+digest, bytes.NewReader(bts[start:end]))
+		c.Request.Header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end-1, len(bts)))
+		s.CreateBlobHandler(c)
+		c.Writer.WriteHeaderNow()
+
+		want := http.StatusAccepted
+		if end == len(bts) {
+			want = http.StatusCreated
+		}
+
+		if w.Code != want {
+			t.Fatalf("expected status code %d, actual %d: %s", want, w.Code, w.Body.String())
+		}
+	}
+
+	return digest
+}
+
+func TestCreateStructured(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	p := t.TempDir()
+	t.Setenv("OLLAMA_MODELS", p)
+
+	bts, err := os.ReadFile(createBinFile(t, nil, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var s Server
+	digest := uploadBlobChunks(t, &s, bts, 16)
+
+	w := createRequest(t, s.CreateHandler, api.CreateRequest{
+		Name:     "test",
+		Files:    map[string]string{"test.gguf": digest},
+		Template: "{{ .Prompt }}",
+		System:   "You are a helpful assistant.",
+		License:  "MIT",
+		Parameters: map[string]any{
+			"temperature": 0.5,
+			"seed":        12345678,
+			"num_ctx":     1048576,
+			"stop":        []any{"<|user|>", "<|end|>"},
+		},
+		Messages: []api.Message{{Role: "user", Content: "Hello!"}},
+		Stream:   &stream,
+	})
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status code 200, actual %d: %s", w.Code, w.Body.String())
+	}
+
+	m, err := GetModel("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if m.Template.String() != "{{ .Prompt }}" {
+		t.Errorf("unexpected template: %q", m.Template.String())
+	}
+
+	if m.System != "You are a helpful assistant." {
+		t.Errorf("unexpected system: %q", m.System)
+	}
+
+	if !slices.Equal(m.License, []string{"MIT"}) {
+		t.Errorf("unexpected license: %v", m.License)
+	}
+
+	if len(m.Messages) != 1 || m.Messages[0].Content != "Hello!" {
+		t.Errorf("unexpected messages: %v", m.Messages)
+	}
+
+	if m.Options["temperature"] != 0.5 {
+		t.Errorf("unexpected temperature: %v", m.Options["temperature"])
+	}
+
+	if m.Options["seed"] != float64(12345678) || m.Options["num_ctx"] != float64(1048576) {
+		t.Errorf("unexpected seed and num_ctx: %v, %v", m.Options["seed"], m.Options["num_ctx"])
+	}
+
+	if stop, ok := m.Options["stop"].([]any); !ok || len(stop) != 2 {
+		t.Errorf("unexpected stop: %v", m.Options["stop"])
+	}
+
+	t.Run("from and files", func(t *testing.T) {
+		w := createRequest(t, s.CreateHandler, api.CreateRequest{
+			Name:   "test2",
+			From:   "test",
+			Files:  map[string]string{"test.gguf": digest},
+			Stream: &stream,
+		})
+
+		if w.Code != http.StatusBadRequest {
+			t.Fatalf("expected status code 400, actual %d", w.Code)
+		}
+	})
+
+	t.Run("from model", func(t *testing.T) {
+		w := createRequest(t, s.CreateHandler, api.CreateRequest{
+			Name:   "test2",
+			From:   "test",
+			System: "You are a pirate.",
+			Stream: &stream,
+		})
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status code 200, actual %d", w.Code)
+		}
+
+		m, err := GetModel("test2")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if m.System != "You are a pirate." {
+			t.Errorf("unexpected system: %q", m.System)
+		}
+	})
+}
+
+func TestCreateBlobChunks(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+
+	var s Server
+	bts := []byte("the quick brown fox jumps over the lazy dog")
+	digest := fmt.Sprintf("sha256:%x", sha256.Sum256(bts))
+
+	post := func(start, end int) *httptest.ResponseRecorder {
+		w := NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		c.Params = gin.Params{{Key: "digest", Value: digest}}
+		c.Request = httptest.NewRequest(http.MethodPost, "/api/blobs/"+digest, bytes.NewReader(bts[start:end]))
+		c.Request.Header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end-1, len(bts)))
+		s.CreateBlobHandler(c)
+		c.Writer.WriteHeaderNow()
+		return w.ResponseRecorder
+	}
+
+	if w := post(0, 10); w.Code != http.StatusAccepted {
+		t.Fatalf("expected status code 202, actual %d", w.Code)
+	} else if r := w.Header().Get("Range"); r != "bytes=0-9" {
+		t.Errorf("unexpected range %q", r)
+	}
+
+	// skipping ahead is rejected with the bytes received so far
+	if w := post(20, 30); w.Code != http.StatusRequestedRangeNotSatisfiable {
+		t.Fatalf("expected status code 416, actual %d", w.Code)
+	} else if r := w.Header().Get("Range"); r != "bytes=0-9" {
+		t.Errorf("unexpected range %q", r)
+	}
+
+	w := NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Params = gin.Params{{Key: "digest", Value: digest}}
+	c.Request = httptest.NewRequest(http.MethodHead, "/api/blobs/"+digest, nil)
+	s.HeadBlobHandler(c)
+	c.Writer.WriteHeaderNow()
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("expected status code 404, actual %d", w.Code)
+	} else if r := w.Header().Get("Range"); r != "bytes=0-9" {
+		t.Errorf("unexpected range %q", r)
+	}
+
+	if w := post(10, len(bts)); w.Code != http.StatusCreated {
+		t.Fatalf("expected status code 201, actual %d", w.Code)
+	}
+
+	p, err := GetBlobsPath(digest)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got, err := os.ReadFile(p); err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(got, bts) {
+		t.Errorf("unexpected blob contents %q", got)
+	}
+}
+
+func TestCreateSoftPrompt(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	p := t.TempDir()
+	t.Setenv("OLLAMA_MODELS", p)
+	var s Server
+
+	base := createBinFile(t, llm.KV{
+		"general.architecture":   "llama",
+		"llama.embedding_length": uint32(4),
+	}, nil)
+
+	// shapes are virtual tokens by embedding length
+	softPrompt := func(shape ...uint64) string {
+		return createBinFile(t, llm.KV{"general.architecture": "llama"}, []llm.Tensor{
+			{Name: "prompt_embd.weight", Shape: shape, WriterTo: bytes.NewReader(make([]byte, 4*shape[0]*shape[1]))},
+		})
+	}
+
+	w := createRequest(t, s.CreateHandler, api.CreateRequest{
+		Name:      "test",
+		Modelfile: fmt.Sprintf("FROM %s\nSOFTPROMPT %s", base, softPrompt(2, 4)),
+		Stream:    &stream,
+	})
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status code 200, actual %d", w.Code)
+	}
+
+	m, err := GetModel("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if m.SoftPromptPath == "" {
+		t.Error("expected soft prompt")
+	}
+
+	t.Run("mismatched embedding length", func(t *testing.T) {
+		w := createRequest(t, s.CreateHandler, api.CreateRequest{
+			Name:      "test2",
+			Modelfile: fmt.Sprintf("FROM %s\nSOFTPROMPT %s", base, softPrompt(2, 8)),
+			Stream:    &stream,
+		})
+
+		if w.Code != http.StatusInternalServerError {
+			t.Fatalf("expected status code 500, actual %d", w.Code)
+		}
+	})
+
+	t.Run("no base model", func(t *testing.T) {
+		w := createRequest(t, s.CreateHandler, api.CreateRequest{
+			Name:      "test3",
+			Modelfile: fmt.Sprintf("SOFTPROMPT %s\nFROM %s", softPrompt(2, 4), base),
+			Stream:    &stream,
+		})
+
+		if w.Code != http.StatusInternalServerError {
+			t.Fatalf("expected status code 500, actual %d", w.Code)
+		}
+	})
+}
+
+func TestCreateProvenance(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	p := t.TempDir()
+	t.Setenv("OLLAMA_MODELS", p)
+	var s Server
+
+	bin := createBinFile(t, llm.KV{
+		"general.architecture":                  "llama",
+		"general.source.huggingface.repository": "example/model",
+	}, nil)
+
+	b, err := os.ReadFile(bin)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := createRequest(t, s.CreateHandler, api.CreateRequest{
+		Name:      "test",
+		Modelfile: fmt.Sprintf("FROM %s", bin),
+		Stream:    &stream,
+	})
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status code 200, actual %d", w.Code)
+	}
+
+	w = createRequest(t, s.CreateHandler, api.CreateRequest{
+		Name:      "test2",
+		Modelfile: "FROM test\nSYSTEM be brief",
+		Stream:    &stream,
+	})
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status code 200, actual %d", w.Code)
+	}
+
+	parent, err := ParseNamedManifest(model.ParseName("test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tool := "ollama " + version.Version
+	first := &api.Provenance{
+		Tool:   tool,
+		Source: "example/model",
+		Parents: []api.ProvenanceParent{
+			{Type: "model", Digest: fmt.Sprintf("sha256:%x", sha256.Sum256(b)), Format: "gguf"},
+		},
+	}
+
+	expect := &api.Provenance{
+		Tool:   tool,
+		Source: "example/model",
+		Parents: []api.ProvenanceParent{
+			{Type: "model", Name: "test:latest", Digest: "sha256:" + parent.digest, Provenance: first},
+		},
+	}
+
+	w = createRequest(t, s.ShowHandler, api.ShowRequest{Name: "test2"})
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status code 200, actual %d", w.Code)
+	}
+
+	var resp struct {
+		Provenance json.RawMessage `json:"provenance"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+
+	want, err := json.Marshal(expect)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(resp.Provenance, want) {
+		t.Errorf("expected provenance %s, got %s", want, resp.Provenance)
+	}
+
+	t.Run("perplexity without quantization", func(t *testing.T) {
+		w := createRequest(t, s.CreateHandler, api.CreateRequest{
+			Name:            "test3",
+			Modelfile:       "FROM test",
+			CheckPerplexity: true,
+			Stream:          &stream,
+		})
+
+		if w.Code != http.StatusBadRequest {
+			t.Fatalf("expected status code 400, actual %d", w.Code)
+		}
+	})
+}
@@ -2,11 +2,15 @@ package server
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
+	"net/http/httptest"
 	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/gin-gonic/gin"
 
@@ -46,9 +50,9 @@ func TestDelete(t *testing.T) {
 	})
 
 	checkFileExists(t, filepath.Join(p, "blobs", "*"), []string{
-		filepath.Join(p, "blobs", "sha256-8f2c2167d789c6b2302dff965160fa5029f6a24096d262c1cbb469f21a045382"),
+		filepath.Join(p, "blobs", "sha256-5fc8de4128b05c10b1dc4c258778b7a6bfd713569af6d202a2027d09258563d4"),
 		filepath.Join(p, "blobs", "sha256-a4e5e156ddec27e286f75328784d7106b60a4eb1d246e950a001a3f944fbda99"),
-		filepath.Join(p, "blobs", "sha256-ca239d7bd8ea90e4a5d2e6bf88f8d74a47b14336e73eb4e18bed4dd325018116"),
+		filepath.Join(p, "blobs", "sha256-fa75e1e251078c760560062073fb30454d2eb2bd5c7453824fc263e939a2c4f9"),
 		filepath.Join(p, "blobs", "sha256-fe7ac77b725cda2ccad03f88a880ecdfd7a33192d6cae08fce2c0ee1455991ed"),
 	})
 
@@ -63,8 +67,8 @@ func TestDelete(t *testing.T) {
 	})
 
 	checkFileExists(t, filepath.Join(p, "blobs", "*"), []string{
-		filepath.Join(p, "blobs", "sha256-8f2c2167d789c6b2302dff965160fa5029f6a24096d262c1cbb469f21a045382"),
 		filepath.Join(p, "blobs", "sha256-a4e5e156ddec27e286f75328784d7106b60a4eb1d246e950a001a3f944fbda99"),
+		filepath.Join(p, "blobs", "sha256-fa75e1e251078c760560062073fb30454d2eb2bd5c7453824fc263e939a2c4f9"),
 		filepath.Join(p, "blobs", "sha256-fe7ac77b725cda2ccad03f88a880ecdfd7a33192d6cae08fce2c0ee1455991ed"),
 	})
 
@@ -109,3 +113,140 @@ func TestDeleteDuplicateLayers(t *testing.T) {
 
 	checkFileExists(t, filepath.Join(p, "manifests", "*", "*", "*", "*"), []string{})
 }
+
+func TestDeleteInUse(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	p := t.TempDir()
+	t.Setenv("OLLAMA_MODELS", p)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	s := Server{sched: InitScheduler(ctx)}
+	s.sched.Run(ctx)
+
+	w := createRequest(t, s.CreateHandler, api.CreateRequest{
+		Name:      "test",
+		Modelfile: fmt.Sprintf("FROM %s", createBinFile(t, nil, nil)),
+		Stream:    &stream,
+	})
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status code 200, actual %d", w.Code)
+	}
+
+	m, err := GetModel("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a loaded runner processing a request
+	llama := &mockLlm{}
+	s.sched.loadedMu.Lock()
+	s.sched.loaded[m.ModelPath] = &runnerRef{
+		model:           m,
+		modelPath:       m.ModelPath,
+		llama:           llama,
+		Options:         &api.Options{},
+		sessionDuration: time.Minute,
+		refCount:        1,
+	}
+	s.sched.loadedMu.Unlock()
+
+	w = createRequest(t, s.DeleteHandler, api.DeleteRequest{Model: "test"})
+	if w.Code != http.StatusConflict {
+		t.Fatalf("expected status code 409, actual %d", w.Code)
+	}
+
+	checkFileExists(t, filepath.Join(p, "manifests", "*", "*", "*", "*"), []string{
+		filepath.Join(p, "manifests", "registry.ollama.ai", "library", "test", "latest"),
+	})
+
+	deleted := make(chan *httptest.ResponseRecorder)
+	go func() {
+		deleted <- createRequest(t, s.DeleteHandler, api.DeleteRequest{Model: "test", Force: true})
+	}()
+
+	// a forced delete waits for the request to finish, and new requests fail
+	// in the meantime
+	time.Sleep(50 * time.Millisecond)
+	select {
+	case w := <-deleted:
+		t.Fatalf("expected delete to wait for the request, got status code %d", w.Code)
+	default:
+	}
+
+	if _, _, _, err := s.scheduleRunner(ctx, "test", nil, nil, nil); !errors.Is(err, errModelDeleting) {
+		t.Errorf("expected model to be deleting, got %v", err)
+	}
+
+	s.sched.finishedReqCh <- &LlmRequest{model: m}
+
+	select {
+	case w := <-deleted:
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status code 200, actual %d", w.Code)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout")
+	}
+
+	if !llama.closeCalled {
+		t.Error("expected runner to be unloaded")
+	}
+
+	checkFileExists(t, filepath.Join(p, "manifests", "*", "*", "*", "*"), []string{})
+	checkFileExists(t, filepath.Join(p, "blobs", "*"), []string{})
+}
+
+func TestDeleteCopyInUse(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	s := Server{sched: InitScheduler(ctx)}
+	s.sched.Run(ctx)
+
+	w := createRequest(t, s.CreateHandler, api.CreateRequest{
+		Name:      "test",
+		Modelfile: fmt.Sprintf("FROM %s", createBinFile(t, nil, nil)),
+		Stream:    &stream,
+	})
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status code 200, actual %d", w.Code)
+	}
+
+	if w := createRequest(t, s.CopyHandler, api.CopyRequest{Source: "test", Destination: "copy"}); w.Code != http.StatusOK {
+		t.Fatalf("expected status code 200, actual %d", w.Code)
+	}
+
+	m, err := GetModel("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the runner loaded for the original, processing a request
+	llama := &mockLlm{}
+	s.sched.loadedMu.Lock()
+	s.sched.loaded[m.ModelPath] = &runnerRef{
+		model:           m,
+		modelPath:       m.ModelPath,
+		llama:           llama,
+		Options:         &api.Options{},
+		sessionDuration: time.Minute,
+		refCount:        1,
+	}
+	s.sched.loadedMu.Unlock()
+
+	if w := createRequest(t, s.DeleteHandler, api.DeleteRequest{Model: "copy"}); w.Code != http.StatusOK {
+		t.Fatalf("expected status code 200, actual %d", w.Code)
+	}
+
+	if llama.closeCalled || !s.sched.isLoaded(m) {
+		t.Error("expected the runner of the original to stay loaded")
+	}
+}
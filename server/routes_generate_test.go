@@ -7,6 +7,9 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
 	"strings"
 	"sync"
 	"testing"
@@ -38,6 +41,11 @@ func (m *mockRunner) Completion(ctx context.Context, r llm.CompletionRequest, fn
 	return nil
 }
 
+// Adapters resolves the ambiguity with CompletionRequest.Adapters
+func (m *mockRunner) Adapters(ctx context.Context) ([]llm.AdapterStatus, error) {
+	return m.LlamaServer.Adapters(ctx)
+}
+
 func (mockRunner) Tokenize(_ context.Context, s string) (tokens []int, err error) {
 	for range strings.Fields(s) {
 		tokens = append(tokens, len(tokens))
@@ -46,8 +54,17 @@ func (mockRunner) Tokenize(_ context.Context, s string) (tokens []int, err error
 	return
 }
 
-func newMockServer(mock *mockRunner) func(discover.GpuInfoList, string, *llm.GGML, []string, []string, api.Options, int) (llm.LlamaServer, error) {
-	return func(gpus discover.GpuInfoList, model string, ggml *llm.GGML, projectors, system []string, opts api.Options, numParallel int) (llm.LlamaServer, error) {
+func (mockRunner) Detokenize(_ context.Context, tokens []int) (string, error) {
+	s := make([]string, len(tokens))
+	for i, t := range tokens {
+		s[i] = strconv.Itoa(t)
+	}
+
+	return strings.Join(s, " "), nil
+}
+
+func newMockServer(mock *mockRunner) func(discover.GpuInfoList, string, *llm.GGML, []string, []string, string, string, api.Options, int) (llm.LlamaServer, error) {
+	return func(gpus discover.GpuInfoList, model string, ggml *llm.GGML, projectors, system []string, softPrompt, sessionDir string, opts api.Options, numParallel int) (llm.LlamaServer, error) {
 		return mock, nil
 	}
 }
@@ -280,6 +297,93 @@ func TestGenerateChat(t *testing.T) {
 		checkChatResponse(t, w.Body, "test", "Hi!")
 	})
 
+	t.Run("messages with template", func(t *testing.T) {
+		w := createRequest(t, s.ChatHandler, api.ChatRequest{
+			Model: "test",
+			Messages: []api.Message{
+				{Role: "user", Content: "Hello!"},
+			},
+			Template: "{{- range .Messages }}<{{ .Role }}>{{ .Content }}{{ end }}",
+			Stream:   &stream,
+		})
+
+		if w.Code != http.StatusOK {
+			t.Errorf("expected status 200, got %d", w.Code)
+		}
+
+		if diff := cmp.Diff(mock.CompletionRequest.Prompt, "<user>Hello!"); diff != "" {
+			t.Errorf("mismatch (-got +want):\n%s", diff)
+		}
+
+		checkChatResponse(t, w.Body, "test", "Hi!")
+	})
+
+	t.Run("messages with best_of", func(t *testing.T) {
+		w := createRequest(t, s.ChatHandler, api.ChatRequest{
+			Model: "test",
+			Messages: []api.Message{
+				{Role: "user", Content: "Hello!"},
+			},
+			Options: map[string]any{"best_of": 2},
+			Stream:  &stream,
+		})
+
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("expected status 400, got %d", w.Code)
+		}
+
+		if diff := cmp.Diff(w.Body.String(), `{"error":"best_of can't be used with chat"}`); diff != "" {
+			t.Errorf("mismatch (-got +want):\n%s", diff)
+		}
+	})
+
+	t.Run("messages with invalid template", func(t *testing.T) {
+		w := createRequest(t, s.ChatHandler, api.ChatRequest{
+			Model: "test",
+			Messages: []api.Message{
+				{Role: "user", Content: "Hello!"},
+			},
+			Template: "{{ .Messages",
+			Stream:   &stream,
+		})
+
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("expected status 400, got %d", w.Code)
+		}
+	})
+
+	t.Run("messages with session seed", func(t *testing.T) {
+		seeds := make([]int, 3)
+		msgs := []api.Message{{Role: "user", Content: "Hello!"}}
+		for i := range seeds {
+			w := createRequest(t, s.ChatHandler, api.ChatRequest{
+				Model:    "test",
+				Messages: msgs,
+				Stream:   &stream,
+				Options:  map[string]any{"seed": 42, "session_seed": true},
+			})
+
+			if w.Code != http.StatusOK {
+				t.Fatalf("expected status 200, got %d", w.Code)
+			}
+
+			seeds[i] = mock.CompletionRequest.Options.Seed
+			msgs = append(msgs, api.Message{Role: "assistant", Content: "Hi!"}, api.Message{Role: "user", Content: "Again!"})
+		}
+
+		if seeds[0] != 42 {
+			t.Errorf("expected first turn to use seed 42, got %d", seeds[0])
+		}
+
+		if seeds[1] == seeds[0] || seeds[2] == seeds[1] || seeds[2] == seeds[0] {
+			t.Errorf("expected seed to advance each turn, got %v", seeds)
+		}
+
+		if got := sessionSeed(42, msgs[:3]); got != seeds[1] {
+			t.Errorf("expected seed %d to be reproducible, got %d", seeds[1], got)
+		}
+	})
+
 	w = createRequest(t, s.CreateHandler, api.CreateRequest{
 		Model:     "test-system",
 		Modelfile: "FROM test\nSYSTEM You are a helpful assistant.",
@@ -289,6 +393,60 @@ func TestGenerateChat(t *testing.T) {
 		t.Fatalf("expected status 200, got %d", w.Code)
 	}
 
+	t.Run("messages migrated", func(t *testing.T) {
+		w := createRequest(t, s.ChatHandler, api.ChatRequest{
+			Model: "test",
+			Messages: []api.Message{
+				{Role: "user", Content: "Hello!"},
+				{Role: "assistant", Content: "Hi there, how"},
+			},
+			MigrateFrom: "test-system",
+			Stream:      &stream,
+			Options:     map[string]any{"seed": 42, "session_seed": true},
+		})
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+
+		if seed := mock.CompletionRequest.Options.Seed; seed != 42 {
+			t.Errorf("expected the seed of the migrated turn, got %d", seed)
+		}
+
+		if n := mock.CompletionRequest.DiscardSamples; n != 3 {
+			t.Errorf("expected the sampler to skip the 3 tokens of the partial response, got %d", n)
+		}
+	})
+
+	t.Run("messages migrated without response", func(t *testing.T) {
+		w := createRequest(t, s.ChatHandler, api.ChatRequest{
+			Model:       "test",
+			Messages:    []api.Message{{Role: "user", Content: "Hello!"}},
+			MigrateFrom: "test-system",
+			Stream:      &stream,
+		})
+
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("expected status 400, got %d", w.Code)
+		}
+	})
+
+	t.Run("messages migrated from missing model", func(t *testing.T) {
+		w := createRequest(t, s.ChatHandler, api.ChatRequest{
+			Model: "test",
+			Messages: []api.Message{
+				{Role: "user", Content: "Hello!"},
+				{Role: "assistant", Content: "Hi"},
+			},
+			MigrateFrom: "missing",
+			Stream:      &stream,
+		})
+
+		if w.Code != http.StatusNotFound {
+			t.Errorf("expected status 404, got %d", w.Code)
+		}
+	})
+
 	t.Run("messages with model system", func(t *testing.T) {
 		w := createRequest(t, s.ChatHandler, api.ChatRequest{
 			Model: "test-system",
@@ -306,9 +464,40 @@ func TestGenerateChat(t *testing.T) {
 			t.Errorf("mismatch (-got +want):\n%s", diff)
 		}
 
+		if mock.CompletionRequest.CacheLength != nil {
+			t.Errorf("expected the whole prompt to be cached, got a cache length of %d", *mock.CompletionRequest.CacheLength)
+		}
+
 		checkChatResponse(t, w.Body, "test-system", "Hi!")
 	})
 
+	t.Run("messages without cache", func(t *testing.T) {
+		cache := false
+		w := createRequest(t, s.ChatHandler, api.ChatRequest{
+			Model: "test-system",
+			Messages: []api.Message{
+				{Role: "user", Content: "Hello!"},
+				{Role: "assistant", Content: "Hi!"},
+				{Role: "user", Content: "My password is hunter2", Cache: &cache},
+			},
+			Stream: &stream,
+		})
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d", w.Code)
+		}
+
+		prompt := mock.CompletionRequest.Prompt
+		n := mock.CompletionRequest.CacheLength
+		if n == nil {
+			t.Fatal("expected a cache length")
+		}
+
+		if diff := cmp.Diff(prompt[:*n], "system: You are a helpful assistant.\nuser: Hello!\nassistant: Hi!\n"); diff != "" {
+			t.Errorf("mismatch (-got +want):\n%s", diff)
+		}
+	})
+
 	mock.CompletionResponse.Content = "Abra kadabra!"
 	t.Run("messages with system", func(t *testing.T) {
 		w := createRequest(t, s.ChatHandler, api.ChatRequest{
@@ -354,6 +543,70 @@ func TestGenerateChat(t *testing.T) {
 		checkChatResponse(t, w.Body, "test-system", "Abra kadabra!")
 	})
 
+	t.Run("messages with session", func(t *testing.T) {
+		t.Setenv("OLLAMA_SESSIONS", t.TempDir())
+
+		for _, tt := range []struct {
+			content string
+			prompt  string
+		}{
+			{"Hello!", "system: You are a helpful assistant.\nuser: Hello!\n"},
+			{"Again!", "system: You are a helpful assistant.\nuser: Hello!\nassistant: Abra kadabra!\nuser: Again!\n"},
+		} {
+			w := createRequest(t, s.ChatHandler, api.ChatRequest{
+				Model:     "test-system",
+				Messages:  []api.Message{{Role: "user", Content: tt.content}},
+				SessionID: "chat-1",
+				Stream:    &stream,
+			})
+
+			if w.Code != http.StatusOK {
+				t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+			}
+
+			if diff := cmp.Diff(mock.CompletionRequest.Prompt, tt.prompt); diff != "" {
+				t.Errorf("mismatch (-got +want):\n%s", diff)
+			}
+
+			checkChatResponse(t, w.Body, "test-system", "Abra kadabra!")
+		}
+
+		if mock.CompletionRequest.Session == "" {
+			t.Error("expected the session to be sent to the runner")
+		}
+
+		w := createRequest(t, s.ListSessionsHandler, nil)
+		var resp api.ListSessionsResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+
+		if len(resp.Sessions) != 1 || resp.Sessions[0].ID != "chat-1" || resp.Sessions[0].Model != "test-system:latest" || resp.Sessions[0].Messages != 4 {
+			t.Errorf("unexpected sessions %+v", resp.Sessions)
+		}
+
+		w = createRequest(t, s.ChatHandler, api.ChatRequest{
+			Model:     "test",
+			Messages:  []api.Message{{Role: "user", Content: "Hello!"}},
+			SessionID: "chat-1",
+			Stream:    &stream,
+		})
+
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("expected status 400 for another model, got %d", w.Code)
+		}
+
+		w = createRequest(t, s.DeleteSessionHandler, api.DeleteSessionRequest{SessionID: "chat-1"})
+		if w.Code != http.StatusOK {
+			t.Errorf("expected status 200, got %d", w.Code)
+		}
+
+		w = createRequest(t, s.DeleteSessionHandler, api.DeleteSessionRequest{SessionID: "chat-1"})
+		if w.Code != http.StatusNotFound {
+			t.Errorf("expected status 404, got %d", w.Code)
+		}
+	})
+
 	t.Run("messages with tools (non-streaming)", func(t *testing.T) {
 		if w.Code != http.StatusOK {
 			t.Fatalf("failed to create test-system model: %d", w.Code)
@@ -823,6 +1076,41 @@ func TestGenerate(t *testing.T) {
 		checkGenerateResponse(t, w.Body, "test", "Hi!")
 	})
 
+	t.Run("metadata", func(t *testing.T) {
+		w := createRequest(t, s.GenerateHandler, api.GenerateRequest{
+			Model:    "test",
+			Prompt:   "Hello!",
+			Metadata: map[string]string{"tenant": "a"},
+			Stream:   &stream,
+		})
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d", w.Code)
+		}
+
+		var resp api.GenerateResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+
+		if diff := cmp.Diff(resp.Metadata, map[string]string{"tenant": "a"}); diff != "" {
+			t.Errorf("mismatch (-got +want):\n%s", diff)
+		}
+	})
+
+	t.Run("metadata too large", func(t *testing.T) {
+		w := createRequest(t, s.GenerateHandler, api.GenerateRequest{
+			Model:    "test",
+			Prompt:   "Hello!",
+			Metadata: map[string]string{"tenant": strings.Repeat("a", maxMetadataLength+1)},
+			Stream:   &stream,
+		})
+
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("expected status 400, got %d", w.Code)
+		}
+	})
+
 	w = createRequest(t, s.CreateHandler, api.CreateRequest{
 		Model:     "test-system",
 		Modelfile: "FROM test\nSYSTEM You are a helpful assistant.",
@@ -870,6 +1158,30 @@ func TestGenerate(t *testing.T) {
 		checkGenerateResponse(t, w.Body, "test-system", "Abra kadabra!")
 	})
 
+	t.Run("prompt without cache", func(t *testing.T) {
+		cache := false
+		w := createRequest(t, s.GenerateHandler, api.GenerateRequest{
+			Model:  "test-system",
+			Prompt: "Hello!",
+			Cache:  &cache,
+			Stream: &stream,
+		})
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d", w.Code)
+		}
+
+		prompt := mock.CompletionRequest.Prompt
+		n := mock.CompletionRequest.CacheLength
+		if n == nil {
+			t.Fatal("expected a cache length")
+		}
+
+		if diff := cmp.Diff(prompt[:*n], "System: You are a helpful assistant. "); diff != "" {
+			t.Errorf("mismatch (-got +want):\n%s", diff)
+		}
+	})
+
 	t.Run("prompt with template", func(t *testing.T) {
 		w := createRequest(t, s.GenerateHandler, api.GenerateRequest{
 			Model:  "test-system",
@@ -951,4 +1263,986 @@ TEMPLATE """{{- if .Suffix }}<PRE> {{ .Prompt }} <SUF>{{ .Suffix }} <MID>
 			t.Errorf("mismatch (-got +want):\n%s", diff)
 		}
 	})
+
+	t.Run("input tokens", func(t *testing.T) {
+		w := createRequest(t, s.GenerateHandler, api.GenerateRequest{
+			Model:       "test-system",
+			InputTokens: []int{1, 15043, 29991},
+			Stream:      &stream,
+		})
+
+		if w.Code != http.StatusOK {
+			t.Errorf("expected status 200, got %d", w.Code)
+		}
+
+		if diff := cmp.Diff(mock.CompletionRequest.Tokens, []int{1, 15043, 29991}); diff != "" {
+			t.Errorf("mismatch (-got +want):\n%s", diff)
+		}
+
+		// the model's system message isn't added to the tokens
+		if diff := cmp.Diff(mock.CompletionRequest.Prompt, ""); diff != "" {
+			t.Errorf("mismatch (-got +want):\n%s", diff)
+		}
+	})
+
+	t.Run("input tokens with prompt", func(t *testing.T) {
+		w := createRequest(t, s.GenerateHandler, api.GenerateRequest{
+			Model:       "test",
+			Prompt:      "Hello!",
+			InputTokens: []int{1, 15043},
+			Stream:      &stream,
+		})
+
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("expected status 400, got %d", w.Code)
+		}
+	})
+
+	t.Run("banned strings", func(t *testing.T) {
+		w := createRequest(t, s.CreateHandler, api.CreateRequest{
+			Model:     "test-ban",
+			Modelfile: "FROM test\nPARAMETER ban foo\nPARAMETER ban_token 5",
+			Stream:    &stream,
+		})
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+
+		w = createRequest(t, s.GenerateHandler, api.GenerateRequest{
+			Model:   "test-ban",
+			Prompt:  "Hello!",
+			Options: map[string]any{"ban": []string{"bar", "foo"}, "ban_token": []int{7}},
+			Stream:  &stream,
+		})
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+
+		// requests can't lift what the model bans
+		if diff := cmp.Diff(mock.CompletionRequest.Options.Ban, []string{"foo", "bar"}); diff != "" {
+			t.Errorf("mismatch (-got +want):\n%s", diff)
+		}
+
+		if diff := cmp.Diff(mock.CompletionRequest.Options.BanTokens, []int{5, 7}); diff != "" {
+			t.Errorf("mismatch (-got +want):\n%s", diff)
+		}
+	})
+
+	t.Run("logit bias", func(t *testing.T) {
+		w := createRequest(t, s.CreateHandler, api.CreateRequest{
+			Model:     "test-bias",
+			Modelfile: "FROM test\nPARAMETER logit_bias 5:-100\nPARAMETER logit_bias 6:1.5",
+			Stream:    &stream,
+		})
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+
+		w = createRequest(t, s.GenerateHandler, api.GenerateRequest{
+			Model:   "test-bias",
+			Prompt:  "Hello!",
+			Options: map[string]any{"logit_bias": map[string]float64{"6": -2, "7": 3}},
+			Stream:  &stream,
+		})
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+
+		// requests add to the model's biases, replacing those of the same tokens
+		if diff := cmp.Diff(mock.CompletionRequest.Options.LogitBias, map[int]float32{5: -100, 6: -2, 7: 3}); diff != "" {
+			t.Errorf("mismatch (-got +want):\n%s", diff)
+		}
+	})
+
+	t.Run("dry and xtc", func(t *testing.T) {
+		w := createRequest(t, s.CreateHandler, api.CreateRequest{
+			Model:     "test-dry",
+			Modelfile: "FROM test\nPARAMETER dry_multiplier 0.8\nPARAMETER dry_sequence_breakers .\nPARAMETER dry_sequence_breakers ;",
+			Stream:    &stream,
+		})
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+
+		w = createRequest(t, s.GenerateHandler, api.GenerateRequest{
+			Model:   "test-dry",
+			Prompt:  "Hello!",
+			Options: map[string]any{"dry_allowed_length": 3, "xtc_probability": 0.5},
+			Stream:  &stream,
+		})
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+
+		opts := mock.CompletionRequest.Options
+		if opts.DryMultiplier != 0.8 || opts.DryBase != 1.75 || opts.DryAllowedLength != 3 || opts.DryPenaltyLastN != -1 {
+			t.Errorf("unexpected dry options %v %v %v %v", opts.DryMultiplier, opts.DryBase, opts.DryAllowedLength, opts.DryPenaltyLastN)
+		}
+
+		if diff := cmp.Diff(opts.DrySequenceBreakers, []string{".", ";"}); diff != "" {
+			t.Errorf("mismatch (-got +want):\n%s", diff)
+		}
+
+		if opts.XTCProbability != 0.5 || opts.XTCThreshold != 0.1 {
+			t.Errorf("unexpected xtc options %v %v", opts.XTCProbability, opts.XTCThreshold)
+		}
+	})
+
+	t.Run("position offset", func(t *testing.T) {
+		w := createRequest(t, s.GenerateHandler, api.GenerateRequest{
+			Model:          "test",
+			Prompt:         "Hello!",
+			PositionOffset: 1024,
+			Stream:         &stream,
+		})
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+
+		if mock.CompletionRequest.PositionOffset != 1024 {
+			t.Errorf("expected position offset 1024, got %d", mock.CompletionRequest.PositionOffset)
+		}
+
+		w = createRequest(t, s.GenerateHandler, api.GenerateRequest{
+			Model:          "test",
+			Prompt:         "Hello!",
+			PositionOffset: -1,
+			Stream:         &stream,
+		})
+
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("expected status 400, got %d: %s", w.Code, w.Body.String())
+		}
+	})
+
+	t.Run("dynatemp", func(t *testing.T) {
+		w := createRequest(t, s.GenerateHandler, api.GenerateRequest{
+			Model:   "test",
+			Prompt:  "Hello!",
+			Options: map[string]any{"dynatemp_range": 0.5},
+			Stream:  &stream,
+		})
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+
+		if opts := mock.CompletionRequest.Options; opts.DynatempRange != 0.5 || opts.DynatempExponent != 1 {
+			t.Errorf("unexpected dynatemp options %v %v", opts.DynatempRange, opts.DynatempExponent)
+		}
+
+		for _, options := range []map[string]any{{"dynatemp_range": -1}, {"dynatemp_range": 0.5, "dynatemp_exponent": 0}} {
+			w := createRequest(t, s.GenerateHandler, api.GenerateRequest{
+				Model:   "test",
+				Prompt:  "Hello!",
+				Options: options,
+				Stream:  &stream,
+			})
+
+			if w.Code != http.StatusBadRequest {
+				t.Errorf("%v: expected status 400, got %d: %s", options, w.Code, w.Body.String())
+			}
+		}
+	})
+
+	t.Run("sampler order", func(t *testing.T) {
+		w := createRequest(t, s.GenerateHandler, api.GenerateRequest{
+			Model:   "test",
+			Prompt:  "Hello!",
+			Options: map[string]any{"sampler_order": []string{"top_k", "min_p", "temperature"}},
+			Stream:  &stream,
+		})
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+
+		if diff := cmp.Diff(mock.CompletionRequest.Options.SamplerOrder, []string{"top_k", "min_p", "temperature"}); diff != "" {
+			t.Errorf("mismatch (-got +want):\n%s", diff)
+		}
+
+		for _, order := range [][]string{{"top_k", "bogus"}, {"temperature", "top_k", "temperature"}} {
+			w := createRequest(t, s.GenerateHandler, api.GenerateRequest{
+				Model:   "test",
+				Prompt:  "Hello!",
+				Options: map[string]any{"sampler_order": order},
+				Stream:  &stream,
+			})
+
+			if w.Code != http.StatusBadRequest {
+				t.Errorf("%v: expected status 400, got %d: %s", order, w.Code, w.Body.String())
+			}
+		}
+	})
+
+	t.Run("affinity", func(t *testing.T) {
+		w := createRequest(t, s.GenerateHandler, api.GenerateRequest{
+			Model:  "test",
+			System: "Be brief.",
+			Prompt: "Hello!",
+			Stream: &stream,
+		})
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+
+		a := createRequest(t, s.AffinityHandler, api.AffinityRequest{Model: "test", System: "Be brief.", Prompt: "Hello!"})
+
+		var resp api.AffinityResponse
+		if err := json.Unmarshal(a.Body.Bytes(), &resp); err != nil {
+			t.Fatal(err)
+		}
+
+		if token := w.Header().Get(affinityHeader); token == "" || token != resp.Token {
+			t.Errorf("expected the token %q, got %q", token, resp.Token)
+		}
+	})
+
+	t.Run("max time", func(t *testing.T) {
+		// generates a token every 10ms until the time budget is spent, as the
+		// runner does
+		mock.CompletionFn = func(ctx context.Context, r llm.CompletionRequest, fn func(llm.CompletionResponse)) error {
+			deadline := time.Now().Add(time.Duration(r.Options.MaxTimeMS) * time.Millisecond)
+			for range 100 {
+				if time.Now().After(deadline) {
+					fn(llm.CompletionResponse{Done: true, DoneReason: "timeout"})
+					return nil
+				}
+
+				fn(llm.CompletionResponse{Content: "a "})
+				time.Sleep(10 * time.Millisecond)
+			}
+
+			fn(llm.CompletionResponse{Done: true, DoneReason: "length"})
+			return nil
+		}
+		t.Cleanup(func() { mock.CompletionFn = nil })
+
+		w := createRequest(t, s.GenerateHandler, api.GenerateRequest{
+			Model:   "test",
+			Prompt:  "Hello!",
+			Options: map[string]any{"max_time_ms": 50},
+			Stream:  &stream,
+		})
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+
+		if mock.CompletionRequest.Options.MaxTimeMS != 50 {
+			t.Errorf("expected max_time_ms 50, got %d", mock.CompletionRequest.Options.MaxTimeMS)
+		}
+
+		var resp api.GenerateResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+
+		if resp.DoneReason != "timeout" {
+			t.Errorf("expected done reason timeout, got %q", resp.DoneReason)
+		}
+
+		if n := strings.Count(resp.Response, "a "); n == 0 || n >= 100 {
+			t.Errorf("expected a truncated response, got %d tokens", n)
+		}
+	})
+
+	t.Run("logprobs", func(t *testing.T) {
+		logprobs := []api.Logprob{
+			{TokenLogprob: api.TokenLogprob{Token: "Hi", Logprob: -0.1}, TopLogprobs: []api.TokenLogprob{{Token: "Hi", Logprob: -0.1}}},
+			{TokenLogprob: api.TokenLogprob{Token: "!", Logprob: -0.5}, TopLogprobs: []api.TokenLogprob{{Token: "!", Logprob: -0.5}}},
+		}
+
+		mock.CompletionFn = func(ctx context.Context, r llm.CompletionRequest, fn func(llm.CompletionResponse)) error {
+			fn(llm.CompletionResponse{Content: "Hi", Logprobs: logprobs[:1]})
+			fn(llm.CompletionResponse{Content: "!", Logprobs: logprobs[1:]})
+			fn(llm.CompletionResponse{Done: true, DoneReason: "stop"})
+			return nil
+		}
+		t.Cleanup(func() { mock.CompletionFn = nil })
+
+		w := createRequest(t, s.GenerateHandler, api.GenerateRequest{
+			Model:       "test",
+			Prompt:      "Hello!",
+			Logprobs:    true,
+			TopLogprobs: 1,
+			Stream:      &stream,
+		})
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+
+		if !mock.CompletionRequest.TokenLogprobs || mock.CompletionRequest.TopLogprobs != 1 {
+			t.Errorf("expected token logprobs with 1 alternative, got %v %d", mock.CompletionRequest.TokenLogprobs, mock.CompletionRequest.TopLogprobs)
+		}
+
+		var resp api.GenerateResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+
+		if diff := cmp.Diff(resp.Logprobs, logprobs); diff != "" {
+			t.Errorf("mismatch (-got +want):\n%s", diff)
+		}
+
+		for _, req := range []api.GenerateRequest{
+			{Model: "test", Prompt: "Hello!", Logprobs: true, TopLogprobs: 21},
+			{Model: "test", Prompt: "Hello!", TopLogprobs: 1},
+		} {
+			req.Stream = &stream
+			if w := createRequest(t, s.GenerateHandler, req); w.Code != http.StatusBadRequest {
+				t.Errorf("%+v: expected status 400, got %d", req, w.Code)
+			}
+		}
+	})
+
+	t.Run("return tokens", func(t *testing.T) {
+		mock.CompletionFn = func(ctx context.Context, r llm.CompletionRequest, fn func(llm.CompletionResponse)) error {
+			fn(llm.CompletionResponse{Content: "Hello", Tokens: []int{1, 2}, Offsets: []int{0, 3}})
+			fn(llm.CompletionResponse{Content: " world", Tokens: []int{3}, Offsets: []int{5}})
+			fn(llm.CompletionResponse{Done: true, DoneReason: "stop"})
+			return nil
+		}
+		t.Cleanup(func() { mock.CompletionFn = nil })
+
+		w := createRequest(t, s.GenerateHandler, api.GenerateRequest{
+			Model:        "test",
+			Prompt:       "Hello!",
+			ReturnTokens: true,
+			Stream:       &stream,
+		})
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+
+		if !mock.CompletionRequest.ReturnTokens {
+			t.Error("expected tokens to be requested from the runner")
+		}
+
+		var resp api.GenerateResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+
+		if diff := cmp.Diff(resp.Tokens, []int{1, 2, 3}); diff != "" {
+			t.Errorf("mismatch (-got +want):\n%s", diff)
+		}
+
+		if diff := cmp.Diff(resp.Offsets, []int{0, 3, 5}); diff != "" {
+			t.Errorf("mismatch (-got +want):\n%s", diff)
+		}
+	})
+
+	t.Run("compressor", func(t *testing.T) {
+		mock.CompletionFn = func(ctx context.Context, r llm.CompletionRequest, fn func(llm.CompletionResponse)) error {
+			if r.Return == "perplexity" {
+				fn(llm.CompletionResponse{Done: true, PromptLogprobs: []float32{-0.1, -3, -0.2}})
+			} else {
+				fn(llm.CompletionResponse{Done: true, DoneReason: "stop"})
+			}
+			return nil
+		}
+		t.Cleanup(func() { mock.CompletionFn = nil })
+
+		w := createRequest(t, s.GenerateHandler, api.GenerateRequest{
+			Model:      "test",
+			Prompt:     "the quick brown fox",
+			Raw:        true,
+			Compressor: "test",
+			Stream:     &stream,
+		})
+
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("expected status 400 with raw, got %d", w.Code)
+		}
+
+		w = createRequest(t, s.GenerateHandler, api.GenerateRequest{
+			Model:      "test",
+			Prompt:     "the quick brown fox",
+			Compressor: "test",
+			Stream:     &stream,
+		})
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+
+		// the first token and the least predictable are kept
+		if diff := cmp.Diff(mock.CompletionRequest.Prompt, "User: 0 2 "); diff != "" {
+			t.Errorf("mismatch (-got +want):\n%s", diff)
+		}
+
+		var resp api.GenerateResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+
+		if resp.Compression == nil || resp.Compression.Segments != 1 || resp.Compression.Tokens != 4 || resp.Compression.CompressedTokens != 2 {
+			t.Errorf("unexpected compression stats %+v", resp.Compression)
+		}
+
+		for _, req := range []api.GenerateRequest{
+			{Model: "test", Prompt: "Hello!", Compressor: "missing"},
+			{Model: "test", Prompt: "Hello!", Compressor: "test", CompressionRate: 2},
+		} {
+			req.Stream = &stream
+			if w := createRequest(t, s.GenerateHandler, req); w.Code == http.StatusOK {
+				t.Errorf("%+v: expected an error", req)
+			}
+		}
+	})
+
+	t.Run("return invalid", func(t *testing.T) {
+		w := createRequest(t, s.GenerateHandler, api.GenerateRequest{
+			Model:  "test",
+			Prompt: "Hello!",
+			Return: "attention",
+			Stream: &stream,
+		})
+
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("expected status 400, got %d", w.Code)
+		}
+
+		if diff := cmp.Diff(w.Body.String(), `{"error":"invalid return \"attention\"; expected \"logits\" or \"hidden_states\""}`); diff != "" {
+			t.Errorf("mismatch (-got +want):\n%s", diff)
+		}
+	})
+
+	t.Run("return logits remote", func(t *testing.T) {
+		w := createRequest(t, s.GenerateHandler, api.GenerateRequest{
+			Model:  "test",
+			Prompt: "Hello!",
+			Return: "logits",
+			Stream: &stream,
+		})
+
+		if w.Code != http.StatusForbidden {
+			t.Errorf("expected status 403, got %d", w.Code)
+		}
+	})
+
+	t.Run("return logits", func(t *testing.T) {
+		mock.CompletionFn = func(ctx context.Context, r llm.CompletionRequest, fn func(llm.CompletionResponse)) error {
+			fn(llm.CompletionResponse{Done: true, DoneReason: "stop", Logits: []float32{0.5, -1, 2}})
+			return nil
+		}
+		t.Cleanup(func() { mock.CompletionFn = nil })
+
+		generate := func(t *testing.T) *httptest.ResponseRecorder {
+			t.Helper()
+
+			var b bytes.Buffer
+			if err := json.NewEncoder(&b).Encode(api.GenerateRequest{
+				Model:  "test",
+				Prompt: "Hello!",
+				Return: "logits",
+				Stream: &stream,
+			}); err != nil {
+				t.Fatal(err)
+			}
+
+			w := NewRecorder()
+			c, _ := gin.CreateTestContext(w)
+			c.Request = &http.Request{
+				Body:       io.NopCloser(&b),
+				RemoteAddr: "127.0.0.1:54321",
+			}
+
+			s.GenerateHandler(c)
+			return w.ResponseRecorder
+		}
+
+		w := generate(t)
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d", w.Code)
+		}
+
+		if mock.CompletionRequest.Return != "logits" {
+			t.Errorf("expected return logits, got %q", mock.CompletionRequest.Return)
+		}
+
+		var resp api.GenerateResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+
+		if diff := cmp.Diff(resp.Logits, []float32{0.5, -1, 2}); diff != "" {
+			t.Errorf("mismatch (-got +want):\n%s", diff)
+		}
+
+		t.Setenv("OLLAMA_MAX_RAW_OUTPUT", "2")
+		w = generate(t)
+		if w.Code != http.StatusRequestEntityTooLarge {
+			t.Errorf("expected status 413, got %d", w.Code)
+		}
+
+		// the runner's response was too large to read
+		mock.CompletionFn = func(ctx context.Context, r llm.CompletionRequest, fn func(llm.CompletionResponse)) error {
+			return llm.ErrRawOutputTooLarge
+		}
+
+		w = generate(t)
+		if w.Code != http.StatusRequestEntityTooLarge {
+			t.Errorf("expected status 413, got %d", w.Code)
+		}
+	})
+
+	t.Run("trace sampling", func(t *testing.T) {
+		trace := []api.SampledToken{{
+			Token: 1,
+			Piece: "Hi",
+			Candidates: []api.SamplingCandidate{
+				{Token: 1, Piece: "Hi", Logit: 3, Penalized: 3, Probability: 1},
+				{Token: 2, Piece: "Hello", Logit: 2, Penalized: 1.5, EliminatedBy: "top-k"},
+			},
+		}}
+
+		mock.CompletionFn = func(ctx context.Context, r llm.CompletionRequest, fn func(llm.CompletionResponse)) error {
+			fn(llm.CompletionResponse{Content: "Hi", Done: true, DoneReason: "stop", SamplingTrace: trace})
+			return nil
+		}
+		t.Cleanup(func() { mock.CompletionFn = nil })
+
+		w := createRequest(t, s.GenerateHandler, api.GenerateRequest{
+			Model:         "test",
+			Prompt:        "Hello!",
+			TraceSampling: 2,
+			Stream:        &stream,
+		})
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d", w.Code)
+		}
+
+		if n := mock.CompletionRequest.TraceSampling; n != 2 {
+			t.Errorf("expected 2 candidates to be traced, got %d", n)
+		}
+
+		var resp api.GenerateResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+
+		if diff := cmp.Diff(resp.SamplingTrace, trace); diff != "" {
+			t.Errorf("mismatch (-got +want):\n%s", diff)
+		}
+
+		w = createRequest(t, s.GenerateHandler, api.GenerateRequest{
+			Model:         "test",
+			Prompt:        "Hello!",
+			TraceSampling: maxTraceSampling + 1,
+			Stream:        &stream,
+		})
+
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("expected status 400, got %d", w.Code)
+		}
+	})
+
+	t.Run("adapter", func(t *testing.T) {
+		w := createRequest(t, s.CreateHandler, api.CreateRequest{
+			Model: "test-lora",
+			Modelfile: fmt.Sprintf("FROM test\nADAPTER %s", createBinFile(t, llm.KV{
+				"general.architecture": "llama",
+				"general.type":         "adapter",
+			}, []llm.Tensor{})),
+			Stream: &stream,
+		})
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+
+		w = createRequest(t, s.GenerateHandler, api.GenerateRequest{
+			Model:   "test",
+			Prompt:  "Hello!",
+			Options: map[string]any{"adapter": "test-lora"},
+			Stream:  &stream,
+		})
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+
+		if len(mock.CompletionRequest.Adapters) != 1 {
+			t.Errorf("expected the adapter of test-lora, got %v", mock.CompletionRequest.Adapters)
+		}
+
+		w = createRequest(t, s.GenerateHandler, api.GenerateRequest{
+			Model:  "test",
+			Prompt: "Hello!",
+			Stream: &stream,
+		})
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+
+		if len(mock.CompletionRequest.Adapters) != 0 {
+			t.Errorf("expected no adapters, got %v", mock.CompletionRequest.Adapters)
+		}
+
+		for _, adapter := range []string{"test-ban", "missing", "bert"} {
+			w = createRequest(t, s.GenerateHandler, api.GenerateRequest{
+				Model:   "test",
+				Prompt:  "Hello!",
+				Options: map[string]any{"adapter": adapter},
+				Stream:  &stream,
+			})
+
+			if w.Code != http.StatusBadRequest {
+				t.Errorf("%s: expected status 400, got %d: %s", adapter, w.Code, w.Body.String())
+			}
+		}
+	})
+
+	t.Run("resident adapters", func(t *testing.T) {
+		adapters := &mockLlm{}
+		mock.LlamaServer = adapters
+		t.Cleanup(func() { mock.LlamaServer = nil })
+
+		w := createRequest(t, s.LoadAdapterHandler, api.AdapterRequest{Model: "test", Adapter: "test-lora"})
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+
+		if len(adapters.adapters) != 1 {
+			t.Fatalf("expected the adapter to be loaded, got %v", adapters.adapters)
+		}
+
+		// loadFn doesn't track the runners it loads
+		m, err := GetModel("test")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		s.sched.loadedMu.Lock()
+		s.sched.loaded[m.ModelPath] = &runnerRef{llama: &mock, model: m}
+		s.sched.loadedMu.Unlock()
+		t.Cleanup(func() {
+			s.sched.loadedMu.Lock()
+			delete(s.sched.loaded, m.ModelPath)
+			s.sched.loadedMu.Unlock()
+		})
+
+		w = createRequest(t, s.ListAdaptersHandler, nil)
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+
+		var list api.ListAdaptersResponse
+		if err := json.NewDecoder(w.Body).Decode(&list); err != nil {
+			t.Fatal(err)
+		}
+
+		if len(list.Adapters) != 1 || list.Adapters[0].Model != "test:latest" || !slices.Equal(list.Adapters[0].Adapters, []string{"test-lora:latest"}) {
+			t.Errorf("unexpected adapters %+v", list.Adapters)
+		}
+
+		adapters.adapters[0].Sequences = 1
+		w = createRequest(t, s.UnloadAdapterHandler, api.AdapterRequest{Model: "test", Adapter: "test-lora"})
+		if w.Code != http.StatusConflict {
+			t.Errorf("expected status 409, got %d: %s", w.Code, w.Body.String())
+		}
+
+		adapters.adapters[0].Sequences = 0
+		for _, expect := range []int{http.StatusOK, http.StatusNotFound} {
+			w = createRequest(t, s.UnloadAdapterHandler, api.AdapterRequest{Model: "test", Adapter: "test-lora"})
+			if w.Code != expect {
+				t.Errorf("expected status %d, got %d: %s", expect, w.Code, w.Body.String())
+			}
+		}
+
+		w = createRequest(t, s.LoadAdapterHandler, api.AdapterRequest{Model: "test"})
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("expected status 400, got %d: %s", w.Code, w.Body.String())
+		}
+	})
+
+	t.Run("grammar", func(t *testing.T) {
+		grammar := `root ::= "SELECT " [a-z]+ ";"`
+		w := createRequest(t, s.GenerateHandler, api.GenerateRequest{
+			Model:   "test",
+			Prompt:  "Hello!",
+			Options: map[string]any{"grammar": grammar},
+			Stream:  &stream,
+		})
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+
+		if mock.CompletionRequest.Options.Grammar != grammar {
+			t.Errorf("expected the grammar to be passed to the runner, got %q", mock.CompletionRequest.Options.Grammar)
+		}
+
+		w = createRequest(t, s.GenerateHandler, api.GenerateRequest{
+			Model:  "test",
+			Prompt: "Hello!",
+			Format: json.RawMessage(`{"type": "object", "properties": 1}`),
+			Stream: &stream,
+		})
+
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("expected status 400 for an invalid schema, got %d", w.Code)
+		}
+
+		for _, grammar := range []string{`root ::= "a`, `answer ::= "yes"`, `root ::= root "a"`} {
+			w := createRequest(t, s.GenerateHandler, api.GenerateRequest{
+				Model:   "test",
+				Prompt:  "Hello!",
+				Options: map[string]any{"grammar": grammar},
+				Stream:  &stream,
+			})
+
+			if w.Code != http.StatusBadRequest {
+				t.Errorf("%s: expected status 400, got %d", grammar, w.Code)
+			}
+		}
+	})
+
+	t.Run("batch of prompts", func(t *testing.T) {
+		mock.CompletionFn = func(ctx context.Context, r llm.CompletionRequest, fn func(llm.CompletionResponse)) error {
+			fn(llm.CompletionResponse{Content: strings.ToUpper(r.Prompt)})
+			fn(llm.CompletionResponse{Done: true, DoneReason: "stop"})
+			return nil
+		}
+		t.Cleanup(func() { mock.CompletionFn = nil })
+
+		w := createRequest(t, s.GenerateHandler, api.GenerateRequest{
+			Model:   "test",
+			Prompts: []string{"one", "two", "three"},
+			Raw:     true,
+			Stream:  &stream,
+		})
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+
+		var responses []api.GenerateResponse
+		if err := json.NewDecoder(w.Body).Decode(&responses); err != nil {
+			t.Fatal(err)
+		}
+
+		var got []string
+		for i, r := range responses {
+			if r.Index == nil || *r.Index != i || !r.Done {
+				t.Errorf("response %d: unexpected index or done: %+v", i, r)
+			}
+
+			got = append(got, r.Response)
+		}
+
+		if diff := cmp.Diff(got, []string{"ONE", "TWO", "THREE"}); diff != "" {
+			t.Errorf("mismatch (-got +want):\n%s", diff)
+		}
+
+		streaming := true
+		w = createRequest(t, s.GenerateHandler, api.GenerateRequest{
+			Model:   "test",
+			Prompts: []string{"one", "two"},
+			Raw:     true,
+			Stream:  &streaming,
+		})
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+
+		streamed := make(map[int]string)
+		dec := json.NewDecoder(w.Body)
+		for dec.More() {
+			var r api.GenerateResponse
+			if err := dec.Decode(&r); err != nil {
+				t.Fatal(err)
+			}
+
+			if r.Index == nil {
+				t.Fatalf("expected an index, got %+v", r)
+			}
+
+			streamed[*r.Index] += r.Response
+		}
+
+		if diff := cmp.Diff(streamed, map[int]string{0: "ONE", 1: "TWO"}); diff != "" {
+			t.Errorf("mismatch (-got +want):\n%s", diff)
+		}
+
+		for _, req := range []api.GenerateRequest{
+			{Model: "test", Prompts: []string{}, Stream: &stream},
+			{Model: "test", Prompts: []string{"one"}, Suffix: "two", Stream: &stream},
+			{Model: "test", Prompts: []string{"one"}, Options: map[string]any{"best_of": 2}, Stream: &stream},
+		} {
+			w := createRequest(t, s.GenerateHandler, req)
+			if w.Code != http.StatusBadRequest {
+				t.Errorf("%+v: expected status 400, got %d", req, w.Code)
+			}
+		}
+	})
+
+	t.Run("invalid cache type", func(t *testing.T) {
+		w := createRequest(t, s.GenerateHandler, api.GenerateRequest{
+			Model:   "test",
+			Prompt:  "Hello!",
+			Options: map[string]any{"cache_type_k": "q2_k"},
+			Stream:  &stream,
+		})
+
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("expected status 400, got %d", w.Code)
+		}
+	})
+
+	t.Run("processors", func(t *testing.T) {
+		w := createRequest(t, s.CreateHandler, api.CreateRequest{
+			Model:     "test-think",
+			Modelfile: "FROM test\nPARAMETER processor think",
+			Stream:    &stream,
+		})
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+
+		mock.CompletionFn = func(ctx context.Context, r llm.CompletionRequest, fn func(llm.CompletionResponse)) error {
+			for _, content := range []string{"<think>", "Hmm", "</think>", "\n", "Hi\n```sh\nls\n```"} {
+				fn(llm.CompletionResponse{Content: content})
+			}
+			fn(llm.CompletionResponse{Done: true, DoneReason: "stop"})
+			return nil
+		}
+		t.Cleanup(func() { mock.CompletionFn = nil })
+
+		w = createRequest(t, s.GenerateHandler, api.GenerateRequest{
+			Model:   "test-think",
+			Prompt:  "Hello!",
+			Options: map[string]any{"processor": []string{"think", "code"}},
+			Stream:  &stream,
+		})
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+
+		var resp api.GenerateResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+
+		if resp.Response != "Hi\n```sh\nls\n```" {
+			t.Errorf("expected response %q, got %q", "Hi\n```sh\nls\n```", resp.Response)
+		}
+
+		if resp.Thinking != "Hmm" {
+			t.Errorf("expected thinking %q, got %q", "Hmm", resp.Thinking)
+		}
+
+		if diff := cmp.Diff(resp.Code, []api.CodeBlock{{Language: "sh", Code: "ls"}}); diff != "" {
+			t.Errorf("mismatch (-got +want):\n%s", diff)
+		}
+
+		w = createRequest(t, s.GenerateHandler, api.GenerateRequest{
+			Model:   "test-think",
+			Prompt:  "Hello!",
+			Options: map[string]any{"processor": []string{"unknown"}},
+			Stream:  &stream,
+		})
+
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("expected status 400, got %d", w.Code)
+		}
+
+		w = createRequest(t, s.CreateHandler, api.CreateRequest{
+			Model:     "test-bad-processor",
+			Modelfile: "FROM test\nPARAMETER processor regex /(/x/",
+			Stream:    &stream,
+		})
+
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("expected status 400, got %d", w.Code)
+		}
+	})
+
+	t.Run("head", func(t *testing.T) {
+		weight := make([]float32, 4096)
+		for i := range weight {
+			weight[i] = 1
+		}
+
+		w := createRequest(t, s.CreateHandler, api.CreateRequest{
+			Model:     "test-head",
+			Modelfile: fmt.Sprintf("FROM test\nHEAD %s", createHeadFile(t, llm.KV{"general.architecture": "llama", "head.name": "reward"}, [][]float32{weight})),
+			Stream:    &stream,
+		})
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d", w.Code)
+		}
+
+		hidden := make([]float32, 4096)
+		for i := range hidden {
+			hidden[i] = 0.5
+		}
+
+		mock.CompletionFn = func(ctx context.Context, r llm.CompletionRequest, fn func(llm.CompletionResponse)) error {
+			fn(llm.CompletionResponse{Done: true, DoneReason: "stop", HiddenStates: hidden})
+			return nil
+		}
+		t.Cleanup(func() { mock.CompletionFn = nil })
+
+		w = createRequest(t, s.GenerateHandler, api.GenerateRequest{
+			Model:  "test-head",
+			Prompt: "Hello!",
+			Head:   "reward",
+			Stream: &stream,
+		})
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d", w.Code)
+		}
+
+		if mock.CompletionRequest.Return != "hidden_states" {
+			t.Errorf("expected return hidden_states, got %q", mock.CompletionRequest.Return)
+		}
+
+		var resp api.GenerateResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+
+		if diff := cmp.Diff(resp.Scores, []float32{2049}); diff != "" {
+			t.Errorf("mismatch (-got +want):\n%s", diff)
+		}
+
+		if resp.HiddenStates != nil {
+			t.Errorf("expected no hidden states, got %d", len(resp.HiddenStates))
+		}
+
+		w = createRequest(t, s.GenerateHandler, api.GenerateRequest{
+			Model:  "test-head",
+			Prompt: "Hello!",
+			Head:   "sentiment",
+			Stream: &stream,
+		})
+
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("expected status 400, got %d", w.Code)
+		}
+
+		if diff := cmp.Diff(w.Body.String(), `{"error":"\"test-head\" does not have a head \"sentiment\""}`); diff != "" {
+			t.Errorf("mismatch (-got +want):\n%s", diff)
+		}
+	})
 }
@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"net/http/httptest"
 	"slices"
 	"testing"
 
@@ -63,3 +64,117 @@ func TestList(t *testing.T) {
 		t.Fatalf("expected slices to be equal %v", actualNames)
 	}
 }
+
+func TestListLabels(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+
+	var s Server
+	for n, labels := range map[string]map[string]string{
+		"search":  {"team": "search", "tier": "prod"},
+		"ranking": {"team": "search"},
+		"chat":    {"team": "assistant"},
+		"scratch": nil,
+	} {
+		w := createRequest(t, s.CreateHandler, api.CreateRequest{
+			Name:      n,
+			Modelfile: fmt.Sprintf("FROM %s", createBinFile(t, nil, nil)),
+			Labels:    labels,
+			Stream:    &stream,
+		})
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status code 200, actual %d", w.Code)
+		}
+	}
+
+	list := func(t *testing.T, query string) []string {
+		t.Helper()
+
+		w := NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		c.Request = httptest.NewRequest(http.MethodGet, "/api/tags?"+query, nil)
+		s.ListHandler(c)
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status code 200, actual %d", w.Code)
+		}
+
+		var resp api.ListResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+
+		var names []string
+		for _, m := range resp.Models {
+			names = append(names, m.Name)
+		}
+
+		slices.Sort(names)
+		return names
+	}
+
+	cases := map[string][]string{
+		"":                                  {"chat:latest", "ranking:latest", "scratch:latest", "search:latest"},
+		"label=team=search":                 {"ranking:latest", "search:latest"},
+		"label=team=search&label=tier=prod": {"search:latest"},
+		"label=tier":                        {"search:latest"},
+		"label=team=nobody":                 nil,
+	}
+
+	for query, expect := range cases {
+		t.Run(query, func(t *testing.T) {
+			if names := list(t, query); !slices.Equal(names, expect) {
+				t.Errorf("expected %v, actual %v", expect, names)
+			}
+		})
+	}
+
+	t.Run("set labels", func(t *testing.T) {
+		w := createRequest(t, s.LabelHandler, api.LabelRequest{
+			Model:  "scratch",
+			Labels: map[string]string{"team": "search"},
+		})
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status code 200, actual %d", w.Code)
+		}
+
+		if names := list(t, "label=team=search"); !slices.Equal(names, []string{"ranking:latest", "scratch:latest", "search:latest"}) {
+			t.Errorf("unexpected models %v", names)
+		}
+
+		w = createRequest(t, s.LabelHandler, api.LabelRequest{
+			Model:  "search",
+			Labels: map[string]string{"tier": ""},
+		})
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status code 200, actual %d", w.Code)
+		}
+
+		var resp api.LabelResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+
+		if len(resp.Labels) != 1 || resp.Labels["team"] != "search" {
+			t.Errorf("unexpected labels %v", resp.Labels)
+		}
+
+		if names := list(t, "label=tier"); names != nil {
+			t.Errorf("unexpected models %v", names)
+		}
+	})
+
+	t.Run("set labels missing model", func(t *testing.T) {
+		w := createRequest(t, s.LabelHandler, api.LabelRequest{
+			Model:  "missing",
+			Labels: map[string]string{"team": "search"},
+		})
+
+		if w.Code != http.StatusNotFound {
+			t.Fatalf("expected status code 404, actual %d", w.Code)
+		}
+	})
+}
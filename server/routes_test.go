@@ -95,7 +95,7 @@ func Test_Routes(t *testing.T) {
 		fn := func(resp api.ProgressResponse) {
 			t.Logf("Status: %s", resp.Status)
 		}
-		err = CreateModel(context.TODO(), model.ParseName(name), "", "", modelfile, fn)
+		err = CreateModel(context.TODO(), model.ParseName(name), "", "", nil, modelfile, &registryOptions{}, fn)
 		if err != nil {
 			t.Fatalf("failed to create model: %v", err)
 		}
@@ -687,3 +687,19 @@ func TestNormalize(t *testing.T) {
 		})
 	}
 }
+
+func TestEmbedEmptyInputTokens(t *testing.T) {
+	var s Server
+	for _, body := range []string{`[]`, `[[1, 2], []]`} {
+		t.Run(body, func(t *testing.T) {
+			w := createRequest(t, s.EmbedHandler, map[string]any{"model": "test", "input_tokens": json.RawMessage(body)})
+			if w.Code != http.StatusBadRequest {
+				t.Fatalf("expected status 400, got %d", w.Code)
+			}
+
+			if got := w.Body.String(); got != `{"error":"input_tokens can't be empty"}` {
+				t.Errorf("unexpected body %s", got)
+			}
+		})
+	}
+}
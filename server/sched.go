@@ -26,7 +26,9 @@ type LlmRequest struct {
 	model           *Model
 	opts            api.Options
 	origNumCtx      int // Track the initial ctx request
+	requestedNumCtx int // The ctx requested, if origNumCtx was reduced to fit
 	sessionDuration *api.Duration
+	sessions        bool // The request continues a session
 	successCh       chan *runnerRef
 	errCh           chan error
 	schedAttempts   uint
@@ -42,10 +44,12 @@ type Scheduler struct {
 	loadedMu sync.Mutex
 
 	loadFn       func(req *LlmRequest, ggml *llm.GGML, gpus discover.GpuInfoList, numParallel int)
-	newServerFn  func(gpus discover.GpuInfoList, model string, ggml *llm.GGML, adapters []string, projectors []string, opts api.Options, numParallel int) (llm.LlamaServer, error)
+	newServerFn  func(gpus discover.GpuInfoList, model string, ggml *llm.GGML, adapters []string, projectors []string, softPrompt, sessionDir string, opts api.Options, numParallel int) (llm.LlamaServer, error)
 	getGpuFn     func() discover.GpuInfoList
 	getCpuFn     func() discover.GpuInfoList
 	reschedDelay time.Duration
+
+	overshoot vramOvershoot
 }
 
 // Default automatic value for number of models we allow per GPU
@@ -60,6 +64,13 @@ var defaultParallel = 4
 
 var ErrMaxQueue = errors.New("server busy, please try again.  maximum pending requests exceeded")
 
+// errEmbeddingPoolFull is returned for embedding models which don't fit
+// without unloading a completion model
+var errEmbeddingPoolFull = errors.New("not enough memory to load embedding model without unloading a completion model")
+
+// errModelInUse is returned when unloading a model that's processing requests
+var errModelInUse = errors.New("is in use")
+
 func InitScheduler(ctx context.Context) *Scheduler {
 	maxQueue := envconfig.MaxQueue()
 	sched := &Scheduler{
@@ -88,6 +99,7 @@ func (s *Scheduler) GetRunner(c context.Context, model *Model, opts api.Options,
 		model:           model,
 		opts:            opts,
 		sessionDuration: sessionDuration,
+		sessions:        usesSessions(c),
 		successCh:       make(chan *runnerRef),
 		errCh:           make(chan error, 1),
 	}
@@ -126,7 +138,7 @@ func (s *Scheduler) processPending(ctx context.Context) {
 			}
 
 			if pending.ctx.Err() != nil {
-				slog.Debug("pending request cancelled or timed out, skipping scheduling")
+				slog.DebugContext(pending.ctx, "pending request cancelled or timed out, skipping scheduling")
 				continue
 			}
 			numParallel := int(envconfig.NumParallel())
@@ -134,7 +146,7 @@ func (s *Scheduler) processPending(ctx context.Context) {
 			// see https://github.com/ollama/ollama/issues/4165
 			if checkMllamaModelFamily(pending.model) && numParallel != 1 {
 				numParallel = 1
-				slog.Warn("mllama doesn't support parallel requests yet")
+				slog.WarnContext(pending.ctx, "mllama doesn't support parallel requests yet")
 			}
 
 			for {
@@ -152,8 +164,8 @@ func (s *Scheduler) processPending(ctx context.Context) {
 						break
 					}
 				} else if envconfig.MaxRunners() > 0 && loadedCount >= int(envconfig.MaxRunners()) {
-					slog.Debug("max runners achieved, unloading one to make room", "runner_count", loadedCount)
-					runnerToExpire = s.findRunnerToUnload()
+					slog.DebugContext(pending.ctx, "max runners achieved, unloading one to make room", "runner_count", loadedCount)
+					runnerToExpire = s.runnerToUnload(pending)
 				} else {
 					// Either no models are loaded or below envconfig.MaxRunners
 					// Get a refreshed GPU list
@@ -178,11 +190,11 @@ func (s *Scheduler) processPending(ctx context.Context) {
 						if allReliable {
 							// HACK
 							os.Setenv("OLLAMA_MAX_LOADED_MODELS", strconv.Itoa(defaultModelsPerGPU*len(gpus)))
-							slog.Debug("updating default concurrency", "OLLAMA_MAX_LOADED_MODELS", envconfig.MaxRunners, "gpu_count", len(gpus))
+							slog.DebugContext(pending.ctx, "updating default concurrency", "OLLAMA_MAX_LOADED_MODELS", envconfig.MaxRunners, "gpu_count", len(gpus))
 						} else {
 							// HACK
 							os.Setenv("OLLAMA_MAX_LOADED_MODELS", strconv.Itoa(len(gpus)))
-							slog.Info("one or more GPUs detected that are unable to accurately report free memory - disabling default concurrency")
+							slog.InfoContext(pending.ctx, "one or more GPUs detected that are unable to accurately report free memory - disabling default concurrency")
 						}
 					}
 
@@ -198,6 +210,14 @@ func (s *Scheduler) processPending(ctx context.Context) {
 						numParallel = 1
 					}
 
+					if pending.inEmbeddingPool() {
+						if g := s.pickEmbeddingPool(pending, ggml); g != nil {
+							slog.DebugContext(pending.ctx, "loading embedding model in pool", "model", pending.model.ModelPath, "device", envconfig.EmbeddingDevice())
+							s.loadFn(pending, ggml, g, numParallel)
+							break
+						}
+					}
+
 					// Evaluate if the model will fit in the available system memory, or if we should unload a model first
 					if len(gpus) == 1 && gpus[0].Library == "cpu" {
 						// simplifying assumption of defaultParallel when in CPU mode
@@ -208,21 +228,25 @@ func (s *Scheduler) processPending(ctx context.Context) {
 						pending.opts.NumCtx = pending.origNumCtx * numParallel
 
 						if loadedCount == 0 {
-							slog.Debug("cpu mode with first model, loading")
+							slog.DebugContext(pending.ctx, "cpu mode with first model, loading")
 							s.loadFn(pending, ggml, gpus, numParallel)
 							break
 						}
 						runnerToExpire = s.maybeFindCPURunnerToUnload(pending, ggml, gpus)
 						if runnerToExpire == nil {
-							slog.Debug("cpu mode with available system memory or first model, loading")
+							slog.DebugContext(pending.ctx, "cpu mode with available system memory or first model, loading")
 							s.loadFn(pending, ggml, gpus, numParallel)
 							break
 						}
 						// else we need to expire a runner
 					} else if loadedCount == 0 {
 						// No models loaded. Load the model but prefer the best fit.
-						slog.Debug("loading first model", "model", pending.model.ModelPath)
+						slog.DebugContext(pending.ctx, "loading first model", "model", pending.model.ModelPath)
+						gpus = s.overshoot.apply(pending.model.ModelPath, gpus)
 						g := pickBestFullFitByLibrary(pending, ggml, gpus, &numParallel)
+						if g == nil && envconfig.FitContext() {
+							g = pickBestContextFit(pending, ggml, gpus, &numParallel)
+						}
 						if g != nil {
 							gpus = g
 						} else {
@@ -244,9 +268,13 @@ func (s *Scheduler) processPending(ctx context.Context) {
 
 						// Update free memory from currently loaded models
 						s.updateFreeSpace(availGpus)
+						availGpus = s.overshoot.apply(pending.model.ModelPath, availGpus)
 						fitGpus := pickBestFullFitByLibrary(pending, ggml, availGpus, &numParallel)
+						if fitGpus == nil && envconfig.FitContext() {
+							fitGpus = pickBestContextFit(pending, ggml, availGpus, &numParallel)
+						}
 						if fitGpus != nil {
-							slog.Debug("new model fits with existing models, loading")
+							slog.DebugContext(pending.ctx, "new model fits with existing models, loading")
 							s.loadFn(pending, ggml, fitGpus, numParallel)
 							break
 						}
@@ -263,24 +291,29 @@ func (s *Scheduler) processPending(ctx context.Context) {
 							go func() {
 								// Process in a go routine to avoid deadlocking
 								// the scheduler if our queue is full
-								slog.Debug("delaying scheduling while other models finish loading", "attempts", pending.schedAttempts, "model", pending.model.ModelPath)
+								slog.DebugContext(pending.ctx, "delaying scheduling while other models finish loading", "attempts", pending.schedAttempts, "model", pending.model.ModelPath)
 								time.Sleep(s.reschedDelay)
 								s.pendingReqCh <- pending
 							}()
 							break
 						}
-						runnerToExpire = s.findRunnerToUnload()
+						runnerToExpire = s.runnerToUnload(pending)
 					}
 				}
 
+				if runnerToExpire == nil && pending.inEmbeddingPool() {
+					pending.errCh <- errEmbeddingPoolFull
+					break
+				}
+
 				if runnerToExpire == nil {
 					// Shouildn't happen
-					slog.Error("runner to expire was nil!")
+					slog.ErrorContext(pending.ctx, "runner to expire was nil!")
 					continue
 				}
 				// Trigger an expiration to unload once it's done
 				runnerToExpire.refMu.Lock()
-				slog.Debug("resetting model to expire immediately to make room", "modelPath", runnerToExpire.modelPath, "refCount", runnerToExpire.refCount)
+				slog.DebugContext(pending.ctx, "resetting model to expire immediately to make room", "modelPath", runnerToExpire.modelPath, "refCount", runnerToExpire.refCount)
 				if runnerToExpire.expireTimer != nil {
 					runnerToExpire.expireTimer.Stop()
 					runnerToExpire.expireTimer = nil
@@ -293,13 +326,13 @@ func (s *Scheduler) processPending(ctx context.Context) {
 				// Wait for the unload to happen
 				// Note: at this point we're queueing up all incoming requests, even if they were for
 				// a different model that's loaded and not scheduled to be removed.
-				slog.Debug("waiting for pending requests to complete and unload to occur", "modelPath", runnerToExpire.modelPath)
+				slog.DebugContext(pending.ctx, "waiting for pending requests to complete and unload to occur", "modelPath", runnerToExpire.modelPath)
 				select {
 				case <-ctx.Done():
 					slog.Debug("shutting down scheduler pending loop")
 					return
 				case <-s.unloadedCh:
-					slog.Debug("unload completed", "modelPath", runnerToExpire.modelPath)
+					slog.DebugContext(pending.ctx, "unload completed", "modelPath", runnerToExpire.modelPath)
 					continue
 				}
 			}
@@ -417,7 +450,21 @@ func (s *Scheduler) load(req *LlmRequest, ggml *llm.GGML, gpus discover.GpuInfoL
 	if req.sessionDuration != nil {
 		sessionDuration = req.sessionDuration.Duration
 	}
-	llama, err := s.newServerFn(gpus, req.model.ModelPath, ggml, req.model.AdapterPaths, req.model.ProjectorPaths, req.opts, numParallel)
+
+	// free memory before loading, to measure how much the runner uses
+	var before discover.GpuInfoList
+	if len(gpus) > 0 && gpus[0].Library != "cpu" {
+		before = s.getGpuFn()
+	}
+
+	// runners only save KV caches for sessions if they were loaded for one,
+	// which keeps other runners out of the sessions directory
+	var sessionDir string
+	if req.sessions {
+		sessionDir = envconfig.Sessions()
+	}
+
+	llama, err := s.newServerFn(gpus, req.model.ModelPath, ggml, req.model.AdapterPaths, req.model.ProjectorPaths, req.model.SoftPromptPath, sessionDir, req.opts, numParallel)
 	if err != nil {
 		// some older models are not compatible with newer versions of llama.cpp
 		// show a generalized compatibility error until there is a better way to
@@ -425,7 +472,7 @@ func (s *Scheduler) load(req *LlmRequest, ggml *llm.GGML, gpus discover.GpuInfoL
 		if errors.Is(err, llm.ErrUnsupportedFormat) || strings.Contains(err.Error(), "failed to load model") {
 			err = fmt.Errorf("%v: this model may be incompatible with your version of Ollama. If you previously pulled this model, try updating it by running `ollama pull %s`", err, req.model.ShortName)
 		}
-		slog.Info("NewLlamaServer failed", "model", req.model.ModelPath, "error", err)
+		slog.InfoContext(req.ctx, "NewLlamaServer failed", "model", req.model.ModelPath, "error", err)
 		req.errCh <- err
 		return
 	}
@@ -440,36 +487,69 @@ func (s *Scheduler) load(req *LlmRequest, ggml *llm.GGML, gpus discover.GpuInfoL
 		estimatedTotal:  llama.EstimatedTotal(),
 		loading:         true,
 		refCount:        1,
+		requestedNumCtx: req.requestedNumCtx,
+		sessions:        req.sessions,
 	}
 	runner.numParallel = numParallel
 	runner.refMu.Lock()
 
 	s.loadedMu.Lock()
 	s.loaded[req.model.ModelPath] = runner
-	slog.Info("loaded runners", "count", len(s.loaded))
+	slog.InfoContext(req.ctx, "loaded runners", "count", len(s.loaded))
 	s.loadedMu.Unlock()
 
 	go func() {
 		defer runner.refMu.Unlock()
 		if err = llama.WaitUntilRunning(req.ctx); err != nil {
-			slog.Error("error loading llama server", "error", err)
+			slog.ErrorContext(req.ctx, "error loading llama server", "error", err)
 			runner.refCount--
 			req.errCh <- err
-			slog.Debug("triggering expiration for failed load", "model", runner.modelPath)
+			slog.DebugContext(req.ctx, "triggering expiration for failed load", "model", runner.modelPath)
 			s.expiredCh <- runner
 			return
 		}
-		slog.Debug("finished setting up runner", "model", req.model.ModelPath)
+		if envconfig.WarmUp() && req.model.CheckCapabilities(CapabilityCompletion) == nil {
+			warmUp(req.ctx, llama, req.opts)
+		}
+
+		if before != nil {
+			s.overshoot.learn(req.ctx, req.model.ModelPath, before, s.getGpuFn(), llama)
+		}
+
+		slog.DebugContext(req.ctx, "finished setting up runner", "model", req.model.ModelPath)
 		runner.loading = false
 		go func() {
 			<-req.ctx.Done()
-			slog.Debug("context for request finished")
+			slog.DebugContext(req.ctx, "context for request finished")
 			s.finishedReqCh <- req
 		}()
 		req.successCh <- runner
 	}()
 }
 
+// warmUpTimeout bounds how long a warm up can delay the request that loaded
+// the model
+const warmUpTimeout = 30 * time.Second
+
+// warmUp generates a single token with a newly loaded runner. The first
+// evaluation compiles kernels and grows the runner's memory pools, which
+// would otherwise add seconds to the time to first token of the request
+// that loaded the model. The runner is usable if it fails, so errors are
+// only logged.
+func warmUp(ctx context.Context, llama llm.LlamaServer, opts api.Options) {
+	ctx, cancel := context.WithTimeout(ctx, warmUpTimeout)
+	defer cancel()
+
+	start := time.Now()
+	opts.NumPredict = 1
+	if err := llama.Completion(ctx, llm.CompletionRequest{Prompt: "Hello", Options: &opts}, func(llm.CompletionResponse) {}); err != nil {
+		slog.WarnContext(ctx, "failed to warm up runner", "error", err)
+		return
+	}
+
+	slog.InfoContext(ctx, "warmed up runner", "duration", time.Since(start))
+}
+
 func (s *Scheduler) updateFreeSpace(allGpus discover.GpuInfoList) {
 	type predKey struct {
 		Library string
@@ -554,6 +634,13 @@ type runnerRef struct {
 	modelPath   string
 	numParallel int
 	*api.Options
+
+	// requestedNumCtx is the ctx requested when the runner was loaded with
+	// a smaller one to fit in memory
+	requestedNumCtx int
+
+	// sessions is set if the runner was loaded with the sessions directory
+	sessions bool
 }
 
 // The refMu must already be held when calling unload
@@ -596,10 +683,18 @@ func (runner *runnerRef) needsReload(ctx context.Context, req *LlmRequest) bool
 	// Normalize the NumCtx for parallelism
 	optsExisting.NumCtx = optsExisting.NumCtx / runner.numParallel
 
+	// A runner with a reduced ctx still serves requests for the ctx that
+	// didn't fit
+	if runner.requestedNumCtx != 0 && optsNew.NumCtx == runner.requestedNumCtx {
+		optsNew.NumCtx = optsExisting.NumCtx
+	}
+
 	ctx, cancel := context.WithTimeout(ctx, timeout)
 	defer cancel()
 	if !reflect.DeepEqual(runner.model.AdapterPaths, req.model.AdapterPaths) || // have the adapters changed?
 		!reflect.DeepEqual(runner.model.ProjectorPaths, req.model.ProjectorPaths) || // have the projectors changed?
+		runner.model.SoftPromptPath != req.model.SoftPromptPath || // has the soft prompt changed?
+		req.sessions && !runner.sessions || // does the request need the sessions directory?
 		!reflect.DeepEqual(optsExisting, optsNew) || // have the runner options changed?
 		runner.llama.Ping(ctx) != nil {
 		return true
@@ -736,6 +831,46 @@ func pickBestFullFitByLibrary(req *LlmRequest, ggml *llm.GGML, gpus discover.Gpu
 	return nil
 }
 
+// minFitContext is the smallest ctx pickBestContextFit will reduce a request
+// to, and fitContextStep the granularity of the ctx it picks
+const (
+	minFitContext  = 2048
+	fitContextStep = 256
+)
+
+// pickBestContextFit finds the largest ctx, down to minFitContext, at which the
+// model fully fits in the available GPUs and reduces the request to it. The
+// requested ctx is kept in requestedNumCtx. If the model doesn't fit with the
+// smallest ctx, the request is left as it is and nil is returned.
+func pickBestContextFit(req *LlmRequest, ggml *llm.GGML, gpus discover.GpuInfoList, numParallel *int) discover.GpuInfoList {
+	requested := req.origNumCtx
+
+	fit := 0
+	lo, hi := minFitContext/fitContextStep, (requested-1)/fitContextStep
+	for lo <= hi {
+		mid := (lo + hi) / 2
+		p := *numParallel
+		req.origNumCtx = mid * fitContextStep
+		if pickBestFullFitByLibrary(req, ggml, gpus, &p) != nil {
+			fit = req.origNumCtx
+			lo = mid + 1
+		} else {
+			hi = mid - 1
+		}
+	}
+
+	if fit == 0 {
+		req.origNumCtx = requested
+		req.opts.NumCtx = requested * max(*numParallel, 1)
+		return nil
+	}
+
+	req.origNumCtx = fit
+	req.requestedNumCtx = requested
+	slog.WarnContext(req.ctx, "model does not fit in available VRAM with requested context length, reducing it", "model", req.model.ModelPath, "requested", requested, "reduced", fit)
+	return pickBestFullFitByLibrary(req, ggml, gpus, numParallel)
+}
+
 // If multiple Libraries are detected, pick the Library which loads the most layers for the model
 func pickBestPartialFitByLibrary(req *LlmRequest, ggml *llm.GGML, gpus discover.GpuInfoList, numParallel *int) discover.GpuInfoList {
 	if *numParallel <= 0 {
@@ -760,10 +895,31 @@ func pickBestPartialFitByLibrary(req *LlmRequest, ggml *llm.GGML, gpus discover.
 
 // findRunnerToUnload finds a runner to unload to make room for a new model
 func (s *Scheduler) findRunnerToUnload() *runnerRef {
+	return s.findRunnerToUnloadFunc(func(*runnerRef) bool { return true })
+}
+
+// runnerToUnload finds a runner to unload to make room for req. Embedding
+// models in the embedding pool only make room by unloading other embedding
+// models, so returns nil if there aren't any.
+func (s *Scheduler) runnerToUnload(req *LlmRequest) *runnerRef {
+	if !req.inEmbeddingPool() {
+		return s.findRunnerToUnload()
+	}
+
+	return s.findRunnerToUnloadFunc(func(r *runnerRef) bool {
+		return r.model != nil && r.model.CheckCapabilities(CapabilityCompletion) != nil
+	})
+}
+
+// findRunnerToUnloadFunc finds a runner for which unload returns true to
+// unload to make room for a new model
+func (s *Scheduler) findRunnerToUnloadFunc(unload func(*runnerRef) bool) *runnerRef {
 	s.loadedMu.Lock()
 	runnerList := make([]*runnerRef, 0, len(s.loaded))
 	for _, r := range s.loaded {
-		runnerList = append(runnerList, r)
+		if unload(r) {
+			runnerList = append(runnerList, r)
+		}
 	}
 	s.loadedMu.Unlock()
 	if len(runnerList) == 0 {
@@ -801,22 +957,104 @@ func (s *Scheduler) unloadAllRunners() {
 	}
 }
 
+// unloadModel unloads the runner for model, if one is loaded, and waits for it
+// to exit. A runner that's processing requests is unloaded once they finish if
+// force is set, otherwise errModelInUse is returned.
+func (s *Scheduler) unloadModel(ctx context.Context, model *Model, force bool) error {
+	if s == nil {
+		return nil
+	}
+
+	s.loadedMu.Lock()
+	runner, ok := s.loaded[model.ModelPath]
+	if !ok {
+		s.loadedMu.Unlock()
+		return nil
+	}
+
+	runner.refMu.Lock()
+	inUse := runner.refCount > 0
+	runner.refMu.Unlock()
+	if inUse && !force {
+		s.loadedMu.Unlock()
+		return errModelInUse
+	}
+
+	s.expire(runner)
+	s.loadedMu.Unlock()
+
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		s.loadedMu.Lock()
+		loaded := s.loaded[model.ModelPath] == runner
+		s.loadedMu.Unlock()
+		if !loaded {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// isLoaded reports whether a runner is loaded for model
+func (s *Scheduler) isLoaded(model *Model) bool {
+	if s == nil {
+		return false
+	}
+
+	s.loadedMu.Lock()
+	defer s.loadedMu.Unlock()
+	_, ok := s.loaded[model.ModelPath]
+	return ok
+}
+
 func (s *Scheduler) expireRunner(model *Model) {
 	s.loadedMu.Lock()
 	defer s.loadedMu.Unlock()
 	runner, ok := s.loaded[model.ModelPath]
 	if ok {
-		runner.refMu.Lock()
-		runner.expiresAt = time.Now()
-		if runner.expireTimer != nil {
-			runner.expireTimer.Stop()
-			runner.expireTimer = nil
-		}
-		runner.sessionDuration = 0
-		if runner.refCount <= 0 {
-			s.expiredCh <- runner
+		s.expire(runner)
+	}
+}
+
+// expireAllRunners unloads every loaded runner once it is no longer in use
+func (s *Scheduler) expireAllRunners() {
+	s.loadedMu.Lock()
+	defer s.loadedMu.Unlock()
+	for _, runner := range s.loaded {
+		s.expire(runner)
+	}
+}
+
+// expireRunnersExcept unloads every loaded runner of a model not in keep, by
+// model path, once it is no longer in use
+func (s *Scheduler) expireRunnersExcept(keep map[string]bool) {
+	s.loadedMu.Lock()
+	defer s.loadedMu.Unlock()
+	for path, runner := range s.loaded {
+		if !keep[path] {
+			s.expire(runner)
 		}
-		runner.refMu.Unlock()
+	}
+}
+
+// expire must be called with loadedMu held
+func (s *Scheduler) expire(runner *runnerRef) {
+	runner.refMu.Lock()
+	defer runner.refMu.Unlock()
+	runner.expiresAt = time.Now()
+	if runner.expireTimer != nil {
+		runner.expireTimer.Stop()
+		runner.expireTimer = nil
+	}
+	runner.sessionDuration = 0
+	if runner.refCount <= 0 {
+		s.expiredCh <- runner
 	}
 }
 
@@ -832,5 +1070,52 @@ func (s *Scheduler) maybeFindCPURunnerToUnload(req *LlmRequest, ggml *llm.GGML,
 
 	// TODO - optimization: try to find CPU only runners first, or partial offloads with enough in system memory to make room
 
-	return s.findRunnerToUnload()
+	return s.runnerToUnload(req)
+}
+
+// inEmbeddingPool reports whether req is for an embedding model, and
+// OLLAMA_EMBEDDING_DEVICE sets aside a device for embedding models
+func (req *LlmRequest) inEmbeddingPool() bool {
+	return envconfig.EmbeddingDevice() != "" && req.model.CheckCapabilities(CapabilityCompletion) != nil
+}
+
+// pickEmbeddingPool returns the device set by OLLAMA_EMBEDDING_DEVICE, either
+// "cpu" or the ID of a GPU, if req fits there, otherwise nil
+func (s *Scheduler) pickEmbeddingPool(req *LlmRequest, ggml *llm.GGML) discover.GpuInfoList {
+	req.opts.NumCtx = req.origNumCtx
+
+	device := envconfig.EmbeddingDevice()
+	if strings.EqualFold(device, "cpu") {
+		cpus := s.getCpuFn()
+		if len(cpus) == 0 {
+			return nil
+		}
+
+		estimate := llm.EstimateGPULayers(cpus, ggml, req.model.ProjectorPaths, req.opts)
+		if estimate.TotalSize > cpus[0].FreeMemory {
+			slog.Debug("embedding model doesn't fit in available system memory", "model", format.HumanBytes2(estimate.TotalSize), "available", format.HumanBytes2(cpus[0].FreeMemory))
+			return nil
+		}
+
+		return cpus
+	}
+
+	gpus := s.filterGPUsWithoutLoadingModels(s.getGpuFn())
+	s.updateFreeSpace(gpus)
+	for _, g := range gpus {
+		if g.ID != device {
+			continue
+		}
+
+		ok, estimatedVRAM := llm.PredictServerFit([]discover.GpuInfo{g}, ggml, req.model.AdapterPaths, req.model.ProjectorPaths, req.opts)
+		if ok {
+			return []discover.GpuInfo{g}
+		}
+
+		slog.Debug("embedding model doesn't fit in available VRAM", "gpu", g.ID, "required", format.HumanBytes2(estimatedVRAM), "available", format.HumanBytes2(g.FreeMemory))
+		return nil
+	}
+
+	slog.Warn("embedding device not found", "OLLAMA_EMBEDDING_DEVICE", device)
+	return nil
 }
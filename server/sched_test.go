@@ -5,7 +5,9 @@ import (
 	"context"
 	"errors"
 	"log/slog"
+	"maps"
 	"os"
+	"slices"
 	"testing"
 	"time"
 
@@ -47,7 +49,7 @@ func TestLoad(t *testing.T) {
 		sessionDuration: &api.Duration{Duration: 2 * time.Second},
 	}
 	// Fail to load model first
-	s.newServerFn = func(gpus discover.GpuInfoList, model string, ggml *llm.GGML, adapters []string, projectors []string, opts api.Options, numParallel int) (llm.LlamaServer, error) {
+	s.newServerFn = func(gpus discover.GpuInfoList, model string, ggml *llm.GGML, adapters []string, projectors []string, softPrompt, sessionDir string, opts api.Options, numParallel int) (llm.LlamaServer, error) {
 		return nil, errors.New("something failed to load model blah")
 	}
 	gpus := discover.GpuInfoList{}
@@ -61,7 +63,7 @@ func TestLoad(t *testing.T) {
 	require.Contains(t, err.Error(), "this model may be incompatible")
 
 	server := &mockLlm{estimatedVRAM: 10, estimatedVRAMByGPU: map[string]uint64{}}
-	s.newServerFn = func(gpus discover.GpuInfoList, model string, ggml *llm.GGML, adapters []string, projectors []string, opts api.Options, numParallel int) (llm.LlamaServer, error) {
+	s.newServerFn = func(gpus discover.GpuInfoList, model string, ggml *llm.GGML, adapters []string, projectors []string, softPrompt, sessionDir string, opts api.Options, numParallel int) (llm.LlamaServer, error) {
 		return server, nil
 	}
 	s.load(req, ggml, gpus, 0)
@@ -94,6 +96,51 @@ func TestLoad(t *testing.T) {
 	require.Len(t, s.expiredCh, 1)
 }
 
+func TestLoadWarmUp(t *testing.T) {
+	ctx, done := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer done()
+
+	cases := []struct {
+		name    string
+		warmUp  string
+		kv      llm.KV
+		expect  int
+		failure error
+	}{
+		{"disabled", "", nil, 0, nil},
+		{"enabled", "1", nil, 1, nil},
+		{"embedding", "1", llm.KV{"llama.pooling_type": uint32(1)}, 0, nil},
+		{"failure", "1", nil, 1, errors.New("warm up failure")},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("OLLAMA_WARMUP", tt.warmUp)
+
+			s := InitScheduler(ctx)
+			a := newScenarioRequestWithKV(t, ctx, "warmup", 10, nil, tt.kv)
+			server := &mockLlm{estimatedVRAMByGPU: map[string]uint64{}, completionResp: tt.failure}
+			s.newServerFn = func(gpus discover.GpuInfoList, model string, ggml *llm.GGML, adapters []string, projectors []string, softPrompt, sessionDir string, opts api.Options, numParallel int) (llm.LlamaServer, error) {
+				return server, nil
+			}
+
+			s.load(a.req, a.ggml, discover.GpuInfoList{}, 0)
+			select {
+			case err := <-a.req.errCh:
+				t.Fatal(err)
+			case <-a.req.successCh:
+			case <-ctx.Done():
+				t.Fatal("timeout")
+			}
+
+			require.Len(t, server.completionReqs, tt.expect)
+			if tt.expect > 0 {
+				require.Equal(t, 1, server.completionReqs[0].Options.NumPredict)
+			}
+		})
+	}
+}
+
 type reqBundle struct {
 	ctx     context.Context //nolint:containedctx
 	ctxDone func()
@@ -102,11 +149,18 @@ type reqBundle struct {
 	ggml    *llm.GGML
 }
 
-func (scenario *reqBundle) newServer(gpus discover.GpuInfoList, model string, ggml *llm.GGML, adapters []string, projectors []string, opts api.Options, numParallel int) (llm.LlamaServer, error) {
+func (scenario *reqBundle) newServer(gpus discover.GpuInfoList, model string, ggml *llm.GGML, adapters []string, projectors []string, softPrompt, sessionDir string, opts api.Options, numParallel int) (llm.LlamaServer, error) {
 	return scenario.srv, nil
 }
 
 func newScenarioRequest(t *testing.T, ctx context.Context, modelName string, estimatedVRAM uint64, duration *api.Duration) *reqBundle {
+	t.Helper()
+	return newScenarioRequestWithKV(t, ctx, modelName, estimatedVRAM, duration, nil)
+}
+
+// newScenarioRequestWithKV is like newScenarioRequest with additional
+// metadata in the model
+func newScenarioRequestWithKV(t *testing.T, ctx context.Context, modelName string, estimatedVRAM uint64, duration *api.Duration, extra llm.KV) *reqBundle {
 	b := &reqBundle{}
 	b.ctx, b.ctxDone = context.WithCancel(ctx)
 	t.Helper()
@@ -115,7 +169,7 @@ func newScenarioRequest(t *testing.T, ctx context.Context, modelName string, est
 	require.NoError(t, err)
 	defer f.Close()
 
-	require.NoError(t, llm.WriteGGUF(f, llm.KV{
+	kv := llm.KV{
 		"general.architecture":          "llama",
 		"llama.context_length":          uint32(32),
 		"llama.embedding_length":        uint32(4096),
@@ -125,7 +179,10 @@ func newScenarioRequest(t *testing.T, ctx context.Context, modelName string, est
 		"tokenizer.ggml.tokens":         []string{" "},
 		"tokenizer.ggml.scores":         []float32{0},
 		"tokenizer.ggml.token_type":     []int32{0},
-	}, []llm.Tensor{
+	}
+	maps.Copy(kv, extra)
+
+	require.NoError(t, llm.WriteGGUF(f, kv, []llm.Tensor{
 		{Name: "blk.0.attn.weight", Kind: uint32(0), Offset: uint64(0), Shape: []uint64{1, 1, 1, 1}, WriterTo: bytes.NewReader(make([]byte, 32))},
 		{Name: "output.weight", Kind: uint32(0), Offset: uint64(0), Shape: []uint64{1, 1, 1, 1}, WriterTo: bytes.NewReader(make([]byte, 32))},
 	}))
@@ -422,7 +479,7 @@ func TestExpireRunner(t *testing.T) {
 	var ggml *llm.GGML
 	gpus := discover.GpuInfoList{}
 	server := &mockLlm{estimatedVRAM: 10, estimatedVRAMByGPU: map[string]uint64{}}
-	s.newServerFn = func(gpus discover.GpuInfoList, model string, ggml *llm.GGML, adapters []string, projectors []string, opts api.Options, numParallel int) (llm.LlamaServer, error) {
+	s.newServerFn = func(gpus discover.GpuInfoList, model string, ggml *llm.GGML, adapters []string, projectors []string, softPrompt, sessionDir string, opts api.Options, numParallel int) (llm.LlamaServer, error) {
 		return server, nil
 	}
 	s.load(req, ggml, gpus, 0)
@@ -614,6 +671,100 @@ func TestFindRunnerToUnload(t *testing.T) {
 	require.Equal(t, r1, resp)
 }
 
+func TestEmbeddingPool(t *testing.T) {
+	ctx, done := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer done()
+
+	t.Setenv("OLLAMA_EMBEDDING_DEVICE", "cpu")
+	t.Setenv("OLLAMA_MAX_LOADED_MODELS", "1")
+
+	s := InitScheduler(ctx)
+	s.getGpuFn = getGpuFn
+	s.getCpuFn = getCpuFn
+
+	embedding := llm.KV{"llama.pooling_type": uint32(1)}
+	a := newScenarioRequest(t, ctx, "ollama-model-chat", 10*format.GigaByte, nil)
+	b := newScenarioRequestWithKV(t, ctx, "ollama-model-embed-a", 30, nil, embedding)
+	c := newScenarioRequestWithKV(t, ctx, "ollama-model-embed-b", 30, nil, embedding)
+
+	var placed []string
+	newServer := func(r *reqBundle) func(discover.GpuInfoList, string, *llm.GGML, []string, []string, string, string, api.Options, int) (llm.LlamaServer, error) {
+		return func(gpus discover.GpuInfoList, model string, ggml *llm.GGML, adapters []string, projectors []string, softPrompt, sessionDir string, opts api.Options, numParallel int) (llm.LlamaServer, error) {
+			placed = append(placed, gpus[0].Library)
+			return r.srv, nil
+		}
+	}
+
+	load := func(r *reqBundle) {
+		t.Helper()
+		s.newServerFn = newServer(r)
+		s.pendingReqCh <- r.req
+		select {
+		case resp := <-r.req.successCh:
+			require.Equal(t, r.srv, resp.llama)
+		case err := <-r.req.errCh:
+			t.Fatal(err.Error())
+		case <-ctx.Done():
+			t.Fatal("timeout")
+		}
+	}
+
+	s.Run(ctx)
+	load(a)
+
+	// the only model which could be unloaded is the chat model
+	s.newServerFn = newServer(b)
+	s.pendingReqCh <- b.req
+	select {
+	case resp := <-b.req.successCh:
+		t.Fatalf("expected the embedding model not to load, got %v", resp)
+	case err := <-b.req.errCh:
+		require.ErrorIs(t, err, errEmbeddingPoolFull)
+	case <-ctx.Done():
+		t.Fatal("timeout")
+	}
+
+	t.Setenv("OLLAMA_MAX_LOADED_MODELS", "2")
+	load(b)
+
+	// the chat model goes on the GPU and the embedding model on the CPU
+	require.Equal(t, []string{"metal", "cpu"}, placed)
+
+	// the embedding model is the only one which can make room for another
+	s.loadedMu.Lock()
+	expect := s.loaded[b.req.model.ModelPath]
+	s.loadedMu.Unlock()
+	require.Equal(t, expect, s.runnerToUnload(c.req))
+}
+
+func TestRunnerToUnload(t *testing.T) {
+	ctx, done := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer done()
+
+	chat := newScenarioRequest(t, ctx, "ollama-model-chat", 10, nil)
+	embed := newScenarioRequestWithKV(t, ctx, "ollama-model-embed", 10, nil, llm.KV{"llama.pooling_type": uint32(1)})
+
+	r1 := &runnerRef{model: chat.req.model, sessionDuration: 1, numParallel: 1}
+	r2 := &runnerRef{model: embed.req.model, sessionDuration: 2, numParallel: 1}
+
+	s := InitScheduler(ctx)
+	s.loadedMu.Lock()
+	s.loaded["a"] = r1
+	s.loaded["b"] = r2
+	s.loadedMu.Unlock()
+
+	require.Equal(t, r1, s.runnerToUnload(embed.req))
+
+	t.Setenv("OLLAMA_EMBEDDING_DEVICE", "cpu")
+	require.Equal(t, r2, s.runnerToUnload(embed.req))
+	require.Equal(t, r1, s.runnerToUnload(chat.req))
+
+	s.loadedMu.Lock()
+	delete(s.loaded, "b")
+	s.loadedMu.Unlock()
+	require.Nil(t, s.runnerToUnload(embed.req))
+}
+
 func TestNeedsReload(t *testing.T) {
 	ctx, done := context.WithTimeout(context.Background(), 100*time.Millisecond)
 	defer done()
@@ -659,6 +810,15 @@ func TestNeedsReload(t *testing.T) {
 	req.opts.NumGPU = -1
 	resp = runner.needsReload(ctx, req)
 	require.False(t, resp)
+	req.sessions = true
+	resp = runner.needsReload(ctx, req)
+	require.True(t, resp)
+	runner.sessions = true
+	resp = runner.needsReload(ctx, req)
+	require.False(t, resp)
+	req.sessions = false
+	resp = runner.needsReload(ctx, req)
+	require.False(t, resp)
 }
 
 func TestUnloadAllRunners(t *testing.T) {
@@ -729,9 +889,9 @@ func TestHomogeneousGPUs(t *testing.T) {
 	}
 	s.getCpuFn = getCpuFn
 	a := newScenarioRequest(t, ctx, "ollama-model-1", 10, &api.Duration{Duration: 5 * time.Millisecond})
-	s.newServerFn = func(gpus discover.GpuInfoList, model string, ggml *llm.GGML, adapters []string, projectors []string, opts api.Options, numParallel int) (llm.LlamaServer, error) {
+	s.newServerFn = func(gpus discover.GpuInfoList, model string, ggml *llm.GGML, adapters []string, projectors []string, softPrompt, sessionDir string, opts api.Options, numParallel int) (llm.LlamaServer, error) {
 		require.Len(t, gpus, 1)
-		return a.newServer(gpus, model, ggml, adapters, projectors, opts, numParallel)
+		return a.newServer(gpus, model, ggml, adapters, projectors, softPrompt, sessionDir, opts, numParallel)
 	}
 	slog.Info("a")
 	s.pendingReqCh <- a.req
@@ -749,6 +909,117 @@ func TestHomogeneousGPUs(t *testing.T) {
 	}
 }
 
+func TestFitContext(t *testing.T) {
+	ctx, done := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer done()
+	t.Setenv("OLLAMA_FIT_CONTEXT", "1")
+
+	a := newScenarioRequest(t, ctx, "ollama-model-1", 10, &api.Duration{Duration: 5 * time.Millisecond})
+	a.req.opts.NumCtx = 32768
+
+	// leave room for the model with a smaller context but not the requested one
+	gpu := discover.GpuInfo{Library: "cuda"}
+	gpu.TotalMemory = 24 * format.GibiByte
+	gpu.FreeMemory = 24 * format.GibiByte
+	opts := a.req.opts
+	opts.NumCtx = 8192
+	gpu.FreeMemory = llm.EstimateGPULayers([]discover.GpuInfo{gpu}, a.ggml, nil, opts).VRAMSize + format.MebiByte
+
+	s := InitScheduler(ctx)
+	s.getGpuFn = func() discover.GpuInfoList { return []discover.GpuInfo{gpu} }
+	s.getCpuFn = getCpuFn
+	s.newServerFn = a.newServer
+
+	s.pendingReqCh <- a.req
+	s.Run(ctx)
+	select {
+	case resp := <-a.req.successCh:
+		require.Equal(t, resp.llama, a.srv)
+		require.Equal(t, 32768, resp.requestedNumCtx)
+		numCtx := resp.Options.NumCtx / resp.numParallel
+		require.GreaterOrEqual(t, numCtx, minFitContext)
+		require.Less(t, numCtx, 32768)
+		require.Zero(t, numCtx%fitContextStep)
+
+		// requests for the same context reuse the reduced runner
+		req := &LlmRequest{model: a.req.model, opts: api.DefaultOptions()}
+		req.opts.NumCtx = 32768
+		require.False(t, resp.needsReload(ctx, req))
+		req.opts.NumCtx = 4096
+		require.True(t, resp.needsReload(ctx, req))
+	case err := <-a.req.errCh:
+		t.Fatal(err.Error())
+	case <-ctx.Done():
+		t.Fatal("timeout")
+	}
+}
+
+func TestFitContextLoadedModels(t *testing.T) {
+	ctx, done := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer done()
+	t.Setenv("OLLAMA_FIT_CONTEXT", "1")
+
+	a := newScenarioRequest(t, ctx, "ollama-model-1", 10, &api.Duration{Duration: 5 * time.Millisecond})
+	a.req.opts.NumCtx = 32768
+
+	// leave room next to the loaded model for a smaller context but not the
+	// requested one
+	gpu := discover.GpuInfo{Library: "cuda", ID: "1"}
+	gpu.TotalMemory = 24 * format.GibiByte
+	gpu.FreeMemory = 24 * format.GibiByte
+	opts := a.req.opts
+	opts.NumCtx = 8192
+	loadedVRAM := uint64(4 * format.GibiByte)
+	gpu.TotalMemory = llm.EstimateGPULayers([]discover.GpuInfo{gpu}, a.ggml, nil, opts).VRAMSize + loadedVRAM + format.MebiByte
+	gpu.FreeMemory = gpu.TotalMemory
+
+	s := InitScheduler(ctx)
+	s.getGpuFn = func() discover.GpuInfoList { return []discover.GpuInfo{gpu} }
+	s.getCpuFn = getCpuFn
+	s.newServerFn = a.newServer
+
+	loaded := &runnerRef{llama: &mockLlm{estimatedVRAMByGPU: map[string]uint64{"1": loadedVRAM}}, gpus: []discover.GpuInfo{gpu}, numParallel: 1}
+	s.loadedMu.Lock()
+	s.loaded["loaded"] = loaded
+	s.loadedMu.Unlock()
+
+	s.pendingReqCh <- a.req
+	s.Run(ctx)
+	select {
+	case resp := <-a.req.successCh:
+		require.Equal(t, resp.llama, a.srv)
+		require.Equal(t, 32768, resp.requestedNumCtx)
+		numCtx := resp.Options.NumCtx / resp.numParallel
+		require.GreaterOrEqual(t, numCtx, minFitContext)
+		require.Less(t, numCtx, 32768)
+
+		// the loaded model is kept
+		s.loadedMu.Lock()
+		require.Len(t, s.loaded, 2)
+		s.loadedMu.Unlock()
+	case err := <-a.req.errCh:
+		t.Fatal(err.Error())
+	case <-ctx.Done():
+		t.Fatal("timeout")
+	}
+}
+
+func TestFitContextTooSmall(t *testing.T) {
+	a := newScenarioRequest(t, context.Background(), "ollama-model-1", 10, nil)
+	a.req.opts.NumCtx = 32768
+	a.req.origNumCtx = 32768
+
+	gpu := discover.GpuInfo{Library: "cuda"}
+	gpu.TotalMemory = 256 * format.MebiByte
+	gpu.FreeMemory = 1 * format.MebiByte
+
+	numParallel := 1
+	require.Nil(t, pickBestContextFit(a.req, a.ggml, []discover.GpuInfo{gpu}, &numParallel))
+	require.Equal(t, 32768, a.req.origNumCtx)
+	require.Equal(t, 32768, a.req.opts.NumCtx)
+	require.Zero(t, a.req.requestedNumCtx)
+}
+
 type mockLlm struct {
 	pingResp           error
 	waitResp           error
@@ -761,18 +1032,21 @@ type mockLlm struct {
 	detonekizeRespErr  error
 	closeResp          error
 	closeCalled        bool
+	completionReqs     []llm.CompletionRequest
 	estimatedVRAM      uint64
 	estimatedTotal     uint64
 	estimatedVRAMByGPU map[string]uint64
+	adapters           []llm.AdapterStatus
 }
 
 func (s *mockLlm) Ping(ctx context.Context) error             { return s.pingResp }
 func (s *mockLlm) WaitUntilRunning(ctx context.Context) error { return s.waitResp }
 func (s *mockLlm) Completion(ctx context.Context, req llm.CompletionRequest, fn func(llm.CompletionResponse)) error {
+	s.completionReqs = append(s.completionReqs, req)
 	return s.completionResp
 }
 
-func (s *mockLlm) Embedding(ctx context.Context, input string) ([]float32, error) {
+func (s *mockLlm) Embedding(ctx context.Context, req llm.EmbeddingRequest) ([]float32, error) {
 	return s.embeddingResp, s.embeddingRespErr
 }
 
@@ -784,6 +1058,28 @@ func (s *mockLlm) Detokenize(ctx context.Context, tokens []int) (string, error)
 	return s.detokenizeResp, s.detonekizeRespErr
 }
 
+func (s *mockLlm) Adapters(ctx context.Context) ([]llm.AdapterStatus, error) { return s.adapters, nil }
+
+func (s *mockLlm) LoadAdapter(ctx context.Context, path string) error {
+	if !slices.ContainsFunc(s.adapters, func(a llm.AdapterStatus) bool { return a.Path == path }) {
+		s.adapters = append(s.adapters, llm.AdapterStatus{Path: path})
+	}
+	return nil
+}
+
+func (s *mockLlm) UnloadAdapter(ctx context.Context, path string) error {
+	i := slices.IndexFunc(s.adapters, func(a llm.AdapterStatus) bool { return a.Path == path })
+	switch {
+	case i < 0:
+		return os.ErrNotExist
+	case s.adapters[i].Sequences > 0:
+		return llm.ErrAdapterInUse
+	}
+
+	s.adapters = slices.Delete(s.adapters, i, i+1)
+	return nil
+}
+
 func (s *mockLlm) Close() error {
 	s.closeCalled = true
 	return s.closeResp
@@ -0,0 +1,487 @@
+package server
+
+import (
+	"cmp"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/envconfig"
+)
+
+var sessionIDRegexp = regexp.MustCompile(`^[A-Za-z0-9_.:-]{1,128}$`)
+
+// sessionFileRegexp matches the keys sessions are saved under
+var sessionFileRegexp = regexp.MustCompile(`^[0-9a-f]{32}$`)
+
+// sessionTTL is how long sessions are kept after their last request
+const sessionTTL = 24 * time.Hour
+
+type sessionsKey struct{}
+
+// withSessions marks a request as continuing a session, so the runner it's
+// scheduled on is started with the sessions directory to save KV caches to
+func withSessions(ctx context.Context) context.Context {
+	return context.WithValue(ctx, sessionsKey{}, true)
+}
+
+// usesSessions reports whether a request continues a session
+func usesSessions(ctx context.Context) bool {
+	v, _ := ctx.Value(sessionsKey{}).(bool)
+	return v
+}
+
+// session is a conversation the server keeps between chat requests. Clients
+// send only the new messages of each turn, and the runner keeps the KV cache
+// of the conversation in a slot, or saves it to the sessions directory when
+// the slot is needed for another prompt, so the conversation isn't processed
+// again with each request.
+type session struct {
+	id     string
+	model  string
+	tenant string
+
+	// key names the saved KV cache of the session in the sessions directory
+	key string
+
+	messages []api.Message
+
+	// memory is a summary of the turns dropped from messages once the
+	// history grew past OLLAMA_SESSION_MEMORY tokens
+	memory string
+
+	createdAt time.Time
+	updatedAt time.Time
+
+	// busy is held during a request in the session, so turns are taken one
+	// at a time
+	busy sync.Mutex
+}
+
+// sessions are the chat sessions of every tenant. The zero value has none.
+type sessions struct {
+	mu       sync.Mutex
+	sessions map[sessionKey]*session
+}
+
+type sessionKey struct {
+	tenant, id string
+}
+
+func tenantName(t *tenant) string {
+	if t == nil {
+		return ""
+	}
+
+	return t.name
+}
+
+// get returns the tenant's session with id, creating it for model if it
+// doesn't exist. A session is only used with the model it was created for.
+func (ss *sessions) get(t *tenant, id, model string) (*session, error) {
+	if !sessionIDRegexp.MatchString(id) {
+		return nil, fmt.Errorf("invalid session_id %q", id)
+	}
+
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	ss.prune()
+
+	k := sessionKey{tenantName(t), id}
+	if s, ok := ss.sessions[k]; ok {
+		if s.model != model {
+			return nil, fmt.Errorf("session %s is used with %s, not %s", id, s.model, model)
+		}
+
+		return s, nil
+	}
+
+	b := make([]byte, 16)
+	if _, err := io.ReadFull(rand.Reader, b); err != nil {
+		return nil, err
+	}
+
+	if ss.sessions == nil {
+		ss.sessions = make(map[sessionKey]*session)
+	}
+
+	ss.evict(k.tenant)
+
+	now := time.Now().UTC()
+	s := &session{id: id, model: model, tenant: k.tenant, key: hex.EncodeToString(b), createdAt: now, updatedAt: now}
+	ss.sessions[k] = s
+	return s, nil
+}
+
+// history returns the messages of the session so far, and its memory of the
+// turns before them
+func (ss *sessions) history(s *session) ([]api.Message, string) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	return slices.Clone(s.messages), s.memory
+}
+
+// add adds the messages of a turn to the session
+func (ss *sessions) add(s *session, msgs ...api.Message) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	s.messages = append(s.messages, msgs...)
+	s.updatedAt = time.Now().UTC()
+	ss.save(s)
+}
+
+// remember replaces the messages of the session from start to end with
+// memory, a summary of them and the memory before it
+func (ss *sessions) remember(s *session, memory string, start, end int) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	s.messages = slices.Delete(s.messages, start, end)
+	s.memory = memory
+	ss.save(s)
+}
+
+// list returns the tenant's sessions, most recently used first
+func (ss *sessions) list(t *tenant) []api.SessionResponse {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	ss.prune()
+
+	list := []api.SessionResponse{}
+	for k, s := range ss.sessions {
+		if k.tenant == tenantName(t) {
+			list = append(list, api.SessionResponse{
+				ID:        s.id,
+				Model:     s.model,
+				Messages:  len(s.messages),
+				Memory:    s.memory != "",
+				CreatedAt: s.createdAt,
+				UpdatedAt: s.updatedAt,
+			})
+		}
+	}
+
+	slices.SortFunc(list, func(a, b api.SessionResponse) int {
+		return cmp.Or(b.UpdatedAt.Compare(a.UpdatedAt), cmp.Compare(a.ID, b.ID))
+	})
+
+	return list
+}
+
+// delete deletes the tenant's session with id and its saved KV cache. It
+// returns an error wrapping os.ErrNotExist if there isn't one.
+func (ss *sessions) delete(t *tenant, id string) error {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
+	k := sessionKey{tenantName(t), id}
+	s, ok := ss.sessions[k]
+	if !ok {
+		return fmt.Errorf("session %s: %w", id, os.ErrNotExist)
+	}
+
+	delete(ss.sessions, k)
+	s.remove()
+	return nil
+}
+
+// exists reports whether the tenant has a session with id
+func (ss *sessions) exists(t *tenant, id string) bool {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	s, ok := ss.sessions[sessionKey{tenantName(t), id}]
+	return ok && time.Since(s.updatedAt) <= sessionTTL
+}
+
+// evict deletes the tenant's least recently used sessions until there's room
+// for another under OLLAMA_MAX_SESSIONS. The mu must already be held.
+func (ss *sessions) evict(tenant string) {
+	limit := int(envconfig.MaxSessions())
+	if limit == 0 {
+		return
+	}
+
+	var own []sessionKey
+	for k := range ss.sessions {
+		if k.tenant == tenant {
+			own = append(own, k)
+		}
+	}
+
+	slices.SortFunc(own, func(a, b sessionKey) int {
+		return ss.sessions[a].updatedAt.Compare(ss.sessions[b].updatedAt)
+	})
+
+	for _, k := range own[:max(len(own)-limit+1, 0)] {
+		s := ss.sessions[k]
+		slog.Debug("session evicted", "session", s.id, "model", s.model)
+		delete(ss.sessions, k)
+		s.remove()
+	}
+}
+
+// The mu must already be held when calling prune
+func (ss *sessions) prune() {
+	for k, s := range ss.sessions {
+		if time.Since(s.updatedAt) > sessionTTL {
+			slog.Debug("session expired", "session", s.id, "model", s.model)
+			delete(ss.sessions, k)
+			s.remove()
+		}
+	}
+}
+
+// remove removes the saved KV cache of the session, and the session itself
+// if it was saved
+func (s *session) remove() {
+	for _, ext := range []string{".session", ".json"} {
+		if err := os.Remove(filepath.Join(envconfig.Sessions(), s.key+ext)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			slog.Warn("failed to remove session", "session", s.id, "error", err)
+		}
+	}
+
+	// sandboxed runners save KV caches in a directory of their user's
+	removeSessionFiles(filepath.Join("*", s.key+".session"))
+}
+
+// savedSession is a session saved to the sessions directory with session
+// memory enabled. Its tenant, ID and model are saved separately in the
+// session index.
+type savedSession struct {
+	Memory    string        `json:"memory,omitempty"`
+	Messages  []api.Message `json:"messages"`
+	CreatedAt time.Time     `json:"created_at"`
+	UpdatedAt time.Time     `json:"updated_at"`
+}
+
+// sessionBinding is the tenant, ID and model of a saved session
+type sessionBinding struct {
+	Tenant string `json:"tenant,omitempty"`
+	ID     string `json:"id"`
+	Model  string `json:"model"`
+}
+
+// sessionIndex returns the path of the index of saved sessions, which maps
+// the key of each saved session to its binding. It's kept with the server's
+// key rather than in the sessions directory, so a session can't be handed to
+// another tenant by editing the files there.
+func sessionIndex() (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(home, ".ollama", "sessions.json"), nil
+}
+
+// readPrivate reads the file at path, which must be owned by the server's
+// user and have no permissions beyond perm
+func readPrivate(path string, perm os.FileMode) ([]byte, error) {
+	if err := checkPrivate(path, perm); err != nil {
+		return nil, err
+	}
+
+	return os.ReadFile(path)
+}
+
+// writePrivate writes b to the file at path, creating its directory, which
+// must be private to the server's user
+func writePrivate(path string, b []byte) error {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return err
+	}
+
+	if err := checkPrivate(dir, 0o700); err != nil {
+		return err
+	}
+
+	if err := os.WriteFile(path, b, 0o600); err != nil {
+		return err
+	}
+
+	return checkPrivate(path, 0o600)
+}
+
+// save saves the session so it's restored after a restart, when session
+// memory is enabled, unless it has been deleted. The mu must already be held.
+func (ss *sessions) save(s *session) {
+	if envconfig.SessionMemory() == 0 || ss.sessions[sessionKey{s.tenant, s.id}] != s {
+		return
+	}
+
+	if err := ss.write(s); err != nil {
+		slog.Warn("failed to save session", "session", s.id, "error", err)
+	}
+}
+
+// write writes the session to the sessions directory and the bindings of
+// every session to the session index. The mu must already be held.
+func (ss *sessions) write(s *session) error {
+	index, err := sessionIndex()
+	if err != nil {
+		return err
+	}
+
+	b, err := json.Marshal(savedSession{
+		Memory:    s.memory,
+		Messages:  s.messages,
+		CreatedAt: s.createdAt,
+		UpdatedAt: s.updatedAt,
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := writePrivate(filepath.Join(envconfig.Sessions(), s.key+".json"), b); err != nil {
+		return err
+	}
+
+	bindings := make(map[string]sessionBinding, len(ss.sessions))
+	for _, s := range ss.sessions {
+		bindings[s.key] = sessionBinding{Tenant: s.tenant, ID: s.id, Model: s.model}
+	}
+
+	if b, err = json.Marshal(bindings); err != nil {
+		return err
+	}
+
+	return writePrivate(index, b)
+}
+
+// restore removes the KV caches saved by a previous server, and restores its
+// sessions in the session index if session memory is enabled. Otherwise
+// sessions are only kept in memory and the saved ones are removed too. The
+// sessions directory, its files and the index are left alone unless they're
+// private to the server's user.
+func (ss *sessions) restore() {
+	if err := checkPrivate(envconfig.Sessions(), 0o700); err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			slog.Warn("not restoring sessions", "error", err)
+		}
+		return
+	}
+
+	removeSessionFiles("*.session")
+	removeSessionFiles(filepath.Join("*", "*.session"))
+	if envconfig.SessionMemory() == 0 {
+		removeSessionFiles("*.json")
+		return
+	}
+
+	index, err := sessionIndex()
+	if err != nil {
+		return
+	}
+
+	b, err := readPrivate(index, 0o600)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			slog.Warn("not restoring sessions", "error", err)
+		}
+		return
+	}
+
+	var bindings map[string]sessionBinding
+	if err := json.Unmarshal(b, &bindings); err != nil {
+		slog.Warn("not restoring sessions", "path", index, "error", err)
+		return
+	}
+
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	for key, binding := range bindings {
+		if !sessionFileRegexp.MatchString(key) || !sessionIDRegexp.MatchString(binding.ID) {
+			slog.Warn("failed to restore session", "key", key, "session", binding.ID)
+			continue
+		}
+
+		p := filepath.Join(envconfig.Sessions(), key+".json")
+		b, err := readPrivate(p, 0o600)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		} else if err != nil {
+			slog.Warn("failed to restore session", "path", p, "error", err)
+			continue
+		}
+
+		var saved savedSession
+		if err := json.Unmarshal(b, &saved); err != nil {
+			slog.Warn("failed to restore session", "path", p, "error", err)
+			continue
+		}
+
+		if ss.sessions == nil {
+			ss.sessions = make(map[sessionKey]*session)
+		}
+
+		ss.sessions[sessionKey{binding.Tenant, binding.ID}] = &session{
+			id:        binding.ID,
+			model:     binding.Model,
+			tenant:    binding.Tenant,
+			key:       key,
+			messages:  saved.Messages,
+			memory:    saved.Memory,
+			createdAt: saved.CreatedAt,
+			updatedAt: saved.UpdatedAt,
+		}
+	}
+
+	ss.prune()
+}
+
+// removeSessionFiles removes the files matching pattern in the sessions
+// directory
+func removeSessionFiles(pattern string) {
+	paths, err := filepath.Glob(filepath.Join(envconfig.Sessions(), pattern))
+	if err != nil {
+		return
+	}
+
+	for _, p := range paths {
+		if err := os.Remove(p); err != nil {
+			slog.Warn("failed to remove session", "path", p, "error", err)
+		}
+	}
+}
+
+func (s *Server) ListSessionsHandler(c *gin.Context) {
+	c.JSON(http.StatusOK, api.ListSessionsResponse{Sessions: s.sessions.list(tenantFromContext(c.Request.Context()))})
+}
+
+func (s *Server) DeleteSessionHandler(c *gin.Context) {
+	var req api.DeleteSessionRequest
+	if err := bindRequest(c, &req); errors.Is(err, io.EOF) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "missing request body"})
+		return
+	} else if err != nil {
+		c.AbortWithStatusJSON(bindStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+
+	if req.SessionID == "" {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "session_id is required"})
+		return
+	}
+
+	if err := s.sessions.delete(tenantFromContext(c.Request.Context()), req.SessionID); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("session '%s' not found", req.SessionID)})
+		return
+	}
+
+	c.Status(http.StatusOK)
+}
@@ -0,0 +1,208 @@
+package server
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/ollama/ollama/api"
+)
+
+func TestSessions(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("OLLAMA_SESSIONS", dir)
+
+	var ss sessions
+	a, b := &tenant{name: "team-a"}, &tenant{name: "team-b"}
+
+	s, err := ss.get(a, "chat", "llama3.2:latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ss.add(s, api.Message{Role: "user", Content: "Hi"}, api.Message{Role: "assistant", Content: "Hello"})
+
+	if again, err := ss.get(a, "chat", "llama3.2:latest"); err != nil || again != s {
+		t.Errorf("expected the same session, got %v %v", again, err)
+	}
+
+	if _, err := ss.get(a, "chat", "mistral:latest"); err == nil {
+		t.Error("expected an error for another model")
+	}
+
+	if _, err := ss.get(a, "chat/../x", "llama3.2:latest"); err == nil {
+		t.Error("expected an error for an invalid id")
+	}
+
+	other, err := ss.get(b, "chat", "mistral:latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if history, _ := ss.history(other); other == s || len(history) > 0 {
+		t.Error("expected tenants to have their own sessions")
+	}
+
+	if list := ss.list(a); len(list) != 1 || list[0].Model != "llama3.2:latest" || list[0].Messages != 2 {
+		t.Errorf("unexpected sessions %+v", list)
+	}
+
+	p := filepath.Join(dir, s.key+".session")
+	if err := os.WriteFile(p, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ss.delete(b, "missing"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected os.ErrNotExist, got %v", err)
+	}
+
+	if err := ss.delete(a, "chat"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(p); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected the saved cache to be removed, got %v", err)
+	}
+
+	other.updatedAt = time.Now().Add(-sessionTTL - time.Minute)
+	if list := ss.list(b); len(list) > 0 {
+		t.Errorf("expected the session to expire, got %+v", list)
+	}
+}
+
+func TestRestoreSessions(t *testing.T) {
+	// the sessions directory has to be private to be restored
+	dir := filepath.Join(t.TempDir(), "sessions")
+	t.Setenv("OLLAMA_SESSIONS", dir)
+	t.Setenv("OLLAMA_SESSION_MEMORY", "1024")
+	t.Setenv("HOME", t.TempDir())
+
+	var ss sessions
+	s, err := ss.get(&tenant{name: "team-a"}, "chat", "llama3.2:latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ss.add(s, api.Message{Role: "user", Content: "I'm Ada"}, api.Message{Role: "assistant", Content: "Hi Ada"}, api.Message{Role: "user", Content: "Hi"})
+	ss.remember(s, "The user is called Ada.", 0, 2)
+
+	if err := os.WriteFile(filepath.Join(dir, s.key+".session"), nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	// and one saved by a sandboxed runner
+	if err := os.Mkdir(filepath.Join(dir, "65534"), 0o700); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, "65534", s.key+".session"), nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	var restored sessions
+	restored.restore()
+
+	r, err := restored.get(&tenant{name: "team-a"}, "chat", "llama3.2:latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	history, memory := restored.history(r)
+	if diff := cmp.Diff(history, []api.Message{{Role: "user", Content: "Hi"}}); diff != "" {
+		t.Errorf("mismatch (-got +want):\n%s", diff)
+	}
+
+	if memory != "The user is called Ada." || r.key != s.key {
+		t.Errorf("unexpected session %q %q", memory, r.key)
+	}
+
+	for _, p := range []string{filepath.Join(dir, s.key+".session"), filepath.Join(dir, "65534", s.key+".session")} {
+		if _, err := os.Stat(p); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("expected the saved cache to be removed, got %v", err)
+		}
+	}
+
+	// the tenant of a session isn't taken from its file
+	p := filepath.Join(dir, s.key+".json")
+	b, err := os.ReadFile(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if strings.Contains(string(b), "team-a") {
+		t.Errorf("expected the tenant to be kept out of the sessions directory, got %s", b)
+	}
+
+	if runtime.GOOS != "windows" {
+		if err := os.Chmod(p, 0o644); err != nil {
+			t.Fatal(err)
+		}
+
+		var shared sessions
+		shared.restore()
+		if list := shared.list(&tenant{name: "team-a"}); len(list) > 0 {
+			t.Errorf("expected sessions other users can read not to be restored, got %+v", list)
+		}
+
+		if err := os.Chmod(p, 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	t.Setenv("OLLAMA_SESSION_MEMORY", "0")
+	var forgotten sessions
+	forgotten.restore()
+	if list := forgotten.list(&tenant{name: "team-a"}); len(list) > 0 {
+		t.Errorf("expected no sessions without session memory, got %+v", list)
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, s.key+".json")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected the saved session to be removed, got %v", err)
+	}
+}
+
+func TestMaxSessions(t *testing.T) {
+	t.Setenv("OLLAMA_SESSIONS", t.TempDir())
+	t.Setenv("OLLAMA_MAX_SESSIONS", "2")
+
+	var ss sessions
+	a, b := &tenant{name: "team-a"}, &tenant{name: "team-b"}
+
+	for _, id := range []string{"first", "second"} {
+		s, err := ss.get(a, id, "llama3.2:latest")
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.updatedAt = time.Now().Add(-time.Minute)
+		if id == "first" {
+			s.updatedAt = s.updatedAt.Add(-time.Minute)
+		}
+	}
+
+	if _, err := ss.get(b, "other", "llama3.2:latest"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := ss.get(a, "third", "llama3.2:latest"); err != nil {
+		t.Fatal(err)
+	}
+
+	var ids []string
+	for _, s := range ss.list(a) {
+		ids = append(ids, s.ID)
+	}
+
+	if diff := cmp.Diff(ids, []string{"third", "second"}); diff != "" {
+		t.Errorf("mismatch (-got +want):\n%s", diff)
+	}
+
+	if list := ss.list(b); len(list) != 1 {
+		t.Errorf("expected other tenants' sessions to be kept, got %+v", list)
+	}
+}
@@ -0,0 +1,464 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/ollama/ollama/envconfig"
+	"github.com/ollama/ollama/format"
+	"github.com/ollama/ollama/types/model"
+)
+
+var tenantNameRegexp = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// tenant is a client of a server shared between several teams. It sees only
+// the models it has pulled, created or copied, and its storage and VRAM use
+// can be limited. Blobs are shared between tenants' models with the same
+// layers.
+type tenant struct {
+	// Keys are the API keys the tenant authenticates with, sent as
+	// "Authorization: Bearer <key>"
+	Keys []string `json:"keys"`
+
+	// MaxStorage and MaxVRAM, such as "200GB", limit the size of the
+	// blobs of the tenant's models and the VRAM used by its loaded models
+	MaxStorage string `json:"max_storage,omitempty"`
+	MaxVRAM    string `json:"max_vram,omitempty"`
+
+	// Upstreams are patterns of the names of upstream models the tenant
+	// can use, matched as in policies, since they aren't pulled
+	Upstreams []string `json:"upstreams,omitempty"`
+
+	name       string
+	maxStorage uint64
+	maxVRAM    uint64
+
+	models *tenantModels
+}
+
+// tenantModels are the names of a tenant's models. They're kept when the
+// server is reloaded, along with their lock, so models added or removed
+// during a reload aren't lost.
+type tenantModels struct {
+	mu    sync.Mutex
+	names map[string]struct{}
+}
+
+// tenants maps names to tenants. A nil tenants allows every client to see
+// every model.
+type tenants struct {
+	tenants map[string]*tenant
+	keys    map[string]*tenant
+}
+
+func loadTenants(path string) (*tenants, error) {
+	if path == "" {
+		return nil, nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	ts := tenants{keys: make(map[string]*tenant)}
+	d := json.NewDecoder(f)
+	d.DisallowUnknownFields()
+	if err := d.Decode(&ts.tenants); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	for name, t := range ts.tenants {
+		if err := t.init(name); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+
+		for _, key := range t.Keys {
+			if key == "" {
+				return nil, fmt.Errorf("%s: empty key for tenant %q", path, name)
+			}
+
+			h := hashKey(key)
+			if _, ok := ts.keys[h]; ok {
+				return nil, fmt.Errorf("%s: key of tenant %q is used more than once", path, name)
+			}
+
+			ts.keys[h] = t
+		}
+	}
+
+	return &ts, nil
+}
+
+// keepModels gives the tenants that are also in old the models of the old
+// ones, so their models are shared with requests still using old
+func (ts *tenants) keepModels(old *tenants) {
+	if ts == nil || old == nil {
+		return
+	}
+
+	for name, t := range ts.tenants {
+		if o, ok := old.tenants[name]; ok {
+			t.models = o.models
+		}
+	}
+}
+
+func hashKey(key string) string {
+	h := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(h[:])
+}
+
+func (t *tenant) init(name string) error {
+	if !tenantNameRegexp.MatchString(name) {
+		return fmt.Errorf("invalid tenant name %q", name)
+	}
+
+	t.name = name
+
+	var err error
+	if t.MaxStorage != "" {
+		if t.maxStorage, err = format.ParseHumanBytes(t.MaxStorage); err != nil {
+			return fmt.Errorf("tenant %q: max_storage: %w", name, err)
+		}
+	}
+
+	if t.MaxVRAM != "" {
+		if t.maxVRAM, err = format.ParseHumanBytes(t.MaxVRAM); err != nil {
+			return fmt.Errorf("tenant %q: max_vram: %w", name, err)
+		}
+	}
+
+	t.models = &tenantModels{names: make(map[string]struct{})}
+	b, err := os.ReadFile(t.path())
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	var names []string
+	if err := json.Unmarshal(b, &names); err != nil {
+		return fmt.Errorf("%s: %w", t.path(), err)
+	}
+
+	for _, n := range names {
+		t.models.names[n] = struct{}{}
+	}
+
+	return nil
+}
+
+// path is where the names of the tenant's models are kept
+func (t *tenant) path() string {
+	return filepath.Join(envconfig.Models(), "tenants", t.name+".json")
+}
+
+func tenantModelKey(n model.Name) string {
+	return strings.ToLower(n.String())
+}
+
+// owns reports whether n is one of the tenant's models. A nil tenant owns
+// every model.
+func (t *tenant) owns(n model.Name) bool {
+	if t == nil {
+		return true
+	}
+
+	t.models.mu.Lock()
+	defer t.models.mu.Unlock()
+	_, ok := t.models.names[tenantModelKey(n)]
+	return ok
+}
+
+// checkModel returns an error wrapping os.ErrNotExist if n isn't one of the
+// tenant's models, so other tenants' models look like they don't exist
+func (t *tenant) checkModel(n model.Name) error {
+	if !t.owns(n) {
+		return fmt.Errorf("model %s: %w", n.DisplayShortest(), os.ErrNotExist)
+	}
+
+	return nil
+}
+
+// checkUpstream returns an error if the tenant can't have chat requests for
+// n proxied to an upstream. Tenants can use their own models and those
+// matching their upstreams.
+func (t *tenant) checkUpstream(n model.Name) error {
+	if t.owns(n) || slices.ContainsFunc(t.Upstreams, func(pattern string) bool { return matchModel(pattern, n) }) {
+		return nil
+	}
+
+	return fmt.Errorf("model %s isn't available to tenant %s", n.DisplayShortest(), t.name)
+}
+
+// add records n as one of the tenant's models
+func (t *tenant) add(n model.Name) error {
+	if t == nil {
+		return nil
+	}
+
+	t.models.mu.Lock()
+	defer t.models.mu.Unlock()
+	if _, ok := t.models.names[tenantModelKey(n)]; ok {
+		return nil
+	}
+
+	t.models.names[tenantModelKey(n)] = struct{}{}
+	return t.save()
+}
+
+// remove removes n from the tenant's models
+func (t *tenant) remove(n model.Name) error {
+	if t == nil {
+		return nil
+	}
+
+	t.models.mu.Lock()
+	defer t.models.mu.Unlock()
+	if _, ok := t.models.names[tenantModelKey(n)]; !ok {
+		return nil
+	}
+
+	delete(t.models.names, tenantModelKey(n))
+	return t.save()
+}
+
+// The mu must already be held when calling save
+func (t *tenant) save() error {
+	names := make([]string, 0, len(t.models.names))
+	for n := range t.models.names {
+		names = append(names, n)
+	}
+	slices.Sort(names)
+
+	b, err := json.Marshal(names)
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(t.path(), append(b, '\n'))
+}
+
+// checkLayers returns an error if adding a model n with layers would take the
+// blobs of the tenant's models over its storage limit. Blobs the tenant's
+// models share are counted once.
+func (t *tenant) checkLayers(n model.Name, layers []Layer) error {
+	if t == nil || t.maxStorage == 0 {
+		return nil
+	}
+
+	t.models.mu.Lock()
+	names := make([]string, 0, len(t.models.names))
+	for name := range t.models.names {
+		names = append(names, name)
+	}
+	t.models.mu.Unlock()
+
+	sizes := make(map[string]int64)
+	for _, name := range names {
+		if name == tenantModelKey(n) {
+			// the model is being replaced
+			continue
+		}
+
+		m, err := ParseNamedManifest(model.ParseName(name))
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		for _, layer := range append(m.Layers, m.Config) {
+			sizes[layer.Digest] = layer.Size
+		}
+	}
+
+	for _, layer := range layers {
+		sizes[layer.Digest] = layer.Size
+	}
+
+	var total uint64
+	for _, size := range sizes {
+		total += uint64(size)
+	}
+
+	if total > t.maxStorage {
+		return fmt.Errorf("%w: tenant %s would use %s of storage with %s, more than %s", errPolicy, t.name, format.HumanBytes(int64(total)), n.DisplayShortest(), t.MaxStorage)
+	}
+
+	return nil
+}
+
+// checkVRAM returns an error if loading m would take the VRAM used by the
+// tenant's loaded models over its limit. The VRAM m needs is estimated from
+// the size of its files.
+func (t *tenant) checkVRAM(s *Scheduler, n model.Name, m *Model) error {
+	if t == nil || t.maxVRAM == 0 {
+		return nil
+	}
+
+	var total uint64
+	for _, p := range slices.Concat([]string{m.ModelPath}, m.AdapterPaths, m.ProjectorPaths) {
+		fi, err := os.Stat(p)
+		if err != nil {
+			return err
+		}
+
+		total += uint64(fi.Size())
+	}
+
+	s.loadedMu.Lock()
+	defer s.loadedMu.Unlock()
+
+	for _, runner := range s.loaded {
+		if runner.model == nil {
+			continue
+		}
+
+		name := model.ParseName(runner.model.Name)
+		if tenantModelKey(name) == tenantModelKey(n) {
+			// the model is already loaded
+			return nil
+		}
+
+		if t.owns(name) {
+			total += runner.estimatedVRAM
+		}
+	}
+
+	if total > t.maxVRAM {
+		return fmt.Errorf("%w: tenant %s would use %s of VRAM with %s, more than %s", errPolicy, t.name, format.HumanBytes(int64(total)), n.DisplayShortest(), t.MaxVRAM)
+	}
+
+	return nil
+}
+
+// checkCreate returns an error if the tenant can't create or copy a model
+// named n. Tenants create models in their own namespace, such as
+// "team-a/mymodel", so they can't replace other tenants' models.
+func (t *tenant) checkCreate(n model.Name) error {
+	if t == nil || strings.EqualFold(n.Namespace, t.name) {
+		return nil
+	}
+
+	return fmt.Errorf("%w: tenant %s can only create models in its namespace, such as %s/%s", errPolicy, t.name, t.name, n.Model)
+}
+
+// checkPull returns an error if t can't pull a model named n because it's in
+// the namespace of another tenant. Other models are shared by the tenants
+// that pull them.
+func (ts *tenants) checkPull(t *tenant, n model.Name) error {
+	if ts == nil || t == nil {
+		return nil
+	}
+
+	for name, other := range ts.tenants {
+		if other != t && strings.EqualFold(n.Namespace, name) {
+			return fmt.Errorf("%w: model %s is in the namespace of another tenant", errPolicy, n.DisplayShortest())
+		}
+	}
+
+	return nil
+}
+
+// shared reports whether a tenant other than t has a model named n
+func (ts *tenants) shared(t *tenant, n model.Name) bool {
+	if ts == nil {
+		return false
+	}
+
+	for _, other := range ts.tenants {
+		if other != t && other.owns(n) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// remove removes n from the models of every tenant
+func (ts *tenants) remove(n model.Name) error {
+	if ts == nil {
+		return nil
+	}
+
+	for _, t := range ts.tenants {
+		if err := t.remove(n); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// tenantDeniedEndpoints change or show the settings and activity of the whole
+// server, so tenants can't call them
+var tenantDeniedEndpoints = []string{
+	"/api/schedule",
+	"/api/schedule/switch",
+	"/api/cors",
+	"/api/log",
+	"/api/reload",
+	"/metrics",
+}
+
+type tenantKey struct{}
+
+// tenantFromContext returns the tenant making a request, or nil if it isn't
+// made by one
+func tenantFromContext(ctx context.Context) *tenant {
+	t, _ := ctx.Value(tenantKey{}).(*tenant)
+	return t
+}
+
+// tenantMiddleware authenticates requests by their API key when there are
+// tenants. Requests without a key are only allowed from this machine, and see
+// every model, except for checking that the server is running.
+func tenantMiddleware(ts *tenants) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if ts == nil {
+			c.Next()
+			return
+		}
+
+		key, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+		if !ok {
+			if isLocalRequest(c.Request) || c.FullPath() == "/" || c.FullPath() == "/api/version" {
+				c.Next()
+				return
+			}
+
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "API key required"})
+			return
+		}
+
+		t, ok := ts.keys[hashKey(key)]
+		if !ok {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "invalid API key"})
+			return
+		}
+
+		if slices.Contains(tenantDeniedEndpoints, c.FullPath()) {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": fmt.Sprintf("%s: tenant %s can't call %s", errPolicy, t.name, c.FullPath())})
+			return
+		}
+
+		c.Request = c.Request.WithContext(context.WithValue(c.Request.Context(), tenantKey{}, t))
+		c.Next()
+	}
+}
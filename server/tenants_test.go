@@ -0,0 +1,273 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/types/model"
+)
+
+func writeTenants(t *testing.T, tenants string) *tenants {
+	t.Helper()
+
+	p := filepath.Join(t.TempDir(), "tenants.json")
+	if err := os.WriteFile(p, []byte(tenants), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	ts, err := loadTenants(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return ts
+}
+
+func TestLoadTenants(t *testing.T) {
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+
+	ts := writeTenants(t, `{"team-a": {"keys": ["a1", "a2"], "max_storage": "200GB", "max_vram": "24 GiB"}, "team-b": {"keys": ["b"]}}`)
+	if ts.keys[hashKey("a2")] != ts.tenants["team-a"] || ts.keys[hashKey("b")] != ts.tenants["team-b"] {
+		t.Errorf("keys don't map to their tenants")
+	}
+
+	if a := ts.tenants["team-a"]; a.maxStorage != 200_000_000_000 || a.maxVRAM != 24<<30 {
+		t.Errorf("unexpected limits %d %d", a.maxStorage, a.maxVRAM)
+	}
+
+	for _, tenants := range []string{
+		`{"team a": {"keys": ["a"]}}`,
+		`{"team-a": {"keys": [""]}}`,
+		`{"team-a": {"keys": ["a"]}, "team-b": {"keys": ["a"]}}`,
+		`{"team-a": {"keys": ["a"], "max_storage": "lots"}}`,
+		`{"team-a": {"keys": ["a"], "quota": "1GB"}}`,
+	} {
+		p := filepath.Join(t.TempDir(), "tenants.json")
+		if err := os.WriteFile(p, []byte(tenants), 0o600); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := loadTenants(p); err == nil {
+			t.Errorf("%s: expected error", tenants)
+		}
+	}
+}
+
+func TestTenantMiddleware(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+
+	ts := writeTenants(t, `{"team-a": {"keys": ["secret"]}}`)
+
+	router := gin.New()
+	router.Use(tenantMiddleware(ts))
+	for _, path := range []string{"/", "/api/tags", "/api/log"} {
+		router.GET(path, func(c *gin.Context) {
+			if t := tenantFromContext(c.Request.Context()); t != nil {
+				c.String(http.StatusOK, t.name)
+				return
+			}
+
+			c.Status(http.StatusOK)
+		})
+	}
+
+	cases := []struct {
+		path, remote, key string
+		status            int
+		tenant            string
+	}{
+		{"/api/tags", "127.0.0.1:1234", "", http.StatusOK, ""},
+		{"/api/tags", "192.0.2.1:1234", "", http.StatusUnauthorized, ""},
+		{"/", "192.0.2.1:1234", "", http.StatusOK, ""},
+		{"/api/tags", "192.0.2.1:1234", "secret", http.StatusOK, "team-a"},
+		{"/api/tags", "127.0.0.1:1234", "secret", http.StatusOK, "team-a"},
+		{"/api/tags", "192.0.2.1:1234", "wrong", http.StatusUnauthorized, ""},
+		{"/api/log", "192.0.2.1:1234", "secret", http.StatusForbidden, ""},
+	}
+
+	for _, tt := range cases {
+		r := httptest.NewRequest(http.MethodGet, tt.path, nil)
+		r.RemoteAddr = tt.remote
+		if tt.key != "" {
+			r.Header.Set("Authorization", "Bearer "+tt.key)
+		}
+
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		if w.Code != tt.status {
+			t.Errorf("%s from %s with %q: expected status code %d, actual %d", tt.path, tt.remote, tt.key, tt.status, w.Code)
+		} else if w.Code == http.StatusOK && w.Body.String() != tt.tenant {
+			t.Errorf("%s from %s with %q: expected tenant %q, actual %q", tt.path, tt.remote, tt.key, tt.tenant, w.Body.String())
+		}
+	}
+}
+
+func TestTenantModels(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	p := t.TempDir()
+	t.Setenv("OLLAMA_MODELS", p)
+
+	tenants := `{"team-a": {"keys": ["a"]}, "team-b": {"keys": ["b"], "max_storage": "1KB"}}`
+	ts := writeTenants(t, tenants)
+	var s Server
+	s.cfg.Store(&serverConfig{tenants: ts})
+
+	as := func(name string, fn func(*gin.Context)) func(*gin.Context) {
+		return func(c *gin.Context) {
+			c.Request = c.Request.WithContext(context.WithValue(context.Background(), tenantKey{}, ts.tenants[name]))
+			fn(c)
+		}
+	}
+
+	list := func(name string) []string {
+		w := createRequest(t, as(name, s.ListHandler), nil)
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status code 200, actual %d", w.Code)
+		}
+
+		var resp api.ListResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+
+		var names []string
+		for _, m := range resp.Models {
+			names = append(names, m.Name)
+		}
+		slices.Sort(names)
+		return names
+	}
+
+	modelfile := fmt.Sprintf("FROM %s", createBinFile(t, nil, nil))
+
+	t.Run("create outside namespace", func(t *testing.T) {
+		w := createRequest(t, as("team-a", s.CreateHandler), api.CreateRequest{Name: "test", Modelfile: modelfile, Stream: &stream})
+		if w.Code != http.StatusForbidden {
+			t.Fatalf("expected status code 403, actual %d", w.Code)
+		}
+	})
+
+	t.Run("create", func(t *testing.T) {
+		w := createRequest(t, as("team-a", s.CreateHandler), api.CreateRequest{Name: "team-a/test", Modelfile: modelfile, Stream: &stream})
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status code 200, actual %d: %s", w.Code, w.Body)
+		}
+
+		if names := list("team-a"); !slices.Equal(names, []string{"team-a/test:latest"}) {
+			t.Errorf("unexpected models %v", names)
+		}
+
+		if names := list("team-b"); len(names) > 0 {
+			t.Errorf("expected no models, got %v", names)
+		}
+
+		// clients without a key see every model
+		if names := list(""); !slices.Equal(names, []string{"team-a/test:latest"}) {
+			t.Errorf("unexpected models %v", names)
+		}
+	})
+
+	t.Run("other tenant", func(t *testing.T) {
+		w := createRequest(t, as("team-b", s.ShowHandler), api.ShowRequest{Model: "team-a/test"})
+		if w.Code != http.StatusNotFound {
+			t.Errorf("show: expected status code 404, actual %d", w.Code)
+		}
+
+		w = createRequest(t, as("team-b", s.CopyHandler), api.CopyRequest{Source: "team-a/test", Destination: "team-b/test"})
+		if w.Code != http.StatusNotFound {
+			t.Errorf("copy: expected status code 404, actual %d", w.Code)
+		}
+
+		w = createRequest(t, as("team-b", s.DeleteHandler), api.DeleteRequest{Model: "team-a/test"})
+		if w.Code != http.StatusNotFound {
+			t.Errorf("delete: expected status code 404, actual %d", w.Code)
+		}
+	})
+
+	t.Run("storage limit", func(t *testing.T) {
+		w := createRequest(t, as("team-b", s.CreateHandler), api.CreateRequest{Name: "team-b/test", Modelfile: modelfile + "\nSYSTEM " + strings.Repeat("x", 1024), Stream: &stream})
+		if w.Code != http.StatusForbidden {
+			t.Fatalf("expected status code 403, actual %d", w.Code)
+		}
+
+		if names := list("team-b"); len(names) > 0 {
+			t.Errorf("expected no models, got %v", names)
+		}
+	})
+
+	t.Run("copy", func(t *testing.T) {
+		w := createRequest(t, as("team-a", s.CopyHandler), api.CopyRequest{Source: "team-a/test", Destination: "team-a/copy"})
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status code 200, actual %d", w.Code)
+		}
+
+		if names := list("team-a"); !slices.Equal(names, []string{"team-a/copy:latest", "team-a/test:latest"}) {
+			t.Errorf("unexpected models %v", names)
+		}
+	})
+
+	t.Run("kept across restarts", func(t *testing.T) {
+		reloaded := writeTenants(t, tenants)
+		if !reloaded.tenants["team-a"].owns(model.ParseName("team-a/copy")) {
+			t.Errorf("expected team-a to have team-a/copy")
+		}
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		w := createRequest(t, as("team-a", s.DeleteHandler), api.DeleteRequest{Model: "team-a/copy"})
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status code 200, actual %d", w.Code)
+		}
+
+		if names := list("team-a"); !slices.Equal(names, []string{"team-a/test:latest"}) {
+			t.Errorf("unexpected models %v", names)
+		}
+	})
+}
+
+func TestTenantShared(t *testing.T) {
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+
+	ts := writeTenants(t, `{"team-a": {"keys": ["a"]}, "team-b": {"keys": ["b"]}}`)
+	a, b := ts.tenants["team-a"], ts.tenants["team-b"]
+	n := model.ParseName("llama3.2")
+
+	if err := ts.checkPull(a, n); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ts.checkPull(a, model.ParseName("team-b/llama3.2")); err == nil {
+		t.Error("expected an error pulling into another tenant's namespace")
+	}
+
+	for _, tenant := range []*tenant{a, b} {
+		if err := tenant.add(n); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if !ts.shared(a, n) {
+		t.Error("expected llama3.2 to be shared")
+	}
+
+	if err := b.remove(n); err != nil {
+		t.Fatal(err)
+	}
+
+	if ts.shared(a, n) {
+		t.Error("expected llama3.2 not to be shared")
+	}
+}
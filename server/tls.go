@@ -0,0 +1,308 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"github.com/ollama/ollama/envconfig"
+)
+
+const (
+	caValidity   = 10 * 365 * 24 * time.Hour
+	certValidity = 365 * 24 * time.Hour
+
+	// certs are renewed when they're this close to expiring
+	certRenewal = 30 * 24 * time.Hour
+)
+
+// TLSConfig returns the TLS configuration for the server, or nil if TLS isn't
+// enabled. The certificate in OLLAMA_TLS_CERT and OLLAMA_TLS_KEY is used if
+// set, otherwise OLLAMA_TLS enables a certificate signed by a local CA which
+// is generated on first use. Clients must present a certificate signed by
+// OLLAMA_TLS_CLIENT_CA if it's set.
+func TLSConfig() (*tls.Config, error) {
+	certFile, keyFile := envconfig.TLSCert(), envconfig.TLSKey()
+	switch {
+	case certFile != "" && keyFile != "":
+	case certFile != "" || keyFile != "":
+		return nil, errors.New("OLLAMA_TLS_CERT and OLLAMA_TLS_KEY must be set together")
+	case envconfig.TLS():
+		dir, err := tlsPath()
+		if err != nil {
+			return nil, err
+		}
+
+		certFile, keyFile, err = localCert(dir, certHosts())
+		if err != nil {
+			return nil, err
+		}
+	case envconfig.TLSClientCA() != "":
+		return nil, errors.New("OLLAMA_TLS_CLIENT_CA requires OLLAMA_TLS or OLLAMA_TLS_CERT and OLLAMA_TLS_KEY")
+	default:
+		return nil, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if path := envconfig.TLSClientCA(); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("no certificates found in %s", path)
+		}
+
+		cfg.ClientCAs = pool
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return cfg, nil
+}
+
+func tlsPath() (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+
+	dir := filepath.Join(home, ".ollama", "tls")
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return "", err
+	}
+
+	return dir, nil
+}
+
+// certHosts returns the names and addresses clients may use to reach the server
+func certHosts() []string {
+	hosts := []string{"localhost", "127.0.0.1", "::1"}
+	if hostname, err := os.Hostname(); err == nil {
+		hosts = append(hosts, hostname)
+	}
+
+	if host, _, err := net.SplitHostPort(envconfig.Host().Host); err == nil && host != "" {
+		if ip := net.ParseIP(host); ip == nil || !ip.IsUnspecified() {
+			hosts = append(hosts, host)
+		}
+	}
+
+	if addrs, err := net.InterfaceAddrs(); err == nil {
+		for _, addr := range addrs {
+			if ipnet, ok := addr.(*net.IPNet); ok && !ipnet.IP.IsLinkLocalUnicast() {
+				hosts = append(hosts, ipnet.IP.String())
+			}
+		}
+	}
+
+	slices.Sort(hosts)
+	return slices.Compact(hosts)
+}
+
+// localCert returns the paths of a certificate and key for hosts signed by
+// the local CA in dir, creating the CA and issuing a new certificate when
+// needed
+func localCert(dir string, hosts []string) (certFile, keyFile string, err error) {
+	ca, caKey, err := loadOrCreateCA(dir, hosts)
+	if err != nil {
+		return "", "", err
+	}
+
+	certFile, keyFile = filepath.Join(dir, "server.crt"), filepath.Join(dir, "server.key")
+	if cert, err := readCert(certFile); err == nil && cert.CheckSignatureFrom(ca) == nil && coversHosts(cert, hosts) && time.Until(cert.NotAfter) > certRenewal {
+		return certFile, keyFile, nil
+	}
+
+	slog.Info("issuing TLS certificate", "hosts", hosts, "ca", filepath.Join(dir, "ca.crt"))
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return "", "", err
+	}
+
+	template, err := certTemplate("ollama")
+	if err != nil {
+		return "", "", err
+	}
+
+	template.NotAfter = template.NotBefore.Add(certValidity)
+	template.KeyUsage = x509.KeyUsageDigitalSignature
+	template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, ca, &key.PublicKey, caKey)
+	if err != nil {
+		return "", "", err
+	}
+
+	if err := writeKeyPair(certFile, keyFile, der, key); err != nil {
+		return "", "", err
+	}
+
+	return certFile, keyFile, nil
+}
+
+// loadOrCreateCA returns the local CA in dir, creating a new one if it doesn't
+// exist, has expired or can't sign certificates for hosts. The CA is name
+// constrained to hosts so trusting it doesn't trust its key for any other
+// name.
+func loadOrCreateCA(dir string, hosts []string) (*x509.Certificate, *ecdsa.PrivateKey, error) {
+	certFile, keyFile := filepath.Join(dir, "ca.crt"), filepath.Join(dir, "ca.key")
+	if pair, err := tls.LoadX509KeyPair(certFile, keyFile); err == nil {
+		if key, ok := pair.PrivateKey.(*ecdsa.PrivateKey); ok {
+			if ca, err := x509.ParseCertificate(pair.Certificate[0]); err == nil && time.Now().Before(ca.NotAfter) && permitsHosts(ca, hosts) {
+				return ca, key, nil
+			}
+		}
+	}
+
+	slog.Info("creating local certificate authority", "path", certFile)
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	hostname, _ := os.Hostname()
+	template, err := certTemplate(fmt.Sprintf("Ollama local CA (%s)", hostname))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	template.NotAfter = template.NotBefore.Add(caValidity)
+	template.IsCA = true
+	template.BasicConstraintsValid = true
+	template.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageCRLSign
+	template.PermittedDNSDomainsCritical = true
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip == nil {
+			template.PermittedDNSDomains = append(template.PermittedDNSDomains, host)
+		} else if ip4 := ip.To4(); ip4 != nil {
+			template.PermittedIPRanges = append(template.PermittedIPRanges, &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)})
+		} else {
+			template.PermittedIPRanges = append(template.PermittedIPRanges, &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)})
+		}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if err := writeKeyPair(certFile, keyFile, der, key); err != nil {
+		return nil, nil, err
+	}
+
+	ca, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return ca, key, nil
+}
+
+func certTemplate(commonName string) (*x509.Certificate, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+
+	return &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+	}, nil
+}
+
+// permitsHosts reports whether the name constraints of ca permit exactly the
+// names and addresses in hosts, so a CA is replaced when the hosts change
+func permitsHosts(ca *x509.Certificate, hosts []string) bool {
+	if !ca.PermittedDNSDomainsCritical {
+		return false
+	}
+
+	var domains, ips []string
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			ips = append(ips, ip.String())
+		} else {
+			domains = append(domains, host)
+		}
+	}
+
+	permitted := make([]string, len(ca.PermittedIPRanges))
+	for i, r := range ca.PermittedIPRanges {
+		if ones, bits := r.Mask.Size(); ones != bits {
+			return false
+		}
+
+		permitted[i] = r.IP.String()
+	}
+
+	return slices.Equal(ca.PermittedDNSDomains, domains) && slices.Equal(permitted, ips)
+}
+
+func coversHosts(cert *x509.Certificate, hosts []string) bool {
+	for _, host := range hosts {
+		if cert.VerifyHostname(host) != nil {
+			return false
+		}
+	}
+
+	return true
+}
+
+func readCert(path string) (*x509.Certificate, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, fmt.Errorf("%s: no certificate found", path)
+	}
+
+	return x509.ParseCertificate(block.Bytes)
+}
+
+func writeKeyPair(certFile, keyFile string, der []byte, key *ecdsa.PrivateKey) error {
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		return err
+	}
+
+	return os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o644)
+}
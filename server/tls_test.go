@@ -0,0 +1,178 @@
+package server
+
+import (
+	"crypto/rand"
+	"crypto/x509"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"testing"
+)
+
+func TestTLSConfig(t *testing.T) {
+	t.Run("disabled", func(t *testing.T) {
+		t.Setenv("OLLAMA_TLS", "")
+		t.Setenv("OLLAMA_TLS_CERT", "")
+		t.Setenv("OLLAMA_TLS_KEY", "")
+
+		cfg, err := TLSConfig()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if cfg != nil {
+			t.Error("expected no TLS configuration")
+		}
+	})
+
+	t.Run("cert without key", func(t *testing.T) {
+		t.Setenv("OLLAMA_TLS_CERT", "server.crt")
+		t.Setenv("OLLAMA_TLS_KEY", "")
+
+		if _, err := TLSConfig(); err == nil {
+			t.Error("expected error")
+		}
+	})
+
+	t.Run("auto", func(t *testing.T) {
+		home := t.TempDir()
+		t.Setenv("HOME", home)
+		t.Setenv("USERPROFILE", home)
+		t.Setenv("OLLAMA_TLS", "1")
+		t.Setenv("OLLAMA_TLS_CERT", "")
+		t.Setenv("OLLAMA_TLS_KEY", "")
+
+		cfg, err := TLSConfig()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if cfg == nil || len(cfg.Certificates) != 1 {
+			t.Fatal("expected a certificate")
+		}
+
+		dir := filepath.Join(home, ".ollama", "tls")
+		ca, err := readCert(filepath.Join(dir, "ca.crt"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		roots := x509.NewCertPool()
+		roots.AddCert(ca)
+
+		cert, err := x509.ParseCertificate(cfg.Certificates[0].Certificate[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, host := range []string{"localhost", "127.0.0.1"} {
+			if _, err := cert.Verify(x509.VerifyOptions{DNSName: host, Roots: roots}); err != nil {
+				t.Errorf("%s: %v", host, err)
+			}
+		}
+
+		if fi, err := os.Stat(filepath.Join(dir, "ca.key")); err != nil {
+			t.Fatal(err)
+		} else if mode := fi.Mode().Perm(); mode != 0o600 && runtime.GOOS != "windows" {
+			t.Errorf("expected CA key mode 0600, got %o", mode)
+		}
+
+		// the CA and certificate are reused
+		if _, err := TLSConfig(); err != nil {
+			t.Fatal(err)
+		}
+
+		again, err := readCert(filepath.Join(dir, "server.crt"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !again.Equal(cert) {
+			t.Error("expected certificate to be reused")
+		}
+	})
+
+	t.Run("name constraints", func(t *testing.T) {
+		dir := t.TempDir()
+		if _, _, err := localCert(dir, []string{"example.com", "10.0.0.1"}); err != nil {
+			t.Fatal(err)
+		}
+
+		ca, key, err := loadOrCreateCA(dir, []string{"example.com", "10.0.0.1"})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		roots := x509.NewCertPool()
+		roots.AddCert(ca)
+
+		// the CA's key can't be used for other names
+		for _, host := range []string{"example.com", "10.0.0.1", "bank.example", "10.0.0.2"} {
+			template, err := certTemplate("ollama")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			template.NotAfter = template.NotBefore.Add(certValidity)
+			template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+			if ip := net.ParseIP(host); ip != nil {
+				template.IPAddresses = []net.IP{ip}
+			} else {
+				template.DNSNames = []string{host}
+			}
+
+			der, err := x509.CreateCertificate(rand.Reader, template, ca, &key.PublicKey, key)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			cert, err := x509.ParseCertificate(der)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			_, err = cert.Verify(x509.VerifyOptions{DNSName: host, Roots: roots})
+			if permitted := host == "example.com" || host == "10.0.0.1"; permitted != (err == nil) {
+				t.Errorf("%s: expected permitted %v, got %v", host, permitted, err)
+			}
+		}
+
+		// a new CA is created when the hosts change
+		again, _, err := loadOrCreateCA(dir, []string{"example.org"})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if again.Equal(ca) || !slices.Equal(again.PermittedDNSDomains, []string{"example.org"}) {
+			t.Errorf("expected a new CA for example.org, got %v", again.PermittedDNSDomains)
+		}
+	})
+
+	t.Run("provided", func(t *testing.T) {
+		dir := t.TempDir()
+		certFile, keyFile, err := localCert(dir, []string{"example.com"})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		t.Setenv("OLLAMA_TLS", "")
+		t.Setenv("OLLAMA_TLS_CERT", certFile)
+		t.Setenv("OLLAMA_TLS_KEY", keyFile)
+
+		cfg, err := TLSConfig()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		cert, err := x509.ParseCertificate(cfg.Certificates[0].Certificate[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := cert.VerifyHostname("example.com"); err != nil {
+			t.Error(err)
+		}
+	})
+}
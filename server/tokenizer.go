@@ -0,0 +1,201 @@
+package server
+
+import (
+	"archive/zip"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/ollama/ollama/convert"
+	"github.com/ollama/ollama/llm"
+)
+
+var errBadTokenizer = errors.New("invalid tokenizer")
+
+// tokenizerKeys are the keys that define a model's vocabulary. They're
+// removed from a model before its tokenizer is replaced, so keys the new
+// tokenizer doesn't set, such as merges, aren't left over from the old one.
+var tokenizerKeys = []string{
+	"tokenizer.ggml.model",
+	"tokenizer.ggml.pre",
+	"tokenizer.ggml.tokens",
+	"tokenizer.ggml.scores",
+	"tokenizer.ggml.token_type",
+	"tokenizer.ggml.merges",
+}
+
+// fileFS is a file system holding only the file f, as name
+type fileFS struct {
+	name string
+	f    *os.File
+}
+
+func (fsys fileFS) Open(name string) (fs.File, error) {
+	if name != fsys.name {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+
+	return os.Open(fsys.f.Name())
+}
+
+// tokenizerFS returns the tokenizer files in f, which is either a zip of a
+// tokenizer directory or a single tokenizer.json or tokenizer.model
+func tokenizerFS(f *os.File) (fs.FS, error) {
+	contentType, err := detectContentType(io.NewSectionReader(f, 0, 512))
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case contentType == "application/zip":
+		fi, err := f.Stat()
+		if err != nil {
+			return nil, err
+		}
+
+		return zip.NewReader(f, fi.Size())
+	case strings.HasPrefix(contentType, "text/plain"):
+		return fileFS{name: "tokenizer.json", f: f}, nil
+	default:
+		// sentencepiece models are protobufs, which have no signature
+		return fileFS{name: "tokenizer.model", f: f}, nil
+	}
+}
+
+// embeddingSize returns the number of rows in the model's token embeddings,
+// or its output layer if the embeddings aren't stored
+func embeddingSize(ggml *llm.GGML) (int, error) {
+	for _, name := range []string{"token_embd.weight", "output.weight"} {
+		for _, t := range ggml.Tensors().Items {
+			if t.Name == name && len(t.Shape) == 2 {
+				return int(t.Shape[1]), nil
+			}
+		}
+	}
+
+	return 0, errors.New("model has no token embeddings")
+}
+
+// sectionTensor writes the data of a tensor read from a GGUF file
+type sectionTensor struct {
+	*io.SectionReader
+}
+
+func (t sectionTensor) WriteTo(w io.Writer) (int64, error) {
+	return io.Copy(w, t.SectionReader)
+}
+
+// tokenizerLayer writes a copy of the model in the layer base with the
+// tokenizer in f in place of its own. The tokenizer must have a token for
+// each row of the model's embeddings.
+func tokenizerLayer(f *os.File, base Layer) (Layer, *llm.GGML, error) {
+	fsys, err := tokenizerFS(f)
+	if err != nil {
+		return Layer{}, nil, fmt.Errorf("%w: %s", errBadTokenizer, err)
+	}
+
+	kv, err := convert.ConvertTokenizer(fsys)
+	if err != nil {
+		return Layer{}, nil, fmt.Errorf("%w: %s", errBadTokenizer, err)
+	}
+
+	blobpath, err := GetBlobsPath(base.Digest)
+	if err != nil {
+		return Layer{}, nil, err
+	}
+
+	blob, err := os.Open(blobpath)
+	if err != nil {
+		return Layer{}, nil, err
+	}
+	defer blob.Close()
+
+	// the tokenizer replaces whole arrays so they all have to be read
+	ggml, _, err := llm.DecodeGGML(blob, -1)
+	if err != nil {
+		return Layer{}, nil, err
+	}
+
+	if ggml.Name() != "gguf" {
+		return Layer{}, nil, fmt.Errorf("%w: only gguf models can have their tokenizer replaced", errBadTokenizer)
+	}
+
+	n, err := embeddingSize(ggml)
+	if err != nil {
+		return Layer{}, nil, err
+	}
+
+	tokens, _ := kv["tokenizer.ggml.tokens"].([]string)
+	if len(tokens) != n {
+		return Layer{}, nil, fmt.Errorf("%w: tokenizer has %d tokens but the model's embeddings have %d", errBadTokenizer, len(tokens), n)
+	}
+
+	merged := maps.Clone(ggml.KV())
+	maps.DeleteFunc(merged, func(k string, _ any) bool {
+		// parameter_count is added when decoding, and tensors are rewritten
+		// with the default alignment
+		return slices.Contains(tokenizerKeys, k) || k == "general.parameter_count" || k == "general.alignment"
+	})
+	maps.Copy(merged, kv)
+
+	// special tokens the new tokenizer doesn't set are kept from the model,
+	// so they have to fit its vocabulary too
+	for k, v := range merged {
+		if id, ok := v.(uint32); ok && strings.HasSuffix(k, "_token_id") && int(id) >= n {
+			return Layer{}, nil, fmt.Errorf("%w: %s %d is out of range for %d tokens", errBadTokenizer, k, id, n)
+		}
+	}
+
+	offset := ggml.Tensors().Offset
+	var ts []llm.Tensor
+	for _, t := range ggml.Tensors().Items {
+		// WriteGGUF takes shapes with the outermost dimension first, the
+		// reverse of how they're stored
+		shape := slices.Clone(t.Shape)
+		slices.Reverse(shape)
+
+		ts = append(ts, llm.Tensor{
+			Name:     t.Name,
+			Kind:     t.Kind,
+			Shape:    shape,
+			WriterTo: sectionTensor{io.NewSectionReader(blob, int64(offset+t.Offset), int64(t.Size()))},
+		})
+	}
+
+	temp, err := os.CreateTemp(filepath.Dir(blobpath), "tokenizer")
+	if err != nil {
+		return Layer{}, nil, err
+	}
+	defer temp.Close()
+	defer os.Remove(temp.Name())
+
+	if err := llm.WriteGGUF(temp, merged, ts); err != nil {
+		return Layer{}, nil, err
+	}
+
+	if _, err := temp.Seek(0, io.SeekStart); err != nil {
+		return Layer{}, nil, err
+	}
+
+	layer, err := NewLayer(temp, base.MediaType)
+	if err != nil {
+		return Layer{}, nil, err
+	}
+
+	if _, err := temp.Seek(0, io.SeekStart); err != nil {
+		return Layer{}, nil, err
+	}
+
+	ggml, _, err = llm.DecodeGGML(temp, 0)
+	if err != nil {
+		return Layer{}, nil, err
+	}
+
+	return layer, ggml, nil
+}
@@ -0,0 +1,130 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/llm"
+)
+
+func TestCreateTokenizer(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+
+	var s Server
+
+	// a model with 4 tokens of embedding length 2
+	bin := createBinFile(t, llm.KV{
+		"general.architecture":        "llama",
+		"tokenizer.ggml.model":        "gpt2",
+		"tokenizer.ggml.tokens":       []string{"w", "x", "y", "z"},
+		"tokenizer.ggml.token_type":   []int32{1, 1, 1, 1},
+		"tokenizer.ggml.merges":       []string{"w x"},
+		"tokenizer.ggml.eos_token_id": uint32(3),
+	}, []llm.Tensor{
+		// output_norm.weight isn't a multiple of the alignment, so the
+		// tensors after it are padded
+		{Name: "output_norm.weight", Shape: []uint64{3}, WriterTo: bytes.NewReader(make([]byte, 4*3))},
+		{Name: "token_embd.weight", Shape: []uint64{4, 2}, WriterTo: bytes.NewReader(make([]byte, 4*8))},
+	})
+
+	tokenizer := func(t *testing.T, vocab ...string) string {
+		t.Helper()
+
+		var sb strings.Builder
+		for i, token := range vocab {
+			if i > 0 {
+				sb.WriteString(",")
+			}
+			fmt.Fprintf(&sb, "%q:%d", token, i)
+		}
+
+		path := filepath.Join(t.TempDir(), "tokenizer.json")
+		if err := os.WriteFile(path, []byte(fmt.Sprintf(`{"model":{"type":"BPE","vocab":{%s}}}`, sb.String())), 0o644); err != nil {
+			t.Fatal(err)
+		}
+
+		return path
+	}
+
+	t.Run("replace", func(t *testing.T) {
+		w := createRequest(t, s.CreateHandler, api.CreateRequest{
+			Name:      "test",
+			Modelfile: fmt.Sprintf("FROM %s\nTOKENIZER %s", bin, tokenizer(t, "a", "b", "c", "d")),
+			Stream:    &stream,
+		})
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status code 200, actual %d: %s", w.Code, w.Body.String())
+		}
+
+		m, err := GetModel("test")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		f, err := os.Open(m.ModelPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+
+		ggml, _, err := llm.DecodeGGML(f, -1)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		kv := ggml.KV()
+		if diff := cmp.Diff(kv.Strings("tokenizer.ggml.tokens"), []string{"a", "b", "c", "d"}); diff != "" {
+			t.Errorf("mismatch (-got +want):\n%s", diff)
+		}
+
+		if _, ok := kv["tokenizer.ggml.merges"]; ok {
+			t.Error("expected merges of the old tokenizer to be removed")
+		}
+
+		if id, _ := kv["tokenizer.ggml.eos_token_id"].(uint32); id != 3 {
+			t.Errorf("expected eos token 3 to be kept, got %d", id)
+		}
+
+		var shapes [][]uint64
+		var offsets []uint64
+		for _, t := range ggml.Tensors().Items {
+			shapes = append(shapes, t.Shape)
+			offsets = append(offsets, t.Offset)
+		}
+
+		if diff := cmp.Diff(shapes, [][]uint64{{3}, {2, 4}}); diff != "" {
+			t.Errorf("mismatch (-got +want):\n%s", diff)
+		}
+
+		if diff := cmp.Diff(offsets, []uint64{0, 32}); diff != "" {
+			t.Errorf("mismatch (-got +want):\n%s", diff)
+		}
+	})
+
+	t.Run("vocab size", func(t *testing.T) {
+		w := createRequest(t, s.CreateHandler, api.CreateRequest{
+			Name:      "test2",
+			Modelfile: fmt.Sprintf("FROM %s\nTOKENIZER %s", bin, tokenizer(t, "a", "b", "c")),
+			Stream:    &stream,
+		})
+
+		if w.Code == http.StatusOK {
+			t.Fatal("expected an error")
+		}
+
+		if !strings.Contains(w.Body.String(), "tokenizer has 3 tokens but the model's embeddings have 4") {
+			t.Errorf("expected vocab size error, got %s", w.Body.String())
+		}
+	})
+}
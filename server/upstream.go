@@ -0,0 +1,447 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/openai"
+	"github.com/ollama/ollama/types/model"
+)
+
+// upstream is an OpenAI compatible API that chat requests for some models
+// are proxied to, such as a hosted provider or a larger server
+type upstream struct {
+	// Models are patterns of the names of the models proxied to the
+	// upstream, matched as in policies
+	Models []string `json:"models"`
+
+	// URL is the base URL of the API, such as "https://api.openai.com/v1"
+	URL string `json:"url"`
+
+	// APIKeyEnv names the environment variable holding the upstream's API
+	// key, so it isn't kept in the file
+	APIKeyEnv string `json:"api_key_env,omitempty"`
+
+	// Model is the name of the model at the upstream. It defaults to the
+	// requested name without its namespace, so "openai/gpt-4o" is gpt-4o.
+	Model string `json:"model,omitempty"`
+
+	// Overflow proxies requests only when the server is too busy to
+	// schedule them, rather than always
+	Overflow bool `json:"overflow,omitempty"`
+}
+
+type upstreams []*upstream
+
+func loadUpstreams(path string) (upstreams, error) {
+	if path == "" {
+		return nil, nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var us upstreams
+	d := json.NewDecoder(f)
+	d.DisallowUnknownFields()
+	if err := d.Decode(&us); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	for i, u := range us {
+		if u.URL == "" {
+			return nil, fmt.Errorf("%s: upstream %d: url is required", path, i)
+		}
+
+		if len(u.Models) == 0 {
+			return nil, fmt.Errorf("%s: upstream %d: models are required", path, i)
+		}
+	}
+
+	return us, nil
+}
+
+// match returns the first upstream for the model n, or nil if there isn't
+// one. With overflow, it matches the upstreams for busy servers instead.
+func (us upstreams) match(n model.Name, overflow bool) *upstream {
+	for _, u := range us {
+		if u.Overflow == overflow && slices.ContainsFunc(u.Models, func(pattern string) bool { return matchModel(pattern, n) }) {
+			return u
+		}
+	}
+
+	return nil
+}
+
+// model returns the name of the model n at the upstream
+func (u *upstream) model(n model.Name) string {
+	if u.Model != "" {
+		return u.Model
+	}
+
+	if n.Tag == "" || n.Tag == "latest" {
+		return n.Model
+	}
+
+	return n.Model + ":" + n.Tag
+}
+
+// upstreamMessage is a message of an OpenAI chat completion request. Unlike
+// openai.Message, it links tool results to the calls they answer.
+type upstreamMessage struct {
+	Role       string            `json:"role"`
+	Content    any               `json:"content"`
+	ToolCalls  []openai.ToolCall `json:"tool_calls,omitempty"`
+	ToolCallID string            `json:"tool_call_id,omitempty"`
+}
+
+// upstreamRequest is an OpenAI chat completion request, leaving out the
+// options the client didn't set so the upstream's defaults apply
+type upstreamRequest struct {
+	Model            string                 `json:"model"`
+	Messages         []upstreamMessage      `json:"messages"`
+	Stream           bool                   `json:"stream"`
+	StreamOptions    *openai.StreamOptions  `json:"stream_options,omitempty"`
+	MaxTokens        *int                   `json:"max_tokens,omitempty"`
+	Seed             *int                   `json:"seed,omitempty"`
+	Stop             []string               `json:"stop,omitempty"`
+	Temperature      *float32               `json:"temperature,omitempty"`
+	TopP             *float32               `json:"top_p,omitempty"`
+	FrequencyPenalty *float32               `json:"frequency_penalty,omitempty"`
+	PresencePenalty  *float32               `json:"presence_penalty,omitempty"`
+	ResponseFormat   *openai.ResponseFormat `json:"response_format,omitempty"`
+	Tools            []api.Tool             `json:"tools,omitempty"`
+}
+
+func toUpstreamRequest(name string, req api.ChatRequest) (*upstreamRequest, error) {
+	r := upstreamRequest{
+		Model:         name,
+		Stream:        true,
+		StreamOptions: &openai.StreamOptions{IncludeUsage: true},
+		Tools:         req.Tools,
+	}
+
+	// tool results answer the calls of the last assistant message in order
+	var ids []string
+	for i, msg := range req.Messages {
+		m := upstreamMessage{Role: msg.Role, Content: msg.Content}
+		if len(msg.Images) > 0 {
+			parts := []map[string]any{{"type": "text", "text": msg.Content}}
+			for _, image := range msg.Images {
+				url := fmt.Sprintf("data:%s;base64,%s", http.DetectContentType(image), base64.StdEncoding.EncodeToString(image))
+				parts = append(parts, map[string]any{"type": "image_url", "image_url": map[string]any{"url": url}})
+			}
+			m.Content = parts
+		}
+
+		if len(msg.ToolCalls) > 0 {
+			ids = ids[:0]
+			for j, tc := range msg.ToolCalls {
+				args, err := json.Marshal(tc.Function.Arguments)
+				if err != nil {
+					return nil, err
+				}
+
+				var call openai.ToolCall
+				call.ID = fmt.Sprintf("call_%d_%d", i, j)
+				call.Index = j
+				call.Type = "function"
+				call.Function.Name = tc.Function.Name
+				call.Function.Arguments = string(args)
+				m.ToolCalls = append(m.ToolCalls, call)
+				ids = append(ids, call.ID)
+			}
+		}
+
+		if msg.Role == "tool" && len(ids) > 0 {
+			m.ToolCallID, ids = ids[0], ids[1:]
+		}
+
+		r.Messages = append(r.Messages, m)
+	}
+
+	var opts api.Options
+	if err := opts.FromMap(req.Options); err != nil {
+		return nil, fmt.Errorf("%w: %w", errBadOption, err)
+	}
+
+	for key := range req.Options {
+		switch key {
+		case "num_predict":
+			if opts.NumPredict >= 0 {
+				r.MaxTokens = &opts.NumPredict
+			}
+		case "seed":
+			if opts.Seed >= 0 {
+				r.Seed = &opts.Seed
+			}
+		case "stop":
+			r.Stop = opts.Stop
+		case "temperature":
+			r.Temperature = &opts.Temperature
+		case "top_p":
+			r.TopP = &opts.TopP
+		case "frequency_penalty":
+			r.FrequencyPenalty = &opts.FrequencyPenalty
+		case "presence_penalty":
+			r.PresencePenalty = &opts.PresencePenalty
+		case "ban", "ban_token", "grammar", "logit_bias":
+			// hosted providers can't enforce them while sampling, and their
+			// token ids aren't the upstream's
+			return nil, fmt.Errorf("%w: %s can't be used with upstream models", errBadOption, key)
+		}
+	}
+
+	var format any
+	if len(req.Format) > 0 {
+		if err := json.Unmarshal(req.Format, &format); err != nil {
+			return nil, fmt.Errorf("%w: invalid format: %w", errBadOption, err)
+		}
+	}
+
+	switch format := format.(type) {
+	case nil:
+	case string:
+		if format != "json" {
+			return nil, fmt.Errorf("%w: invalid format %q", errBadOption, format)
+		}
+
+		r.ResponseFormat = &openai.ResponseFormat{Type: "json_object"}
+	default:
+		r.ResponseFormat = &openai.ResponseFormat{Type: "json_schema", JsonSchema: &openai.JsonSchema{Schema: req.Format}}
+	}
+
+	return &r, nil
+}
+
+// chat sends req to the upstream, calling fn with each chunk of the response
+// as it arrives. The last chunk is done and has the upstream's token counts.
+func (u *upstream) chat(ctx context.Context, n model.Name, req api.ChatRequest, fn func(api.ChatResponse)) error {
+	r, err := toUpstreamRequest(u.model(n), req)
+	if err != nil {
+		return err
+	}
+
+	body, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+
+	hr, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimSuffix(u.URL, "/")+"/chat/completions", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	hr.Header.Set("Content-Type", "application/json")
+	hr.Header.Set("Accept", "text/event-stream")
+	if u.APIKeyEnv != "" {
+		hr.Header.Set("Authorization", "Bearer "+os.Getenv(u.APIKeyEnv))
+	}
+
+	resp, err := http.DefaultClient.Do(hr)
+	if err != nil {
+		return fmt.Errorf("upstream %s: %w", u.URL, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		b, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+		var e openai.ErrorResponse
+		if err := json.Unmarshal(b, &e); err == nil && e.Error.Message != "" {
+			return fmt.Errorf("upstream %s: %s", u.URL, e.Error.Message)
+		}
+
+		return fmt.Errorf("upstream %s: %s", u.URL, resp.Status)
+	}
+
+	// tool calls are streamed in pieces, so they're sent on the last chunk
+	type toolCall struct {
+		name string
+		args strings.Builder
+	}
+
+	var calls []*toolCall
+	var usage openai.Usage
+	var doneReason string
+
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 0, 64<<10), 16<<20)
+	for scanner.Scan() {
+		data, ok := strings.CutPrefix(scanner.Text(), "data:")
+		if !ok {
+			continue
+		}
+
+		data = strings.TrimSpace(data)
+		if data == "[DONE]" {
+			break
+		}
+
+		var chunk openai.ChatCompletionChunk
+		if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+			return fmt.Errorf("upstream %s: %w", u.URL, err)
+		}
+
+		if chunk.Usage != nil {
+			usage = *chunk.Usage
+		}
+
+		for _, choice := range chunk.Choices {
+			for _, tc := range choice.Delta.ToolCalls {
+				// calls are streamed in order, so a new one is the next
+				if tc.Index < 0 || tc.Index > len(calls) {
+					return fmt.Errorf("upstream %s: invalid tool call index %d", u.URL, tc.Index)
+				}
+
+				for len(calls) <= tc.Index {
+					calls = append(calls, &toolCall{})
+				}
+
+				if tc.Function.Name != "" {
+					calls[tc.Index].name = tc.Function.Name
+				}
+				calls[tc.Index].args.WriteString(tc.Function.Arguments)
+			}
+
+			if choice.FinishReason != nil {
+				doneReason = *choice.FinishReason
+			}
+
+			content, _ := choice.Delta.Content.(string)
+			if content != "" || choice.Delta.Reasoning != "" {
+				fn(api.ChatResponse{
+					Model:     req.Model,
+					CreatedAt: time.Now().UTC(),
+					Message:   api.Message{Role: "assistant", Content: content, Thinking: choice.Delta.Reasoning},
+				})
+			}
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("upstream %s: %w", u.URL, err)
+	}
+
+	res := api.ChatResponse{
+		Model:      req.Model,
+		CreatedAt:  time.Now().UTC(),
+		Message:    api.Message{Role: "assistant"},
+		Done:       true,
+		DoneReason: doneReason,
+		Metrics: api.Metrics{
+			PromptEvalCount: usage.PromptTokens,
+			EvalCount:       usage.CompletionTokens,
+		},
+	}
+
+	if usage.PromptTokensDetails != nil {
+		res.PromptCachedCount = usage.PromptTokensDetails.CachedTokens
+	}
+
+	if doneReason == "tool_calls" {
+		res.DoneReason = "stop"
+	}
+
+	for i, call := range calls {
+		var args api.ToolCallFunctionArguments
+		if call.args.Len() > 0 {
+			if err := json.Unmarshal([]byte(call.args.String()), &args); err != nil {
+				return fmt.Errorf("upstream %s: tool call arguments: %w", u.URL, err)
+			}
+		}
+
+		res.Message.ToolCalls = append(res.Message.ToolCalls, api.ToolCall{Function: api.ToolCallFunction{Index: i, Name: call.name, Arguments: args}})
+	}
+
+	fn(res)
+	return nil
+}
+
+// proxyChat answers a chat request for the model n from the upstream u,
+// streaming its response unless the request turns streaming off. Its usage
+// is recorded with that of local models.
+func (s *Server) proxyChat(c *gin.Context, u *upstream, n model.Name, req api.ChatRequest) {
+	checkpointStart := time.Now()
+
+	if err := s.config().policy.checkModel(n); err != nil {
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := tenantFromContext(c.Request.Context()).checkUpstream(n); err != nil {
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+		return
+	}
+
+	if len(req.Messages) == 0 {
+		c.JSON(http.StatusOK, api.ChatResponse{
+			Model:      req.Model,
+			CreatedAt:  time.Now().UTC(),
+			Message:    api.Message{Role: "assistant"},
+			Done:       true,
+			DoneReason: "load",
+			Metadata:   req.Metadata,
+		})
+		return
+	}
+
+	if _, err := toUpstreamRequest(u.model(n), req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	ch := make(chan any)
+	go func() {
+		defer close(ch)
+		if err := u.chat(c.Request.Context(), n, req, func(res api.ChatResponse) {
+			if res.Done {
+				res.TotalDuration = time.Since(checkpointStart)
+				res.Metadata = req.Metadata
+				usage.record(ParseModelPath(n.String()).GetShortTagname(), req.Metadata, res.Metrics)
+			}
+
+			ch <- res
+		}); err != nil {
+			ch <- gin.H{"error": err.Error()}
+		}
+	}()
+
+	if req.Stream != nil && !*req.Stream {
+		var resp api.ChatResponse
+		var sb, thinking strings.Builder
+		for rr := range ch {
+			switch t := rr.(type) {
+			case api.ChatResponse:
+				sb.WriteString(t.Message.Content)
+				thinking.WriteString(t.Message.Thinking)
+				resp = t
+			case gin.H:
+				c.JSON(http.StatusBadGateway, t)
+				return
+			}
+		}
+
+		resp.Message.Content = sb.String()
+		resp.Message.Thinking = thinking.String()
+		c.JSON(http.StatusOK, resp)
+		return
+	}
+
+	streamResponse(c, ch)
+}
@@ -0,0 +1,263 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/types/model"
+)
+
+func TestLoadUpstreams(t *testing.T) {
+	for _, upstreams := range []string{
+		`[{"models": ["openai/*"]}]`,
+		`[{"url": "http://localhost/v1"}]`,
+		`[{"models": ["openai/*"], "url": "http://localhost/v1", "key": "secret"}]`,
+	} {
+		p := filepath.Join(t.TempDir(), "upstreams.json")
+		if err := os.WriteFile(p, []byte(upstreams), 0o600); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := loadUpstreams(p); err == nil {
+			t.Errorf("%s: expected error", upstreams)
+		}
+	}
+}
+
+func TestUpstreamsMatch(t *testing.T) {
+	us := upstreams{
+		{Models: []string{"openai/*"}, URL: "http://openai"},
+		{Models: []string{"llama3.2"}, URL: "http://busy", Overflow: true},
+	}
+
+	cases := []struct {
+		name     string
+		overflow bool
+		url      string
+	}{
+		{"openai/gpt-4o", false, "http://openai"},
+		{"openai/gpt-4o", true, ""},
+		{"llama3.2", false, ""},
+		{"llama3.2:1b", true, "http://busy"},
+		{"mistral", true, ""},
+	}
+
+	for _, tt := range cases {
+		var url string
+		if u := us.match(model.ParseName(tt.name), tt.overflow); u != nil {
+			url = u.URL
+		}
+
+		if url != tt.url {
+			t.Errorf("%s overflow %t: expected %q, actual %q", tt.name, tt.overflow, tt.url, url)
+		}
+	}
+
+	if name := us[0].model(model.ParseName("openai/gpt-4o")); name != "gpt-4o" {
+		t.Errorf("expected gpt-4o, actual %s", name)
+	}
+}
+
+func TestToUpstreamRequest(t *testing.T) {
+	req := api.ChatRequest{
+		Model: "openai/gpt-4o",
+		Messages: []api.Message{
+			{Role: "user", Content: "weather?"},
+			{Role: "assistant", ToolCalls: []api.ToolCall{{Function: api.ToolCallFunction{Name: "weather", Arguments: api.ToolCallFunctionArguments{"city": "Paris"}}}}},
+			{Role: "tool", Content: "sunny"},
+		},
+		Format:  json.RawMessage(`"json"`),
+		Options: map[string]any{"temperature": 0.5, "num_predict": 10.0, "seed": -1.0},
+	}
+
+	r, err := toUpstreamRequest("gpt-4o", req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := json.Marshal(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expect := `{"model":"gpt-4o","messages":[{"role":"user","content":"weather?"},{"role":"assistant","content":"","tool_calls":[{"id":"call_1_0","index":0,"type":"function","function":{"name":"weather","arguments":"{\"city\":\"Paris\"}"}}]},{"role":"tool","content":"sunny","tool_call_id":"call_1_0"}],"stream":true,"stream_options":{"include_usage":true},"max_tokens":10,"temperature":0.5,"response_format":{"type":"json_object"}}`
+	if diff := cmp.Diff(string(b), expect); diff != "" {
+		t.Errorf("mismatch (-got +want):\n%s", diff)
+	}
+
+	req.Format = json.RawMessage(`"yaml"`)
+	if _, err := toUpstreamRequest("gpt-4o", req); err == nil {
+		t.Error("expected an error for an invalid format")
+	}
+
+	req.Format = nil
+	req.Options = map[string]any{"ban": []any{"foo"}}
+	if _, err := toUpstreamRequest("gpt-4o", req); err == nil {
+		t.Error("expected an error for banned strings")
+	}
+
+	req.Options = map[string]any{"logit_bias": map[string]any{"128001": -100}}
+	if _, err := toUpstreamRequest("gpt-4o", req); err == nil {
+		t.Error("expected an error for logit biases")
+	}
+}
+
+func TestProxyChat(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+	t.Setenv("UPSTREAM_KEY", "secret")
+
+	usage = usageMetrics{}
+	t.Cleanup(func() { usage = usageMetrics{} })
+
+	var got map[string]any
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/chat/completions" || r.Header.Get("Authorization") != "Bearer secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprint(w, `{"error": {"message": "invalid key", "type": "invalid_request_error"}}`)
+			return
+		}
+
+		if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+			t.Error(err)
+		}
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		for _, chunk := range []string{
+			`{"choices": [{"index": 0, "delta": {"role": "assistant", "content": "Hello"}}]}`,
+			`{"choices": [{"index": 0, "delta": {"content": " world"}}]}`,
+			`{"choices": [{"index": 0, "delta": {"tool_calls": [{"index": 0, "id": "call_1", "type": "function", "function": {"name": "weather", "arguments": "{\"city\":"}}]}}]}`,
+			`{"choices": [{"index": 0, "delta": {"tool_calls": [{"index": 0, "function": {"arguments": "\"Paris\"}"}}]}, "finish_reason": "tool_calls"}]}`,
+			`{"choices": [], "usage": {"prompt_tokens": 12, "completion_tokens": 5, "total_tokens": 17}}`,
+			`[DONE]`,
+		} {
+			fmt.Fprintf(w, "data: %s\n\n", chunk)
+		}
+	}))
+	defer ts.Close()
+
+	var s Server
+	s.cfg.Store(&serverConfig{upstreams: upstreams{{Models: []string{"openai/*"}, URL: ts.URL + "/v1/", APIKeyEnv: "UPSTREAM_KEY"}}})
+
+	t.Run("streaming", func(t *testing.T) {
+		w := createRequest(t, s.ChatHandler, api.ChatRequest{Model: "openai/gpt-4o", Messages: []api.Message{{Role: "user", Content: "Hi"}}})
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status code 200, actual %d: %s", w.Code, w.Body)
+		}
+
+		if got["model"] != "gpt-4o" || got["stream"] != true {
+			t.Errorf("unexpected upstream request %v", got)
+		}
+
+		var contents []string
+		var last api.ChatResponse
+		scanner := bufio.NewScanner(w.Body)
+		for scanner.Scan() {
+			var resp api.ChatResponse
+			if err := json.Unmarshal(scanner.Bytes(), &resp); err != nil {
+				t.Fatal(err)
+			}
+
+			contents = append(contents, resp.Message.Content)
+			last = resp
+		}
+
+		if diff := cmp.Diff(contents, []string{"Hello", " world", ""}); diff != "" {
+			t.Errorf("mismatch (-got +want):\n%s", diff)
+		}
+
+		if !last.Done || last.DoneReason != "stop" || last.PromptEvalCount != 12 || last.EvalCount != 5 || last.Model != "openai/gpt-4o" {
+			t.Errorf("unexpected last response %+v", last)
+		}
+
+		expect := []api.ToolCall{{Function: api.ToolCallFunction{Name: "weather", Arguments: api.ToolCallFunctionArguments{"city": "Paris"}}}}
+		if diff := cmp.Diff(last.Message.ToolCalls, expect); diff != "" {
+			t.Errorf("mismatch (-got +want):\n%s", diff)
+		}
+	})
+
+	t.Run("not streaming", func(t *testing.T) {
+		w := createRequest(t, s.ChatHandler, api.ChatRequest{Model: "openai/gpt-4o", Messages: []api.Message{{Role: "user", Content: "Hi"}}, Stream: &stream})
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status code 200, actual %d: %s", w.Code, w.Body)
+		}
+
+		var resp api.ChatResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+
+		if resp.Message.Content != "Hello world" || !resp.Done {
+			t.Errorf("unexpected response %+v", resp)
+		}
+	})
+
+	t.Run("usage", func(t *testing.T) {
+		stats := usage.models[usageKey{model: "openai/gpt-4o:latest"}]
+		if stats == nil || stats.requests != 2 || stats.promptTokens != 24 || stats.evalTokens != 10 {
+			t.Errorf("unexpected usage %+v", stats)
+		}
+	})
+
+	t.Run("tenants", func(t *testing.T) {
+		chat := func(tn *tenant) int {
+			t.Helper()
+			if err := tn.init(tn.name); err != nil {
+				t.Fatal(err)
+			}
+
+			as := func(c *gin.Context) {
+				c.Request = c.Request.WithContext(context.WithValue(context.Background(), tenantKey{}, tn))
+				s.ChatHandler(c)
+			}
+
+			return createRequest(t, as, api.ChatRequest{Model: "openai/gpt-4o", Messages: []api.Message{{Role: "user", Content: "Hi"}}, Stream: &stream}).Code
+		}
+
+		if code := chat(&tenant{name: "team-a"}); code != http.StatusForbidden {
+			t.Errorf("expected status 403 without access to the upstream, got %d", code)
+		}
+
+		if code := chat(&tenant{name: "team-b", Upstreams: []string{"openai/*"}}); code != http.StatusOK {
+			t.Errorf("expected status 200, got %d", code)
+		}
+	})
+
+	t.Run("invalid tool call index", func(t *testing.T) {
+		for _, index := range []int{-1, 1, 1 << 30} {
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "text/event-stream")
+				fmt.Fprintf(w, "data: %s\n\n", fmt.Sprintf(`{"choices": [{"index": 0, "delta": {"tool_calls": [{"index": %d, "function": {"name": "weather"}}]}}]}`, index))
+			}))
+			defer ts.Close()
+
+			var s Server
+			s.cfg.Store(&serverConfig{upstreams: upstreams{{Models: []string{"openai/*"}, URL: ts.URL}}})
+
+			w := createRequest(t, s.ChatHandler, api.ChatRequest{Model: "openai/gpt-4o", Messages: []api.Message{{Role: "user", Content: "Hi"}}, Stream: &stream})
+			if w.Code != http.StatusBadGateway || !strings.Contains(w.Body.String(), "invalid tool call index") {
+				t.Errorf("index %d: expected an invalid tool call index error, got %d: %s", index, w.Code, w.Body)
+			}
+		}
+	})
+
+	t.Run("upstream error", func(t *testing.T) {
+		t.Setenv("UPSTREAM_KEY", "wrong")
+		w := createRequest(t, s.ChatHandler, api.ChatRequest{Model: "openai/gpt-4o", Messages: []api.Message{{Role: "user", Content: "Hi"}}, Stream: &stream})
+		if w.Code != http.StatusBadGateway {
+			t.Fatalf("expected status code 502, actual %d", w.Code)
+		}
+	})
+}
@@ -12,6 +12,7 @@ import (
 	"sync"
 	"text/template"
 	"text/template/parse"
+	"time"
 
 	"github.com/agnivade/levenshtein"
 	"golang.org/x/exp/maps"
@@ -95,6 +96,10 @@ var DefaultTemplate, _ = Parse("{{ .Prompt }}")
 type Template struct {
 	*template.Template
 	raw string
+
+	// positionalSystem is set for templates that handle system messages in
+	// Messages themselves, which then only get the leading ones as System
+	positionalSystem bool
 }
 
 // response is a template node that can be added to templates that don't already have one
@@ -116,11 +121,69 @@ var response = parse.ActionNode{
 	},
 }
 
+// funcs are the functions templates can call besides the builtin functions
+// of text/template. Those that take a value to operate on take it last, so
+// it can be piped to them: {{ .Content | trim | indent 2 }}
 var funcs = template.FuncMap{
 	"json": func(v any) string {
 		b, _ := json.Marshal(v)
 		return string(b)
 	},
+	"jsonIndent": func(v any) string {
+		b, _ := json.MarshalIndent(v, "", "  ")
+		return string(b)
+	},
+	"now": time.Now,
+	"date": func(layout string, t time.Time) string {
+		return t.Format(layout)
+	},
+	"trim":  strings.TrimSpace,
+	"upper": strings.ToUpper,
+	"lower": strings.ToLower,
+	"replace": func(old, new, s string) string {
+		return strings.ReplaceAll(s, old, new)
+	},
+	"contains": func(substr, s string) bool {
+		return strings.Contains(s, substr)
+	},
+	"hasPrefix": func(prefix, s string) bool {
+		return strings.HasPrefix(s, prefix)
+	},
+	"hasSuffix": func(suffix, s string) bool {
+		return strings.HasSuffix(s, suffix)
+	},
+	"split": func(sep, s string) []string {
+		return strings.Split(s, sep)
+	},
+	"join": func(sep string, elems []string) string {
+		return strings.Join(elems, sep)
+	},
+	"indent": func(n int, s string) string {
+		pad := strings.Repeat(" ", n)
+		return pad + strings.ReplaceAll(s, "\n", "\n"+pad)
+	},
+	// default returns v, or d if v is empty
+	"default": func(d, v any) any {
+		if truth, _ := template.IsTrue(v); !truth {
+			return d
+		}
+		return v
+	},
+	// tokens estimates the number of tokens in s, unless it's executed with
+	// the model's tokenizer in Values
+	"tokens": func(s string) int {
+		return (len(s) + 3) / 4
+	},
+	"hasTool": func(name string, tools api.Tools) bool {
+		return slices.ContainsFunc(tools, func(t api.Tool) bool { return t.Function.Name == name })
+	},
+	"toolNames": func(tools api.Tools) []string {
+		names := make([]string, len(tools))
+		for i, t := range tools {
+			names[i] = t.Function.Name
+		}
+		return names
+	},
 }
 
 func Parse(s string) (*Template, error) {
@@ -131,7 +194,7 @@ func Parse(s string) (*Template, error) {
 		return nil, err
 	}
 
-	t := Template{Template: tmpl, raw: s}
+	t := Template{Template: tmpl, raw: s, positionalSystem: mentions(tmpl.Tree.Root, "system")}
 	if vars := t.Vars(); !slices.Contains(vars, "messages") && !slices.Contains(vars, "response") {
 		// touch up the template and append {{ .Response }}
 		tmpl.Tree.Root.Nodes = append(tmpl.Tree.Root.Nodes, &response)
@@ -168,6 +231,10 @@ type Values struct {
 	Prompt string
 	Suffix string
 
+	// Tokenize counts the tokens in a string with the model's tokenizer for
+	// the tokens function, which estimates them without it
+	Tokenize func(string) (int, error)
+
 	// forceLegacy is a flag used to test compatibility with legacy templates
 	forceLegacy bool
 }
@@ -218,16 +285,35 @@ func (t *Template) Subtree(fn func(parse.Node) bool) *template.Template {
 	return nil
 }
 
+// funcs returns the functions that replace those in funcs for v
+func (v Values) funcs() template.FuncMap {
+	if v.Tokenize == nil {
+		return nil
+	}
+
+	return template.FuncMap{"tokens": v.Tokenize}
+}
+
 func (t *Template) Execute(w io.Writer, v Values) error {
-	system, messages := collate(v.Messages)
+	tmpl := t.Template
+	if fns := v.funcs(); fns != nil {
+		// the template is shared, so its functions are only replaced in a copy
+		var err error
+		if tmpl, err = tmpl.Clone(); err != nil {
+			return err
+		}
+		tmpl.Funcs(fns)
+	}
+
+	system, messages := collate(v.Messages, t.positionalSystem)
 	if v.Prompt != "" && v.Suffix != "" {
-		return t.Template.Execute(w, map[string]any{
+		return tmpl.Execute(w, map[string]any{
 			"Prompt":   v.Prompt,
 			"Suffix":   v.Suffix,
 			"Response": "",
 		})
 	} else if !v.forceLegacy && slices.Contains(t.Vars(), "messages") {
-		return t.Template.Execute(w, map[string]any{
+		return tmpl.Execute(w, map[string]any{
 			"System":   system,
 			"Messages": messages,
 			"Tools":    v.Tools,
@@ -240,7 +326,7 @@ func (t *Template) Execute(w io.Writer, v Values) error {
 	var prompt, response string
 	for _, m := range messages {
 		execute := func() error {
-			if err := t.Template.Execute(&b, map[string]any{
+			if err := tmpl.Execute(&b, map[string]any{
 				"System":   system,
 				"Prompt":   prompt,
 				"Response": response,
@@ -285,7 +371,7 @@ func (t *Template) Execute(w io.Writer, v Values) error {
 	})
 
 	tree := parse.Tree{Root: nodes.(*parse.ListNode)}
-	if err := template.Must(template.New("").AddParseTree("", &tree)).Execute(&b, map[string]any{
+	if err := template.Must(template.New("").Funcs(funcs).Funcs(v.funcs()).AddParseTree("", &tree)).Execute(&b, map[string]any{
 		"System":   system,
 		"Prompt":   prompt,
 		"Response": response,
@@ -298,14 +384,19 @@ func (t *Template) Execute(w io.Writer, v Values) error {
 }
 
 // collate messages based on role. consecutive messages of the same role are merged
-// into a single message. collate also collects and returns all system messages.
+// into a single message. collate also collects and returns all system messages, or
+// with leading, only those before the first message of another role so the rest
+// stay where they are in the conversation.
 // collate mutates message content adding image tags ([img-%d]) as needed
-func collate(msgs []api.Message) (string, []*api.Message) {
+func collate(msgs []api.Message, leading bool) (string, []*api.Message) {
 	var system []string
 	var collated []*api.Message
+	var started bool
 	for i := range msgs {
 		msg := msgs[i]
-		if msg.Role == "system" {
+		if msg.Role != "system" {
+			started = true
+		} else if !leading || !started {
 			system = append(system, msg.Content)
 		}
 
@@ -364,6 +455,45 @@ func Identifiers(n parse.Node) []string {
 	return nil
 }
 
+// mentions reports whether the template compares anything with the string
+// literal s, such as a message role, anywhere in the tree under n
+func mentions(n parse.Node, s string) bool {
+	switch n := n.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return false
+		}
+
+		return slices.ContainsFunc(n.Nodes, func(n parse.Node) bool { return mentions(n, s) })
+	case *parse.ActionNode:
+		return mentions(n.Pipe, s)
+	case *parse.TemplateNode:
+		return mentions(n.Pipe, s)
+	case *parse.BranchNode:
+		return mentions(n.Pipe, s) || mentions(n.List, s) || mentions(n.ElseList, s)
+	case *parse.IfNode:
+		return mentions(&n.BranchNode, s)
+	case *parse.RangeNode:
+		return mentions(&n.BranchNode, s)
+	case *parse.WithNode:
+		return mentions(&n.BranchNode, s)
+	case *parse.PipeNode:
+		if n == nil {
+			return false
+		}
+
+		for _, c := range n.Cmds {
+			if slices.ContainsFunc(c.Args, func(a parse.Node) bool { return mentions(a, s) }) {
+				return true
+			}
+		}
+	case *parse.StringNode:
+		return n.Text == s
+	}
+
+	return false
+}
+
 // deleteNode walks the node list and deletes nodes that match the predicate
 // this is currently to remove the {{ .Response }} node from templates
 func deleteNode(n parse.Node, fn func(parse.Node) bool) parse.Node {
@@ -342,6 +342,76 @@ What is your name?<|im_end|>
 	}
 }
 
+func TestExecuteWithSystemMessages(t *testing.T) {
+	msgs := []api.Message{
+		{Role: "system", Content: "You are a helpful assistant."},
+		{Role: "user", Content: "Hello friend!"},
+		{Role: "assistant", Content: "Hello human!"},
+		{Role: "system", Content: "Answer with the weather tool."},
+		{Role: "user", Content: "Is it raining?"},
+	}
+
+	cases := []struct {
+		name     string
+		template string
+		expected string
+	}{
+		{
+			// templates that handle system messages get the later ones in place
+			"positional",
+			`{{- if .System }}<|system|>{{ .System }}
+{{ end }}
+{{- range $i, $_ := .Messages }}
+{{- if eq .Role "system" }}{{ if $i }}<|system|>{{ .Content }}
+{{ end }}
+{{- else }}<|{{ .Role }}|>{{ .Content }}
+{{ end }}
+{{- end }}<|assistant|>`,
+			`<|system|>You are a helpful assistant.
+<|user|>Hello friend!
+<|assistant|>Hello human!
+<|system|>Answer with the weather tool.
+<|user|>Is it raining?
+<|assistant|>`,
+		},
+		{
+			// other templates get every system message at the front
+			"leading",
+			`{{- if .System }}<|system|>{{ .System }}
+{{ end }}
+{{- range .Messages }}
+{{- if or (eq .Role "user") (eq .Role "assistant") }}<|{{ .Role }}|>{{ .Content }}
+{{ end }}
+{{- end }}<|assistant|>`,
+			`<|system|>You are a helpful assistant.
+
+Answer with the weather tool.
+<|user|>Hello friend!
+<|assistant|>Hello human!
+<|user|>Is it raining?
+<|assistant|>`,
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			tmpl, err := Parse(tt.template)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var b bytes.Buffer
+			if err := tmpl.Execute(&b, Values{Messages: msgs}); err != nil {
+				t.Fatal(err)
+			}
+
+			if diff := cmp.Diff(b.String(), tt.expected); diff != "" {
+				t.Errorf("mismatch (-got +want):\n%s", diff)
+			}
+		})
+	}
+}
+
 func TestExecuteWithSuffix(t *testing.T) {
 	tmpl, err := Parse(`{{- if .Suffix }}<PRE> {{ .Prompt }} <SUF>{{ .Suffix }} <MID>
 {{- else }}{{ .Prompt }}
@@ -376,3 +446,61 @@ func TestExecuteWithSuffix(t *testing.T) {
 		})
 	}
 }
+
+func TestFuncs(t *testing.T) {
+	var weather api.Tool
+	weather.Function.Name = "get_weather"
+	weather.Function.Parameters.Type = "object"
+	weather.Function.Parameters.Required = []string{"city"}
+
+	var search api.Tool
+	search.Function.Name = "search"
+
+	values := Values{
+		Messages: []api.Message{{Role: "user", Content: "  Hello,\nWorld  "}},
+		Tools:    api.Tools{weather, search},
+	}
+
+	cases := []struct {
+		name     string
+		template string
+		values   Values
+		expect   string
+	}{
+		{"string utilities", `{{ range .Messages }}{{ .Content | trim | replace "World" "there" | upper | indent 2 }}{{ end }}`, values, "  HELLO,\n  THERE"},
+		{"split and join", `{{ range .Messages }}{{ .Content | trim | split "\n" | join " " | lower }}{{ end }}`, values, "hello, world"},
+		{"string tests", `{{ range .Messages }}{{ contains "World" .Content }} {{ hasPrefix "Hello" .Content }} {{ hasSuffix "  " .Content }}{{ end }}`, values, "true false true"},
+		{"json", `{{ range .Messages }}{{ end }}{{ range .Tools }}{{ if eq .Function.Name "get_weather" }}{{ jsonIndent .Function.Parameters.Required }}{{ end }}{{ end }}`, values, "[\n  \"city\"\n]"},
+		{"tools", `{{ range .Messages }}{{ end }}{{ if hasTool "search" .Tools }}{{ toolNames .Tools | join ", " }}{{ end }}{{ if hasTool "calculator" .Tools }} calculator{{ end }}`, values, "get_weather, search"},
+		{"default", `{{ range .Messages }}{{ .Content | trim }}{{ end }} {{ .System | default "You are a helpful assistant." }}`, values, "Hello,\nWorld You are a helpful assistant."},
+		{"date", `{{ $d := now | date "2006" }}{{ if ge (len $d) 4 }}ok{{ end }}`, values, "ok"},
+		{"estimated tokens", `{{ range .Messages }}{{ tokens .Content }}{{ end }}`, values, "4"},
+		{"tokens", `{{ range .Messages }}{{ tokens .Content }}{{ end }}`, Values{
+			Messages: values.Messages,
+			Tokenize: func(s string) (int, error) { return len(strings.Fields(s)), nil },
+		}, "2"},
+		{"legacy", `{{ .Prompt | upper }} {{ tokens .Prompt }}`, Values{
+			Messages:    values.Messages,
+			Tokenize:    func(s string) (int, error) { return 7, nil },
+			forceLegacy: true,
+		}, "  HELLO,\nWORLD   7"},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			tmpl, err := Parse(tt.template)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var b bytes.Buffer
+			if err := tmpl.Execute(&b, tt.values); err != nil {
+				t.Fatal(err)
+			}
+
+			if diff := cmp.Diff(b.String(), tt.expect); diff != "" {
+				t.Errorf("mismatch (-got +want):\n%s", diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,203 @@
+package tokenizer
+
+import (
+	"container/heap"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+func (t *Tokenizer) parseBPE(f *file) error {
+	if err := json.Unmarshal(f.Model.Vocab, &t.vocab); err != nil {
+		return fmt.Errorf("vocab: %w", err)
+	}
+
+	// merges are either "a b" or, in newer files, ["a", "b"]
+	var merges []json.RawMessage
+	if len(f.Model.Merges) > 0 {
+		if err := json.Unmarshal(f.Model.Merges, &merges); err != nil {
+			return fmt.Errorf("merges: %w", err)
+		}
+	}
+
+	t.ranks = make(map[string]int, len(merges))
+	for i, m := range merges {
+		var merge string
+		if err := json.Unmarshal(m, &merge); err != nil {
+			var pair [2]string
+			if err := json.Unmarshal(m, &pair); err != nil {
+				return fmt.Errorf("merges: %w", err)
+			}
+
+			merge = pair[0] + " " + pair[1]
+		}
+
+		if _, ok := t.ranks[merge]; !ok {
+			t.ranks[merge] = i
+		}
+	}
+
+	t.ignoreMerges = f.Model.IgnoreMerges
+
+	switch p := f.PreTokenizer; {
+	case p == nil:
+		return fmt.Errorf("%w: no pre-tokenizer", ErrUnsupported)
+	case p.Type == "ByteLevel" && p.UseRegex:
+		t.split = splitGPT2
+	case p.Type == "Sequence" && len(p.PreTokenizers) == 2 &&
+		p.PreTokenizers[0].Type == "Split" && p.PreTokenizers[0].Pattern.Regex == Llama3Pattern &&
+		p.PreTokenizers[1].Type == "ByteLevel" && !p.PreTokenizers[1].UseRegex:
+		t.split = splitLlama3
+	default:
+		return fmt.Errorf("%w: %q pre-tokenizer", ErrUnsupported, p.Type)
+	}
+
+	return nil
+}
+
+// byteEncoding maps bytes to the characters that stand for them in a
+// byte-level vocabulary
+var byteEncoding = func() (m [256]string) {
+	n := 0
+	for b := range 256 {
+		if b >= '!' && b <= '~' || b >= 0xa1 && b <= 0xac || b >= 0xae {
+			m[b] = string(rune(b))
+		} else {
+			m[b] = string(rune(256 + n))
+			n++
+		}
+	}
+
+	return m
+}()
+
+// merge is a pair of adjacent symbols which can be merged
+type merge struct {
+	left, right int
+	text        string
+	rank        int
+}
+
+// merges is a queue of merges, lowest rank first
+type merges []merge
+
+func (q merges) Len() int { return len(q) }
+
+func (q merges) Less(i, j int) bool {
+	if q[i].rank != q[j].rank {
+		return q[i].rank < q[j].rank
+	}
+
+	return q[i].left < q[j].left
+}
+
+func (q merges) Swap(i, j int) { q[i], q[j] = q[j], q[i] }
+
+func (q *merges) Push(x any) { *q = append(*q, x.(merge)) }
+
+func (q *merges) Pop() any {
+	old := *q
+	m := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return m
+}
+
+// symbol is a part of the text being encoded, linked to its neighbors
+type symbol struct {
+	text       string
+	prev, next int
+}
+
+// symbols splits s into a symbol for each character
+func symbols(s string) []symbol {
+	var syms []symbol
+	for i := 0; i < len(s); {
+		n := min(utf8Len(s[i]), len(s)-i)
+		syms = append(syms, symbol{text: s[i : i+n], prev: len(syms) - 1, next: len(syms) + 1})
+		i += n
+	}
+
+	if len(syms) > 0 {
+		syms[len(syms)-1].next = -1
+	}
+
+	return syms
+}
+
+func (t *Tokenizer) encodeBPE(tokens []int, s string) []int {
+	for _, word := range t.split(s) {
+		var sb strings.Builder
+		for _, r := range word {
+			var buf [utf8.UTFMax]byte
+			for _, b := range buf[:utf8.EncodeRune(buf[:], r)] {
+				sb.WriteString(byteEncoding[b])
+			}
+		}
+
+		encoded := sb.String()
+		if _, ok := t.vocab[encoded]; ok && t.ignoreMerges {
+			tokens = append(tokens, t.vocab[encoded])
+			continue
+		}
+
+		syms := symbols(encoded)
+
+		var q merges
+		push := func(left, right int) {
+			if left < 0 || right < 0 {
+				return
+			}
+
+			text := syms[left].text + syms[right].text
+			if rank, ok := t.ranks[syms[left].text+" "+syms[right].text]; ok {
+				heap.Push(&q, merge{left, right, text, rank})
+			}
+		}
+
+		for i := 1; i < len(syms); i++ {
+			push(i-1, i)
+		}
+
+		for q.Len() > 0 {
+			m := heap.Pop(&q).(merge)
+			left, right := &syms[m.left], &syms[m.right]
+
+			// skip merges of symbols which have since changed
+			if left.text == "" || right.text == "" || left.text+right.text != m.text {
+				continue
+			}
+
+			left.text += right.text
+			right.text = ""
+			left.next = right.next
+			if right.next >= 0 {
+				syms[right.next].prev = m.left
+			}
+
+			push(left.prev, m.left)
+			push(m.left, left.next)
+		}
+
+		for _, sym := range syms {
+			if sym.text == "" {
+				continue
+			}
+
+			if id, ok := t.vocab[sym.text]; ok {
+				tokens = append(tokens, id)
+				continue
+			}
+
+			// symbols without a token are left out, unless their bytes have
+			// tokens of their own
+			for i := range len(sym.text) {
+				if id, ok := t.vocab[sym.text[i:i+1]]; ok {
+					tokens = append(tokens, id)
+				}
+			}
+		}
+	}
+
+	return tokens
+}
@@ -0,0 +1,201 @@
+package tokenizer
+
+import "unicode"
+
+// runes is text being split by a pre-tokenizer. Its flags are those of
+// llama.cpp, which are false past the end of the text.
+type runes []rune
+
+func (r runes) at(i int) rune {
+	if i < len(r) {
+		return r[i]
+	}
+
+	return -1
+}
+
+func (r runes) letter(i int) bool { return i < len(r) && unicode.IsLetter(r[i]) }
+
+func (r runes) number(i int) bool { return i < len(r) && unicode.IsNumber(r[i]) }
+
+func (r runes) space(i int) bool { return i < len(r) && unicode.IsSpace(r[i]) }
+
+// other reports whether the rune at i is neither a letter, number nor
+// whitespace
+func (r runes) other(i int) bool { return i < len(r) && !r.letter(i) && !r.number(i) && !r.space(i) }
+
+// contraction returns the length of the contraction at i, such as 's, or 0.
+// Llama 3 matches contractions regardless of case.
+func (r runes) contraction(i int, fold bool) int {
+	lower := func(i int) rune {
+		if fold {
+			return unicode.ToLower(r.at(i))
+		}
+
+		return r.at(i)
+	}
+
+	if r.at(i) != '\'' || i+1 >= len(r) {
+		return 0
+	}
+
+	switch next := lower(i + 1); {
+	case next == 's' || next == 't' || next == 'm' || next == 'd':
+		return 2
+	case i+2 < len(r):
+		if after := lower(i + 2); next == 'r' && after == 'e' || next == 'v' && after == 'e' || next == 'l' && after == 'l' {
+			return 3
+		}
+	}
+
+	return 0
+}
+
+// splitter collects the pieces of the text
+type splitter struct {
+	r      runes
+	end    int
+	pieces []string
+}
+
+// add ends the current piece at end
+func (s *splitter) add(end int) {
+	if end > s.end {
+		s.pieces = append(s.pieces, string(s.r[s.end:end]))
+	}
+
+	s.end = end
+}
+
+// splitGPT2 splits s as the GPT-2 pattern does:
+//
+//	's|'t|'re|'ve|'m|'ll|'d| ?\p{L}+| ?\p{N}+| ?[^\s\p{L}\p{N}]+|\s+(?!\S)|\s+
+func splitGPT2(text string) []string {
+	r := runes(text)
+	s := splitter{r: r}
+	for pos := 0; pos < len(r); {
+		if n := r.contraction(pos, false); n > 0 {
+			pos += n
+			s.add(pos)
+			continue
+		}
+
+		// an optional space before letters, numbers or other characters
+		start := pos
+		if r[pos] == ' ' {
+			start++
+		}
+
+		if r.letter(start) || r.number(start) || r.other(start) {
+			class := r.letter
+			if r.number(start) {
+				class = r.number
+			} else if r.other(start) {
+				class = r.other
+			}
+
+			for pos = start; class(pos); pos++ {
+			}
+
+			s.add(pos)
+			continue
+		}
+
+		pos = s.spaces(pos)
+	}
+
+	return s.pieces
+}
+
+// splitLlama3 splits s as Llama3Pattern does
+func splitLlama3(text string) []string {
+	r := runes(text)
+	s := splitter{r: r}
+	for pos := 0; pos < len(r); {
+		if n := r.contraction(pos, true); n > 0 {
+			pos += n
+			s.add(pos)
+			continue
+		}
+
+		// [^\r\n\p{L}\p{N}]?\p{L}+
+		if c := r[pos]; c != '\r' && c != '\n' && !r.number(pos) && (r.letter(pos) || r.letter(pos+1)) {
+			for pos++; r.letter(pos); pos++ {
+			}
+
+			s.add(pos)
+			continue
+		}
+
+		// \p{N}{1,3}
+		if r.number(pos) {
+			for start := pos; r.number(pos); {
+				if pos++; pos-start >= 3 {
+					s.add(pos)
+					start = pos
+				}
+			}
+
+			s.add(pos)
+			continue
+		}
+
+		// ?[^\s\p{L}\p{N}]+[\r\n]*
+		start := pos
+		if r[pos] == ' ' {
+			start++
+		}
+
+		if r.other(start) || start == len(r) {
+			for pos = start; r.other(pos); pos++ {
+			}
+
+			for r.at(pos) == '\r' || r.at(pos) == '\n' {
+				pos++
+			}
+
+			s.add(pos)
+			continue
+		}
+
+		// \s*[\r\n]+
+		n, newline := 0, 0
+		for ; r.space(pos + n); n++ {
+			if c := r[pos+n]; c == '\r' || c == '\n' {
+				newline = pos + n + 1
+			}
+		}
+
+		if newline > 0 {
+			pos = newline
+			s.add(pos)
+			continue
+		}
+
+		pos = s.spaces(pos)
+	}
+
+	return s.pieces
+}
+
+// spaces splits the whitespace at pos as \s+(?!\S)|\s+ does, leaving the
+// last space before other text for it, and returns where it ends
+func (s *splitter) spaces(pos int) int {
+	n := 0
+	for s.r.space(pos + n) {
+		n++
+	}
+
+	switch {
+	case n > 1 && pos+n < len(s.r):
+		pos += n - 1
+	case n > 0:
+		pos += n
+	default:
+		// a character no pattern matches
+		pos++
+	}
+
+	s.add(pos)
+	return pos
+}
@@ -0,0 +1,140 @@
+package tokenizer
+
+import (
+	"container/heap"
+	"encoding/json"
+	"fmt"
+)
+
+func (t *Tokenizer) parseSPM(f *file) error {
+	if !f.Model.ByteFallback {
+		return fmt.Errorf("%w: Unigram model without byte fallback", ErrUnsupported)
+	}
+
+	var vocab [][2]any
+	if err := json.Unmarshal(f.Model.Vocab, &vocab); err != nil {
+		return fmt.Errorf("vocab: %w", err)
+	}
+
+	t.scores = make([]float32, len(vocab))
+	for i, v := range vocab {
+		piece, ok := v[0].(string)
+		score, ok2 := v[1].(float64)
+		if !ok || !ok2 {
+			return fmt.Errorf("vocab: invalid entry %d", i)
+		}
+
+		t.vocab[piece] = i
+		t.scores[i] = float32(score)
+	}
+
+	t.unk = f.Model.UnkID
+
+	// normalizers prepend a space to the text and replace spaces with ▁,
+	// which Encode does itself
+	if n := f.Normalizer; n != nil {
+		for _, n := range append([]normalizer{*n}, n.Normalizers...) {
+			if n.Type == "Prepend" && n.Prepend == "▁" {
+				t.spacePrefix = true
+			}
+		}
+	}
+
+	return nil
+}
+
+// pair is a pair of adjacent symbols which make up a token
+type pair struct {
+	left, right int
+	score       float32
+	size        int
+}
+
+// pairs is a queue of pairs, highest score first
+type pairs []pair
+
+func (q pairs) Len() int { return len(q) }
+
+func (q pairs) Less(i, j int) bool {
+	if q[i].score != q[j].score {
+		return q[i].score > q[j].score
+	}
+
+	return q[i].left < q[j].left
+}
+
+func (q pairs) Swap(i, j int) { q[i], q[j] = q[j], q[i] }
+
+func (q *pairs) Push(x any) { *q = append(*q, x.(pair)) }
+
+func (q *pairs) Pop() any {
+	old := *q
+	p := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return p
+}
+
+func (t *Tokenizer) encodeSPM(tokens []int, s string) []int {
+	syms := symbols(s)
+
+	var q pairs
+	push := func(left, right int) {
+		if left < 0 || right < 0 {
+			return
+		}
+
+		text := syms[left].text + syms[right].text
+		if id, ok := t.vocab[text]; ok {
+			heap.Push(&q, pair{left, right, t.scores[id], len(text)})
+		}
+	}
+
+	for i := 1; i < len(syms); i++ {
+		push(i-1, i)
+	}
+
+	for q.Len() > 0 {
+		p := heap.Pop(&q).(pair)
+		left, right := &syms[p.left], &syms[p.right]
+
+		// skip pairs of symbols which have since been merged
+		if left.text == "" || right.text == "" || len(left.text)+len(right.text) != p.size {
+			continue
+		}
+
+		left.text += right.text
+		right.text = ""
+		left.next = right.next
+		if right.next >= 0 {
+			syms[right.next].prev = p.left
+		}
+
+		push(left.prev, p.left)
+		push(p.left, left.next)
+	}
+
+	for i := 0; i >= 0 && i < len(syms); i = syms[i].next {
+		if id, ok := t.vocab[syms[i].text]; ok {
+			tokens = append(tokens, id)
+			continue
+		}
+
+		// characters without a token are encoded as their bytes
+		for j := range len(syms[i].text) {
+			tokens = append(tokens, t.byteToken(syms[i].text[j]))
+		}
+	}
+
+	return tokens
+}
+
+// byteToken returns the token of b, falling back to the byte as text
+func (t *Tokenizer) byteToken(b byte) int {
+	if id, ok := t.vocab[fmt.Sprintf("<0x%02X>", b)]; ok {
+		return id
+	} else if id, ok := t.vocab[string([]byte{b})]; ok {
+		return id
+	}
+
+	return t.unk
+}
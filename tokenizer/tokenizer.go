@@ -0,0 +1,263 @@
+// Package tokenizer encodes text into tokens with the tokenizer.json of a
+// model, as served by the server's files endpoint, the same way llama.cpp
+// does in the runner. It's written in Go alone so it can be built for
+// WebAssembly.
+package tokenizer
+
+import (
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// Llama3Pattern splits text for the llama-bpe pre-tokenizer, as in the
+// tokenizer.json of Llama 3
+const Llama3Pattern = `(?i:'s|'t|'re|'ve|'m|'ll|'d)|[^\r\n\p{L}\p{N}]?\p{L}+|\p{N}{1,3}| ?[^\s\p{L}\p{N}]+[\r\n]*|\s*[\r\n]+|\s+(?!\S)|\s+`
+
+// ErrUnsupported is returned for tokenizers this package can't encode text
+// for exactly as the model does
+var ErrUnsupported = errors.New("unsupported tokenizer")
+
+// special is a token matched in text before it's split, such as a control
+// token of the chat template
+type special struct {
+	id             int
+	content        string
+	lstrip, rstrip bool
+}
+
+// Tokenizer encodes text into the tokens of a BPE or SentencePiece
+// vocabulary
+type Tokenizer struct {
+	vocab   map[string]int
+	special []special
+
+	// bos and eos are added to text encoded with its special tokens, -1 if
+	// the model doesn't add them
+	bos, eos int
+
+	// split is the pre-tokenizer of a BPE vocabulary, nil for SentencePiece
+	split        func(string) []string
+	ranks        map[string]int
+	ignoreMerges bool
+
+	scores      []float32
+	unk         int
+	spacePrefix bool
+}
+
+type file struct {
+	AddedTokens []struct {
+		ID      int    `json:"id"`
+		Content string `json:"content"`
+		LStrip  bool   `json:"lstrip"`
+		RStrip  bool   `json:"rstrip"`
+	} `json:"added_tokens"`
+	Normalizer    *normalizer    `json:"normalizer"`
+	PreTokenizer  *preTokenizer  `json:"pre_tokenizer"`
+	PostProcessor *postProcessor `json:"post_processor"`
+	Model         struct {
+		Type         string          `json:"type"`
+		Vocab        json.RawMessage `json:"vocab"`
+		Merges       json.RawMessage `json:"merges"`
+		IgnoreMerges bool            `json:"ignore_merges"`
+		UnkID        int             `json:"unk_id"`
+		ByteFallback bool            `json:"byte_fallback"`
+	} `json:"model"`
+}
+
+type normalizer struct {
+	Type        string       `json:"type"`
+	Normalizers []normalizer `json:"normalizers"`
+	Prepend     string       `json:"prepend"`
+	Pattern     any          `json:"pattern"`
+	Content     string       `json:"content"`
+}
+
+type preTokenizer struct {
+	Type          string         `json:"type"`
+	PreTokenizers []preTokenizer `json:"pretokenizers"`
+	UseRegex      bool           `json:"use_regex"`
+	Pattern       struct {
+		Regex string `json:"Regex"`
+	} `json:"pattern"`
+}
+
+// piece is a special token or sequence of a template
+type piece struct {
+	ID string `json:"id"`
+}
+
+type postProcessor struct {
+	Type          string             `json:"type"`
+	Single        []map[string]piece `json:"single"`
+	SpecialTokens map[string]struct {
+		IDs []int `json:"ids"`
+	} `json:"special_tokens"`
+}
+
+// Parse reads a tokenizer.json for a BPE vocabulary split with the GPT-2 or
+// Llama 3 pre-tokenizer, or a SentencePiece vocabulary as a Unigram model
+// with byte fallback
+func Parse(b []byte) (*Tokenizer, error) {
+	var f file
+	if err := json.Unmarshal(b, &f); err != nil {
+		return nil, err
+	}
+
+	t := Tokenizer{vocab: make(map[string]int), bos: -1, eos: -1}
+	switch f.Model.Type {
+	case "BPE":
+		if err := t.parseBPE(&f); err != nil {
+			return nil, err
+		}
+	case "Unigram":
+		if err := t.parseSPM(&f); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("%w: %q model", ErrUnsupported, f.Model.Type)
+	}
+
+	for _, at := range f.AddedTokens {
+		if at.Content != "" {
+			t.special = append(t.special, special{at.ID, at.Content, at.LStrip, at.RStrip})
+		}
+	}
+
+	// longer tokens are matched first
+	slices.SortStableFunc(t.special, func(a, b special) int {
+		return cmp.Compare(len(b.content), len(a.content))
+	})
+
+	if p := f.PostProcessor; p != nil && p.Type == "TemplateProcessing" {
+		id := func(pieces map[string]piece) int {
+			if ids := p.SpecialTokens[pieces["SpecialToken"].ID].IDs; len(ids) > 0 {
+				return ids[0]
+			}
+
+			return -1
+		}
+
+		// tokens before the sequence are added at the start and those after
+		// it at the end
+		for i, piece := range p.Single {
+			if _, ok := piece["Sequence"]; ok {
+				if i > 0 {
+					t.bos = id(p.Single[i-1])
+				}
+
+				if i+1 < len(p.Single) {
+					t.eos = id(p.Single[i+1])
+				}
+			}
+		}
+	}
+
+	return &t, nil
+}
+
+// Encode returns the tokens of s. Special tokens in s, such as those of a
+// chat template, are encoded as themselves, and addSpecial adds the tokens
+// the model adds to prompts, such as BOS.
+func (t *Tokenizer) Encode(s string, addSpecial bool) []int {
+	tokens := []int{}
+	if addSpecial && t.bos >= 0 {
+		tokens = append(tokens, t.bos)
+	}
+
+	prevSpecial := true
+	for _, f := range t.partition(s) {
+		switch {
+		case f.text == "":
+			tokens = append(tokens, f.token)
+			prevSpecial = true
+		case t.split != nil:
+			tokens = t.encodeBPE(tokens, f.text)
+		default:
+			// SentencePiece adds a space after special tokens as well as at
+			// the start of the text
+			text := f.text
+			if t.spacePrefix && prevSpecial {
+				text = " " + text
+			}
+
+			tokens = t.encodeSPM(tokens, strings.ReplaceAll(text, " ", "▁"))
+			prevSpecial = false
+		}
+	}
+
+	if addSpecial && t.eos >= 0 {
+		tokens = append(tokens, t.eos)
+	}
+
+	return tokens
+}
+
+// fragment is either text yet to be encoded, or a special token
+type fragment struct {
+	text  string
+	token int
+}
+
+// asciiSpace is the whitespace stripped around special tokens
+const asciiSpace = " \t\n\v\f\r"
+
+// partition splits s at its special tokens
+func (t *Tokenizer) partition(s string) []fragment {
+	if s == "" {
+		return nil
+	}
+
+	fragments := []fragment{{text: s}}
+	for _, sp := range t.special {
+		var next []fragment
+		for _, f := range fragments {
+			if f.text == "" {
+				next = append(next, f)
+				continue
+			}
+
+			text := f.text
+			for {
+				i := strings.Index(text, sp.content)
+				if i < 0 {
+					break
+				}
+
+				left := text[:i]
+				if sp.lstrip {
+					left = strings.TrimRight(left, asciiSpace)
+				}
+
+				if left != "" {
+					next = append(next, fragment{text: left})
+				}
+
+				next = append(next, fragment{token: sp.id})
+
+				text = text[i+len(sp.content):]
+				if sp.rstrip {
+					text = strings.TrimLeft(text, asciiSpace)
+				}
+			}
+
+			if text != "" {
+				next = append(next, fragment{text: text})
+			}
+		}
+
+		fragments = next
+	}
+
+	return fragments
+}
+
+// utf8Len returns the length of the UTF-8 sequence starting with b, which
+// llama.cpp splits text into symbols by
+func utf8Len(b byte) int {
+	return [16]int{1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 2, 2, 3, 4}[b>>4]
+}
@@ -0,0 +1,197 @@
+package tokenizer
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+// bpe is a byte-level BPE tokenizer.json as served for a model, split with
+// preTokenizer
+func bpe(t *testing.T, preTokenizer any, ignoreMerges bool) []byte {
+	t.Helper()
+	b, err := json.Marshal(map[string]any{
+		"added_tokens": []map[string]any{
+			{"id": 0, "content": "<|begin_of_text|>", "special": true},
+			{"id": 1, "content": "<|eot_id|>", "special": true},
+		},
+		"pre_tokenizer": preTokenizer,
+		"post_processor": map[string]any{
+			"type": "TemplateProcessing",
+			"single": []any{
+				map[string]any{"SpecialToken": map[string]any{"id": "<|begin_of_text|>", "type_id": 0}},
+				map[string]any{"Sequence": map[string]any{"id": "A", "type_id": 0}},
+			},
+			"special_tokens": map[string]any{
+				"<|begin_of_text|>": map[string]any{"id": "<|begin_of_text|>", "ids": []int{0}},
+			},
+		},
+		"model": map[string]any{
+			"type": "BPE",
+			"vocab": map[string]int{
+				"<|begin_of_text|>": 0, "<|eot_id|>": 1,
+				"h": 2, "e": 3, "l": 4, "o": 5, "Ġ": 6, "w": 7, "r": 8, "d": 9, "1": 10, "2": 11,
+				"he": 12, "ll": 13, "hell": 14, "hello": 15, "Ġw": 16, "or": 17, "Ġwor": 18, "12": 19,
+				// a word which merges don't reach
+				"Ġworld": 20,
+			},
+			"merges":        []any{"h e", "l l", []string{"he", "ll"}, "hell o", "Ġ w", "o r", "Ġw or", "1 2"},
+			"ignore_merges": ignoreMerges,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return b
+}
+
+var llama3 = map[string]any{
+	"type": "Sequence",
+	"pretokenizers": []any{
+		map[string]any{"type": "Split", "pattern": map[string]string{"Regex": Llama3Pattern}, "behavior": "Isolated"},
+		map[string]any{"type": "ByteLevel", "use_regex": false},
+	},
+}
+
+func TestEncodeBPE(t *testing.T) {
+	tok, err := Parse(bpe(t, llama3, true))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name       string
+		text       string
+		addSpecial bool
+		expect     []int
+	}{
+		{"merges", "hello", false, []int{15}},
+		{"bos", "hello", true, []int{0, 15}},
+		{"ignore merges", "hello world", false, []int{15, 20}},
+		{"unmerged", "hello wor", false, []int{15, 18}},
+		{"numbers", "12121", false, []int{19, 10, 11, 10}},
+		{"special tokens", "hello<|eot_id|>hello", false, []int{15, 1, 15}},
+		{"unknown characters", "hé", false, []int{2}},
+		{"empty", "", true, []int{0}},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			if diff := cmp.Diff(tok.Encode(tt.text, tt.addSpecial), tt.expect); diff != "" {
+				t.Errorf("mismatch (-got +want):\n%s", diff)
+			}
+		})
+	}
+
+	t.Run("merge words", func(t *testing.T) {
+		tok, err := Parse(bpe(t, map[string]any{"type": "ByteLevel", "use_regex": true}, false))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if diff := cmp.Diff(tok.Encode("hello world", false), []int{15, 18, 4, 9}); diff != "" {
+			t.Errorf("mismatch (-got +want):\n%s", diff)
+		}
+	})
+
+	t.Run("unsupported pre-tokenizer", func(t *testing.T) {
+		_, err := Parse(bpe(t, map[string]any{"type": "Metaspace"}, false))
+		if !errors.Is(err, ErrUnsupported) {
+			t.Errorf("expected ErrUnsupported, got %v", err)
+		}
+	})
+}
+
+func TestEncodeSPM(t *testing.T) {
+	b, err := json.Marshal(map[string]any{
+		"added_tokens": []map[string]any{
+			{"id": 0, "content": "<unk>", "special": true},
+			{"id": 1, "content": "<s>", "special": true},
+			{"id": 2, "content": "</s>", "special": true},
+			{"id": 3, "content": "<|end|>", "special": true, "rstrip": true},
+		},
+		"normalizer": map[string]any{
+			"type": "Sequence",
+			"normalizers": []any{
+				map[string]string{"type": "Prepend", "prepend": "▁"},
+				map[string]string{"type": "Replace", "pattern": " ", "content": "▁"},
+			},
+		},
+		"post_processor": map[string]any{
+			"type": "TemplateProcessing",
+			"single": []any{
+				map[string]any{"Sequence": map[string]any{"id": "A", "type_id": 0}},
+				map[string]any{"SpecialToken": map[string]any{"id": "</s>", "type_id": 0}},
+			},
+			"special_tokens": map[string]any{
+				"</s>": map[string]any{"id": "</s>", "ids": []int{2}},
+			},
+		},
+		"model": map[string]any{
+			"type": "Unigram",
+			"vocab": [][2]any{
+				{"<unk>", 0}, {"<s>", 0}, {"</s>", 0}, {"<|end|>", 0}, {"<0xC3>", 0}, {"<0xA9>", 0},
+				{"▁", -1}, {"h", -1}, {"i", -1}, {"▁h", -2}, {"hi", -1},
+			},
+			"unk_id":        0,
+			"byte_fallback": true,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tok, err := Parse(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name       string
+		text       string
+		addSpecial bool
+		expect     []int
+	}{
+		// hi scores higher than ▁h, so it's merged first
+		{"scores", "hi", false, []int{6, 10}},
+		{"eos", "hi", true, []int{6, 10, 2}},
+		{"space prefix after special tokens", "hi<|end|>  hi", false, []int{6, 10, 3, 6, 10}},
+		{"byte fallback", "é", false, []int{6, 4, 5}},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			if diff := cmp.Diff(tok.Encode(tt.text, tt.addSpecial), tt.expect); diff != "" {
+				t.Errorf("mismatch (-got +want):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestSplit(t *testing.T) {
+	cases := []struct {
+		text         string
+		llama3, gpt2 []string
+	}{
+		{"Hello world", []string{"Hello", " world"}, []string{"Hello", " world"}},
+		{"I'M don't", []string{"I", "'M", " don", "'t"}, []string{"I", "'", "M", " don", "'t"}},
+		{"1234567", []string{"123", "456", "7"}, []string{"1234567"}},
+		{"a  b\n\n c", []string{"a", " ", " b", "\n\n", " c"}, []string{"a", " ", " b", "\n\n", " c"}},
+		{"x:\n\ty", []string{"x", ":\n", "\ty"}, []string{"x", ":", "\n", "\t", "y"}},
+		{"(日本語) ", []string{"(日本語", ")", " "}, []string{"(", "日本語", ")", " "}},
+		{"end.  ", []string{"end", ".", "  "}, []string{"end", ".", "  "}},
+	}
+
+	for _, tt := range cases {
+		if diff := cmp.Diff(splitLlama3(tt.text), tt.llama3); diff != "" {
+			t.Errorf("llama3 %q: mismatch (-got +want):\n%s", tt.text, diff)
+		}
+
+		if diff := cmp.Diff(splitGPT2(tt.text), tt.gpt2); diff != "" {
+			t.Errorf("gpt2 %q: mismatch (-got +want):\n%s", tt.text, diff)
+		}
+	}
+}